@@ -0,0 +1,111 @@
+// Package client 提供进程内使用 xmongodb 的 Go 接口
+// 直接调用 storage.Engine，不经过网络和 wire 协议；过滤条件、更新文档、排序和投影的语义与 wire 协议的命令处理相同
+package client
+
+import (
+	"context"
+
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// Client 嵌入式客户端
+type Client struct {
+	engine storage.Engine
+}
+
+// NewClient 创建操作指定存储引擎的客户端，引擎的启动和关闭由调用方负责
+func NewClient(engine storage.Engine) *Client {
+	return &Client{engine: engine}
+}
+
+// Database 返回指定名称的数据库，数据库在首次写入时自动创建
+func (c *Client) Database(name string) *Database {
+	return &Database{engine: c.engine, name: name}
+}
+
+// Database 嵌入式客户端的数据库
+type Database struct {
+	engine storage.Engine
+	name   string
+}
+
+// Name 返回数据库名
+func (d *Database) Name() string {
+	return d.name
+}
+
+// Collection 返回指定名称的集合，集合在首次写入时自动创建
+func (d *Database) Collection(name string) *Collection {
+	return &Collection{engine: d.engine, database: d.name, name: name}
+}
+
+// Collection 嵌入式客户端的集合
+type Collection struct {
+	engine   storage.Engine
+	database string
+	name     string
+}
+
+// Name 返回集合名
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// InsertOneResult InsertOne 的结果
+type InsertOneResult struct {
+	InsertedID interface{} // 插入文档的 _id，文档缺少 _id 时为生成的 ObjectId
+}
+
+// InsertOne 插入单个文档，doc 本身不会被修改
+func (c *Collection) InsertOne(ctx context.Context, doc storage.Document) (*InsertOneResult, error) {
+	inserted := make(storage.Document, len(doc)+1)
+	for key, value := range doc {
+		inserted[key] = value
+	}
+	if err := c.engine.Insert(ctx, c.database, c.name, []storage.Document{inserted}); err != nil {
+		return nil, err
+	}
+	return &InsertOneResult{InsertedID: inserted["_id"]}, nil
+}
+
+// FindOptions Find 的选项：排序、投影、skip、limit 和索引提示，与 find 命令的参数相同
+type FindOptions = storage.FindOptions
+
+// Find 返回满足过滤条件的文档，依次应用排序、skip、limit 和投影
+// filter 为 nil 时返回全部文档；skip 或 limit 为负数时返回 storage.ErrBadValue
+func (c *Collection) Find(ctx context.Context, filter storage.Document, opts ...FindOptions) ([]storage.Document, error) {
+	var o FindOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if filter == nil {
+		filter = storage.Document{}
+	}
+	return storage.FindDocuments(ctx, c.engine, c.database, c.name, filter, o)
+}
+
+// UpdateOne 更新第一个满足过滤条件的文档，update 可以是操作符更新或替换文档
+// upsert 为 true 且没有匹配文档时按过滤条件和更新文档插入新文档
+func (c *Collection) UpdateOne(ctx context.Context, filter, update storage.Document, upsert bool) (*storage.UpdateResult, error) {
+	if filter == nil {
+		filter = storage.Document{}
+	}
+	return c.engine.Update(ctx, c.database, c.name, filter, update, storage.UpdateOptions{Upsert: upsert})
+}
+
+// DeleteOne 删除第一个满足过滤条件的文档，返回删除的文档数
+func (c *Collection) DeleteOne(ctx context.Context, filter storage.Document) (int64, error) {
+	if filter == nil {
+		filter = storage.Document{}
+	}
+	return c.engine.Delete(ctx, c.database, c.name, filter, true)
+}
+
+// CountDocuments 返回满足过滤条件的文档数
+func (c *Collection) CountDocuments(ctx context.Context, filter storage.Document) (int64, error) {
+	docs, err := c.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(docs)), nil
+}
@@ -0,0 +1,137 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/client"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestCollection 测试嵌入式客户端对内存引擎的增删改查
+func TestCollection(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	if err := engine.Start(); err != nil {
+		t.Fatalf("启动引擎失败: %v", err)
+	}
+	defer engine.Stop()
+
+	users := client.NewClient(engine).Database("app").Collection("users")
+
+	t.Run("InsertOne", func(t *testing.T) {
+		doc := storage.Document{"name": "Alice", "age": int32(30)}
+		result, err := users.InsertOne(ctx, doc)
+		if err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		if _, ok := result.InsertedID.(storage.ObjectID); !ok {
+			t.Errorf("缺少 _id 时应生成 ObjectId: %#v", result.InsertedID)
+		}
+		if _, ok := doc["_id"]; ok {
+			t.Error("InsertOne 不应修改传入的文档")
+		}
+
+		for i, name := range []string{"Bob", "Carol", "Dave"} {
+			result, err := users.InsertOne(ctx, storage.Document{"_id": int32(i + 1), "name": name, "age": int32(20 + i*15)})
+			if err != nil {
+				t.Fatalf("插入失败: %v", err)
+			}
+			if result.InsertedID != int32(i+1) {
+				t.Errorf("InsertedID = %v, want %d", result.InsertedID, i+1)
+			}
+		}
+		if _, err := users.InsertOne(ctx, storage.Document{"_id": int32(1)}); !errors.Is(err, storage.ErrDuplicateKey) {
+			t.Errorf("重复的 _id 应返回 ErrDuplicateKey, got %v", err)
+		}
+	})
+
+	t.Run("Find", func(t *testing.T) {
+		docs, err := users.Find(ctx, storage.Document{"age": storage.Document{"$gte": int32(30)}}, client.FindOptions{
+			Sort:       storage.Document{"age": -1},
+			Projection: storage.Document{"name": 1, "_id": 0},
+		})
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(docs) != 3 || docs[0]["name"] != "Dave" || docs[2]["name"] != "Alice" {
+			t.Fatalf("按 age 降序的结果不正确: %v", docs)
+		}
+		if len(docs[0]) != 1 {
+			t.Errorf("投影后应只有 name 字段: %v", docs[0])
+		}
+
+		docs, err = users.Find(ctx, nil, client.FindOptions{Sort: storage.Document{"age": 1}, Skip: 1, Limit: 2})
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(docs) != 2 || docs[0]["name"] != "Alice" || docs[1]["name"] != "Carol" {
+			t.Errorf("skip/limit 的结果不正确: %v", docs)
+		}
+
+		if _, err := users.Find(ctx, storage.Document{"age": storage.Document{"$bogus": 1}}); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("未知操作符应返回 ErrBadValue, got %v", err)
+		}
+		for _, opts := range []client.FindOptions{{Skip: -1}, {Limit: -1}} {
+			if _, err := users.Find(ctx, nil, opts); !errors.Is(err, storage.ErrBadValue) {
+				t.Errorf("负数的 skip/limit 应返回 ErrBadValue: %+v, got %v", opts, err)
+			}
+		}
+		if _, err := users.Find(ctx, nil, client.FindOptions{Hint: &storage.Hint{IndexName: "missing_1"}}); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("提示不存在的索引应返回 ErrBadValue, got %v", err)
+		}
+	})
+
+	t.Run("UpdateOne", func(t *testing.T) {
+		result, err := users.UpdateOne(ctx, storage.Document{"age": storage.Document{"$lt": int32(40)}}, storage.Document{"$inc": storage.Document{"age": int32(1)}}, false)
+		if err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		if result.Matched != 1 || result.Modified != 1 {
+			t.Errorf("UpdateOne 应只更新一个文档: %+v", result)
+		}
+
+		result, err = users.UpdateOne(ctx, storage.Document{"_id": int32(9)}, storage.Document{"$set": storage.Document{"name": "Eve"}}, true)
+		if err != nil {
+			t.Fatalf("upsert 失败: %v", err)
+		}
+		if result.UpsertedID != int32(9) {
+			t.Errorf("upsert 应插入 _id 为 9 的文档: %+v", result)
+		}
+		docs, err := users.Find(ctx, storage.Document{"_id": int32(9)})
+		if err != nil || len(docs) != 1 || docs[0]["name"] != "Eve" {
+			t.Errorf("upsert 插入的文档不正确: %v, %v", docs, err)
+		}
+	})
+
+	t.Run("DeleteOne 与 CountDocuments", func(t *testing.T) {
+		n, err := users.CountDocuments(ctx, nil)
+		if err != nil || n != 5 {
+			t.Fatalf("CountDocuments = %d, %v, want 5", n, err)
+		}
+		deleted, err := users.DeleteOne(ctx, storage.Document{"age": storage.Document{"$gte": int32(30)}})
+		if err != nil || deleted != 1 {
+			t.Fatalf("DeleteOne = %d, %v, want 1", deleted, err)
+		}
+		if n, _ := users.CountDocuments(ctx, nil); n != 4 {
+			t.Errorf("删除后应剩 4 个文档, got %d", n)
+		}
+		if n, _ := users.CountDocuments(ctx, storage.Document{"name": "Nobody"}); n != 0 {
+			t.Errorf("没有匹配文档时应返回 0, got %d", n)
+		}
+
+		// 不存在的集合不报错
+		missing := client.NewClient(engine).Database("app").Collection("missing")
+		if n, err := missing.CountDocuments(ctx, nil); err != nil || n != 0 {
+			t.Errorf("不存在的集合应返回 0, got %d, %v", n, err)
+		}
+		if deleted, err := missing.DeleteOne(ctx, nil); err != nil || deleted != 0 {
+			t.Errorf("不存在的集合删除应返回 0, got %d, %v", deleted, err)
+		}
+	})
+}
@@ -24,6 +24,12 @@ type ServerConfig struct {
 	BaseDir     string `mapstructure:"base_dir"`
 	User        string `mapstructure:"user"`
 	ProfilePort int    `mapstructure:"profile_port"`
+
+	MaxOpenCursors       int `mapstructure:"max_open_cursors"`        // 服务端同时打开的游标数上限，0 表示不限制
+	MaxCursorsPerSession int `mapstructure:"max_cursors_per_session"` // 每个逻辑会话同时打开的游标数上限，0 表示不限制
+
+	CursorDefaultBatchSize int `mapstructure:"cursor_default_batch_size"` // find/aggregate 未指定 batchSize 时首批返回的文档数，0 表示默认值 101
+	CursorTimeoutMS        int `mapstructure:"cursor_timeout_ms"`         // 游标空闲超过该时长(毫秒)后被回收，0 表示不回收
 }
 
 // NetworkConfig 网络配置
@@ -34,8 +40,19 @@ type NetworkConfig struct {
 	TCPWriteTimeout   string `mapstructure:"tcp_write_timeout"`
 	MaxMsgLen         int    `mapstructure:"max_msg_len"`
 	CompressEncoding  bool   `mapstructure:"compress_encoding"`
+	ChecksumEnabled   bool   `mapstructure:"checksum_enabled"`
 	MaxConnections    int    `mapstructure:"max_connections"`
 	ConnectionTimeout string `mapstructure:"connection_timeout"`
+	IdleTimeout       string `mapstructure:"idle_timeout"` // 空闲会话超时，超时后由 OnCron 关闭，0 表示不限制
+
+	// ReplyDocumentSequence 较大的 firstBatch/nextBatch 以 OP_MSG kind 1 文档序列返回
+	// 部分驱动会忽略回复中的文档序列，只应在确认客户端支持时开启
+	ReplyDocumentSequence bool `mapstructure:"reply_document_sequence"`
+
+	// 命令限流：按令牌桶限制每秒执行的命令数，超出时返回可重试的错误，默认关闭
+	RateLimitEnabled       bool `mapstructure:"rate_limit_enabled"`
+	RateLimitPerConnection int  `mapstructure:"rate_limit_per_connection"` // 每个连接每秒允许的命令数，0 表示不限制
+	RateLimitGlobal        int  `mapstructure:"rate_limit_global"`         // 所有连接合计每秒允许的命令数，0 表示不限制
 }
 
 // StorageConfig 存储配置
@@ -43,11 +60,15 @@ type StorageConfig struct {
 	Engine          string `mapstructure:"engine"`
 	JournalEnabled  bool   `mapstructure:"journal_enabled"`
 	OplogSizeMB     int    `mapstructure:"oplog_size_mb"`
-	CacheSizeGB     int    `mapstructure:"cache_size_gb"`
+	CacheSizeGB     int    `mapstructure:"cache_size_gb"` // 缓存大小(GB)，大于 0 时优先于 wired_tiger_cache
 	DirectoryForDB  string `mapstructure:"directory_for_db"`
 	SyncPeriodSecs  int    `mapstructure:"sync_period_secs"`
 	CheckpointSecs  int    `mapstructure:"checkpoint_secs"`
-	WiredTigerCache int    `mapstructure:"wired_tiger_cache"`
+	WiredTigerCache int    `mapstructure:"wired_tiger_cache"` // 缓存大小(字节)，仅在 cache_size_gb 为 0 时生效
+	TTLMonitorSecs  int    `mapstructure:"ttl_monitor_secs"`  // TTL 索引清理周期(秒)，0 表示不清理
+	BTreeOrder      int    `mapstructure:"btree_order"`       // 集合和索引 B+树的阶数，不小于 3，0 表示默认值 128
+
+	MaxBsonObjectSize int `mapstructure:"max_bson_object_size"` // 单个文档的最大字节数，0 表示默认值 16MB
 }
 
 // SecurityConfig 安全配置
@@ -70,6 +91,24 @@ type LoggerConfig struct {
 	MaxBackups int    `mapstructure:"max_backups"`
 	MaxAge     int    `mapstructure:"max_age"`
 	Compress   bool   `mapstructure:"compress"`
+
+	LogCommands     bool `mapstructure:"log_commands"`      // 在 info 级别记录每个命令，敏感字段会被隐藏
+	DebugSampleRate int  `mapstructure:"debug_sample_rate"` // debug 日志每 N 条输出 1 条，不大于 1 时全部输出；其他级别不采样
+}
+
+// DefaultCacheSize 未配置缓存大小时使用的默认值 1GB
+const DefaultCacheSize int64 = 1 << 30
+
+// CacheSizeBytes 返回存储引擎实际使用的缓存大小(字节)
+// cache_size_gb 大于 0 时以它为准，否则使用 wired_tiger_cache，两者都不大于 0 时为 DefaultCacheSize
+func (c StorageConfig) CacheSizeBytes() int64 {
+	if c.CacheSizeGB > 0 {
+		return int64(c.CacheSizeGB) << 30
+	}
+	if c.WiredTigerCache > 0 {
+		return int64(c.WiredTigerCache)
+	}
+	return DefaultCacheSize
 }
 
 // LoadConfig 加载配置文件
@@ -109,6 +148,10 @@ func setDefaults() {
 	viper.SetDefault("server.base_dir", "./")
 	viper.SetDefault("server.user", "mongodb")
 	viper.SetDefault("server.profile_port", 6060)
+	viper.SetDefault("server.max_open_cursors", 10000)
+	viper.SetDefault("server.max_cursors_per_session", 1000)
+	viper.SetDefault("server.cursor_default_batch_size", 101)
+	viper.SetDefault("server.cursor_timeout_ms", 600000) // 10 分钟
 
 	// Network defaults
 	viper.SetDefault("network.tcp_keep_alive", true)
@@ -117,8 +160,14 @@ func setDefaults() {
 	viper.SetDefault("network.tcp_write_timeout", "30s")
 	viper.SetDefault("network.max_msg_len", 67108864) // 64MB
 	viper.SetDefault("network.compress_encoding", false)
+	viper.SetDefault("network.checksum_enabled", false)
 	viper.SetDefault("network.max_connections", 1000)
 	viper.SetDefault("network.connection_timeout", "30s")
+	viper.SetDefault("network.idle_timeout", "10m")
+	viper.SetDefault("network.reply_document_sequence", false)
+	viper.SetDefault("network.rate_limit_enabled", false)
+	viper.SetDefault("network.rate_limit_per_connection", 1000)
+	viper.SetDefault("network.rate_limit_global", 10000)
 
 	// Storage defaults
 	viper.SetDefault("storage.engine", "wiredTiger")
@@ -129,6 +178,9 @@ func setDefaults() {
 	viper.SetDefault("storage.sync_period_secs", 60)
 	viper.SetDefault("storage.checkpoint_secs", 60)
 	viper.SetDefault("storage.wired_tiger_cache", 1073741824) // 1GB
+	viper.SetDefault("storage.ttl_monitor_secs", 60)
+	viper.SetDefault("storage.btree_order", 128)
+	viper.SetDefault("storage.max_bson_object_size", 16777216) // 16MB
 
 	// Security defaults
 	viper.SetDefault("security.authorization", false)
@@ -147,6 +199,8 @@ func setDefaults() {
 	viper.SetDefault("logger.max_backups", 3)
 	viper.SetDefault("logger.max_age", 30)
 	viper.SetDefault("logger.compress", true)
+	viper.SetDefault("logger.log_commands", false)
+	viper.SetDefault("logger.debug_sample_rate", 1)
 }
 
 // createDefaultConfig 创建默认配置文件
@@ -160,6 +214,10 @@ data_dir = "./data"
 base_dir = "./"
 user = "mongodb"
 profile_port = 6060
+max_open_cursors = 10000
+max_cursors_per_session = 1000
+cursor_default_batch_size = 101
+cursor_timeout_ms = 600000
 
 [network]
 tcp_keep_alive = true
@@ -168,8 +226,14 @@ tcp_read_timeout = "30s"
 tcp_write_timeout = "30s"
 max_msg_len = 67108864
 compress_encoding = false
+checksum_enabled = false
 max_connections = 1000
 connection_timeout = "30s"
+idle_timeout = "10m"
+reply_document_sequence = false
+rate_limit_enabled = false
+rate_limit_per_connection = 1000
+rate_limit_global = 10000
 
 [storage]
 engine = "wiredTiger"
@@ -180,13 +244,16 @@ directory_for_db = "./data/db"
 sync_period_secs = 60
 checkpoint_secs = 60
 wired_tiger_cache = 1073741824
+ttl_monitor_secs = 60
+btree_order = 128
+max_bson_object_size = 16777216
 
 [security]
 authorization = false
 auth_mechanism = "SCRAM-SHA-256"
 key_file = ""
 cluster_auth_mode = "keyFile"
-ssl_mode = "disabled"
+ssl_mode = "disabled" # disabled / allowSSL / preferSSL / requireSSL
 ssl_pem_key_file = ""
 ssl_ca_file = ""
 
@@ -198,6 +265,8 @@ max_size = 100
 max_backups = 3
 max_age = 30
 compress = true
+log_commands = false
+debug_sample_rate = 1
 `
 
 	return os.WriteFile(configPath, []byte(configContent), 0644)
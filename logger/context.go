@@ -0,0 +1,53 @@
+package logger
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// entryKey 携带请求日志条目的 context 键
+type entryKey struct{}
+
+// requestKey 携带请求远端地址和请求 ID 的 context 键，见 WithRequest
+type requestKey struct{}
+
+// requestFields 请求日志条目的字段
+type requestFields struct {
+	remote    string
+	requestID int32
+}
+
+// ForRequest 返回带连接远端地址和请求 ID 字段的日志条目，同一请求的日志可以按这两个字段关联
+func ForRequest(remote string, requestID int32) *logrus.Entry {
+	return GetLogger().WithFields(logrus.Fields{"remote": remote, "requestId": requestID})
+}
+
+// NewContext 返回携带日志条目的 context
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, entry)
+}
+
+// WithRequest 返回携带请求远端地址和请求 ID 的 context
+// 与 NewContext(ctx, ForRequest(remote, requestID)) 输出相同的字段，但日志条目在 FromContext 时才创建，
+// 处理过程中不输出日志的请求不分配日志条目
+func WithRequest(ctx context.Context, remote string, requestID int32) context.Context {
+	return context.WithValue(ctx, requestKey{}, requestFields{remote: remote, requestID: requestID})
+}
+
+// FromContext 返回 context 携带的日志条目，没有时返回不带字段的条目
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(entryKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	if fields, ok := ctx.Value(requestKey{}).(requestFields); ok {
+		return ForRequest(fields.remote, fields.requestID)
+	}
+	return logrus.NewEntry(GetLogger())
+}
+
+// DebugEnabled 判断是否输出下一条 debug 日志，按 debug_sample_rate 采样
+// 通过日志条目输出 debug 日志前调用，使其与 Debugf 采用相同的采样
+func DebugEnabled() bool {
+	return GetLogger().IsLevelEnabled(logrus.DebugLevel) && debugSampler.Allow()
+}
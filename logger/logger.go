@@ -1,14 +1,22 @@
 package logger
 
 import (
+	"io"
 	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/zhukovaskychina/xmongodb/config"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var log *logrus.Logger
 
+// debugSampler debug 日志的采样器，为 nil 时输出全部 debug 日志
+var debugSampler *Sampler
+
+// fileOutput 当前使用的日志文件，重新初始化时关闭
+var fileOutput io.Closer
+
 // Init 初始化日志系统
 func Init(cfg config.LoggerConfig) {
 	log = logrus.New()
@@ -19,6 +27,7 @@ func Init(cfg config.LoggerConfig) {
 		level = logrus.InfoLevel
 	}
 	log.SetLevel(level)
+	debugSampler = NewSampler(cfg.DebugSampleRate)
 
 	// 设置日志格式
 	if cfg.Format == "json" {
@@ -33,6 +42,10 @@ func Init(cfg config.LoggerConfig) {
 	}
 
 	// 设置输出目标
+	if fileOutput != nil {
+		fileOutput.Close()
+		fileOutput = nil
+	}
 	if cfg.Output == "stdout" || cfg.Output == "" {
 		log.SetOutput(os.Stdout)
 	} else {
@@ -40,9 +53,20 @@ func Init(cfg config.LoggerConfig) {
 		if err != nil {
 			log.Warnf("无法打开日志文件 %s: %v, 使用标准输出", cfg.Output, err)
 			log.SetOutput(os.Stdout)
-		} else {
-			log.SetOutput(file)
+			return
 		}
+		file.Close()
+		// 文件超过 max_size(MB) 时轮转，为 0 时按 100MB 轮转；保留 max_backups 个和 max_age 天内的备份，为 0 时不限制
+		rolling := &lumberjack.Logger{
+			Filename:   cfg.Output,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+			Compress:   cfg.Compress,
+			LocalTime:  true,
+		}
+		fileOutput = rolling
+		log.SetOutput(rolling)
 	}
 }
 
@@ -54,14 +78,18 @@ func GetLogger() *logrus.Logger {
 	return log
 }
 
-// Debug 调试日志
+// Debug 调试日志，配置了 debug_sample_rate 时按比例采样
 func Debug(args ...interface{}) {
-	GetLogger().Debug(args...)
+	if DebugEnabled() {
+		GetLogger().Debug(args...)
+	}
 }
 
-// Debugf 格式化调试日志
+// Debugf 格式化调试日志，配置了 debug_sample_rate 时按比例采样
 func Debugf(format string, args ...interface{}) {
-	GetLogger().Debugf(format, args...)
+	if DebugEnabled() {
+		GetLogger().Debugf(format, args...)
+	}
 }
 
 // Info 信息日志
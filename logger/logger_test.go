@@ -0,0 +1,136 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+)
+
+// TestDebugSampling 测试 debug 日志按 debug_sample_rate 采样，错误日志全部输出
+func TestDebugSampling(t *testing.T) {
+	Init(config.LoggerConfig{Level: "debug", Format: "text", DebugSampleRate: 10})
+	defer Init(config.LoggerConfig{})
+	var buf bytes.Buffer
+	GetLogger().SetOutput(&buf)
+
+	// 并发写入时采样计数同样准确
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				Debugf("收到消息 %d", i)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 50; i++ {
+		Errorf("处理失败 %d", i)
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, "level=debug"); n != 100 {
+		t.Errorf("1000 条 debug 日志按 1/10 采样应输出 100 条, got %d", n)
+	}
+	if n := strings.Count(out, "level=error"); n != 50 {
+		t.Errorf("错误日志不应被采样, got %d 条, want 50", n)
+	}
+}
+
+// TestSampler 测试采样器的比例
+func TestSampler(t *testing.T) {
+	for _, n := range []int{0, 1} {
+		if s := NewSampler(n); s != nil || !s.Allow() {
+			t.Errorf("NewSampler(%d) 应不采样", n)
+		}
+	}
+	s := NewSampler(3)
+	var got []bool
+	for i := 0; i < 7; i++ {
+		got = append(got, s.Allow())
+	}
+	want := []bool{true, false, false, true, false, false, true}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Allow() 序列 = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestRotatingFileOutput 测试日志文件超过 max_size 后轮转并保留备份
+func TestRotatingFileOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "xmongodb.log")
+	Init(config.LoggerConfig{Level: "info", Format: "text", Output: path, MaxSize: 1, MaxBackups: 2})
+	defer Init(config.LoggerConfig{})
+
+	// 每条约 1KB，写入约 1.5MB 触发一次轮转
+	line := strings.Repeat("x", 1024)
+	for i := 0; i < 1500; i++ {
+		Info(line)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("读取日志目录失败: %v", err)
+	}
+	var backups []string
+	for _, e := range entries {
+		if e.Name() != "xmongodb.log" {
+			backups = append(backups, e.Name())
+		}
+	}
+	if len(backups) != 1 || !strings.HasPrefix(backups[0], "xmongodb-") {
+		t.Fatalf("应生成一个备份文件, got %v", backups)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("当前日志文件不存在: %v", err)
+	}
+	if info.Size() >= 1<<20 {
+		t.Errorf("轮转后的当前日志文件应小于 max_size, got %d 字节", info.Size())
+	}
+}
+
+// TestForRequest 测试请求日志条目携带远端地址和请求 ID，并可以通过 context 传递
+func TestForRequest(t *testing.T) {
+	Init(config.LoggerConfig{Level: "info", Format: "json"})
+	defer Init(config.LoggerConfig{})
+	var buf bytes.Buffer
+	GetLogger().SetOutput(&buf)
+
+	ctx := NewContext(context.Background(), ForRequest("10.0.0.1:1234", 7))
+	FromContext(ctx).Info("处理请求")
+	FromContext(context.Background()).Info("没有请求")
+	FromContext(WithRequest(context.Background(), "10.0.0.2:5678", 8)).Info("延迟创建条目的请求")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("应输出 3 行日志, got %d", len(lines))
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("解析日志失败: %v", err)
+	}
+	if entry["remote"] != "10.0.0.1:1234" || entry["requestId"] != float64(7) {
+		t.Errorf("日志应带有 remote 和 requestId: %v", entry)
+	}
+	if strings.Contains(lines[1], "requestId") {
+		t.Errorf("没有请求条目的 context 不应带有请求字段: %s", lines[1])
+	}
+	entry = nil
+	if err := json.Unmarshal([]byte(lines[2]), &entry); err != nil {
+		t.Fatalf("解析日志失败: %v", err)
+	}
+	if entry["remote"] != "10.0.0.2:5678" || entry["requestId"] != float64(8) {
+		t.Errorf("WithRequest 的日志应带有 remote 和 requestId: %v", entry)
+	}
+}
@@ -0,0 +1,26 @@
+package logger
+
+import "sync/atomic"
+
+// Sampler 按固定比例采样日志，每 n 条输出 1 条，并发安全
+// 用于高频的 debug 日志，避免每个请求都写日志拖慢服务
+type Sampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+// NewSampler 创建每 n 条输出 1 条的采样器，n 不大于 1 时返回 nil，表示不采样
+func NewSampler(n int) *Sampler {
+	if n <= 1 {
+		return nil
+	}
+	return &Sampler{n: uint64(n)}
+}
+
+// Allow 判断本条日志是否输出，第 1、n+1、2n+1... 条返回 true；nil 采样器总是返回 true
+func (s *Sampler) Allow() bool {
+	if s == nil {
+		return true
+	}
+	return (s.count.Add(1)-1)%s.n == 0
+}
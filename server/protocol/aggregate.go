@@ -0,0 +1,250 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("aggregate", ActionFind, (*EventListener).cmdAggregate)
+}
+
+// pipelineStage 聚合管道中的一个阶段
+type pipelineStage struct {
+	name string           // 阶段名，如 $match
+	spec storage.Document // 阶段参数
+	raw  bsoncore.Value   // 原始参数，用于非文档参数的阶段如 $limit
+}
+
+// parsePipeline 解析 pipeline 参数
+func parsePipeline(req *commandRequest) ([]pipelineStage, error) {
+	v, err := req.body.LookupErr("pipeline")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'aggregate.pipeline' is missing but a required field")
+	}
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'aggregate.pipeline' is the wrong type '%s', expected type 'array'", v.Type)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+
+	stages := make([]pipelineStage, 0, len(values))
+	for _, value := range values {
+		doc, ok := value.DocumentOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "Each element of the 'pipeline' array must be an object")
+		}
+		elems, err := doc.Elements()
+		if err != nil || len(elems) != 1 {
+			return nil, NewCommandError(CodeFailedToParse, "A pipeline stage specification object must contain exactly one field.")
+		}
+		stage := pipelineStage{name: elems[0].Key(), raw: elems[0].Value()}
+		if spec, ok := stage.raw.DocumentOK(); ok {
+			if stage.spec, err = storage.UnmarshalDocument(spec); err != nil {
+				return nil, NewCommandError(CodeFailedToParse, "%v", err)
+			}
+		}
+		if stage.name == "$replaceWith" {
+			// $replaceWith 的参数是任意表达式，与 $replaceRoot 一样保存为 {newRoot: 表达式}
+			wrapped := bsoncore.NewDocumentBuilder().AppendValue("newRoot", stage.raw).Build()
+			if stage.spec, err = storage.UnmarshalDocument(wrapped); err != nil {
+				return nil, NewCommandError(CodeFailedToParse, "%v", err)
+			}
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// cmdAggregate 处理 aggregate 命令
+// 以 $changeStream 开头的管道打开 change stream 游标，其余管道对集合执行
+// $match/$project/$addFields/$set/$replaceRoot/$replaceWith/$sort/$skip/$limit/$lookup 阶段
+func (l *EventListener) cmdAggregate(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	stages, err := parsePipeline(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cursorOpts, err := req.body.LookupErr("cursor")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "The 'cursor' option is required, except for aggregate with the explain argument")
+	}
+	cursorDoc, ok := cursorOpts.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "cursor field must be missing or an object")
+	}
+	batchSize, err := batchSizeArgument(cursorDoc, l.defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// aggregate: 1 表示数据库级聚合，目前只支持 change stream
+	target := req.body.Index(0).Value()
+	coll, isColl := target.StringValueOK()
+	if !isColl && !target.IsNumber() {
+		return nil, NewCommandError(CodeInvalidNamespace, "Invalid aggregate namespace")
+	}
+	ns := req.db + "." + coll
+	if !isColl {
+		ns = req.db + ".$cmd.aggregate"
+	}
+
+	if len(stages) > 0 && stages[0].name == "$changeStream" {
+		stream, err := l.openChangeStream(ctx, req.db, coll, stages[0].spec, stages[1:])
+		if err != nil {
+			return nil, err
+		}
+		return l.openCursor(ctx, ns, stream, batchSize, true)
+	}
+	if !isColl {
+		return nil, NewCommandError(CodeInvalidNamespace, "{aggregate: 1} is not valid for '%s' pipelines", stages[0].name)
+	}
+
+	docs, err := l.runPipeline(ctx, req.db, coll, stages)
+	if err != nil {
+		return nil, err
+	}
+	return l.openCursor(ctx, ns, newDocumentSource(docs), batchSize, false)
+}
+
+// runPipeline 对集合执行聚合管道，开头的 $match 下推到存储引擎查询
+func (l *EventListener) runPipeline(ctx context.Context, db, coll string, stages []pipelineStage) ([]storage.Document, error) {
+	filter := storage.Document{}
+	if len(stages) > 0 && stages[0].name == "$match" {
+		filter = stages[0].spec
+		stages = stages[1:]
+	}
+	docs, err := l.storageEngine.Find(ctx, db, coll, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// $lookup 需要读取其他集合，不能作为纯粹的文档变换执行
+		if stage.name == "$lookup" {
+			docs, err = l.applyLookup(ctx, db, docs, stage)
+		} else {
+			docs, err = applyStage(ctx, docs, stage)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// applyStage 对文档集合执行单个聚合阶段，逐文档的阶段在处理每个文档前检查 ctx 是否已取消
+func applyStage(ctx context.Context, docs []storage.Document, stage pipelineStage) ([]storage.Document, error) {
+	switch stage.name {
+	case "$match", "$project", "$addFields", "$set", "$replaceRoot", "$replaceWith":
+		if stage.spec == nil {
+			return nil, NewCommandError(CodeTypeMismatch, "the %s specification must be an object", stage.name)
+		}
+		out := docs[:0:0]
+		for _, doc := range docs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			result, ok, err := applyDocumentStage(doc, stage)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, result)
+			}
+		}
+		return out, nil
+	case "$sort":
+		if len(stage.spec) == 0 {
+			return nil, NewCommandError(CodeTypeMismatch, "the $sort key specification must be an object")
+		}
+		sorted := append([]storage.Document(nil), docs...)
+		if err := storage.SortDocuments(sorted, stage.spec); err != nil {
+			return nil, err
+		}
+		return sorted, nil
+	case "$skip", "$limit":
+		n, ok := stage.raw.AsInt64OK()
+		if !ok || n < 0 || (stage.name == "$limit" && n == 0) {
+			return nil, NewCommandError(CodeBadValue, "invalid argument to %s stage: %s", stage.name, stage.raw)
+		}
+		if stage.name == "$skip" {
+			if int(n) >= len(docs) {
+				return docs[:0], nil
+			}
+			return docs[n:], nil
+		}
+		if int(n) < len(docs) {
+			return docs[:n], nil
+		}
+		return docs, nil
+	}
+	return nil, NewCommandError(CodeFailedToParse, "Unrecognized pipeline stage name: '%s'", stage.name)
+}
+
+// applyDocumentStage 对单个文档执行逐文档的阶段，返回结果以及文档是否保留
+func applyDocumentStage(doc storage.Document, stage pipelineStage) (storage.Document, bool, error) {
+	switch stage.name {
+	case "$match":
+		ok, err := storage.Matches(doc, stage.spec)
+		return doc, ok, err
+	case "$project":
+		projected, err := storage.ApplyProjection(doc, stage.spec)
+		return projected, err == nil, err
+	case "$addFields", "$set":
+		added, err := storage.AddFields(doc, stage.spec)
+		return added, err == nil, err
+	case "$replaceRoot", "$replaceWith":
+		expr, ok := stage.spec["newRoot"]
+		if !ok {
+			return nil, false, NewCommandError(CodeFailedToParse, "no newRoot specified for the %s stage", stage.name)
+		}
+		v, err := storage.EvalExpression(expr, doc)
+		if err != nil {
+			return nil, false, err
+		}
+		root, ok := v.(storage.Document)
+		if !ok {
+			return nil, false, NewCommandError(CodeBadValue, "'newRoot' expression must evaluate to an object, but resulting value was: %v", v)
+		}
+		return root, true, nil
+	}
+	return nil, false, fmt.Errorf("阶段 %s 不能逐文档执行", stage.name)
+}
+
+// documentSource 已计算完成的结果集
+type documentSource struct {
+	docs []storage.Document
+}
+
+func newDocumentSource(docs []storage.Document) *documentSource {
+	return &documentSource{docs: docs}
+}
+
+func (s *documentSource) next(ctx context.Context, n int) ([]bsoncore.Document, error) {
+	if n < 0 || n > len(s.docs) {
+		n = len(s.docs)
+	}
+	batch := make([]bsoncore.Document, 0, n)
+	for _, doc := range s.docs[:n] {
+		raw, err := storage.MarshalDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, raw)
+	}
+	s.docs = s.docs[n:]
+	return batch, nil
+}
+
+func (s *documentSource) exhausted() bool {
+	return len(s.docs) == 0
+}
@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// aggregateCommandDocument 构造 {aggregate: coll, pipeline: stages, cursor: {}, $db: db}
+func aggregateCommandDocument(db, coll string, stages ...bsoncore.Document) bsoncore.Document {
+	pipeline := bsoncore.NewArrayBuilder()
+	for _, stage := range stages {
+		pipeline.AppendDocument(stage)
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("aggregate", coll).
+		AppendArray("pipeline", pipeline.Build()).
+		AppendDocument("cursor", bsoncore.NewDocumentBuilder().Build()).
+		AppendString("$db", db).
+		Build()
+}
+
+// TestLookup 测试 $lookup 把订单对应的客户文档连接到 customer 字段
+func TestLookup(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	customer := func(id int32, name string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).AppendString("name", name).Build()
+	}
+	order := func(id, customerID int32) *bsoncore.DocumentBuilder {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).AppendInt32("customerId", customerID)
+	}
+	run(1, insertCommandDocument("test", "customers", customer(1, "alice"), customer(2, "bob"), customer(3, "carol")))
+	run(2, insertCommandDocument("test", "orders",
+		order(10, 1).Build(),
+		order(11, 2).Build(),
+		order(12, 1).Build(),
+		order(13, 9).Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 14).
+			AppendArray("customerId", bsoncore.NewArrayBuilder().AppendInt32(2).AppendInt64(3).Build()).
+			Build()))
+
+	lookup := func(foreignField string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			StartDocument("$lookup").
+			AppendString("from", "customers").
+			AppendString("localField", "customerId").
+			AppendString("foreignField", foreignField).
+			AppendString("as", "customer").
+			FinishDocument().
+			Build()
+	}
+	sort := bsoncore.NewDocumentBuilder().
+		StartDocument("$sort").AppendInt32("_id", 1).FinishDocument().
+		Build()
+	want := map[int32][]string{10: {"alice"}, 11: {"bob"}, 12: {"alice"}, 13: {}, 14: {"bob", "carol"}}
+
+	// _id 上有索引；cid 上没有索引，只扫描一次 customers
+	for i, foreignField := range []string{"_id", "cid"} {
+		if foreignField == "cid" {
+			run(3, insertCommandDocument("test", "customers",
+				bsoncore.NewDocumentBuilder().AppendInt32("_id", 4).AppendInt32("cid", 1).AppendString("name", "dave").Build()))
+			want = map[int32][]string{10: {"dave"}, 11: {}, 12: {"dave"}, 13: {}, 14: {}}
+		}
+		reply := run(int32(10+i), aggregateCommandDocument("test", "orders", lookup(foreignField), sort))
+		_, batch := cursorBatch(t, reply, "firstBatch")
+		if len(batch) != len(want) {
+			t.Fatalf("$lookup 应返回每个订单: %s", reply)
+		}
+		for _, doc := range batch {
+			id := doc.Lookup("_id").Int32()
+			matches, err := doc.Lookup("customer").Array().Values()
+			if err != nil || len(matches) != len(want[id]) {
+				t.Errorf("按 %s 连接时订单 %d 的客户 = %s, want %v", foreignField, id, doc.Lookup("customer"), want[id])
+				continue
+			}
+			for j, m := range matches {
+				if name := m.Document().Lookup("name").StringValue(); name != want[id][j] {
+					t.Errorf("按 %s 连接时订单 %d 的第 %d 个客户 = %s, want %s", foreignField, id, j, name, want[id][j])
+				}
+			}
+		}
+	}
+
+	invalid := bsoncore.NewDocumentBuilder().
+		StartDocument("$lookup").AppendString("from", "customers").AppendString("as", "c").FinishDocument().
+		Build()
+	if code := run(20, aggregateCommandDocument("test", "orders", invalid)).Lookup("code").Int32(); code != int32(CodeFailedToParse) {
+		t.Errorf("缺少 localField 应返回 FailedToParse, got %d", code)
+	}
+}
+
+// TestAddFieldsAndReplaceRoot 测试 $addFields/$set 添加计算字段，以及 $replaceRoot/$replaceWith 用嵌入文档替换整个文档
+func TestAddFieldsAndReplaceRoot(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	item := func(id int32, name string, price, qty int32, city string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			AppendInt32("_id", id).
+			AppendString("name", name).
+			AppendInt32("price", price).
+			AppendInt32("qty", qty).
+			StartDocument("supplier").AppendString("city", city).AppendInt32("rating", id).FinishDocument().
+			Build()
+	}
+	run(1, insertCommandDocument("test", "items", item(1, "pen", 3, 10, "paris"), item(2, "ink", 7, 2, "rome")))
+	sort := bsoncore.NewDocumentBuilder().
+		StartDocument("$sort").AppendInt32("_id", 1).FinishDocument().
+		Build()
+
+	for i, name := range []string{"$addFields", "$set"} {
+		stage := bsoncore.NewDocumentBuilder().
+			StartDocument(name).
+			StartDocument("total").
+			AppendArray("$multiply", bsoncore.NewArrayBuilder().AppendString("$price").AppendString("$qty").Build()).
+			FinishDocument().
+			StartDocument("label").
+			AppendArray("$concat", bsoncore.NewArrayBuilder().AppendString("$name").AppendString("@").AppendString("$supplier.city").Build()).
+			FinishDocument().
+			AppendString("supplier.country", "EU").
+			AppendString("missing", "$nope").
+			FinishDocument().
+			Build()
+		reply := run(int32(2+i), aggregateCommandDocument("test", "items", stage, sort))
+		_, batch := cursorBatch(t, reply, "firstBatch")
+		if len(batch) != 2 {
+			t.Fatalf("%s 应返回 2 个文档: %s", name, reply)
+		}
+		if total := batch[0].Lookup("total").Int32(); total != 30 {
+			t.Errorf("%s total = %d, want 30", name, total)
+		}
+		if label := batch[1].Lookup("label").StringValue(); label != "ink@rome" {
+			t.Errorf("%s label = %s, want ink@rome", name, label)
+		}
+		if country := batch[0].Lookup("supplier", "country").StringValue(); country != "EU" || batch[0].Lookup("supplier", "city").StringValue() != "paris" {
+			t.Errorf("%s 应在嵌入文档中添加字段并保留原有字段: %s", name, batch[0])
+		}
+		if batch[0].Lookup("price").Int32() != 3 {
+			t.Errorf("%s 应保留原有字段: %s", name, batch[0])
+		}
+		if _, err := batch[0].LookupErr("missing"); err == nil {
+			t.Errorf("%s 不应添加取值为缺失字段的字段: %s", name, batch[0])
+		}
+	}
+
+	replaceRoot := bsoncore.NewDocumentBuilder().
+		StartDocument("$replaceRoot").AppendString("newRoot", "$supplier").FinishDocument().
+		Build()
+	replaceWith := bsoncore.NewDocumentBuilder().AppendString("$replaceWith", "$supplier").Build()
+	for i, stage := range []bsoncore.Document{replaceRoot, replaceWith} {
+		reply := run(int32(10+i), aggregateCommandDocument("test", "items", sort, stage))
+		_, batch := cursorBatch(t, reply, "firstBatch")
+		if len(batch) != 2 {
+			t.Fatalf("应返回 2 个文档: %s", reply)
+		}
+		if elems, _ := batch[0].Elements(); len(elems) != 2 || batch[0].Lookup("city").StringValue() != "paris" || batch[1].Lookup("rating").Int32() != 2 {
+			t.Errorf("嵌入文档应成为新的根文档: %v", batch)
+		}
+	}
+
+	notObject := bsoncore.NewDocumentBuilder().
+		StartDocument("$replaceRoot").AppendString("newRoot", "$name").FinishDocument().
+		Build()
+	if code := run(20, aggregateCommandDocument("test", "items", notObject)).Lookup("code").Int32(); code != int32(CodeBadValue) {
+		t.Errorf("newRoot 不是文档时应返回 BadValue, got %d", code)
+	}
+}
@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"strings"
+
+	getty "github.com/apache/dubbo-getty"
+)
+
+// ActionType 权限动作
+type ActionType string
+
+const (
+	ActionNone             ActionType = ""                 // 无需鉴权（握手、心跳等）
+	ActionFind             ActionType = "find"             // 查询
+	ActionInsert           ActionType = "insert"           // 插入
+	ActionUpdate           ActionType = "update"           // 更新
+	ActionRemove           ActionType = "remove"           // 删除
+	ActionCreateIndex      ActionType = "createIndex"      // 创建索引
+	ActionDropIndex        ActionType = "dropIndex"        // 删除索引
+	ActionListIndexes      ActionType = "listIndexes"      // 列出索引
+	ActionCreateCollection ActionType = "createCollection" // 创建集合
+	ActionDropCollection   ActionType = "dropCollection"   // 删除集合
+	ActionListCollections  ActionType = "listCollections"  // 列出集合
+	ActionCollMod          ActionType = "collMod"          // 修改集合选项
+	ActionDropDatabase     ActionType = "dropDatabase"     // 删除数据库
+	ActionCollStats        ActionType = "collStats"        // 集合统计
+	ActionValidate         ActionType = "validate"         // 集合一致性检查
+	ActionReIndex          ActionType = "reIndex"          // 重建索引
+	ActionCompact          ActionType = "compact"          // 压缩集合
+	ActionEnableProfiler   ActionType = "enableProfiler"   // 设置分析级别
+	ActionDBStats          ActionType = "dbStats"          // 数据库统计
+	ActionKillCursors      ActionType = "killCursors"      // 关闭游标
+	ActionListDatabases    ActionType = "listDatabases"    // 列出数据库（集群级）
+	ActionServerStatus     ActionType = "serverStatus"     // 服务器状态（集群级）
+	ActionFsync            ActionType = "fsync"            // 检查点和写入加锁（集群级）
+	ActionUnlock           ActionType = "unlock"           // 解除写入加锁（集群级）
+	ActionInprog           ActionType = "inprog"           // 查看正在执行的操作（集群级）
+	ActionKillop           ActionType = "killop"           // 中止正在执行的操作（集群级）
+	ActionGetCmdLineOpts   ActionType = "getCmdLineOpts"   // 查看启动参数和配置（集群级）
+	ActionHostInfo         ActionType = "hostInfo"         // 查看主机信息（集群级）
+	ActionKillAnySession   ActionType = "killAnySession"   // 结束任意用户的逻辑会话（集群级）
+)
+
+// clusterActions 作用于集群资源而非单个数据库的动作
+var clusterActions = map[ActionType]bool{
+	ActionListDatabases:  true,
+	ActionServerStatus:   true,
+	ActionFsync:          true,
+	ActionUnlock:         true,
+	ActionInprog:         true,
+	ActionKillop:         true,
+	ActionGetCmdLineOpts: true,
+	ActionHostInfo:       true,
+	ActionKillAnySession: true,
+}
+
+// actionSet 动作集合
+type actionSet map[ActionType]bool
+
+// newActionSet 创建动作集合
+func newActionSet(sets []actionSet, actions ...ActionType) actionSet {
+	s := make(actionSet)
+	for _, set := range sets {
+		for action := range set {
+			s[action] = true
+		}
+	}
+	for _, action := range actions {
+		s[action] = true
+	}
+	return s
+}
+
+var (
+	readActions = newActionSet(nil,
+		ActionFind, ActionListCollections, ActionListIndexes,
+		ActionCollStats, ActionDBStats, ActionKillCursors)
+
+	readWriteActions = newActionSet([]actionSet{readActions},
+		ActionInsert, ActionUpdate, ActionRemove,
+		ActionCreateCollection, ActionDropCollection,
+		ActionCreateIndex, ActionDropIndex)
+
+	dbAdminActions = newActionSet(nil,
+		ActionListCollections, ActionListIndexes, ActionCollStats, ActionDBStats,
+		ActionCreateCollection, ActionDropCollection,
+		ActionCreateIndex, ActionDropIndex, ActionDropDatabase, ActionValidate,
+		ActionReIndex, ActionCompact, ActionEnableProfiler, ActionCollMod)
+)
+
+// databaseRoles 内置数据库角色授予的动作
+var databaseRoles = map[string]actionSet{
+	"read":      readActions,
+	"readWrite": readWriteActions,
+	"dbAdmin":   dbAdminActions,
+	"dbOwner":   newActionSet([]actionSet{readWriteActions, dbAdminActions}),
+}
+
+// clusterRoles 定义在 admin 库上的角色授予的集群级动作
+var clusterRoles = map[string]actionSet{
+	"readAnyDatabase":      newActionSet(nil, ActionListDatabases),
+	"readWriteAnyDatabase": newActionSet(nil, ActionListDatabases),
+	"dbAdminAnyDatabase":   newActionSet(nil, ActionListDatabases),
+	"clusterMonitor":       newActionSet(nil, ActionListDatabases, ActionServerStatus, ActionInprog, ActionGetCmdLineOpts, ActionHostInfo),
+	"hostManager":          newActionSet(nil, ActionFsync, ActionUnlock, ActionKillop, ActionKillAnySession),
+}
+
+// RoleName 角色名，角色总是定义在某个数据库上
+type RoleName struct {
+	Role string
+	DB   string
+}
+
+// grants 判断角色是否在指定数据库上授予该动作
+func (r RoleName) grants(db string, action ActionType) bool {
+	if r.Role == "root" && r.DB == "admin" {
+		return true
+	}
+
+	if clusterActions[action] {
+		return r.DB == "admin" && clusterRoles[r.Role][action]
+	}
+
+	role := r.Role
+	if strings.HasSuffix(role, "AnyDatabase") {
+		// xxxAnyDatabase 角色只在 admin 库上有效，作用于所有数据库
+		if r.DB != "admin" {
+			return false
+		}
+		role = strings.TrimSuffix(role, "AnyDatabase")
+	} else if r.DB != db {
+		return false
+	}
+
+	return databaseRoles[role][action]
+}
+
+// UserIdentity 已认证的用户身份
+type UserIdentity struct {
+	User  string
+	DB    string
+	Roles []RoleName
+}
+
+// IsAuthorized 判断用户是否有权在数据库上执行该动作
+func (u *UserIdentity) IsAuthorized(db string, action ActionType) bool {
+	if action == ActionNone {
+		return true
+	}
+	for _, role := range u.Roles {
+		if role.grants(db, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAuthenticatedUser 在会话上记录认证成功的用户，由认证机制调用
+func SetAuthenticatedUser(session getty.Session, user *UserIdentity) {
+	stateOf(session).setAuthenticatedUser(user)
+}
+
+// AuthenticatedUser 获取会话上已认证的用户，未认证返回 nil
+func AuthenticatedUser(session getty.Session) *UserIdentity {
+	if session == nil {
+		return nil
+	}
+	return stateOf(session).authenticatedUser()
+}
+
+// checkAuthorization 检查会话用户是否有权执行命令
+func (l *EventListener) checkAuthorization(session getty.Session, db string, spec *commandSpec) error {
+	return l.checkAction(session, db, spec.name, spec.action)
+}
+
+// checkAction 检查会话用户是否有权在数据库上执行指定动作，name 用于错误信息
+func (l *EventListener) checkAction(session getty.Session, db, name string, action ActionType) error {
+	if l.config == nil || !l.config.Security.Authorization || action == ActionNone {
+		return nil
+	}
+
+	user := AuthenticatedUser(session)
+	if user == nil || !user.IsAuthorized(db, action) {
+		return NewCommandError(CodeUnauthorized, "not authorized on %s to execute command { %s: ... }", db, name)
+	}
+	return nil
+}
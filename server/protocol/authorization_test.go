@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestAuthorization 测试命令分发的角色鉴权
+func TestAuthorization(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Storage.Engine = "memory"
+	cfg.Security.Authorization = true
+
+	registerCommand("testFind", ActionFind, func(l *EventListener, ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+		return bsoncore.NewDocumentBuilder().AppendString("result", "found"), nil
+	})
+	defer delete(commandRegistry, "testFind")
+
+	listener := newTestListener(t, cfg)
+	session := newFakeSession()
+	SetAuthenticatedUser(session, &UserIdentity{
+		User:  "reader",
+		DB:    "test",
+		Roles: []RoleName{{Role: "read", DB: "test"}},
+	})
+
+	run := func(command bsoncore.Document) bsoncore.Document {
+		return replyDocument(t, listener.handleMessage(session, newOpMsgMessage(1, command)))
+	}
+
+	t.Run("允许的操作", func(t *testing.T) {
+		doc := run(bsoncore.NewDocumentBuilder().
+			AppendString("testFind", "users").
+			AppendString("$db", "test").
+			Build())
+
+		if ok := doc.Lookup("ok").Double(); ok != 1 {
+			t.Fatalf("read 角色应允许 find: %s", doc)
+		}
+		if result := doc.Lookup("result").StringValue(); result != "found" {
+			t.Errorf("结果不正确: got %s, want found", result)
+		}
+	})
+
+	t.Run("拒绝的操作", func(t *testing.T) {
+		doc := run(bsoncore.NewDocumentBuilder().
+			AppendInt32("dropDatabase", 1).
+			AppendString("$db", "test").
+			Build())
+
+		if ok := doc.Lookup("ok").Double(); ok != 0 {
+			t.Fatalf("read 角色不应允许 dropDatabase: %s", doc)
+		}
+		if code := doc.Lookup("code").Int32(); code != 13 {
+			t.Errorf("错误码不正确: got %d, want 13", code)
+		}
+		if codeName := doc.Lookup("codeName").StringValue(); codeName != "Unauthorized" {
+			t.Errorf("错误码名称不正确: got %s, want Unauthorized", codeName)
+		}
+	})
+
+	t.Run("其他数据库被拒绝", func(t *testing.T) {
+		doc := run(bsoncore.NewDocumentBuilder().
+			AppendString("testFind", "users").
+			AppendString("$db", "other").
+			Build())
+
+		if code := doc.Lookup("code").Int32(); code != 13 {
+			t.Errorf("read@test 不应访问其他数据库: %s", doc)
+		}
+	})
+
+	t.Run("握手命令无需鉴权", func(t *testing.T) {
+		doc := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(2,
+			bsoncore.NewDocumentBuilder().
+				AppendInt32("hello", 1).
+				AppendString("$db", "admin").
+				Build())))
+
+		if ok := doc.Lookup("ok").Double(); ok != 1 {
+			t.Fatalf("未认证会话应能执行 hello: %s", doc)
+		}
+	})
+
+	t.Run("未认证用户被拒绝", func(t *testing.T) {
+		doc := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(3,
+			bsoncore.NewDocumentBuilder().
+				AppendString("testFind", "users").
+				AppendString("$db", "test").
+				Build())))
+
+		if code := doc.Lookup("code").Int32(); code != 13 {
+			t.Errorf("未认证用户应被拒绝: %s", doc)
+		}
+	})
+}
+
+// TestRoleGrants 测试内置角色的权限
+func TestRoleGrants(t *testing.T) {
+	tests := []struct {
+		role   RoleName
+		db     string
+		action ActionType
+		want   bool
+	}{
+		{RoleName{"read", "test"}, "test", ActionFind, true},
+		{RoleName{"read", "test"}, "test", ActionInsert, false},
+		{RoleName{"readWrite", "test"}, "test", ActionInsert, true},
+		{RoleName{"readWrite", "test"}, "test", ActionDropDatabase, false},
+		{RoleName{"dbAdmin", "test"}, "test", ActionCreateIndex, true},
+		{RoleName{"dbAdmin", "test"}, "test", ActionDropDatabase, true},
+		{RoleName{"dbAdmin", "test"}, "test", ActionFind, false},
+		{RoleName{"readAnyDatabase", "admin"}, "other", ActionFind, true},
+		{RoleName{"readAnyDatabase", "test"}, "test", ActionFind, false},
+		{RoleName{"readWrite", "test"}, "admin", ActionListDatabases, false},
+		{RoleName{"root", "admin"}, "any", ActionDropDatabase, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.role.grants(tt.db, tt.action); got != tt.want {
+			t.Errorf("%s@%s 在 %s 上执行 %s: got %v, want %v", tt.role.Role, tt.role.DB, tt.db, tt.action, got, tt.want)
+		}
+	}
+}
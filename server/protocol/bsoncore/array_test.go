@@ -0,0 +1,100 @@
+package bsoncore
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// TestArrayRoundTrip 测试混合类型数组的构造与读取
+func TestArrayRoundTrip(t *testing.T) {
+	oid := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	nested := NewArrayBuilder().AppendInt32(7).AppendString("x").Build()
+	doc := NewDocumentBuilder().AppendString("name", "alice").Build()
+
+	arr := NewArrayBuilder().
+		AppendInt32(1).
+		AppendString("two").
+		AppendDouble(3.5).
+		AppendBoolean(true).
+		AppendNull().
+		AppendInt64(1 << 40).
+		AppendObjectID(oid).
+		AppendDocument(doc).
+		AppendArray(nested).
+		StartArray().AppendInt32(8).AppendInt32(9).FinishArray().
+		Build()
+
+	if err := arr.Validate(); err != nil {
+		t.Fatalf("构造的数组无效: %v", err)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		t.Fatalf("读取数组失败: %v", err)
+	}
+	if len(values) != 10 {
+		t.Fatalf("数组应有 10 个元素, got %d", len(values))
+	}
+
+	// 元素的键依次为 "0"、"1"、...
+	elems, err := Document(arr).Elements()
+	if err != nil {
+		t.Fatalf("读取数组元素失败: %v", err)
+	}
+	for i, elem := range elems {
+		if want := strconv.Itoa(i); elem.Key() != want {
+			t.Errorf("第 %d 个元素的键应为 %q, got %q", i, want, elem.Key())
+		}
+	}
+
+	if v := values[0].Int32(); v != 1 {
+		t.Errorf("values[0] = %d, want 1", v)
+	}
+	if v := values[1].StringValue(); v != "two" {
+		t.Errorf("values[1] = %q, want two", v)
+	}
+	if v := values[2].Double(); v != 3.5 {
+		t.Errorf("values[2] = %v, want 3.5", v)
+	}
+	if v := values[3].Boolean(); !v {
+		t.Error("values[3] 应为 true")
+	}
+	if values[4].Type != TypeNull {
+		t.Errorf("values[4] 应为 null, got %s", values[4].Type)
+	}
+	if v := values[5].Int64(); v != 1<<40 {
+		t.Errorf("values[5] = %d, want %d", v, int64(1<<40))
+	}
+	if v := values[6].ObjectID(); v != oid {
+		t.Errorf("values[6] = %x, want %x", v, oid)
+	}
+	if v := values[7].Document().Lookup("name").StringValue(); v != "alice" {
+		t.Errorf("values[7].name = %q, want alice", v)
+	}
+	if !bytes.Equal(values[8].Array(), nested) {
+		t.Errorf("values[8] = %s, want %s", values[8].Array(), nested)
+	}
+	if v := values[9].Array().Index(1).Int32(); v != 9 {
+		t.Errorf("values[9][1] = %d, want 9", v)
+	}
+
+	// 按下标访问与 Values 一致，越界时返回错误
+	if v := arr.Index(1).StringValue(); v != "two" {
+		t.Errorf("Index(1) = %q, want two", v)
+	}
+	if _, err := arr.IndexErr(10); err == nil {
+		t.Error("越界的下标应返回错误")
+	}
+
+	// 底层的 AppendArrayStart/AppendArrayEnd 与 ArrayBuilder 生成相同的字节
+	idx, raw := AppendArrayStart(nil)
+	raw = AppendInt32Element(raw, "0", 7)
+	raw = AppendStringElement(raw, "1", "x")
+	raw, err = AppendArrayEnd(raw, idx)
+	if err != nil {
+		t.Fatalf("结束数组失败: %v", err)
+	}
+	if !bytes.Equal(raw, nested) {
+		t.Errorf("底层接口构造的数组不一致: %x != %x", raw, []byte(nested))
+	}
+}
@@ -7,10 +7,11 @@
 package bsoncore
 
 import (
-	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"strconv"
+	"strings"
 )
 
 // Decimal128 represents a BSON Decimal128 value.
@@ -28,10 +29,58 @@ func (d Decimal128) GetBytes() (h, l uint64) {
 	return d.h, d.l
 }
 
-// String returns the string representation of the decimal value.
+// String returns the string representation of the decimal value, following the
+// decimal128 to-string rules of the BSON specification.
 func (d Decimal128) String() string {
-	// Simplified implementation - just return hex representation for now
-	return fmt.Sprintf("Decimal128(%016x%016x)", d.h, d.l)
+	if d.IsNaN() {
+		return "NaN"
+	}
+	if inf := d.IsInf(); inf != 0 {
+		if inf < 0 {
+			return "-Infinity"
+		}
+		return "Infinity"
+	}
+
+	sign := ""
+	if d.h>>63 == 1 {
+		sign = "-"
+	}
+	var exp int
+	var high uint64
+	if d.h>>61&3 == 3 {
+		// Form 2: the implied significand exceeds the maximum and is treated as zero.
+		exp = int(d.h >> 47 & (1<<14 - 1))
+	} else {
+		exp = int(d.h >> 49 & (1<<14 - 1))
+		high = d.h & (1<<49 - 1)
+	}
+	exp -= decimal128ExponentBias
+
+	sig := new(big.Int).SetUint64(high)
+	sig.Lsh(sig, 64).Or(sig, new(big.Int).SetUint64(d.l))
+	digits := sig.String()
+	if sig.BitLen() > 113 {
+		digits = "0"
+	}
+
+	adjusted := exp + len(digits) - 1
+	if exp <= 0 && adjusted >= -6 {
+		if exp == 0 {
+			return sign + digits
+		}
+		point := len(digits) + exp
+		if point > 0 {
+			return sign + digits[:point] + "." + digits[point:]
+		}
+		return sign + "0." + strings.Repeat("0", -point) + digits
+	}
+
+	s := sign + digits[:1]
+	if len(digits) > 1 {
+		s += "." + digits[1:]
+	}
+	return s + "E" + fmt.Sprintf("%+d", adjusted)
 }
 
 // IsNaN returns if the decimal is NaN.
@@ -50,10 +99,91 @@ func (d Decimal128) IsInf() int {
 	return 1
 }
 
-// ParseDecimal128 parses a string representation of a decimal128 value.
+const (
+	decimal128ExponentBias = 6176
+	decimal128MaxExponent  = 6111
+	decimal128MinExponent  = -6176
+	decimal128MaxDigits    = 34
+)
+
+// ParseDecimal128 parses a string representation of a decimal128 value. Values
+// that cannot be represented exactly are rejected rather than rounded.
 func ParseDecimal128(s string) (Decimal128, error) {
-	// Simplified implementation
-	return Decimal128{}, errors.New("ParseDecimal128 not fully implemented")
+	switch strings.ToLower(s) {
+	case "nan", "+nan", "-nan":
+		return Decimal128NaN, nil
+	case "inf", "+inf", "infinity", "+infinity":
+		return Decimal128PosInf, nil
+	case "-inf", "-infinity":
+		return Decimal128NegInf, nil
+	}
+
+	orig := s
+	negative := false
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+	mantissa, exponent, hasExponent := s, "", false
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mantissa, exponent, hasExponent = s[:i], s[i+1:], true
+	}
+	intPart, fracPart := mantissa, ""
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		intPart, fracPart = mantissa[:i], mantissa[i+1:]
+	}
+	digits := intPart + fracPart
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal128{}, fmt.Errorf("cannot parse %q as a decimal128", orig)
+	}
+	exp := -len(fracPart)
+	if hasExponent {
+		e, err := strconv.Atoi(exponent)
+		if err != nil {
+			return Decimal128{}, fmt.Errorf("cannot parse %q as a decimal128", orig)
+		}
+		exp += e
+	}
+
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		digits = "0"
+	}
+	// Drop trailing zeros that do not fit, or that push the exponent below the minimum.
+	for (len(digits) > decimal128MaxDigits || exp < decimal128MinExponent) && len(digits) > 1 && digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+	if digits == "0" {
+		exp = clampInt(exp, decimal128MinExponent, decimal128MaxExponent)
+	}
+	// Clamp large exponents by padding the significand with zeros.
+	for exp > decimal128MaxExponent && len(digits) < decimal128MaxDigits && digits != "0" {
+		digits += "0"
+		exp--
+	}
+	if len(digits) > decimal128MaxDigits || exp < decimal128MinExponent || exp > decimal128MaxExponent {
+		return Decimal128{}, fmt.Errorf("%q cannot be represented exactly as a decimal128", orig)
+	}
+
+	sig, _ := new(big.Int).SetString(digits, 10)
+	low := new(big.Int).And(sig, new(big.Int).SetUint64(math.MaxUint64)).Uint64()
+	high := new(big.Int).Rsh(sig, 64).Uint64()
+	high |= uint64(exp+decimal128ExponentBias) << 49
+	if negative {
+		high |= 1 << 63
+	}
+	return Decimal128{h: high, l: low}, nil
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
 }
 
 // ParseDecimal128FromBigInt creates a Decimal128 from a big.Int.
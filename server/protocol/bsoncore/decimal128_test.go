@@ -0,0 +1,46 @@
+package bsoncore
+
+import "testing"
+
+// TestDecimal128String 测试 decimal128 与字符串的相互转换
+func TestDecimal128String(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"0", "0"},
+		{"-0", "-0"},
+		{"1", "1"},
+		{"-1", "-1"},
+		{"123.45", "123.45"},
+		{"0.001", "0.001"},
+		{"0.0000001", "1E-7"},
+		{"1E+3", "1E+3"},
+		{"1.000", "1.000"},
+		{"12345678901234567890123456789012.34", "12345678901234567890123456789012.34"},
+		{"1E6144", "1.000000000000000000000000000000000E+6144"},
+		{"NaN", "NaN"},
+		{"Infinity", "Infinity"},
+		{"-Infinity", "-Infinity"},
+	}
+	for _, c := range cases {
+		d, err := ParseDecimal128(c.in)
+		if err != nil {
+			t.Errorf("ParseDecimal128(%q) 失败: %v", c.in, err)
+			continue
+		}
+		if got := d.String(); got != c.want {
+			t.Errorf("ParseDecimal128(%q).String() = %q, want %q", c.in, got, c.want)
+		}
+	}
+
+	// 1 的编码: 指数偏移 6176，有效数字 1
+	if d := NewDecimal128(0x3040000000000000, 1); d.String() != "1" {
+		t.Errorf("0x3040000000000000/1 = %s, want 1", d)
+	}
+	for _, bad := range []string{"", "abc", "1.2.3", "1E", "1E-7000", "12345678901234567890123456789012345"} {
+		if _, err := ParseDecimal128(bad); err == nil {
+			t.Errorf("ParseDecimal128(%q) 应返回错误", bad)
+		}
+	}
+}
@@ -395,35 +395,9 @@ func values(b []byte) ([]Value, error) {
 }
 
 // Validate validates the document and ensures the elements contained within are valid.
+// The leading length must match len(d) exactly, every element must have a known type and a
+// value that fits within the document, strings must be length prefixed and null terminated and
+// nested documents and arrays are validated recursively.
 func (d Document) Validate() error {
-	length, rem, ok := ReadLength(d)
-	if !ok {
-		return NewInsufficientBytesError(d, rem)
-	}
-	if int(length) > len(d) {
-		return NewDocumentLengthError(int(length), len(d))
-	}
-	if d[length-1] != 0x00 {
-		return ErrMissingNull
-	}
-
-	length -= 4
-	var elem Element
-
-	for length > 1 {
-		elem, rem, ok = ReadElement(rem)
-		length -= int32(len(elem))
-		if !ok {
-			return NewInsufficientBytesError(d, rem)
-		}
-		err := elem.Validate()
-		if err != nil {
-			return err
-		}
-	}
-
-	if len(rem) < 1 || rem[0] != 0x00 {
-		return ErrMissingNull
-	}
-	return nil
+	return validateDocument(d, 0, false)
 }
@@ -0,0 +1,181 @@
+package bsoncore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestElementRoundTrip 测试各 BSON 类型经元素追加函数写入后能通过 Document.Lookup 读回
+func TestElementRoundTrip(t *testing.T) {
+	oid := [12]byte{0x65, 0x1f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	now := time.UnixMilli(1700000000123).UTC()
+
+	idx, doc := AppendDocumentStart(nil)
+	doc = AppendDoubleElement(doc, "double", 2.25)
+	doc = AppendStringElement(doc, "string", "hello")
+	doc = AppendInt32Element(doc, "int32", -7)
+	doc = AppendInt64Element(doc, "int64", 1<<50)
+	doc = AppendDateTimeElement(doc, "datetime", now.UnixMilli())
+	doc = AppendNullElement(doc, "null")
+	doc = AppendObjectIDElement(doc, "oid", oid)
+	doc = AppendBinaryElement(doc, "binary", 4, []byte{1, 2, 3})
+	doc = AppendDecimal128Element(doc, "decimal", 0x3040000000000000, 12345)
+	doc = AppendTimestampElement(doc, "timestamp", 1700000000, 3)
+	doc = AppendRegexElement(doc, "regex", "^a.*", "i")
+	doc = AppendBooleanElement(doc, "bool", true)
+	doc, err := AppendDocumentEnd(doc, idx)
+	if err != nil {
+		t.Fatalf("结束文档失败: %v", err)
+	}
+	if err := Document(doc).Validate(); err != nil {
+		t.Fatalf("构造的文档无效: %v", err)
+	}
+	d := Document(doc)
+
+	if v, ok := d.Lookup("double").DoubleOK(); !ok || v != 2.25 {
+		t.Errorf("double = %v, %v", v, ok)
+	}
+	if v, ok := d.Lookup("string").StringValueOK(); !ok || v != "hello" {
+		t.Errorf("string = %q, %v", v, ok)
+	}
+	if v, ok := d.Lookup("int32").Int32OK(); !ok || v != -7 {
+		t.Errorf("int32 = %d, %v", v, ok)
+	}
+	if v, ok := d.Lookup("int64").Int64OK(); !ok || v != 1<<50 {
+		t.Errorf("int64 = %d, %v", v, ok)
+	}
+	if v, ok := d.Lookup("datetime").DateTimeOK(); !ok || v != now.UnixMilli() {
+		t.Errorf("datetime = %d, %v", v, ok)
+	}
+	if v, ok := d.Lookup("datetime").TimeOK(); !ok || !v.Equal(now) {
+		t.Errorf("datetime 时间 = %v, %v", v, ok)
+	}
+	if v := d.Lookup("null"); v.Type != TypeNull {
+		t.Errorf("null 的类型 = %s", v.Type)
+	}
+	if v, ok := d.Lookup("oid").ObjectIDOK(); !ok || v != oid {
+		t.Errorf("oid = %x, %v", v, ok)
+	}
+	if subtype, data, ok := d.Lookup("binary").BinaryOK(); !ok || subtype != 4 || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("binary = %d %v, %v", subtype, data, ok)
+	}
+	if high, low, ok := d.Lookup("decimal").Decimal128OK(); !ok || high != 0x3040000000000000 || low != 12345 {
+		t.Errorf("decimal = %x %x, %v", high, low, ok)
+	}
+	if ts, i, ok := d.Lookup("timestamp").TimestampOK(); !ok || ts != 1700000000 || i != 3 {
+		t.Errorf("timestamp = %d %d, %v", ts, i, ok)
+	}
+	if pattern, options, ok := d.Lookup("regex").RegexOK(); !ok || pattern != "^a.*" || options != "i" {
+		t.Errorf("regex = %q %q, %v", pattern, options, ok)
+	}
+	if v, ok := d.Lookup("bool").BooleanOK(); !ok || !v {
+		t.Errorf("bool = %v, %v", v, ok)
+	}
+
+	// 类型不符时 OK 形式的读取返回 false
+	if _, ok := d.Lookup("string").Int64OK(); ok {
+		t.Error("字符串不应读取为 int64")
+	}
+	if _, ok := d.Lookup("int32").DateTimeOK(); ok {
+		t.Error("int32 不应读取为 datetime")
+	}
+
+	// AppendValueElement 按原类型复制任意值
+	elems, err := d.Elements()
+	if err != nil {
+		t.Fatalf("读取元素失败: %v", err)
+	}
+	idx, copied := AppendDocumentStart(nil)
+	for _, elem := range elems {
+		copied = AppendValueElement(copied, elem.Key(), elem.Value())
+	}
+	if copied, err = AppendDocumentEnd(copied, idx); err != nil {
+		t.Fatalf("结束文档失败: %v", err)
+	}
+	if !bytes.Equal(copied, doc) {
+		t.Errorf("AppendValueElement 复制的文档不一致:\n%s\n%s", Document(copied), d)
+	}
+}
+
+// TestDocumentValidate 测试 Validate 拒绝长度、类型和字符串编码不合法的文档
+func TestDocumentValidate(t *testing.T) {
+	nested := NewDocumentBuilder().AppendString("city", "Paris").Build()
+	valid := NewDocumentBuilder().
+		AppendInt32("_id", 1).
+		AppendString("name", "Alice").
+		AppendDocument("address", nested).
+		AppendArray("tags", NewArrayBuilder().AppendString("a").AppendString("b").Build()).
+		Build()
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("合法文档不应报错: %v", err)
+	}
+
+	// mutate 复制 valid 后修改，保持其余字节不变
+	mutate := func(f func(doc []byte) []byte) Document {
+		return Document(f(append([]byte(nil), valid...)))
+	}
+	offset := func(doc []byte, key string) int {
+		return bytes.Index(doc, []byte(key+"\x00")) - 1
+	}
+	cases := []struct {
+		name string
+		doc  Document
+	}{
+		{"截断的文档", valid[:len(valid)-3]},
+		{"只有长度", Document{5, 0, 0}},
+		{"长度小于实际字节数", mutate(func(doc []byte) []byte {
+			doc[0]--
+			return doc
+		})},
+		{"长度大于实际字节数", mutate(func(doc []byte) []byte {
+			doc[0]++
+			return doc
+		})},
+		{"末尾多出字节", mutate(func(doc []byte) []byte {
+			doc[0]++
+			return append(doc, 0)
+		})},
+		{"缺少结束符", mutate(func(doc []byte) []byte {
+			doc[len(doc)-1] = 1
+			return doc
+		})},
+		{"未知类型", mutate(func(doc []byte) []byte {
+			doc[offset(doc, "name")] = 0x20
+			return doc
+		})},
+		{"字符串长度不匹配", mutate(func(doc []byte) []byte {
+			doc[offset(doc, "name")+len("name")+2]++
+			return doc
+		})},
+		{"字符串缺少结束符", mutate(func(doc []byte) []byte {
+			i := bytes.Index(doc, []byte("Alice\x00"))
+			doc[i+len("Alice")] = 'x'
+			return doc
+		})},
+		{"嵌套文档中的未知类型", mutate(func(doc []byte) []byte {
+			doc[offset(doc, "city")] = 0x20
+			return doc
+		})},
+		{"数组键不连续", mutate(func(doc []byte) []byte {
+			i := bytes.Index(doc, []byte("tags\x00"))
+			j := bytes.Index(doc[i:], []byte{byte(TypeString), '1', 0})
+			doc[i+j+1] = '5'
+			return doc
+		})},
+	}
+	for _, c := range cases {
+		if err := c.doc.Validate(); err == nil {
+			t.Errorf("%s: Validate 应返回错误", c.name)
+		}
+	}
+
+	// 嵌套层数超过上限
+	deep := NewDocumentBuilder().Build()
+	for i := 0; i <= maxValidateDepth; i++ {
+		deep = NewDocumentBuilder().AppendDocument("a", deep).Build()
+	}
+	if err := deep.Validate(); err != ErrTooDeep {
+		t.Errorf("嵌套过深应返回 ErrTooDeep, got %v", err)
+	}
+}
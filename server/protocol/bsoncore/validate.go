@@ -0,0 +1,123 @@
+package bsoncore
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// maxValidateDepth is the deepest nesting of documents and arrays accepted by Validate.
+const maxValidateDepth = 200
+
+// ErrTooDeep is returned by Validate when documents and arrays are nested too deeply.
+const ErrTooDeep ValidationError = "document or array nesting is too deep"
+
+// validateDocument checks that src is exactly one well formed document (or array when isArray
+// is true): the leading length equals len(src), every element has a known type byte, a null
+// terminated key and a value that fits within the document, strings are length prefixed and
+// null terminated, nested documents are valid themselves and the document ends with a null byte.
+func validateDocument(src []byte, depth int, isArray bool) error {
+	if depth > maxValidateDepth {
+		return ErrTooDeep
+	}
+	length, rem, ok := ReadLength(src)
+	if !ok {
+		return NewInsufficientBytesError(src, rem)
+	}
+	if int(length) != len(src) {
+		if isArray {
+			return NewArrayLengthError(int(length), len(src))
+		}
+		return NewDocumentLengthError(int(length), len(src))
+	}
+	if length < 5 {
+		return ErrInvalidLength
+	}
+	if src[length-1] != 0x00 {
+		return ErrMissingNull
+	}
+
+	rem = src[4 : length-1]
+	var keyNum int64
+	for len(rem) > 0 {
+		t := Type(rem[0])
+		idx := bytes.IndexByte(rem[1:], 0x00)
+		if idx == -1 {
+			return ErrElementMissingKey
+		}
+		key := string(rem[1 : idx+1])
+		if isArray {
+			if fmt.Sprint(keyNum) != key {
+				return fmt.Errorf("array key %q is out of order or invalid", key)
+			}
+			keyNum++
+		}
+		rem = rem[idx+2:]
+
+		n, ok := valueLength(rem, t)
+		if !ok {
+			if !isKnownType(t) {
+				return fmt.Errorf("invalid BSON type %#x for key %q", byte(t), key)
+			}
+			return NewInsufficientBytesError(src, rem)
+		}
+		if n < 0 || int(n) > len(rem) {
+			return fmt.Errorf("value of key %q exceeds the document: %w", key, NewInsufficientBytesError(src, rem))
+		}
+		if err := validateValue(key, t, rem[:n], depth); err != nil {
+			return err
+		}
+		rem = rem[n:]
+	}
+	return nil
+}
+
+// isKnownType reports whether t is a BSON type understood by this package.
+func isKnownType(t Type) bool {
+	return (t >= TypeDouble && t <= TypeDecimal128) || t == TypeMinKey || t == TypeMaxKey
+}
+
+// validateValue checks the contents of a value whose length has already been checked.
+func validateValue(key string, t Type, data []byte, depth int) error {
+	switch t {
+	case TypeEmbeddedDocument:
+		return validateDocument(data, depth+1, false)
+	case TypeArray:
+		return validateDocument(data, depth+1, true)
+	case TypeString, TypeJavaScript, TypeSymbol:
+		return validateString(key, data)
+	case TypeDBPointer:
+		return validateString(key, data[:len(data)-12])
+	case TypeBoolean:
+		if data[0] > 1 {
+			return fmt.Errorf("invalid boolean value %#x for key %q", data[0], key)
+		}
+	case TypeCodeWithScope:
+		// int32 total length, code string, scope document
+		if len(data) < 4+5+5 {
+			return NewInsufficientBytesError(data, data)
+		}
+		code := data[4:]
+		n, _, ok := ReadLength(code)
+		if !ok || n < 1 || int(n)+4 > len(code) {
+			return NewInsufficientBytesError(data, code)
+		}
+		if err := validateString(key, code[:n+4]); err != nil {
+			return err
+		}
+		return validateDocument(code[n+4:], depth+1, false)
+	}
+	return nil
+}
+
+// validateString checks that a length prefixed string is null terminated and the prefix covers
+// exactly the remaining bytes.
+func validateString(key string, data []byte) error {
+	n, rem, ok := ReadLength(data)
+	if !ok || n < 1 || int(n) != len(rem) {
+		return fmt.Errorf("string length %d of key %q does not match the %d bytes available", n, key, len(rem))
+	}
+	if rem[n-1] != 0x00 {
+		return fmt.Errorf("string of key %q is missing null terminator", key)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"context"
+	"strings"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	// bulkWrite 混合多种写操作，执行前按操作类型逐一鉴权，见 cmdBulkWrite
+	registerCommand("bulkWrite", ActionNone, (*EventListener).cmdBulkWrite)
+}
+
+// bulkOperationActions bulkWrite 支持的操作及其所需的权限动作
+var bulkOperationActions = map[string]ActionType{
+	"insertOne":  ActionInsert,
+	"updateOne":  ActionUpdate,
+	"updateMany": ActionUpdate,
+	"replaceOne": ActionUpdate,
+	"deleteOne":  ActionRemove,
+	"deleteMany": ActionRemove,
+}
+
+// bulkOperation bulkWrite 命令中的单个操作
+type bulkOperation struct {
+	kind     string           // 操作名，如 insertOne
+	document storage.Document // insertOne 插入的文档
+	update   *updateStatement // updateOne/updateMany/replaceOne 的更新语句
+	delete   *deleteStatement // deleteOne/deleteMany 的删除语句
+}
+
+// bulkDocumentField 读取操作参数中必需的文档字段，同时返回解码后的文档和原始 BSON
+func bulkDocumentField(args bsoncore.Document, kind, field string) (storage.Document, bsoncore.Document, error) {
+	v, err := args.LookupErr(field)
+	if err != nil {
+		return nil, nil, NewCommandError(CodeFailedToParse, "BSON field 'bulkWrite.ops.%s.%s' is missing but a required field", kind, field)
+	}
+	raw, ok := v.DocumentOK()
+	if !ok {
+		return nil, nil, NewCommandError(CodeTypeMismatch, "BSON field 'bulkWrite.ops.%s.%s' is the wrong type '%s', expected type 'object'", kind, field, v.Type)
+	}
+	doc, err := validatedDocument(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, raw, nil
+}
+
+// parseBulkOperation 解析 {insertOne: {document}}、{updateOne: {filter, update, upsert, arrayFilters}}、
+// {replaceOne: {filter, replacement, upsert}}、{deleteOne: {filter}} 等形式的操作
+func parseBulkOperation(raw bsoncore.Document) (*bulkOperation, error) {
+	elems, err := raw.Elements()
+	if err != nil || len(elems) != 1 {
+		return nil, NewCommandError(CodeFailedToParse, "each bulkWrite operation must contain exactly one field")
+	}
+	op := &bulkOperation{kind: elems[0].Key()}
+	if _, ok := bulkOperationActions[op.kind]; !ok {
+		return nil, NewCommandError(CodeFailedToParse, "unknown bulkWrite operation: '%s'", op.kind)
+	}
+	args, ok := elems[0].Value().DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'bulkWrite.ops.%s' is the wrong type '%s', expected type 'object'", op.kind, elems[0].Value().Type)
+	}
+
+	if op.kind == "insertOne" {
+		if op.document, _, err = bulkDocumentField(args, op.kind, "document"); err != nil {
+			return nil, err
+		}
+		return op, nil
+	}
+
+	filter, _, err := bulkDocumentField(args, op.kind, "filter")
+	if err != nil {
+		return nil, err
+	}
+	switch op.kind {
+	case "deleteOne", "deleteMany":
+		op.delete = &deleteStatement{filter: filter, justOne: op.kind == "deleteOne"}
+		return op, nil
+	}
+
+	field := "update"
+	if op.kind == "replaceOne" {
+		field = "replacement"
+	}
+	update, rawUpdate, err := bulkDocumentField(args, op.kind, field)
+	if err != nil {
+		return nil, err
+	}
+	isOperator := len(rawUpdate) > 5 && strings.HasPrefix(rawUpdate.Index(0).Key(), "$")
+	if op.kind == "replaceOne" && isOperator {
+		return nil, NewCommandError(CodeFailedToParse, "the replacement document of replaceOne must not contain update operators")
+	}
+	if op.kind != "replaceOne" && !isOperator {
+		return nil, NewCommandError(CodeFailedToParse, "the update document of %s must contain only update operators", op.kind)
+	}
+	op.update = &updateStatement{
+		filter: filter,
+		update: update,
+		opts:   storage.UpdateOptions{Multi: op.kind == "updateMany"},
+	}
+	if v, err := args.LookupErr("upsert"); err == nil {
+		upsert, ok := v.BooleanOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'bulkWrite.ops.%s.upsert' is the wrong type '%s', expected type 'bool'", op.kind, v.Type)
+		}
+		op.update.opts.Upsert = upsert
+	}
+	if op.update.opts.ArrayFilters, err = arrayFiltersArgument(args, "bulkWrite.ops."+op.kind); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// bulkWriteResult bulkWrite 的汇总结果
+type bulkWriteResult struct {
+	inserted, matched, modified, removed, upserted int32
+	upsertedIDs                                    *bsoncore.ArrayBuilder
+	errs                                           writeErrors
+}
+
+// applyBulkOperation 执行第 index 个操作并累计结果
+func (l *EventListener) applyBulkOperation(ctx context.Context, db, coll string, index int, op *bulkOperation, r *bulkWriteResult) error {
+	switch {
+	case op.document != nil:
+		if err := l.storageEngine.Insert(ctx, db, coll, []storage.Document{op.document}); err != nil {
+			return err
+		}
+		r.inserted++
+	case op.update != nil:
+		result, err := l.storageEngine.Update(ctx, db, coll, op.update.filter, op.update.update, op.update.opts)
+		if err != nil {
+			return err
+		}
+		r.matched += int32(result.Matched)
+		r.modified += int32(result.Modified)
+		if result.UpsertedID != nil {
+			entry, err := storage.MarshalDocument(storage.Document{"index": int32(index), "_id": result.UpsertedID})
+			if err != nil {
+				return err
+			}
+			if r.upsertedIDs == nil {
+				r.upsertedIDs = bsoncore.NewArrayBuilder()
+			}
+			r.upsertedIDs.AppendDocument(entry)
+			r.upserted++
+		}
+	case op.delete != nil:
+		n, err := l.storageEngine.Delete(ctx, db, coll, op.delete.filter, op.delete.justOne)
+		if err != nil {
+			return err
+		}
+		r.removed += int32(n)
+	}
+	return nil
+}
+
+// cmdBulkWrite 处理 bulkWrite 命令，按顺序执行混合的插入、更新和删除操作
+// ordered 为 true（默认）时在第一个失败的操作处停止，否则继续执行其余操作；
+// 单个操作失败记录在 writeErrors 中，命令本身仍返回 ok: 1
+func (l *EventListener) cmdBulkWrite(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	raws, err := documentsArgument(req, "ops")
+	if err != nil {
+		return nil, err
+	}
+	if len(raws) == 0 || len(raws) > maxWriteBatchSize {
+		return nil, NewCommandError(CodeInvalidOptions, "Write batch sizes must be between 1 and %d. Got %d operations.", maxWriteBatchSize, len(raws))
+	}
+
+	// 先解析全部操作并鉴权，避免执行到一半才因格式或权限错误失败
+	ops := make([]*bulkOperation, len(raws))
+	checked := make(map[ActionType]bool)
+	for i, raw := range raws {
+		if ops[i], err = parseBulkOperation(raw); err != nil {
+			return nil, err
+		}
+		action := bulkOperationActions[ops[i].kind]
+		if !checked[action] {
+			if err := l.checkAction(req.session, req.db, req.name, action); err != nil {
+				return nil, err
+			}
+			checked[action] = true
+		}
+	}
+
+	ordered := orderedArgument(req)
+	var r bulkWriteResult
+	for i, op := range ops {
+		if req.retry.skip(i) {
+			continue
+		}
+		if err := l.applyBulkOperation(ctx, req.db, coll, i, op, &r); err != nil {
+			r.errs.add(i, err)
+			if ordered {
+				break
+			}
+			continue
+		}
+		req.retry.done(i)
+	}
+
+	builder := bsoncore.NewDocumentBuilder().
+		AppendInt32("nInserted", r.inserted).
+		AppendInt32("nMatched", r.matched).
+		AppendInt32("nModified", r.modified).
+		AppendInt32("nRemoved", r.removed).
+		AppendInt32("nUpserted", r.upserted)
+	if r.upsertedIDs != nil {
+		builder.AppendArray("upserted", r.upsertedIDs.Build())
+	}
+	return r.errs.appendTo(builder), nil
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// bulkWriteCommandDocument 构造 bulkWrite 命令文档
+func bulkWriteCommandDocument(db, coll string, ordered bool, ops ...bsoncore.Document) bsoncore.Document {
+	arr := bsoncore.NewArrayBuilder()
+	for _, op := range ops {
+		arr.AppendDocument(op)
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("bulkWrite", coll).
+		AppendArray("ops", arr.Build()).
+		AppendBoolean("ordered", ordered).
+		AppendString("$db", db).
+		Build()
+}
+
+// TestBulkWriteCommand 测试 bulkWrite 混合操作的执行顺序、汇总结果和 ordered 语义
+func TestBulkWriteCommand(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	requestID := int32(0)
+	send := func(doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	insertOne := func(id int32, tag string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			StartDocument("insertOne").
+			StartDocument("document").AppendInt32("_id", id).AppendString("tag", tag).FinishDocument().
+			FinishDocument().Build()
+	}
+	setByTag := func(kind, tag string, n int32, upsert bool) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			StartDocument(kind).
+			StartDocument("filter").AppendString("tag", tag).FinishDocument().
+			StartDocument("update").StartDocument("$set").AppendInt32("n", n).FinishDocument().FinishDocument().
+			AppendBoolean("upsert", upsert).
+			FinishDocument().Build()
+	}
+	deleteByTag := func(kind, tag string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			StartDocument(kind).
+			StartDocument("filter").AppendString("tag", tag).FinishDocument().
+			FinishDocument().Build()
+	}
+	replaceOne := func(id int32, tag string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			StartDocument("replaceOne").
+			StartDocument("filter").AppendInt32("_id", id).FinishDocument().
+			StartDocument("replacement").AppendString("tag", tag).FinishDocument().
+			FinishDocument().Build()
+	}
+	count := func(coll string) int {
+		t.Helper()
+		find := bsoncore.NewDocumentBuilder().AppendString("find", coll).AppendString("$db", "test").Build()
+		_, docs := cursorBatch(t, send(find), "firstBatch")
+		return len(docs)
+	}
+	writeErrorIndexes := func(reply bsoncore.Document) []int32 {
+		t.Helper()
+		v, err := reply.LookupErr("writeErrors")
+		if err != nil {
+			return nil
+		}
+		values, err := v.Array().Values()
+		if err != nil {
+			t.Fatalf("读取 writeErrors 失败: %v", err)
+		}
+		var indexes []int32
+		for _, value := range values {
+			indexes = append(indexes, value.Document().Lookup("index").Int32())
+		}
+		return indexes
+	}
+
+	t.Run("混合操作的汇总结果", func(t *testing.T) {
+		reply := send(bulkWriteCommandDocument("test", "mixed", true,
+			insertOne(1, "a"),
+			insertOne(2, "a"),
+			insertOne(3, "b"),
+			setByTag("updateMany", "a", 1, false),
+			setByTag("updateOne", "z", 2, true),
+			replaceOne(3, "c"),
+			deleteByTag("deleteOne", "a"),
+			deleteByTag("deleteMany", "c"),
+		))
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("bulkWrite 失败: %s", reply)
+		}
+		want := map[string]int32{"nInserted": 3, "nMatched": 3, "nModified": 3, "nRemoved": 2, "nUpserted": 1}
+		for field, n := range want {
+			if got := reply.Lookup(field).Int32(); got != n {
+				t.Errorf("%s = %d, want %d: %s", field, got, n, reply)
+			}
+		}
+		upserted, err := reply.Lookup("upserted").Array().Values()
+		if err != nil || len(upserted) != 1 || upserted[0].Document().Lookup("index").Int32() != 4 {
+			t.Errorf("upserted 应记录第 4 个操作插入的文档: %s", reply)
+		}
+		if _, err := reply.LookupErr("writeErrors"); err == nil {
+			t.Errorf("没有失败的操作时不应返回 writeErrors: %s", reply)
+		}
+		if n := count("mixed"); n != 2 {
+			t.Errorf("执行后应剩 2 个文档, got %d", n)
+		}
+	})
+
+	t.Run("ordered 在第一个错误处停止", func(t *testing.T) {
+		reply := send(bulkWriteCommandDocument("test", "ordered", true,
+			insertOne(1, "a"),
+			insertOne(1, "dup"),
+			insertOne(2, "a"),
+			deleteByTag("deleteMany", "a"),
+		))
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("单个操作失败时命令本身应成功: %s", reply)
+		}
+		if indexes := writeErrorIndexes(reply); len(indexes) != 1 || indexes[0] != 1 {
+			t.Errorf("应只记录第 1 个操作的错误: %s", reply)
+		}
+		if reply.Lookup("nInserted").Int32() != 1 || reply.Lookup("nRemoved").Int32() != 0 {
+			t.Errorf("出错后的操作不应执行: %s", reply)
+		}
+		if n := count("ordered"); n != 1 {
+			t.Errorf("应只插入 1 个文档, got %d", n)
+		}
+	})
+
+	t.Run("unordered 出错后继续执行", func(t *testing.T) {
+		reply := send(bulkWriteCommandDocument("test", "unordered", false,
+			insertOne(1, "a"),
+			insertOne(1, "dup"),
+			insertOne(2, "a"),
+			insertOne(2, "dup"),
+			setByTag("updateMany", "a", 7, false),
+		))
+		if indexes := writeErrorIndexes(reply); len(indexes) != 2 || indexes[0] != 1 || indexes[1] != 3 {
+			t.Errorf("应记录第 1 和第 3 个操作的错误: %s", reply)
+		}
+		if reply.Lookup("nInserted").Int32() != 2 || reply.Lookup("nModified").Int32() != 2 {
+			t.Errorf("其余操作应继续执行: %s", reply)
+		}
+	})
+
+	t.Run("无效的操作", func(t *testing.T) {
+		bad := []bsoncore.Document{
+			bsoncore.NewDocumentBuilder().StartDocument("upsertOne").FinishDocument().Build(),
+			bsoncore.NewDocumentBuilder().StartDocument("insertOne").FinishDocument().Build(),
+			// updateOne 的更新文档必须是操作符文档，replaceOne 则不能包含操作符
+			bsoncore.NewDocumentBuilder().
+				StartDocument("updateOne").
+				StartDocument("filter").FinishDocument().
+				StartDocument("update").AppendString("tag", "x").FinishDocument().
+				FinishDocument().Build(),
+			bsoncore.NewDocumentBuilder().
+				StartDocument("replaceOne").
+				StartDocument("filter").FinishDocument().
+				StartDocument("replacement").StartDocument("$set").AppendInt32("n", 1).FinishDocument().FinishDocument().
+				FinishDocument().Build(),
+		}
+		for _, op := range bad {
+			reply := send(bulkWriteCommandDocument("test", "invalid", true, insertOne(1, "a"), op))
+			if reply.Lookup("code").Int32() != int32(CodeFailedToParse) {
+				t.Errorf("%s 应返回 FailedToParse: %s", op, reply)
+			}
+		}
+		if n := count("invalid"); n != 0 {
+			t.Errorf("解析失败时不应执行任何操作, got %d 个文档", n)
+		}
+	})
+}
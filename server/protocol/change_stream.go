@@ -0,0 +1,254 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// change stream 中 $changeStream 之后允许的阶段
+var changeStreamStages = map[string]bool{
+	"$match":   true,
+	"$project": true,
+}
+
+// changeStream 基于 oplog 的 change stream 游标数据来源
+// 每次读取 oplog 中时间戳大于 lastTs 的条目并转换为变更事件
+type changeStream struct {
+	engine       storage.Engine
+	db           string
+	coll         string // 为空时监听整个数据库
+	fullDocument string // default 或 updateLookup
+	stages       []pipelineStage
+	lastTs       storage.Timestamp // 已返回的最后一个 oplog 条目的时间戳
+}
+
+// openChangeStream 根据 $changeStream 参数创建 change stream
+// 支持 resumeAfter/startAfter 恢复令牌和 startAtOperationTime，未指定时从当前时刻开始
+func (l *EventListener) openChangeStream(ctx context.Context, db, coll string, spec storage.Document, stages []pipelineStage) (*changeStream, error) {
+	if spec == nil {
+		return nil, NewCommandError(CodeTypeMismatch, "the $changeStream stage specification must be an object")
+	}
+	for _, stage := range stages {
+		if !changeStreamStages[stage.name] {
+			return nil, NewCommandError(CodeIllegalOperation, "%s is not permitted in a $changeStream pipeline", stage.name)
+		}
+	}
+
+	cs := &changeStream{engine: l.storageEngine, db: db, coll: coll, fullDocument: "default", stages: stages}
+	if v, ok := spec["fullDocument"]; ok {
+		mode, _ := v.(string)
+		if mode != "default" && mode != "updateLookup" {
+			return nil, NewCommandError(CodeBadValue, "unrecognized value for fullDocument: %v", v)
+		}
+		cs.fullDocument = mode
+	}
+
+	switch {
+	case spec["resumeAfter"] != nil || spec["startAfter"] != nil:
+		token, ok := spec["resumeAfter"].(storage.Document)
+		if !ok {
+			token, ok = spec["startAfter"].(storage.Document)
+		}
+		ts, err := parseResumeToken(token)
+		if !ok || err != nil {
+			return nil, NewCommandError(CodeBadValue, "invalid resume token: %v", err)
+		}
+		cs.lastTs = ts
+	case spec["startAtOperationTime"] != nil:
+		ts, ok := spec["startAtOperationTime"].(storage.Timestamp)
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "startAtOperationTime must be a timestamp")
+		}
+		// 包含该时间戳本身的事件
+		cs.lastTs = previousTimestamp(ts)
+	default:
+		entries, err := cs.readOplog(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			cs.lastTs, _ = entries[len(entries)-1]["ts"].(storage.Timestamp)
+		}
+	}
+	return cs, nil
+}
+
+// readOplog 读取 lastTs 之后属于监听范围的 oplog 条目
+func (cs *changeStream) readOplog(ctx context.Context) ([]storage.Document, error) {
+	filter := storage.Document{"ts": storage.Document{"$gt": cs.lastTs}}
+	if cs.coll != "" {
+		filter["ns"] = cs.db + "." + cs.coll
+	}
+	entries, err := cs.engine.Find(ctx, storage.OplogDatabase, storage.OplogCollection, filter)
+	if err != nil {
+		return nil, err
+	}
+	if cs.coll != "" {
+		return entries, nil
+	}
+
+	prefix := cs.db + "."
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if ns, _ := entry["ns"].(string); strings.HasPrefix(ns, prefix) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered, nil
+}
+
+// next 返回新的变更事件，没有新事件时返回空批次
+func (cs *changeStream) next(ctx context.Context, n int) ([]bsoncore.Document, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	entries, err := cs.readOplog(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch []bsoncore.Document
+	for _, entry := range entries {
+		event, err := cs.buildEvent(ctx, entry)
+		if err != nil {
+			return nil, err
+		}
+		cs.lastTs, _ = entry["ts"].(storage.Timestamp)
+
+		keep := true
+		for _, stage := range cs.stages {
+			if event, keep, err = applyDocumentStage(event, stage); err != nil {
+				return nil, err
+			}
+			if !keep {
+				break
+			}
+		}
+		if !keep {
+			continue
+		}
+
+		raw, err := storage.MarshalDocument(event)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, raw)
+		if n > 0 && len(batch) >= n {
+			break
+		}
+	}
+	return batch, nil
+}
+
+// exhausted change stream 是 tailable 游标，不会耗尽
+func (cs *changeStream) exhausted() bool {
+	return false
+}
+
+// resumeToken 返回最后一个已处理事件的恢复令牌
+func (cs *changeStream) resumeToken() bsoncore.Document {
+	raw, _ := storage.MarshalDocument(makeResumeToken(cs.lastTs))
+	return raw
+}
+
+// buildEvent 将 oplog 条目转换为变更事件
+func (cs *changeStream) buildEvent(ctx context.Context, entry storage.Document) (storage.Document, error) {
+	ts, _ := entry["ts"].(storage.Timestamp)
+	ns, _ := entry["ns"].(string)
+	o, _ := entry["o"].(storage.Document)
+	db, coll, _ := strings.Cut(ns, ".")
+
+	event := storage.Document{
+		"_id":         makeResumeToken(ts),
+		"clusterTime": ts,
+		"ns":          storage.Document{"db": db, "coll": coll},
+	}
+	if wall, ok := entry["wall"]; ok {
+		event["wallTime"] = wall
+	}
+
+	switch entry["op"] {
+	case storage.OplogInsert:
+		event["operationType"] = "insert"
+		event["documentKey"] = storage.Document{"_id": o["_id"]}
+		event["fullDocument"] = o
+	case storage.OplogDelete:
+		event["operationType"] = "delete"
+		event["documentKey"] = storage.Document{"_id": o["_id"]}
+	case storage.OplogUpdate:
+		o2, _ := entry["o2"].(storage.Document)
+		key := storage.Document{"_id": o2["_id"]}
+		event["documentKey"] = key
+
+		set, hasSet := o["$set"].(storage.Document)
+		unset, hasUnset := o["$unset"].(storage.Document)
+		if !hasSet && !hasUnset {
+			event["operationType"] = "replace"
+			event["fullDocument"] = o
+			break
+		}
+
+		event["operationType"] = "update"
+		fields := make([]string, 0, len(unset))
+		for field := range unset {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		removed := make([]interface{}, len(fields))
+		for i, field := range fields {
+			removed[i] = field
+		}
+		if set == nil {
+			set = storage.Document{}
+		}
+		event["updateDescription"] = storage.Document{"updatedFields": set, "removedFields": removed}
+
+		if cs.fullDocument == "updateLookup" {
+			docs, err := cs.engine.Find(ctx, db, coll, key)
+			if err != nil {
+				return nil, err
+			}
+			event["fullDocument"] = nil
+			if len(docs) > 0 {
+				event["fullDocument"] = docs[0]
+			}
+		}
+	default:
+		return nil, fmt.Errorf("未知的 oplog 操作类型: %v", entry["op"])
+	}
+	return event, nil
+}
+
+// makeResumeToken 由 oplog 时间戳生成恢复令牌 {_data: "<16 位十六进制>"}
+func makeResumeToken(ts storage.Timestamp) storage.Document {
+	return storage.Document{"_data": fmt.Sprintf("%08X%08X", ts.T, ts.I)}
+}
+
+// parseResumeToken 解析 makeResumeToken 生成的恢复令牌
+func parseResumeToken(token storage.Document) (storage.Timestamp, error) {
+	data, ok := token["_data"].(string)
+	if !ok || len(data) != 16 {
+		return storage.Timestamp{}, fmt.Errorf("恢复令牌格式错误: %v", token)
+	}
+	var ts storage.Timestamp
+	if _, err := fmt.Sscanf(data, "%08X%08X", &ts.T, &ts.I); err != nil {
+		return storage.Timestamp{}, fmt.Errorf("恢复令牌格式错误: %w", err)
+	}
+	return ts, nil
+}
+
+// previousTimestamp 返回紧邻 ts 之前的时间戳
+func previousTimestamp(ts storage.Timestamp) storage.Timestamp {
+	if ts.I > 0 {
+		return storage.Timestamp{T: ts.T, I: ts.I - 1}
+	}
+	if ts.T > 0 {
+		return storage.Timestamp{T: ts.T - 1, I: ^uint32(0)}
+	}
+	return ts
+}
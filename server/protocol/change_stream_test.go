@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// watchCommandDocument 构造 {aggregate: coll, pipeline: [{$changeStream: spec}], cursor: {}}
+func watchCommandDocument(db, coll string, spec bsoncore.Document) bsoncore.Document {
+	pipeline := bsoncore.NewArrayBuilder().
+		AppendDocument(bsoncore.NewDocumentBuilder().AppendDocument("$changeStream", spec).Build()).
+		Build()
+	return bsoncore.NewDocumentBuilder().
+		AppendString("aggregate", coll).
+		AppendArray("pipeline", pipeline).
+		AppendDocument("cursor", bsoncore.NewDocumentBuilder().Build()).
+		AppendString("$db", db).
+		Build()
+}
+
+// getMoreCommandDocument 构造 getMore 命令文档
+func getMoreCommandDocument(db, coll string, id int64, maxTimeMS int64) bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().
+		AppendInt64("getMore", id).
+		AppendString("collection", coll).
+		AppendInt64("maxTimeMS", maxTimeMS).
+		AppendString("$db", db).
+		Build()
+}
+
+// cursorBatch 读取游标结果中的游标 ID 和批次文档
+func cursorBatch(t *testing.T, reply bsoncore.Document, field string) (int64, []bsoncore.Document) {
+	t.Helper()
+	if reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("命令失败: %s", reply)
+	}
+	cursor := reply.Lookup("cursor").Document()
+	values, err := cursor.Lookup(field).Array().Values()
+	if err != nil {
+		t.Fatalf("读取 %s 失败: %v", field, err)
+	}
+	docs := make([]bsoncore.Document, len(values))
+	for i, v := range values {
+		docs[i] = v.Document()
+	}
+	return cursor.Lookup("id").Int64(), docs
+}
+
+// TestChangeStream 测试通过 aggregate/$changeStream 监听集合变更
+func TestChangeStream(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	userDoc := func(id int32, name string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).AppendString("name", name).Build()
+	}
+
+	// 打开 change stream 之前的写入不应出现在事件中
+	run(1, insertCommandDocument("test", "users", userDoc(1, "Alice")))
+
+	id, batch := cursorBatch(t, run(2, watchCommandDocument("test", "users", bsoncore.NewDocumentBuilder().Build())), "firstBatch")
+	if id == 0 || len(batch) != 0 {
+		t.Fatalf("change stream 应返回空的首批结果和有效游标: id=%d, batch=%v", id, batch)
+	}
+
+	run(3, insertCommandDocument("test", "users", userDoc(2, "Bob")))
+	run(4, insertCommandDocument("test", "orders", userDoc(1, "other collection")))
+	run(5, insertCommandDocument("test", "users", userDoc(3, "Carol")))
+
+	nextID, events := cursorBatch(t, run(6, getMoreCommandDocument("test", "users", id, 100)), "nextBatch")
+	if nextID != id {
+		t.Errorf("getMore 后游标应保持打开: got %d, want %d", nextID, id)
+	}
+	if len(events) != 2 {
+		t.Fatalf("应收到 2 个事件, got %d: %v", len(events), events)
+	}
+	first := events[0]
+	if op := first.Lookup("operationType").StringValue(); op != "insert" {
+		t.Errorf("operationType = %s, want insert", op)
+	}
+	if name := first.Lookup("fullDocument", "name").StringValue(); name != "Bob" {
+		t.Errorf("fullDocument.name = %s, want Bob", name)
+	}
+	if key := first.Lookup("documentKey", "_id").Int32(); key != 2 {
+		t.Errorf("documentKey._id = %d, want 2", key)
+	}
+	if coll := first.Lookup("ns", "coll").StringValue(); coll != "users" {
+		t.Errorf("ns.coll = %s, want users", coll)
+	}
+
+	// 没有新事件时 awaitData 等待超时后返回空批次
+	if _, empty := cursorBatch(t, run(7, getMoreCommandDocument("test", "users", id, 20)), "nextBatch"); len(empty) != 0 {
+		t.Errorf("没有新事件时应返回空批次: %v", empty)
+	}
+
+	// 从第一个事件的恢复令牌继续，应收到之后的事件
+	token := first.Lookup("_id").Document()
+	spec := bsoncore.NewDocumentBuilder().AppendDocument("resumeAfter", token).Build()
+	_, resumed := cursorBatch(t, run(8, watchCommandDocument("test", "users", spec)), "firstBatch")
+	if len(resumed) != 1 || resumed[0].Lookup("fullDocument", "name").StringValue() != "Carol" {
+		t.Errorf("恢复后应只收到 Carol 的插入事件: %v", resumed)
+	}
+
+	killCursors := bsoncore.NewDocumentBuilder().
+		AppendString("killCursors", "users").
+		AppendArray("cursors", bsoncore.NewArrayBuilder().AppendInt64(id).Build()).
+		AppendString("$db", "test").
+		Build()
+	if killed, _ := run(9, killCursors).Lookup("cursorsKilled").Array().Values(); len(killed) != 1 {
+		t.Errorf("killCursors 应关闭游标: %v", killed)
+	}
+	if code := run(10, getMoreCommandDocument("test", "users", id, 0)).Lookup("code").Int32(); code != int32(CodeCursorNotFound) {
+		t.Errorf("关闭后的游标 getMore 应返回 CursorNotFound, got %d", code)
+	}
+
+	// 更新、替换和删除事件
+	ctx := context.Background()
+	id, _ = cursorBatch(t, run(11, watchCommandDocument("test", "users", bsoncore.NewDocumentBuilder().Build())), "firstBatch")
+	engine := listener.storageEngine
+	engine.Update(ctx, "test", "users", storage.Document{"_id": int32(1)},
+		storage.Document{"$set": storage.Document{"age": int32(30)}, "$unset": storage.Document{"name": ""}}, storage.UpdateOptions{})
+	engine.Update(ctx, "test", "users", storage.Document{"_id": int32(2)}, storage.Document{"name": "Robert"}, storage.UpdateOptions{})
+	engine.Delete(ctx, "test", "users", storage.Document{"_id": int32(3)}, true)
+
+	_, events = cursorBatch(t, run(12, getMoreCommandDocument("test", "users", id, 100)), "nextBatch")
+	if len(events) != 3 {
+		t.Fatalf("应收到 3 个事件, got %d: %v", len(events), events)
+	}
+	for i, want := range []string{"update", "replace", "delete"} {
+		if op := events[i].Lookup("operationType").StringValue(); op != want {
+			t.Errorf("事件 %d operationType = %s, want %s", i, op, want)
+		}
+	}
+	if age := events[0].Lookup("updateDescription", "updatedFields", "age").Int32(); age != 30 {
+		t.Errorf("updatedFields.age = %d, want 30", age)
+	}
+	if removed := events[0].Lookup("updateDescription", "removedFields", "0").StringValue(); removed != "name" {
+		t.Errorf("removedFields = %s, want [name]", removed)
+	}
+	if name := events[1].Lookup("fullDocument", "name").StringValue(); name != "Robert" {
+		t.Errorf("replace fullDocument.name = %s, want Robert", name)
+	}
+	if key := events[2].Lookup("documentKey", "_id").Int32(); key != 3 {
+		t.Errorf("delete documentKey._id = %d, want 3", key)
+	}
+}
@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("collMod", ActionCollMod, (*EventListener).cmdCollMod)
+	registerCommand("create", ActionCreateCollection, (*EventListener).cmdCreate)
+	registerCommand("createCollection", ActionCreateCollection, (*EventListener).cmdCreate)
+}
+
+// collModIndex collMod 命令中 index 参数指定的索引及修改
+type collModIndex struct {
+	name string
+	mod  storage.IndexModification
+}
+
+// parseCollModIndex 解析 collMod 的 index 参数 {keyPattern 或 name, expireAfterSeconds, hidden}
+// 按键模式指定时返回集合中键模式相同的索引名
+func (l *EventListener) parseCollModIndex(ctx context.Context, db, coll string, v bsoncore.Value) (*collModIndex, error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'collMod.index' is the wrong type '%s', expected type 'object'", v.Type)
+	}
+	keyPattern, keyErr := doc.LookupErr("keyPattern")
+	nameValue, nameErr := doc.LookupErr("name")
+	if (keyErr == nil) == (nameErr == nil) {
+		return nil, NewCommandError(CodeInvalidOptions, "must specify either index name or key pattern")
+	}
+
+	target := &collModIndex{}
+	if nameErr == nil {
+		if target.name, ok = nameValue.StringValueOK(); !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'collMod.index.name' is the wrong type '%s', expected type 'string'", nameValue.Type)
+		}
+	} else {
+		name, err := l.indexNameByKeyPattern(ctx, db, coll, keyPattern)
+		if err != nil {
+			return nil, err
+		}
+		target.name = name
+	}
+
+	if v, err := doc.LookupErr("expireAfterSeconds"); err == nil {
+		seconds, ok := v.AsInt64OK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'collMod.index.expireAfterSeconds' is the wrong type '%s', expected a number", v.Type)
+		}
+		if seconds <= 0 || seconds > math.MaxInt32 {
+			return nil, NewCommandError(CodeInvalidOptions, "TTL index 'expireAfterSeconds' option must be within an acceptable range [1, %d], got %d", math.MaxInt32, seconds)
+		}
+		n := int(seconds)
+		target.mod.ExpireAfterSeconds = &n
+	}
+	if v, err := doc.LookupErr("hidden"); err == nil {
+		hidden, ok := v.BooleanOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'collMod.index.hidden' is the wrong type '%s', expected type 'bool'", v.Type)
+		}
+		target.mod.Hidden = &hidden
+	}
+	if target.mod.ExpireAfterSeconds == nil && target.mod.Hidden == nil {
+		return nil, NewCommandError(CodeInvalidOptions, "no expireAfterSeconds or hidden field")
+	}
+	return target, nil
+}
+
+// validationArguments 读取命令中的 validator、validationLevel 和 validationAction 参数，覆盖 opts 中对应的选项
+// 返回是否指定了其中任一参数
+func validationArguments(req *commandRequest, opts *storage.ValidationOptions) (bool, error) {
+	changed := false
+	if v, err := req.body.LookupErr("validator"); err == nil {
+		doc, ok := v.DocumentOK()
+		if !ok {
+			return false, NewCommandError(CodeTypeMismatch, "BSON field '%s.validator' is the wrong type '%s', expected type 'object'", req.name, v.Type)
+		}
+		if opts.Validator, err = storage.UnmarshalDocument(doc); err != nil {
+			return false, NewCommandError(CodeFailedToParse, "%v", err)
+		}
+		changed = true
+	}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"validationLevel", &opts.Level},
+		{"validationAction", &opts.Action},
+	} {
+		v, err := req.body.LookupErr(field.name)
+		if err != nil {
+			continue
+		}
+		s, ok := v.StringValueOK()
+		if !ok {
+			return false, NewCommandError(CodeTypeMismatch, "BSON field '%s.%s' is the wrong type '%s', expected type 'string'", req.name, field.name, v.Type)
+		}
+		*field.value = s
+		changed = true
+	}
+	return changed, nil
+}
+
+// cappedArguments 读取 create 命令的 capped、size 和 max 参数，capped 为 true 时必须指定正数的 size
+func cappedArguments(req *commandRequest) (capped bool, sizeBytes, maxDocs int64, err error) {
+	if v, lookupErr := req.body.LookupErr("capped"); lookupErr == nil {
+		var ok bool
+		if capped, ok = v.BooleanOK(); !ok {
+			return false, 0, 0, NewCommandError(CodeTypeMismatch, "BSON field '%s.capped' is the wrong type '%s', expected type 'bool'", req.name, v.Type)
+		}
+	}
+	if !capped {
+		return false, 0, 0, nil
+	}
+	v, lookupErr := req.body.LookupErr("size")
+	if lookupErr != nil {
+		return false, 0, 0, NewCommandError(CodeInvalidOptions, "the 'size' field is required when 'capped' is true")
+	}
+	sizeBytes, ok := v.AsInt64OK()
+	if !ok {
+		return false, 0, 0, NewCommandError(CodeTypeMismatch, "BSON field '%s.size' is the wrong type '%s', expected a number", req.name, v.Type)
+	}
+	if sizeBytes <= 0 {
+		return false, 0, 0, NewCommandError(CodeInvalidOptions, "the 'size' field must be a positive number, got %d", sizeBytes)
+	}
+	if v, lookupErr := req.body.LookupErr("max"); lookupErr == nil {
+		if maxDocs, ok = v.AsInt64OK(); !ok {
+			return false, 0, 0, NewCommandError(CodeTypeMismatch, "BSON field '%s.max' is the wrong type '%s', expected a number", req.name, v.Type)
+		}
+		// 与 mongod 一致，max 不大于 0 表示不限制文档数
+		if maxDocs < 0 {
+			maxDocs = 0
+		}
+	}
+	return true, sizeBytes, maxDocs, nil
+}
+
+// cmdCreate 处理 create 命令，显式创建集合；capped 为 true 时创建固定集合，并可同时设置校验规则
+// 集合已存在时返回 NamespaceExists；校验规则不合法时不创建集合
+func (l *EventListener) cmdCreate(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	capped, sizeBytes, maxDocs, err := cappedArguments(req)
+	if err != nil {
+		return nil, err
+	}
+	var validation storage.ValidationOptions
+	hasValidation, err := validationArguments(req, &validation)
+	if err != nil {
+		return nil, err
+	}
+	if hasValidation {
+		if err := validation.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := l.storageEngine.CreateDatabase(ctx, req.db); err != nil && !errors.Is(err, storage.ErrNamespaceExists) {
+		return nil, err
+	}
+	if capped {
+		err = l.storageEngine.CreateCappedCollection(ctx, req.db, coll, sizeBytes, maxDocs)
+	} else {
+		err = l.storageEngine.CreateCollection(ctx, req.db, coll)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hasValidation {
+		if err := l.storageEngine.SetValidation(ctx, req.db, coll, validation); err != nil {
+			return nil, err
+		}
+	}
+	return bsoncore.NewDocumentBuilder(), nil
+}
+
+// cmdCollMod 处理 collMod 命令，修改集合的校验规则和索引选项
+// 未指定的校验选项保持不变；修改索引时与 mongod 一致返回 expireAfterSeconds_old/new 和 hidden_old/new
+// 任一修改失败时整个命令不生效：先检查全部参数再修改，修改索引失败时恢复原来的校验规则
+func (l *EventListener) cmdCollMod(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	current, err := l.storageEngine.CollectionValidation(ctx, req.db, coll)
+	if err != nil {
+		return nil, NewCommandError(CodeNamespaceNotFound, "ns does not exist")
+	}
+
+	validation := current
+	changeValidation, err := validationArguments(req, &validation)
+	if err != nil {
+		return nil, err
+	}
+
+	var index *collModIndex
+	if v, err := req.body.LookupErr("index"); err == nil {
+		if index, err = l.parseCollModIndex(ctx, req.db, coll, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if changeValidation {
+		if err := validation.Validate(); err != nil {
+			return nil, err
+		}
+		if err := l.storageEngine.SetValidation(ctx, req.db, coll, validation); err != nil {
+			return nil, err
+		}
+	}
+	builder := bsoncore.NewDocumentBuilder()
+	if index != nil {
+		old, err := l.storageEngine.ModifyIndex(ctx, req.db, coll, index.name, index.mod)
+		if err != nil {
+			if changeValidation {
+				l.storageEngine.SetValidation(ctx, req.db, coll, current)
+			}
+			return nil, err
+		}
+		if index.mod.ExpireAfterSeconds != nil {
+			builder.AppendInt64("expireAfterSeconds_old", int64(old.ExpireAfterSeconds)).
+				AppendInt64("expireAfterSeconds_new", int64(*index.mod.ExpireAfterSeconds))
+		}
+		if index.mod.Hidden != nil {
+			builder.AppendBoolean("hidden_old", old.Hidden).
+				AppendBoolean("hidden_new", *index.mod.Hidden)
+		}
+	}
+	return builder, nil
+}
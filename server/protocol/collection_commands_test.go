@@ -0,0 +1,254 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestCollMod 测试 collMod 修改校验规则和索引选项后立即生效
+func TestCollMod(t *testing.T) {
+	ctx := context.Background()
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	collMod := func(coll string) *bsoncore.DocumentBuilder {
+		return bsoncore.NewDocumentBuilder().AppendString("collMod", coll)
+	}
+	insertCode := func(requestID int32, coll string, doc bsoncore.Document) int32 {
+		t.Helper()
+		reply := run(requestID, insertCommandDocument("test", coll, doc))
+		v, err := reply.LookupErr("writeErrors")
+		if err != nil {
+			return 0
+		}
+		errs, err := v.Array().Values()
+		if err != nil || len(errs) == 0 {
+			return 0
+		}
+		return errs[0].Document().Lookup("code").Int32()
+	}
+
+	t.Run("校验规则", func(t *testing.T) {
+		seed := bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("name", "a").Build()
+		if code := insertCode(1, "people", seed); code != 0 {
+			t.Fatalf("插入失败, code %d", code)
+		}
+		validator := bsoncore.NewDocumentBuilder().
+			StartDocument("$jsonSchema").
+			AppendArray("required", bsoncore.NewArrayBuilder().AppendString("email").Build()).
+			FinishDocument().
+			Build()
+		reply := run(2, collMod("people").AppendDocument("validator", validator).AppendString("$db", "test").Build())
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("collMod 失败: %s", reply)
+		}
+		noEmail := bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).Build()
+		if code := insertCode(3, "people", noEmail); code != int32(CodeDocumentValidation) {
+			t.Errorf("缺少 email 的文档应返回 DocumentValidationFailure, code %d", code)
+		}
+
+		// 只修改处理方式时保留原来的校验规则
+		reply = run(4, collMod("people").AppendString("validationAction", "warn").AppendString("$db", "test").Build())
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("collMod 失败: %s", reply)
+		}
+		got, err := listener.storageEngine.CollectionValidation(ctx, "test", "people")
+		if err != nil || len(got.Validator) == 0 || got.Action != storage.ValidationActionWarn {
+			t.Fatalf("校验规则 = %v, %v", got, err)
+		}
+		if code := insertCode(5, "people", noEmail); code != 0 {
+			t.Errorf("warn 方式不应拒绝写入, code %d", code)
+		}
+
+		bad := collMod("people").AppendString("validationLevel", "sometimes").AppendString("$db", "test").Build()
+		if code := run(6, bad).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("未知的 validationLevel 应返回 BadValue, got %d", code)
+		}
+		missing := collMod("missing").AppendDocument("validator", validator).AppendString("$db", "test").Build()
+		if code := run(7, missing).Lookup("code").Int32(); code != int32(CodeNamespaceNotFound) {
+			t.Errorf("集合不存在时应返回 NamespaceNotFound, got %d", code)
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		ttl := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("createdAt", 1).Build()).
+			AppendInt32("expireAfterSeconds", 24*3600).
+			Build()
+		if reply := run(10, createIndexesCommandDocument("test", "sessions", ttl)); reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("创建 TTL 索引失败: %s", reply)
+		}
+		twoHoursAgo := time.Now().Add(-2 * time.Hour)
+		doc := bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendDateTime("createdAt", twoHoursAgo.UnixMilli()).Build()
+		if code := insertCode(11, "sessions", doc); code != 0 {
+			t.Fatalf("插入失败, code %d", code)
+		}
+		engine := listener.storageEngine.(*storage.MemoryEngine)
+		if n, err := engine.ExpireDocuments(ctx, time.Now()); err != nil || n != 0 {
+			t.Fatalf("一天内的文档不应过期: %d, %v", n, err)
+		}
+
+		index := bsoncore.NewDocumentBuilder().
+			AppendDocument("keyPattern", bsoncore.NewDocumentBuilder().AppendInt32("createdAt", 1).Build()).
+			AppendInt32("expireAfterSeconds", 3600).
+			Build()
+		reply := run(12, collMod("sessions").AppendDocument("index", index).AppendString("$db", "test").Build())
+		if reply.Lookup("ok").Double() != 1 ||
+			reply.Lookup("expireAfterSeconds_old").Int64() != 24*3600 ||
+			reply.Lookup("expireAfterSeconds_new").Int64() != 3600 {
+			t.Fatalf("collMod 结果不正确: %s", reply)
+		}
+		if n, err := engine.ExpireDocuments(ctx, time.Now()); err != nil || n != 1 {
+			t.Errorf("改为一小时后两小时前的文档应过期: %d, %v", n, err)
+		}
+
+		notTTL := bsoncore.NewDocumentBuilder().AppendString("name", "_id_").AppendInt32("expireAfterSeconds", 10).Build()
+		if code := run(13, collMod("sessions").AppendDocument("index", notTTL).AppendString("$db", "test").Build()).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("修改非 TTL 索引的 expireAfterSeconds 应返回 BadValue, got %d", code)
+		}
+		unknown := bsoncore.NewDocumentBuilder().AppendString("name", "nope").AppendBoolean("hidden", true).Build()
+		if code := run(14, collMod("sessions").AppendDocument("index", unknown).AppendString("$db", "test").Build()).Lookup("code").Int32(); code != int32(CodeIndexNotFound) {
+			t.Errorf("索引不存在时应返回 IndexNotFound, got %d", code)
+		}
+
+		// 修改索引失败时同一命令中的校验规则也不生效
+		failing := collMod("sessions").
+			AppendDocument("validator", bsoncore.NewDocumentBuilder().AppendDocument("createdAt", bsoncore.NewDocumentBuilder().AppendString("$type", "date").Build()).Build()).
+			AppendDocument("index", notTTL).
+			AppendString("$db", "test").
+			Build()
+		if code := run(15, failing).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("修改非 TTL 索引的 expireAfterSeconds 应返回 BadValue, got %d", code)
+		}
+		if got, err := listener.storageEngine.CollectionValidation(ctx, "test", "sessions"); err != nil || len(got.Validator) != 0 {
+			t.Errorf("collMod 失败后不应设置校验规则, got %v, %v", got, err)
+		}
+	})
+
+	t.Run("隐藏索引", func(t *testing.T) {
+		spec := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("x", 1).Build()).
+			Build()
+		if reply := run(20, createIndexesCommandDocument("test", "items", spec)); reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("创建索引失败: %s", reply)
+		}
+		hinted := bsoncore.NewDocumentBuilder().
+			AppendString("find", "items").
+			AppendString("hint", "x_1").
+			AppendString("$db", "test").
+			Build()
+		setHidden := func(requestID int32, hidden bool) bsoncore.Document {
+			index := bsoncore.NewDocumentBuilder().AppendString("name", "x_1").AppendBoolean("hidden", hidden).Build()
+			return run(requestID, collMod("items").AppendDocument("index", index).AppendString("$db", "test").Build())
+		}
+
+		reply := setHidden(21, true)
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("hidden_old").Boolean() || !reply.Lookup("hidden_new").Boolean() {
+			t.Fatalf("collMod 结果不正确: %s", reply)
+		}
+		if code := run(22, hinted).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("隐藏的索引不能用于 hint, got %d", code)
+		}
+		list := bsoncore.NewDocumentBuilder().AppendString("listIndexes", "items").AppendString("$db", "test").Build()
+		if _, batch := cursorBatch(t, run(23, list), "firstBatch"); len(batch) != 2 || !batch[1].Lookup("hidden").Boolean() {
+			t.Errorf("listIndexes 应返回 hidden: %v", batch)
+		}
+
+		reply = setHidden(24, false)
+		if !reply.Lookup("hidden_old").Boolean() || reply.Lookup("hidden_new").Boolean() {
+			t.Fatalf("collMod 结果不正确: %s", reply)
+		}
+		if reply := run(25, hinted); reply.Lookup("ok").Double() != 1 {
+			t.Errorf("取消隐藏后应能使用索引: %s", reply)
+		}
+
+		id := bsoncore.NewDocumentBuilder().AppendString("name", "_id_").AppendBoolean("hidden", true).Build()
+		if code := run(26, collMod("items").AppendDocument("index", id).AppendString("$db", "test").Build()).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("隐藏 _id 索引应返回 BadValue, got %d", code)
+		}
+	})
+}
+
+// TestCreateCollection 测试 create 命令创建固定集合和带校验规则的集合，集合已存在时返回 NamespaceExists
+func TestCreateCollection(t *testing.T) {
+	ctx := context.Background()
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	create := func(coll string) *bsoncore.DocumentBuilder {
+		return bsoncore.NewDocumentBuilder().AppendString("create", coll)
+	}
+
+	t.Run("固定集合", func(t *testing.T) {
+		reply := run(1, create("events").
+			AppendBoolean("capped", true).
+			AppendInt64("size", 1<<20).
+			AppendInt32("max", 3).
+			AppendString("$db", "test").
+			Build())
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("create 失败: %s", reply)
+		}
+		for i := int32(1); i <= 5; i++ {
+			run(1+i, insertCommandDocument("test", "events", bsoncore.NewDocumentBuilder().AppendInt32("_id", i).Build()))
+		}
+		docs, err := listener.storageEngine.Find(ctx, "test", "events", storage.Document{})
+		if err != nil || len(docs) != 3 {
+			t.Fatalf("固定集合应只保留 3 个文档: %v, %v", docs, err)
+		}
+		for _, doc := range docs {
+			if doc["_id"].(int32) < 3 {
+				t.Errorf("应淘汰最早插入的文档: %v", docs)
+			}
+		}
+
+		if code := run(10, create("events").AppendString("$db", "test").Build()).Lookup("code").Int32(); code != int32(CodeNamespaceExists) {
+			t.Errorf("集合已存在时应返回 NamespaceExists, got %d", code)
+		}
+		noSize := create("other").AppendBoolean("capped", true).AppendString("$db", "test").Build()
+		if code := run(11, noSize).Lookup("code").Int32(); code != int32(CodeInvalidOptions) {
+			t.Errorf("固定集合缺少 size 时应返回 InvalidOptions, got %d", code)
+		}
+	})
+
+	t.Run("校验规则", func(t *testing.T) {
+		validator := bsoncore.NewDocumentBuilder().
+			StartDocument("age").AppendInt32("$gte", 0).FinishDocument().
+			Build()
+		reply := run(20, create("people").
+			AppendDocument("validator", validator).
+			AppendString("validationLevel", "strict").
+			AppendString("validationAction", "error").
+			AppendString("$db", "test").
+			Build())
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("create 失败: %s", reply)
+		}
+		reply = run(21, insertCommandDocument("test", "people", bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendInt32("age", -1).Build()))
+		if errs, err := reply.Lookup("writeErrors").Array().Values(); err != nil || len(errs) != 1 ||
+			errs[0].Document().Lookup("code").Int32() != int32(CodeDocumentValidation) {
+			t.Errorf("不满足校验规则的文档应返回 DocumentValidationFailure: %s", reply)
+		}
+		if reply := run(22, insertCommandDocument("test", "people", bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendInt32("age", 30).Build())); reply.Lookup("n").Int32() != 1 {
+			t.Errorf("满足校验规则的文档应插入成功: %s", reply)
+		}
+
+		// 校验规则不合法时不创建集合
+		invalid := create("broken").AppendString("validationLevel", "sometimes").AppendString("$db", "test").Build()
+		if code := run(23, invalid).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("未知的校验级别应返回 BadValue, got %d", code)
+		}
+		if _, err := listener.storageEngine.CollectionValidation(ctx, "test", "broken"); err == nil {
+			t.Errorf("校验规则不合法时不应创建集合")
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// redactedValue 替换敏感字段值的占位符
+const redactedValue = "###"
+
+// redactedFields 各命令中需要在日志、system.profile 和 currentOp 中隐藏的敏感字段
+var redactedFields = map[string][]string{
+	"createUser":   {"pwd"},
+	"updateUser":   {"pwd"},
+	"saslStart":    {"payload"},
+	"saslContinue": {"payload"},
+	"authenticate": {"key"},
+}
+
+// redactCommand 返回隐藏了敏感字段的命令文档，命令没有敏感字段时原样返回
+func redactCommand(name string, body bsoncore.Document) bsoncore.Document {
+	fields := redactedFields[name]
+	if len(fields) == 0 {
+		return body
+	}
+	elems, err := body.Elements()
+	if err != nil {
+		return body
+	}
+	builder := bsoncore.NewDocumentBuilder()
+	for _, elem := range elems {
+		sensitive := false
+		for _, field := range fields {
+			sensitive = sensitive || elem.Key() == field
+		}
+		if sensitive {
+			builder.AppendString(elem.Key(), redactedValue)
+		} else {
+			builder.AppendValue(elem.Key(), elem.Value())
+		}
+	}
+	return builder.Build()
+}
+
+// commandNamespace 返回命令作用的命名空间，命令不针对集合时为 db.$cmd
+func commandNamespace(req *commandRequest) string {
+	if first, err := req.body.IndexErr(0); err == nil {
+		if coll, ok := first.Value().StringValueOK(); ok && coll != "" {
+			return req.db + "." + coll
+		}
+	}
+	return req.db + ".$cmd"
+}
+
+// logCommand 在 info 级别记录一次命令执行，logger.log_commands 为 true 时启用
+// 记录命令名、命名空间、耗时、结果以及隐藏了敏感字段的命令文档
+func (l *EventListener) logCommand(ctx context.Context, req *commandRequest, reply bsoncore.Document, elapsed time.Duration) {
+	fields := logrus.Fields{
+		"command":        req.name,
+		"ns":             commandNamespace(req),
+		"durationMillis": elapsed.Milliseconds(),
+		"body":           redactCommand(req.name, req.body).String(),
+	}
+	if v, err := reply.LookupErr("ok"); err == nil {
+		fields["ok"] = v.Double()
+	}
+	if v, err := reply.LookupErr("code"); err == nil {
+		fields["errCode"] = v.Int32()
+	}
+	for _, name := range []string{"firstBatch", "nextBatch"} {
+		if v, err := reply.LookupErr("cursor", name); err == nil {
+			if arr, ok := v.ArrayOK(); ok {
+				if docs, err := arr.Values(); err == nil {
+					fields["nReturned"] = len(docs)
+				}
+			}
+		}
+	}
+	for _, name := range []string{"n", "nModified"} {
+		if v, err := reply.LookupErr(name); err == nil {
+			if n, ok := v.AsInt64OK(); ok {
+				fields[name] = n
+			}
+		}
+	}
+	logger.FromContext(ctx).WithFields(fields).Info("命令执行完成")
+}
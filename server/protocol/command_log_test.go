@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestCommandLogging 测试开启 log_commands 后记录每个命令，createUser 的密码被隐藏
+func TestCommandLogging(t *testing.T) {
+	var buf bytes.Buffer
+	log := logger.GetLogger()
+	out, level := log.Out, log.GetLevel()
+	log.SetOutput(&buf)
+	log.SetLevel(logrus.InfoLevel)
+	defer func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+	}()
+
+	run := func(listener *EventListener, cmd bsoncore.Document) {
+		t.Helper()
+		replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, cmd)))
+	}
+	createUser := bsoncore.NewDocumentBuilder().
+		AppendString("createUser", "alice").
+		AppendString("pwd", "s3cret-password").
+		AppendString("$db", "admin").
+		Build()
+
+	// 未开启时不记录命令
+	run(newTestListener(t, &config.Config{}), createUser)
+	if strings.Contains(buf.String(), "命令执行完成") {
+		t.Fatalf("未开启 log_commands 时不应记录命令: %s", buf.String())
+	}
+
+	listener := newTestListener(t, &config.Config{Logger: config.LoggerConfig{LogCommands: true}})
+	run(listener, createUser)
+	logged := buf.String()
+	if strings.Contains(logged, "s3cret-password") {
+		t.Errorf("日志中不应出现密码: %s", logged)
+	}
+	if !strings.Contains(logged, "command=createUser") || !strings.Contains(logged, redactedValue) {
+		t.Errorf("日志应记录命令名和隐藏后的字段: %s", logged)
+	}
+
+	buf.Reset()
+	run(listener, insertCommandDocument("test", "items",
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).Build()))
+	run(listener, bsoncore.NewDocumentBuilder().AppendString("find", "items").AppendString("$db", "test").Build())
+	logged = buf.String()
+	for _, want := range []string{"command=insert", "ns=test.items", "n=2", "command=find", "nReturned=2", "durationMillis="} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("日志应包含 %q: %s", want, logged)
+		}
+	}
+}
+
+// TestRequestLogFields 测试请求处理中的日志带有连接地址和请求 ID
+func TestRequestLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	log := logger.GetLogger()
+	out, level := log.Out, log.GetLevel()
+	log.SetOutput(&buf)
+	log.SetLevel(logrus.DebugLevel)
+	defer func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+	}()
+
+	listener := newTestListener(t, &config.Config{Logger: config.LoggerConfig{LogCommands: true}})
+	listener.OnMessage(newFakeSession(), newOpMsgMessage(42, pingCommandDocument()))
+	// 只有标志没有 section 的 OP_MSG 解析失败
+	malformed := newOpMsgMessage(43, pingCommandDocument())
+	malformed.Body = malformed.Body[:4]
+	listener.handleMessage(newFakeSession(), malformed)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for _, want := range []struct{ msg, requestID string }{
+		{"收到消息", "requestId=42"},
+		{"执行命令: admin.ping", "requestId=42"},
+		{"命令执行完成", "requestId=42"},
+		{"解析 OP_MSG 失败", "requestId=43"},
+	} {
+		found := false
+		for _, line := range lines {
+			if strings.Contains(line, want.msg) {
+				found = true
+				if !strings.Contains(line, want.requestID) || !strings.Contains(line, "127.0.0.1:50000") {
+					t.Errorf("%q 的日志应带有 %s 和远端地址: %s", want.msg, want.requestID, line)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("缺少日志 %q: %s", want.msg, buf.String())
+		}
+	}
+}
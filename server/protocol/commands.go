@@ -0,0 +1,454 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+const (
+	maxMessageSizeBytes = 48000000 // 单条消息最大长度
+	maxWriteBatchSize   = 100000   // 单批写操作最大文档数
+	minWireVersion      = 0
+	maxWireVersion      = 17
+)
+
+// commandRequest 命令请求
+type commandRequest struct {
+	name      string                         // 命令名（命令文档的第一个字段）
+	db        string                         // 目标数据库（$db）
+	body      bsoncore.Document              // 命令文档
+	sequences map[string][]bsoncore.Document // OP_MSG kind 1 文档序列
+	session   getty.Session
+	txn       *logicalSession      // 命令所属的事务，不在事务中时为 nil
+	retry     *retryableStatements // 可重试写操作的语句执行记录，不是可重试写操作时为 nil
+}
+
+// commandFunc 命令处理函数，返回不含 ok 字段的结果文档构造器
+type commandFunc func(l *EventListener, ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error)
+
+// commandSpec 命令注册信息
+type commandSpec struct {
+	name    string
+	action  ActionType // 执行命令所需的权限动作
+	handler commandFunc
+}
+
+// commandRegistry 命令名到命令注册信息的映射
+var commandRegistry = make(map[string]*commandSpec)
+
+// registerCommand 注册命令及其所需的权限动作
+// 新增命令必须在注册时声明权限，ActionNone 表示无需鉴权
+func registerCommand(name string, action ActionType, handler commandFunc) {
+	commandRegistry[name] = &commandSpec{
+		name:    name,
+		action:  action,
+		handler: handler,
+	}
+}
+
+func init() {
+	registerCommand("ping", ActionNone, (*EventListener).cmdPing)
+	registerCommand("hello", ActionNone, (*EventListener).cmdHello)
+	registerCommand("isMaster", ActionNone, (*EventListener).cmdHello)
+	registerCommand("ismaster", ActionNone, (*EventListener).cmdHello)
+	registerCommand("listDatabases", ActionListDatabases, (*EventListener).cmdListDatabases)
+	registerCommand("dropDatabase", ActionDropDatabase, (*EventListener).cmdDropDatabase)
+	registerCommand("collStats", ActionCollStats, (*EventListener).cmdCollStats)
+	registerCommand("validate", ActionValidate, (*EventListener).cmdValidate)
+	registerCommand("compact", ActionCompact, (*EventListener).cmdCompact)
+}
+
+// newCommandRequest 从命令文档构造命令请求
+func newCommandRequest(session getty.Session, body bsoncore.Document, sequences map[string][]bsoncore.Document) (*commandRequest, error) {
+	first, err := body.IndexErr(0)
+	if err != nil {
+		return nil, fmt.Errorf("命令文档为空: %w", err)
+	}
+
+	// 未指定 $db 时沿用连接上一次命令的数据库
+	db := "admin"
+	if session != nil {
+		if current := stateOf(session).currentDatabase(); current != "" {
+			db = current
+		}
+	}
+	if v, err := body.LookupErr("$db"); err == nil {
+		name, ok := v.StringValueOK()
+		if !ok {
+			return nil, fmt.Errorf("$db 必须是字符串")
+		}
+		db = name
+	}
+
+	return &commandRequest{
+		name:      first.Key(),
+		db:        db,
+		body:      body,
+		sequences: sequences,
+		session:   session,
+	}, nil
+}
+
+// runCommand 查找、鉴权并执行命令，返回结果文档
+func (l *EventListener) runCommand(ctx context.Context, req *commandRequest) (reply bsoncore.Document) {
+	if l.config.Logger.LogCommands {
+		start := time.Now()
+		defer func() { l.logCommand(ctx, req, reply, time.Since(start)) }()
+	}
+
+	spec, ok := commandRegistry[req.name]
+	if !ok {
+		return errorDocument(NewCommandError(CodeCommandNotFound, "no such command: '%s'", req.name))
+	}
+
+	if err := l.checkAuthorization(req.session, req.db, spec); err != nil {
+		logger.FromContext(ctx).Warnf("命令 %s 鉴权失败: %v", req.name, err)
+		return errorDocument(err)
+	}
+	if err := l.rateLimiter.allow(req.session, spec); err != nil {
+		logger.FromContext(ctx).Warnf("命令 %s 被限流: %v", req.name, err)
+		return errorDocument(err)
+	}
+
+	if req.session != nil {
+		stateOf(req.session).setCurrentDatabase(req.db)
+	}
+	if op := operationOf(ctx); op != nil {
+		op.describe(req)
+	}
+	f, err := parseTransactionFields(req.body)
+	if err != nil {
+		return errorDocument(err)
+	}
+	rc, err := parseReadConcern(req.body)
+	if err == nil {
+		err = checkReadConcern(rc, f)
+	}
+	if err == nil {
+		err = parseReadPreference(req.body)
+	}
+	var wc *writeConcern
+	if err == nil {
+		wc, err = parseWriteConcern(req.body)
+	}
+	var maxTime time.Duration
+	if err == nil {
+		maxTime, err = maxTimeArgument(req)
+	}
+	if err != nil {
+		return errorDocument(err)
+	}
+	if f.lsid != "" {
+		// 首次携带 lsid 的命令创建逻辑会话，之后的命令刷新其使用时间
+		logicalSessions.open(f.lsid, sessionOwner(req.session))
+		ctx = withLogicalSession(ctx, f.lsid)
+	}
+	txn, err := l.enterTransaction(ctx, req, spec, f)
+	if err != nil {
+		return errorDocument(err)
+	}
+	if txn != nil {
+		defer txn.mu.Unlock()
+		req.txn = txn
+		ctx = storage.WithRecoveryUnit(ctx, txn.engineSession.GetRecoveryUnit())
+	}
+
+	var retry *logicalSession
+	if txn == nil && f.lsid != "" && f.hasTxnNumber && isWriteCommand(spec) {
+		s, cached, err := beginRetryableWrite(ctx, f)
+		if err != nil {
+			return errorDocument(err)
+		}
+		defer s.mu.Unlock()
+		if cached != nil {
+			return cached
+		}
+		retry = s
+		req.retry = &retryableStatements{executed: s.retryExecuted}
+	}
+
+	if blockedByFsyncLock(spec) {
+		fsyncLock.gate.RLock()
+		defer fsyncLock.gate.RUnlock()
+	}
+	op := &profiledOp{req: req, stats: &storage.ExecutionStats{}}
+	handlerCtx := storage.WithExecutionStats(ctx, op.stats)
+	if maxTime > 0 {
+		var cancel context.CancelFunc
+		handlerCtx, cancel = context.WithTimeout(handlerCtx, maxTime)
+		defer cancel()
+	}
+	start := time.Now()
+	result, err := spec.handler(l, handlerCtx, req)
+	op.elapsed, op.err = time.Since(start), err
+	l.profileCommand(op)
+	opLatencies.record(req.name, op.elapsed)
+	if err != nil {
+		// 事务中的命令失败时中止整个事务
+		if txn != nil {
+			txn.abort(ctx)
+		}
+		return errorDocument(err)
+	}
+	// 写关注要求日志落盘时，在确认写入前刷新日志
+	if wc != nil && wc.journal {
+		if err := l.storageEngine.SyncJournal(ctx); err != nil {
+			return errorDocument(err)
+		}
+	}
+	doc := result.AppendDouble("ok", 1).Build()
+	if txn != nil {
+		if _, err := doc.LookupErr("writeErrors"); err == nil {
+			txn.abort(ctx)
+		}
+	}
+	if retry != nil {
+		doc = retry.recordRetryableWrite(doc, req.retry)
+	}
+	return doc
+}
+
+// maxTimeArgument 读取命令的 maxTimeMS，未指定或为 0 时不限制执行时间
+// awaitData 游标的 getMore 以 maxTimeMS 作为等待新数据的时长，不作为执行时限
+func maxTimeArgument(req *commandRequest) (time.Duration, error) {
+	v, err := req.body.LookupErr("maxTimeMS")
+	if err != nil || req.name == "getMore" {
+		return 0, nil
+	}
+	ms, ok := v.AsInt64OK()
+	if !ok {
+		return 0, NewCommandError(CodeBadValue, "maxTimeMS must be a number")
+	}
+	if ms < 0 || ms > math.MaxInt32 {
+		return 0, NewCommandError(CodeBadValue, "%d value for maxTimeMS is out of range [0, %d]", ms, math.MaxInt32)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// stringArray 将 BSON 数组值转换为字符串切片
+func stringArray(v bsoncore.Value) ([]string, error) {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, fmt.Errorf("期望数组类型, 实际为 %s", v.Type)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		str, ok := value.StringValueOK()
+		if !ok {
+			return nil, fmt.Errorf("数组元素必须是字符串, 实际为 %s", value.Type)
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+// cmdPing 处理 ping 命令
+func (l *EventListener) cmdPing(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	return bsoncore.NewDocumentBuilder(), nil
+}
+
+// cmdHello 处理 hello/isMaster 握手命令
+func (l *EventListener) cmdHello(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	builder := bsoncore.NewDocumentBuilder()
+	if req.name == "hello" {
+		builder.AppendBoolean("isWritablePrimary", true)
+	} else {
+		builder.AppendBoolean("ismaster", true)
+	}
+	// 旧版握手通过 isMaster 的 helloOk 询问是否支持 hello，之后驱动改用 hello
+	if v, err := req.body.LookupErr("helloOk"); err == nil && v.Type == bsoncore.TypeBoolean && v.Boolean() {
+		builder.AppendBoolean("helloOk", true)
+	}
+	// 压缩协商：仅在服务端启用压缩时回应客户端声明的算法
+	if l.config != nil && l.config.Network.CompressEncoding {
+		if v, err := req.body.LookupErr("compression"); err == nil {
+			requested, err := stringArray(v)
+			if err != nil {
+				return nil, NewCommandError(CodeBadValue, "compression must be an array of strings")
+			}
+			agreed := bsoncore.NewArrayBuilder()
+			for _, name := range negotiateCompressors(requested) {
+				agreed.AppendString(name)
+			}
+			builder.AppendArray("compression", agreed.Build())
+		}
+	}
+
+	return builder.
+		AppendInt32("maxBsonObjectSize", int32(storage.MaxBsonObjectSize(l.config.Storage))).
+		AppendInt32("maxMessageSizeBytes", maxMessageSizeBytes).
+		AppendInt32("maxWriteBatchSize", maxWriteBatchSize).
+		AppendDateTime("localTime", time.Now().UnixMilli()).
+		AppendInt32("logicalSessionTimeoutMinutes", int32(logicalSessionTimeout/time.Minute)).
+		AppendInt32("minWireVersion", minWireVersion).
+		AppendInt32("maxWireVersion", maxWireVersion).
+		AppendBoolean("readOnly", false), nil
+}
+
+// cmdListDatabases 处理 listDatabases 命令
+func (l *EventListener) cmdListDatabases(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	names, err := l.storageEngine.ListDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	databases := bsoncore.NewArrayBuilder()
+	for _, name := range names {
+		databases.AppendDocument(bsoncore.NewDocumentBuilder().
+			AppendString("name", name).
+			AppendInt64("sizeOnDisk", 0).
+			AppendBoolean("empty", false).
+			Build())
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendArray("databases", databases.Build()).
+		AppendInt64("totalSize", 0), nil
+}
+
+// cmdDropDatabase 处理 dropDatabase 命令
+func (l *EventListener) cmdDropDatabase(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	// 数据库不存在时 MongoDB 同样返回成功
+	if err := l.storageEngine.DropDatabase(ctx, req.db); err != nil {
+		if logger.DebugEnabled() {
+			logger.FromContext(ctx).Debugf("删除数据库 %s: %v", req.db, err)
+		}
+	}
+	return bsoncore.NewDocumentBuilder().AppendString("dropped", req.db), nil
+}
+
+// cmdCollStats 处理 collStats 命令
+// 大小按 scale 参数换算，空集合的 avgObjSize 为 0
+func (l *EventListener) cmdCollStats(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	scale := int64(1)
+	if v, err := req.body.LookupErr("scale"); err == nil {
+		if scale, _ = v.AsInt64OK(); scale < 1 {
+			return nil, NewCommandError(CodeBadValue, "scale has to be >= 1")
+		}
+	}
+
+	stats, err := l.storageEngine.CollectionStats(ctx, req.db, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	var avgObjSize int64
+	if stats.Count > 0 {
+		avgObjSize = stats.Size / stats.Count
+	}
+	names := make([]string, 0, len(stats.IndexEntries))
+	for name := range stats.IndexEntries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// 索引没有单独统计字节数，按索引条目数报告
+	var totalIndexSize int64
+	indexSizes := bsoncore.NewDocumentBuilder()
+	for _, name := range names {
+		totalIndexSize += stats.IndexEntries[name]
+		indexSizes.AppendInt64(name, stats.IndexEntries[name]/scale)
+	}
+
+	builder := bsoncore.NewDocumentBuilder().
+		AppendString("ns", stats.Namespace).
+		AppendInt64("count", stats.Count).
+		AppendInt64("size", stats.Size/scale).
+		AppendInt64("avgObjSize", avgObjSize).
+		AppendInt64("storageSize", stats.Size/scale).
+		AppendBoolean("capped", stats.Capped)
+	if stats.Capped {
+		builder.AppendInt64("max", stats.MaxDocs).AppendInt64("maxSize", stats.MaxSize/scale)
+	}
+	return builder.
+		AppendInt32("nindexes", int32(len(names))).
+		AppendInt64("totalIndexSize", totalIndexSize/scale).
+		AppendDocument("indexSizes", indexSizes.Build()).
+		AppendInt64("scaleFactor", scale), nil
+}
+
+// cmdValidate 处理 validate 命令，检查集合的每个索引条目都指向存在的记录，每条记录在所有适用的索引中都有条目
+// missingIndexEntries 和 extraIndexEntries 报告缺少和多出的索引条目总数
+func (l *EventListener) cmdValidate(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	results, err := l.storageEngine.Validate(ctx, req.db, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing, extra int64
+	keysPerIndex := bsoncore.NewDocumentBuilder()
+	indexDetails := bsoncore.NewDocumentBuilder()
+	errs := bsoncore.NewArrayBuilder()
+	for _, index := range results.Indexes {
+		missing += index.MissingEntries
+		extra += index.ExtraEntries
+		valid := index.MissingEntries == 0 && index.ExtraEntries == 0
+		keysPerIndex.AppendInt64(index.Name, index.Keys)
+		indexDetails.AppendDocument(index.Name, bsoncore.NewDocumentBuilder().AppendBoolean("valid", valid).Build())
+		if !valid {
+			errs.AppendString(fmt.Sprintf("Index with name '%s' has inconsistencies: %d missing and %d extra index entries.",
+				index.Name, index.MissingEntries, index.ExtraEntries))
+		}
+	}
+	if results.CorruptRecords > 0 {
+		errs.AppendString(fmt.Sprintf("Detected %d invalid documents.", results.CorruptRecords))
+	}
+
+	return bsoncore.NewDocumentBuilder().
+		AppendString("ns", results.Namespace).
+		AppendInt64("nInvalidDocuments", results.CorruptRecords).
+		AppendInt64("nrecords", results.NRecords).
+		AppendInt32("nIndexes", int32(len(results.Indexes))).
+		AppendDocument("keysPerIndex", keysPerIndex.Build()).
+		AppendDocument("indexDetails", indexDetails.Build()).
+		AppendBoolean("valid", results.Valid()).
+		AppendBoolean("repaired", false).
+		AppendArray("warnings", bsoncore.NewArrayBuilder().Build()).
+		AppendArray("errors", errs.Build()).
+		AppendInt64("missingIndexEntries", missing).
+		AppendInt64("extraIndexEntries", extra), nil
+}
+
+// cmdCompact 处理 compact 命令，用集合的有效记录重建 B+Tree，回收大量删除后留下的稀疏叶子节点
+// 同时重新计算记录数和数据大小，bytesFreed 为压缩前后统计的数据大小之差
+func (l *EventListener) cmdCompact(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := l.storageEngine.Compact(ctx, req.db, coll)
+	if err != nil {
+		return nil, err
+	}
+	freed := stats.SizeBefore - stats.SizeAfter
+	if freed < 0 {
+		freed = 0
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendInt64("bytesFreed", freed).
+		AppendInt64("sizeBefore", stats.SizeBefore).
+		AppendInt64("sizeAfter", stats.SizeAfter).
+		AppendInt64("nrecords", stats.RecordsAfter).
+		AppendInt32("leavesBefore", int32(stats.LeavesBefore)).
+		AppendInt32("leavesAfter", int32(stats.LeavesAfter)), nil
+}
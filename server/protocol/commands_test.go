@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestCollStats 测试 collStats 命令的文档数和数据大小
+func TestCollStats(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	collStats := func(coll string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendString("collStats", coll).AppendString("$db", "test").Build()
+	}
+
+	var docs []bsoncore.Document
+	var size int64
+	for i := int32(1); i <= 3; i++ {
+		doc := bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendString("payload", "0123456789").Build()
+		docs = append(docs, doc)
+		// 存储引擎按自身的字段顺序重新编码文档
+		stored, _ := storage.UnmarshalDocument(doc)
+		raw, _ := storage.MarshalDocument(stored)
+		size += int64(len(raw))
+	}
+	run(1, insertCommandDocument("test", "items", docs...))
+
+	stats := run(2, collStats("items"))
+	if stats.Lookup("ok").Double() != 1 {
+		t.Fatalf("collStats 失败: %s", stats)
+	}
+	if ns := stats.Lookup("ns").StringValue(); ns != "test.items" {
+		t.Errorf("ns = %s, want test.items", ns)
+	}
+	if count := stats.Lookup("count").Int64(); count != 3 {
+		t.Errorf("count = %d, want 3", count)
+	}
+	if got := stats.Lookup("size").Int64(); got != size {
+		t.Errorf("size = %d, want %d", got, size)
+	}
+	if avg := stats.Lookup("avgObjSize").Int64(); avg != size/3 {
+		t.Errorf("avgObjSize = %d, want %d", avg, size/3)
+	}
+	if n := stats.Lookup("nindexes").Int32(); n != 1 {
+		t.Errorf("nindexes = %d, want 1", n)
+	}
+	if entries := stats.Lookup("indexSizes", "_id_").Int64(); entries != 3 {
+		t.Errorf("indexSizes._id_ = %d, want 3", entries)
+	}
+
+	// 删除全部文档后 avgObjSize 不应除零
+	listener.storageEngine.Delete(context.Background(), "test", "items", storage.Document{}, false)
+	empty := run(3, collStats("items"))
+	if empty.Lookup("count").Int64() != 0 || empty.Lookup("avgObjSize").Int64() != 0 {
+		t.Errorf("空集合统计不正确: %s", empty)
+	}
+
+	if code := run(4, collStats("missing")).Lookup("code").Int32(); code != int32(CodeNamespaceNotFound) {
+		t.Errorf("不存在的集合应返回 NamespaceNotFound, got %d", code)
+	}
+}
+
+// TestValidateCommand 测试 validate 命令的结果格式
+func TestValidateCommand(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	validate := func(coll string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendString("validate", coll).AppendString("$db", "test").Build()
+	}
+
+	docs := []bsoncore.Document{
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendInt32("a", 1).Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendInt32("a", 2).Build(),
+	}
+	run(1, insertCommandDocument("test", "items", docs...))
+	run(2, createIndexesCommandDocument("test", "items",
+		bsoncore.NewDocumentBuilder().
+			StartDocument("key").AppendInt32("a", 1).FinishDocument().
+			AppendString("name", "a_1").
+			Build()))
+
+	reply := run(3, validate("items"))
+	if reply.Lookup("ok").Double() != 1 || !reply.Lookup("valid").Boolean() {
+		t.Fatalf("validate 失败: %s", reply)
+	}
+	if reply.Lookup("nrecords").Int64() != 2 || reply.Lookup("nIndexes").Int32() != 2 ||
+		reply.Lookup("keysPerIndex", "a_1").Int64() != 2 || !reply.Lookup("indexDetails", "_id_", "valid").Boolean() {
+		t.Errorf("validate 结果不正确: %s", reply)
+	}
+	if reply.Lookup("missingIndexEntries").Int64() != 0 || reply.Lookup("extraIndexEntries").Int64() != 0 {
+		t.Errorf("一致的集合不应有缺少或多出的条目: %s", reply)
+	}
+	if errs, err := reply.Lookup("errors").Array().Values(); err != nil || len(errs) != 0 {
+		t.Errorf("一致的集合不应有错误: %s", reply)
+	}
+
+	if code := run(4, validate("missing")).Lookup("code").Int32(); code != int32(CodeNamespaceNotFound) {
+		t.Errorf("不存在的集合应返回 NamespaceNotFound, got %d", code)
+	}
+}
+
+// TestCompactCommand 测试 compact 命令在删除后重建集合并返回压缩前后的统计
+func TestCompactCommand(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	compact := func(coll string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendString("compact", coll).AppendString("$db", "test").Build()
+	}
+
+	var docs []bsoncore.Document
+	for i := int32(0); i < 200; i++ {
+		docs = append(docs, bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendInt32("a", i%2).Build())
+	}
+	run(1, insertCommandDocument("test", "items", docs...))
+	run(2, deleteCommandDocument("test", "items", deleteStatementDocument(
+		bsoncore.NewDocumentBuilder().AppendInt32("a", 1).Build(), 0)))
+
+	reply := run(3, compact("items"))
+	if reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("compact 失败: %s", reply)
+	}
+	if reply.Lookup("nrecords").Int64() != 100 || reply.Lookup("bytesFreed").Int64() != 0 ||
+		reply.Lookup("sizeAfter").Int64() != reply.Lookup("sizeBefore").Int64() {
+		t.Errorf("compact 结果不正确: %s", reply)
+	}
+	if reply.Lookup("leavesAfter").Int32() > reply.Lookup("leavesBefore").Int32() {
+		t.Errorf("压缩后叶子节点不应变多: %s", reply)
+	}
+	find := bsoncore.NewDocumentBuilder().AppendString("find", "items").AppendString("$db", "test").Build()
+	if _, batch := cursorBatch(t, run(4, find), "firstBatch"); len(batch) != 100 {
+		t.Errorf("压缩后应剩 100 个文档, got %d", len(batch))
+	}
+
+	if code := run(5, compact("missing")).Lookup("code").Int32(); code != int32(CodeNamespaceNotFound) {
+		t.Errorf("不存在的集合应返回 NamespaceNotFound, got %d", code)
+	}
+}
@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// supportedCompressors 服务端支持的压缩算法
+var supportedCompressors = map[string]wiremessage.CompressorID{
+	"snappy": wiremessage.CompressorSnappy,
+	"zlib":   wiremessage.CompressorZLib,
+	"zstd":   wiremessage.CompressorZstd,
+}
+
+// uncompressibleCommands 握手与认证相关命令的回复不允许压缩
+var uncompressibleCommands = map[string]bool{
+	"hello":           true,
+	"isMaster":        true,
+	"ismaster":        true,
+	"saslStart":       true,
+	"saslContinue":    true,
+	"getnonce":        true,
+	"authenticate":    true,
+	"createUser":      true,
+	"updateUser":      true,
+	"copydbSaslStart": true,
+	"copydbgetnonce":  true,
+	"copydb":          true,
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+)
+
+// initZstd 惰性创建 zstd 编码器，EncodeAll 可并发使用
+// 解码器按消息创建，见 decompressPayload
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+	return zstdErr
+}
+
+// negotiateCompressors 从客户端声明的压缩算法中选出服务端支持的部分，保持客户端的优先顺序
+func negotiateCompressors(requested []string) []string {
+	var agreed []string
+	for _, name := range requested {
+		if _, ok := supportedCompressors[name]; ok {
+			agreed = append(agreed, name)
+		}
+	}
+	return agreed
+}
+
+// compressPayload 压缩数据
+func compressPayload(id wiremessage.CompressorID, data []byte) ([]byte, error) {
+	switch id {
+	case wiremessage.CompressorNoOp:
+		return data, nil
+	case wiremessage.CompressorSnappy:
+		return snappy.Encode(nil, data), nil
+	case wiremessage.CompressorZLib:
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case wiremessage.CompressorZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("不支持的压缩算法: %d", id)
+	}
+}
+
+// decompressPayload 解压数据并校验解压后的长度，解压后长度不能超过 maxSize
+// 流式算法最多读出 uncompressedSize+1 字节，伪造的小长度不会让恶意构造的数据解压出任意大的内容
+func decompressPayload(id wiremessage.CompressorID, data []byte, uncompressedSize, maxSize int32) ([]byte, error) {
+	if uncompressedSize < 0 || uncompressedSize > maxSize {
+		return nil, fmt.Errorf("非法的解压后长度: %d", uncompressedSize)
+	}
+
+	var (
+		out []byte
+		err error
+	)
+	switch id {
+	case wiremessage.CompressorNoOp:
+		out = data
+	case wiremessage.CompressorSnappy:
+		n, lenErr := snappy.DecodedLen(data)
+		if lenErr != nil {
+			return nil, lenErr
+		}
+		if n != int(uncompressedSize) {
+			return nil, fmt.Errorf("解压后长度不匹配: got %d, want %d", n, uncompressedSize)
+		}
+		out, err = snappy.Decode(nil, data)
+	case wiremessage.CompressorZLib:
+		var r io.ReadCloser
+		if r, err = zlib.NewReader(bytes.NewReader(data)); err == nil {
+			out, err = io.ReadAll(io.LimitReader(r, int64(uncompressedSize)+1))
+			r.Close()
+		}
+	case wiremessage.CompressorZstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(data),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err == nil {
+			out, err = io.ReadAll(io.LimitReader(d, int64(uncompressedSize)+1))
+			d.Close()
+		}
+	default:
+		return nil, fmt.Errorf("不支持的压缩算法: %d", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解压失败: %w", err)
+	}
+	if len(out) != int(uncompressedSize) {
+		return nil, fmt.Errorf("解压后长度不匹配: got %d, want %d", len(out), uncompressedSize)
+	}
+	return out, nil
+}
+
+// decompressMessage 解开 OP_COMPRESSED 消息，返回原始操作码的消息
+// 返回消息的 Compressor 记录客户端使用的压缩算法，回复沿用同一算法；解压后的消息长度不能超过 maxMsgLen
+func decompressMessage(message *Message, maxMsgLen int32) (*Message, error) {
+	originalOpCode, rem, ok := wiremessage.ReadCompressedOriginalOpCode(message.Body)
+	if !ok {
+		return nil, fmt.Errorf("读取原始操作码失败")
+	}
+	uncompressedSize, rem, ok := wiremessage.ReadCompressedUncompressedSize(rem)
+	if !ok {
+		return nil, fmt.Errorf("读取解压后长度失败")
+	}
+	compressorID, rem, ok := wiremessage.ReadCompressedCompressorID(rem)
+	if !ok {
+		return nil, fmt.Errorf("读取压缩算法失败")
+	}
+
+	body, err := decompressPayload(compressorID, rem, uncompressedSize, maxMsgLen-16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Header: &MessageHeader{
+			MessageLength: int32(16 + len(body)),
+			RequestID:     message.Header.RequestID,
+			ResponseTo:    message.Header.ResponseTo,
+			OpCode:        int32(originalOpCode),
+		},
+		Body:       body,
+		OpCode:     OpCode(originalOpCode),
+		Compressor: compressorID,
+	}, nil
+}
+
+// compressMessage 按消息的 Compressor 将其包装为 OP_COMPRESSED
+// 压缩失败或压缩后没有变小时返回原消息
+func compressMessage(message *Message) *Message {
+	if message.Compressor == wiremessage.CompressorNoOp {
+		return message
+	}
+
+	compressed, err := compressPayload(message.Compressor, message.Body)
+	if err != nil || len(compressed)+9 >= len(message.Body) {
+		return message
+	}
+
+	body := wiremessage.AppendCompressedOriginalOpCode(nil, wiremessage.OpCode(message.OpCode))
+	body = wiremessage.AppendCompressedUncompressedSize(body, int32(len(message.Body)))
+	body = wiremessage.AppendCompressedCompressorID(body, message.Compressor)
+	body = wiremessage.AppendCompressedCompressedMessage(body, compressed)
+
+	return &Message{
+		Header: &MessageHeader{
+			MessageLength: int32(16 + len(body)),
+			RequestID:     message.Header.RequestID,
+			ResponseTo:    message.Header.ResponseTo,
+			OpCode:        int32(OpCompressed),
+		},
+		Body:    body,
+		OpCode:  OpCompressed,
+		exhaust: message.exhaust,
+	}
+}
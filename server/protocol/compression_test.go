@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// newCompressedMessage 将消息用指定算法包装为 OP_COMPRESSED
+func newCompressedMessage(t *testing.T, message *Message, id wiremessage.CompressorID) *Message {
+	t.Helper()
+	compressed, err := compressPayload(id, message.Body)
+	if err != nil {
+		t.Fatalf("压缩失败: %v", err)
+	}
+	body := wiremessage.AppendCompressedOriginalOpCode(nil, wiremessage.OpCode(message.OpCode))
+	body = wiremessage.AppendCompressedUncompressedSize(body, int32(len(message.Body)))
+	body = wiremessage.AppendCompressedCompressorID(body, id)
+	body = wiremessage.AppendCompressedCompressedMessage(body, compressed)
+	return &Message{
+		Header: &MessageHeader{
+			MessageLength: int32(16 + len(body)),
+			RequestID:     message.Header.RequestID,
+			OpCode:        int32(OpCompressed),
+		},
+		Body:   body,
+		OpCode: OpCompressed,
+	}
+}
+
+// TestCompressionNegotiation 测试 hello 中的压缩协商
+func TestCompressionNegotiation(t *testing.T) {
+	hello := bsoncore.NewDocumentBuilder().
+		AppendInt32("hello", 1).
+		AppendArray("compression", bsoncore.NewArrayBuilder().
+			AppendString("lz4").
+			AppendString("zstd").
+			AppendString("snappy").
+			Build()).
+		AppendString("$db", "admin").
+		Build()
+
+	t.Run("启用压缩", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Network.CompressEncoding = true
+		listener := newTestListener(t, cfg)
+
+		doc := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, hello)))
+		agreed, err := stringArray(doc.Lookup("compression"))
+		if err != nil {
+			t.Fatalf("回复缺少 compression 字段: %s", doc)
+		}
+		if len(agreed) != 2 || agreed[0] != "zstd" || agreed[1] != "snappy" {
+			t.Errorf("协商结果不正确: got %v, want [zstd snappy]", agreed)
+		}
+	})
+
+	t.Run("未启用压缩", func(t *testing.T) {
+		listener := newTestListener(t, &config.Config{})
+
+		doc := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, hello)))
+		if _, err := doc.LookupErr("compression"); err == nil {
+			t.Errorf("未启用压缩时不应回应 compression: %s", doc)
+		}
+	})
+}
+
+// TestOpCompressed 测试压缩消息的解压与回复压缩
+func TestOpCompressed(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Storage.Engine = "memory"
+	cfg.Network.CompressEncoding = true
+	listener := newTestListener(t, cfg)
+
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		if err := listener.storageEngine.CreateDatabase(ctx, fmt.Sprintf("compression_test_db_%02d", i)); err != nil {
+			t.Fatalf("创建数据库失败: %v", err)
+		}
+	}
+
+	command := bsoncore.NewDocumentBuilder().
+		AppendInt32("listDatabases", 1).
+		AppendString("$db", "admin").
+		Build()
+
+	t.Run("snappy", func(t *testing.T) {
+		request := newCompressedMessage(t, newOpMsgMessage(7, command), wiremessage.CompressorSnappy)
+		reply := listener.handleMessage(newFakeSession(), request)
+		if reply == nil {
+			t.Fatal("回复不应为空")
+		}
+		if reply.OpCode != OpCompressed {
+			t.Fatalf("回复应为 OP_COMPRESSED: got %s", reply.OpCode)
+		}
+		if reply.Header.ResponseTo != 7 {
+			t.Errorf("ResponseTo 不正确: got %d, want 7", reply.Header.ResponseTo)
+		}
+
+		// 按线协议格式手工解开回复
+		opcode, rem, _ := wiremessage.ReadCompressedOriginalOpCode(reply.Body)
+		size, rem, _ := wiremessage.ReadCompressedUncompressedSize(rem)
+		id, rem, _ := wiremessage.ReadCompressedCompressorID(rem)
+		if opcode != wiremessage.OpMsg || id != wiremessage.CompressorSnappy {
+			t.Fatalf("压缩头不正确: opcode=%s compressor=%s", opcode, id)
+		}
+		body, err := snappy.Decode(nil, rem)
+		if err != nil {
+			t.Fatalf("snappy 解压失败: %v", err)
+		}
+		if len(body) != int(size) {
+			t.Fatalf("解压后长度不匹配: got %d, want %d", len(body), size)
+		}
+
+		msg, err := parseOpMsg(body)
+		if err != nil {
+			t.Fatalf("解析回复失败: %v", err)
+		}
+		databases, _ := msg.body.Lookup("databases").Array().Values()
+		if len(databases) != 20 {
+			t.Errorf("数据库数量不正确: got %d, want 20", len(databases))
+		}
+	})
+
+	t.Run("zlib 与 zstd", func(t *testing.T) {
+		for _, id := range []wiremessage.CompressorID{wiremessage.CompressorZLib, wiremessage.CompressorZstd} {
+			request := newCompressedMessage(t, newOpMsgMessage(8, command), id)
+			reply := listener.handleMessage(newFakeSession(), request)
+			if reply == nil || reply.OpCode != OpCompressed {
+				t.Fatalf("%s: 回复应为 OP_COMPRESSED", id)
+			}
+			decompressed, err := decompressMessage(reply, maxMessageSizeBytes)
+			if err != nil {
+				t.Fatalf("%s: 解压回复失败: %v", id, err)
+			}
+			if decompressed.OpCode != OpMsg || decompressed.Compressor != id {
+				t.Errorf("%s: 解压结果不正确", id)
+			}
+		}
+	})
+
+	t.Run("握手回复不压缩", func(t *testing.T) {
+		hello := bsoncore.NewDocumentBuilder().AppendInt32("hello", 1).AppendString("$db", "admin").Build()
+		reply := listener.handleMessage(newFakeSession(), newCompressedMessage(t, newOpMsgMessage(9, hello), wiremessage.CompressorSnappy))
+		if reply == nil || reply.OpCode != OpMsg {
+			t.Fatalf("hello 回复不应压缩")
+		}
+	})
+
+	t.Run("未启用压缩时断开连接", func(t *testing.T) {
+		plain := newTestListener(t, &config.Config{})
+		session := newFakeSession()
+		reply := plain.handleMessage(session, newCompressedMessage(t, newOpMsgMessage(10, command), wiremessage.CompressorSnappy))
+		if reply != nil || !session.closed {
+			t.Errorf("未启用压缩时应拒绝 OP_COMPRESSED")
+		}
+	})
+
+	t.Run("解压后超过声明长度", func(t *testing.T) {
+		// 1MB 的零压缩后只有几十字节，声明的解压后长度远小于实际内容
+		bomb, err := compressPayload(wiremessage.CompressorZstd, make([]byte, 1<<20))
+		if err != nil {
+			t.Fatalf("压缩失败: %v", err)
+		}
+		if _, err := decompressPayload(wiremessage.CompressorZstd, bomb, 1024, maxMessageSizeBytes); err == nil {
+			t.Errorf("解压后超过声明长度时应返回错误")
+		}
+	})
+
+	t.Run("解压后超过配置的消息长度上限", func(t *testing.T) {
+		limited := &config.Config{}
+		limited.Network.CompressEncoding = true
+		limited.Network.MaxMsgLen = 64
+		request := newCompressedMessage(t, newOpMsgMessage(12, command), wiremessage.CompressorZstd)
+		session := newFakeSession()
+		if reply := newTestListener(t, limited).handleMessage(session, request); reply != nil || !session.closed {
+			t.Errorf("解压后超过 max_msg_len 时应断开连接")
+		}
+	})
+
+	t.Run("解压长度不符", func(t *testing.T) {
+		request := newCompressedMessage(t, newOpMsgMessage(11, command), wiremessage.CompressorSnappy)
+		request.Body[4]++ // 篡改 uncompressedSize
+		session := newFakeSession()
+		if reply := listener.handleMessage(session, request); reply != nil || !session.closed {
+			t.Errorf("解压长度不符时应断开连接")
+		}
+	})
+}
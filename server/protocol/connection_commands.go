@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+func init() {
+	registerCommand("whatsmyuri", ActionNone, (*EventListener).cmdWhatsMyURI)
+	registerCommand("connectionStatus", ActionNone, (*EventListener).cmdConnectionStatus)
+}
+
+// cmdWhatsMyURI 处理 whatsmyuri 命令，返回服务端看到的客户端地址
+func (l *EventListener) cmdWhatsMyURI(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	return bsoncore.NewDocumentBuilder().AppendString("you", remoteAddr(req.session)), nil
+}
+
+// cmdConnectionStatus 处理 connectionStatus 命令，返回连接上已认证的用户及其角色
+// 未认证时两个数组均为空
+func (l *EventListener) cmdConnectionStatus(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	users := bsoncore.NewArrayBuilder()
+	roles := bsoncore.NewArrayBuilder()
+	if user := AuthenticatedUser(req.session); user != nil {
+		users.AppendDocument(bsoncore.NewDocumentBuilder().
+			AppendString("user", user.User).
+			AppendString("db", user.DB).
+			Build())
+		for _, role := range user.Roles {
+			roles.AppendDocument(bsoncore.NewDocumentBuilder().
+				AppendString("role", role.Role).
+				AppendString("db", role.DB).
+				Build())
+		}
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendDocument("authInfo", bsoncore.NewDocumentBuilder().
+			AppendArray("authenticatedUsers", users.Build()).
+			AppendArray("authenticatedUserRoles", roles.Build()).
+			Build()), nil
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestWhatsMyURI 测试 whatsmyuri 返回会话的客户端地址，认证与否不影响结果
+func TestWhatsMyURI(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Security.Authorization = true
+	listener := newTestListener(t, cfg)
+	cmd := bsoncore.NewDocumentBuilder().AppendInt32("whatsmyuri", 1).AppendString("$db", "admin").Build()
+
+	authenticated := newFakeSession()
+	SetAuthenticatedUser(authenticated, &UserIdentity{User: "reader", DB: "test", Roles: []RoleName{{Role: "read", DB: "test"}}})
+	for name, session := range map[string]*fakeSession{"未认证": newFakeSession(), "已认证": authenticated} {
+		reply := replyDocument(t, listener.handleMessage(session, newOpMsgMessage(1, cmd)))
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("you").StringValue() != "127.0.0.1:50000" {
+			t.Errorf("%s会话的 whatsmyuri 结果不正确: %s", name, reply)
+		}
+	}
+}
+
+// TestConnectionStatus 测试 connectionStatus 返回已认证的用户和角色，未认证时为空数组
+func TestConnectionStatus(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Security.Authorization = true
+	listener := newTestListener(t, cfg)
+	cmd := bsoncore.NewDocumentBuilder().AppendInt32("connectionStatus", 1).AppendString("$db", "admin").Build()
+	authInfo := func(session *fakeSession) (users, roles []bsoncore.Value) {
+		t.Helper()
+		reply := replyDocument(t, listener.handleMessage(session, newOpMsgMessage(1, cmd)))
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("connectionStatus 失败: %s", reply)
+		}
+		users, err := reply.Lookup("authInfo", "authenticatedUsers").Array().Values()
+		if err != nil {
+			t.Fatalf("缺少 authenticatedUsers: %s", reply)
+		}
+		roles, err = reply.Lookup("authInfo", "authenticatedUserRoles").Array().Values()
+		if err != nil {
+			t.Fatalf("缺少 authenticatedUserRoles: %s", reply)
+		}
+		return users, roles
+	}
+
+	if users, roles := authInfo(newFakeSession()); len(users) != 0 || len(roles) != 0 {
+		t.Errorf("未认证时应没有用户和角色: %v, %v", users, roles)
+	}
+
+	session := newFakeSession()
+	SetAuthenticatedUser(session, &UserIdentity{
+		User:  "app",
+		DB:    "admin",
+		Roles: []RoleName{{Role: "readWrite", DB: "shop"}, {Role: "clusterMonitor", DB: "admin"}},
+	})
+	users, roles := authInfo(session)
+	if len(users) != 1 || users[0].Document().Lookup("user").StringValue() != "app" || users[0].Document().Lookup("db").StringValue() != "admin" {
+		t.Errorf("authenticatedUsers 不正确: %v", users)
+	}
+	if len(roles) != 2 ||
+		roles[0].Document().Lookup("role").StringValue() != "readWrite" || roles[0].Document().Lookup("db").StringValue() != "shop" ||
+		roles[1].Document().Lookup("role").StringValue() != "clusterMonitor" {
+		t.Errorf("authenticatedUserRoles 不正确: %v", roles)
+	}
+}
@@ -0,0 +1,415 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+const (
+	defaultBatchSize   = 101                   // 未配置 cursor_default_batch_size 时首批结果默认返回的文档数
+	defaultAwaitDataMS = 1000                  // awaitData 游标 getMore 默认等待时长
+	awaitDataInterval  = 10 * time.Millisecond // awaitData 游标轮询新数据的间隔
+)
+
+func init() {
+	registerCommand("getMore", ActionFind, (*EventListener).cmdGetMore)
+	registerCommand("killCursors", ActionKillCursors, (*EventListener).cmdKillCursors)
+}
+
+// cursorSource 游标的数据来源
+type cursorSource interface {
+	// next 返回最多 n 个文档，n 小于 0 时不限制数量
+	next(ctx context.Context, n int) ([]bsoncore.Document, error)
+	// exhausted 数据是否已全部返回，tailable 游标始终返回 false
+	exhausted() bool
+}
+
+// resumableSource 可以提供恢复点的数据来源，用于 change stream 的 postBatchResumeToken
+type resumableSource interface {
+	resumeToken() bsoncore.Document
+}
+
+// closableSource 持有存储游标等资源的数据来源，没有注册为服务端游标时由 openCursor 关闭
+type closableSource interface {
+	close()
+}
+
+// serverCursor 服务端游标
+type serverCursor struct {
+	id        int64
+	ns        string // db.collection
+	source    cursorSource
+	awaitData bool   // getMore 在没有新数据时等待
+	lsid      string // 打开游标的逻辑会话，会话结束时关闭游标；没有时为空
+	lastUsed  time.Time
+
+	// mu 串行 getMore 对数据来源的读取，游标被删除时等待正在执行的 getMore 结束后再关闭数据来源
+	mu sync.Mutex
+}
+
+// close 关闭游标的数据来源，在 cursorRegistry.mu 之外调用
+func (c *serverCursor) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	closeSource(c.source)
+}
+
+// cursorRegistry 服务端游标注册表
+// 连接池中的 getMore 可能落在不同连接上，因此所有连接共享同一个注册表
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[int64]*serverCursor
+	owned   map[string]int // 每个逻辑会话打开的游标数，用于检查 perSession 上限
+}
+
+// cursors 全局游标注册表
+var cursors = &cursorRegistry{cursors: make(map[int64]*serverCursor), owned: make(map[string]int)}
+
+// cursorLimits 同时打开的游标数上限，0 表示不限制
+// 游标被 killCursors 关闭、取完或随逻辑会话结束从注册表删除后即释放名额
+type cursorLimits struct {
+	global     int
+	perSession int // 按打开游标的逻辑会话计数，没有 lsid 的游标只受 global 限制
+}
+
+// register 注册游标并分配非零的游标 ID，打开的游标数达到上限时返回 CursorInUse 错误
+func (r *cursorRegistry) register(ns string, source cursorSource, awaitData bool, lsid string, limits cursorLimits) (*serverCursor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if limits.global > 0 && len(r.cursors) >= limits.global {
+		return nil, NewCommandError(CodeCursorInUse, "cannot open a new cursor: the server already has %d open cursors", limits.global)
+	}
+	if limits.perSession > 0 && lsid != "" {
+		if r.owned[lsid] >= limits.perSession {
+			return nil, NewCommandError(CodeCursorInUse, "cannot open a new cursor: the session already has %d open cursors", limits.perSession)
+		}
+	}
+
+	var id int64
+	for id == 0 || r.cursors[id] != nil {
+		id = rand.Int63()
+	}
+	c := &serverCursor{id: id, ns: ns, source: source, awaitData: awaitData, lsid: lsid, lastUsed: time.Now()}
+	r.cursors[id] = c
+	if lsid != "" {
+		r.owned[lsid]++
+	}
+	return c, nil
+}
+
+// deleteLocked 从注册表删除游标并更新所属会话的游标数，调用方需持有 r.mu
+func (r *cursorRegistry) deleteLocked(c *serverCursor) {
+	delete(r.cursors, c.id)
+	if c.lsid == "" {
+		return
+	}
+	if r.owned[c.lsid]--; r.owned[c.lsid] <= 0 {
+		delete(r.owned, c.lsid)
+	}
+}
+
+// get 查找游标
+func (r *cursorRegistry) get(id int64) (*serverCursor, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.cursors[id]
+	if ok {
+		c.lastUsed = time.Now()
+	}
+	return c, ok
+}
+
+// remove 删除游标并关闭其数据来源，返回游标是否存在
+func (r *cursorRegistry) remove(id int64) bool {
+	r.mu.Lock()
+	c, ok := r.cursors[id]
+	if ok {
+		r.deleteLocked(c)
+	}
+	r.mu.Unlock()
+
+	if ok {
+		c.close()
+	}
+	return ok
+}
+
+// removeOwnedBy 删除逻辑会话打开的全部游标并关闭其数据来源，返回删除的数量
+func (r *cursorRegistry) removeOwnedBy(lsid string) int {
+	return r.removeWhere(func(c *serverCursor) bool {
+		return c.lsid == lsid
+	})
+}
+
+// reapIdle 删除空闲超过 timeout 的游标并关闭其数据来源，返回删除的数量
+func (r *cursorRegistry) reapIdle(now time.Time, timeout time.Duration) int {
+	return r.removeWhere(func(c *serverCursor) bool {
+		if now.Sub(c.lastUsed) < timeout {
+			return false
+		}
+		logger.Infof("游标 %d (%s) 空闲超过 %s，关闭游标", c.id, c.ns, timeout)
+		return true
+	})
+}
+
+// removeWhere 删除满足 match 的游标，释放注册表的锁后再关闭数据来源，返回删除的数量
+// match 在持有 r.mu 时调用
+func (r *cursorRegistry) removeWhere(match func(c *serverCursor) bool) int {
+	r.mu.Lock()
+	var removed []*serverCursor
+	for _, c := range r.cursors {
+		if match(c) {
+			r.deleteLocked(c)
+			removed = append(removed, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range removed {
+		c.close()
+	}
+	return len(removed)
+}
+
+// cursorResponse 构造 {cursor: {firstBatch|nextBatch, id, ns}} 结果
+func cursorResponse(batchField string, id int64, ns string, docs []bsoncore.Document, source cursorSource) *bsoncore.DocumentBuilder {
+	batch := bsoncore.NewArrayBuilder()
+	for _, doc := range docs {
+		batch.AppendDocument(doc)
+	}
+	builder := bsoncore.NewDocumentBuilder().
+		StartDocument("cursor").
+		AppendArray(batchField, batch.Build()).
+		AppendInt64("id", id).
+		AppendString("ns", ns)
+	if resumable, ok := source.(resumableSource); ok {
+		builder.AppendDocument("postBatchResumeToken", resumable.resumeToken())
+	}
+	return builder.FinishDocument()
+}
+
+// openCursor 返回首批结果，数据未取完时注册游标供 getMore 继续读取
+// 首批即取完的结果不占用游标名额，不受打开游标数上限的限制；读取失败或达到上限时关闭数据来源
+func (l *EventListener) openCursor(ctx context.Context, ns string, source cursorSource, batchSize int, awaitData bool) (*bsoncore.DocumentBuilder, error) {
+	docs, err := source.next(ctx, batchSize)
+	if err != nil {
+		closeSource(source)
+		return nil, err
+	}
+	var id int64
+	if !source.exhausted() {
+		c, err := cursors.register(ns, source, awaitData, logicalSessionOf(ctx), l.cursorLimits)
+		if err != nil {
+			closeSource(source)
+			return nil, err
+		}
+		id = c.id
+	}
+	return cursorResponse("firstBatch", id, ns, docs, source), nil
+}
+
+// closeSource 关闭持有资源的数据来源
+func closeSource(source cursorSource) {
+	if closable, ok := source.(closableSource); ok {
+		closable.close()
+	}
+}
+
+// batchSizeArgument 读取 batchSize 参数，缺省时返回 defaultValue
+func batchSizeArgument(doc bsoncore.Document, defaultValue int) (int, error) {
+	v, err := doc.LookupErr("batchSize")
+	if err != nil {
+		return defaultValue, nil
+	}
+	size, ok := v.AsInt64OK()
+	if !ok || size < 0 {
+		return 0, NewCommandError(CodeBadValue, "BSON field 'batchSize' value must be >= 0, actual value '%s'", v)
+	}
+	return int(size), nil
+}
+
+// exhaustCommands 可以使用 exhaust 方式连续返回后续批次的命令
+var exhaustCommands = map[string]bool{"find": true, "aggregate": true, "getMore": true}
+
+// prepareExhaust 处理设置了 exhaustAllowed 的请求：命令打开的游标还有数据时为回复设置 moreToCome 标志，
+// 并返回读取下一批的 getMore 请求，服务端不等待客户端请求即发送该请求的回复
+// 后续批次沿用原命令的 batchSize；tailable 游标没有新数据时不会结束，不以 exhaust 方式返回
+func prepareExhaust(request, reply *Message, req *commandRequest, result bsoncore.Document) {
+	if !exhaustCommands[req.name] {
+		return
+	}
+	// 命令失败时回复中没有游标
+	id, _ := result.Lookup("cursor", "id").Int64OK()
+	ns, _ := result.Lookup("cursor", "ns").StringValueOK()
+	c, found := cursors.get(id)
+	if id == 0 || !found || c.awaitData {
+		return
+	}
+
+	getMore := bsoncore.NewDocumentBuilder().
+		AppendInt64("getMore", id).
+		AppendString("collection", strings.TrimPrefix(ns, req.db+"."))
+	if v, err := req.body.LookupErr("batchSize"); err == nil {
+		getMore.AppendValue("batchSize", v)
+	} else if v, err := req.body.LookupErr("cursor", "batchSize"); err == nil {
+		getMore.AppendValue("batchSize", v)
+	}
+	if v, err := req.body.LookupErr("lsid"); err == nil {
+		getMore.AppendValue("lsid", v)
+	}
+	getMore.AppendString("$db", req.db)
+
+	body := wiremessage.AppendMsgFlags(nil, wiremessage.ExhaustAllowed)
+	body = wiremessage.AppendMsgSectionType(body, wiremessage.SingleDocument)
+	body = append(body, getMore.Build()...)
+	// 下一批回复的 responseTo 为本次回复的 requestID
+	reply.exhaust = &Message{
+		Header: &MessageHeader{
+			MessageLength: int32(16 + len(body)),
+			RequestID:     reply.Header.RequestID,
+			OpCode:        int32(OpMsg),
+		},
+		Body:       body,
+		OpCode:     OpMsg,
+		Compressor: request.Compressor,
+	}
+	binary.LittleEndian.PutUint32(reply.Body, uint32(wiremessage.MoreToCome))
+}
+
+// cmdGetMore 处理 getMore 命令
+func (l *EventListener) cmdGetMore(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	id, ok := req.body.Index(0).Value().Int64OK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'getMore.getMore' is the wrong type, expected type 'long'")
+	}
+	coll, err := req.body.LookupErr("collection")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'getMore.collection' is missing but a required field")
+	}
+	// getMore 的 batchSize 为 0 或缺省时不限制数量
+	batchSize, err := batchSizeArgument(req.body, 0)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize == 0 {
+		batchSize = -1
+	}
+
+	c, ok := cursors.get(id)
+	if !ok {
+		return nil, NewCommandError(CodeCursorNotFound, "cursor id %d not found", id)
+	}
+	if ns := req.db + "." + coll.StringValue(); ns != c.ns {
+		return nil, NewCommandError(CodeUnauthorized, "Requested getMore on namespace '%s', but cursor belongs to a different namespace %s", ns, c.ns)
+	}
+
+	c.mu.Lock()
+	response, exhausted, err := c.readMore(ctx, req, batchSize)
+	c.mu.Unlock()
+	// 读取失败或取完的游标从注册表删除并关闭数据来源
+	if exhausted {
+		cursors.remove(id)
+	}
+	return response, err
+}
+
+// readMore 读取 getMore 的下一批结果，exhausted 为 true 时游标已取完或数据来源读取失败，应删除游标
+// 调用方需持有 c.mu
+func (c *serverCursor) readMore(ctx context.Context, req *commandRequest, batchSize int) (response *bsoncore.DocumentBuilder, exhausted bool, err error) {
+	docs, err := c.source.next(ctx, batchSize)
+	if err != nil {
+		return nil, true, err
+	}
+
+	// awaitData 游标没有新数据时等待到 maxTimeMS 超时
+	if len(docs) == 0 && c.awaitData {
+		wait := time.Duration(defaultAwaitDataMS) * time.Millisecond
+		if v, err := req.body.LookupErr("maxTimeMS"); err == nil {
+			if ms, ok := v.AsInt64OK(); ok && ms >= 0 {
+				wait = time.Duration(ms) * time.Millisecond
+			}
+		}
+		deadline := time.Now().Add(wait)
+		for len(docs) == 0 && time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			case <-time.After(awaitDataInterval):
+			}
+			if docs, err = c.source.next(ctx, batchSize); err != nil {
+				return nil, true, err
+			}
+		}
+	}
+
+	id := c.id
+	if exhausted = c.source.exhausted(); exhausted {
+		id = 0
+	}
+	return cursorResponse("nextBatch", id, c.ns, docs, c.source), exhausted, nil
+}
+
+// cmdKillCursors 处理 killCursors 命令
+func (l *EventListener) cmdKillCursors(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	v, err := req.body.LookupErr("cursors")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'killCursors.cursors' is missing but a required field")
+	}
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'killCursors.cursors' is the wrong type, expected type 'array'")
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+
+	killed, notFound := bsoncore.NewArrayBuilder(), bsoncore.NewArrayBuilder()
+	for _, value := range values {
+		id, ok := value.AsInt64OK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'killCursors.cursors' elements must be of type 'long'")
+		}
+		if cursors.remove(id) {
+			killed.AppendInt64(id)
+		} else {
+			notFound.AppendInt64(id)
+		}
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendArray("cursorsKilled", killed.Build()).
+		AppendArray("cursorsNotFound", notFound.Build()).
+		AppendArray("cursorsAlive", bsoncore.NewArrayBuilder().Build()).
+		AppendArray("cursorsUnknown", bsoncore.NewArrayBuilder().Build()), nil
+}
+
+// rawDocumentSource 已编码的结果集，保留文档字段顺序
+type rawDocumentSource struct {
+	docs []bsoncore.Document
+}
+
+func newRawDocumentSource(docs []bsoncore.Document) *rawDocumentSource {
+	return &rawDocumentSource{docs: docs}
+}
+
+func (s *rawDocumentSource) next(ctx context.Context, n int) ([]bsoncore.Document, error) {
+	if n < 0 || n > len(s.docs) {
+		n = len(s.docs)
+	}
+	batch := s.docs[:n]
+	s.docs = s.docs[n:]
+	return batch, nil
+}
+
+func (s *rawDocumentSource) exhausted() bool {
+	return len(s.docs) == 0
+}
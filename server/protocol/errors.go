@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// ErrorCode MongoDB 错误码
+type ErrorCode int32
+
+// 常用的 MongoDB 错误码
+const (
+	CodeInternalError             ErrorCode = 1
+	CodeBadValue                  ErrorCode = 2
+	CodeFailedToParse             ErrorCode = 9
+	CodeInvalidBSON               ErrorCode = 22
+	CodeUnauthorized              ErrorCode = 13
+	CodeTypeMismatch              ErrorCode = 14
+	CodeIllegalOperation          ErrorCode = 20
+	CodeNamespaceNotFound         ErrorCode = 26
+	CodeIndexNotFound             ErrorCode = 27
+	CodeCursorNotFound            ErrorCode = 43
+	CodeCursorInUse               ErrorCode = 44
+	CodeMaxTimeMSExpired          ErrorCode = 50
+	CodeNamespaceExists           ErrorCode = 48
+	CodeCommandNotFound           ErrorCode = 59
+	CodeImmutableField            ErrorCode = 66
+	CodeCannotCreateIndex         ErrorCode = 67
+	CodeInvalidOptions            ErrorCode = 72
+	CodeInvalidNamespace          ErrorCode = 73
+	CodeIndexOptionsConflict      ErrorCode = 85
+	CodeWriteConflict             ErrorCode = 112
+	CodeConflictingOperation      ErrorCode = 117
+	CodeQueryPlanKilled           ErrorCode = 175
+	CodeDocumentValidation        ErrorCode = 121
+	CodeInvalidIndexSpecification ErrorCode = 197
+	CodeTransactionTooOld         ErrorCode = 225
+	CodeSnapshotUnavailable       ErrorCode = 246
+	CodeNoSuchTransaction         ErrorCode = 251
+	CodeTransactionCommitted      ErrorCode = 256
+	CodeOperationNotSupportedInTx ErrorCode = 263
+	CodeUnsupportedOpQueryCommand ErrorCode = 352
+	CodeRateLimitExceeded         ErrorCode = 462
+	CodeBSONObjectTooLarge        ErrorCode = 10334
+	CodeDuplicateKey              ErrorCode = 11000
+	CodeInterrupted               ErrorCode = 11601
+)
+
+// codeNames 错误码对应的 codeName
+var codeNames = map[ErrorCode]string{
+	CodeInternalError:             "InternalError",
+	CodeBadValue:                  "BadValue",
+	CodeFailedToParse:             "FailedToParse",
+	CodeInvalidBSON:               "InvalidBSON",
+	CodeUnauthorized:              "Unauthorized",
+	CodeTypeMismatch:              "TypeMismatch",
+	CodeIllegalOperation:          "IllegalOperation",
+	CodeNamespaceNotFound:         "NamespaceNotFound",
+	CodeIndexNotFound:             "IndexNotFound",
+	CodeCursorNotFound:            "CursorNotFound",
+	CodeCursorInUse:               "CursorInUse",
+	CodeMaxTimeMSExpired:          "MaxTimeMSExpired",
+	CodeNamespaceExists:           "NamespaceExists",
+	CodeCommandNotFound:           "CommandNotFound",
+	CodeImmutableField:            "ImmutableField",
+	CodeCannotCreateIndex:         "CannotCreateIndex",
+	CodeInvalidOptions:            "InvalidOptions",
+	CodeInvalidNamespace:          "InvalidNamespace",
+	CodeIndexOptionsConflict:      "IndexOptionsConflict",
+	CodeWriteConflict:             "WriteConflict",
+	CodeConflictingOperation:      "ConflictingOperationInProgress",
+	CodeQueryPlanKilled:           "QueryPlanKilled",
+	CodeDocumentValidation:        "DocumentValidationFailure",
+	CodeInvalidIndexSpecification: "InvalidIndexSpecificationOption",
+	CodeTransactionTooOld:         "TransactionTooOld",
+	CodeSnapshotUnavailable:       "SnapshotUnavailable",
+	CodeNoSuchTransaction:         "NoSuchTransaction",
+	CodeTransactionCommitted:      "TransactionCommitted",
+	CodeOperationNotSupportedInTx: "OperationNotSupportedInTransaction",
+	CodeUnsupportedOpQueryCommand: "UnsupportedOpQueryCommand",
+	CodeRateLimitExceeded:         "IngressRequestRateLimitExceeded",
+	CodeBSONObjectTooLarge:        "BSONObjectTooLarge",
+	CodeDuplicateKey:              "DuplicateKey",
+	CodeInterrupted:               "Interrupted",
+}
+
+// Name 返回错误码的 codeName，未知错误码返回空字符串
+func (c ErrorCode) Name() string {
+	return codeNames[c]
+}
+
+// 错误标签，驱动按标签决定是否重试
+const (
+	labelRetryableError        = "RetryableError"
+	labelSystemOverloadedError = "SystemOverloadedError"
+)
+
+// CommandError 命令执行失败，携带 MongoDB 错误码
+type CommandError struct {
+	Code     ErrorCode
+	CodeName string
+	Message  string
+	Labels   []string // errorLabels，为空时回复中不包含该字段
+}
+
+// NewCommandError 创建命令错误，codeName 按错误码自动填写
+func NewCommandError(code ErrorCode, format string, args ...interface{}) *CommandError {
+	return &CommandError{
+		Code:     code,
+		CodeName: code.Name(),
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+// Document 将错误转换为 {ok: 0, errmsg, code, codeName, errorLabels} 文档
+func (e *CommandError) Document() bsoncore.Document {
+	builder := bsoncore.NewDocumentBuilder().
+		AppendDouble("ok", 0).
+		AppendString("errmsg", e.Message).
+		AppendInt32("code", int32(e.Code)).
+		AppendString("codeName", e.CodeName)
+	if len(e.Labels) > 0 {
+		labels := bsoncore.NewArrayBuilder()
+		for _, label := range e.Labels {
+			labels.AppendString(label)
+		}
+		builder.AppendArray("errorLabels", labels.Build())
+	}
+	return builder.Build()
+}
+
+// toCommandError 将任意错误转换为 CommandError，存储引擎的错误映射到对应的错误码
+func toCommandError(err error) *CommandError {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr
+	}
+
+	var dupErr *storage.DuplicateKeyError
+	var sizeErr *storage.DocumentTooLargeError
+	switch {
+	case errors.As(err, &dupErr):
+		return NewCommandError(CodeDuplicateKey, "E11000 duplicate key error collection: %s index: %s dup key: %s",
+			dupErr.Namespace, dupErr.Index, formatKeyValue(dupErr.Key))
+	case errors.Is(err, storage.ErrDuplicateKey):
+		return NewCommandError(CodeDuplicateKey, "E11000 duplicate key error: %v", err)
+	case errors.As(err, &sizeErr):
+		return NewCommandError(CodeBSONObjectTooLarge, "object to insert too large. size in bytes: %d, max size: %d", sizeErr.Size, sizeErr.MaxSize)
+	case errors.Is(err, storage.ErrDocumentValidation):
+		return NewCommandError(CodeDocumentValidation, "Document failed validation")
+	case errors.Is(err, storage.ErrNamespaceNotFound):
+		return NewCommandError(CodeNamespaceNotFound, "ns not found")
+	case errors.Is(err, storage.ErrNamespaceExists):
+		return NewCommandError(CodeNamespaceExists, "namespace already exists")
+	case errors.Is(err, storage.ErrIndexNotFound):
+		return NewCommandError(CodeIndexNotFound, "%v", err)
+	case errors.Is(err, storage.ErrQueryPlanKilled):
+		return NewCommandError(CodeQueryPlanKilled, "%v", err)
+	case errors.Is(err, storage.ErrWriteConflict):
+		return NewCommandError(CodeWriteConflict, "%v", err)
+	case errors.Is(err, storage.ErrIndexConflict):
+		return NewCommandError(CodeIndexOptionsConflict, "%v", err)
+	case errors.Is(err, storage.ErrIllegalOperation):
+		return NewCommandError(CodeIllegalOperation, "%v", err)
+	case errors.Is(err, storage.ErrBadValue):
+		return NewCommandError(CodeBadValue, "%v", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewCommandError(CodeMaxTimeMSExpired, "operation exceeded time limit")
+	case errors.Is(err, context.Canceled):
+		return NewCommandError(CodeInterrupted, "operation was interrupted")
+	}
+	return NewCommandError(CodeInternalError, "%v", err)
+}
+
+// errorDocument 将错误转换为 {ok: 0, errmsg, code, codeName} 文档
+func errorDocument(err error) bsoncore.Document {
+	return toCommandError(err).Document()
+}
+
+// formatKeyValue 按 mongod 错误信息的格式输出索引键，如 { _id: "a" }
+func formatKeyValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case storage.ObjectID:
+		return "ObjectId('" + v.Hex() + "')"
+	case storage.Document:
+		if len(v) == 0 {
+			return "{}"
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key + ": " + formatKeyValue(v[key])
+		}
+		return "{ " + strings.Join(parts, ", ") + " }"
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			parts[i] = formatKeyValue(elem)
+		}
+		return "[ " + strings.Join(parts, ", ") + " ]"
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	case storage.Binary:
+		return fmt.Sprintf("BinData(%d, %X)", v.Subtype, v.Data)
+	}
+	return fmt.Sprint(value)
+}
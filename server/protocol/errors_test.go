@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// insertCommandDocument 构造 insert 命令文档
+func insertCommandDocument(db, coll string, docs ...bsoncore.Document) bsoncore.Document {
+	arr := bsoncore.NewArrayBuilder()
+	for _, doc := range docs {
+		arr.AppendDocument(doc)
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("insert", coll).
+		AppendArray("documents", arr.Build()).
+		AppendString("$db", db).
+		Build()
+}
+
+// TestCommandError 测试错误文档格式与存储引擎错误的映射
+func TestCommandError(t *testing.T) {
+	t.Run("错误文档", func(t *testing.T) {
+		doc := NewCommandError(CodeNamespaceNotFound, "ns not found").Document()
+		if doc.Lookup("ok").Double() != 0 ||
+			doc.Lookup("errmsg").StringValue() != "ns not found" ||
+			doc.Lookup("code").Int32() != 26 ||
+			doc.Lookup("codeName").StringValue() != "NamespaceNotFound" {
+			t.Errorf("错误文档不正确: %s", doc)
+		}
+	})
+
+	t.Run("引擎错误映射", func(t *testing.T) {
+		tests := []struct {
+			err  error
+			code ErrorCode
+		}{
+			{fmt.Errorf("插入失败: %w", storage.ErrDuplicateKey), CodeDuplicateKey},
+			{fmt.Errorf("集合 c 不存在: %w", storage.ErrNamespaceNotFound), CodeNamespaceNotFound},
+			{fmt.Errorf("集合 c 已存在: %w", storage.ErrNamespaceExists), CodeNamespaceExists},
+			{fmt.Errorf("%w: 未知的操作符: $foo", storage.ErrBadValue), CodeBadValue},
+			{fmt.Errorf("索引 a_1 不存在: %w", storage.ErrIndexNotFound), CodeIndexNotFound},
+			{fmt.Errorf("%w: 索引 a_1 已存在且定义不同", storage.ErrIndexConflict), CodeIndexOptionsConflict},
+			{fmt.Errorf("其他错误"), CodeInternalError},
+			{NewCommandError(CodeUnauthorized, "denied"), CodeUnauthorized},
+		}
+		for _, tt := range tests {
+			if got := toCommandError(tt.err); got.Code != tt.code || got.CodeName != tt.code.Name() {
+				t.Errorf("%v: got %d(%s), want %d", tt.err, got.Code, got.CodeName, tt.code)
+			}
+		}
+	})
+
+	t.Run("重复插入返回 11000", func(t *testing.T) {
+		listener := newTestListener(t, &config.Config{})
+		doc := bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("name", "Alice").Build()
+
+		first := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, insertCommandDocument("test", "users", doc))))
+		if first.Lookup("ok").Double() != 1 || first.Lookup("n").Int32() != 1 {
+			t.Fatalf("首次插入失败: %s", first)
+		}
+
+		second := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(2, insertCommandDocument("test", "users", doc))))
+		if second.Lookup("n").Int32() != 0 {
+			t.Errorf("重复插入不应成功: %s", second)
+		}
+		writeErrors, err := second.Lookup("writeErrors").Array().Values()
+		if err != nil || len(writeErrors) != 1 {
+			t.Fatalf("应返回一个 writeError: %s", second)
+		}
+		writeErr := writeErrors[0].Document()
+		if code := writeErr.Lookup("code").Int32(); code != int32(CodeDuplicateKey) {
+			t.Errorf("错误码不正确: got %d, want 11000", code)
+		}
+		if index := writeErr.Lookup("index").Int32(); index != 0 {
+			t.Errorf("错误下标不正确: got %d, want 0", index)
+		}
+		want := "E11000 duplicate key error collection: test.users index: _id_ dup key: { _id: 1 }"
+		if msg := writeErr.Lookup("errmsg").StringValue(); msg != want {
+			t.Errorf("错误信息不正确:\n got %s\nwant %s", msg, want)
+		}
+	})
+
+	t.Run("重复键格式", func(t *testing.T) {
+		id := storage.ObjectID{0x65, 0x0c, 0x1f, 0x2e, 0x3d, 0x4c, 0x5b, 0x6a, 0x79, 0x88, 0x97, 0xa6}
+		tests := []struct {
+			key  interface{}
+			want string
+		}{
+			{storage.Document{"_id": "alice"}, `{ _id: "alice" }`},
+			{storage.Document{"_id": id}, `{ _id: ObjectId('650c1f2e3d4c5b6a798897a6') }`},
+			{storage.Document{"_id": storage.Document{"a": int32(1), "b": nil}}, `{ _id: { a: 1, b: null } }`},
+		}
+		for _, tt := range tests {
+			err := fmt.Errorf("插入失败: %w", &storage.DuplicateKeyError{Namespace: "test.c", Index: "_id_", Key: tt.key})
+			want := "E11000 duplicate key error collection: test.c index: _id_ dup key: " + tt.want
+			if got := toCommandError(err); got.Code != CodeDuplicateKey || got.Message != want {
+				t.Errorf("got %d %q, want %q", got.Code, got.Message, want)
+			}
+		}
+	})
+}
@@ -8,7 +8,8 @@ import (
 )
 
 func main() {
-	fmt.Println("=== MongoDB Wire Protocol 测试 ===\n")
+	fmt.Println("=== MongoDB Wire Protocol 测试 ===")
+	fmt.Println()
 
 	// 1. 测试 OpCode
 	fmt.Println("1. OpCode 测试:")
@@ -0,0 +1,264 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// explain 的输出详细程度
+const (
+	verbosityQueryPlanner      = "queryPlanner"
+	verbosityExecutionStats    = "executionStats"
+	verbosityAllPlansExecution = "allPlansExecution"
+)
+
+func init() {
+	registerCommand("explain", ActionFind, (*EventListener).cmdExplain)
+}
+
+// explainedQuery 被 explain 的命令中与查询计划相关的部分
+type explainedQuery struct {
+	coll       string
+	filter     storage.Document
+	projection storage.Document // 只在 find 按需读取结果时传给存储引擎，用于判断能否覆盖查询
+	skip       int64
+	limit      int64
+	hint       *storage.Hint
+}
+
+// parseExplainedCommand 从 find/count/distinct/aggregate 命令中提取集合和过滤条件
+func parseExplainedCommand(req *commandRequest) (*explainedQuery, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	q := &explainedQuery{coll: coll, filter: storage.Document{}}
+
+	switch req.name {
+	case "find", "count":
+		parse := parseFindQuery
+		if req.name == "count" {
+			parse = parseCountQuery
+		}
+		fq, err := parse(req)
+		if err != nil {
+			return nil, err
+		}
+		q.filter, q.skip, q.limit, q.hint = fq.filter, fq.skip, fq.limit, fq.hint
+		// 与 cmdFind 一致，有排序或相关度得分投影时需要读取完整文档
+		if len(fq.sort) == 0 && len(storage.TextScoreFields(fq.projection)) == 0 {
+			q.projection = fq.projection
+		}
+	case "distinct":
+		if q.filter, err = filterArgument(req, "query"); err != nil {
+			return nil, err
+		}
+	case "aggregate":
+		stages, err := parsePipeline(req)
+		if err != nil {
+			return nil, err
+		}
+		if len(stages) > 0 {
+			switch stages[0].name {
+			case "$changeStream":
+				return nil, NewCommandError(CodeIllegalOperation, "explain is not supported for $changeStream pipelines")
+			case "$match":
+				// 与 runPipeline 一致，只有开头的 $match 下推到存储引擎
+				q.filter = stages[0].spec
+			}
+		}
+	default:
+		return nil, NewCommandError(CodeCommandNotFound, "Explain failed due to unknown command: %s", req.name)
+	}
+	return q, nil
+}
+
+// cmdExplain 处理 explain 命令
+// queryPlanner 只返回选择的执行计划，executionStats 和 allPlansExecution 还会执行查询并返回统计
+func (l *EventListener) cmdExplain(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	v := req.body.Index(0).Value()
+	inner, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "explain command requires a nested object")
+	}
+	elem, err := inner.IndexErr(0)
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "explain command requires a nested object")
+	}
+
+	verbosity := verbosityAllPlansExecution
+	if v, err := req.body.LookupErr("verbosity"); err == nil {
+		mode, _ := v.StringValueOK()
+		switch mode {
+		case verbosityQueryPlanner, verbosityExecutionStats, verbosityAllPlansExecution:
+			verbosity = mode
+		default:
+			return nil, NewCommandError(CodeFailedToParse, "verbosity string must be one of {'queryPlanner', 'executionStats', 'allPlansExecution'}")
+		}
+	}
+
+	innerReq := &commandRequest{name: elem.Key(), db: req.db, body: inner, sequences: req.sequences, session: req.session}
+	q, err := parseExplainedCommand(innerReq)
+	if err != nil {
+		return nil, err
+	}
+	explanation, err := l.storageEngine.Explain(ctx, req.db, q.coll, q.filter, q.projection, q.hint, verbosity != verbosityQueryPlanner)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := bsoncore.NewDocumentBuilder().
+		AppendString("explainVersion", "1")
+	if err := appendExplainSection(builder, "queryPlanner", queryPlannerDocument(explanation)); err != nil {
+		return nil, err
+	}
+	if explanation.Stats != nil {
+		if err := appendExplainSection(builder, "executionStats", executionStatsDocument(explanation, q)); err != nil {
+			return nil, err
+		}
+	}
+	return builder.AppendDocument("command", inner), nil
+}
+
+// appendExplainSection 将 explain 的一个部分追加到结果中
+func appendExplainSection(builder *bsoncore.DocumentBuilder, name string, section storage.Document) error {
+	raw, err := storage.MarshalDocument(section)
+	if err != nil {
+		return err
+	}
+	builder.AppendDocument(name, raw)
+	return nil
+}
+
+// queryPlannerDocument 构造 queryPlanner 部分
+// 选中和未选中的计划都附带按集合样本估计的 costEstimate（需要读取的文档数）和 cardinalityEstimate（满足过滤条件的文档数）
+func queryPlannerDocument(e *storage.Explanation) storage.Document {
+	rejected := make([]interface{}, 0, len(e.Rejected))
+	for _, plan := range e.Rejected {
+		rejected = append(rejected, estimatedPlanStage(plan))
+	}
+	return storage.Document{
+		"namespace":      e.Namespace,
+		"indexFilterSet": false,
+		"parsedQuery":    e.Plan.Filter,
+		"winningPlan":    estimatedPlanStage(e.Plan),
+		"rejectedPlans":  rejected,
+	}
+}
+
+// estimatedPlanStage 描述计划的阶段树，并在最外层阶段附带计划的估计，无法估计的项不输出
+func estimatedPlanStage(plan *storage.QueryPlan) storage.Document {
+	stage := planStage(plan, nil)
+	if plan.CostEstimate >= 0 {
+		stage["costEstimate"] = plan.CostEstimate
+	}
+	if plan.CardinalityEstimate >= 0 {
+		stage["cardinalityEstimate"] = plan.CardinalityEstimate
+	}
+	return stage
+}
+
+// executionStatsDocument 构造 executionStats 部分
+// nReturned 按被 explain 命令的 skip 和 limit 折算
+func executionStatsDocument(e *storage.Explanation, q *explainedQuery) storage.Document {
+	stats := *e.Stats
+	returned := stats.NReturned - q.skip
+	if returned < 0 {
+		returned = 0
+	}
+	if q.limit > 0 && returned > q.limit {
+		returned = q.limit
+	}
+	stats.NReturned = returned
+
+	return storage.Document{
+		"executionSuccess":    true,
+		"nReturned":           stats.NReturned,
+		"executionTimeMillis": stats.ExecutionTime.Milliseconds(),
+		"totalKeysExamined":   stats.KeysExamined,
+		"totalDocsExamined":   stats.DocsExamined,
+		"executionStages":     planStage(e.Plan, &stats),
+	}
+}
+
+// planStage 描述执行计划的阶段树，stats 不为 nil 时附带各阶段的执行统计
+// IXSCAN 计划由 FETCH 阶段读取索引命中的文档并应用完整的过滤条件，TEXT 和 GEO_NEAR 计划再外加对应的阶段
+// OR 计划的 FETCH 阶段读取各分支索引扫描合并后的结果，各分支的扫描不单独统计
+func planStage(plan *storage.QueryPlan, stats *storage.ExecutionStats) storage.Document {
+	if plan.Stage == storage.StageOr {
+		scans := make([]interface{}, 0, len(plan.Branches))
+		for _, branch := range plan.Branches {
+			scans = append(scans, indexScanStage(branch))
+		}
+		or := storage.Document{"stage": storage.StageOr, "inputStages": scans}
+		fetch := storage.Document{"stage": storage.StageFetch, "filter": plan.Filter, "inputStage": or}
+		if stats != nil {
+			or["nReturned"] = stats.KeysExamined
+			fetch["nReturned"] = stats.NReturned
+			fetch["docsExamined"] = stats.DocsExamined
+		}
+		return fetch
+	}
+	if plan.Stage == storage.StageCollScan {
+		stage := storage.Document{"stage": storage.StageCollScan, "filter": plan.Filter, "direction": "forward"}
+		if stats != nil {
+			stage["nReturned"] = stats.NReturned
+			stage["docsExamined"] = stats.DocsExamined
+		}
+		return stage
+	}
+
+	scan := indexScanStage(plan)
+	if plan.Covered {
+		// 覆盖查询直接用索引键构造结果，没有 FETCH 阶段
+		projection := storage.Document{"stage": storage.StageProjectionCovered, "transformBy": plan.Projection, "inputStage": scan}
+		if stats != nil {
+			scan["keysExamined"] = stats.KeysExamined
+			scan["nReturned"] = stats.KeysExamined
+			projection["nReturned"] = stats.NReturned
+		}
+		return projection
+	}
+	fetch := storage.Document{"stage": storage.StageFetch, "filter": plan.Filter, "inputStage": scan}
+	if stats != nil {
+		scan["keysExamined"] = stats.KeysExamined
+		scan["nReturned"] = stats.KeysExamined
+		fetch["nReturned"] = stats.NReturned
+		fetch["docsExamined"] = stats.DocsExamined
+	}
+	switch plan.Stage {
+	case storage.StageGeoNear2D, storage.StageGeoNear2DSphere:
+		return storage.Document{
+			"stage":      plan.Stage,
+			"keyPattern": plan.KeyPattern,
+			"indexName":  plan.IndexName,
+			"inputStage": fetch,
+		}
+	case storage.StageText:
+		terms := make([]interface{}, len(plan.TextTerms))
+		for i, term := range plan.TextTerms {
+			terms[i] = term
+		}
+		scan["isMultiKey"] = true
+		return storage.Document{
+			"stage":           "TEXT_MATCH",
+			"indexName":       plan.IndexName,
+			"parsedTextQuery": storage.Document{"terms": terms},
+			"inputStage":      fetch,
+		}
+	}
+	return fetch
+}
+
+// indexScanStage 描述计划使用的 IXSCAN 阶段
+func indexScanStage(plan *storage.QueryPlan) storage.Document {
+	return storage.Document{
+		"stage":      storage.StageIxScan,
+		"keyPattern": plan.KeyPattern,
+		"indexName":  plan.IndexName,
+		"isMultiKey": plan.IsMultiKey,
+		"direction":  "forward",
+	}
+}
@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// explainCommandDocument 构造 explain 命令文档
+func explainCommandDocument(db string, cmd bsoncore.Document, verbosity string) bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().
+		AppendDocument("explain", cmd).
+		AppendString("verbosity", verbosity).
+		AppendString("$db", db).
+		Build()
+}
+
+// TestExplain 测试 explain 命令报告的执行计划和执行统计
+func TestExplain(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		reply := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+		return reply
+	}
+
+	docs := make([]bsoncore.Document, 0, 10)
+	for i := int32(1); i <= 10; i++ {
+		docs = append(docs, bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendString("name", "user").Build())
+	}
+	run(1, insertCommandDocument("test", "users", docs...))
+
+	findByID := bsoncore.NewDocumentBuilder().
+		AppendString("find", "users").
+		AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendInt32("_id", 3).Build()).
+		Build()
+	findByName := bsoncore.NewDocumentBuilder().
+		AppendString("find", "users").
+		AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendString("name", "user").Build()).
+		AppendInt32("limit", 4).
+		Build()
+
+	t.Run("索引命中时使用 IXSCAN", func(t *testing.T) {
+		reply := run(2, explainCommandDocument("test", findByID, "executionStats"))
+		plan := reply.Lookup("queryPlanner", "winningPlan").Document()
+		if stage := plan.Lookup("stage").StringValue(); stage != "FETCH" {
+			t.Fatalf("winningPlan 应为 FETCH: %s", plan)
+		}
+		scan := plan.Lookup("inputStage").Document()
+		if scan.Lookup("stage").StringValue() != "IXSCAN" || scan.Lookup("indexName").StringValue() != "_id_" {
+			t.Errorf("应使用 _id_ 索引扫描: %s", scan)
+		}
+
+		stats := reply.Lookup("executionStats").Document()
+		if n := stats.Lookup("nReturned").AsInt64(); n != 1 {
+			t.Errorf("nReturned = %d, want 1", n)
+		}
+		if n := stats.Lookup("totalKeysExamined").AsInt64(); n != 1 {
+			t.Errorf("totalKeysExamined = %d, want 1", n)
+		}
+		if n := stats.Lookup("totalDocsExamined").AsInt64(); n != 1 {
+			t.Errorf("totalDocsExamined = %d, want 1", n)
+		}
+		if _, ok := stats.Lookup("executionTimeMillis").AsInt64OK(); !ok {
+			t.Errorf("缺少 executionTimeMillis: %s", stats)
+		}
+	})
+
+	t.Run("没有可用索引时使用 COLLSCAN", func(t *testing.T) {
+		reply := run(3, explainCommandDocument("test", findByName, "executionStats"))
+		plan := reply.Lookup("queryPlanner", "winningPlan").Document()
+		if stage := plan.Lookup("stage").StringValue(); stage != "COLLSCAN" {
+			t.Fatalf("winningPlan 应为 COLLSCAN: %s", plan)
+		}
+		stats := reply.Lookup("executionStats").Document()
+		if n := stats.Lookup("totalDocsExamined").AsInt64(); n != 10 {
+			t.Errorf("totalDocsExamined = %d, want 10", n)
+		}
+		if n := stats.Lookup("totalKeysExamined").AsInt64(); n != 0 {
+			t.Errorf("totalKeysExamined = %d, want 0", n)
+		}
+		if n := stats.Lookup("nReturned").AsInt64(); n != 4 {
+			t.Errorf("nReturned 应按 limit 折算为 4, got %d", n)
+		}
+	})
+
+	t.Run("$or 的每个分支使用 IXSCAN", func(t *testing.T) {
+		branches := bsoncore.NewArrayBuilder().
+			AppendDocument(bsoncore.NewDocumentBuilder().AppendInt32("_id", 3).Build()).
+			AppendDocument(bsoncore.NewDocumentBuilder().AppendInt32("_id", 5).Build()).
+			Build()
+		findEither := bsoncore.NewDocumentBuilder().
+			AppendString("find", "users").
+			AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendArray("$or", branches).Build()).
+			Build()
+		reply := run(7, explainCommandDocument("test", findEither, "executionStats"))
+		or := reply.Lookup("queryPlanner", "winningPlan", "inputStage").Document()
+		if or.Lookup("stage").StringValue() != "OR" {
+			t.Fatalf("FETCH 的输入应为 OR: %s", reply)
+		}
+		scans, err := or.Lookup("inputStages").Array().Values()
+		if err != nil || len(scans) != 2 || scans[1].Document().Lookup("indexName").StringValue() != "_id_" {
+			t.Errorf("每个分支应使用 _id_ 索引扫描: %s", or)
+		}
+		if n := reply.Lookup("executionStats", "totalDocsExamined").AsInt64(); n != 2 {
+			t.Errorf("totalDocsExamined = %d, want 2", n)
+		}
+	})
+
+	t.Run("覆盖查询不读取文档", func(t *testing.T) {
+		spec := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("a", 1).AppendInt32("b", 1).Build()).
+			Build()
+		run(8, createIndexesCommandDocument("test", "points", spec))
+		points := make([]bsoncore.Document, 0, 5)
+		for i := int32(1); i <= 5; i++ {
+			points = append(points, bsoncore.NewDocumentBuilder().
+				AppendInt32("_id", i).AppendInt32("a", i).AppendDouble("b", float64(i)/2).AppendString("c", "x").Build())
+		}
+		run(9, insertCommandDocument("test", "points", points...))
+
+		find := func() *bsoncore.DocumentBuilder {
+			return bsoncore.NewDocumentBuilder().
+				AppendString("find", "points").
+				AppendDocument("filter", bsoncore.NewDocumentBuilder().
+					StartDocument("a").AppendInt32("$gte", 3).FinishDocument().
+					Build()).
+				AppendDocument("projection", bsoncore.NewDocumentBuilder().
+					AppendInt32("a", 1).AppendInt32("b", 1).AppendInt32("_id", 0).Build())
+		}
+		reply := run(10, explainCommandDocument("test", find().Build(), "executionStats"))
+		plan := reply.Lookup("queryPlanner", "winningPlan").Document()
+		if plan.Lookup("stage").StringValue() != "PROJECTION_COVERED" || plan.Lookup("inputStage", "stage").StringValue() != "IXSCAN" {
+			t.Fatalf("winningPlan 应为 PROJECTION_COVERED + IXSCAN: %s", plan)
+		}
+		stats := reply.Lookup("executionStats").Document()
+		if n := stats.Lookup("totalDocsExamined").AsInt64(); n != 0 {
+			t.Errorf("totalDocsExamined = %d, want 0", n)
+		}
+		if n := stats.Lookup("nReturned").AsInt64(); n != 3 {
+			t.Errorf("nReturned = %d, want 3", n)
+		}
+
+		_, batch := cursorBatch(t, run(11, find().AppendString("$db", "test").Build()), "firstBatch")
+		if len(batch) != 3 {
+			t.Fatalf("应返回 3 个文档: %v", batch)
+		}
+		first := batch[0]
+		if _, err := first.LookupErr("_id"); err == nil {
+			t.Errorf("结果不应包含 _id: %s", first)
+		}
+		if _, err := first.LookupErr("c"); err == nil {
+			t.Errorf("结果不应包含投影以外的字段: %s", first)
+		}
+		if a, ok := first.Lookup("a").Int32OK(); !ok || a != 3 {
+			t.Errorf("a 应为 int32 3: %s", first)
+		}
+		if b, ok := first.Lookup("b").DoubleOK(); !ok || b != 1.5 {
+			t.Errorf("b 应为 double 1.5: %s", first)
+		}
+
+		// 投影包含索引以外的字段时需要读取文档
+		withC := bsoncore.NewDocumentBuilder().
+			AppendString("find", "points").
+			AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendInt32("a", 3).Build()).
+			AppendDocument("projection", bsoncore.NewDocumentBuilder().AppendInt32("a", 1).AppendInt32("c", 1).AppendInt32("_id", 0).Build()).
+			Build()
+		reply = run(12, explainCommandDocument("test", withC, "executionStats"))
+		if stage := reply.Lookup("queryPlanner", "winningPlan", "stage").StringValue(); stage != "FETCH" {
+			t.Errorf("投影包含 c 时应为 FETCH: %s", reply)
+		}
+	})
+
+	t.Run("queryPlanner 不执行查询", func(t *testing.T) {
+		reply := run(4, explainCommandDocument("test", findByID, "queryPlanner"))
+		if _, err := reply.LookupErr("executionStats"); err == nil {
+			t.Errorf("queryPlanner 模式不应包含 executionStats: %s", reply)
+		}
+		if ns := reply.Lookup("queryPlanner", "namespace").StringValue(); ns != "test.users" {
+			t.Errorf("namespace = %q, want test.users", ns)
+		}
+	})
+
+	t.Run("count 和 aggregate", func(t *testing.T) {
+		count := bsoncore.NewDocumentBuilder().
+			AppendString("count", "users").
+			AppendDocument("query", bsoncore.NewDocumentBuilder().AppendInt32("_id", 5).Build()).
+			Build()
+		reply := run(5, explainCommandDocument("test", count, "queryPlanner"))
+		if stage := reply.Lookup("queryPlanner", "winningPlan", "inputStage", "stage").StringValue(); stage != "IXSCAN" {
+			t.Errorf("count 按 _id 过滤应使用 IXSCAN: %s", reply)
+		}
+
+		match := bsoncore.NewDocumentBuilder().
+			StartDocument("$match").AppendString("name", "user").FinishDocument().
+			Build()
+		aggregate := bsoncore.NewDocumentBuilder().
+			AppendString("aggregate", "users").
+			AppendArray("pipeline", bsoncore.NewArrayBuilder().AppendDocument(match).Build()).
+			AppendDocument("cursor", bsoncore.NewDocumentBuilder().Build()).
+			Build()
+		reply = run(6, explainCommandDocument("test", aggregate, "queryPlanner"))
+		if stage := reply.Lookup("queryPlanner", "winningPlan", "stage").StringValue(); stage != "COLLSCAN" {
+			t.Errorf("aggregate 按 name 过滤应使用 COLLSCAN: %s", reply)
+		}
+	})
+}
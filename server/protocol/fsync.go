@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+func init() {
+	registerCommand("fsync", ActionFsync, (*EventListener).cmdFsync)
+	registerCommand("fsyncUnlock", ActionUnlock, (*EventListener).cmdFsyncUnlock)
+}
+
+// fsyncLockState fsync lock 的状态，所有连接共享
+// 修改数据的命令执行期间持有 gate 的读锁；第一次加锁时获取 gate 的写锁，等待进行中的写命令结束并阻塞之后的写命令，
+// 加锁次数减到 0 时释放。加锁和解锁可能来自不同的连接
+type fsyncLockState struct {
+	mu    sync.Mutex // 保护 count，串行执行加锁和解锁
+	gate  sync.RWMutex
+	count int // 尚未解除的加锁次数
+}
+
+// fsyncLock 全局 fsync lock 状态
+var fsyncLock = &fsyncLockState{}
+
+// lock 阻塞写命令，返回加锁后的次数
+func (s *fsyncLockState) lock() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		s.gate.Lock()
+	}
+	s.count++
+	return s.count
+}
+
+// unlock 解除一次加锁，返回剩余的次数；没有加锁时 ok 为 false
+func (s *fsyncLockState) unlock() (remaining int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return 0, false
+	}
+	s.count--
+	if s.count == 0 {
+		s.gate.Unlock()
+	}
+	return s.count, true
+}
+
+// blockedByFsyncLock 命令是否修改数据，fsync lock 期间需要等待解锁后执行
+func blockedByFsyncLock(spec *commandSpec) bool {
+	switch spec.action {
+	case ActionCreateCollection, ActionDropCollection, ActionCreateIndex, ActionDropIndex,
+		ActionDropDatabase, ActionReIndex, ActionCompact:
+		return true
+	}
+	return isWriteCommand(spec)
+}
+
+// cmdFsync 处理 fsync 命令，建立存储引擎检查点
+// lock 为 true 时先阻塞之后的写命令再建立检查点，直到相同次数的 fsyncUnlock 后恢复写入
+func (l *EventListener) cmdFsync(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	if req.db != "admin" {
+		return nil, NewCommandError(CodeUnauthorized, "fsync may only be run against the admin database.")
+	}
+	lock := false
+	if v, err := req.body.LookupErr("lock"); err == nil {
+		b, ok := v.BooleanOK()
+		if !ok {
+			n, isNumber := v.AsInt64OK()
+			if !isNumber {
+				return nil, NewCommandError(CodeTypeMismatch, "BSON field 'fsync.lock' is the wrong type '%s', expected type 'bool'", v.Type)
+			}
+			b = n != 0
+		}
+		lock = b
+	}
+
+	var lockCount int
+	if lock {
+		lockCount = fsyncLock.lock()
+	}
+	numFiles, err := l.storageEngine.Checkpoint(ctx)
+	if err != nil {
+		if lock {
+			fsyncLock.unlock()
+		}
+		return nil, err
+	}
+
+	builder := bsoncore.NewDocumentBuilder().AppendInt32("numFiles", int32(numFiles))
+	if lock {
+		builder.
+			AppendString("info", "now locked against writes, use db.fsyncUnlock() to unlock").
+			AppendInt64("lockCount", int64(lockCount))
+	}
+	return builder, nil
+}
+
+// cmdFsyncUnlock 处理 fsyncUnlock 命令，解除一次 fsync lock
+func (l *EventListener) cmdFsyncUnlock(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	if req.db != "admin" {
+		return nil, NewCommandError(CodeUnauthorized, "fsyncUnlock may only be run against the admin database.")
+	}
+	remaining, ok := fsyncLock.unlock()
+	if !ok {
+		return nil, NewCommandError(CodeIllegalOperation, "fsyncUnlock called when not locked")
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("info", "fsyncUnlock completed").
+		AppendInt64("lockCount", int64(remaining)), nil
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestFsync 测试 fsync 建立检查点，以及 fsync lock 阻塞写命令直到 fsyncUnlock
+func TestFsync(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	fsync := func(lock bool) bsoncore.Document {
+		b := bsoncore.NewDocumentBuilder().AppendInt32("fsync", 1)
+		if lock {
+			b.AppendBoolean("lock", true)
+		}
+		return b.AppendString("$db", "admin").Build()
+	}
+	unlock := bsoncore.NewDocumentBuilder().AppendInt32("fsyncUnlock", 1).AppendString("$db", "admin").Build()
+	doc := func(id int32) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).Build()
+	}
+
+	t.Run("检查点", func(t *testing.T) {
+		run(1, insertCommandDocument("test", "items", doc(1)))
+		reply := run(2, fsync(false))
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("numFiles").Int32() < 2 {
+			t.Errorf("fsync 应返回检查点覆盖的文件数: %s", reply)
+		}
+		if _, err := reply.LookupErr("lockCount"); err == nil {
+			t.Errorf("不加锁时不应返回 lockCount: %s", reply)
+		}
+		notAdmin := bsoncore.NewDocumentBuilder().AppendInt32("fsync", 1).AppendString("$db", "test").Build()
+		if code := run(3, notAdmin).Lookup("code").Int32(); code != int32(CodeUnauthorized) {
+			t.Errorf("fsync 只能在 admin 库上执行, got %d", code)
+		}
+	})
+
+	t.Run("加锁与解锁", func(t *testing.T) {
+		if code := run(10, unlock).Lookup("code").Int32(); code != int32(CodeIllegalOperation) {
+			t.Errorf("没有加锁时 fsyncUnlock 应返回 IllegalOperation, got %d", code)
+		}
+
+		if reply := run(11, fsync(true)); reply.Lookup("lockCount").Int64() != 1 {
+			t.Fatalf("加锁后 lockCount 应为 1: %s", reply)
+		}
+		if reply := run(12, fsync(true)); reply.Lookup("lockCount").Int64() != 2 {
+			t.Fatalf("再次加锁后 lockCount 应为 2: %s", reply)
+		}
+
+		done := make(chan *Message, 1)
+		go func() {
+			done <- listener.handleMessage(newFakeSession(), newOpMsgMessage(13, insertCommandDocument("test", "items", doc(2))))
+		}()
+		select {
+		case reply := <-done:
+			t.Fatalf("加锁期间写命令应被阻塞: %s", replyDocument(t, reply))
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// 加锁期间仍然可以读取
+		find := bsoncore.NewDocumentBuilder().AppendString("find", "items").AppendString("$db", "test").Build()
+		if _, docs := cursorBatch(t, run(14, find), "firstBatch"); len(docs) != 1 {
+			t.Errorf("加锁期间应能读到 1 个文档, got %d", len(docs))
+		}
+
+		if reply := run(15, unlock); reply.Lookup("lockCount").Int64() != 1 {
+			t.Fatalf("解锁一次后 lockCount 应为 1: %s", reply)
+		}
+		select {
+		case reply := <-done:
+			t.Fatalf("还有未解除的加锁时写命令应继续阻塞: %s", replyDocument(t, reply))
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if reply := run(16, unlock); reply.Lookup("lockCount").Int64() != 0 {
+			t.Fatalf("全部解锁后 lockCount 应为 0: %s", reply)
+		}
+		select {
+		case msg := <-done:
+			if reply := replyDocument(t, msg); reply.Lookup("n").Int32() != 1 {
+				t.Errorf("解锁后写命令应执行成功: %s", reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("解锁后写命令仍被阻塞")
+		}
+	})
+}
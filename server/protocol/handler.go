@@ -4,16 +4,30 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 
 	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
 )
 
 // PackageHandler MongoDB 协议包处理器
-type PackageHandler struct{}
+type PackageHandler struct {
+	maxMsgLen int32 // 单条消息允许的最大长度
+}
 
 // NewPackageHandler 创建新的包处理器
-func NewPackageHandler() *PackageHandler {
-	return &PackageHandler{}
+// maxMsgLen 不大于 0 时使用 maxMessageSizeBytes
+func NewPackageHandler(maxMsgLen int) *PackageHandler {
+	return &PackageHandler{maxMsgLen: maxMessageLength(maxMsgLen)}
+}
+
+// maxMessageLength 返回配置的单条消息最大长度，不大于 0 或超出 int32 时使用 maxMessageSizeBytes
+// 解压 OP_COMPRESSED 消息时同样按该长度限制解压后的消息
+func maxMessageLength(maxMsgLen int) int32 {
+	if maxMsgLen <= 0 || maxMsgLen > math.MaxInt32 {
+		return maxMessageSizeBytes
+	}
+	return int32(maxMsgLen)
 }
 
 // Read 读取数据包
@@ -29,6 +43,14 @@ func (h *PackageHandler) Read(ss getty.Session, data []byte) (interface{}, int,
 		return nil, 0, fmt.Errorf("解析消息头失败: %w", err)
 	}
 
+	// 在等待消息体之前校验长度，避免按伪造的长度缓冲数据；返回错误时 getty 会关闭连接
+	if header.MessageLength < 16 {
+		return nil, 0, fmt.Errorf("消息长度 %d 小于消息头长度 16", header.MessageLength)
+	}
+	if header.MessageLength > h.maxMsgLen {
+		return nil, 0, fmt.Errorf("消息长度 %d 超过上限 %d", header.MessageLength, h.maxMsgLen)
+	}
+
 	// 检查是否有完整的消息
 	if len(data) < int(header.MessageLength) {
 		return nil, 0, nil // 等待更多数据
@@ -66,6 +88,12 @@ type Message struct {
 	Header *MessageHeader
 	Body   []byte
 	OpCode OpCode
+
+	// Compressor 请求解压前使用的压缩算法；设置在回复上时表示回复需要压缩
+	Compressor wiremessage.CompressorID
+
+	// exhaust 设置了 moreToCome 的回复发送后需要继续执行的 getMore 请求，见 prepareExhaust
+	exhaust *Message
 }
 
 // OpCode 操作码
@@ -81,6 +109,7 @@ const (
 	OpKillCursors  OpCode = 2007 // 关闭游标
 	OpCommand      OpCode = 2010 // 命令 (MongoDB 3.2+)
 	OpCommandReply OpCode = 2011 // 命令回复
+	OpCompressed   OpCode = 2012 // 压缩消息 (MongoDB 3.4+)
 	OpMsg          OpCode = 2013 // 消息 (MongoDB 3.6+)
 )
 
@@ -111,9 +140,10 @@ func parseMessageHeader(data []byte) (*MessageHeader, error) {
 
 // parseMessage 解析完整消息
 func parseMessage(data []byte, header *MessageHeader) (*Message, error) {
+	// 复制消息体：data 是 getty 的读缓冲区，消费后会被后续读取的数据覆盖
 	message := &Message{
 		Header: header,
-		Body:   data[16:], // 跳过16字节头部
+		Body:   bytes.Clone(data[16:]), // 跳过16字节头部
 		OpCode: OpCode(header.OpCode),
 	}
 
@@ -121,29 +151,22 @@ func parseMessage(data []byte, header *MessageHeader) (*Message, error) {
 }
 
 // Serialize 序列化消息
+// 消息长度总是按消息体重新计算，不依赖调用方手工填写的 MessageLength
 func (m *Message) Serialize() ([]byte, error) {
-	buf := new(bytes.Buffer)
-
-	// 写入消息头
-	if err := binary.Write(buf, binary.LittleEndian, m.Header.MessageLength); err != nil {
-		return nil, err
-	}
-	if err := binary.Write(buf, binary.LittleEndian, m.Header.RequestID); err != nil {
-		return nil, err
-	}
-	if err := binary.Write(buf, binary.LittleEndian, m.Header.ResponseTo); err != nil {
-		return nil, err
-	}
-	if err := binary.Write(buf, binary.LittleEndian, m.Header.OpCode); err != nil {
-		return nil, err
+	if m.Header == nil {
+		return nil, fmt.Errorf("消息头为空")
 	}
 
-	// 写入消息体
-	if _, err := buf.Write(m.Body); err != nil {
-		return nil, err
-	}
+	m.Header.MessageLength = int32(16 + len(m.Body))
+
+	buf := make([]byte, 0, m.Header.MessageLength)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(m.Header.MessageLength))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(m.Header.RequestID))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(m.Header.ResponseTo))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(m.Header.OpCode))
+	buf = append(buf, m.Body...)
 
-	return buf.Bytes(), nil
+	return buf, nil
 }
 
 // GetOpCodeName 获取操作码名称
@@ -167,6 +190,8 @@ func (op OpCode) String() string {
 		return "OP_COMMAND"
 	case OpCommandReply:
 		return "OP_COMMAND_REPLY"
+	case OpCompressed:
+		return "OP_COMPRESSED"
 	case OpMsg:
 		return "OP_MSG"
 	default:
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// TestPackageHandlerMessageLength 测试读取时对消息头长度的校验
+func TestPackageHandlerMessageLength(t *testing.T) {
+	handler := NewPackageHandler(1024)
+	header := func(length int32) []byte {
+		return wiremessage.AppendHeader(nil, length, 1, 0, wiremessage.OpMsg)
+	}
+
+	tests := []struct {
+		name   string
+		length int32
+	}{
+		{"超过上限", 1<<31 - 1},
+		{"略超上限", 1025},
+		{"小于消息头", 8},
+		{"负数", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg, n, err := handler.Read(nil, header(tt.length))
+			if err == nil {
+				t.Fatalf("长度 %d 应返回错误，而不是等待更多数据: pkg=%v n=%d", tt.length, pkg, n)
+			}
+		})
+	}
+
+	t.Run("合法长度等待消息体", func(t *testing.T) {
+		pkg, n, err := handler.Read(nil, header(100))
+		if err != nil || pkg != nil || n != 0 {
+			t.Fatalf("消息不完整时应等待更多数据: pkg=%v n=%d err=%v", pkg, n, err)
+		}
+	})
+
+	t.Run("默认上限", func(t *testing.T) {
+		if _, _, err := NewPackageHandler(0).Read(nil, header(maxMessageSizeBytes+1)); err == nil {
+			t.Fatal("未配置上限时应使用 maxMessageSizeBytes")
+		}
+	})
+}
+
+// TestPackageHandlerPartialRead 测试大消息被拆成多次 TCP 读取时能正确拼装
+func TestPackageHandlerPartialRead(t *testing.T) {
+	handler := NewPackageHandler(0)
+	command := bsoncore.NewDocumentBuilder().
+		AppendString("insert", "items").
+		AppendString("payload", strings.Repeat("x", 64*1024)).
+		AppendString("$db", "test").
+		Build()
+	first, err := newOpMsgMessage(1, command).Serialize()
+	if err != nil {
+		t.Fatalf("序列化消息失败: %v", err)
+	}
+	second, err := newOpMsgMessage(2, command).Serialize()
+	if err != nil {
+		t.Fatalf("序列化消息失败: %v", err)
+	}
+
+	t.Run("逐字节到达", func(t *testing.T) {
+		for i := 0; i < len(first); i++ {
+			pkg, n, err := handler.Read(nil, first[:i])
+			if err != nil || pkg != nil || n != 0 {
+				t.Fatalf("收到 %d/%d 字节时应等待更多数据: pkg=%v n=%d err=%v", i, len(first), pkg, n, err)
+			}
+		}
+		pkg, n, err := handler.Read(nil, first)
+		if err != nil || n != len(first) {
+			t.Fatalf("完整消息应被读取: n=%d err=%v", n, err)
+		}
+		msg := pkg.(*Message)
+		if msg.Header.RequestID != 1 || !bytes.Equal(msg.Body, first[16:]) {
+			t.Errorf("消息内容不正确: requestID=%d", msg.Header.RequestID)
+		}
+	})
+
+	t.Run("只消费一条消息", func(t *testing.T) {
+		stream := append(append([]byte{}, first...), second[:len(second)/2]...)
+		pkg, n, err := handler.Read(nil, stream)
+		if err != nil || pkg == nil || n != len(first) {
+			t.Fatalf("应只消费第一条消息的 %d 字节: n=%d err=%v", len(first), n, err)
+		}
+		// getty 复用读缓冲区，已返回的消息不应受后续数据影响
+		copy(stream, second)
+		if !bytes.Equal(pkg.(*Message).Body, first[16:]) {
+			t.Error("消息体不应引用读缓冲区")
+		}
+		pkg, n, err = handler.Read(nil, stream[n:])
+		if err != nil || pkg != nil || n != 0 {
+			t.Fatalf("第二条消息不完整时应等待更多数据: pkg=%v n=%d err=%v", pkg, n, err)
+		}
+	})
+}
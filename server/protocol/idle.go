@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/logger"
+)
+
+// parseIdleTimeout 解析空闲超时配置，空值、0 或非法值表示不限制
+func parseIdleTimeout(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		logger.Warnf("无效的 idle_timeout 配置 %q，不启用空闲会话回收", value)
+		return 0
+	}
+	return timeout
+}
+
+// touchSession 记录会话的最近活动时间
+func touchSession(session getty.Session) {
+	stateOf(session).touch(time.Now())
+}
+
+// sessionIdleTime 返回会话自最近一次活动以来的空闲时长
+func sessionIdleTime(session getty.Session, now time.Time) time.Duration {
+	return stateOf(session).idleTime(now)
+}
+
+// reapIdleSession 关闭空闲超过阈值的会话，返回是否已关闭
+func (l *EventListener) reapIdleSession(session getty.Session, now time.Time) bool {
+	if l.idleTimeout <= 0 || session.IsClosed() {
+		return false
+	}
+	idle := sessionIdleTime(session, now)
+	if idle < l.idleTimeout {
+		return false
+	}
+
+	logger.Infof("会话 %s 空闲 %s 超过 %s，关闭连接", remoteAddr(session), idle.Truncate(time.Second), l.idleTimeout)
+	releaseSessionState(session)
+	session.Close()
+	return true
+}
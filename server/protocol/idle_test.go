@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestIdleSessionReaper 测试 OnCron 回收空闲会话
+func TestIdleSessionReaper(t *testing.T) {
+	cfg := &config.Config{Network: config.NetworkConfig{IdleTimeout: "1m"}}
+	listener := newTestListener(t, cfg)
+
+	t.Run("活跃会话保留", func(t *testing.T) {
+		session := newFakeSession()
+		listener.OnOpen(session)
+		listener.OnCron(session)
+		if session.IsClosed() {
+			t.Error("刚建立的会话不应被关闭")
+		}
+	})
+
+	t.Run("空闲会话被关闭并回滚事务", func(t *testing.T) {
+		ctx := context.Background()
+		session := newFakeSession()
+		listener.OnOpen(session)
+
+		engineSession := stateOf(session).boundEngineSession()
+		if err := engineSession.BeginTransaction(ctx); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+
+		now := time.Now()
+		if listener.reapIdleSession(session, now.Add(30*time.Second)) {
+			t.Fatal("未超过阈值的会话不应被回收")
+		}
+		if !listener.reapIdleSession(session, now.Add(2*time.Minute)) {
+			t.Fatal("超过阈值的会话应被回收")
+		}
+		if !session.IsClosed() {
+			t.Error("会话应已关闭")
+		}
+		if engineSession.InTransaction() || engineSession.IsActive() {
+			t.Error("会话持有的事务应被回滚并结束")
+		}
+	})
+
+	t.Run("收到消息刷新活动时间", func(t *testing.T) {
+		session := newFakeSession()
+		stateOf(session).touch(time.Now().Add(-time.Hour))
+		listener.OnMessage(session, newOpMsgMessage(1, pingCommandDocument()))
+		listener.OnCron(session)
+		if session.IsClosed() {
+			t.Error("收到消息后会话不应被视为空闲")
+		}
+	})
+
+	t.Run("空闲回收关闭游标的数据来源", func(t *testing.T) {
+		cfg := &config.Config{Network: config.NetworkConfig{IdleTimeout: "1m"}}
+		cfg.Server.CursorTimeoutMS = 60000
+		listener := newTestListener(t, cfg)
+		session := newFakeSession()
+		listener.OnOpen(session)
+
+		source := &closeRecordingSource{documentSource: newDocumentSource([]storage.Document{{"_id": int32(1)}, {"_id": int32(2)}})}
+		result, err := listener.openCursor(context.Background(), "test.items", source, 1, false)
+		if err != nil {
+			t.Fatalf("打开游标失败: %v", err)
+		}
+		id := result.Build().Lookup("cursor", "id").Int64()
+		cursors.mu.Lock()
+		cursors.cursors[id].lastUsed = time.Now().Add(-time.Hour)
+		cursors.mu.Unlock()
+		stateOf(session).touch(time.Now().Add(-time.Hour))
+
+		listener.OnCron(session)
+		if !session.IsClosed() {
+			t.Error("空闲会话应被关闭")
+		}
+		if _, ok := cursors.get(id); ok {
+			t.Error("空闲游标应从注册表删除")
+		}
+		if !source.closed {
+			t.Error("回收空闲游标时应关闭数据来源")
+		}
+	})
+
+	t.Run("未配置超时不回收", func(t *testing.T) {
+		listener := newTestListener(t, &config.Config{})
+		session := newFakeSession()
+		stateOf(session).touch(time.Now().Add(-24 * time.Hour))
+		listener.OnCron(session)
+		if session.IsClosed() {
+			t.Error("未配置 idle_timeout 时不应关闭会话")
+		}
+	})
+}
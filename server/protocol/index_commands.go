@@ -0,0 +1,373 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("createIndexes", ActionCreateIndex, (*EventListener).cmdCreateIndexes)
+	registerCommand("listIndexes", ActionListIndexes, (*EventListener).cmdListIndexes)
+	registerCommand("reIndex", ActionReIndex, (*EventListener).cmdReIndex)
+	registerCommand("dropIndexes", ActionDropIndex, (*EventListener).cmdDropIndexes)
+}
+
+// maxIndexNameLength 索引名的最大字节数，默认索引名同样受限，键模式较长时需要显式指定 name
+const maxIndexNameLength = 127
+
+// parseIndexKey 解析键模式中的一个字段，方向只能是 1、-1 或索引类型名
+// 1 和 -1 可以是任意数值类型
+func parseIndexKey(field string, v bsoncore.Value) (storage.IndexKey, error) {
+	if plugin, ok := v.StringValueOK(); ok {
+		switch plugin {
+		case storage.IndexTypeText, storage.IndexType2D, storage.IndexType2DSphere, storage.IndexTypeHashed:
+			return storage.IndexKey{Field: field, Direction: 1, Type: plugin}, nil
+		}
+		return storage.IndexKey{}, NewCommandError(CodeInvalidIndexSpecification, "Unknown index plugin '%s' for field '%s'", plugin, field)
+	}
+	if v.IsNumber() {
+		direction, isDouble := v.DoubleOK()
+		if !isDouble {
+			n, _ := v.AsInt64OK()
+			direction = float64(n)
+		}
+		switch direction {
+		case 1:
+			return storage.IndexKey{Field: field, Direction: 1}, nil
+		case -1:
+			return storage.IndexKey{Field: field, Direction: -1}, nil
+		}
+	}
+	return storage.IndexKey{}, NewCommandError(CodeInvalidIndexSpecification,
+		"Values in the index key pattern can only be 1, -1 or one of \"2d\", \"2dsphere\", \"text\", \"hashed\"; field '%s' has %s", field, v)
+}
+
+// parseKeyPattern 解析索引的键模式，键模式不能为空，字段名不能为空或重复
+func parseKeyPattern(v bsoncore.Value) ([]storage.IndexKey, error) {
+	keyDoc, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "The field 'key' must be an object, but got %s", v.Type)
+	}
+	elems, err := keyDoc.Elements()
+	if err != nil || len(elems) == 0 {
+		return nil, NewCommandError(CodeCannotCreateIndex, "Index keys cannot be empty.")
+	}
+	keys := make([]storage.IndexKey, 0, len(elems))
+	seen := make(map[string]bool, len(elems))
+	for _, elem := range elems {
+		field := elem.Key()
+		if field == "" {
+			return nil, NewCommandError(CodeCannotCreateIndex, "Index keys cannot be an empty field.")
+		}
+		if seen[field] {
+			return nil, NewCommandError(CodeInvalidIndexSpecification, "Index key pattern %s contains duplicate field '%s'", keyDoc, field)
+		}
+		seen[field] = true
+		key, err := parseIndexKey(field, elem.Value())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// parseIndexSpec 解析 createIndexes 中的单个索引定义 {key, name, unique, sparse, partialFilterExpression, expireAfterSeconds, hidden}
+func parseIndexSpec(doc bsoncore.Document) (storage.Index, error) {
+	var index storage.Index
+	v, err := doc.LookupErr("key")
+	if err != nil {
+		return index, NewCommandError(CodeFailedToParse, "The 'key' field is a required property of an index specification")
+	}
+	if index.Keys, err = parseKeyPattern(v); err != nil {
+		return index, err
+	}
+
+	index.Name = storage.DefaultIndexName(index.Keys)
+	if v, err := doc.LookupErr("name"); err == nil {
+		name, ok := v.StringValueOK()
+		if !ok || name == "" {
+			return index, NewCommandError(CodeTypeMismatch, "The field 'name' must be a non-empty string")
+		}
+		index.Name = name
+	}
+	if len(index.Name) > maxIndexNameLength {
+		return index, NewCommandError(CodeCannotCreateIndex, "index name '%s' is too long (%d bytes, %d byte max)", index.Name, len(index.Name), maxIndexNameLength)
+	}
+	if v, err := doc.LookupErr("unique"); err == nil {
+		index.Unique = v.Boolean()
+	}
+	if v, err := doc.LookupErr("sparse"); err == nil {
+		index.Sparse = v.Boolean()
+	}
+	if v, err := doc.LookupErr("partialFilterExpression"); err == nil {
+		filter, ok := v.DocumentOK()
+		if !ok {
+			return index, NewCommandError(CodeTypeMismatch, "The field 'partialFilterExpression' must be an object, but got %s", v.Type)
+		}
+		if index.PartialFilterExpression, err = storage.UnmarshalDocument(filter); err != nil {
+			return index, NewCommandError(CodeFailedToParse, "%v", err)
+		}
+	}
+	if v, err := doc.LookupErr("expireAfterSeconds"); err == nil {
+		seconds, ok := v.AsInt64OK()
+		if !ok {
+			return index, NewCommandError(CodeTypeMismatch, "The field 'expireAfterSeconds' must be a number, but got %s", v.Type)
+		}
+		if seconds <= 0 || seconds > math.MaxInt32 {
+			// ExpireAfterSeconds 为 0 表示普通索引，暂不支持在指定时刻过期的写法
+			return index, NewCommandError(CodeCannotCreateIndex, "TTL index 'expireAfterSeconds' option must be within an acceptable range [1, %d], got %d", math.MaxInt32, seconds)
+		}
+		index.ExpireAfterSeconds = int(seconds)
+	}
+	if v, err := doc.LookupErr("hidden"); err == nil {
+		hidden, ok := v.BooleanOK()
+		if !ok {
+			return index, NewCommandError(CodeTypeMismatch, "The field 'hidden' must be a boolean, but got %s", v.Type)
+		}
+		if hidden && index.Name == storage.IdIndexName {
+			return index, NewCommandError(CodeBadValue, "can't hide _id index")
+		}
+		index.Hidden = hidden
+	}
+	return index, nil
+}
+
+// indexSpecDocument 将索引定义转换为 listIndexes 返回的 {v, key, name, unique, sparse, partialFilterExpression, expireAfterSeconds, hidden} 文档
+func indexSpecDocument(index storage.Index) bsoncore.Document {
+	key := bsoncore.NewDocumentBuilder()
+	if index.IsText() {
+		key.AppendString("_fts", "text").AppendInt32("_ftsx", 1)
+	} else {
+		for _, k := range index.Keys {
+			if k.Type != "" {
+				key.AppendString(k.Field, k.Type)
+				continue
+			}
+			key.AppendInt32(k.Field, int32(k.Direction))
+		}
+	}
+	builder := bsoncore.NewDocumentBuilder().
+		AppendInt32("v", 2).
+		AppendDocument("key", key.Build()).
+		AppendString("name", index.Name)
+	if index.IsText() {
+		weights := bsoncore.NewDocumentBuilder()
+		for _, k := range index.Keys {
+			weights.AppendInt32(k.Field, 1)
+		}
+		builder.AppendDocument("weights", weights.Build()).
+			AppendString("default_language", "english").
+			AppendString("language_override", "language").
+			AppendInt32("textIndexVersion", 3)
+	}
+	if index.Type() == storage.IndexType2DSphere {
+		builder.AppendInt32("2dsphereIndexVersion", 3)
+	}
+	if index.Unique && index.Name != storage.IdIndexName {
+		builder.AppendBoolean("unique", true)
+	}
+	if index.Sparse {
+		builder.AppendBoolean("sparse", true)
+	}
+	if len(index.PartialFilterExpression) > 0 {
+		if filter, err := storage.MarshalDocument(index.PartialFilterExpression); err == nil {
+			builder.AppendDocument("partialFilterExpression", filter)
+		}
+	}
+	if index.ExpireAfterSeconds > 0 {
+		builder.AppendInt32("expireAfterSeconds", int32(index.ExpireAfterSeconds))
+	}
+	if index.Hidden {
+		builder.AppendBoolean("hidden", true)
+	}
+	return builder.Build()
+}
+
+// cmdCreateIndexes 处理 createIndexes 命令，集合不存在时隐式创建
+func (l *EventListener) cmdCreateIndexes(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := documentsArgument(req, "indexes")
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, NewCommandError(CodeBadValue, "Must specify at least one index to create")
+	}
+	indexes := make([]storage.Index, 0, len(specs))
+	for _, spec := range specs {
+		index, err := parseIndexSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+
+	before, err := l.storageEngine.ListIndexes(ctx, req.db, coll)
+	createdCollection := errors.Is(err, storage.ErrNamespaceNotFound)
+	if err != nil && !createdCollection {
+		return nil, err
+	}
+	numBefore := len(before)
+	if createdCollection {
+		numBefore = 1 // 隐式创建的集合自带 _id 索引
+	}
+
+	for _, index := range indexes {
+		if err := l.storageEngine.CreateIndex(ctx, req.db, coll, index); err != nil {
+			return nil, err
+		}
+	}
+	after, err := l.storageEngine.ListIndexes(ctx, req.db, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := bsoncore.NewDocumentBuilder().
+		AppendBoolean("createdCollectionAutomatically", createdCollection).
+		AppendInt32("numIndexesBefore", int32(numBefore)).
+		AppendInt32("numIndexesAfter", int32(len(after)))
+	if len(after) == numBefore {
+		builder.AppendString("note", "all indexes already exist")
+	}
+	return builder, nil
+}
+
+// cmdListIndexes 处理 listIndexes 命令
+func (l *EventListener) cmdListIndexes(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := l.defaultBatchSize
+	if v, err := req.body.LookupErr("cursor"); err == nil {
+		cursorDoc, ok := v.DocumentOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "cursor field must be missing or an object")
+		}
+		if batchSize, err = batchSizeArgument(cursorDoc, l.defaultBatchSize); err != nil {
+			return nil, err
+		}
+	}
+
+	indexes, err := l.storageEngine.ListIndexes(ctx, req.db, coll)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]bsoncore.Document, len(indexes))
+	for i, index := range indexes {
+		docs[i] = indexSpecDocument(index)
+	}
+	return l.openCursor(ctx, req.db+".$cmd.listIndexes."+coll, newRawDocumentSource(docs), batchSize, false)
+}
+
+// cmdReIndex 处理 reIndex 命令，按记录重建集合中除 _id 以外的全部索引
+func (l *EventListener) cmdReIndex(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.storageEngine.ReIndex(ctx, req.db, coll); err != nil {
+		return nil, err
+	}
+	indexes, err := l.storageEngine.ListIndexes(ctx, req.db, coll)
+	if err != nil {
+		return nil, err
+	}
+	specs := bsoncore.NewArrayBuilder()
+	for _, index := range indexes {
+		specs.AppendDocument(indexSpecDocument(index))
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendInt32("nIndexesWas", int32(len(indexes))).
+		AppendInt32("nIndexes", int32(len(indexes))).
+		AppendArray("indexes", specs.Build()), nil
+}
+
+// indexNameByKeyPattern 返回集合中键模式与 keyPattern 相同的索引名
+func (l *EventListener) indexNameByKeyPattern(ctx context.Context, db, coll string, keyPattern bsoncore.Value) (string, error) {
+	keys, err := parseKeyPattern(keyPattern)
+	if err != nil {
+		return "", err
+	}
+	name := storage.DefaultIndexName(keys)
+	indexes, err := l.storageEngine.ListIndexes(ctx, db, coll)
+	if err != nil {
+		return "", err
+	}
+	for _, index := range indexes {
+		if storage.DefaultIndexName(index.Keys) == name {
+			return index.Name, nil
+		}
+	}
+	return "", NewCommandError(CodeIndexNotFound, "cannot find index %s for ns %s.%s", keyPattern, db, coll)
+}
+
+// cmdDropIndexes 处理 dropIndexes 命令，返回删除前的索引数 nIndexesWas
+// index 可以是索引名、索引名数组、键模式或 "*"，"*" 删除 _id 索引以外的所有索引；_id 索引不能删除
+func (l *EventListener) cmdDropIndexes(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	v, err := req.body.LookupErr("index")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'dropIndexes.index' is missing but a required field")
+	}
+
+	var names []string
+	switch v.Type {
+	case bsoncore.TypeString:
+		names = []string{v.StringValue()}
+	case bsoncore.TypeArray:
+		values, err := v.Array().Values()
+		if err != nil {
+			return nil, NewCommandError(CodeFailedToParse, "%v", err)
+		}
+		for _, value := range values {
+			name, ok := value.StringValueOK()
+			if !ok {
+				return nil, NewCommandError(CodeTypeMismatch, "dropIndexes index array must contain only strings, found %s", value.Type)
+			}
+			if name == storage.AllIndexes {
+				return nil, NewCommandError(CodeBadValue, "The wildcard '*' cannot be used in an index name array")
+			}
+			names = append(names, name)
+		}
+	case bsoncore.TypeEmbeddedDocument:
+		name, err := l.indexNameByKeyPattern(ctx, req.db, coll, v)
+		if err != nil {
+			if errors.Is(err, storage.ErrNamespaceNotFound) {
+				return nil, NewCommandError(CodeNamespaceNotFound, "ns not found %s.%s", req.db, coll)
+			}
+			return nil, err
+		}
+		names = []string{name}
+	default:
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'dropIndexes.index' is the wrong type '%s', expected types '[string, object, array]'", v.Type)
+	}
+	for _, name := range names {
+		if name == storage.IdIndexName {
+			return nil, NewCommandError(CodeInvalidOptions, "cannot drop _id index")
+		}
+	}
+
+	nIndexesWas, err := l.storageEngine.DropIndexes(ctx, req.db, coll, names)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNamespaceNotFound):
+			return nil, NewCommandError(CodeNamespaceNotFound, "ns not found %s.%s", req.db, coll)
+		case errors.Is(err, storage.ErrIndexNotFound):
+			return nil, NewCommandError(CodeIndexNotFound, "index not found with name %v", names)
+		}
+		return nil, err
+	}
+	return bsoncore.NewDocumentBuilder().AppendInt32("nIndexesWas", int32(nIndexesWas)), nil
+}
@@ -0,0 +1,451 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// createIndexesCommandDocument 构造 createIndexes 命令文档
+func createIndexesCommandDocument(db, coll string, specs ...bsoncore.Document) bsoncore.Document {
+	arr := bsoncore.NewArrayBuilder()
+	for _, spec := range specs {
+		arr.AppendDocument(spec)
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("createIndexes", coll).
+		AppendArray("indexes", arr.Build()).
+		AppendString("$db", db).
+		Build()
+}
+
+// TestIndexCommands 测试 createIndexes 和 listIndexes 命令，以及 find 使用新建的索引
+func TestIndexCommands(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+
+	compound := bsoncore.NewDocumentBuilder().
+		AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("city", 1).AppendInt32("age", -1).Build()).
+		Build()
+	reply := run(1, createIndexesCommandDocument("test", "people", compound))
+	if reply.Lookup("ok").Double() != 1 ||
+		!reply.Lookup("createdCollectionAutomatically").Boolean() ||
+		reply.Lookup("numIndexesBefore").Int32() != 1 ||
+		reply.Lookup("numIndexesAfter").Int32() != 2 {
+		t.Fatalf("createIndexes 结果不正确: %s", reply)
+	}
+
+	t.Run("重复创建", func(t *testing.T) {
+		reply := run(2, createIndexesCommandDocument("test", "people", compound))
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("numIndexesAfter").Int32() != 2 {
+			t.Errorf("重复创建相同索引应成功且不增加索引: %s", reply)
+		}
+		conflict := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("name", 1).Build()).
+			AppendString("name", "city_1_age_-1").
+			Build()
+		reply = run(3, createIndexesCommandDocument("test", "people", conflict))
+		if code := reply.Lookup("code").Int32(); code != int32(CodeIndexOptionsConflict) {
+			t.Errorf("同名不同键模式的索引应返回 IndexOptionsConflict: %s", reply)
+		}
+	})
+
+	t.Run("listIndexes", func(t *testing.T) {
+		cmd := bsoncore.NewDocumentBuilder().AppendString("listIndexes", "people").AppendString("$db", "test").Build()
+		_, batch := cursorBatch(t, run(4, cmd), "firstBatch")
+		if len(batch) != 2 {
+			t.Fatalf("应返回 2 个索引: %v", batch)
+		}
+		if name := batch[0].Lookup("name").StringValue(); name != "_id_" {
+			t.Errorf("第一个索引应为 _id_, got %s", name)
+		}
+		if name := batch[1].Lookup("name").StringValue(); name != "city_1_age_-1" {
+			t.Errorf("默认索引名不正确: %s", name)
+		}
+		elems, _ := batch[1].Lookup("key").Document().Elements()
+		if len(elems) != 2 || elems[0].Key() != "city" || elems[1].Key() != "age" || elems[1].Value().Int32() != -1 {
+			t.Errorf("键模式应保持字段顺序: %s", batch[1])
+		}
+
+		missing := bsoncore.NewDocumentBuilder().AppendString("listIndexes", "missing").AppendString("$db", "test").Build()
+		if code := run(5, missing).Lookup("code").Int32(); code != int32(CodeNamespaceNotFound) {
+			t.Errorf("集合不存在时应返回 NamespaceNotFound, got %d", code)
+		}
+	})
+
+	t.Run("find 使用索引", func(t *testing.T) {
+		docs := []bsoncore.Document{
+			bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("city", "Beijing").AppendInt32("age", 30).Build(),
+			bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendString("city", "Shanghai").AppendInt32("age", 25).Build(),
+			bsoncore.NewDocumentBuilder().AppendInt32("_id", 3).AppendString("city", "Beijing").AppendInt32("age", 40).Build(),
+		}
+		run(6, insertCommandDocument("test", "people", docs...))
+
+		find := bsoncore.NewDocumentBuilder().
+			AppendString("find", "people").
+			AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendString("city", "Beijing").Build()).
+			Build()
+		reply := run(7, explainCommandDocument("test", find, "executionStats"))
+		if name := reply.Lookup("queryPlanner", "winningPlan", "inputStage", "indexName").StringValue(); name != "city_1_age_-1" {
+			t.Errorf("应使用 city_1_age_-1 索引: %s", reply)
+		}
+		if n := reply.Lookup("executionStats", "totalDocsExamined").AsInt64(); n != 2 {
+			t.Errorf("totalDocsExamined = %d, want 2", n)
+		}
+
+		cmd := bsoncore.NewDocumentBuilder().
+			AppendString("find", "people").
+			AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendString("city", "Beijing").Build()).
+			AppendString("$db", "test").
+			Build()
+		if _, batch := cursorBatch(t, run(8, cmd), "firstBatch"); len(batch) != 2 {
+			t.Errorf("应返回 2 个文档: %v", batch)
+		}
+	})
+
+	t.Run("部分索引", func(t *testing.T) {
+		partial := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("age", 1).Build()).
+			AppendDocument("partialFilterExpression", bsoncore.NewDocumentBuilder().
+				AppendDocument("age", bsoncore.NewDocumentBuilder().AppendInt32("$gte", 30).Build()).
+				Build()).
+			Build()
+		if reply := run(9, createIndexesCommandDocument("test", "people", partial)); reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("创建部分索引失败: %s", reply)
+		}
+		cmd := bsoncore.NewDocumentBuilder().AppendString("listIndexes", "people").AppendString("$db", "test").Build()
+		_, batch := cursorBatch(t, run(10, cmd), "firstBatch")
+		if len(batch) != 3 || batch[2].Lookup("partialFilterExpression", "age", "$gte").Int32() != 30 {
+			t.Errorf("listIndexes 应返回 partialFilterExpression: %v", batch)
+		}
+
+		invalid := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("name", 1).Build()).
+			AppendInt32("partialFilterExpression", 1).
+			Build()
+		if code := run(11, createIndexesCommandDocument("test", "people", invalid)).Lookup("code").Int32(); code != int32(CodeTypeMismatch) {
+			t.Errorf("partialFilterExpression 不是文档时应返回 TypeMismatch, got %d", code)
+		}
+	})
+
+	t.Run("TTL 索引", func(t *testing.T) {
+		ttl := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("createdAt", 1).Build()).
+			AppendInt32("expireAfterSeconds", 3600).
+			Build()
+		if reply := run(12, createIndexesCommandDocument("test", "sessions", ttl)); reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("创建 TTL 索引失败: %s", reply)
+		}
+		cmd := bsoncore.NewDocumentBuilder().AppendString("listIndexes", "sessions").AppendString("$db", "test").Build()
+		_, batch := cursorBatch(t, run(13, cmd), "firstBatch")
+		if len(batch) != 2 || batch[1].Lookup("expireAfterSeconds").Int32() != 3600 {
+			t.Errorf("listIndexes 应返回 expireAfterSeconds: %v", batch)
+		}
+
+		invalid := bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32("updatedAt", 1).Build()).
+			AppendInt32("expireAfterSeconds", -5).
+			Build()
+		if code := run(14, createIndexesCommandDocument("test", "sessions", invalid)).Lookup("code").Int32(); code != int32(CodeCannotCreateIndex) {
+			t.Errorf("expireAfterSeconds 为负数时应返回 CannotCreateIndex, got %d", code)
+		}
+	})
+
+	t.Run("reIndex", func(t *testing.T) {
+		cmd := bsoncore.NewDocumentBuilder().AppendString("reIndex", "people").AppendString("$db", "test").Build()
+		reply := run(15, cmd)
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("nIndexes").Int32() != 3 {
+			t.Fatalf("reIndex 失败: %s", reply)
+		}
+		indexes, err := reply.Lookup("indexes").Array().Values()
+		if err != nil || len(indexes) != 3 || indexes[1].Document().Lookup("name").StringValue() != "city_1_age_-1" {
+			t.Errorf("reIndex 应返回全部索引定义: %s", reply)
+		}
+
+		missing := bsoncore.NewDocumentBuilder().AppendString("reIndex", "missing").AppendString("$db", "test").Build()
+		if code := run(16, missing).Lookup("code").Int32(); code != int32(CodeNamespaceNotFound) {
+			t.Errorf("不存在的集合应返回 NamespaceNotFound, got %d", code)
+		}
+	})
+}
+
+// TestIndexKeyValidation 测试创建索引时校验键模式和索引名
+func TestIndexKeyValidation(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	key := func() *bsoncore.DocumentBuilder { return bsoncore.NewDocumentBuilder() }
+	longField := strings.Repeat("f", 130)
+	tests := []struct {
+		name string
+		spec bsoncore.Document
+		code ErrorCode // 0 表示应创建成功
+	}{
+		{"升序和降序", key().AppendDocument("key", key().AppendInt32("a", 1).AppendInt64("b", -1).Build()).Build(), 0},
+		{"浮点方向", key().AppendDocument("key", key().AppendDouble("c", -1).Build()).Build(), 0},
+		{"索引类型", key().AppendDocument("key", key().AppendString("loc", "2dsphere").Build()).Build(), 0},
+		{"长键模式指定短索引名", key().AppendDocument("key", key().AppendInt32(longField, 1).Build()).AppendString("name", "long").Build(), 0},
+		{"方向为 0", key().AppendDocument("key", key().AppendInt32("a", 0).Build()).Build(), CodeInvalidIndexSpecification},
+		{"方向为 2", key().AppendDocument("key", key().AppendInt32("a", 2).Build()).Build(), CodeInvalidIndexSpecification},
+		{"方向为小数", key().AppendDocument("key", key().AppendDouble("a", 0.5).Build()).Build(), CodeInvalidIndexSpecification},
+		{"方向为布尔值", key().AppendDocument("key", key().AppendBoolean("a", true).Build()).Build(), CodeInvalidIndexSpecification},
+		{"未知索引类型", key().AppendDocument("key", key().AppendString("a", "btree").Build()).Build(), CodeInvalidIndexSpecification},
+		{"空键模式", key().AppendDocument("key", key().Build()).Build(), CodeCannotCreateIndex},
+		{"重复字段", key().AppendDocument("key", key().AppendInt32("a", 1).AppendInt32("a", -1).Build()).Build(), CodeInvalidIndexSpecification},
+		{"索引名过长", key().AppendDocument("key", key().AppendInt32("a", 1).Build()).AppendString("name", strings.Repeat("n", 128)).Build(), CodeCannotCreateIndex},
+		{"默认索引名过长", key().AppendDocument("key", key().AppendInt32(longField, 1).Build()).Build(), CodeCannotCreateIndex},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(int32(i+1), createIndexesCommandDocument("test", "items", tt.spec))))
+			if tt.code == 0 {
+				if reply.Lookup("ok").Double() != 1 {
+					t.Errorf("创建索引失败: %s", reply)
+				}
+				return
+			}
+			if code := reply.Lookup("code").Int32(); code != int32(tt.code) {
+				t.Errorf("code = %d, want %d: %s", code, tt.code, reply)
+			}
+		})
+	}
+}
+
+// TestDropIndexes 测试 dropIndexes 按索引名、索引名数组、键模式和 "*" 删除索引，以及 _id 索引不能删除
+func TestDropIndexes(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	keySpec := func(field string) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			AppendDocument("key", bsoncore.NewDocumentBuilder().AppendInt32(field, 1).Build()).
+			Build()
+	}
+	dropIndexes := func(coll string) *bsoncore.DocumentBuilder {
+		return bsoncore.NewDocumentBuilder().AppendString("dropIndexes", coll).AppendString("$db", "test")
+	}
+	indexNames := func(requestID int32, coll string) []string {
+		t.Helper()
+		cmd := bsoncore.NewDocumentBuilder().AppendString("listIndexes", coll).AppendString("$db", "test").Build()
+		_, batch := cursorBatch(t, run(requestID, cmd), "firstBatch")
+		names := make([]string, len(batch))
+		for i, index := range batch {
+			names[i] = index.Lookup("name").StringValue()
+		}
+		return names
+	}
+	kvIndexes := func() int {
+		return listener.storageEngine.GetStats()["kv_engine"].(map[string]interface{})["indexes"].(int)
+	}
+
+	reply := run(1, createIndexesCommandDocument("test", "items", keySpec("a"), keySpec("b"), keySpec("c"), keySpec("d")))
+	if reply.Lookup("ok").Double() != 1 || reply.Lookup("numIndexesAfter").Int32() != 5 {
+		t.Fatalf("创建索引失败: %s", reply)
+	}
+	kvBefore := kvIndexes()
+
+	t.Run("单个索引名", func(t *testing.T) {
+		reply := run(2, dropIndexes("items").AppendString("index", "a_1").Build())
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("nIndexesWas").Int32() != 5 {
+			t.Fatalf("dropIndexes 结果不正确: %s", reply)
+		}
+		if names := indexNames(3, "items"); len(names) != 4 {
+			t.Errorf("删除后应剩 4 个索引: %v", names)
+		}
+		if n := kvIndexes(); n != kvBefore-1 {
+			t.Errorf("KV 引擎中的索引数 = %d, want %d", n, kvBefore-1)
+		}
+	})
+
+	t.Run("索引名数组", func(t *testing.T) {
+		names := bsoncore.NewArrayBuilder().AppendString("b_1").AppendString("c_1").Build()
+		reply := run(4, dropIndexes("items").AppendArray("index", names).Build())
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("nIndexesWas").Int32() != 4 {
+			t.Fatalf("dropIndexes 结果不正确: %s", reply)
+		}
+		if names := indexNames(5, "items"); len(names) != 2 || names[1] != "d_1" {
+			t.Errorf("删除后应剩 _id_ 和 d_1: %v", names)
+		}
+		if n := kvIndexes(); n != kvBefore-3 {
+			t.Errorf("KV 引擎中的索引数 = %d, want %d", n, kvBefore-3)
+		}
+
+		// 任一索引不存在时不删除任何索引
+		partial := bsoncore.NewArrayBuilder().AppendString("d_1").AppendString("nope").Build()
+		if code := run(6, dropIndexes("items").AppendArray("index", partial).Build()).Lookup("code").Int32(); code != int32(CodeIndexNotFound) {
+			t.Errorf("索引不存在时应返回 IndexNotFound, got %d", code)
+		}
+		if names := indexNames(7, "items"); len(names) != 2 {
+			t.Errorf("失败的 dropIndexes 不应删除索引: %v", names)
+		}
+	})
+
+	t.Run("键模式", func(t *testing.T) {
+		run(8, createIndexesCommandDocument("test", "keyed", keySpec("x")))
+		key := bsoncore.NewDocumentBuilder().AppendInt32("x", 1).Build()
+		reply := run(9, dropIndexes("keyed").AppendDocument("index", key).Build())
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("nIndexesWas").Int32() != 2 {
+			t.Fatalf("dropIndexes 结果不正确: %s", reply)
+		}
+		if names := indexNames(10, "keyed"); len(names) != 1 {
+			t.Errorf("删除后应只剩 _id_: %v", names)
+		}
+	})
+
+	t.Run("通配符", func(t *testing.T) {
+		run(11, createIndexesCommandDocument("test", "items", keySpec("e"), keySpec("f")))
+		reply := run(12, dropIndexes("items").AppendString("index", "*").Build())
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("nIndexesWas").Int32() != 4 {
+			t.Fatalf("dropIndexes 结果不正确: %s", reply)
+		}
+		if names := indexNames(13, "items"); len(names) != 1 || names[0] != "_id_" {
+			t.Errorf("删除后应只剩 _id_: %v", names)
+		}
+		// 只剩 _id 索引时 "*" 不删除任何索引
+		if reply := run(14, dropIndexes("items").AppendString("index", "*").Build()); reply.Lookup("nIndexesWas").Int32() != 1 {
+			t.Errorf("dropIndexes 结果不正确: %s", reply)
+		}
+	})
+
+	t.Run("_id 索引", func(t *testing.T) {
+		run(15, createIndexesCommandDocument("test", "items", keySpec("g")))
+		if code := run(16, dropIndexes("items").AppendString("index", "_id_").Build()).Lookup("code").Int32(); code != int32(CodeInvalidOptions) {
+			t.Errorf("删除 _id 索引应返回 InvalidOptions, got %d", code)
+		}
+		names := bsoncore.NewArrayBuilder().AppendString("g_1").AppendString("_id_").Build()
+		if code := run(17, dropIndexes("items").AppendArray("index", names).Build()).Lookup("code").Int32(); code != int32(CodeInvalidOptions) {
+			t.Errorf("数组中包含 _id 索引应返回 InvalidOptions, got %d", code)
+		}
+		if names := indexNames(18, "items"); len(names) != 2 {
+			t.Errorf("失败的 dropIndexes 不应删除索引: %v", names)
+		}
+	})
+
+	t.Run("参数错误", func(t *testing.T) {
+		if code := run(19, dropIndexes("items").Build()).Lookup("code").Int32(); code != int32(CodeFailedToParse) {
+			t.Errorf("缺少 index 应返回 FailedToParse, got %d", code)
+		}
+		if code := run(20, dropIndexes("items").AppendInt32("index", 1).Build()).Lookup("code").Int32(); code != int32(CodeTypeMismatch) {
+			t.Errorf("index 类型错误应返回 TypeMismatch, got %d", code)
+		}
+		if code := run(21, dropIndexes("missing").AppendString("index", "*").Build()).Lookup("code").Int32(); code != int32(CodeNamespaceNotFound) {
+			t.Errorf("集合不存在时应返回 NamespaceNotFound, got %d", code)
+		}
+	})
+}
+
+// TestTextSearch 测试文本索引的创建、$text 查询以及按 textScore 排序和投影
+func TestTextSearch(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+
+	docs := []bsoncore.Document{
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("content", "coffee shop").Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendString("content", "Coffee, coffee and more coffee").Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 3).AppendString("content", "tea house").Build(),
+	}
+	run(1, insertCommandDocument("test", "posts", docs...))
+	spec := bsoncore.NewDocumentBuilder().
+		AppendDocument("key", bsoncore.NewDocumentBuilder().AppendString("content", "text").Build()).
+		Build()
+	if reply := run(2, createIndexesCommandDocument("test", "posts", spec)); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("创建文本索引失败: %s", reply)
+	}
+
+	list := bsoncore.NewDocumentBuilder().AppendString("listIndexes", "posts").AppendString("$db", "test").Build()
+	_, indexes := cursorBatch(t, run(3, list), "firstBatch")
+	if len(indexes) != 2 || indexes[1].Lookup("name").StringValue() != "content_text" ||
+		indexes[1].Lookup("key", "_fts").StringValue() != "text" || indexes[1].Lookup("weights", "content").Int32() != 1 {
+		t.Errorf("listIndexes 返回的文本索引不正确: %v", indexes)
+	}
+
+	score := bsoncore.NewDocumentBuilder().AppendString("$meta", "textScore").Build()
+	find := bsoncore.NewDocumentBuilder().
+		AppendString("find", "posts").
+		AppendDocument("filter", bsoncore.NewDocumentBuilder().
+			AppendDocument("$text", bsoncore.NewDocumentBuilder().AppendString("$search", "coffee tea").Build()).
+			Build()).
+		AppendDocument("projection", bsoncore.NewDocumentBuilder().AppendDocument("score", score).Build()).
+		AppendDocument("sort", bsoncore.NewDocumentBuilder().AppendDocument("score", score).Build()).
+		AppendString("$db", "test").
+		Build()
+	_, batch := cursorBatch(t, run(4, find), "firstBatch")
+	if len(batch) != 3 {
+		t.Fatalf("应返回 3 个文档: %v", batch)
+	}
+	if batch[0].Lookup("_id").Int32() != 2 || batch[0].Lookup("content").StringValue() == "" {
+		t.Errorf("coffee 出现最多的文档应排在最前且保留原字段: %s", batch[0])
+	}
+	for i := 1; i < len(batch); i++ {
+		if batch[i].Lookup("score").Double() > batch[i-1].Lookup("score").Double() {
+			t.Errorf("结果应按 score 降序排列: %v", batch)
+		}
+	}
+
+	missing := bsoncore.NewDocumentBuilder().
+		AppendString("find", "other").
+		AppendDocument("filter", bsoncore.NewDocumentBuilder().
+			AppendDocument("$text", bsoncore.NewDocumentBuilder().AppendString("$search", "coffee").Build()).
+			Build()).
+		AppendString("$db", "test").
+		Build()
+	run(5, insertCommandDocument("test", "other", docs[0]))
+	if code := run(6, missing).Lookup("code").Int32(); code != int32(CodeIndexNotFound) {
+		t.Errorf("没有文本索引时应返回 IndexNotFound, got %d", code)
+	}
+}
+
+// TestGeoNear 测试通过 createIndexes 创建 2d 索引后 $near 查询按距离返回
+func TestGeoNear(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	point := func(x, y float64) bsoncore.Array {
+		return bsoncore.NewArrayBuilder().AppendDouble(x).AppendDouble(y).Build()
+	}
+
+	docs := []bsoncore.Document{
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendArray("loc", point(3, 3)).Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendArray("loc", point(1, 0)).Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 3).AppendArray("loc", point(50, 50)).Build(),
+	}
+	run(1, insertCommandDocument("test", "shops", docs...))
+	spec := bsoncore.NewDocumentBuilder().
+		AppendDocument("key", bsoncore.NewDocumentBuilder().AppendString("loc", "2d").Build()).
+		Build()
+	if reply := run(2, createIndexesCommandDocument("test", "shops", spec)); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("创建 2d 索引失败: %s", reply)
+	}
+
+	find := bsoncore.NewDocumentBuilder().
+		AppendString("find", "shops").
+		AppendDocument("filter", bsoncore.NewDocumentBuilder().
+			AppendDocument("loc", bsoncore.NewDocumentBuilder().
+				AppendArray("$near", point(0, 0)).
+				AppendDouble("$maxDistance", 10).
+				Build()).
+			Build()).
+		AppendString("$db", "test").
+		Build()
+	_, batch := cursorBatch(t, run(3, find), "firstBatch")
+	if len(batch) != 2 || batch[0].Lookup("_id").Int32() != 2 || batch[1].Lookup("_id").Int32() != 1 {
+		t.Errorf("$near 应按距离返回最大距离内的文档: %v", batch)
+	}
+
+	invalid := bsoncore.NewDocumentBuilder().
+		AppendDocument("key", bsoncore.NewDocumentBuilder().AppendString("loc", "quadtree").Build()).
+		Build()
+	if code := run(4, createIndexesCommandDocument("test", "shops", invalid)).Lookup("code").Int32(); code != int32(CodeInvalidIndexSpecification) {
+		t.Errorf("未知的索引类型应返回 InvalidIndexSpecificationOption, got %d", code)
+	}
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"context"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("getLastError", ActionNone, (*EventListener).cmdGetLastError)
+	registerCommand("getlasterror", ActionNone, (*EventListener).cmdGetLastError)
+}
+
+// lastError 旧版写操作的结果
+// OP_INSERT/OP_UPDATE/OP_DELETE 没有回复，旧版驱动在写操作之后发送 getLastError 获取结果
+type lastError struct {
+	n               int64
+	updatedExisting bool
+	upserted        bsoncore.Value // upsert 插入文档的 _id，未插入时为零值
+	err             error
+}
+
+// setLastError 在会话上记录最近一次写操作的结果
+func setLastError(session getty.Session, result *lastError) {
+	if session == nil {
+		return
+	}
+	stateOf(session).setLastWrite(result)
+}
+
+// updateLastError 将 OP_UPDATE 的执行结果转换为 lastError
+func updateLastError(result *storage.UpdateResult, err error) *lastError {
+	if err != nil {
+		return &lastError{err: err}
+	}
+	le := &lastError{n: result.Matched, updatedExisting: result.Matched > 0}
+	if result.UpsertedID != nil {
+		raw, err := storage.MarshalDocument(storage.Document{"_id": result.UpsertedID})
+		if err != nil {
+			return &lastError{err: err}
+		}
+		le.n = 1
+		le.upserted = bsoncore.Document(raw).Lookup("_id")
+	}
+	return le
+}
+
+// cmdGetLastError 返回当前连接上最近一次旧版写操作的结果
+// 写操作同步执行，w/j/wtimeout 等写关注参数不影响结果；写操作失败时命令本身仍返回 ok: 1
+func (l *EventListener) cmdGetLastError(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	builder := bsoncore.NewDocumentBuilder()
+	var result *lastError
+	if req.session != nil {
+		result = stateOf(req.session).lastWrite()
+	}
+	if result == nil {
+		return builder.AppendInt32("n", 0).AppendNull("err"), nil
+	}
+
+	if result.err != nil {
+		cmdErr := toCommandError(result.err)
+		return builder.
+			AppendInt32("n", 0).
+			AppendString("err", cmdErr.Message).
+			AppendInt32("code", int32(cmdErr.Code)).
+			AppendString("codeName", cmdErr.CodeName), nil
+	}
+
+	builder.AppendInt32("n", int32(result.n))
+	if result.updatedExisting || result.upserted.Type != 0 {
+		builder.AppendBoolean("updatedExisting", result.updatedExisting)
+	}
+	if result.upserted.Type != 0 {
+		builder.AppendValue("upserted", result.upserted)
+	}
+	return builder.AppendNull("err"), nil
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBucketCount 延迟直方图的桶数，第 i 个桶记录不超过 2^i 微秒的操作，最后一个桶同时记录更慢的操作（约 67 秒以上）
+const latencyBucketCount = 27
+
+// latencyHistogram 按 2 的幂分桶的延迟直方图，可以并发记录
+type latencyHistogram struct {
+	counts [latencyBucketCount]uint64
+}
+
+// latencyBucket 返回延迟所在桶的下标
+func latencyBucket(d time.Duration) int {
+	micros := d.Microseconds()
+	if micros <= 1 {
+		return 0
+	}
+	i := bits.Len64(uint64(micros - 1))
+	if i >= latencyBucketCount {
+		return latencyBucketCount - 1
+	}
+	return i
+}
+
+// record 记录一次操作的延迟
+func (h *latencyHistogram) record(d time.Duration) {
+	atomic.AddUint64(&h.counts[latencyBucket(d)], 1)
+}
+
+// snapshot 返回各桶的计数和总数
+func (h *latencyHistogram) snapshot() (counts [latencyBucketCount]uint64, total uint64) {
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	return counts, total
+}
+
+// percentiles 返回记录总数和各分位数所在桶的上界，没有记录时均为 0
+// 结果只精确到桶，实际分位数通常在返回值的一半到返回值之间
+func (h *latencyHistogram) percentiles(ps ...float64) (total uint64, values []time.Duration) {
+	counts, total := h.snapshot()
+	values = make([]time.Duration, len(ps))
+	if total == 0 {
+		return 0, values
+	}
+	for j, p := range ps {
+		rank := uint64(math.Ceil(p * float64(total)))
+		if rank == 0 {
+			rank = 1
+		}
+		var seen uint64
+		for i, n := range counts {
+			seen += n
+			if seen >= rank {
+				values[j] = time.Duration(1<<i) * time.Microsecond
+				break
+			}
+		}
+	}
+	return total, values
+}
+
+// latencyOperations 统计延迟的命令
+var latencyOperations = []string{"insert", "find", "update", "delete"}
+
+// opLatencies 各命令的延迟直方图，由 runCommand 在命令执行后记录
+var opLatencies = newLatencyHistograms(latencyOperations)
+
+// latencyHistograms 命令名到延迟直方图的映射，创建后不再修改
+type latencyHistograms map[string]*latencyHistogram
+
+func newLatencyHistograms(names []string) latencyHistograms {
+	h := make(latencyHistograms, len(names))
+	for _, name := range names {
+		h[name] = &latencyHistogram{}
+	}
+	return h
+}
+
+// record 记录命令的执行时间，不统计延迟的命令忽略
+func (h latencyHistograms) record(name string, d time.Duration) {
+	if hist, ok := h[name]; ok {
+		hist.record(d)
+	}
+}
+
+// LatencyStats 返回 insert/find/update/delete 的执行次数和 p50/p95/p99 延迟(微秒)
+func LatencyStats() map[string]interface{} {
+	stats := make(map[string]interface{}, len(latencyOperations))
+	for _, name := range latencyOperations {
+		ops, values := opLatencies[name].percentiles(0.50, 0.95, 0.99)
+		stats[name] = map[string]interface{}{
+			"ops":    ops,
+			"p50_us": values[0].Microseconds(),
+			"p95_us": values[1].Microseconds(),
+			"p99_us": values[2].Microseconds(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLatencyBucket 测试延迟按 2 的幂归入桶，超出范围的归入最后一个桶
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Microsecond, 0},
+		{2 * time.Microsecond, 1},
+		{3 * time.Microsecond, 2},
+		{128 * time.Microsecond, 7},
+		{129 * time.Microsecond, 8},
+		{time.Hour, latencyBucketCount - 1},
+	}
+	for _, tt := range tests {
+		if got := latencyBucket(tt.d); got != tt.want {
+			t.Errorf("latencyBucket(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+// TestLatencyPercentiles 测试按记录的延迟分布计算 p50/p95/p99 所在的桶
+func TestLatencyPercentiles(t *testing.T) {
+	h := &latencyHistogram{}
+	if total, values := h.percentiles(0.5); total != 0 || values[0] != 0 {
+		t.Errorf("没有记录时应返回 0: %d, %v", total, values)
+	}
+
+	// 90 个 100µs、8 个 3ms、2 个 200ms
+	for i := 0; i < 90; i++ {
+		h.record(100 * time.Microsecond)
+	}
+	for i := 0; i < 8; i++ {
+		h.record(3 * time.Millisecond)
+	}
+	h.record(200 * time.Millisecond)
+	h.record(200 * time.Millisecond)
+
+	total, values := h.percentiles(0.50, 0.95, 0.99, 1)
+	if total != 100 {
+		t.Fatalf("记录总数 = %d, want 100", total)
+	}
+	want := []time.Duration{128 * time.Microsecond, 4096 * time.Microsecond, 262144 * time.Microsecond, 262144 * time.Microsecond}
+	for i, w := range want {
+		if values[i] != w {
+			t.Errorf("第 %d 个分位数 = %v, want %v", i, values[i], w)
+		}
+	}
+}
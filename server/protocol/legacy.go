@@ -0,0 +1,417 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// 旧版写操作的标志位
+const (
+	insertContinueOnError = 1 << 0 // OP_INSERT: 出错后继续插入剩余文档
+	updateUpsert          = 1 << 0 // OP_UPDATE: 不存在时插入
+	updateMulti           = 1 << 1 // OP_UPDATE: 更新全部匹配文档
+	deleteSingleRemove    = 1 << 0 // OP_DELETE: 只删除第一个匹配文档
+)
+
+// queryRequest OP_QUERY 请求
+type queryRequest struct {
+	flags          wiremessage.QueryFlag
+	namespace      string
+	numberToSkip   int32
+	numberToReturn int32
+	query          bsoncore.Document
+	fields         bsoncore.Document // 可选的 returnFieldsSelector
+}
+
+// insertRequest OP_INSERT 请求
+type insertRequest struct {
+	flags     int32
+	namespace string
+	documents []bsoncore.Document
+}
+
+// updateRequest OP_UPDATE 请求
+type updateRequest struct {
+	namespace string
+	flags     int32
+	selector  bsoncore.Document
+	update    bsoncore.Document
+}
+
+// deleteRequest OP_DELETE 请求
+type deleteRequest struct {
+	namespace string
+	flags     int32
+	selector  bsoncore.Document
+}
+
+// parseQuery 解析 OP_QUERY 消息体
+// 格式: flags(int32) fullCollectionName(cstring) numberToSkip(int32) numberToReturn(int32) query [returnFieldsSelector]
+func parseQuery(body []byte) (*queryRequest, error) {
+	req := &queryRequest{}
+	var ok bool
+	rem := body
+	if req.flags, rem, ok = wiremessage.ReadQueryFlags(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_QUERY flags 失败")
+	}
+	if req.namespace, rem, ok = wiremessage.ReadQueryFullCollectionName(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_QUERY 集合名失败")
+	}
+	if req.numberToSkip, rem, ok = wiremessage.ReadQueryNumberToSkip(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_QUERY numberToSkip 失败")
+	}
+	if req.numberToReturn, rem, ok = wiremessage.ReadQueryNumberToReturn(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_QUERY numberToReturn 失败")
+	}
+	if req.query, rem, ok = wiremessage.ReadQueryQuery(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_QUERY 查询文档失败")
+	}
+	if err := req.query.Validate(); err != nil {
+		return nil, fmt.Errorf("OP_QUERY 查询文档无效: %w", err)
+	}
+	if len(rem) > 0 {
+		if req.fields, rem, ok = wiremessage.ReadQueryReturnFieldsSelector(rem); !ok {
+			return nil, fmt.Errorf("读取 OP_QUERY 投影文档失败")
+		}
+		if err := req.fields.Validate(); err != nil {
+			return nil, fmt.Errorf("OP_QUERY 投影文档无效: %w", err)
+		}
+	}
+	if len(rem) > 0 {
+		return nil, fmt.Errorf("OP_QUERY 末尾有多余的 %d 字节", len(rem))
+	}
+	return req, nil
+}
+
+// parseInsert 解析 OP_INSERT 消息体
+// 格式: flags(int32) fullCollectionName(cstring) documents...
+func parseInsert(body []byte) (*insertRequest, error) {
+	req := &insertRequest{}
+	var ok bool
+	rem := body
+	if req.flags, rem, ok = bsoncore.ReadInt32(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_INSERT flags 失败")
+	}
+	if req.namespace, rem, ok = bsoncore.ReadKey(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_INSERT 集合名失败")
+	}
+	for len(rem) > 0 {
+		var doc bsoncore.Document
+		if doc, rem, ok = bsoncore.ReadDocument(rem); !ok {
+			return nil, fmt.Errorf("读取 OP_INSERT 文档失败")
+		}
+		if err := doc.Validate(); err != nil {
+			return nil, fmt.Errorf("OP_INSERT 文档无效: %w", err)
+		}
+		req.documents = append(req.documents, doc)
+	}
+	if len(req.documents) == 0 {
+		return nil, fmt.Errorf("OP_INSERT 没有文档")
+	}
+	return req, nil
+}
+
+// parseUpdate 解析 OP_UPDATE 消息体
+// 格式: ZERO(int32) fullCollectionName(cstring) flags(int32) selector update
+func parseUpdate(body []byte) (*updateRequest, error) {
+	req := &updateRequest{}
+	var ok bool
+	rem := body
+	if _, rem, ok = bsoncore.ReadInt32(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_UPDATE 保留字段失败")
+	}
+	if req.namespace, rem, ok = bsoncore.ReadKey(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_UPDATE 集合名失败")
+	}
+	if req.flags, rem, ok = bsoncore.ReadInt32(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_UPDATE flags 失败")
+	}
+	if req.selector, rem, ok = bsoncore.ReadDocument(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_UPDATE 选择器失败")
+	}
+	if req.update, rem, ok = bsoncore.ReadDocument(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_UPDATE 更新文档失败")
+	}
+	if len(rem) > 0 {
+		return nil, fmt.Errorf("OP_UPDATE 末尾有多余的 %d 字节", len(rem))
+	}
+	if err := req.selector.Validate(); err != nil {
+		return nil, fmt.Errorf("OP_UPDATE 选择器无效: %w", err)
+	}
+	if err := req.update.Validate(); err != nil {
+		return nil, fmt.Errorf("OP_UPDATE 更新文档无效: %w", err)
+	}
+	return req, nil
+}
+
+// parseDelete 解析 OP_DELETE 消息体
+// 格式: ZERO(int32) fullCollectionName(cstring) flags(int32) selector
+func parseDelete(body []byte) (*deleteRequest, error) {
+	req := &deleteRequest{}
+	var ok bool
+	rem := body
+	if _, rem, ok = bsoncore.ReadInt32(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_DELETE 保留字段失败")
+	}
+	if req.namespace, rem, ok = bsoncore.ReadKey(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_DELETE 集合名失败")
+	}
+	if req.flags, rem, ok = bsoncore.ReadInt32(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_DELETE flags 失败")
+	}
+	if req.selector, rem, ok = bsoncore.ReadDocument(rem); !ok {
+		return nil, fmt.Errorf("读取 OP_DELETE 选择器失败")
+	}
+	if len(rem) > 0 {
+		return nil, fmt.Errorf("OP_DELETE 末尾有多余的 %d 字节", len(rem))
+	}
+	if err := req.selector.Validate(); err != nil {
+		return nil, fmt.Errorf("OP_DELETE 选择器无效: %w", err)
+	}
+	return req, nil
+}
+
+// splitNamespace 将 "db.collection" 拆分为数据库名和集合名
+func splitNamespace(namespace string) (string, string, error) {
+	db, coll, ok := strings.Cut(namespace, ".")
+	if !ok || db == "" || coll == "" {
+		return "", "", NewCommandError(CodeInvalidNamespace, "Invalid namespace specified '%s'", namespace)
+	}
+	return db, coll, nil
+}
+
+// unwrapQuery 处理 {$query: {...}, $orderby: ...} 形式的包装查询，返回实际的查询文档
+func unwrapQuery(query bsoncore.Document) bsoncore.Document {
+	for _, key := range []string{"$query", "query"} {
+		if v, err := query.LookupErr(key); err == nil {
+			if doc, ok := v.DocumentOK(); ok {
+				return doc
+			}
+		}
+	}
+	return query
+}
+
+// handleQuery 处理 OP_QUERY
+// 集合名为 $cmd 时按命令执行，否则在存储引擎上执行查询
+func (l *EventListener) handleQuery(ctx context.Context, session getty.Session, message *Message) *Message {
+	req, err := parseQuery(message.Body)
+	if err != nil {
+		logger.FromContext(ctx).Warnf("解析 OP_QUERY 失败: %v", err)
+		return buildQueryFailureReply(message, NewCommandError(CodeFailedToParse, "%v", err))
+	}
+
+	db, coll, err := splitNamespace(req.namespace)
+	if err != nil {
+		return buildQueryFailureReply(message, err)
+	}
+
+	if coll == "$cmd" {
+		return l.handleQueryCommand(ctx, session, message, db, req)
+	}
+
+	docs, err := l.legacyFind(ctx, session, db, coll, req)
+	if err != nil {
+		return buildQueryFailureReply(message, err)
+	}
+	return buildOpReply(message, 0, 0, req.numberToSkip, docs)
+}
+
+// handleQueryCommand 执行通过 OP_QUERY 发送到 db.$cmd 的命令，结果包装为 OP_REPLY
+func (l *EventListener) handleQueryCommand(ctx context.Context, session getty.Session, message *Message, db string, req *queryRequest) *Message {
+	cmdReq, err := newCommandRequest(session, unwrapQuery(req.query), nil)
+	if err != nil {
+		return buildOpReply(message, 0, 0, 0, []bsoncore.Document{NewCommandError(CodeFailedToParse, "%v", err).Document()})
+	}
+	cmdReq.db = db
+
+	if logger.DebugEnabled() {
+		logger.FromContext(ctx).Debugf("执行 OP_QUERY 命令: %s.%s", cmdReq.db, cmdReq.name)
+	}
+	reply := buildOpReply(message, 0, 0, 0, []bsoncore.Document{l.runCommand(ctx, cmdReq)})
+	if !uncompressibleCommands[cmdReq.name] {
+		reply.Compressor = message.Compressor
+	}
+	return reply
+}
+
+// legacyFind 在存储引擎上执行 OP_QUERY 查询，应用 skip/limit 与投影
+// 游标尚未实现，numberToReturn 为 0 时一次返回全部结果，否则按其绝对值限制返回数量
+func (l *EventListener) legacyFind(ctx context.Context, session getty.Session, db, coll string, req *queryRequest) ([]bsoncore.Document, error) {
+	if err := l.checkAction(session, db, "find", ActionFind); err != nil {
+		return nil, err
+	}
+
+	filter, err := storage.UnmarshalDocument(unwrapQuery(req.query))
+	if err != nil {
+		return nil, NewCommandError(CodeBadValue, "%v", err)
+	}
+	var projection storage.Document
+	if req.fields != nil {
+		if projection, err = storage.UnmarshalDocument(req.fields); err != nil {
+			return nil, NewCommandError(CodeBadValue, "%v", err)
+		}
+	}
+
+	results, err := l.storageEngine.Find(ctx, db, coll, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := int(req.numberToSkip)
+	if skip < 0 {
+		skip = 0
+	}
+	if skip > len(results) {
+		skip = len(results)
+	}
+	results = results[skip:]
+
+	limit := int(req.numberToReturn)
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(results) {
+		results = results[:limit]
+	}
+
+	docs := make([]bsoncore.Document, 0, len(results))
+	for _, result := range results {
+		projected, err := storage.ApplyQueryProjection(result, projection, filter)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := storage.MarshalDocument(projected)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, raw)
+	}
+	return docs, nil
+}
+
+// handleInsert 处理 OP_INSERT
+// OP_INSERT/OP_UPDATE/OP_DELETE 在协议上没有回复，错误记录日志，结果记录在会话上供 getLastError 查询
+func (l *EventListener) handleInsert(ctx context.Context, session getty.Session, message *Message) *Message {
+	req, err := parseInsert(message.Body)
+	if err != nil {
+		logger.FromContext(ctx).Warnf("解析 OP_INSERT 失败: %v", err)
+		setLastError(session, &lastError{err: NewCommandError(CodeFailedToParse, "%v", err)})
+		return nil
+	}
+	n, err := l.legacyInsert(ctx, session, req)
+	setLastError(session, &lastError{n: n, err: err})
+	return nil
+}
+
+// legacyInsert 逐个插入 OP_INSERT 中的文档，返回插入成功的文档数和最后一个错误
+// 未设置 ContinueOnError 时在第一个错误处停止
+func (l *EventListener) legacyInsert(ctx context.Context, session getty.Session, req *insertRequest) (int64, error) {
+	db, coll, err := splitNamespace(req.namespace)
+	if err == nil {
+		err = l.checkAction(session, db, "insert", ActionInsert)
+	}
+	if err != nil {
+		logger.FromContext(ctx).Warnf("OP_INSERT %s 失败: %v", req.namespace, err)
+		return 0, err
+	}
+
+	var n int64
+	var lastErr error
+	for _, raw := range req.documents {
+		doc, err := validatedDocument(raw)
+		if err == nil {
+			err = l.storageEngine.Insert(ctx, db, coll, []storage.Document{doc})
+		}
+		if err != nil {
+			logger.FromContext(ctx).Warnf("OP_INSERT %s 失败: %v", req.namespace, err)
+			lastErr = err
+			if req.flags&insertContinueOnError == 0 {
+				return n, err
+			}
+			continue
+		}
+		n++
+	}
+	return n, lastErr
+}
+
+// handleUpdate 处理 OP_UPDATE
+func (l *EventListener) handleUpdate(ctx context.Context, session getty.Session, message *Message) *Message {
+	req, err := parseUpdate(message.Body)
+	if err != nil {
+		logger.FromContext(ctx).Warnf("解析 OP_UPDATE 失败: %v", err)
+		setLastError(session, &lastError{err: NewCommandError(CodeFailedToParse, "%v", err)})
+		return nil
+	}
+	result, err := l.legacyUpdate(ctx, session, req)
+	if err != nil {
+		logger.FromContext(ctx).Warnf("OP_UPDATE %s 失败: %v", req.namespace, err)
+	}
+	setLastError(session, updateLastError(result, err))
+	return nil
+}
+
+// legacyUpdate 执行 OP_UPDATE
+func (l *EventListener) legacyUpdate(ctx context.Context, session getty.Session, req *updateRequest) (*storage.UpdateResult, error) {
+	db, coll, err := splitNamespace(req.namespace)
+	if err == nil {
+		err = l.checkAction(session, db, "update", ActionUpdate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	filter, err := storage.UnmarshalDocument(req.selector)
+	if err != nil {
+		return nil, NewCommandError(CodeBadValue, "%v", err)
+	}
+	update, err := storage.UnmarshalDocument(req.update)
+	if err != nil {
+		return nil, NewCommandError(CodeBadValue, "%v", err)
+	}
+
+	opts := storage.UpdateOptions{
+		Multi:  req.flags&updateMulti != 0,
+		Upsert: req.flags&updateUpsert != 0,
+	}
+	return l.storageEngine.Update(ctx, db, coll, filter, update, opts)
+}
+
+// handleDelete 处理 OP_DELETE
+func (l *EventListener) handleDelete(ctx context.Context, session getty.Session, message *Message) *Message {
+	req, err := parseDelete(message.Body)
+	if err != nil {
+		logger.FromContext(ctx).Warnf("解析 OP_DELETE 失败: %v", err)
+		setLastError(session, &lastError{err: NewCommandError(CodeFailedToParse, "%v", err)})
+		return nil
+	}
+	n, err := l.legacyDelete(ctx, session, req)
+	if err != nil {
+		logger.FromContext(ctx).Warnf("OP_DELETE %s 失败: %v", req.namespace, err)
+	}
+	setLastError(session, &lastError{n: n, err: err})
+	return nil
+}
+
+// legacyDelete 执行 OP_DELETE，返回删除的文档数
+func (l *EventListener) legacyDelete(ctx context.Context, session getty.Session, req *deleteRequest) (int64, error) {
+	db, coll, err := splitNamespace(req.namespace)
+	if err == nil {
+		err = l.checkAction(session, db, "delete", ActionRemove)
+	}
+	if err != nil {
+		return 0, err
+	}
+	filter, err := storage.UnmarshalDocument(req.selector)
+	if err != nil {
+		return 0, NewCommandError(CodeBadValue, "%v", err)
+	}
+	return l.storageEngine.Delete(ctx, db, coll, filter, req.flags&deleteSingleRemove != 0)
+}
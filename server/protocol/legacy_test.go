@@ -0,0 +1,295 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// rawMessage 按线协议格式拼装完整消息，body 由 build 追加
+func rawMessage(requestID int32, opcode wiremessage.OpCode, build func([]byte) []byte) []byte {
+	idx, wm := wiremessage.AppendHeaderStart(nil, requestID, 0, opcode)
+	wm = build(wm)
+	return bsoncore.UpdateLength(wm, idx, int32(len(wm[idx:])))
+}
+
+func rawInsert(requestID int32, ns string, flags int32, docs ...bsoncore.Document) []byte {
+	return rawMessage(requestID, wiremessage.OpInsert, func(wm []byte) []byte {
+		wm = bsoncore.AppendInt32(wm, flags)
+		wm = append(wm, ns+"\x00"...)
+		for _, doc := range docs {
+			wm = append(wm, doc...)
+		}
+		return wm
+	})
+}
+
+func rawUpdate(requestID int32, ns string, flags int32, selector, update bsoncore.Document) []byte {
+	return rawMessage(requestID, wiremessage.OpUpdate, func(wm []byte) []byte {
+		wm = bsoncore.AppendInt32(wm, 0)
+		wm = append(wm, ns+"\x00"...)
+		wm = bsoncore.AppendInt32(wm, flags)
+		wm = append(wm, selector...)
+		return append(wm, update...)
+	})
+}
+
+func rawDelete(requestID int32, ns string, flags int32, selector bsoncore.Document) []byte {
+	return rawMessage(requestID, wiremessage.OpDelete, func(wm []byte) []byte {
+		wm = bsoncore.AppendInt32(wm, 0)
+		wm = append(wm, ns+"\x00"...)
+		wm = bsoncore.AppendInt32(wm, flags)
+		return append(wm, selector...)
+	})
+}
+
+func rawQuery(requestID int32, ns string, skip, limit int32, query, fields bsoncore.Document) []byte {
+	return rawMessage(requestID, wiremessage.OpQuery, func(wm []byte) []byte {
+		wm = wiremessage.AppendQueryFlags(wm, 0)
+		wm = wiremessage.AppendQueryFullCollectionName(wm, ns)
+		wm = wiremessage.AppendQueryNumberToSkip(wm, skip)
+		wm = wiremessage.AppendQueryNumberToReturn(wm, limit)
+		wm = append(wm, query...)
+		return append(wm, fields...)
+	})
+}
+
+// sendRaw 经 PackageHandler 解析原始字节后交给监听器处理，返回序列化后的回复
+func sendRaw(t *testing.T, listener *EventListener, raw []byte) []byte {
+	t.Helper()
+	return sendRawOn(t, listener, newFakeSession(), raw)
+}
+
+// sendRawOn 与 sendRaw 相同，但在指定的会话上处理消息
+func sendRawOn(t *testing.T, listener *EventListener, session *fakeSession, raw []byte) []byte {
+	t.Helper()
+	pkg, n, err := NewPackageHandler(0).Read(nil, raw)
+	if err != nil || n != len(raw) {
+		t.Fatalf("解析原始消息失败: n=%d err=%v", n, err)
+	}
+	reply := listener.handleMessage(session, pkg.(*Message))
+	if reply == nil {
+		return nil
+	}
+	data, err := reply.Serialize()
+	if err != nil {
+		t.Fatalf("序列化回复失败: %v", err)
+	}
+	return data
+}
+
+// readOpReply 解析 OP_REPLY 原始字节，返回标志与文档
+func readOpReply(t *testing.T, data []byte, responseTo int32) (wiremessage.ReplyFlag, []bsoncore.Document) {
+	t.Helper()
+	length, _, respTo, opcode, rem, ok := wiremessage.ReadHeader(data)
+	if !ok || int(length) != len(data) || opcode != wiremessage.OpReply || respTo != responseTo {
+		t.Fatalf("回复消息头不正确: opcode=%s responseTo=%d", opcode, respTo)
+	}
+	flags, rem, _ := wiremessage.ReadReplyFlags(rem)
+	_, rem, _ = wiremessage.ReadReplyCursorID(rem)
+	_, rem, _ = wiremessage.ReadReplyStartingFrom(rem)
+	n, rem, _ := wiremessage.ReadReplyNumberReturned(rem)
+	docs, _, ok := wiremessage.ReadReplyDocuments(rem)
+	if !ok || int(n) != len(docs) {
+		t.Fatalf("读取回复文档失败: numberReturned=%d", n)
+	}
+	return flags, docs
+}
+
+// TestLegacyOpcodes 测试旧版 OP_INSERT/OP_QUERY/OP_UPDATE/OP_DELETE
+func TestLegacyOpcodes(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	const ns = "legacy.people"
+
+	find := func(requestID int32, skip, limit int32, query, fields bsoncore.Document) []bsoncore.Document {
+		t.Helper()
+		flags, docs := readOpReply(t, sendRaw(t, listener, rawQuery(requestID, ns, skip, limit, query, fields)), requestID)
+		if flags&wiremessage.QueryFailure != 0 {
+			t.Fatalf("查询失败: %s", docs[0])
+		}
+		return docs
+	}
+	all := bsoncore.NewDocumentBuilder().Build()
+	person := func(id int32, name string, age int32) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			AppendInt32("_id", id).
+			AppendString("name", name).
+			AppendInt32("age", age).
+			Build()
+	}
+
+	t.Run("插入", func(t *testing.T) {
+		raw := rawInsert(1, ns, 0, person(1, "Alice", 30), person(2, "Bob", 25), person(3, "Carol", 35))
+		if reply := sendRaw(t, listener, raw); reply != nil {
+			t.Fatal("OP_INSERT 不应有回复")
+		}
+		if docs := find(2, 0, 0, all, nil); len(docs) != 3 {
+			t.Fatalf("文档数量不正确: got %d, want 3", len(docs))
+		}
+	})
+
+	t.Run("查询", func(t *testing.T) {
+		filter := bsoncore.NewDocumentBuilder().
+			StartDocument("age").AppendInt32("$gte", 30).FinishDocument().
+			Build()
+		fields := bsoncore.NewDocumentBuilder().AppendInt32("name", 1).AppendInt32("_id", 0).Build()
+		docs := find(3, 0, 0, filter, fields)
+		if len(docs) != 2 {
+			t.Fatalf("文档数量不正确: got %d, want 2", len(docs))
+		}
+		for _, doc := range docs {
+			if _, err := doc.LookupErr("_id"); err == nil {
+				t.Errorf("投影应排除 _id: %s", doc)
+			}
+			if _, err := doc.LookupErr("age"); err == nil {
+				t.Errorf("投影应只包含 name: %s", doc)
+			}
+		}
+
+		if docs := find(4, 1, 1, all, nil); len(docs) != 1 || docs[0].Lookup("_id").Int32() != 2 {
+			t.Errorf("skip/limit 结果不正确: %v", docs)
+		}
+
+		wrapped := bsoncore.NewDocumentBuilder().
+			StartDocument("$query").AppendString("name", "Carol").FinishDocument().
+			Build()
+		if docs := find(5, 0, 0, wrapped, nil); len(docs) != 1 || docs[0].Lookup("age").Int32() != 35 {
+			t.Errorf("$query 包装查询结果不正确: %v", docs)
+		}
+	})
+
+	t.Run("更新", func(t *testing.T) {
+		selector := bsoncore.NewDocumentBuilder().AppendString("name", "Bob").Build()
+		update := bsoncore.NewDocumentBuilder().
+			StartDocument("$inc").AppendInt32("age", 1).FinishDocument().
+			Build()
+		if reply := sendRaw(t, listener, rawUpdate(6, ns, 0, selector, update)); reply != nil {
+			t.Fatal("OP_UPDATE 不应有回复")
+		}
+		docs := find(7, 0, 0, selector, nil)
+		if len(docs) != 1 || docs[0].Lookup("age").Int32() != 26 {
+			t.Fatalf("更新结果不正确: %v", docs)
+		}
+
+		multi := bsoncore.NewDocumentBuilder().
+			StartDocument("$set").AppendBoolean("active", true).FinishDocument().
+			Build()
+		sendRaw(t, listener, rawUpdate(8, ns, updateMulti, all, multi))
+		active := bsoncore.NewDocumentBuilder().AppendBoolean("active", true).Build()
+		if docs := find(9, 0, 0, active, nil); len(docs) != 3 {
+			t.Errorf("multi 更新数量不正确: got %d, want 3", len(docs))
+		}
+	})
+
+	t.Run("删除", func(t *testing.T) {
+		sendRaw(t, listener, rawDelete(10, ns, deleteSingleRemove, all))
+		if docs := find(11, 0, 0, all, nil); len(docs) != 2 {
+			t.Fatalf("SingleRemove 后数量不正确: got %d, want 2", len(docs))
+		}
+		sendRaw(t, listener, rawDelete(12, ns, 0, all))
+		if docs := find(13, 0, 0, all, nil); len(docs) != 0 {
+			t.Fatalf("删除全部后数量不正确: got %d, want 0", len(docs))
+		}
+	})
+
+	t.Run("admin.$cmd 命令", func(t *testing.T) {
+		flags, docs := readOpReply(t, sendRaw(t, listener, rawQuery(14, "admin.$cmd", 0, -1, pingCommandDocument(), nil)), 14)
+		if flags != 0 || len(docs) != 1 || docs[0].Lookup("ok").Double() != 1 {
+			t.Fatalf("$cmd 命令结果不正确: %v", docs)
+		}
+	})
+
+	t.Run("非法命名空间", func(t *testing.T) {
+		flags, docs := readOpReply(t, sendRaw(t, listener, rawQuery(15, "nodot", 0, 0, all, nil)), 15)
+		if flags&wiremessage.QueryFailure == 0 || docs[0].Lookup("code").Int32() != 73 {
+			t.Fatalf("非法命名空间应返回 QueryFailure: %v", docs)
+		}
+	})
+}
+
+// TestGetLastError 测试旧版写操作之后通过 getLastError 获取结果
+func TestGetLastError(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	session := newFakeSession()
+	const ns = "legacy.gle"
+
+	requestID := int32(0)
+	getLastError := func() bsoncore.Document {
+		t.Helper()
+		requestID++
+		cmd := bsoncore.NewDocumentBuilder().AppendInt32("getLastError", 1).AppendInt32("w", 1).Build()
+		flags, docs := readOpReply(t, sendRawOn(t, listener, session, rawQuery(requestID, "admin.$cmd", 0, -1, cmd, nil)), requestID)
+		if flags != 0 || len(docs) != 1 || docs[0].Lookup("ok").Double() != 1 {
+			t.Fatalf("getLastError 结果不正确: %v", docs)
+		}
+		return docs[0]
+	}
+	send := func(build func(requestID int32) []byte) {
+		t.Helper()
+		requestID++
+		if reply := sendRawOn(t, listener, session, build(requestID)); reply != nil {
+			t.Fatal("旧版写操作不应有回复")
+		}
+	}
+	doc := func(id int32) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).AppendInt32("v", id).Build()
+	}
+
+	t.Run("没有写操作", func(t *testing.T) {
+		gle := getLastError()
+		if gle.Lookup("n").Int32() != 0 || gle.Lookup("err").Type != bsoncore.TypeNull {
+			t.Errorf("没有写操作时应返回 {n: 0, err: null}: %s", gle)
+		}
+	})
+
+	t.Run("插入成功", func(t *testing.T) {
+		send(func(id int32) []byte { return rawInsert(id, ns, 0, doc(1), doc(2)) })
+		gle := getLastError()
+		if gle.Lookup("n").Int32() != 2 || gle.Lookup("err").Type != bsoncore.TypeNull {
+			t.Errorf("插入成功应返回 {n: 2, err: null}: %s", gle)
+		}
+		if _, err := gle.LookupErr("code"); err == nil {
+			t.Errorf("成功时不应包含 code: %s", gle)
+		}
+	})
+
+	t.Run("插入重复键", func(t *testing.T) {
+		send(func(id int32) []byte { return rawInsert(id, ns, 0, doc(1)) })
+		gle := getLastError()
+		if gle.Lookup("code").Int32() != int32(CodeDuplicateKey) || gle.Lookup("err").Type != bsoncore.TypeString {
+			t.Errorf("重复键应返回 E11000 错误: %s", gle)
+		}
+		// 其他连接的写操作结果互不影响
+		requestID++
+		cmd := bsoncore.NewDocumentBuilder().AppendInt32("getLastError", 1).Build()
+		_, docs := readOpReply(t, sendRawOn(t, listener, newFakeSession(), rawQuery(requestID, "admin.$cmd", 0, -1, cmd, nil)), requestID)
+		if docs[0].Lookup("err").Type != bsoncore.TypeNull {
+			t.Errorf("新连接不应看到其他连接的错误: %s", docs[0])
+		}
+	})
+
+	t.Run("更新和删除", func(t *testing.T) {
+		all := bsoncore.NewDocumentBuilder().Build()
+		set := bsoncore.NewDocumentBuilder().StartDocument("$set").AppendBoolean("seen", true).FinishDocument().Build()
+		send(func(id int32) []byte { return rawUpdate(id, ns, updateMulti, all, set) })
+		gle := getLastError()
+		if gle.Lookup("n").Int32() != 2 || !gle.Lookup("updatedExisting").Boolean() {
+			t.Errorf("multi 更新应返回 {n: 2, updatedExisting: true}: %s", gle)
+		}
+
+		missing := bsoncore.NewDocumentBuilder().AppendInt32("_id", 9).Build()
+		send(func(id int32) []byte { return rawUpdate(id, ns, updateUpsert, missing, set) })
+		gle = getLastError()
+		if gle.Lookup("n").Int32() != 1 || gle.Lookup("updatedExisting").Boolean() || gle.Lookup("upserted").Int32() != 9 {
+			t.Errorf("upsert 应返回插入文档的 _id: %s", gle)
+		}
+
+		send(func(id int32) []byte { return rawDelete(id, ns, 0, all) })
+		gle = getLastError()
+		if gle.Lookup("n").Int32() != 3 || gle.Lookup("err").Type != bsoncore.TypeNull {
+			t.Errorf("删除应返回 {n: 3, err: null}: %s", gle)
+		}
+	})
+}
@@ -2,33 +2,57 @@ package protocol
 
 import (
 	"context"
+	"time"
 
 	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/config"
 	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
 	"github.com/zhukovaskychina/xmongodb/server/storage"
 )
 
 // EventListener MongoDB 协议事件监听器
 type EventListener struct {
 	storageEngine storage.Engine
+	config        *config.Config
+	idleTimeout   time.Duration // 空闲会话超时，0 表示不限制
+	rateLimiter   *RateLimiter  // 命令限流，由所有连接的监听器共享，未开启时为 nil
+	cursorLimits  cursorLimits  // 同时打开的游标数上限
+
+	defaultBatchSize int           // 未指定 batchSize 时首批返回的文档数
+	cursorTimeout    time.Duration // 游标空闲超时，0 表示不回收
 }
 
-// NewEventListener 创建新的事件监听器
-func NewEventListener(engine storage.Engine) *EventListener {
-	return &EventListener{
+// NewEventListener 创建新的事件监听器，limiter 为 NewRateLimiter 创建的限流器，所有连接共用同一个
+func NewEventListener(engine storage.Engine, cfg *config.Config, limiter *RateLimiter) *EventListener {
+	l := &EventListener{
 		storageEngine: engine,
+		config:        cfg,
+		idleTimeout:   parseIdleTimeout(cfg.Network.IdleTimeout),
+		rateLimiter:   limiter,
+		cursorLimits:  cursorLimits{global: cfg.Server.MaxOpenCursors, perSession: cfg.Server.MaxCursorsPerSession},
+
+		defaultBatchSize: defaultBatchSize,
+		cursorTimeout:    time.Duration(cfg.Server.CursorTimeoutMS) * time.Millisecond,
+	}
+	if cfg.Server.CursorDefaultBatchSize > 0 {
+		l.defaultBatchSize = cfg.Server.CursorDefaultBatchSize
 	}
+	return l
 }
 
 // OnOpen 连接打开事件
 func (l *EventListener) OnOpen(session getty.Session) error {
-	logger.Infof("客户端连接: %s", session.RemoteAddr())
+	logger.Infof("客户端连接: %s", remoteAddr(session))
+	session.SetAttribute(sessionStateAttribute, newSessionState())
 	return nil
 }
 
 // OnClose 连接关闭事件
 func (l *EventListener) OnClose(session getty.Session) {
-	logger.Infof("客户端断开: %s", session.RemoteAddr())
+	logger.Infof("客户端断开: %s", remoteAddr(session))
+	releaseSessionState(session)
+	l.rateLimiter.release(session)
 }
 
 // OnMessage 消息接收事件
@@ -38,126 +62,137 @@ func (l *EventListener) OnMessage(session getty.Session, pkg interface{}) {
 		logger.Errorf("收到无效消息类型")
 		return
 	}
+	touchSession(session)
 
-	logger.Debugf("收到消息: OpCode=%s, RequestID=%d", message.OpCode, message.Header.RequestID)
+	if logger.DebugEnabled() {
+		logger.ForRequest(remoteAddr(session), message.Header.RequestID).Debugf("收到消息: OpCode=%s", message.OpCode)
+	}
 
-	// 处理消息
+	// 处理消息，exhaust 游标的回复发送后继续执行 getMore 并发送下一批，直到游标取完
 	response := l.handleMessage(session, message)
-	if response != nil {
-		if err := session.WritePkg(response); err != nil {
+	for response != nil {
+		if _, _, err := session.WritePkg(response, 0); err != nil {
 			logger.Errorf("发送响应失败: %v", err)
+			return
+		}
+		if response.exhaust == nil || session.IsClosed() {
+			return
 		}
+		response = l.handleMessage(session, response.exhaust)
 	}
 }
 
 // OnError 错误事件
 func (l *EventListener) OnError(session getty.Session, err error) {
-	logger.Errorf("会话错误 %s: %v", session.RemoteAddr(), err)
+	logger.Errorf("会话错误 %s: %v", remoteAddr(session), err)
 }
 
 // OnCron 定时事件
+// 关闭空闲超过 idle_timeout 的会话并回滚其未提交的事务，结束空闲超时的逻辑会话，回收空闲超时的游标
 func (l *EventListener) OnCron(session getty.Session) {
-	// 可以在这里实现心跳检测等定时任务
+	now := time.Now()
+	l.reapIdleSession(session, now)
+	logicalSessions.reap(context.Background(), now, logicalSessionTimeout)
+	if l.cursorTimeout > 0 {
+		cursors.reapIdle(now, l.cursorTimeout)
+	}
 }
 
 // handleMessage 处理具体的消息
+// 请求处理过程中的日志通过 context 携带的条目输出，带有连接地址和请求 ID
 func (l *EventListener) handleMessage(session getty.Session, message *Message) *Message {
-	ctx := context.Background()
+	// 请求的日志条目在第一次输出日志时才创建，大多数请求不输出日志
+	remote := remoteAddr(session)
+	ctx := logger.WithRequest(context.Background(), remote, message.Header.RequestID)
+
+	if message.OpCode == OpCompressed {
+		if l.config == nil || !l.config.Network.CompressEncoding {
+			logger.FromContext(ctx).Warn("未启用压缩，拒绝 OP_COMPRESSED 消息")
+			session.Close()
+			return nil
+		}
+		decompressed, err := decompressMessage(message, maxMessageLength(l.config.Network.MaxMsgLen))
+		if err != nil {
+			logger.FromContext(ctx).Warnf("解压消息失败: %v", err)
+			session.Close()
+			return nil
+		}
+		message = decompressed
+	}
 
+	// 注册为正在执行的操作，currentOp 可以看到、killOp 可以中止
+	ctx, op := operations.begin(ctx, remote, opcodeOpType(message.OpCode))
+	response := l.dispatch(ctx, session, message)
+	operations.end(op)
+	if response == nil {
+		return nil
+	}
+	if response.OpCode == OpMsg && l.config != nil && l.config.Network.ChecksumEnabled {
+		appendOpMsgChecksum(response)
+	}
+	return compressMessage(response)
+}
+
+// dispatch 按操作码分发消息
+func (l *EventListener) dispatch(ctx context.Context, session getty.Session, message *Message) *Message {
 	switch message.OpCode {
 	case OpQuery:
-		return l.handleQuery(ctx, message)
+		return l.handleQuery(ctx, session, message)
 	case OpInsert:
-		return l.handleInsert(ctx, message)
+		return l.handleInsert(ctx, session, message)
 	case OpUpdate:
-		return l.handleUpdate(ctx, message)
+		return l.handleUpdate(ctx, session, message)
 	case OpDelete:
-		return l.handleDelete(ctx, message)
-	case OpCommand:
-		return l.handleCommand(ctx, message)
+		return l.handleDelete(ctx, session, message)
 	case OpMsg:
-		return l.handleMsg(ctx, message)
+		return l.handleMsg(ctx, session, message)
 	default:
-		logger.Warnf("不支持的操作码: %s", message.OpCode)
-		return l.createErrorResponse(message, "不支持的操作")
+		// 与 mongod 一致，收到不支持的操作码（包括已移除的 OP_COMMAND）时断开连接
+		logger.FromContext(ctx).Warnf("不支持的操作码 %s，断开连接", message.OpCode)
+		session.Close()
+		return nil
 	}
 }
 
-// handleQuery 处理查询操作
-func (l *EventListener) handleQuery(ctx context.Context, message *Message) *Message {
-	// TODO: 实现查询逻辑
-	logger.Debug("处理查询操作")
-	return l.createSuccessResponse(message, []byte("查询结果"))
-}
-
-// handleInsert 处理插入操作
-func (l *EventListener) handleInsert(ctx context.Context, message *Message) *Message {
-	// TODO: 实现插入逻辑
-	logger.Debug("处理插入操作")
-	return l.createSuccessResponse(message, []byte("插入成功"))
-}
-
-// handleUpdate 处理更新操作
-func (l *EventListener) handleUpdate(ctx context.Context, message *Message) *Message {
-	// TODO: 实现更新逻辑
-	logger.Debug("处理更新操作")
-	return l.createSuccessResponse(message, []byte("更新成功"))
-}
-
-// handleDelete 处理删除操作
-func (l *EventListener) handleDelete(ctx context.Context, message *Message) *Message {
-	// TODO: 实现删除逻辑
-	logger.Debug("处理删除操作")
-	return l.createSuccessResponse(message, []byte("删除成功"))
-}
-
-// handleCommand 处理命令操作
-func (l *EventListener) handleCommand(ctx context.Context, message *Message) *Message {
-	// TODO: 实现命令逻辑
-	logger.Debug("处理命令操作")
-	return l.createSuccessResponse(message, []byte("命令执行成功"))
-}
-
 // handleMsg 处理消息操作 (MongoDB 3.6+)
-func (l *EventListener) handleMsg(ctx context.Context, message *Message) *Message {
-	// TODO: 实现消息处理逻辑
-	logger.Debug("处理消息操作")
-	return l.createSuccessResponse(message, []byte("消息处理成功"))
-}
+func (l *EventListener) handleMsg(ctx context.Context, session getty.Session, message *Message) *Message {
+	if err := verifyOpMsgChecksum(message); err != nil {
+		logger.FromContext(ctx).Warnf("OP_MSG 校验失败: %v", err)
+		return buildOpMsgReply(message, NewCommandError(CodeFailedToParse, "%v", err).Document())
+	}
 
-// createSuccessResponse 创建成功响应
-func (l *EventListener) createSuccessResponse(request *Message, data []byte) *Message {
-	response := &Message{
-		Header: &MessageHeader{
-			MessageLength: int32(16 + len(data)),
-			RequestID:     generateRequestID(),
-			ResponseTo:    request.Header.RequestID,
-			OpCode:        int32(OpReply),
-		},
-		Body:   data,
-		OpCode: OpReply,
-	}
-	return response
-}
+	msg, err := parseOpMsg(message.Body)
+	if err != nil {
+		logger.FromContext(ctx).Warnf("解析 OP_MSG 失败: %v", err)
+		return buildOpMsgReply(message, NewCommandError(CodeFailedToParse, "%v", err).Document())
+	}
+
+	req, err := newCommandRequest(session, msg.body, msg.sequences)
+	if err != nil {
+		return buildOpMsgReply(message, NewCommandError(CodeFailedToParse, "%v", err).Document())
+	}
 
-// createErrorResponse 创建错误响应
-func (l *EventListener) createErrorResponse(request *Message, errorMsg string) *Message {
-	data := []byte(errorMsg)
-	response := &Message{
-		Header: &MessageHeader{
-			MessageLength: int32(16 + len(data)),
-			RequestID:     generateRequestID(),
-			ResponseTo:    request.Header.RequestID,
-			OpCode:        int32(OpReply),
-		},
-		Body:   data,
-		OpCode: OpReply,
-	}
-	return response
+	if logger.DebugEnabled() {
+		logger.FromContext(ctx).Debugf("执行命令: %s.%s", req.db, req.name)
+	}
+	result := l.runCommand(ctx, req)
+	reply := buildOpMsgReply(message, result)
+	if l.config != nil && l.config.Network.ReplyDocumentSequence {
+		if doc, identifier, docs, ok := splitCursorBatch(result, documentSequenceMinBytes); ok {
+			reply = buildOpMsgSequenceReply(message, doc, identifier, docs)
+		}
+	}
+	if !uncompressibleCommands[req.name] {
+		reply.Compressor = message.Compressor
+	}
+	if msg.flags&wiremessage.ExhaustAllowed != 0 {
+		prepareExhaust(message, reply, req, result)
+	}
+	return reply
 }
 
-// generateRequestID 生成请求ID
+// generateRequestID 生成回复的请求ID
+// 与 wiremessage.NextRequestID 共用同一个原子计数器，跨会话并发安全且单调递增
 func generateRequestID() int32 {
-	// TODO: 实现更好的ID生成策略
-	return 1
+	return wiremessage.NextRequestID()
 }
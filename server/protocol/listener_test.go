@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// fakeSession 测试用会话，只实现监听器用到的方法
+type fakeSession struct {
+	getty.Session
+	attributes map[interface{}]interface{}
+	written    []interface{}
+	closed     bool
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{attributes: make(map[interface{}]interface{})}
+}
+
+func (s *fakeSession) RemoteAddr() string { return "127.0.0.1:50000" }
+func (s *fakeSession) LocalAddr() string  { return "127.0.0.1:27017" }
+func (s *fakeSession) IsClosed() bool     { return s.closed }
+func (s *fakeSession) Close()             { s.closed = true }
+
+func (s *fakeSession) GetAttribute(key interface{}) interface{} { return s.attributes[key] }
+func (s *fakeSession) SetAttribute(key, value interface{})      { s.attributes[key] = value }
+func (s *fakeSession) RemoveAttribute(key interface{})          { delete(s.attributes, key) }
+
+func (s *fakeSession) WritePkg(pkg interface{}, timeout time.Duration) (int, int, error) {
+	s.written = append(s.written, pkg)
+	return 0, 0, nil
+}
+
+// newTestListener 创建使用内存引擎的监听器
+func newTestListener(t testing.TB, cfg *config.Config) *EventListener {
+	t.Helper()
+	engine, err := storage.NewMemoryEngine(cfg.Storage)
+	if err != nil {
+		t.Fatalf("创建存储引擎失败: %v", err)
+	}
+	return NewEventListener(engine, cfg, NewRateLimiter(cfg.Network))
+}
+
+// newOpMsgMessage 构造只包含命令文档的 OP_MSG 请求
+func newOpMsgMessage(requestID int32, command bsoncore.Document) *Message {
+	body := wiremessage.AppendMsgFlags(nil, 0)
+	body = wiremessage.AppendMsgSectionType(body, wiremessage.SingleDocument)
+	body = append(body, command...)
+	return &Message{
+		Header: &MessageHeader{
+			MessageLength: int32(16 + len(body)),
+			RequestID:     requestID,
+			OpCode:        int32(OpMsg),
+		},
+		Body:   body,
+		OpCode: OpMsg,
+	}
+}
+
+// replyDocument 从 OP_MSG 回复中取出结果文档
+func replyDocument(t testing.TB, reply *Message) bsoncore.Document {
+	t.Helper()
+	if reply == nil {
+		t.Fatal("回复不应为空")
+	}
+	if reply.OpCode != OpMsg {
+		t.Fatalf("回复操作码不正确: got %s, want OP_MSG", reply.OpCode)
+	}
+	msg, err := parseOpMsg(reply.Body)
+	if err != nil {
+		t.Fatalf("解析回复失败: %v", err)
+	}
+	return msg.body
+}
+
+// pingCommandDocument 构造 ping 命令文档
+func pingCommandDocument() bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().
+		AppendInt32("ping", 1).
+		AppendString("$db", "admin").
+		Build()
+}
+
+// TestReplyRequestIDs 测试并发请求的回复 RequestID 互不相同
+func TestReplyRequestIDs(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+
+	const workers = 16
+	const perWorker = 200
+
+	ids := make(chan int32, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			session := newFakeSession()
+			for i := 0; i < perWorker; i++ {
+				reply := listener.handleMessage(session, newOpMsgMessage(int32(w*perWorker+i), pingCommandDocument()))
+				ids <- reply.Header.RequestID
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int32]bool, workers*perWorker)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("RequestID %d 重复", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("回复数量不正确: got %d, want %d", len(seen), workers*perWorker)
+	}
+
+	first, second := generateRequestID(), generateRequestID()
+	if second <= first {
+		t.Errorf("RequestID 应单调递增: %d, %d", first, second)
+	}
+}
@@ -0,0 +1,235 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// logicalSessionTimeout 逻辑会话的空闲超时，通过 hello 的 logicalSessionTimeoutMinutes 告知驱动
+const logicalSessionTimeout = 30 * time.Minute
+
+func init() {
+	registerCommand("endSessions", ActionNone, (*EventListener).cmdEndSessions)
+	registerCommand("killSessions", ActionKillAnySession, (*EventListener).cmdKillSessions)
+}
+
+// logicalSession 驱动通过 lsid 标识的逻辑会话
+// 同一逻辑会话的命令可能经连接池中不同的连接发送，事务状态按 lsid 而不是按连接保存
+type logicalSession struct {
+	key           string     // 逻辑会话的键，见 lsidKey
+	owner         string     // 创建会话的用户，见 sessionOwner
+	mu            sync.Mutex // 串行执行同一逻辑会话上的事务命令
+	engineSession storage.EngineSession
+	txnNumber     int64
+	state         txnState
+	retryResult   bsoncore.Document // txnNumber 对应的可重试写操作的结果，重试时直接返回
+	retryPartial  bsoncore.Document // txnNumber 部分语句失败时的结果，重试时与新执行的结果合并
+	retryExecuted map[int]bool      // txnNumber 中已成功执行的语句下标，重试时跳过
+	lastUsed      time.Time         // 最近一次携带该 lsid 的命令时间，由 sessionRegistry.mu 保护
+}
+
+// sessionRegistry 逻辑会话注册表，所有连接共享
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*logicalSession
+}
+
+// logicalSessions 全局逻辑会话注册表
+var logicalSessions = &sessionRegistry{sessions: make(map[string]*logicalSession)}
+
+// get 返回 lsid 对应的逻辑会话并记录使用时间，不存在时创建不属于任何用户的会话
+func (r *sessionRegistry) get(lsid string) *logicalSession {
+	return r.open(lsid, "")
+}
+
+// open 返回 lsid 对应的逻辑会话并记录使用时间，不存在时创建属于 owner 的会话并开始绑定的存储引擎会话
+func (r *sessionRegistry) open(lsid, owner string) *logicalSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[lsid]
+	if !ok {
+		engineSession := storage.NewEngineSession(uuid.New().String(), nil)
+		if err := engineSession.Begin(context.Background()); err != nil {
+			logger.Errorf("开始会话 %s 失败: %v", engineSession.GetSessionId(), err)
+		}
+		s = &logicalSession{key: lsid, owner: owner, engineSession: engineSession}
+		r.sessions[lsid] = s
+	}
+	s.lastUsed = time.Now()
+	return s
+}
+
+// lookup 查找逻辑会话，不存在时返回 nil
+func (r *sessionRegistry) lookup(lsid string) *logicalSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[lsid]
+}
+
+// end 结束 lsid 对应的逻辑会话，返回会话是否存在
+func (r *sessionRegistry) end(ctx context.Context, lsid string) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[lsid]
+	delete(r.sessions, lsid)
+	r.mu.Unlock()
+	if ok {
+		s.close(ctx)
+	}
+	return ok
+}
+
+// endOwned 结束 lsid 对应且属于 owner 的逻辑会话，会话不存在或属于其他用户时不做修改
+func (r *sessionRegistry) endOwned(ctx context.Context, lsid, owner string) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[lsid]
+	ok = ok && s.owner == owner
+	if ok {
+		delete(r.sessions, lsid)
+	}
+	r.mu.Unlock()
+	if ok {
+		s.close(ctx)
+	}
+	return ok
+}
+
+// endAll 结束全部逻辑会话，返回结束的数量
+func (r *sessionRegistry) endAll(ctx context.Context) int {
+	r.mu.Lock()
+	sessions := r.sessions
+	r.sessions = make(map[string]*logicalSession)
+	r.mu.Unlock()
+	for _, s := range sessions {
+		s.close(ctx)
+	}
+	return len(sessions)
+}
+
+// reap 结束空闲超过 timeout 的逻辑会话，返回结束的数量
+func (r *sessionRegistry) reap(ctx context.Context, now time.Time, timeout time.Duration) int {
+	var expired []*logicalSession
+	r.mu.Lock()
+	for key, s := range r.sessions {
+		if now.Sub(s.lastUsed) >= timeout {
+			expired = append(expired, s)
+			delete(r.sessions, key)
+		}
+	}
+	r.mu.Unlock()
+	for _, s := range expired {
+		logger.Infof("逻辑会话 %s 空闲超过 %s，结束会话", s.engineSession.GetSessionId(), timeout)
+		s.close(ctx)
+	}
+	return len(expired)
+}
+
+// close 中止会话上进行中的事务、关闭会话打开的游标并结束存储引擎会话
+// 正在执行的事务命令持有 s.mu，close 等待其完成后再清理
+func (s *logicalSession) close(ctx context.Context) {
+	s.mu.Lock()
+	s.abort(ctx)
+	if err := s.engineSession.End(ctx); err != nil {
+		logger.Errorf("结束会话 %s 失败: %v", s.engineSession.GetSessionId(), err)
+	}
+	s.mu.Unlock()
+	cursors.removeOwnedBy(s.key)
+}
+
+// lsidKey 从 {id: UUID} 形式的 lsid 文档中取出会话 ID，用作逻辑会话的键
+// field 为出错时报告的字段名
+func lsidKey(field string, v bsoncore.Value) (string, error) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return "", NewCommandError(CodeTypeMismatch, "BSON field '%s' is the wrong type '%s', expected type 'object'", field, v.Type)
+	}
+	id, err := doc.LookupErr("id")
+	if err != nil {
+		return "", NewCommandError(CodeFailedToParse, "BSON field '%s.id' is missing but a required field", field)
+	}
+	subtype, data, ok := id.BinaryOK()
+	if !ok || subtype != 4 {
+		return "", NewCommandError(CodeTypeMismatch, "BSON field '%s.id' is the wrong type '%s', expected type 'uuid'", field, id.Type)
+	}
+	return string(data), nil
+}
+
+// sessionOwner 返回会话上已认证的用户，格式为 user@db，未认证时返回空字符串
+func sessionOwner(session getty.Session) string {
+	user := AuthenticatedUser(session)
+	if user == nil {
+		return ""
+	}
+	return user.User + "@" + user.DB
+}
+
+// lsidContextKey context 中保存当前命令所属逻辑会话键的键
+type lsidContextKey struct{}
+
+// withLogicalSession 返回携带逻辑会话键的 context，命令打开的游标归该会话所有
+func withLogicalSession(ctx context.Context, lsid string) context.Context {
+	return context.WithValue(ctx, lsidContextKey{}, lsid)
+}
+
+// logicalSessionOf 返回 context 中的逻辑会话键，命令不属于任何逻辑会话时返回空字符串
+func logicalSessionOf(ctx context.Context) string {
+	lsid, _ := ctx.Value(lsidContextKey{}).(string)
+	return lsid
+}
+
+// sessionKeys 解析 endSessions/killSessions 的会话数组
+func sessionKeys(req *commandRequest) ([]string, error) {
+	v := req.body.Index(0).Value()
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s' is the wrong type '%s', expected type 'array'", req.name, v.Type)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "invalid %s array: %v", req.name, err)
+	}
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		key, err := lsidKey(req.name, value)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// cmdEndSessions 结束当前用户的指定逻辑会话，中止其事务并关闭其游标；不存在或属于其他用户的会话被忽略
+func (l *EventListener) cmdEndSessions(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	keys, err := sessionKeys(req)
+	if err != nil {
+		return nil, err
+	}
+	owner := sessionOwner(req.session)
+	for _, key := range keys {
+		logicalSessions.endOwned(ctx, key, owner)
+	}
+	return bsoncore.NewDocumentBuilder(), nil
+}
+
+// cmdKillSessions 结束指定的任意用户的逻辑会话，空数组表示结束全部逻辑会话，需要 killAnySession 权限
+func (l *EventListener) cmdKillSessions(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	keys, err := sessionKeys(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		logicalSessions.endAll(ctx)
+		return bsoncore.NewDocumentBuilder(), nil
+	}
+	for _, key := range keys {
+		logicalSessions.end(ctx, key)
+	}
+	return bsoncore.NewDocumentBuilder(), nil
+}
@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestLogicalSessions 测试逻辑会话的延迟创建、endSessions/killSessions 清理和空闲回收
+func TestLogicalSessions(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	requestID := int32(0)
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+	mustRun := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		reply := run(cmd)
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+		return reply
+	}
+	withLsid := func(cmd bsoncore.Document, lsid uuid.UUID) bsoncore.Document {
+		return appendFields(t, cmd, func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("lsid").AppendBinary("id", 4, lsid[:]).FinishDocument()
+		})
+	}
+	sessionsCommand := func(name string, lsids ...uuid.UUID) bsoncore.Document {
+		arr := bsoncore.NewArrayBuilder()
+		for _, lsid := range lsids {
+			arr.AppendDocument(bsoncore.NewDocumentBuilder().AppendBinary("id", 4, lsid[:]).Build())
+		}
+		return bsoncore.NewDocumentBuilder().AppendArray(name, arr.Build()).AppendString("$db", "admin").Build()
+	}
+	doc := func(id int32) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).Build()
+	}
+	mustRun(insertCommandDocument("app", "items", doc(1), doc(2), doc(3)))
+	// openCursor 在 lsid 所属的会话上打开一个未取完的游标
+	openCursor := func(lsid uuid.UUID) int64 {
+		t.Helper()
+		find := bsoncore.NewDocumentBuilder().
+			AppendString("find", "items").
+			AppendInt32("batchSize", 1).
+			AppendString("$db", "app").
+			Build()
+		id, _ := cursorBatch(t, mustRun(withLsid(find, lsid)), "firstBatch")
+		if id == 0 {
+			t.Fatal("batchSize 为 1 时应返回未取完的游标")
+		}
+		return id
+	}
+	expectCursorGone := func(id int64) {
+		t.Helper()
+		reply := run(getMoreCommandDocument("app", "items", id, 0))
+		if reply.Lookup("code").Int32() != int32(CodeCursorNotFound) {
+			t.Errorf("会话结束后游标应被关闭: %s", reply)
+		}
+	}
+
+	t.Run("携带 lsid 的命令创建逻辑会话", func(t *testing.T) {
+		lsid := uuid.New()
+		if logicalSessions.lookup(string(lsid[:])) != nil {
+			t.Fatal("未使用的 lsid 不应有逻辑会话")
+		}
+		ping := bsoncore.NewDocumentBuilder().AppendInt32("ping", 1).AppendString("$db", "admin").Build()
+		mustRun(ping)
+		mustRun(withLsid(ping, lsid))
+		s := logicalSessions.lookup(string(lsid[:]))
+		if s == nil || !s.engineSession.IsActive() {
+			t.Fatal("首次携带 lsid 的命令应创建逻辑会话")
+		}
+		if logicalSessions.get(string(lsid[:])) != s {
+			t.Error("同一 lsid 应返回同一个逻辑会话")
+		}
+
+		bad := appendFields(t, ping, func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("lsid").AppendString("id", "not-a-uuid").FinishDocument()
+		})
+		if reply := run(bad); reply.Lookup("code").Int32() != int32(CodeTypeMismatch) {
+			t.Errorf("lsid.id 不是 UUID 时应返回 TypeMismatch: %s", reply)
+		}
+	})
+
+	t.Run("endSessions 中止事务并关闭游标", func(t *testing.T) {
+		lsid := uuid.New()
+		other := uuid.New()
+		cursorID := openCursor(lsid)
+		otherCursorID := openCursor(other)
+		mustRun(withTransaction(t, insertCommandDocument("app", "items", doc(4)), lsid, 1, true))
+		s := logicalSessions.lookup(string(lsid[:]))
+		engineSession := s.engineSession
+
+		mustRun(sessionsCommand("endSessions", lsid, uuid.New()))
+		if logicalSessions.lookup(string(lsid[:])) != nil {
+			t.Error("endSessions 后逻辑会话应被移除")
+		}
+		if engineSession.InTransaction() || engineSession.IsActive() {
+			t.Error("endSessions 应回滚事务并结束存储引擎会话")
+		}
+		expectCursorGone(cursorID)
+		find := bsoncore.NewDocumentBuilder().AppendString("find", "items").AppendString("$db", "app").Build()
+		if _, docs := cursorBatch(t, mustRun(find), "firstBatch"); len(docs) != 3 {
+			t.Errorf("结束的会话中未提交的写入应被撤销, got %d 个文档", len(docs))
+		}
+		if _, ok := cursors.get(otherCursorID); !ok {
+			t.Error("其他会话的游标不应被关闭")
+		}
+
+		// 同一 lsid 再次使用时创建新的逻辑会话
+		code := run(endTransactionCommandDocument(t, "commitTransaction", lsid, 1)).Lookup("code").Int32()
+		if code != int32(CodeNoSuchTransaction) {
+			t.Errorf("结束的会话上不应再有事务, got code %d", code)
+		}
+
+		mustRun(sessionsCommand("killSessions"))
+		if logicalSessions.lookup(string(other[:])) != nil {
+			t.Error("空数组的 killSessions 应结束全部逻辑会话")
+		}
+		expectCursorGone(otherCursorID)
+	})
+
+	t.Run("回收空闲的逻辑会话", func(t *testing.T) {
+		idle := uuid.New()
+		active := uuid.New()
+		cursorID := openCursor(idle)
+		mustRun(withLsid(bsoncore.NewDocumentBuilder().AppendInt32("ping", 1).AppendString("$db", "admin").Build(), active))
+
+		ctx := context.Background()
+		now := time.Now()
+		if n := logicalSessions.reap(ctx, now, logicalSessionTimeout); n != 0 {
+			t.Errorf("未超时的逻辑会话不应被回收, got %d", n)
+		}
+		logicalSessions.get(string(active[:])).lastUsed = now.Add(logicalSessionTimeout)
+		if n := logicalSessions.reap(ctx, now.Add(logicalSessionTimeout+time.Minute), logicalSessionTimeout); n != 1 {
+			t.Errorf("应只回收 1 个空闲的逻辑会话, got %d", n)
+		}
+		if logicalSessions.lookup(string(idle[:])) != nil || logicalSessions.lookup(string(active[:])) == nil {
+			t.Error("只有空闲超时的逻辑会话应被回收")
+		}
+		expectCursorGone(cursorID)
+	})
+}
+
+// TestLogicalSessionOwnership 测试开启鉴权时 endSessions 只结束当前用户的会话，killSessions 需要 killAnySession 权限
+func TestLogicalSessionOwnership(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Security.Authorization = true
+	listener := newTestListener(t, cfg)
+	userSession := func(user string, roles ...RoleName) *fakeSession {
+		session := newFakeSession()
+		SetAuthenticatedUser(session, &UserIdentity{User: user, DB: "admin", Roles: roles})
+		return session
+	}
+	alice := userSession("alice", RoleName{Role: "readWrite", DB: "app"})
+	bob := userSession("bob", RoleName{Role: "readWrite", DB: "app"})
+	admin := userSession("admin", RoleName{Role: "hostManager", DB: "admin"})
+
+	run := func(session *fakeSession, cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(session, newOpMsgMessage(1, cmd)))
+	}
+	sessionsCommand := func(name string, lsids ...uuid.UUID) bsoncore.Document {
+		arr := bsoncore.NewArrayBuilder()
+		for _, lsid := range lsids {
+			arr.AppendDocument(bsoncore.NewDocumentBuilder().AppendBinary("id", 4, lsid[:]).Build())
+		}
+		return bsoncore.NewDocumentBuilder().AppendArray(name, arr.Build()).AppendString("$db", "admin").Build()
+	}
+	lsid := uuid.New()
+	ping := appendFields(t, bsoncore.NewDocumentBuilder().AppendInt32("ping", 1).AppendString("$db", "admin").Build(), func(b *bsoncore.DocumentBuilder) {
+		b.StartDocument("lsid").AppendBinary("id", 4, lsid[:]).FinishDocument()
+	})
+	if reply := run(alice, ping); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("ping 失败: %s", reply)
+	}
+
+	if reply := run(bob, sessionsCommand("endSessions", lsid)); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("endSessions 失败: %s", reply)
+	}
+	if logicalSessions.lookup(string(lsid[:])) == nil {
+		t.Fatal("endSessions 不应结束其他用户的会话")
+	}
+	for _, cmd := range []bsoncore.Document{sessionsCommand("killSessions"), sessionsCommand("killSessions", lsid)} {
+		if reply := run(bob, cmd); reply.Lookup("code").Int32() != int32(CodeUnauthorized) {
+			t.Errorf("没有 killAnySession 权限时 killSessions 应被拒绝: %s", reply)
+		}
+	}
+	if logicalSessions.lookup(string(lsid[:])) == nil {
+		t.Fatal("被拒绝的 killSessions 不应结束会话")
+	}
+
+	if reply := run(alice, sessionsCommand("endSessions", lsid)); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("endSessions 失败: %s", reply)
+	}
+	if logicalSessions.lookup(string(lsid[:])) != nil {
+		t.Error("endSessions 应结束当前用户的会话")
+	}
+
+	run(alice, ping)
+	if reply := run(admin, sessionsCommand("killSessions", lsid)); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("hostManager 应能执行 killSessions: %s", reply)
+	}
+	if logicalSessions.lookup(string(lsid[:])) != nil {
+		t.Error("killSessions 应结束其他用户的会话")
+	}
+}
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// lookupSpec $lookup 阶段的 {from, localField, foreignField, as}
+type lookupSpec struct {
+	from, localField, foreignField, as string
+}
+
+// parseLookup 解析 $lookup 阶段的参数，四个字段都必须是非空字符串
+func parseLookup(stage pipelineStage) (*lookupSpec, error) {
+	if stage.spec == nil {
+		return nil, NewCommandError(CodeFailedToParse, "the $lookup specification must be an object")
+	}
+	if _, ok := stage.spec["pipeline"]; ok {
+		return nil, NewCommandError(CodeFailedToParse, "$lookup with 'pipeline' is not supported")
+	}
+	spec := &lookupSpec{}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"from", &spec.from},
+		{"localField", &spec.localField},
+		{"foreignField", &spec.foreignField},
+		{"as", &spec.as},
+	} {
+		s, ok := stage.spec[field.name].(string)
+		if !ok || s == "" {
+			return nil, NewCommandError(CodeFailedToParse, "$lookup argument '%s' must be a non-empty string", field.name)
+		}
+		*field.value = s
+	}
+	return spec, nil
+}
+
+// lookupValues 返回字段用于连接的取值：数组按元素展开，字段缺失时为 null
+// includeArray 为 true 时还包含数组本身，被连接一侧的数组字段既可以按元素也可以整体匹配
+func lookupValues(doc storage.Document, path string, includeArray bool) []interface{} {
+	v, ok := storage.LookupField(doc, path)
+	if !ok {
+		return []interface{}{nil}
+	}
+	arr, isArray := v.([]interface{})
+	if !isArray {
+		return []interface{}{v}
+	}
+	values := append([]interface{}(nil), arr...)
+	if includeArray || len(values) == 0 {
+		values = append(values, v)
+	}
+	return values
+}
+
+// applyLookup 执行 $lookup，对每个输入文档把 from 集合中 foreignField 与 localField 相等的文档数组放在 as 字段
+// 所有输入文档的 localField 取值合并为一次 $in 查询，foreignField 上有索引时由查询计划器使用索引，
+// 否则只扫描一次被连接的集合；查询结果按 foreignField 的取值分组后与每个输入文档匹配
+func (l *EventListener) applyLookup(ctx context.Context, db string, docs []storage.Document, stage pipelineStage) ([]storage.Document, error) {
+	spec, err := parseLookup(stage)
+	if err != nil {
+		return nil, err
+	}
+
+	var locals []interface{}
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		for _, v := range lookupValues(doc, spec.localField, false) {
+			if key := storage.GroupKey(v); !seen[key] {
+				seen[key] = true
+				locals = append(locals, v)
+			}
+		}
+	}
+	var foreign []storage.Document
+	if len(locals) > 0 {
+		filter := storage.Document{spec.foreignField: storage.Document{"$in": locals}}
+		if foreign, err = l.storageEngine.Find(ctx, db, spec.from, filter); err != nil {
+			return nil, err
+		}
+	}
+	byKey := make(map[string][]int)
+	for i, doc := range foreign {
+		added := make(map[string]bool)
+		for _, v := range lookupValues(doc, spec.foreignField, true) {
+			if key := storage.GroupKey(v); !added[key] {
+				added[key] = true
+				byKey[key] = append(byKey[key], i)
+			}
+		}
+	}
+
+	out := make([]storage.Document, len(docs))
+	for i, doc := range docs {
+		// 同一个被连接文档只出现一次，按查询结果的顺序排列
+		matched := make(map[int]bool)
+		for _, v := range lookupValues(doc, spec.localField, false) {
+			for _, j := range byKey[storage.GroupKey(v)] {
+				matched[j] = true
+			}
+		}
+		joined := make([]interface{}, 0, len(matched))
+		for j, f := range foreign {
+			if matched[j] {
+				joined = append(joined, f)
+			}
+		}
+		result := make(storage.Document, len(doc)+1)
+		for k, v := range doc {
+			result[k] = v
+		}
+		result[spec.as] = joined
+		out[i] = result
+	}
+	return out, nil
+}
@@ -0,0 +1,261 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("mapReduce", ActionFind, (*EventListener).cmdMapReduce)
+	registerCommand("mapreduce", ActionFind, (*EventListener).cmdMapReduce)
+}
+
+// mapReduceNote mapReduce 回复中说明的限制
+// 服务端没有 JavaScript 引擎，map 和 reduce 不能是函数
+const mapReduceNote = "mapReduce runs without a JavaScript engine: 'map' must be a field path such as \"$status\" " +
+	"or {key: <field path>, value: <field path or constant>}, and 'reduce' must be one of \"count\", \"sum\" or \"push\""
+
+// mapReduceOutput mapReduce 的输出方式
+type mapReduceOutput struct {
+	inline     bool
+	merge      bool // 按 _id 覆盖输出集合中的文档，否则替换整个输出集合
+	db         string
+	collection string
+}
+
+// actions 写入输出集合需要的权限：replace 删除并重新创建输出集合，merge 按 _id 插入或覆盖文档
+func (out mapReduceOutput) actions() []ActionType {
+	if out.merge {
+		return []ActionType{ActionInsert, ActionUpdate}
+	}
+	return []ActionType{ActionInsert, ActionDropCollection, ActionCreateCollection}
+}
+
+// mapReduceSpec 受限的 mapReduce：按字段路径取键和值，用固定的聚合方式合并每个键的值
+type mapReduceSpec struct {
+	keyPath     string      // 键的字段路径，不含 $ 前缀
+	valuePath   string      // 值的字段路径，为空时使用 value
+	value       interface{} // 常量值，map 为字段路径时为 1
+	accumulator string
+	out         mapReduceOutput
+	query       findQuery
+}
+
+// fieldPathArgument 解析 "$a.b" 形式的字段路径，返回去掉 $ 前缀的路径
+func fieldPathArgument(v bsoncore.Value, name string) (string, error) {
+	switch v.Type {
+	case bsoncore.TypeJavaScript, bsoncore.TypeCodeWithScope:
+		return "", NewCommandError(CodeBadValue, "JavaScript functions are not supported in mapReduce.%s; %s", name, mapReduceNote)
+	}
+	s, ok := v.StringValueOK()
+	if !ok || len(s) < 2 || !strings.HasPrefix(s, "$") || strings.ContainsAny(s, " (){}") {
+		return "", NewCommandError(CodeBadValue, "mapReduce.%s must be a field path; %s", name, mapReduceNote)
+	}
+	return s[1:], nil
+}
+
+// parseMapReduce 解析 mapReduce 命令的 map、reduce、out、query、sort 和 limit 参数
+func parseMapReduce(req *commandRequest) (*mapReduceSpec, error) {
+	spec := &mapReduceSpec{value: int32(1)}
+	m, err := req.body.LookupErr("map")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'mapReduce.map' is missing but a required field")
+	}
+	if doc, ok := m.DocumentOK(); ok {
+		key, err := doc.LookupErr("key")
+		if err != nil {
+			return nil, NewCommandError(CodeFailedToParse, "BSON field 'mapReduce.map.key' is missing but a required field")
+		}
+		if spec.keyPath, err = fieldPathArgument(key, "map.key"); err != nil {
+			return nil, err
+		}
+		if value, err := doc.LookupErr("value"); err == nil {
+			if s, ok := value.StringValueOK(); ok && strings.HasPrefix(s, "$") {
+				if spec.valuePath, err = fieldPathArgument(value, "map.value"); err != nil {
+					return nil, err
+				}
+			} else {
+				decoded, err := storage.UnmarshalDocument(doc)
+				if err != nil {
+					return nil, NewCommandError(CodeFailedToParse, "%v", err)
+				}
+				spec.value = decoded["value"]
+			}
+		}
+	} else if spec.keyPath, err = fieldPathArgument(m, "map"); err != nil {
+		return nil, err
+	}
+
+	r, err := req.body.LookupErr("reduce")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'mapReduce.reduce' is missing but a required field")
+	}
+	spec.accumulator, _ = r.StringValueOK()
+	switch spec.accumulator {
+	case storage.AccumulatorCount, storage.AccumulatorSum, storage.AccumulatorPush:
+	default:
+		if r.Type == bsoncore.TypeJavaScript || r.Type == bsoncore.TypeCodeWithScope {
+			return nil, NewCommandError(CodeBadValue, "JavaScript functions are not supported in mapReduce.reduce; %s", mapReduceNote)
+		}
+		return nil, NewCommandError(CodeBadValue, "unsupported mapReduce.reduce %s; %s", r, mapReduceNote)
+	}
+
+	if spec.out, err = parseMapReduceOutput(req); err != nil {
+		return nil, err
+	}
+	if spec.query.filter, err = filterArgument(req, "query"); err != nil {
+		return nil, err
+	}
+	if spec.query.sort, err = filterArgument(req, "sort"); err != nil {
+		return nil, err
+	}
+	if spec.query.limit, err = int64Argument(req, "limit"); err != nil {
+		return nil, err
+	}
+	if spec.query.limit < 0 {
+		return nil, NewCommandError(CodeBadValue, "mapReduce limit must be non-negative")
+	}
+	return spec, nil
+}
+
+// parseMapReduceOutput 解析 out 参数：{inline: 1}、集合名、{replace: 集合名, db} 或 {merge: 集合名, db}
+func parseMapReduceOutput(req *commandRequest) (mapReduceOutput, error) {
+	out := mapReduceOutput{db: req.db}
+	v, err := req.body.LookupErr("out")
+	if err != nil {
+		return out, NewCommandError(CodeFailedToParse, "BSON field 'mapReduce.out' is missing but a required field")
+	}
+	if name, ok := v.StringValueOK(); ok {
+		out.collection = name
+	} else if doc, ok := v.DocumentOK(); ok {
+		elems, err := doc.Elements()
+		if err != nil || len(elems) == 0 {
+			return out, NewCommandError(CodeFailedToParse, "mapReduce.out must not be empty")
+		}
+		for _, elem := range elems {
+			switch elem.Key() {
+			case "inline":
+				out.inline = true
+			case "replace", "merge":
+				out.merge = elem.Key() == "merge"
+				out.collection, _ = elem.Value().StringValueOK()
+			case "db":
+				out.db, _ = elem.Value().StringValueOK()
+			case "reduce":
+				return out, NewCommandError(CodeBadValue, "mapReduce.out mode 'reduce' is not supported; %s", mapReduceNote)
+			default:
+				return out, NewCommandError(CodeBadValue, "unknown mapReduce.out option '%s'", elem.Key())
+			}
+		}
+	} else {
+		return out, NewCommandError(CodeTypeMismatch, "BSON field 'mapReduce.out' is the wrong type '%s', expected types '[string, object]'", v.Type)
+	}
+	if !out.inline && (out.collection == "" || out.db == "") {
+		return out, NewCommandError(CodeInvalidNamespace, "mapReduce output collection and database must be non-empty strings")
+	}
+	return out, nil
+}
+
+// cmdMapReduce 处理 mapReduce 命令
+// 没有 JavaScript 引擎，只支持按字段路径分组并计数、求和或收集取值，相当于单个累加器的 $group；限制在回复的 note 字段中说明
+// 输出集合按 out 替换或按 _id 合并，{inline: 1} 时结果直接在 results 中返回
+func (l *EventListener) cmdMapReduce(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	start := time.Now()
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseMapReduce(req)
+	if err != nil {
+		return nil, err
+	}
+	if !spec.out.inline {
+		for _, action := range spec.out.actions() {
+			if err := l.checkAction(req.session, spec.out.db, req.name, action); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	docs, err := l.runFind(ctx, req.db, coll, &spec.query)
+	if err != nil {
+		return nil, err
+	}
+	emits := make([]storage.GroupEmit, 0, len(docs))
+	for _, doc := range docs {
+		emit := storage.GroupEmit{Value: spec.value}
+		emit.Key, _ = storage.LookupField(doc, spec.keyPath)
+		if spec.valuePath != "" {
+			emit.Value, _ = storage.LookupField(doc, spec.valuePath)
+		}
+		emits = append(emits, emit)
+	}
+	results, err := storage.GroupValues(emits, spec.accumulator)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := bsoncore.NewDocumentBuilder()
+	if spec.out.inline {
+		values := make([]interface{}, len(results))
+		for i, doc := range results {
+			values[i] = doc
+		}
+		raw, err := storage.MarshalDocument(storage.Document{"results": values})
+		if err != nil {
+			return nil, err
+		}
+		builder.AppendArray("results", bsoncore.Document(raw).Lookup("results").Array())
+	} else {
+		if err := l.writeMapReduceOutput(ctx, spec.out, results); err != nil {
+			return nil, err
+		}
+		if spec.out.db == req.db {
+			builder.AppendString("result", spec.out.collection)
+		} else {
+			builder.AppendDocument("result", bsoncore.NewDocumentBuilder().
+				AppendString("db", spec.out.db).
+				AppendString("collection", spec.out.collection).
+				Build())
+		}
+	}
+	return builder.
+		AppendInt64("timeMillis", time.Since(start).Milliseconds()).
+		AppendDocument("counts", bsoncore.NewDocumentBuilder().
+			AppendInt64("input", int64(len(docs))).
+			AppendInt64("emit", int64(len(emits))).
+			AppendInt64("reduce", int64(len(results))).
+			AppendInt64("output", int64(len(results))).
+			Build()).
+		AppendString("note", mapReduceNote), nil
+}
+
+// writeMapReduceOutput 将结果写入输出集合，replace 方式先删除原有集合
+func (l *EventListener) writeMapReduceOutput(ctx context.Context, out mapReduceOutput, results []storage.Document) error {
+	if out.merge {
+		for _, doc := range results {
+			if _, err := l.storageEngine.Update(ctx, out.db, out.collection, storage.Document{"_id": doc["_id"]}, doc, storage.UpdateOptions{Upsert: true}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := l.storageEngine.DropCollection(ctx, out.db, out.collection); err != nil && !errors.Is(err, storage.ErrNamespaceNotFound) {
+		return err
+	}
+	if err := l.storageEngine.CreateDatabase(ctx, out.db); err != nil && !errors.Is(err, storage.ErrNamespaceExists) {
+		return err
+	}
+	if err := l.storageEngine.CreateCollection(ctx, out.db, out.collection); err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return l.storageEngine.Insert(ctx, out.db, out.collection, results)
+}
@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestMapReduce 测试按字段分组计数写入输出集合，以及 inline 输出和不支持的 JavaScript 函数
+func TestMapReduce(t *testing.T) {
+	ctx := context.Background()
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	order := func(id int32, status string, amount int32) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).AppendString("status", status).AppendInt32("amount", amount).Build()
+	}
+	run(1, insertCommandDocument("test", "orders",
+		order(1, "A", 10), order(2, "B", 5), order(3, "A", 7), order(4, "C", 1), order(5, "A", 3),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 6).AppendInt32("amount", 2).Build()))
+	mapReduce := func() *bsoncore.DocumentBuilder {
+		return bsoncore.NewDocumentBuilder().AppendString("mapReduce", "orders")
+	}
+
+	t.Run("计数写入输出集合", func(t *testing.T) {
+		cmd := mapReduce().
+			AppendString("map", "$status").
+			AppendString("reduce", "count").
+			AppendString("out", "order_counts").
+			AppendString("$db", "test").
+			Build()
+		reply := run(2, cmd)
+		if reply.Lookup("ok").Double() != 1 || reply.Lookup("result").StringValue() != "order_counts" {
+			t.Fatalf("mapReduce 失败: %s", reply)
+		}
+		if reply.Lookup("counts", "input").Int64() != 6 || reply.Lookup("counts", "output").Int64() != 4 {
+			t.Errorf("counts 不正确: %s", reply)
+		}
+		if note, ok := reply.Lookup("note").StringValueOK(); !ok || note == "" {
+			t.Errorf("回复应说明 mapReduce 的限制: %s", reply)
+		}
+
+		docs, err := listener.storageEngine.Find(ctx, "test", "order_counts", storage.Document{})
+		if err != nil {
+			t.Fatalf("读取输出集合失败: %v", err)
+		}
+		want := map[interface{}]int32{nil: 1, "A": 3, "B": 1, "C": 1}
+		if len(docs) != len(want) {
+			t.Fatalf("输出集合应有 %d 个文档: %v", len(want), docs)
+		}
+		for _, doc := range docs {
+			if doc["value"] != want[doc["_id"]] {
+				t.Errorf("%v 的计数 = %v, want %d", doc["_id"], doc["value"], want[doc["_id"]])
+			}
+		}
+
+		// 再次输出时替换整个集合
+		filtered := mapReduce().
+			AppendString("map", "$status").
+			AppendString("reduce", "count").
+			AppendDocument("query", bsoncore.NewDocumentBuilder().AppendString("status", "A").Build()).
+			AppendDocument("out", bsoncore.NewDocumentBuilder().AppendString("replace", "order_counts").Build()).
+			AppendString("$db", "test").
+			Build()
+		if reply := run(3, filtered); reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("mapReduce 失败: %s", reply)
+		}
+		docs, _ = listener.storageEngine.Find(ctx, "test", "order_counts", storage.Document{})
+		if len(docs) != 1 || docs[0]["_id"] != "A" || docs[0]["value"] != int32(3) {
+			t.Errorf("replace 输出应只包含 A 的计数: %v", docs)
+		}
+	})
+
+	t.Run("inline 求和", func(t *testing.T) {
+		cmd := mapReduce().
+			AppendDocument("map", bsoncore.NewDocumentBuilder().AppendString("key", "$status").AppendString("value", "$amount").Build()).
+			AppendString("reduce", "sum").
+			AppendDocument("out", bsoncore.NewDocumentBuilder().AppendInt32("inline", 1).Build()).
+			AppendString("$db", "test").
+			Build()
+		reply := run(4, cmd)
+		results, err := reply.Lookup("results").Array().Values()
+		if reply.Lookup("ok").Double() != 1 || err != nil || len(results) != 4 {
+			t.Fatalf("inline 结果不正确: %s", reply)
+		}
+		// 结果按键排序，null 在最前
+		if a := results[1].Document(); a.Lookup("_id").StringValue() != "A" || a.Lookup("value").Int32() != 20 {
+			t.Errorf("A 的合计不正确: %s", a)
+		}
+	})
+
+	t.Run("不支持的参数", func(t *testing.T) {
+		js := mapReduce().
+			AppendJavaScript("map", "function() { emit(this.status, 1); }").
+			AppendString("reduce", "count").
+			AppendString("out", "x").
+			AppendString("$db", "test").
+			Build()
+		if code := run(5, js).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("JavaScript 函数应返回 BadValue, got %d", code)
+		}
+		reduce := mapReduce().
+			AppendString("map", "$status").
+			AppendString("reduce", "avg").
+			AppendString("out", "x").
+			AppendString("$db", "test").
+			Build()
+		if code := run(6, reduce).Lookup("code").Int32(); code != int32(CodeBadValue) {
+			t.Errorf("不支持的 reduce 应返回 BadValue, got %d", code)
+		}
+	})
+}
+
+// TestMapReduceOutputAuthorization 测试写入输出集合按 out 方式检查权限
+func TestMapReduceOutputAuthorization(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Storage.Engine = "memory"
+	cfg.Security.Authorization = true
+	// 只能插入的角色不能替换或合并输出集合
+	databaseRoles["insertOnly"] = newActionSet([]actionSet{readActions}, ActionInsert)
+	defer delete(databaseRoles, "insertOnly")
+
+	listener := newTestListener(t, cfg)
+	if err := listener.storageEngine.Insert(context.Background(), "test", "orders", []storage.Document{
+		{"_id": int32(1), "status": "A"},
+	}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	run := func(roles []RoleName, out bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		session := newFakeSession()
+		SetAuthenticatedUser(session, &UserIdentity{User: "reporter", DB: "test", Roles: roles})
+		cmd := bsoncore.NewDocumentBuilder().
+			AppendString("mapReduce", "orders").
+			AppendString("map", "$status").
+			AppendString("reduce", "count").
+			AppendDocument("out", out).
+			AppendString("$db", "test").
+			Build()
+		return replyDocument(t, listener.handleMessage(session, newOpMsgMessage(1, cmd)))
+	}
+	insertOnly := []RoleName{{Role: "insertOnly", DB: "test"}}
+	readWrite := []RoleName{{Role: "readWrite", DB: "test"}}
+
+	for _, mode := range []string{"replace", "merge"} {
+		out := bsoncore.NewDocumentBuilder().AppendString(mode, "order_counts").Build()
+		if code := run(insertOnly, out).Lookup("code").Int32(); code != int32(CodeUnauthorized) {
+			t.Errorf("%s 输出只有 insert 权限时应返回 Unauthorized, got %d", mode, code)
+		}
+		if reply := run(readWrite, out); reply.Lookup("ok").Double() != 1 {
+			t.Errorf("readWrite 角色应能以 %s 方式输出: %s", mode, reply)
+		}
+	}
+	inline := bsoncore.NewDocumentBuilder().AppendInt32("inline", 1).Build()
+	if reply := run(insertOnly, inline); reply.Lookup("ok").Double() != 1 {
+		t.Errorf("inline 输出只需要读权限: %s", reply)
+	}
+}
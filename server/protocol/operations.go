@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("currentOp", ActionInprog, (*EventListener).cmdCurrentOp)
+	registerCommand("killOp", ActionKillop, (*EventListener).cmdKillOp)
+}
+
+// activeOp 正在执行的操作
+type activeOp struct {
+	opid   int32
+	client string // 客户端地址
+	start  time.Time
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	op      string            // 操作类型，与 system.profile 的 op 字段相同
+	ns      string            // 命名空间，旧版写操作为空
+	command bsoncore.Document // 隐藏了敏感字段的命令文档，旧版写操作为 nil
+	killed  bool              // 是否已被 killOp 中止
+}
+
+// describe 记录操作执行的命令
+func (op *activeOp) describe(req *commandRequest) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.op = commandOpType(req)
+	op.ns = commandNamespace(req)
+	op.command = redactCommand(req.name, req.body)
+}
+
+// document 返回 currentOp 结果中的一项
+func (op *activeOp) document(now time.Time) (storage.Document, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	running := now.Sub(op.start)
+	doc := storage.Document{
+		"opid":              op.opid,
+		"active":            true,
+		"op":                op.op,
+		"ns":                op.ns,
+		"client":            op.client,
+		"secs_running":      int64(running / time.Second),
+		"microsecs_running": running.Microseconds(),
+		"killPending":       op.killed,
+	}
+	if op.command != nil {
+		command, err := storage.UnmarshalDocument(op.command)
+		if err != nil {
+			return nil, err
+		}
+		doc["command"] = command
+	}
+	return doc, nil
+}
+
+// operationRegistry 正在执行的操作，killOp 可能在其他连接上执行，因此所有连接共享同一个注册表
+type operationRegistry struct {
+	mu     sync.Mutex
+	nextId int32
+	ops    map[int32]*activeOp
+}
+
+// operations 全局操作注册表
+var operations = &operationRegistry{ops: make(map[int32]*activeOp)}
+
+// begin 注册操作，返回的 context 在 killOp 或 end 时取消
+func (r *operationRegistry) begin(ctx context.Context, client, opType string) (context.Context, *activeOp) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextId++
+	op := &activeOp{opid: r.nextId, client: client, start: time.Now(), cancel: cancel, op: opType}
+	r.ops[op.opid] = op
+	return context.WithValue(ctx, activeOpKey{}, op), op
+}
+
+// end 移除已结束的操作
+func (r *operationRegistry) end(op *activeOp) {
+	r.mu.Lock()
+	delete(r.ops, op.opid)
+	r.mu.Unlock()
+	op.cancel()
+}
+
+// kill 取消操作的 context，操作在下一次检查 context 时中止；返回操作是否存在
+func (r *operationRegistry) kill(opid int32) bool {
+	r.mu.Lock()
+	op, ok := r.ops[opid]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	op.mu.Lock()
+	op.killed = true
+	op.mu.Unlock()
+	op.cancel()
+	return true
+}
+
+// list 按 opid 顺序返回正在执行的操作
+func (r *operationRegistry) list() []*activeOp {
+	r.mu.Lock()
+	ops := make([]*activeOp, 0, len(r.ops))
+	for _, op := range r.ops {
+		ops = append(ops, op)
+	}
+	r.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].opid < ops[j].opid })
+	return ops
+}
+
+// activeOpKey context 中保存当前操作的键
+type activeOpKey struct{}
+
+// operationOf 返回 context 所属的操作，不在 handleMessage 中执行时返回 nil
+func operationOf(ctx context.Context) *activeOp {
+	op, _ := ctx.Value(activeOpKey{}).(*activeOp)
+	return op
+}
+
+// opcodeOpType 按操作码返回操作类型，命令的类型在解析命令后更新
+func opcodeOpType(opCode OpCode) string {
+	switch opCode {
+	case OpQuery:
+		return "query"
+	case OpInsert:
+		return "insert"
+	case OpUpdate:
+		return "update"
+	case OpDelete:
+		return "remove"
+	}
+	return "command"
+}
+
+// currentOpArguments currentOp 命令中不作为过滤条件的参数
+var currentOpArguments = map[string]bool{
+	"currentOp":       true,
+	"$all":            true,
+	"$ownOps":         true,
+	"$db":             true,
+	"lsid":            true,
+	"$clusterTime":    true,
+	"$readPreference": true,
+	"maxTimeMS":       true,
+	"comment":         true,
+}
+
+// cmdCurrentOp 处理 currentOp 命令，返回正在执行的操作
+// 命令中 currentOp、$all、$ownOps 和通用参数以外的字段作为过滤条件匹配每个操作
+func (l *EventListener) cmdCurrentOp(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	if req.db != "admin" {
+		return nil, NewCommandError(CodeUnauthorized, "currentOp may only be run against the admin database.")
+	}
+	body, err := storage.UnmarshalDocument(req.body)
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	filter := storage.Document{}
+	for key, value := range body {
+		if !currentOpArguments[key] {
+			filter[key] = value
+		}
+	}
+
+	inprog := bsoncore.NewArrayBuilder()
+	now := time.Now()
+	for _, op := range operations.list() {
+		doc, err := op.document(now)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := storage.Matches(doc, filter)
+		if err != nil {
+			return nil, NewCommandError(CodeBadValue, "%v", err)
+		}
+		if !ok {
+			continue
+		}
+		raw, err := storage.MarshalDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		inprog.AppendDocument(raw)
+	}
+	return bsoncore.NewDocumentBuilder().AppendArray("inprog", inprog.Build()), nil
+}
+
+// cmdKillOp 处理 killOp 命令，中止 op 指定的操作
+// 与 mongod 一致，操作不存在时同样返回成功
+func (l *EventListener) cmdKillOp(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	if req.db != "admin" {
+		return nil, NewCommandError(CodeUnauthorized, "killOp may only be run against the admin database.")
+	}
+	v, err := req.body.LookupErr("op")
+	if err != nil {
+		return nil, NewCommandError(CodeBadValue, "Did not provide \"op\" field")
+	}
+	opid, ok := v.AsInt64OK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'killOp.op' is the wrong type '%s', expected a number", v.Type)
+	}
+	operations.kill(int32(opid))
+	return bsoncore.NewDocumentBuilder().AppendString("info", "attempting to kill op"), nil
+}
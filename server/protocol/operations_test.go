@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestKillOp 测试通过 currentOp 找到正在执行的全表扫描，并用 killOp 中止
+func TestKillOp(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	insertLargeCollection(t, listener, 50000)
+
+	// 不匹配任何文档的正则需要扫描整个集合
+	find := bsoncore.NewDocumentBuilder().
+		AppendString("find", "large").
+		AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendRegex("name", "^none", "").Build()).
+		AppendString("$db", "test").
+		Build()
+	done := make(chan bsoncore.Document, 1)
+	go func() {
+		msg, err := parseOpMsg(listener.handleMessage(newFakeSession(), newOpMsgMessage(1, find)).Body)
+		if err != nil {
+			done <- nil
+			return
+		}
+		done <- msg.body
+	}()
+
+	currentOp := bsoncore.NewDocumentBuilder().
+		AppendInt32("currentOp", 1).
+		AppendString("ns", "test.large").
+		AppendString("$db", "admin").
+		Build()
+	var op bsoncore.Document
+	for op == nil {
+		select {
+		case reply := <-done:
+			t.Fatalf("查询在中止前已经结束: %s", reply)
+		default:
+		}
+		values, err := run(2, currentOp).Lookup("inprog").Array().Values()
+		if err != nil {
+			t.Fatalf("读取 inprog 失败: %v", err)
+		}
+		if len(values) > 0 {
+			op = values[0].Document()
+		}
+	}
+	if op.Lookup("op").StringValue() != "query" || op.Lookup("client").StringValue() != "127.0.0.1:50000" {
+		t.Errorf("currentOp 的操作信息不正确: %s", op)
+	}
+	if op.Lookup("command", "find").StringValue() != "large" {
+		t.Errorf("currentOp 应包含命令文档: %s", op)
+	}
+
+	killOp := bsoncore.NewDocumentBuilder().
+		AppendInt32("killOp", 1).
+		AppendInt32("op", op.Lookup("opid").Int32()).
+		AppendString("$db", "admin").
+		Build()
+	if reply := run(3, killOp); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("killOp 失败: %s", reply)
+	}
+
+	select {
+	case reply := <-done:
+		if reply.Lookup("ok").Double() != 0 || reply.Lookup("code").Int32() != int32(CodeInterrupted) {
+			t.Errorf("被中止的查询应返回 Interrupted: %s", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("killOp 后查询没有结束")
+	}
+
+	// 结束的操作不再出现在 currentOp 中
+	if values, _ := run(4, currentOp).Lookup("inprog").Array().Values(); len(values) != 0 {
+		t.Errorf("操作结束后 currentOp 不应再返回: %v", values)
+	}
+
+	// 只能在 admin 库上执行
+	notAdmin := bsoncore.NewDocumentBuilder().AppendInt32("currentOp", 1).AppendString("$db", "test").Build()
+	if reply := run(5, notAdmin); reply.Lookup("code").Int32() != int32(CodeUnauthorized) {
+		t.Errorf("在非 admin 库上执行 currentOp 应返回 Unauthorized: %s", reply)
+	}
+}
+
+// TestCurrentOpRedaction 测试 currentOp 返回的命令文档隐藏了密码等敏感字段
+func TestCurrentOpRedaction(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	registerCommand("createUser", ActionNone, func(l *EventListener, ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+		close(started)
+		<-release
+		return bsoncore.NewDocumentBuilder(), nil
+	})
+	defer delete(commandRegistry, "createUser")
+
+	listener := newTestListener(t, &config.Config{})
+	createUser := bsoncore.NewDocumentBuilder().
+		AppendString("createUser", "alice").
+		AppendString("pwd", "s3cret-password").
+		AppendString("$db", "admin").
+		Build()
+	done := make(chan struct{})
+	go func() {
+		listener.handleMessage(newFakeSession(), newOpMsgMessage(1, createUser))
+		close(done)
+	}()
+	<-started
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	currentOp := bsoncore.NewDocumentBuilder().
+		AppendInt32("currentOp", 1).
+		AppendString("ns", "admin.alice").
+		AppendString("$db", "admin").
+		Build()
+	values, err := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(2, currentOp))).Lookup("inprog").Array().Values()
+	if err != nil || len(values) != 1 {
+		t.Fatalf("currentOp 应返回正在执行的 createUser: %v, %v", values, err)
+	}
+	op := values[0].Document()
+	if pwd := op.Lookup("command", "pwd").StringValue(); pwd != redactedValue {
+		t.Errorf("currentOp 中的密码应被隐藏: %s", op)
+	}
+}
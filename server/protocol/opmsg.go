@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// castagnoliTable OP_MSG 校验和使用的 CRC32C 表
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// opMsgRequest 解析后的 OP_MSG 请求
+type opMsgRequest struct {
+	flags     wiremessage.MsgFlag
+	body      bsoncore.Document              // kind 0 命令文档
+	sequences map[string][]bsoncore.Document // kind 1 文档序列，按标识符分组
+}
+
+// parseOpMsg 解析 OP_MSG 消息体（不含消息头）
+func parseOpMsg(body []byte) (*opMsgRequest, error) {
+	flags, rem, ok := wiremessage.ReadMsgFlags(body)
+	if !ok {
+		return nil, fmt.Errorf("读取 OP_MSG 标志失败")
+	}
+
+	// 末尾的 CRC32C 校验和不属于任何 section
+	if flags&wiremessage.ChecksumPresent != 0 {
+		if len(rem) < 4 {
+			return nil, fmt.Errorf("OP_MSG 校验和长度不足")
+		}
+		rem = rem[:len(rem)-4]
+	}
+
+	req := &opMsgRequest{flags: flags}
+	for len(rem) > 0 {
+		stype, r, ok := wiremessage.ReadMsgSectionType(rem)
+		if !ok {
+			return nil, fmt.Errorf("读取 OP_MSG section 类型失败")
+		}
+
+		switch stype {
+		case wiremessage.SingleDocument:
+			if req.body != nil {
+				return nil, fmt.Errorf("OP_MSG 包含多个 kind 0 section")
+			}
+			doc, r2, ok := wiremessage.ReadMsgSectionSingleDocument(r)
+			if !ok {
+				return nil, fmt.Errorf("读取 OP_MSG 命令文档失败")
+			}
+			req.body = doc
+			rem = r2
+		case wiremessage.DocumentSequence:
+			identifier, docs, r2, ok := wiremessage.ReadMsgSectionDocumentSequence(r)
+			if !ok {
+				return nil, fmt.Errorf("读取 OP_MSG 文档序列失败")
+			}
+			if req.sequences == nil {
+				req.sequences = make(map[string][]bsoncore.Document)
+			}
+			req.sequences[identifier] = append(req.sequences[identifier], docs...)
+			rem = r2
+		default:
+			return nil, fmt.Errorf("未知的 OP_MSG section 类型: %d", stype)
+		}
+	}
+
+	if req.body == nil {
+		return nil, fmt.Errorf("OP_MSG 缺少命令文档")
+	}
+	return req, nil
+}
+
+// buildOpMsgReply 构造携带单个结果文档的 OP_MSG 回复
+func buildOpMsgReply(request *Message, doc bsoncore.Document) *Message {
+	body := wiremessage.AppendMsgFlags(nil, 0)
+	body = wiremessage.AppendMsgSectionType(body, wiremessage.SingleDocument)
+	body = append(body, doc...)
+
+	return &Message{
+		Header: &MessageHeader{
+			MessageLength: int32(16 + len(body)),
+			RequestID:     generateRequestID(),
+			ResponseTo:    request.Header.RequestID,
+			OpCode:        int32(OpMsg),
+		},
+		Body:   body,
+		OpCode: OpMsg,
+	}
+}
+
+// documentSequenceMinBytes 游标批次的文档总大小达到该字节数时才改用文档序列返回
+const documentSequenceMinBytes = 256 * 1024
+
+// buildOpMsgSequenceReply 构造带 kind 1 文档序列的 OP_MSG 回复
+// kind 0 section 为结果文档，随后的 kind 1 section 以 identifier 标识携带 docs
+func buildOpMsgSequenceReply(request *Message, doc bsoncore.Document, identifier string, docs []bsoncore.Document) *Message {
+	reply := buildOpMsgReply(request, doc)
+	reply.Body = wiremessage.AppendMsgSectionType(reply.Body, wiremessage.DocumentSequence)
+	reply.Body = wiremessage.AppendMsgSectionDocumentSequence(reply.Body, identifier, docs)
+	reply.Header.MessageLength = int32(16 + len(reply.Body))
+	return reply
+}
+
+// splitCursorBatch 把 {cursor: {firstBatch|nextBatch, id, ns}} 结果中的批次拆成文档序列
+// 返回去掉批次数组的结果文档、序列标识符 cursor.firstBatch 或 cursor.nextBatch 和批次中的文档；
+// 结果不是游标或批次文档总大小小于 minBytes 时 ok 为 false
+func splitCursorBatch(result bsoncore.Document, minBytes int) (doc bsoncore.Document, identifier string, docs []bsoncore.Document, ok bool) {
+	cursor, ok := result.Lookup("cursor").DocumentOK()
+	if !ok {
+		return nil, "", nil, false
+	}
+	var batchField string
+	var batch bsoncore.Array
+	for _, name := range []string{"firstBatch", "nextBatch"} {
+		if batch, ok = cursor.Lookup(name).ArrayOK(); ok {
+			batchField = name
+			break
+		}
+	}
+	if !ok || len(batch) < minBytes {
+		return nil, "", nil, false
+	}
+	values, err := batch.Values()
+	if err != nil {
+		return nil, "", nil, false
+	}
+	docs = make([]bsoncore.Document, 0, len(values))
+	for _, v := range values {
+		d, isDoc := v.DocumentOK()
+		if !isDoc {
+			return nil, "", nil, false
+		}
+		docs = append(docs, d)
+	}
+
+	// kind 0 section 保留 cursor 中除批次以外的字段，驱动从中读取 id 和 ns
+	elems, err := result.Elements()
+	if err != nil {
+		return nil, "", nil, false
+	}
+	builder := bsoncore.NewDocumentBuilder()
+	for _, elem := range elems {
+		if elem.Key() != "cursor" {
+			builder.AppendValue(elem.Key(), elem.Value())
+			continue
+		}
+		cursorElems, err := cursor.Elements()
+		if err != nil {
+			return nil, "", nil, false
+		}
+		builder.StartDocument("cursor")
+		for _, ce := range cursorElems {
+			if ce.Key() != batchField {
+				builder.AppendValue(ce.Key(), ce.Value())
+			}
+		}
+		builder.FinishDocument()
+	}
+	return builder.Build(), "cursor." + batchField, docs, true
+}
+
+// opMsgChecksum 计算消息头与消息体的 CRC32C
+func opMsgChecksum(header *MessageHeader, body []byte) uint32 {
+	var buf [16]byte
+	binary.LittleEndian.PutUint32(buf[0:], uint32(header.MessageLength))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(header.RequestID))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(header.ResponseTo))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(header.OpCode))
+
+	crc := crc32.Update(0, castagnoliTable, buf[:])
+	return crc32.Update(crc, castagnoliTable, body)
+}
+
+// verifyOpMsgChecksum 若设置了 checksumPresent 标志，校验消息末尾的 CRC32C
+func verifyOpMsgChecksum(message *Message) error {
+	flags, _, ok := wiremessage.ReadMsgFlags(message.Body)
+	if !ok {
+		return fmt.Errorf("读取 OP_MSG 标志失败")
+	}
+	if flags&wiremessage.ChecksumPresent == 0 {
+		return nil
+	}
+	if len(message.Body) < 8 {
+		return fmt.Errorf("OP_MSG 校验和长度不足")
+	}
+
+	content := message.Body[:len(message.Body)-4]
+	expected, _, _ := wiremessage.ReadMsgChecksum(message.Body[len(content):])
+	if actual := opMsgChecksum(message.Header, content); actual != expected {
+		return fmt.Errorf("OP_MSG checksum does not match contents: got %08x, want %08x", actual, expected)
+	}
+	return nil
+}
+
+// appendOpMsgChecksum 为 OP_MSG 设置 checksumPresent 标志并追加 CRC32C
+func appendOpMsgChecksum(message *Message) {
+	flags, _, _ := wiremessage.ReadMsgFlags(message.Body)
+	binary.LittleEndian.PutUint32(message.Body, uint32(flags|wiremessage.ChecksumPresent))
+
+	message.Header.MessageLength = int32(16 + len(message.Body) + 4)
+	checksum := opMsgChecksum(message.Header, message.Body)
+	message.Body = binary.LittleEndian.AppendUint32(message.Body, checksum)
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// TestOpMsgChecksum 测试 OP_MSG 的 CRC32C 校验和
+func TestOpMsgChecksum(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+
+	t.Run("校验和正确", func(t *testing.T) {
+		request := newOpMsgMessage(1, pingCommandDocument())
+		appendOpMsgChecksum(request)
+
+		doc := replyDocument(t, listener.handleMessage(newFakeSession(), request))
+		if ok := doc.Lookup("ok").Double(); ok != 1 {
+			t.Fatalf("校验和正确时应执行成功: %s", doc)
+		}
+	})
+
+	t.Run("校验和损坏", func(t *testing.T) {
+		request := newOpMsgMessage(2, pingCommandDocument())
+		appendOpMsgChecksum(request)
+		request.Body[len(request.Body)-1] ^= 0xFF
+
+		doc := replyDocument(t, listener.handleMessage(newFakeSession(), request))
+		if ok := doc.Lookup("ok").Double(); ok != 0 {
+			t.Fatalf("校验和损坏时应拒绝: %s", doc)
+		}
+		if code := doc.Lookup("code").Int32(); code != 9 {
+			t.Errorf("错误码不正确: got %d, want 9", code)
+		}
+	})
+
+	t.Run("内容被篡改", func(t *testing.T) {
+		request := newOpMsgMessage(3, pingCommandDocument())
+		appendOpMsgChecksum(request)
+		request.Header.RequestID = 4
+
+		doc := replyDocument(t, listener.handleMessage(newFakeSession(), request))
+		if ok := doc.Lookup("ok").Double(); ok != 0 {
+			t.Fatalf("消息头被篡改时应拒绝: %s", doc)
+		}
+	})
+
+	t.Run("回复附带校验和", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Network.ChecksumEnabled = true
+		checksumListener := newTestListener(t, cfg)
+
+		reply := checksumListener.handleMessage(newFakeSession(), newOpMsgMessage(5, pingCommandDocument()))
+		flags, _, _ := wiremessage.ReadMsgFlags(reply.Body)
+		if flags&wiremessage.ChecksumPresent == 0 {
+			t.Fatal("回复应设置 checksumPresent 标志")
+		}
+		if int(reply.Header.MessageLength) != 16+len(reply.Body) {
+			t.Errorf("消息长度不正确: got %d, want %d", reply.Header.MessageLength, 16+len(reply.Body))
+		}
+		if err := verifyOpMsgChecksum(reply); err != nil {
+			t.Errorf("回复校验和无效: %v", err)
+		}
+		if doc := replyDocument(t, reply); doc.Lookup("ok").Double() != 1 {
+			t.Errorf("回复内容不正确: %s", doc)
+		}
+	})
+}
+
+// TestOpMsgDocumentSequenceReply 测试游标批次以 kind 1 文档序列返回
+func TestOpMsgDocumentSequenceReply(t *testing.T) {
+	t.Run("构造与解析", func(t *testing.T) {
+		docs := []bsoncore.Document{
+			bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).Build(),
+			bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendString("name", "b").Build(),
+		}
+		result := cursorResponse("firstBatch", 42, "test.items", docs, nil).AppendDouble("ok", 1).Build()
+		doc, identifier, seq, ok := splitCursorBatch(result, 0)
+		if !ok || identifier != "cursor.firstBatch" {
+			t.Fatalf("拆分游标批次失败: identifier=%q ok=%v", identifier, ok)
+		}
+
+		data, err := buildOpMsgSequenceReply(newOpMsgMessage(1, pingCommandDocument()), doc, identifier, seq).Serialize()
+		if err != nil {
+			t.Fatalf("序列化回复失败: %v", err)
+		}
+		pkg, n, err := NewPackageHandler(0).Read(nil, data)
+		if err != nil || n != len(data) {
+			t.Fatalf("读取回复失败: n=%d err=%v", n, err)
+		}
+		msg, err := parseOpMsg(pkg.(*Message).Body)
+		if err != nil {
+			t.Fatalf("解析回复失败: %v", err)
+		}
+		if id := msg.body.Lookup("cursor", "id").Int64(); id != 42 {
+			t.Errorf("cursor.id = %d, want 42", id)
+		}
+		if ns := msg.body.Lookup("cursor", "ns").StringValue(); ns != "test.items" {
+			t.Errorf("cursor.ns = %q, want test.items", ns)
+		}
+		if _, err := msg.body.LookupErr("cursor", "firstBatch"); err == nil {
+			t.Error("kind 0 section 不应再包含 firstBatch")
+		}
+		got := msg.sequences["cursor.firstBatch"]
+		if len(got) != len(docs) {
+			t.Fatalf("文档序列长度 = %d, want %d", len(got), len(docs))
+		}
+		for i := range docs {
+			if !bytes.Equal(got[i], docs[i]) {
+				t.Errorf("第 %d 个文档 = %s, want %s", i, got[i], docs[i])
+			}
+		}
+	})
+
+	t.Run("只有大批次使用文档序列", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Network.ReplyDocumentSequence = true
+		listener := newTestListener(t, cfg)
+		insertLargeCollection(t, listener, 2000)
+
+		for _, tt := range []struct {
+			batchSize int32
+			sequence  bool
+		}{
+			{10, false},
+			{2000, true},
+		} {
+			reply := listener.handleMessage(newFakeSession(), newOpMsgMessage(tt.batchSize, findBatchCommand(tt.batchSize, nil)))
+			msg, err := parseOpMsg(reply.Body)
+			if err != nil {
+				t.Fatalf("解析回复失败: %v", err)
+			}
+			docs, sequence := msg.sequences["cursor.firstBatch"]
+			if sequence != tt.sequence {
+				t.Fatalf("batchSize %d 使用文档序列 = %v, want %v", tt.batchSize, sequence, tt.sequence)
+			}
+			if !sequence {
+				_, docs = cursorBatch(t, msg.body, "firstBatch")
+			}
+			if len(docs) != int(tt.batchSize) {
+				t.Errorf("batchSize %d 返回 %d 个文档", tt.batchSize, len(docs))
+			}
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("profile", ActionEnableProfiler, (*EventListener).cmdProfile)
+}
+
+// 分析级别
+const (
+	profileOff  = 0 // 不记录
+	profileSlow = 1 // 只记录超过慢操作阈值的操作
+	profileAll  = 2 // 记录所有操作
+)
+
+const (
+	// defaultSlowMs 默认的慢操作阈值(毫秒)
+	defaultSlowMs = 100
+	// profileCollection 保存分析记录的集合
+	profileCollection = "system.profile"
+	// profileCollectionSize system.profile 固定集合的大小
+	profileCollectionSize = 1024 * 1024
+)
+
+// profilerState 分析器配置，所有连接共享
+// 分析级别按数据库设置，慢操作阈值对所有数据库生效
+type profilerState struct {
+	mu     sync.Mutex
+	levels map[string]int
+	slowMs int64
+}
+
+// profiler 全局分析器配置
+var profiler = &profilerState{levels: make(map[string]int), slowMs: defaultSlowMs}
+
+// settings 返回数据库的分析级别和慢操作阈值
+func (p *profilerState) settings(db string) (level int, slowMs int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.levels[db], p.slowMs
+}
+
+// profiledOp 一次命令执行的分析信息
+type profiledOp struct {
+	req     *commandRequest
+	stats   *storage.ExecutionStats
+	elapsed time.Duration
+	err     error
+}
+
+// opType 返回 system.profile 中的操作类型
+func (op *profiledOp) opType() string {
+	return commandOpType(op.req)
+}
+
+// commandOpType 返回命令的操作类型，用于 system.profile 和 currentOp
+func commandOpType(req *commandRequest) string {
+	switch req.name {
+	case "find", "count", "distinct":
+		return "query"
+	case "insert", "update":
+		return req.name
+	case "delete":
+		return "remove"
+	case "getMore":
+		return "getmore"
+	}
+	return "command"
+}
+
+// filter 返回命令的过滤条件，没有时返回 nil
+func (op *profiledOp) filter() bsoncore.Document {
+	for _, name := range []string{"filter", "query"} {
+		if v, err := op.req.body.LookupErr(name); err == nil {
+			if doc, ok := v.DocumentOK(); ok {
+				return doc
+			}
+		}
+	}
+	return nil
+}
+
+// profileCommand 记录命令的执行情况
+// 超过慢操作阈值的操作总是写入日志；分析级别为 1 时慢操作、为 2 时所有操作写入所在数据库的 system.profile
+func (l *EventListener) profileCommand(op *profiledOp) {
+	ns := commandNamespace(op.req)
+	if ns == op.req.db+"."+profileCollection {
+		return
+	}
+	level, slowMs := profiler.settings(op.req.db)
+	millis := op.elapsed.Milliseconds()
+	slow := millis >= slowMs
+	if slow {
+		filter := "{}"
+		if doc := op.filter(); doc != nil {
+			filter = doc.String()
+		}
+		logger.Infof("慢操作 %s %s filter: %s docsExamined: %d keysExamined: %d 耗时 %dms",
+			op.opType(), ns, filter, op.stats.DocsExamined, op.stats.KeysExamined, millis)
+	}
+	if level == profileAll || (level == profileSlow && slow) {
+		if err := l.writeProfileEntry(op, ns, millis); err != nil {
+			logger.Warnf("写入 %s.%s 失败: %v", op.req.db, profileCollection, err)
+		}
+	}
+}
+
+// writeProfileEntry 向 system.profile 追加一条分析记录，集合不存在时创建为固定集合
+// 分析记录不属于命令所在的事务，使用独立的 context 写入；命令文档中的密码等敏感字段按 redactCommand 隐藏
+func (l *EventListener) writeProfileEntry(op *profiledOp, ns string, millis int64) error {
+	ctx := context.Background()
+	command, err := storage.UnmarshalDocument(redactCommand(op.req.name, op.req.body))
+	if err != nil {
+		return err
+	}
+	entry := storage.Document{
+		"op":           op.opType(),
+		"ns":           ns,
+		"command":      command,
+		"docsExamined": op.stats.DocsExamined,
+		"keysExamined": op.stats.KeysExamined,
+		"millis":       millis,
+		"ts":           time.Now(),
+	}
+	if op.err != nil {
+		entry["ok"] = float64(0)
+		entry["errMsg"] = op.err.Error()
+	} else {
+		entry["ok"] = float64(1)
+	}
+
+	if err := l.storageEngine.CreateDatabase(ctx, op.req.db); err != nil && !errors.Is(err, storage.ErrNamespaceExists) {
+		return err
+	}
+	err = l.storageEngine.CreateCappedCollection(ctx, op.req.db, profileCollection, profileCollectionSize, 0)
+	if err != nil && !errors.Is(err, storage.ErrNamespaceExists) {
+		return err
+	}
+	return l.storageEngine.Insert(ctx, op.req.db, profileCollection, []storage.Document{entry})
+}
+
+// cmdProfile 处理 profile 命令，返回原来的分析级别和慢操作阈值
+// profile 为 -1 时只查询当前设置；slowms 修改所有数据库共用的慢操作阈值
+func (l *EventListener) cmdProfile(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	v := req.body.Index(0).Value()
+	level, ok := v.AsInt64OK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'profile.profile' is the wrong type '%s', expected a number", v.Type)
+	}
+	if level < -1 || level > profileAll {
+		return nil, NewCommandError(CodeBadValue, "Profiling level must be -1, 0, 1 or 2, got %d", level)
+	}
+	slowMs := int64(-1)
+	if v, err := req.body.LookupErr("slowms"); err == nil {
+		if slowMs, ok = v.AsInt64OK(); !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'profile.slowms' is the wrong type '%s', expected a number", v.Type)
+		}
+		if slowMs < 0 {
+			return nil, NewCommandError(CodeBadValue, "slowms must be a non-negative number, got %d", slowMs)
+		}
+	}
+
+	profiler.mu.Lock()
+	was, wasSlowMs := profiler.levels[req.db], profiler.slowMs
+	if level >= 0 {
+		profiler.levels[req.db] = int(level)
+	}
+	if slowMs >= 0 {
+		profiler.slowMs = slowMs
+	}
+	profiler.mu.Unlock()
+
+	return bsoncore.NewDocumentBuilder().
+		AppendInt32("was", int32(was)).
+		AppendInt32("slowms", int32(wasSlowMs)).
+		AppendDouble("sampleRate", 1), nil
+}
@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestProfiler 测试 profile 命令设置分析级别，慢操作写入 system.profile
+func TestProfiler(t *testing.T) {
+	defer func() {
+		profiler.mu.Lock()
+		profiler.levels = make(map[string]int)
+		profiler.slowMs = defaultSlowMs
+		profiler.mu.Unlock()
+	}()
+
+	listener := newTestListener(t, &config.Config{})
+	requestID := int32(0)
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+	profile := func(level, slowMs int32) bsoncore.Document {
+		t.Helper()
+		return run(bsoncore.NewDocumentBuilder().
+			AppendInt32("profile", level).AppendInt32("slowms", slowMs).AppendString("$db", "test").Build())
+	}
+	findItems := func() {
+		t.Helper()
+		filter := bsoncore.NewDocumentBuilder().AppendInt32("x", 2).Build()
+		reply := run(bsoncore.NewDocumentBuilder().
+			AppendString("find", "items").AppendDocument("filter", filter).AppendString("$db", "test").Build())
+		if _, docs := cursorBatch(t, reply, "firstBatch"); len(docs) != 1 {
+			t.Fatalf("find 应返回 1 个文档: %s", reply)
+		}
+	}
+	// 只取查询的记录，profile 命令本身也会被记录
+	profileEntries := func() []bsoncore.Document {
+		t.Helper()
+		filter := bsoncore.NewDocumentBuilder().AppendString("op", "query").Build()
+		reply := run(bsoncore.NewDocumentBuilder().
+			AppendString("find", "system.profile").AppendDocument("filter", filter).AppendString("$db", "test").Build())
+		_, docs := cursorBatch(t, reply, "firstBatch")
+		return docs
+	}
+
+	for i := int32(1); i <= 3; i++ {
+		run(insertCommandDocument("test", "items", bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendInt32("x", i).Build()))
+	}
+
+	reply := profile(1, 100000)
+	if reply.Lookup("was").Int32() != 0 || reply.Lookup("slowms").Int32() != defaultSlowMs {
+		t.Errorf("应返回原来的级别 0 和默认阈值: %s", reply)
+	}
+	findItems()
+	if entries := profileEntries(); len(entries) != 0 {
+		t.Errorf("未超过阈值的操作不应被记录: %v", entries)
+	}
+
+	reply = profile(1, 0)
+	if reply.Lookup("was").Int32() != 1 || reply.Lookup("slowms").Int32() != 100000 {
+		t.Errorf("应返回原来的级别 1 和阈值 100000: %s", reply)
+	}
+	findItems()
+	entries := profileEntries()
+	if len(entries) != 1 {
+		t.Fatalf("慢查询应被记录一次, got %v", entries)
+	}
+	entry := entries[0]
+	if op := entry.Lookup("op").StringValue(); op != "query" {
+		t.Errorf("op 应为 query, got %s", op)
+	}
+	if ns := entry.Lookup("ns").StringValue(); ns != "test.items" {
+		t.Errorf("ns 应为 test.items, got %s", ns)
+	}
+	if n := entry.Lookup("docsExamined").Int64(); n != 3 {
+		t.Errorf("全表扫描应读取 3 个文档, got %d", n)
+	}
+	if x := entry.Lookup("command", "filter", "x").Int32(); x != 2 {
+		t.Errorf("记录应包含查询的过滤条件: %s", entry)
+	}
+	if _, err := entry.LookupErr("millis"); err != nil {
+		t.Errorf("记录应包含耗时: %s", entry)
+	}
+
+	// 关闭分析后不再记录
+	profile(0, 0)
+	findItems()
+	if entries := profileEntries(); len(entries) != 1 {
+		t.Errorf("关闭分析后不应新增记录, got %d", len(entries))
+	}
+
+	reply = run(bsoncore.NewDocumentBuilder().AppendInt32("profile", 3).AppendString("$db", "test").Build())
+	if reply.Lookup("ok").Double() != 0 || reply.Lookup("code").Int32() != int32(CodeBadValue) {
+		t.Errorf("无效的分析级别应返回 BadValue: %s", reply)
+	}
+}
+
+// TestProfilerRedaction 测试写入 system.profile 的命令文档隐藏了密码等敏感字段
+func TestProfilerRedaction(t *testing.T) {
+	defer func() {
+		profiler.mu.Lock()
+		profiler.levels = make(map[string]int)
+		profiler.slowMs = defaultSlowMs
+		profiler.mu.Unlock()
+	}()
+	registerCommand("createUser", ActionNone, func(l *EventListener, ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+		return bsoncore.NewDocumentBuilder(), nil
+	})
+	defer delete(commandRegistry, "createUser")
+
+	listener := newTestListener(t, &config.Config{})
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, cmd)))
+	}
+	run(bsoncore.NewDocumentBuilder().AppendInt32("profile", 2).AppendString("$db", "admin").Build())
+	run(bsoncore.NewDocumentBuilder().
+		AppendString("createUser", "alice").
+		AppendString("pwd", "s3cret-password").
+		AppendString("$db", "admin").
+		Build())
+
+	filter := bsoncore.NewDocumentBuilder().AppendString("command.createUser", "alice").Build()
+	reply := run(bsoncore.NewDocumentBuilder().
+		AppendString("find", "system.profile").AppendDocument("filter", filter).AppendString("$db", "admin").Build())
+	_, entries := cursorBatch(t, reply, "firstBatch")
+	if len(entries) != 1 {
+		t.Fatalf("createUser 应被记录一次, got %v", entries)
+	}
+	if pwd := entries[0].Lookup("command", "pwd").StringValue(); pwd != redactedValue {
+		t.Errorf("system.profile 中的密码应被隐藏: %s", entries[0])
+	}
+}
@@ -0,0 +1,385 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("find", ActionFind, (*EventListener).cmdFind)
+	registerCommand("count", ActionFind, (*EventListener).cmdCount)
+	registerCommand("distinct", ActionFind, (*EventListener).cmdDistinct)
+}
+
+// findQuery find 和 count 命令的查询参数
+type findQuery struct {
+	filter      storage.Document
+	projection  storage.Document
+	sort        storage.Document
+	skip        int64
+	limit       int64         // 0 表示不限制
+	singleBatch bool          // 只返回一批结果，不创建游标
+	hint        *storage.Hint // 强制使用的索引，nil 时由查询计划器选择
+}
+
+// filterArgument 读取可选的过滤条件参数，缺省时返回空过滤条件
+func filterArgument(req *commandRequest, name string) (storage.Document, error) {
+	v, err := req.body.LookupErr(name)
+	if err != nil || v.Type == bsoncore.TypeNull {
+		return storage.Document{}, nil
+	}
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s.%s' is the wrong type '%s', expected type 'object'", req.name, name, v.Type)
+	}
+	filter, err := storage.UnmarshalDocument(doc)
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	return filter, nil
+}
+
+// int64Argument 读取可选的非负整数参数，缺省时返回 0
+func int64Argument(req *commandRequest, name string) (int64, error) {
+	v, err := req.body.LookupErr(name)
+	if err != nil || v.Type == bsoncore.TypeNull {
+		return 0, nil
+	}
+	n, ok := v.AsInt64OK()
+	if !ok {
+		return 0, NewCommandError(CodeTypeMismatch, "BSON field '%s.%s' is the wrong type '%s', expected a number", req.name, name, v.Type)
+	}
+	return n, nil
+}
+
+// hintArgument 读取可选的 hint 参数：索引名字符串、索引键模式文档或 {$natural: 1}
+func hintArgument(req *commandRequest) (*storage.Hint, error) {
+	v, err := req.body.LookupErr("hint")
+	if err != nil || v.Type == bsoncore.TypeNull {
+		return nil, nil
+	}
+	if name, ok := v.StringValueOK(); ok {
+		if name == "" {
+			return nil, NewCommandError(CodeBadValue, "hint must be a non-empty index name")
+		}
+		return &storage.Hint{IndexName: name}, nil
+	}
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s.hint' is the wrong type '%s', expected types '[string, object]'", req.name, v.Type)
+	}
+	elems, err := doc.Elements()
+	if err != nil || len(elems) == 0 {
+		// 空文档与不指定 hint 相同
+		return nil, nil
+	}
+	hint := &storage.Hint{}
+	if elems[0].Key() == "$natural" {
+		if len(elems) != 1 || !elems[0].Value().IsNumber() {
+			return nil, NewCommandError(CodeBadValue, "$natural hint must be {$natural: 1} or {$natural: -1}")
+		}
+		hint.Natural = true
+		return hint, nil
+	}
+	for _, elem := range elems {
+		v := elem.Value()
+		key := storage.IndexKey{Field: elem.Key(), Direction: 1}
+		if plugin, ok := v.StringValueOK(); ok {
+			key.Type = plugin
+			hint.Keys = append(hint.Keys, key)
+			continue
+		}
+		direction, isDouble := v.DoubleOK()
+		if !isDouble {
+			n, _ := v.AsInt64OK()
+			direction = float64(n)
+		}
+		if !v.IsNumber() || direction == 0 {
+			return nil, NewCommandError(CodeBadValue, "Values in the hint key pattern can only be numbers or index plugin names: %s", doc)
+		}
+		if direction < 0 {
+			key.Direction = -1
+		}
+		hint.Keys = append(hint.Keys, key)
+	}
+	return hint, nil
+}
+
+// indexBoundArgument 读取可选的 min/max 参数，按文档中的字段顺序返回各字段的取值
+func indexBoundArgument(req *commandRequest, name string) ([]storage.IndexKeyValue, error) {
+	v, err := req.body.LookupErr(name)
+	if err != nil || v.Type == bsoncore.TypeNull {
+		return nil, nil
+	}
+	raw, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s.%s' is the wrong type '%s', expected type 'object'", req.name, name, v.Type)
+	}
+	doc, err := storage.UnmarshalDocument(raw)
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	elems, err := raw.Elements()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	values := make([]storage.IndexKeyValue, 0, len(elems))
+	for _, elem := range elems {
+		values = append(values, storage.IndexKeyValue{Field: elem.Key(), Value: doc[elem.Key()]})
+	}
+	return values, nil
+}
+
+// parseFindQuery 解析 find 命令的查询参数
+func parseFindQuery(req *commandRequest) (*findQuery, error) {
+	q := &findQuery{}
+	var err error
+	if q.filter, err = filterArgument(req, "filter"); err != nil {
+		return nil, err
+	}
+	if q.projection, err = filterArgument(req, "projection"); err != nil {
+		return nil, err
+	}
+	if q.sort, err = filterArgument(req, "sort"); err != nil {
+		return nil, err
+	}
+	if q.skip, err = int64Argument(req, "skip"); err != nil {
+		return nil, err
+	}
+	if q.skip < 0 {
+		return nil, NewCommandError(CodeBadValue, "skip value must be non-negative, but received: %d", q.skip)
+	}
+	if q.limit, err = int64Argument(req, "limit"); err != nil {
+		return nil, err
+	}
+	// 负数 limit 沿用旧协议语义：只返回一批结果
+	if q.limit < 0 {
+		q.limit, q.singleBatch = -q.limit, true
+	}
+	if v, err := req.body.LookupErr("singleBatch"); err == nil {
+		if single, ok := v.BooleanOK(); ok && single {
+			q.singleBatch = true
+		}
+	}
+	if q.hint, err = hintArgument(req); err != nil {
+		return nil, err
+	}
+	// min/max 限定索引扫描范围，没有 hint 时使用字段一致的索引
+	minKey, err := indexBoundArgument(req, "min")
+	if err != nil {
+		return nil, err
+	}
+	maxKey, err := indexBoundArgument(req, "max")
+	if err != nil {
+		return nil, err
+	}
+	if len(minKey) > 0 || len(maxKey) > 0 {
+		if q.hint == nil {
+			q.hint = &storage.Hint{}
+		}
+		q.hint.Min, q.hint.Max = minKey, maxKey
+	}
+	return q, nil
+}
+
+// runFind 执行查询，依次应用排序、skip、limit 和投影，指定了 hint 时使用对应的索引或全表扫描
+// $text 查询的排序和投影可以通过 {$meta: "textScore"} 使用相关度得分
+func (l *EventListener) runFind(ctx context.Context, db, coll string, q *findQuery) ([]storage.Document, error) {
+	return storage.FindDocuments(ctx, l.storageEngine, db, coll, q.filter, storage.FindOptions{
+		Sort:       q.sort,
+		Projection: q.projection,
+		Skip:       q.skip,
+		Limit:      q.limit,
+		Hint:       q.hint,
+	})
+}
+
+// cmdFind 处理 find 命令
+func (l *EventListener) cmdFind(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parseFindQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	batchSize, err := batchSizeArgument(req.body, l.defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// 没有排序和相关度得分投影时按需读取结果，否则需要先取得全部结果
+	if len(q.sort) == 0 && len(storage.TextScoreFields(q.projection)) == 0 {
+		cursor, err := l.storageEngine.FindCursor(ctx, req.db, coll, q.filter, q.projection, q.hint)
+		if err != nil {
+			return nil, err
+		}
+		cursor = storage.NewFindResultCursor(cursor, q.filter, storage.FindOptions{
+			Projection: q.projection,
+			Skip:       q.skip,
+			Limit:      q.limit,
+		})
+		return l.openCursor(ctx, req.db+"."+coll, &findSource{cursor: cursor, q: q}, batchSize, false)
+	}
+	docs, err := l.runFind(ctx, req.db, coll, q)
+	if err != nil {
+		return nil, err
+	}
+	if q.singleBatch && batchSize < len(docs) {
+		docs = docs[:batchSize]
+	}
+	return l.openCursor(ctx, req.db+"."+coll, newDocumentSource(docs), batchSize, false)
+}
+
+// findSource 按需读取 find 结果的游标数据来源，skip、limit 和投影由 storage.NewFindResultCursor 应用，与 FindDocuments 相同
+// 每批只持有 batchSize 个文档，另外预读一个文档用于判断结果是否已经取完
+type findSource struct {
+	cursor  storage.DocumentCursor
+	q       *findQuery
+	pending storage.Document // 预读的文档
+	done    bool
+}
+
+func (s *findSource) next(ctx context.Context, n int) ([]bsoncore.Document, error) {
+	var batch []bsoncore.Document
+	for n < 0 || len(batch) < n {
+		doc, err := s.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			break
+		}
+		raw, err := storage.MarshalDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, raw)
+	}
+	if s.q.singleBatch {
+		s.finish()
+		return batch, nil
+	}
+	if !s.done && s.pending == nil {
+		doc, err := s.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.pending = doc
+	}
+	return batch, nil
+}
+
+func (s *findSource) exhausted() bool {
+	return s.done && s.pending == nil
+}
+
+// fetch 返回下一个文档，没有更多结果时返回 nil
+func (s *findSource) fetch(ctx context.Context) (storage.Document, error) {
+	if s.pending != nil {
+		doc := s.pending
+		s.pending = nil
+		return doc, nil
+	}
+	if s.done {
+		return nil, nil
+	}
+	doc, err := s.cursor.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		s.finish()
+		return nil, nil
+	}
+	return doc, nil
+}
+
+// finish 关闭存储游标，之后不再返回文档
+func (s *findSource) finish() {
+	s.done = true
+	s.cursor.Close()
+}
+
+func (s *findSource) close() {
+	if !s.done {
+		s.finish()
+	}
+	s.pending = nil
+}
+
+// cmdCount 处理 count 命令
+func (l *EventListener) cmdCount(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parseCountQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := l.runFind(ctx, req.db, coll, q)
+	if err != nil {
+		return nil, err
+	}
+	return bsoncore.NewDocumentBuilder().AppendInt32("n", int32(len(docs))), nil
+}
+
+// parseCountQuery 解析 count 命令的 query、skip 和 limit 参数
+func parseCountQuery(req *commandRequest) (*findQuery, error) {
+	q := &findQuery{}
+	var err error
+	if q.filter, err = filterArgument(req, "query"); err != nil {
+		return nil, err
+	}
+	if q.skip, err = int64Argument(req, "skip"); err != nil {
+		return nil, err
+	}
+	if q.skip < 0 {
+		return nil, NewCommandError(CodeBadValue, "skip value is negative in count query")
+	}
+	if q.limit, err = int64Argument(req, "limit"); err != nil {
+		return nil, err
+	}
+	// count 的负数 limit 与正数含义相同
+	if q.limit < 0 {
+		q.limit = -q.limit
+	}
+	if q.hint, err = hintArgument(req); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// cmdDistinct 处理 distinct 命令
+func (l *EventListener) cmdDistinct(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	v, err := req.body.LookupErr("key")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'distinct.key' is missing but a required field")
+	}
+	key, ok := v.StringValueOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'distinct.key' is the wrong type '%s', expected type 'string'", v.Type)
+	}
+	filter, err := filterArgument(req, "query")
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := l.storageEngine.Distinct(ctx, req.db, coll, key, filter)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := storage.MarshalDocument(storage.Document{"values": values})
+	if err != nil {
+		return nil, err
+	}
+	return bsoncore.NewDocumentBuilder().AppendArray("values", bsoncore.Document(raw).Lookup("values").Array()), nil
+}
@@ -0,0 +1,702 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestDistinct 测试 distinct 命令
+func TestDistinct(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+
+	docs := []bsoncore.Document{
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("city", "Beijing").AppendInt32("age", 30).
+			AppendArray("tags", bsoncore.NewArrayBuilder().AppendString("a").AppendString("b").Build()).Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendString("city", "Shanghai").AppendDouble("age", 30).
+			AppendArray("tags", bsoncore.NewArrayBuilder().AppendString("b").AppendString("c").Build()).Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 3).AppendString("city", "Beijing").AppendInt32("age", 25).
+			AppendString("tags", "a").Build(),
+		bsoncore.NewDocumentBuilder().AppendInt32("_id", 4).AppendInt32("age", 40).Build(),
+	}
+	if reply := run(1, insertCommandDocument("test", "people", docs...)); reply.Lookup("n").Int32() != 4 {
+		t.Fatalf("插入失败: %s", reply)
+	}
+
+	distinct := func(requestID int32, key string, query bsoncore.Document) []bsoncore.Value {
+		t.Helper()
+		builder := bsoncore.NewDocumentBuilder().AppendString("distinct", "people").AppendString("key", key)
+		if query != nil {
+			builder.AppendDocument("query", query)
+		}
+		reply := run(requestID, builder.AppendString("$db", "test").Build())
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("distinct 失败: %s", reply)
+		}
+		values, err := reply.Lookup("values").Array().Values()
+		if err != nil {
+			t.Fatalf("读取 values 失败: %v", err)
+		}
+		return values
+	}
+	strs := func(values []bsoncore.Value) []string {
+		out := make([]string, len(values))
+		for i, v := range values {
+			out[i] = v.StringValue()
+		}
+		return out
+	}
+
+	t.Run("标量字段", func(t *testing.T) {
+		if got := strs(distinct(2, "city", nil)); len(got) != 2 || got[0] != "Beijing" || got[1] != "Shanghai" {
+			t.Errorf("city = %v, want [Beijing Shanghai]", got)
+		}
+		// int32(30) 与 30.0 视为同一个值
+		if got := distinct(3, "age", nil); len(got) != 3 {
+			t.Errorf("age 应有 3 个不同取值: %v", got)
+		}
+	})
+
+	t.Run("数组字段展开", func(t *testing.T) {
+		if got := strs(distinct(4, "tags", nil)); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+			t.Errorf("tags = %v, want [a b c]", got)
+		}
+	})
+
+	t.Run("查询条件", func(t *testing.T) {
+		query := bsoncore.NewDocumentBuilder().AppendString("city", "Beijing").Build()
+		got := distinct(5, "age", query)
+		if len(got) != 2 || got[0].AsInt64() != 30 || got[1].AsInt64() != 25 {
+			t.Errorf("age = %v, want [30 25]", got)
+		}
+	})
+
+	t.Run("集合不存在", func(t *testing.T) {
+		reply := run(6, bsoncore.NewDocumentBuilder().AppendString("distinct", "missing").AppendString("key", "a").AppendString("$db", "test").Build())
+		if values, _ := reply.Lookup("values").Array().Values(); reply.Lookup("ok").Double() != 1 || len(values) != 0 {
+			t.Errorf("不存在的集合应返回空数组: %s", reply)
+		}
+	})
+}
+
+// TestFind 测试 find 和 count 命令
+func TestFind(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+
+	docs := make([]bsoncore.Document, 0, 5)
+	for i := int32(1); i <= 5; i++ {
+		docs = append(docs, bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendInt32("score", i*10).AppendBoolean("even", i%2 == 0).Build())
+	}
+	if reply := run(1, insertCommandDocument("test", "scores", docs...)); reply.Lookup("n").Int32() != 5 {
+		t.Fatalf("插入失败: %s", reply)
+	}
+
+	t.Run("排序、跳过、限制和投影", func(t *testing.T) {
+		cmd := bsoncore.NewDocumentBuilder().
+			AppendString("find", "scores").
+			AppendDocument("sort", bsoncore.NewDocumentBuilder().AppendInt32("score", -1).Build()).
+			AppendDocument("projection", bsoncore.NewDocumentBuilder().AppendInt32("score", 1).Build()).
+			AppendInt32("skip", 1).
+			AppendInt32("limit", 3).
+			AppendString("$db", "test").
+			Build()
+		id, batch := cursorBatch(t, run(2, cmd), "firstBatch")
+		if id != 0 || len(batch) != 3 {
+			t.Fatalf("应返回 3 个文档且不创建游标: id=%d, %d 个文档", id, len(batch))
+		}
+		for i, want := range []int32{40, 30, 20} {
+			if got := batch[i].Lookup("score").Int32(); got != want {
+				t.Errorf("第 %d 个文档 score = %d, want %d", i, got, want)
+			}
+			if _, err := batch[i].LookupErr("even"); err == nil {
+				t.Errorf("投影后不应包含 even 字段: %s", batch[i])
+			}
+		}
+	})
+
+	t.Run("分批返回", func(t *testing.T) {
+		cmd := bsoncore.NewDocumentBuilder().AppendString("find", "scores").AppendInt32("batchSize", 2).AppendString("$db", "test").Build()
+		id, batch := cursorBatch(t, run(3, cmd), "firstBatch")
+		if id == 0 || len(batch) != 2 {
+			t.Fatalf("首批应返回 2 个文档并创建游标: id=%d, %d 个文档", id, len(batch))
+		}
+		id, batch = cursorBatch(t, run(4, getMoreCommandDocument("test", "scores", id, 0)), "nextBatch")
+		if id != 0 || len(batch) != 3 {
+			t.Errorf("getMore 应返回剩余 3 个文档并关闭游标: id=%d, %d 个文档", id, len(batch))
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		query := bsoncore.NewDocumentBuilder().AppendBoolean("even", false).Build()
+		cmd := bsoncore.NewDocumentBuilder().AppendString("count", "scores").AppendDocument("query", query).AppendString("$db", "test").Build()
+		if reply := run(5, cmd); reply.Lookup("ok").Double() != 1 || reply.Lookup("n").Int32() != 3 {
+			t.Errorf("count 应返回 3: %s", reply)
+		}
+		cmd = bsoncore.NewDocumentBuilder().AppendString("count", "scores").AppendInt32("skip", 4).AppendInt32("limit", 2).AppendString("$db", "test").Build()
+		if reply := run(6, cmd); reply.Lookup("n").Int32() != 1 {
+			t.Errorf("skip 4 后应只剩 1 个文档: %s", reply)
+		}
+	})
+}
+
+// TestFindHint 测试 find 的 hint 参数强制使用指定索引或全表扫描
+func TestFindHint(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+
+	docs := make([]bsoncore.Document, 0, 6)
+	for i := int32(1); i <= 6; i++ {
+		docs = append(docs, bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendInt32("a", i%3).Build())
+	}
+	run(1, insertCommandDocument("test", "items", docs...))
+	run(2, createIndexesCommandDocument("test", "items",
+		bsoncore.NewDocumentBuilder().
+			StartDocument("key").AppendInt32("a", 1).FinishDocument().
+			AppendString("name", "a_1").
+			Build()))
+
+	find := bsoncore.NewDocumentBuilder().
+		AppendString("find", "items").
+		AppendDocument("filter", bsoncore.NewDocumentBuilder().AppendInt32("a", 1).Build()).
+		Build()
+	withHint := func(hint func(*bsoncore.DocumentBuilder)) bsoncore.Document {
+		return appendFields(t, find, hint)
+	}
+	withDB := func(cmd bsoncore.Document) bsoncore.Document {
+		return appendFields(t, cmd, func(b *bsoncore.DocumentBuilder) { b.AppendString("$db", "test") })
+	}
+	byName := withHint(func(b *bsoncore.DocumentBuilder) { b.AppendString("hint", "a_1") })
+	byKeys := withHint(func(b *bsoncore.DocumentBuilder) {
+		b.AppendDocument("hint", bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).Build())
+	})
+	natural := withHint(func(b *bsoncore.DocumentBuilder) {
+		b.AppendDocument("hint", bsoncore.NewDocumentBuilder().AppendInt32("$natural", 1).Build())
+	})
+
+	cases := []struct {
+		name      string
+		cmd       bsoncore.Document
+		stage     string
+		indexName string
+	}{
+		{"按索引名", byName, "IXSCAN", "a_1"},
+		{"按键模式", byKeys, "IXSCAN", "_id_"},
+		{"$natural", natural, "COLLSCAN", ""},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reply := run(int32(10+i*2), withDB(c.cmd))
+			if _, batch := cursorBatch(t, reply, "firstBatch"); len(batch) != 2 {
+				t.Errorf("应返回 2 个文档, got %d: %s", len(batch), reply)
+			}
+			reply = run(int32(11+i*2), explainCommandDocument("test", c.cmd, "queryPlanner"))
+			plan := reply.Lookup("queryPlanner", "winningPlan").Document()
+			if c.stage == "IXSCAN" {
+				plan = plan.Lookup("inputStage").Document()
+			}
+			if plan.Lookup("stage").StringValue() != c.stage {
+				t.Fatalf("计划应为 %s: %s", c.stage, reply)
+			}
+			if c.indexName != "" && plan.Lookup("indexName").StringValue() != c.indexName {
+				t.Errorf("应使用索引 %s: %s", c.indexName, plan)
+			}
+		})
+	}
+
+	missing := withHint(func(b *bsoncore.DocumentBuilder) { b.AppendString("hint", "b_1") })
+	if code := run(20, withDB(missing)).Lookup("code").Int32(); code != int32(CodeBadValue) {
+		t.Errorf("不存在的索引应返回 BadValue, got %d", code)
+	}
+	wrongType := withHint(func(b *bsoncore.DocumentBuilder) { b.AppendInt32("hint", 1) })
+	if code := run(21, withDB(wrongType)).Lookup("code").Int32(); code != int32(CodeTypeMismatch) {
+		t.Errorf("hint 类型错误应返回 TypeMismatch, got %d", code)
+	}
+}
+
+// TestFindMinMax 测试 find 的 min/max 参数限定索引扫描范围
+func TestFindMinMax(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+
+	docs := make([]bsoncore.Document, 0, 10)
+	for i := int32(0); i < 10; i++ {
+		docs = append(docs, bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendInt32("score", i*10).Build())
+	}
+	run(1, insertCommandDocument("test", "scores", docs...))
+	run(2, createIndexesCommandDocument("test", "scores",
+		bsoncore.NewDocumentBuilder().
+			StartDocument("key").AppendInt32("score", 1).FinishDocument().
+			AppendString("name", "score_1").
+			Build()))
+
+	bound := func(value int32) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("score", value).Build()
+	}
+	cmd := bsoncore.NewDocumentBuilder().
+		AppendString("find", "scores").
+		AppendString("hint", "score_1").
+		AppendDocument("min", bound(30)).
+		AppendDocument("max", bound(70)).
+		AppendDocument("sort", bsoncore.NewDocumentBuilder().AppendInt32("score", 1).Build()).
+		AppendString("$db", "test").
+		Build()
+	_, batch := cursorBatch(t, run(3, cmd), "firstBatch")
+	if len(batch) != 4 {
+		t.Fatalf("应返回 score 在 [30, 70) 内的 4 个文档, got %d", len(batch))
+	}
+	for i, want := range []int32{30, 40, 50, 60} {
+		if got := batch[i].Lookup("score").Int32(); got != want {
+			t.Errorf("第 %d 个文档 score = %d, want %d", i, got, want)
+		}
+	}
+
+	// 没有 hint 时使用键模式与 min/max 一致的索引
+	cmd = bsoncore.NewDocumentBuilder().
+		AppendString("find", "scores").
+		AppendDocument("min", bound(80)).
+		AppendString("$db", "test").
+		Build()
+	if _, batch := cursorBatch(t, run(4, cmd), "firstBatch"); len(batch) != 2 {
+		t.Errorf("应返回 score >= 80 的 2 个文档, got %d", len(batch))
+	}
+
+	mismatched := bsoncore.NewDocumentBuilder().
+		AppendString("find", "scores").
+		AppendString("hint", "_id_").
+		AppendDocument("min", bound(30)).
+		AppendString("$db", "test").
+		Build()
+	if code := run(5, mismatched).Lookup("code").Int32(); code != int32(CodeBadValue) {
+		t.Errorf("min 与索引键模式不一致应返回 BadValue, got %d", code)
+	}
+}
+
+// TestMaxTimeMS 测试超过 maxTimeMS 的查询中止并返回 MaxTimeMSExpired
+func TestMaxTimeMS(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+
+	const n = 20000
+	docs := make([]storage.Document, 0, n)
+	for i := 0; i < n; i++ {
+		docs = append(docs, storage.Document{"_id": int32(i), "name": fmt.Sprintf("item-%d", i)})
+	}
+	if err := listener.storageEngine.Insert(context.Background(), "test", "large", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	find := func(maxTimeMS int32, filter bsoncore.Document) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().
+			AppendString("find", "large").
+			AppendDocument("filter", filter).
+			AppendInt32("maxTimeMS", maxTimeMS).
+			AppendString("$db", "test").
+			Build()
+	}
+	noMatch := bsoncore.NewDocumentBuilder().AppendRegex("name", "^none", "").Build()
+
+	reply := run(1, find(1, noMatch))
+	if reply.Lookup("ok").Double() != 0 || reply.Lookup("code").Int32() != int32(CodeMaxTimeMSExpired) {
+		t.Fatalf("全表扫描超时应返回 MaxTimeMSExpired: %s", reply)
+	}
+	if name := reply.Lookup("codeName").StringValue(); name != "MaxTimeMSExpired" {
+		t.Errorf("codeName 应为 MaxTimeMSExpired, got %s", name)
+	}
+
+	// 通过 _id 索引的点查询在时限内完成
+	byId := bsoncore.NewDocumentBuilder().AppendInt32("_id", 42).Build()
+	if _, docs := cursorBatch(t, run(2, find(10000, byId)), "firstBatch"); len(docs) != 1 {
+		t.Errorf("时限内的查询应返回 1 个文档, got %d", len(docs))
+	}
+
+	reply = run(3, find(-1, byId))
+	if reply.Lookup("ok").Double() != 0 || reply.Lookup("code").Int32() != int32(CodeBadValue) {
+		t.Errorf("负数 maxTimeMS 应返回 BadValue: %s", reply)
+	}
+}
+
+// insertLargeCollection 向 test.large 插入 n 个文档
+func insertLargeCollection(t testing.TB, listener *EventListener, n int) {
+	t.Helper()
+	docs := make([]storage.Document, 0, n)
+	for i := 0; i < n; i++ {
+		docs = append(docs, storage.Document{"_id": int32(i), "name": fmt.Sprintf("item-%d", i), "padding": strings.Repeat("x", 200)})
+	}
+	if err := listener.storageEngine.Insert(context.Background(), "test", "large", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+}
+
+// findBatchCommand 构造 {find: "large", batchSize: batchSize} 并追加 fields 中的参数
+func findBatchCommand(batchSize int32, fields func(b *bsoncore.DocumentBuilder)) bsoncore.Document {
+	b := bsoncore.NewDocumentBuilder().
+		AppendString("find", "large").
+		AppendInt32("batchSize", batchSize)
+	if fields != nil {
+		fields(b)
+	}
+	return b.AppendString("$db", "test").Build()
+}
+
+// TestExhaustCursor 测试设置了 exhaustAllowed 的 find 由服务端连续发送后续批次
+func TestExhaustCursor(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	insertLargeCollection(t, listener, 500)
+
+	session := newFakeSession()
+	request := newOpMsgMessage(7, findBatchCommand(100, nil))
+	binary.LittleEndian.PutUint32(request.Body, uint32(wiremessage.ExhaustAllowed))
+	listener.OnMessage(session, request)
+
+	if len(session.written) != 5 {
+		t.Fatalf("500 个文档按每批 100 个应发送 5 个回复, got %d", len(session.written))
+	}
+	responseTo := int32(7)
+	next := int32(0)
+	for i, pkg := range session.written {
+		reply := pkg.(*Message)
+		if reply.Header.ResponseTo != responseTo {
+			t.Errorf("第 %d 个回复的 responseTo = %d, want %d", i, reply.Header.ResponseTo, responseTo)
+		}
+		responseTo = reply.Header.RequestID
+		field := "nextBatch"
+		if i == 0 {
+			field = "firstBatch"
+		}
+		id, docs := cursorBatch(t, replyDocument(t, reply), field)
+		last := i == len(session.written)-1
+		raw, err := reply.Serialize()
+		if err != nil {
+			t.Fatalf("序列化回复失败: %v", err)
+		}
+		if moreToCome := wiremessage.IsMsgMoreToCome(raw); moreToCome == last {
+			t.Errorf("第 %d 个回复的 moreToCome = %v", i, moreToCome)
+		}
+		if (id == 0) != last || len(docs) != 100 {
+			t.Errorf("第 %d 个回复: id %d, %d 个文档", i, id, len(docs))
+		}
+		for _, doc := range docs {
+			if got := doc.Lookup("_id").Int32(); got != next {
+				t.Fatalf("_id 应为 %d, got %d", next, got)
+			}
+			next++
+		}
+	}
+
+	// 没有设置 exhaustAllowed 时只返回首批
+	session = newFakeSession()
+	listener.OnMessage(session, newOpMsgMessage(8, findBatchCommand(100, nil)))
+	if len(session.written) != 1 {
+		t.Errorf("普通 find 应只发送 1 个回复, got %d", len(session.written))
+	}
+}
+
+// TestFindStreaming 测试没有排序的 find 按批读取结果，首批的内存分配与集合大小无关
+func TestFindStreaming(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(requestID int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, doc)))
+	}
+	const n = 20000
+	insertLargeCollection(t, listener, n)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	reply := run(1, findBatchCommand(10, nil))
+	runtime.ReadMemStats(&after)
+	id, docs := cursorBatch(t, reply, "firstBatch")
+	if len(docs) != 10 || id == 0 {
+		t.Fatalf("首批应返回 10 个文档并保留游标: %d 个, id %d", len(docs), id)
+	}
+	// 一次取出全部结果需要为每个文档分配数百字节，按批读取只与 batchSize 和扫描批次有关
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("batchSize 为 10 的 find 分配了 %d 字节", allocated)
+	}
+
+	// getMore 从上一批结束的位置继续读取
+	seen := len(docs)
+	next := int32(10)
+	for id != 0 {
+		getMore := bsoncore.NewDocumentBuilder().
+			AppendInt64("getMore", id).
+			AppendString("collection", "large").
+			AppendInt32("batchSize", 5000).
+			AppendString("$db", "test").
+			Build()
+		id, docs = cursorBatch(t, run(2, getMore), "nextBatch")
+		for _, doc := range docs {
+			if got := doc.Lookup("_id").Int32(); got != next {
+				t.Fatalf("第 %d 个文档的 _id 应为 %d, got %d", seen, next, got)
+			}
+			next++
+		}
+		seen += len(docs)
+	}
+	if seen != n {
+		t.Errorf("应读取 %d 个文档, got %d", n, seen)
+	}
+
+	// skip、limit 和投影在读取时应用，结果取完后不保留游标
+	reply = run(3, findBatchCommand(10, func(b *bsoncore.DocumentBuilder) {
+		b.AppendInt64("skip", 100).
+			AppendInt64("limit", 10).
+			AppendDocument("projection", bsoncore.NewDocumentBuilder().AppendInt32("name", 1).Build())
+	}))
+	id, docs = cursorBatch(t, reply, "firstBatch")
+	if id != 0 || len(docs) != 10 {
+		t.Fatalf("limit 等于 batchSize 时应在首批返回全部结果: %d 个, id %d", len(docs), id)
+	}
+	if docs[0].Lookup("_id").Int32() != 100 || docs[0].Lookup("name").StringValue() != "item-100" {
+		t.Errorf("skip 后的首个文档不正确: %s", docs[0])
+	}
+	if _, err := docs[0].LookupErr("padding"); err == nil {
+		t.Errorf("投影应去掉 padding: %s", docs[0])
+	}
+
+	// singleBatch 只返回一批
+	reply = run(4, findBatchCommand(10, func(b *bsoncore.DocumentBuilder) { b.AppendBoolean("singleBatch", true) }))
+	if id, docs = cursorBatch(t, reply, "firstBatch"); id != 0 || len(docs) != 10 {
+		t.Errorf("singleBatch 应返回 10 个文档且不保留游标: %d 个, id %d", len(docs), id)
+	}
+}
+
+// TestCursorLimits 测试打开的游标数达到上限后拒绝新游标，关闭或取完游标后释放名额
+func TestCursorLimits(t *testing.T) {
+	cfg := &config.Config{}
+	listener := newTestListener(t, cfg)
+	insertLargeCollection(t, listener, 20)
+	requestID := int32(0)
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+	find := func(lsid []byte) bsoncore.Document {
+		return findBatchCommand(2, func(b *bsoncore.DocumentBuilder) {
+			if lsid != nil {
+				b.StartDocument("lsid").AppendBinary("id", 4, lsid).FinishDocument()
+			}
+		})
+	}
+	openCursors := func(lsid []byte, n int) []int64 {
+		t.Helper()
+		ids := make([]int64, n)
+		for i := range ids {
+			id, _ := cursorBatch(t, run(find(lsid)), "firstBatch")
+			if id == 0 {
+				t.Fatalf("第 %d 个游标应未取完", i+1)
+			}
+			ids[i] = id
+		}
+		return ids
+	}
+	expectRefused := func(cmd bsoncore.Document) {
+		t.Helper()
+		if reply := run(cmd); reply.Lookup("code").Int32() != int32(CodeCursorInUse) {
+			t.Errorf("达到上限后应拒绝新游标: %s", reply)
+		}
+	}
+	killCursors := func(ids ...int64) {
+		t.Helper()
+		arr := bsoncore.NewArrayBuilder()
+		for _, id := range ids {
+			arr.AppendInt64(id)
+		}
+		cmd := bsoncore.NewDocumentBuilder().
+			AppendString("killCursors", "large").
+			AppendArray("cursors", arr.Build()).
+			AppendString("$db", "test").
+			Build()
+		if killed, _ := run(cmd).Lookup("cursorsKilled").Array().Values(); len(killed) != len(ids) {
+			t.Fatalf("killCursors 应关闭 %d 个游标: %v", len(ids), killed)
+		}
+	}
+
+	t.Run("全局上限", func(t *testing.T) {
+		// 注册表由所有监听器共享，上限在已有游标数的基础上再允许 3 个
+		cursors.mu.Lock()
+		existing := len(cursors.cursors)
+		cursors.mu.Unlock()
+		listener.cursorLimits = cursorLimits{global: existing + 3}
+
+		ids := openCursors(nil, 3)
+		expectRefused(find(nil))
+		// 未能注册的数据来源被关闭，不泄漏存储游标
+		source := &closeRecordingSource{documentSource: newDocumentSource([]storage.Document{{"_id": int32(1)}, {"_id": int32(2)}})}
+		if _, err := listener.openCursor(context.Background(), "test.large", source, 1, false); err == nil || !source.closed {
+			t.Errorf("达到上限时应关闭数据来源: closed %v, %v", source.closed, err)
+		}
+
+		// 首批即取完的结果不需要游标
+		if id, docs := cursorBatch(t, run(findBatchCommand(50, nil)), "firstBatch"); id != 0 || len(docs) != 20 {
+			t.Errorf("取完的结果不受上限限制: %d 个, id %d", len(docs), id)
+		}
+
+		killCursors(ids[0])
+		ids[0] = openCursors(nil, 1)[0]
+
+		// getMore 取完的游标同样释放名额
+		if reply := run(getMoreCommandDocument("test", "large", ids[1], 0)); reply.Lookup("cursor", "id").Int64() != 0 {
+			t.Fatalf("getMore 应取完游标: %s", reply)
+		}
+		ids[1] = openCursors(nil, 1)[0]
+		killCursors(ids...)
+	})
+
+	t.Run("每个逻辑会话的上限", func(t *testing.T) {
+		listener.cursorLimits = cursorLimits{perSession: 2}
+		first, second := uuid.New(), uuid.New()
+
+		ids := openCursors(first[:], 2)
+		expectRefused(find(first[:]))
+		others := openCursors(second[:], 2)
+		// 没有 lsid 的游标不受每个会话的上限限制
+		others = append(others, openCursors(nil, 3)...)
+
+		killCursors(ids[1])
+		ids[1] = openCursors(first[:], 1)[0]
+		killCursors(append(ids, others...)...)
+	})
+}
+
+// closeRecordingSource 记录是否被关闭的数据来源
+type closeRecordingSource struct {
+	*documentSource
+	closed bool
+}
+
+func (s *closeRecordingSource) close() {
+	s.closed = true
+}
+
+// TestCursorCloseSource 测试游标被 killCursors 关闭或空闲超时回收时关闭数据来源
+func TestCursorCloseSource(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	// 首批只返回 1 个文档，游标保留在注册表中
+	open := func() (*closeRecordingSource, int64) {
+		t.Helper()
+		source := &closeRecordingSource{documentSource: newDocumentSource([]storage.Document{{"_id": int32(1)}, {"_id": int32(2)}})}
+		result, err := listener.openCursor(context.Background(), "test.items", source, 1, false)
+		if err != nil {
+			t.Fatalf("打开游标失败: %v", err)
+		}
+		id := result.Build().Lookup("cursor", "id").Int64()
+		if id == 0 || source.closed {
+			t.Fatalf("游标应保留且数据来源未关闭: id %d", id)
+		}
+		return source, id
+	}
+
+	t.Run("killCursors", func(t *testing.T) {
+		source, id := open()
+		cmd := bsoncore.NewDocumentBuilder().
+			AppendString("killCursors", "items").
+			AppendArray("cursors", bsoncore.NewArrayBuilder().AppendInt64(id).Build()).
+			AppendString("$db", "test").
+			Build()
+		reply := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, cmd)))
+		if killed, _ := reply.Lookup("cursorsKilled").Array().Values(); len(killed) != 1 {
+			t.Fatalf("killCursors 应关闭游标: %s", reply)
+		}
+		if !source.closed {
+			t.Errorf("killCursors 应关闭数据来源")
+		}
+	})
+
+	t.Run("空闲回收", func(t *testing.T) {
+		source, id := open()
+		cursors.mu.Lock()
+		cursors.cursors[id].lastUsed = time.Now().Add(-time.Hour)
+		cursors.mu.Unlock()
+		if n := cursors.reapIdle(time.Now(), time.Minute); n != 1 {
+			t.Fatalf("应回收 1 个空闲游标, got %d", n)
+		}
+		if !source.closed {
+			t.Errorf("回收空闲游标时应关闭数据来源")
+		}
+	})
+}
+
+// TestCursorDefaults 测试未指定 batchSize 时使用配置的首批大小，空闲超时的游标被回收
+func TestCursorDefaults(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.CursorDefaultBatchSize = 7
+	cfg.Server.CursorTimeoutMS = 1000
+	listener := newTestListener(t, cfg)
+	insertLargeCollection(t, listener, 20)
+	requestID := int32(0)
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+
+	find := bsoncore.NewDocumentBuilder().AppendString("find", "large").AppendString("$db", "test").Build()
+	idle, docs := cursorBatch(t, run(find), "firstBatch")
+	if idle == 0 || len(docs) != 7 {
+		t.Fatalf("find 首批应返回 7 个文档并保留游标: %d 个, id %d", len(docs), idle)
+	}
+	aggregate := aggregateCommandDocument("test", "large")
+	if _, docs := cursorBatch(t, run(aggregate), "firstBatch"); len(docs) != 7 {
+		t.Errorf("aggregate 首批应返回 7 个文档: %d 个", len(docs))
+	}
+	if _, docs := cursorBatch(t, run(findBatchCommand(3, nil)), "firstBatch"); len(docs) != 3 {
+		t.Errorf("指定的 batchSize 优先于默认值: %d 个", len(docs))
+	}
+
+	// 将游标的最近使用时间提前到超时之前，定时任务应回收该游标而保留刚使用过的游标
+	active, _ := cursorBatch(t, run(find), "firstBatch")
+	cursors.mu.Lock()
+	cursors.cursors[idle].lastUsed = time.Now().Add(-2 * time.Second)
+	cursors.mu.Unlock()
+	listener.OnCron(newFakeSession())
+
+	if reply := run(getMoreCommandDocument("test", "large", idle, 0)); reply.Lookup("code").Int32() != int32(CodeCursorNotFound) {
+		t.Errorf("空闲超时的游标应被回收: %s", reply)
+	}
+	if reply := run(getMoreCommandDocument("test", "large", active, 0)); reply.Lookup("ok").Double() != 1 {
+		t.Errorf("未超时的游标不应被回收: %s", reply)
+	}
+}
+
+// BenchmarkFindBatch 测量大集合上 batchSize 为 10 的 find 的内存分配
+func BenchmarkFindBatch(b *testing.B) {
+	listener := newTestListener(b, &config.Config{})
+	insertLargeCollection(b, listener, 100000)
+	find := findBatchCommand(10, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reply := replyDocument(b, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, find)))
+		cursors.remove(reply.Lookup("cursor", "id").Int64())
+	}
+}
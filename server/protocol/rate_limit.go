@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/zhukovaskychina/xmongodb/config"
+)
+
+// tokenBucket 令牌桶，每秒补充 rate 个令牌，最多累积 burst 个
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket 创建装满令牌的令牌桶，容量与每秒补充的数量相同
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(rate), tokens: float64(rate), last: now}
+}
+
+// refill 按距上次补充经过的时间补充令牌
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// RateLimiter 命令限流器，分别限制每个连接和所有连接合计每秒执行的命令数
+// 握手、心跳等不需要权限的命令不受限制，以免客户端在过载时无法完成连接监控；
+// 每个连接有各自的 EventListener，服务器只创建一个限流器并传给所有连接的监听器，全局限制才能覆盖全部连接
+type RateLimiter struct {
+	mu            sync.Mutex
+	perConnection int // 每个连接每秒允许的命令数，0 表示不限制
+	global        *tokenBucket
+	connections   map[getty.Session]*tokenBucket
+	now           func() time.Time
+}
+
+// NewRateLimiter 按网络配置创建限流器，未开启或两个限制均为 0 时返回 nil
+func NewRateLimiter(cfg config.NetworkConfig) *RateLimiter {
+	if !cfg.RateLimitEnabled || (cfg.RateLimitPerConnection <= 0 && cfg.RateLimitGlobal <= 0) {
+		return nil
+	}
+	l := &RateLimiter{
+		connections: make(map[getty.Session]*tokenBucket),
+		now:         time.Now,
+	}
+	if cfg.RateLimitPerConnection > 0 {
+		l.perConnection = cfg.RateLimitPerConnection
+	}
+	if cfg.RateLimitGlobal > 0 {
+		l.global = newTokenBucket(cfg.RateLimitGlobal, l.now())
+	}
+	return l
+}
+
+// allow 为一次命令执行消耗令牌，连接或全局的令牌不足时返回带 RetryableError 标签的错误
+// 只有两个令牌桶都有令牌时才消耗，被拒绝的命令不占用额度
+func (l *RateLimiter) allow(session getty.Session, spec *commandSpec) error {
+	if l == nil || spec.action == ActionNone {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var conn *tokenBucket
+	if l.perConnection > 0 && session != nil {
+		conn = l.connections[session]
+		if conn == nil {
+			conn = newTokenBucket(l.perConnection, now)
+			l.connections[session] = conn
+		}
+		conn.refill(now)
+		if conn.tokens < 1 {
+			return rateLimitError("connection", l.perConnection)
+		}
+	}
+	if l.global != nil {
+		l.global.refill(now)
+		if l.global.tokens < 1 {
+			return rateLimitError("server", int(l.global.rate))
+		}
+		l.global.tokens--
+	}
+	if conn != nil {
+		conn.tokens--
+	}
+	return nil
+}
+
+// release 连接关闭时释放其令牌桶
+func (l *RateLimiter) release(session getty.Session) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.connections, session)
+	l.mu.Unlock()
+}
+
+// rateLimitError 超出限流时返回的错误，驱动可以按标签退避后重试
+func rateLimitError(scope string, limit int) *CommandError {
+	err := NewCommandError(CodeRateLimitExceeded, "%s request rate limit of %d commands per second exceeded", scope, limit)
+	err.Labels = []string{labelSystemOverloadedError, labelRetryableError}
+	return err
+}
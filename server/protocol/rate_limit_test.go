@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// newRateLimitedListener 创建开启限流的监听器，限流器使用可手动推进的时钟
+func newRateLimitedListener(t *testing.T, perConnection, global int) (*EventListener, *time.Time) {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Network.RateLimitEnabled = true
+	cfg.Network.RateLimitPerConnection = perConnection
+	cfg.Network.RateLimitGlobal = global
+	listener := newTestListener(t, cfg)
+	clock := time.Now()
+	listener.rateLimiter.now = func() time.Time { return clock }
+	return listener, &clock
+}
+
+// runCounts 在会话上执行 n 次 count 命令，返回成功和被限流的次数
+func runCounts(t *testing.T, listener *EventListener, session *fakeSession, n int) (passed, throttled int) {
+	t.Helper()
+	cmd := bsoncore.NewDocumentBuilder().AppendString("count", "c").AppendString("$db", "test").Build()
+	for i := 0; i < n; i++ {
+		reply := replyDocument(t, listener.handleMessage(session, newOpMsgMessage(int32(i+1), cmd)))
+		if reply.Lookup("ok").Double() == 1 {
+			passed++
+			continue
+		}
+		if reply.Lookup("code").Int32() != int32(CodeRateLimitExceeded) {
+			t.Fatalf("count 失败: %s", reply)
+		}
+		labels, err := reply.Lookup("errorLabels").Array().Values()
+		if err != nil || len(labels) != 2 || labels[1].StringValue() != labelRetryableError {
+			t.Fatalf("限流错误应带有 RetryableError 标签: %s", reply)
+		}
+		throttled++
+	}
+	return passed, throttled
+}
+
+// TestRateLimitDisabledByDefault 测试未开启限流时不创建限流器
+func TestRateLimitDisabledByDefault(t *testing.T) {
+	if limiter := NewRateLimiter(config.NetworkConfig{RateLimitPerConnection: 1, RateLimitGlobal: 1}); limiter != nil {
+		t.Error("未开启 rate_limit_enabled 时不应限流")
+	}
+	listener := newTestListener(t, &config.Config{})
+	if passed, throttled := runCounts(t, listener, newFakeSession(), 50); passed != 50 || throttled != 0 {
+		t.Errorf("未开启限流时所有命令都应成功: 成功 %d, 限流 %d", passed, throttled)
+	}
+}
+
+// TestRateLimitPerConnection 测试超过每连接限制的命令被限流，令牌随时间补充，不需要权限的命令不受限制
+func TestRateLimitPerConnection(t *testing.T) {
+	listener, clock := newRateLimitedListener(t, 5, 0)
+	session := newFakeSession()
+
+	if passed, throttled := runCounts(t, listener, session, 20); passed != 5 || throttled != 15 {
+		t.Errorf("同一时刻 20 个命令应有 5 个成功: 成功 %d, 限流 %d", passed, throttled)
+	}
+	ping := bsoncore.NewDocumentBuilder().AppendInt32("ping", 1).AppendString("$db", "admin").Build()
+	if reply := replyDocument(t, listener.handleMessage(session, newOpMsgMessage(1, ping))); reply.Lookup("ok").Double() != 1 {
+		t.Errorf("ping 不应被限流: %s", reply)
+	}
+	if passed, _ := runCounts(t, listener, newFakeSession(), 5); passed != 5 {
+		t.Errorf("其他连接不受该连接限流的影响: 成功 %d", passed)
+	}
+
+	*clock = clock.Add(time.Second)
+	if passed, throttled := runCounts(t, listener, session, 10); passed != 5 || throttled != 5 {
+		t.Errorf("一秒后应补充 5 个令牌: 成功 %d, 限流 %d", passed, throttled)
+	}
+}
+
+// TestRateLimitUnderLimit 测试请求速率不超过限制时所有命令都成功
+func TestRateLimitUnderLimit(t *testing.T) {
+	listener, clock := newRateLimitedListener(t, 5, 8)
+	session := newFakeSession()
+	for i := 0; i < 40; i++ {
+		*clock = clock.Add(250 * time.Millisecond)
+		if passed, _ := runCounts(t, listener, session, 1); passed != 1 {
+			t.Fatalf("每秒 4 个命令不应被限流, 第 %d 个失败", i+1)
+		}
+	}
+}
+
+// TestRateLimitGlobal 测试所有连接共享全局限制，连接关闭后释放其令牌桶
+// 服务器为每个连接创建各自的监听器，两个连接使用共享同一个限流器的不同监听器
+func TestRateLimitGlobal(t *testing.T) {
+	listener, _ := newRateLimitedListener(t, 4, 6)
+	other := NewEventListener(listener.storageEngine, listener.config, listener.rateLimiter)
+	first, second := newFakeSession(), newFakeSession()
+
+	passed1, _ := runCounts(t, listener, first, 4)
+	passed2, throttled2 := runCounts(t, other, second, 4)
+	if passed1 != 4 || passed2 != 2 || throttled2 != 2 {
+		t.Errorf("全局限制为 6 时第二个连接应只有 2 个成功: %d, %d, 限流 %d", passed1, passed2, throttled2)
+	}
+
+	if n := len(listener.rateLimiter.connections); n != 2 {
+		t.Fatalf("应有 2 个连接的令牌桶, 实际 %d", n)
+	}
+	listener.OnClose(first)
+	other.OnClose(second)
+	if n := len(listener.rateLimiter.connections); n != 0 {
+		t.Errorf("连接关闭后应释放令牌桶, 剩余 %d", n)
+	}
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// 读关注级别
+// 单节点部署中所有已写入的数据都已被多数节点确认，各级别的读取结果相同，只做参数校验
+const (
+	readConcernLocal        = "local"
+	readConcernAvailable    = "available"
+	readConcernMajority     = "majority"
+	readConcernLinearizable = "linearizable"
+	readConcernSnapshot     = "snapshot"
+)
+
+// readPreferenceModes $readPreference 支持的 mode
+var readPreferenceModes = map[string]bool{
+	"primary":            true,
+	"primaryPreferred":   true,
+	"secondary":          true,
+	"secondaryPreferred": true,
+	"nearest":            true,
+}
+
+// readConcern 命令文档中的 readConcern 参数
+type readConcern struct {
+	level string
+}
+
+// parseReadConcern 解析命令文档中的 readConcern，未指定时返回 nil
+func parseReadConcern(body bsoncore.Document) (*readConcern, error) {
+	v, err := body.LookupErr("readConcern")
+	if err != nil {
+		return nil, nil
+	}
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'readConcern' is the wrong type '%s', expected type 'object'", v.Type)
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+
+	rc := &readConcern{}
+	atClusterTime := false
+	for _, elem := range elems {
+		v := elem.Value()
+		switch elem.Key() {
+		case "level":
+			level, ok := v.StringValueOK()
+			if !ok {
+				return nil, NewCommandError(CodeTypeMismatch, "BSON field 'readConcern.level' is the wrong type '%s', expected type 'string'", v.Type)
+			}
+			switch level {
+			case readConcernLocal, readConcernAvailable, readConcernMajority, readConcernLinearizable, readConcernSnapshot:
+			default:
+				return nil, NewCommandError(CodeFailedToParse,
+					"readConcern.level must be either 'local', 'majority', 'linearizable', 'available', or 'snapshot', got '%s'", level)
+			}
+			rc.level = level
+		case "atClusterTime":
+			if _, _, ok := v.TimestampOK(); !ok {
+				return nil, NewCommandError(CodeTypeMismatch, "BSON field 'readConcern.atClusterTime' is the wrong type '%s', expected type 'timestamp'", v.Type)
+			}
+			atClusterTime = true
+		case "afterClusterTime":
+			// 单节点上所有已确认的写入都已可见，只检查类型
+			if _, _, ok := v.TimestampOK(); !ok {
+				return nil, NewCommandError(CodeTypeMismatch, "BSON field 'readConcern.afterClusterTime' is the wrong type '%s', expected type 'timestamp'", v.Type)
+			}
+		default:
+			return nil, NewCommandError(CodeInvalidOptions, "Unrecognized option in readConcern: %s", elem.Key())
+		}
+	}
+	if atClusterTime && rc.level != readConcernSnapshot {
+		return nil, NewCommandError(CodeInvalidOptions, "readConcern.atClusterTime is only valid with level 'snapshot'")
+	}
+	// 存储引擎不保留记录的历史版本，无法读取过去时间点的快照；
+	// 拒绝 atClusterTime，避免事务声称读取快照却读到之后的写入
+	if atClusterTime {
+		return nil, NewCommandError(CodeSnapshotUnavailable, "readConcern.atClusterTime is not supported: the storage engine does not keep historical versions")
+	}
+	return rc, nil
+}
+
+// checkReadConcern 检查读关注能否用于命令所在的事务上下文
+// snapshot 只能用于多文档事务；事务中只有开始事务的第一个命令可以指定读关注，且级别只能是 local、majority 或 snapshot
+func checkReadConcern(rc *readConcern, f *transactionFields) error {
+	if rc == nil {
+		return nil
+	}
+	if f.autocommit == nil {
+		if rc.level == readConcernSnapshot {
+			return NewCommandError(CodeInvalidOptions, "readConcern level snapshot is only valid in multi-statement transactions")
+		}
+		return nil
+	}
+	if !f.start {
+		return NewCommandError(CodeInvalidOptions, "Only the first command in a transaction may specify a readConcern")
+	}
+	switch rc.level {
+	case "", readConcernLocal, readConcernMajority, readConcernSnapshot:
+		return nil
+	}
+	return NewCommandError(CodeInvalidOptions,
+		"The readConcern level must be either 'local' (default), 'majority' or 'snapshot' in order to run in a transaction")
+}
+
+// parseReadPreference 校验命令文档中的 $readPreference
+// 单节点部署只有主节点，任何合法的读偏好都在本节点读取
+func parseReadPreference(body bsoncore.Document) error {
+	v, err := body.LookupErr("$readPreference")
+	if err != nil {
+		return nil
+	}
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return NewCommandError(CodeTypeMismatch, "BSON field '$readPreference' is the wrong type '%s', expected type 'object'", v.Type)
+	}
+	mode, err := doc.LookupErr("mode")
+	if err != nil {
+		return NewCommandError(CodeFailedToParse, "Missing required field 'mode' in $readPreference")
+	}
+	name, ok := mode.StringValueOK()
+	if !ok || !readPreferenceModes[name] {
+		return NewCommandError(CodeFailedToParse, "Could not parse $readPreference mode: %s", mode)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestReadConcern 测试 readConcern 和 $readPreference 的校验，以及 snapshot 读关注与事务的关系
+func TestReadConcern(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	requestID := int32(0)
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+	find := bsoncore.NewDocumentBuilder().AppendString("find", "items").AppendString("$db", "test").Build()
+	withReadConcern := func(cmd bsoncore.Document, level string) bsoncore.Document {
+		return appendFields(t, cmd, func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("readConcern").AppendString("level", level).FinishDocument()
+		})
+	}
+	expectCode := func(reply bsoncore.Document, code ErrorCode) {
+		t.Helper()
+		if reply.Lookup("ok").Double() != 0 || reply.Lookup("code").Int32() != int32(code) {
+			t.Errorf("应返回错误码 %d (%s): %s", code, code.Name(), reply)
+		}
+	}
+	run(insertCommandDocument("test", "items", bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).Build()))
+
+	t.Run("合法的读关注级别", func(t *testing.T) {
+		for _, level := range []string{"local", "available", "majority", "linearizable"} {
+			reply := run(withReadConcern(find, level))
+			if _, docs := cursorBatch(t, reply, "firstBatch"); len(docs) != 1 {
+				t.Errorf("readConcern %s 应正常读取: %s", level, reply)
+			}
+		}
+	})
+
+	t.Run("无效的读关注", func(t *testing.T) {
+		expectCode(run(withReadConcern(find, "bogus")), CodeFailedToParse)
+		expectCode(run(appendFields(t, find, func(b *bsoncore.DocumentBuilder) { b.AppendString("readConcern", "local") })), CodeTypeMismatch)
+		expectCode(run(appendFields(t, find, func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("readConcern").AppendString("level", "local").AppendInt32("bogus", 1).FinishDocument()
+		})), CodeInvalidOptions)
+		expectCode(run(appendFields(t, find, func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("readConcern").AppendString("level", "majority").AppendTimestamp("atClusterTime", 1, 1).FinishDocument()
+		})), CodeInvalidOptions)
+	})
+
+	t.Run("snapshot 只能用于事务", func(t *testing.T) {
+		expectCode(run(withReadConcern(find, "snapshot")), CodeInvalidOptions)
+
+		lsid := uuid.New()
+		reply := run(withTransaction(t, withReadConcern(find, "snapshot"), lsid, 1, true))
+		if _, docs := cursorBatch(t, reply, "firstBatch"); len(docs) != 1 {
+			t.Errorf("事务中的 snapshot 读取失败: %s", reply)
+		}
+		// 事务中只有第一个命令可以指定读关注
+		expectCode(run(withTransaction(t, withReadConcern(find, "snapshot"), lsid, 1, false)), CodeInvalidOptions)
+		// 事务中不支持 linearizable
+		expectCode(run(withTransaction(t, withReadConcern(find, "linearizable"), lsid, 2, true)), CodeInvalidOptions)
+	})
+
+	t.Run("atClusterTime 之后的写入不可见", func(t *testing.T) {
+		// 快照时间点之后写入的文档不能出现在按该时间点读取的结果中；不保留历史版本时拒绝读取
+		at := time.Now().Add(-time.Hour)
+		run(insertCommandDocument("test", "items", bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).Build()))
+		lsid := uuid.New()
+		cmd := appendFields(t, find, func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("readConcern").
+				AppendString("level", "snapshot").
+				AppendTimestamp("atClusterTime", uint32(at.Unix()), 1).
+				FinishDocument()
+		})
+		reply := run(withTransaction(t, cmd, lsid, 1, true))
+		expectCode(reply, CodeSnapshotUnavailable)
+		if reply.Lookup("cursor").Type != 0 {
+			t.Errorf("拒绝 atClusterTime 时不应返回文档: %s", reply)
+		}
+		if logicalSessions.lookup(string(lsid[:])) != nil {
+			t.Errorf("拒绝 atClusterTime 时不应开始事务")
+		}
+		run(bsoncore.NewDocumentBuilder().AppendString("delete", "items").
+			AppendArray("deletes", bsoncore.NewArrayBuilder().AppendDocument(bsoncore.NewDocumentBuilder().
+				AppendDocument("q", bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).Build()).
+				AppendInt32("limit", 1).Build()).Build()).
+			AppendString("$db", "test").Build())
+	})
+
+	t.Run("$readPreference", func(t *testing.T) {
+		withMode := func(mode string) bsoncore.Document {
+			return appendFields(t, find, func(b *bsoncore.DocumentBuilder) {
+				b.StartDocument("$readPreference").AppendString("mode", mode).FinishDocument()
+			})
+		}
+		for _, mode := range []string{"primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest"} {
+			if reply := run(withMode(mode)); reply.Lookup("ok").Double() != 1 {
+				t.Errorf("$readPreference %s 应被接受: %s", mode, reply)
+			}
+		}
+		expectCode(run(withMode("fastest")), CodeFailedToParse)
+	})
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// buildOpReply 构造 OP_REPLY 回复
+// 格式: responseFlags(int32) cursorID(int64) startingFrom(int32) numberReturned(int32) documents...
+func buildOpReply(request *Message, flags wiremessage.ReplyFlag, cursorID int64, startingFrom int32, docs []bsoncore.Document) *Message {
+	body := wiremessage.AppendReplyFlags(nil, flags)
+	body = wiremessage.AppendReplyCursorID(body, cursorID)
+	body = wiremessage.AppendReplyStartingFrom(body, startingFrom)
+	body = wiremessage.AppendReplyNumberReturned(body, int32(len(docs)))
+	for _, doc := range docs {
+		body = append(body, doc...)
+	}
+
+	return &Message{
+		Header: &MessageHeader{
+			MessageLength: int32(16 + len(body)),
+			RequestID:     generateRequestID(),
+			ResponseTo:    request.Header.RequestID,
+			OpCode:        int32(OpReply),
+		},
+		Body:   body,
+		OpCode: OpReply,
+	}
+}
+
+// buildQueryFailureReply 构造设置了 QueryFailure 标志的 OP_REPLY，
+// 唯一的文档为 {$err, code}
+func buildQueryFailureReply(request *Message, err error) *Message {
+	failure := toCommandError(err)
+	doc := bsoncore.NewDocumentBuilder().
+		AppendString("$err", failure.Message).
+		AppendInt32("code", int32(failure.Code)).
+		Build()
+	return buildOpReply(request, wiremessage.QueryFailure, 0, 0, []bsoncore.Document{doc})
+}
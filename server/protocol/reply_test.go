@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// serialize 序列化消息并校验消息头
+func serialize(t *testing.T, message *Message, opcode wiremessage.OpCode, responseTo int32) []byte {
+	t.Helper()
+	data, err := message.Serialize()
+	if err != nil {
+		t.Fatalf("序列化失败: %v", err)
+	}
+
+	length, _, respTo, op, rem, ok := wiremessage.ReadHeader(data)
+	if !ok {
+		t.Fatal("读取消息头失败")
+	}
+	if int(length) != len(data) {
+		t.Errorf("消息长度不正确: got %d, want %d", length, len(data))
+	}
+	if op != opcode {
+		t.Errorf("操作码不正确: got %s, want %s", op, opcode)
+	}
+	if respTo != responseTo {
+		t.Errorf("ResponseTo 不正确: got %d, want %d", respTo, responseTo)
+	}
+	return rem
+}
+
+// TestOpMsgReplySerialize 测试 OP_MSG 回复的线上格式
+func TestOpMsgReplySerialize(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	reply := listener.handleMessage(newFakeSession(), newOpMsgMessage(42, pingCommandDocument()))
+
+	rem := serialize(t, reply, wiremessage.OpMsg, 42)
+
+	flags, rem, ok := wiremessage.ReadMsgFlags(rem)
+	if !ok || flags != 0 {
+		t.Fatalf("OP_MSG 标志不正确: %v", flags)
+	}
+	stype, rem, ok := wiremessage.ReadMsgSectionType(rem)
+	if !ok || stype != wiremessage.SingleDocument {
+		t.Fatalf("section 类型不正确: %v", stype)
+	}
+	doc, rem, ok := wiremessage.ReadMsgSectionSingleDocument(rem)
+	if !ok {
+		t.Fatal("读取结果文档失败")
+	}
+	if len(rem) != 0 {
+		t.Errorf("消息末尾有多余字节: %d", len(rem))
+	}
+	if err := doc.Validate(); err != nil {
+		t.Fatalf("结果文档不是合法 BSON: %v", err)
+	}
+	if ok := doc.Lookup("ok").Double(); ok != 1 {
+		t.Errorf("ok 字段不正确: %s", doc)
+	}
+}
+
+// TestOpReplySerialize 测试 OP_REPLY 回复的线上格式
+func TestOpReplySerialize(t *testing.T) {
+	request := &Message{Header: &MessageHeader{RequestID: 7, OpCode: int32(OpQuery)}, OpCode: OpQuery}
+
+	t.Run("携带文档", func(t *testing.T) {
+		docs := []bsoncore.Document{
+			bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("name", "Alice").Build(),
+			bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendString("name", "Bob").Build(),
+		}
+		reply := buildOpReply(request, 0, 12345, 10, docs)
+		rem := serialize(t, reply, wiremessage.OpReply, 7)
+
+		flags, rem, _ := wiremessage.ReadReplyFlags(rem)
+		cursorID, rem, _ := wiremessage.ReadReplyCursorID(rem)
+		startingFrom, rem, _ := wiremessage.ReadReplyStartingFrom(rem)
+		numberReturned, rem, _ := wiremessage.ReadReplyNumberReturned(rem)
+		parsed, rem, ok := wiremessage.ReadReplyDocuments(rem)
+		if !ok || len(rem) != 0 {
+			t.Fatal("读取回复文档失败")
+		}
+
+		if flags != 0 || cursorID != 12345 || startingFrom != 10 || numberReturned != 2 {
+			t.Errorf("回复字段不正确: flags=%v cursorID=%d startingFrom=%d numberReturned=%d",
+				flags, cursorID, startingFrom, numberReturned)
+		}
+		if len(parsed) != 2 || parsed[1].Lookup("name").StringValue() != "Bob" {
+			t.Errorf("回复文档不正确: %v", parsed)
+		}
+	})
+
+	t.Run("查询失败", func(t *testing.T) {
+		reply := buildQueryFailureReply(request, NewCommandError(CodeBadValue, "bad query"))
+		rem := serialize(t, reply, wiremessage.OpReply, 7)
+
+		flags, rem, _ := wiremessage.ReadReplyFlags(rem)
+		if flags&wiremessage.QueryFailure == 0 {
+			t.Errorf("应设置 QueryFailure 标志: %v", flags)
+		}
+		_, rem, _ = wiremessage.ReadReplyCursorID(rem)
+		_, rem, _ = wiremessage.ReadReplyStartingFrom(rem)
+		_, rem, _ = wiremessage.ReadReplyNumberReturned(rem)
+		doc, _, ok := wiremessage.ReadReplyDocument(rem)
+		if !ok {
+			t.Fatal("读取错误文档失败")
+		}
+		if doc.Lookup("$err").StringValue() != "bad query" || doc.Lookup("code").Int32() != 2 {
+			t.Errorf("错误文档不正确: %s", doc)
+		}
+	})
+
+	t.Run("长度以消息体为准", func(t *testing.T) {
+		reply := buildOpReply(request, 0, 0, 0, nil)
+		reply.Header.MessageLength = 9999
+		serialize(t, reply, wiremessage.OpReply, 7)
+	})
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"context"
+	"strings"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// beginRetryableWrite 开始携带 lsid 和 txnNumber、不属于事务的可重试写操作
+// 驱动在网络错误后用相同的 txnNumber 重发写命令，txnNumber 已执行过时返回缓存的结果，避免重复写入
+// 返回已加锁的逻辑会话，调用方执行完命令后负责解锁
+func beginRetryableWrite(ctx context.Context, f *transactionFields) (*logicalSession, bsoncore.Document, error) {
+	s := logicalSessions.get(f.lsid)
+	s.mu.Lock()
+	if f.txnNumber < s.txnNumber {
+		s.mu.Unlock()
+		return nil, nil, NewCommandError(CodeTransactionTooOld,
+			"Retryable write with txnNumber %d is prohibited on session because a newer retryable write with txnNumber %d has already started on this session.",
+			f.txnNumber, s.txnNumber)
+	}
+	if f.txnNumber == s.txnNumber {
+		if s.retryResult != nil {
+			return s, s.retryResult, nil
+		}
+		if s.state != txnNone {
+			s.mu.Unlock()
+			return nil, nil, NewCommandError(CodeConflictingOperation,
+				"Cannot run a retryable write with txnNumber %d because it was used by a transaction.", f.txnNumber)
+		}
+		// 上一次执行失败或部分语句失败，重新执行，已成功的语句由 retryableStatements 跳过
+		return s, nil, nil
+	}
+
+	// 更大的 txnNumber 开始新的写操作，未结束的事务被中止
+	s.abort(ctx)
+	s.txnNumber, s.state, s.retryResult = f.txnNumber, txnNone, nil
+	s.retryPartial, s.retryExecuted = nil, nil
+	return s, nil, nil
+}
+
+// retryableStatements 可重试写操作中各语句的执行情况，语句按在命令中的下标标识
+type retryableStatements struct {
+	executed  map[int]bool // 之前的执行中已成功的语句，重试时跳过
+	succeeded []int        // 本次执行中成功的语句
+}
+
+// skip 判断第 i 个语句是否已在之前的执行中成功，r 为 nil 时总是返回 false
+func (r *retryableStatements) skip(i int) bool {
+	return r != nil && r.executed[i]
+}
+
+// done 记录第 i 个语句执行成功
+func (r *retryableStatements) done(i int) {
+	if r != nil {
+		r.succeeded = append(r.succeeded, i)
+	}
+}
+
+// recordRetryableWrite 记录可重试写操作的结果并返回合并了之前部分执行结果的回复，调用方需持有 s.mu
+// 没有 writeErrors 时缓存结果，重试直接返回；有 writeErrors 时记录成功的语句，重试时只执行失败和未执行的语句
+func (s *logicalSession) recordRetryableWrite(reply bsoncore.Document, stmts *retryableStatements) bsoncore.Document {
+	if s.retryPartial != nil {
+		reply = mergeRetryReply(s.retryPartial, reply)
+	}
+	if _, err := reply.LookupErr("writeErrors"); err != nil {
+		s.retryResult, s.retryPartial, s.retryExecuted = reply, nil, nil
+		return reply
+	}
+	if len(stmts.succeeded) > 0 {
+		if s.retryExecuted == nil {
+			s.retryExecuted = make(map[int]bool, len(stmts.succeeded))
+		}
+		for _, i := range stmts.succeeded {
+			s.retryExecuted[i] = true
+		}
+	}
+	s.retryPartial = reply
+	return reply
+}
+
+// mergeRetryReply 合并部分失败的写命令之前的结果和重试的结果
+// n、nModified 等计数相加，upserted 依次拼接，writeErrors 和其他字段以重试的结果为准
+func mergeRetryReply(previous, reply bsoncore.Document) bsoncore.Document {
+	elems, _ := reply.Elements()
+	builder := bsoncore.NewDocumentBuilder()
+	mergedUpserted := false
+	appendUpserted := func() {
+		if mergedUpserted {
+			return
+		}
+		mergedUpserted = true
+		upserted := bsoncore.NewArrayBuilder()
+		count := 0
+		for _, doc := range []bsoncore.Document{previous, reply} {
+			if arr, ok := doc.Lookup("upserted").ArrayOK(); ok {
+				values, _ := arr.Values()
+				for _, v := range values {
+					upserted.AppendDocument(v.Document())
+					count++
+				}
+			}
+		}
+		if count > 0 {
+			builder.AppendArray("upserted", upserted.Build())
+		}
+	}
+	for _, elem := range elems {
+		key, value := elem.Key(), elem.Value()
+		switch {
+		case key == "upserted":
+			appendUpserted()
+		case key == "writeErrors" || key == "ok":
+			appendUpserted()
+			builder.AppendValue(key, value)
+		case strings.HasPrefix(key, "n") && value.Type == bsoncore.TypeInt32:
+			n, _ := previous.Lookup(key).Int32OK()
+			builder.AppendInt32(key, value.Int32()+n)
+		default:
+			builder.AppendValue(key, value)
+		}
+	}
+	return builder.Build()
+}
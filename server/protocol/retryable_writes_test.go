@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestRetryableWrites 测试相同 lsid 和 txnNumber 的写命令只执行一次
+func TestRetryableWrites(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	requestID := int32(0)
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+	mustRun := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		reply := run(cmd)
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+		return reply
+	}
+	retryable := func(cmd bsoncore.Document, lsid uuid.UUID, txnNumber int64) bsoncore.Document {
+		return appendFields(t, cmd, func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("lsid").AppendBinary("id", 4, lsid[:]).FinishDocument().
+				AppendInt64("txnNumber", txnNumber)
+		})
+	}
+	find := func(filter bsoncore.Document) []bsoncore.Document {
+		t.Helper()
+		cmd := bsoncore.NewDocumentBuilder().
+			AppendString("find", "counters").
+			AppendDocument("filter", filter).
+			AppendString("$db", "app").
+			Build()
+		_, docs := cursorBatch(t, mustRun(cmd), "firstBatch")
+		return docs
+	}
+	empty := bsoncore.NewDocumentBuilder().Build()
+	lsid := uuid.New()
+
+	t.Run("重试的插入只执行一次", func(t *testing.T) {
+		// 没有 _id 的文档每次执行都会生成新的 ObjectId，重复执行会插入两个文档
+		doc := bsoncore.NewDocumentBuilder().AppendString("name", "visits").AppendInt32("value", 0).Build()
+		insert := retryable(insertCommandDocument("app", "counters", doc), lsid, 1)
+		first := mustRun(insert)
+		second := mustRun(insert)
+		if first.Lookup("n").Int32() != 1 || second.Lookup("n").Int32() != 1 {
+			t.Errorf("重试应返回第一次的结果: %s %s", first, second)
+		}
+		if docs := find(empty); len(docs) != 1 {
+			t.Errorf("文档应只插入一次, got %d", len(docs))
+		}
+	})
+
+	t.Run("重试的更新只执行一次", func(t *testing.T) {
+		stmt := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendString("name", "visits").FinishDocument().
+			StartDocument("u").StartDocument("$inc").AppendInt32("value", 1).FinishDocument().FinishDocument().
+			Build()
+		update := retryable(updateCommandDocument("app", "counters", stmt), lsid, 2)
+		mustRun(update)
+		if reply := mustRun(update); reply.Lookup("nModified").Int32() != 1 {
+			t.Errorf("重试应返回第一次的结果: %s", reply)
+		}
+		if docs := find(empty); len(docs) != 1 || docs[0].Lookup("value").Int32() != 1 {
+			t.Errorf("$inc 应只执行一次: %v", docs)
+		}
+
+		// 不携带 txnNumber 的写操作不去重
+		plain := updateCommandDocument("app", "counters", stmt)
+		mustRun(plain)
+		mustRun(plain)
+		if docs := find(empty); docs[0].Lookup("value").Int32() != 3 {
+			t.Errorf("普通写操作每次都应执行: %v", docs)
+		}
+	})
+
+	t.Run("重试的删除只执行一次", func(t *testing.T) {
+		mustRun(insertCommandDocument("app", "counters",
+			bsoncore.NewDocumentBuilder().AppendString("name", "extra").Build(),
+			bsoncore.NewDocumentBuilder().AppendString("name", "extra").Build()))
+		filter := bsoncore.NewDocumentBuilder().AppendString("name", "extra").Build()
+		del := retryable(deleteCommandDocument("app", "counters", deleteStatementDocument(filter, 1)), lsid, 3)
+		mustRun(del)
+		if reply := mustRun(del); reply.Lookup("n").Int32() != 1 {
+			t.Errorf("重试应返回第一次的结果: %s", reply)
+		}
+		if docs := find(filter); len(docs) != 1 {
+			t.Errorf("limit 1 的删除重试后应只删除一个文档, 剩余 %d", len(docs))
+		}
+	})
+
+	t.Run("重试部分失败的写操作只执行失败的语句", func(t *testing.T) {
+		lsid := uuid.New()
+		mustRun(insertCommandDocument("app", "counters",
+			bsoncore.NewDocumentBuilder().AppendString("_id", "hits").AppendInt32("value", 0).Build()))
+		inc := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendString("_id", "hits").FinishDocument().
+			StartDocument("u").StartDocument("$inc").AppendInt32("value", 1).FinishDocument().FinishDocument().
+			Build()
+		// 修改 _id 的语句总是失败
+		bad := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendString("_id", "hits").FinishDocument().
+			StartDocument("u").StartDocument("$set").AppendString("_id", "other").FinishDocument().FinishDocument().
+			Build()
+		update := appendFields(t, retryable(updateCommandDocument("app", "counters", inc, bad, inc), lsid, 1), func(b *bsoncore.DocumentBuilder) {
+			b.AppendBoolean("ordered", false)
+		})
+		hits := bsoncore.NewDocumentBuilder().AppendString("_id", "hits").Build()
+		for attempt := 1; attempt <= 2; attempt++ {
+			reply := mustRun(update)
+			if reply.Lookup("n").Int32() != 2 || reply.Lookup("nModified").Int32() != 2 {
+				t.Errorf("第 %d 次执行应报告两个成功的语句: %s", attempt, reply)
+			}
+			if errs, ok := reply.Lookup("writeErrors").ArrayOK(); !ok || errs.Index(0).Document().Lookup("index").Int32() != 1 {
+				t.Errorf("第 %d 次执行应报告第 2 个语句失败: %s", attempt, reply)
+			}
+			if docs := find(hits); len(docs) != 1 || docs[0].Lookup("value").Int32() != 2 {
+				t.Fatalf("第 %d 次执行后成功的 $inc 应只执行一次: %v", attempt, docs)
+			}
+		}
+
+		// 有序插入在重复的 _id 处停止，冲突消除后重试只插入之前失败和未执行的文档
+		doc := func(id string) bsoncore.Document {
+			return bsoncore.NewDocumentBuilder().AppendString("_id", id).Build()
+		}
+		insert := retryable(insertCommandDocument("app", "counters", doc("a"), doc("hits"), doc("b")), lsid, 2)
+		if reply := mustRun(insert); reply.Lookup("n").Int32() != 1 {
+			t.Fatalf("重复的 _id 之前应只插入一个文档: %s", reply)
+		}
+		mustRun(deleteCommandDocument("app", "counters", deleteStatementDocument(hits, 1)))
+		reply := mustRun(insert)
+		if _, err := reply.LookupErr("writeErrors"); err == nil {
+			t.Errorf("冲突消除后重试应全部成功: %s", reply)
+		}
+		if reply.Lookup("n").Int32() != 3 {
+			t.Errorf("重试的结果应包含之前插入的文档: %s", reply)
+		}
+		if again := mustRun(insert); again.Lookup("n").Int32() != 3 {
+			t.Errorf("全部成功后重试应返回缓存的结果: %s", again)
+		}
+	})
+
+	t.Run("txnNumber 校验", func(t *testing.T) {
+		doc := bsoncore.NewDocumentBuilder().AppendString("name", "old").Build()
+		reply := run(retryable(insertCommandDocument("app", "counters", doc), lsid, 2))
+		if reply.Lookup("code").Int32() != int32(CodeTransactionTooOld) {
+			t.Errorf("较小的 txnNumber 应返回 TransactionTooOld: %s", reply)
+		}
+		// 不同的逻辑会话各自计数
+		mustRun(retryable(insertCommandDocument("app", "counters", doc), uuid.New(), 1))
+		if docs := find(doc); len(docs) != 1 {
+			t.Errorf("其他会话的写操作应正常执行, got %d", len(docs))
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+func init() {
+	registerCommand("getCmdLineOpts", ActionGetCmdLineOpts, (*EventListener).cmdGetCmdLineOpts)
+	registerCommand("hostInfo", ActionHostInfo, (*EventListener).cmdHostInfo)
+	registerCommand("serverStatus", ActionServerStatus, (*EventListener).cmdServerStatus)
+}
+
+// processStartTime 进程启动时间，serverStatus 据此计算 uptime
+var processStartTime = time.Now()
+
+// secretConfigFields getCmdLineOpts 中不返回的配置项，按 "段.字段" 的 mapstructure 名称匹配
+var secretConfigFields = map[string]bool{
+	"security.key_file":         true,
+	"security.ssl_pem_key_file": true,
+}
+
+// configDocument 按 mapstructure 标签将配置结构体转换为嵌套文档，prefix 为上层段名
+// 跳过 secretConfigFields 中的配置项和没有标签的字段，遇到无法转换的字段类型时返回错误
+func configDocument(v reflect.Value, prefix string) (bsoncore.Document, error) {
+	builder := bsoncore.NewDocumentBuilder()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("mapstructure")
+		if name == "" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if secretConfigFields[path] {
+			continue
+		}
+		val, err := configValue(v.Field(i), path)
+		if err != nil {
+			return nil, err
+		}
+		builder.AppendValue(name, val)
+	}
+	return builder.Build(), nil
+}
+
+// configValue 将单个配置项转换为 BSON 值：无符号整数按 int64 返回，切片和数组转换为数组，
+// 以字符串为键的 map 按键排序后转换为文档，nil 指针和接口返回 null
+func configValue(v reflect.Value, path string) (bsoncore.Value, error) {
+	switch v.Kind() {
+	case reflect.Struct:
+		doc, err := configDocument(v, path)
+		if err != nil {
+			return bsoncore.Value{}, err
+		}
+		return bsoncore.Value{Type: bsoncore.TypeEmbeddedDocument, Data: doc}, nil
+	case reflect.String:
+		return bsoncore.Value{Type: bsoncore.TypeString, Data: bsoncore.AppendString(nil, v.String())}, nil
+	case reflect.Bool:
+		return bsoncore.Value{Type: bsoncore.TypeBoolean, Data: bsoncore.AppendBoolean(nil, v.Bool())}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return bsoncore.Value{Type: bsoncore.TypeInt64, Data: bsoncore.AppendInt64(nil, v.Int())}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return bsoncore.Value{}, NewCommandError(CodeInternalError, "config field %s value %d overflows int64", path, v.Uint())
+		}
+		return bsoncore.Value{Type: bsoncore.TypeInt64, Data: bsoncore.AppendInt64(nil, int64(v.Uint()))}, nil
+	case reflect.Float32, reflect.Float64:
+		return bsoncore.Value{Type: bsoncore.TypeDouble, Data: bsoncore.AppendDouble(nil, v.Float())}, nil
+	case reflect.Slice, reflect.Array:
+		arr := bsoncore.NewArrayBuilder()
+		for i := 0; i < v.Len(); i++ {
+			elem, err := configValue(v.Index(i), path+"."+strconv.Itoa(i))
+			if err != nil {
+				return bsoncore.Value{}, err
+			}
+			arr.AppendValue(elem)
+		}
+		return bsoncore.Value{Type: bsoncore.TypeArray, Data: arr.Build()}, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return bsoncore.Value{}, NewCommandError(CodeInternalError, "config field %s has unsupported map key type %s", path, v.Type().Key())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		doc := bsoncore.NewDocumentBuilder()
+		for _, key := range keys {
+			elem, err := configValue(v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())), path+"."+key)
+			if err != nil {
+				return bsoncore.Value{}, err
+			}
+			doc.AppendValue(key, elem)
+		}
+		return bsoncore.Value{Type: bsoncore.TypeEmbeddedDocument, Data: doc.Build()}, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return bsoncore.Value{Type: bsoncore.TypeNull}, nil
+		}
+		return configValue(v.Elem(), path)
+	}
+	return bsoncore.Value{}, NewCommandError(CodeInternalError, "config field %s has unsupported type %s", path, v.Type())
+}
+
+// cmdGetCmdLineOpts 处理 getCmdLineOpts 命令，返回启动参数和解析后的配置
+// parsed 按配置文件的段和字段名组织，不包含密钥文件等敏感配置
+func (l *EventListener) cmdGetCmdLineOpts(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	argv := bsoncore.NewArrayBuilder()
+	for _, arg := range os.Args {
+		argv.AppendString(arg)
+	}
+	parsed, err := configDocument(reflect.ValueOf(*l.config), "")
+	if err != nil {
+		return nil, err
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendArray("argv", argv.Build()).
+		AppendDocument("parsed", parsed), nil
+}
+
+// cmdHostInfo 处理 hostInfo 命令，返回主机名、CPU、内存和操作系统信息
+// 无法读取的信息（如非 Linux 系统的内存大小和发行版）返回零值
+func (l *EventListener) cmdHostInfo(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	hostname, _ := os.Hostname()
+	osName, osVersion := operatingSystem()
+	return bsoncore.NewDocumentBuilder().
+		AppendDocument("system", bsoncore.NewDocumentBuilder().
+			AppendDateTime("currentTime", time.Now().UnixMilli()).
+			AppendString("hostname", hostname).
+			AppendInt32("cpuAddrSize", int32(strconv.IntSize)).
+			AppendInt64("memSizeMB", memorySizeMB()).
+			AppendInt32("numCores", int32(runtime.NumCPU())).
+			AppendString("cpuArch", runtime.GOARCH).
+			Build()).
+		AppendDocument("os", bsoncore.NewDocumentBuilder().
+			AppendString("type", osType()).
+			AppendString("name", osName).
+			AppendString("version", osVersion).
+			Build()).
+		AppendDocument("extra", bsoncore.NewDocumentBuilder().
+			AppendString("goVersion", runtime.Version()).
+			Build()), nil
+}
+
+// cmdServerStatus 处理 serverStatus 命令，返回进程信息和 insert/find/update/delete 的延迟分位数
+// 延迟按 2 的幂分桶统计，p50Micros/p95Micros/p99Micros 为分位数所在桶的上界(微秒)
+func (l *EventListener) cmdServerStatus(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	latencies := bsoncore.NewDocumentBuilder()
+	for _, name := range latencyOperations {
+		ops, values := opLatencies[name].percentiles(0.50, 0.95, 0.99)
+		latencies.AppendDocument(name, bsoncore.NewDocumentBuilder().
+			AppendInt64("ops", int64(ops)).
+			AppendInt64("p50Micros", values[0].Microseconds()).
+			AppendInt64("p95Micros", values[1].Microseconds()).
+			AppendInt64("p99Micros", values[2].Microseconds()).
+			Build())
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("host", hostname).
+		AppendString("process", "xmongodb").
+		AppendInt64("pid", int64(os.Getpid())).
+		AppendInt64("uptime", int64(now.Sub(processStartTime).Seconds())).
+		AppendInt64("uptimeMillis", now.Sub(processStartTime).Milliseconds()).
+		AppendDateTime("localTime", now.UnixMilli()).
+		AppendDocument("opLatencyPercentiles", latencies.Build()), nil
+}
+
+// osType 返回与 mongod 一致的操作系统类型名
+func osType() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "Linux"
+	case "darwin":
+		return "Darwin"
+	case "windows":
+		return "Windows"
+	}
+	return runtime.GOOS
+}
+
+// operatingSystem 返回 Linux 发行版名称（/etc/os-release 的 PRETTY_NAME）和内核版本
+func operatingSystem() (name, version string) {
+	if f, err := os.Open("/etc/os-release"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if v, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+				name = strings.Trim(v, `"`)
+				break
+			}
+		}
+	}
+	if data, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		version = strings.TrimSpace(string(data))
+	}
+	return name, version
+}
+
+// memorySizeMB 从 /proc/meminfo 读取物理内存大小(MB)，读取失败时返回 0
+func memorySizeMB() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			return kb / 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestGetCmdLineOpts 测试 getCmdLineOpts 返回启动参数和按段组织的配置，且不包含密钥文件路径
+func TestGetCmdLineOpts(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.Port = 27018
+	cfg.Storage.Engine = "memory"
+	cfg.Security.Authorization = true
+	cfg.Security.KeyFile = "/etc/secret/mongodb.key"
+	cfg.Security.SSLPEMKeyFile = "/etc/secret/server.pem"
+	listener := newTestListener(t, cfg)
+	session := newFakeSession()
+	SetAuthenticatedUser(session, &UserIdentity{User: "monitor", DB: "admin", Roles: []RoleName{{Role: "clusterMonitor", DB: "admin"}}})
+
+	cmd := bsoncore.NewDocumentBuilder().AppendInt32("getCmdLineOpts", 1).AppendString("$db", "admin").Build()
+	reply := replyDocument(t, listener.handleMessage(session, newOpMsgMessage(1, cmd)))
+	if reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("getCmdLineOpts 失败: %s", reply)
+	}
+	if argv, err := reply.Lookup("argv").Array().Values(); err != nil || len(argv) == 0 {
+		t.Errorf("argv 应包含启动参数: %s", reply)
+	}
+	for _, section := range []string{"server", "network", "storage", "security", "logger"} {
+		if _, err := reply.LookupErr("parsed", section); err != nil {
+			t.Errorf("parsed 缺少 %s 段: %s", section, reply)
+		}
+	}
+	if port := reply.Lookup("parsed", "server", "port").Int64(); port != 27018 {
+		t.Errorf("parsed.server.port = %d, want 27018", port)
+	}
+	if !reply.Lookup("parsed", "security", "authorization").Boolean() {
+		t.Errorf("应返回非敏感的安全配置: %s", reply)
+	}
+	for _, field := range []string{"key_file", "ssl_pem_key_file"} {
+		if _, err := reply.LookupErr("parsed", "security", field); err == nil {
+			t.Errorf("不应返回 security.%s", field)
+		}
+	}
+	if bytes.Contains(reply, []byte("/etc/secret")) {
+		t.Errorf("回复中不应出现密钥文件路径: %s", reply)
+	}
+
+	// 没有集群监控权限的用户不能查看配置
+	reader := newFakeSession()
+	SetAuthenticatedUser(reader, &UserIdentity{User: "reader", DB: "test", Roles: []RoleName{{Role: "read", DB: "test"}}})
+	if code := replyDocument(t, listener.handleMessage(reader, newOpMsgMessage(2, cmd))).Lookup("code").Int32(); code != int32(CodeUnauthorized) {
+		t.Errorf("read 角色执行 getCmdLineOpts 应返回 Unauthorized, got %d", code)
+	}
+}
+
+// TestConfigDocument 测试配置中的浮点数、无符号整数、切片、map 和指针字段都会转换，无法转换的字段类型返回错误
+func TestConfigDocument(t *testing.T) {
+	type section struct {
+		Ratio   float64           `mapstructure:"ratio"`
+		Limit   uint32            `mapstructure:"limit"`
+		Hosts   []string          `mapstructure:"hosts"`
+		Labels  map[string]string `mapstructure:"labels"`
+		Timeout *int              `mapstructure:"timeout"`
+	}
+	type options struct {
+		Section section `mapstructure:"section"`
+	}
+	doc, err := configDocument(reflect.ValueOf(options{Section: section{
+		Ratio: 0.5, Limit: 7, Hosts: []string{"a", "b"}, Labels: map[string]string{"zone": "east"},
+	}}), "")
+	if err != nil {
+		t.Fatalf("configDocument: %v", err)
+	}
+	if ratio := doc.Lookup("section", "ratio").Double(); ratio != 0.5 {
+		t.Errorf("section.ratio = %v, want 0.5", ratio)
+	}
+	if limit := doc.Lookup("section", "limit").Int64(); limit != 7 {
+		t.Errorf("section.limit = %d, want 7", limit)
+	}
+	if hosts, err := doc.Lookup("section", "hosts").Array().Values(); err != nil || len(hosts) != 2 || hosts[1].StringValue() != "b" {
+		t.Errorf("section.hosts 应为 [a, b]: %s", doc)
+	}
+	if zone := doc.Lookup("section", "labels", "zone").StringValue(); zone != "east" {
+		t.Errorf("section.labels.zone = %q, want east", zone)
+	}
+	if typ := doc.Lookup("section", "timeout").Type; typ != bsoncore.TypeNull {
+		t.Errorf("nil 指针应转换为 null，实际为 %s", typ)
+	}
+
+	type unsupported struct {
+		Notify chan int `mapstructure:"notify"`
+	}
+	if _, err := configDocument(reflect.ValueOf(unsupported{}), "server"); err == nil {
+		t.Error("无法转换的字段类型应返回错误")
+	}
+}
+
+// TestHostInfo 测试 hostInfo 返回主机和操作系统信息
+func TestHostInfo(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	cmd := bsoncore.NewDocumentBuilder().AppendInt32("hostInfo", 1).AppendString("$db", "admin").Build()
+	reply := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(1, cmd)))
+	if reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("hostInfo 失败: %s", reply)
+	}
+	for _, key := range []string{"currentTime", "hostname", "cpuAddrSize", "memSizeMB", "numCores", "cpuArch"} {
+		if _, err := reply.LookupErr("system", key); err != nil {
+			t.Errorf("system 缺少 %s: %s", key, reply)
+		}
+	}
+	if n := reply.Lookup("system", "numCores").Int32(); n < 1 {
+		t.Errorf("numCores = %d, want >= 1", n)
+	}
+	if size := reply.Lookup("system", "cpuAddrSize").Int32(); size != 32 && size != 64 {
+		t.Errorf("cpuAddrSize = %d, want 32 或 64", size)
+	}
+	for _, key := range []string{"type", "name", "version"} {
+		if _, err := reply.LookupErr("os", key); err != nil {
+			t.Errorf("os 缺少 %s: %s", key, reply)
+		}
+	}
+}
+
+// TestServerStatus 测试 serverStatus 返回进程信息和按命令统计的延迟分位数
+func TestServerStatus(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	session := newFakeSession()
+	doc := bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).Build()
+	find := bsoncore.NewDocumentBuilder().AppendString("find", "c").AppendString("$db", "test").Build()
+	for i, cmd := range []bsoncore.Document{insertCommandDocument("test", "c", doc), find} {
+		if reply := replyDocument(t, listener.handleMessage(session, newOpMsgMessage(int32(i+1), cmd))); reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+	}
+
+	cmd := bsoncore.NewDocumentBuilder().AppendInt32("serverStatus", 1).AppendString("$db", "admin").Build()
+	reply := replyDocument(t, listener.handleMessage(session, newOpMsgMessage(3, cmd)))
+	if reply.Lookup("ok").Double() != 1 || reply.Lookup("pid").Int64() <= 0 {
+		t.Fatalf("serverStatus 失败: %s", reply)
+	}
+	for _, name := range []string{"insert", "find"} {
+		stats := reply.Lookup("opLatencyPercentiles", name).Document()
+		if stats.Lookup("ops").Int64() < 1 || stats.Lookup("p99Micros").Int64() < stats.Lookup("p50Micros").Int64() {
+			t.Errorf("%s 的延迟统计不正确: %s", name, stats)
+		}
+	}
+	if _, err := reply.LookupErr("opLatencyPercentiles", "update", "p95Micros"); err != nil {
+		t.Errorf("没有执行过的命令也应返回延迟统计: %s", reply)
+	}
+	if stats := LatencyStats()["insert"].(map[string]interface{}); stats["ops"].(uint64) < 1 {
+		t.Errorf("LatencyStats 应包含 insert 的执行次数: %v", stats)
+	}
+}
@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// sessionStateAttribute 会话中保存连接状态的属性名
+const sessionStateAttribute = "xmongodb.sessionState"
+
+// remoteAddrAttribute 会话中保存客户端地址的属性名，见 SetRemoteAddr
+const remoteAddrAttribute = "xmongodb.remoteAddr"
+
+// SetRemoteAddr 设置会话的客户端地址
+// 连接经本地代理转发时 getty 看到的是代理的回环地址，由服务器设置代理记录的真实地址
+func SetRemoteAddr(session getty.Session, addr string) {
+	session.SetAttribute(remoteAddrAttribute, addr)
+}
+
+// remoteAddr 返回会话的客户端地址，优先使用 SetRemoteAddr 设置的地址
+func remoteAddr(session getty.Session) string {
+	if session == nil {
+		return ""
+	}
+	if addr, ok := session.GetAttribute(remoteAddrAttribute).(string); ok {
+		return addr
+	}
+	return session.RemoteAddr()
+}
+
+// sessionState 连接级别的状态
+// OnOpen 时创建并保存在 getty 会话的属性中，OnClose 时结束存储引擎会话并移除
+// 同一连接的消息处理和定时回收可能在不同的 goroutine 中执行，字段由 mu 保护
+type sessionState struct {
+	mu            sync.Mutex
+	engineSession storage.EngineSession // 绑定的存储引擎会话，承载事务
+	database      string                // 最近一次命令的目标数据库，命令未指定 $db 时使用
+	user          *UserIdentity         // 已认证的用户
+	lastError     *lastError            // 最近一次旧版写操作的结果
+	lastActivity  time.Time             // 最近一次收到消息的时间
+}
+
+// newSessionState 创建连接状态并开始绑定的存储引擎会话
+func newSessionState() *sessionState {
+	engineSession := storage.NewEngineSession(uuid.New().String(), nil)
+	if err := engineSession.Begin(context.Background()); err != nil {
+		logger.Errorf("开始会话 %s 失败: %v", engineSession.GetSessionId(), err)
+	}
+	return &sessionState{
+		engineSession: engineSession,
+		lastActivity:  time.Now(),
+	}
+}
+
+// stateOf 返回会话的连接状态，会话上还没有状态时创建一个
+func stateOf(session getty.Session) *sessionState {
+	if state, ok := session.GetAttribute(sessionStateAttribute).(*sessionState); ok {
+		return state
+	}
+	state := newSessionState()
+	session.SetAttribute(sessionStateAttribute, state)
+	return state
+}
+
+// releaseSessionState 移除会话的连接状态，结束绑定的存储引擎会话，未提交的事务会被回滚
+func releaseSessionState(session getty.Session) {
+	state, ok := session.GetAttribute(sessionStateAttribute).(*sessionState)
+	if !ok {
+		return
+	}
+	session.RemoveAttribute(sessionStateAttribute)
+
+	state.mu.Lock()
+	engineSession := state.engineSession
+	state.engineSession = nil
+	state.mu.Unlock()
+	if engineSession == nil {
+		return
+	}
+
+	ctx := context.Background()
+	if engineSession.InTransaction() {
+		if err := engineSession.RollbackTransaction(ctx); err != nil {
+			logger.Errorf("回滚会话 %s 的事务失败: %v", engineSession.GetSessionId(), err)
+		}
+	}
+	if err := engineSession.End(ctx); err != nil {
+		logger.Errorf("结束会话 %s 失败: %v", engineSession.GetSessionId(), err)
+	}
+}
+
+// boundEngineSession 返回连接绑定的存储引擎会话，连接关闭后返回 nil
+func (s *sessionState) boundEngineSession() storage.EngineSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.engineSession
+}
+
+// currentDatabase 返回最近一次命令的目标数据库，没有执行过命令时返回空字符串
+func (s *sessionState) currentDatabase() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.database
+}
+
+// setCurrentDatabase 记录命令的目标数据库
+func (s *sessionState) setCurrentDatabase(db string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.database = db
+}
+
+// authenticatedUser 返回已认证的用户，未认证返回 nil
+func (s *sessionState) authenticatedUser() *UserIdentity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// setAuthenticatedUser 记录已认证的用户，nil 表示注销
+func (s *sessionState) setAuthenticatedUser(user *UserIdentity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+// lastWrite 返回最近一次旧版写操作的结果，没有写操作时返回 nil
+func (s *sessionState) lastWrite() *lastError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError
+}
+
+// setLastWrite 记录旧版写操作的结果
+func (s *sessionState) setLastWrite(result *lastError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = result
+}
+
+// touch 记录最近一次活动时间
+func (s *sessionState) touch(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = now
+}
+
+// idleTime 返回自最近一次活动以来的空闲时长
+func (s *sessionState) idleTime(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Sub(s.lastActivity)
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestSessionState 测试连接状态在 OnOpen 时创建、处理消息时更新、OnClose 时清理
+func TestSessionState(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	session := newFakeSession()
+
+	if err := listener.OnOpen(session); err != nil {
+		t.Fatalf("OnOpen 失败: %v", err)
+	}
+	state, ok := session.GetAttribute(sessionStateAttribute).(*sessionState)
+	if !ok {
+		t.Fatal("OnOpen 应在会话上创建连接状态")
+	}
+	engineSession := state.boundEngineSession()
+	if engineSession == nil || !engineSession.IsActive() || engineSession.InTransaction() {
+		t.Fatal("连接应绑定一个已开始、没有事务的存储引擎会话")
+	}
+	if stateOf(session) != state {
+		t.Fatal("同一连接应返回同一个连接状态")
+	}
+
+	t.Run("记录认证用户、当前数据库和写操作结果", func(t *testing.T) {
+		user := &UserIdentity{User: "alice", DB: "admin"}
+		SetAuthenticatedUser(session, user)
+		if AuthenticatedUser(session) != user || state.authenticatedUser() != user {
+			t.Error("认证用户应记录在连接状态上")
+		}
+		SetAuthenticatedUser(session, nil)
+		if AuthenticatedUser(session) != nil {
+			t.Error("注销后不应有认证用户")
+		}
+
+		listener.OnMessage(session, newOpMsgMessage(1, bsoncore.NewDocumentBuilder().
+			AppendInt32("ping", 1).
+			AppendString("$db", "shop").
+			Build()))
+		if db := state.currentDatabase(); db != "shop" {
+			t.Errorf("当前数据库应为 shop, got %q", db)
+		}
+		req, err := newCommandRequest(session, bsoncore.NewDocumentBuilder().AppendInt32("ping", 1).Build(), nil)
+		if err != nil || req.db != "shop" {
+			t.Errorf("未指定 $db 的命令应沿用当前数据库: %v %v", req, err)
+		}
+		if other := newFakeSession(); stateOf(other) == state || stateOf(other).currentDatabase() != "" {
+			t.Error("不同连接的状态应相互独立")
+		}
+
+		sendRawOn(t, listener, session, rawInsert(2, "shop.items", 0, bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).Build()))
+		if last := state.lastWrite(); last == nil || last.n != 1 || last.err != nil {
+			t.Errorf("旧版写操作结果应记录在连接状态上: %+v", last)
+		}
+	})
+
+	t.Run("关闭连接时清理状态并回滚事务", func(t *testing.T) {
+		if err := engineSession.BeginTransaction(context.Background()); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+		listener.OnClose(session)
+		if session.GetAttribute(sessionStateAttribute) != nil {
+			t.Error("OnClose 应移除连接状态")
+		}
+		if engineSession.InTransaction() || engineSession.IsActive() {
+			t.Error("OnClose 应回滚事务并结束存储引擎会话")
+		}
+		if state.boundEngineSession() != nil {
+			t.Error("关闭后连接状态不应再持有存储引擎会话")
+		}
+		// 重复清理不应出错
+		listener.OnClose(session)
+	})
+}
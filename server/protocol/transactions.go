@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/zhukovaskychina/xmongodb/logger"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+func init() {
+	registerCommand("commitTransaction", ActionNone, (*EventListener).cmdCommitTransaction)
+	registerCommand("abortTransaction", ActionNone, (*EventListener).cmdAbortTransaction)
+}
+
+// transactionCommands 可以在多文档事务中执行的命令
+var transactionCommands = map[string]bool{
+	"find":              true,
+	"getMore":           true,
+	"killCursors":       true,
+	"aggregate":         true,
+	"distinct":          true,
+	"insert":            true,
+	"update":            true,
+	"delete":            true,
+	"bulkWrite":         true,
+	"commitTransaction": true,
+	"abortTransaction":  true,
+}
+
+// txnState 逻辑会话上最近一个事务的状态
+type txnState int
+
+const (
+	txnNone txnState = iota
+	txnInProgress
+	txnCommitted
+	txnAborted
+)
+
+// transactionFields 命令文档中的事务字段
+type transactionFields struct {
+	lsid         string // 逻辑会话的键，见 lsidKey
+	txnNumber    int64
+	hasTxnNumber bool
+	autocommit   *bool
+	start        bool
+}
+
+// parseTransactionFields 解析命令文档中的 lsid、txnNumber、autocommit 和 startTransaction
+func parseTransactionFields(body bsoncore.Document) (*transactionFields, error) {
+	f := &transactionFields{}
+	if v, err := body.LookupErr("lsid"); err == nil {
+		key, err := lsidKey("lsid", v)
+		if err != nil {
+			return nil, err
+		}
+		f.lsid = key
+	}
+	if v, err := body.LookupErr("txnNumber"); err == nil {
+		n, ok := v.AsInt64OK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'txnNumber' is the wrong type '%s', expected type 'long'", v.Type)
+		}
+		f.txnNumber, f.hasTxnNumber = n, true
+	}
+	if v, err := body.LookupErr("autocommit"); err == nil {
+		b, ok := v.BooleanOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'autocommit' is the wrong type '%s', expected type 'bool'", v.Type)
+		}
+		f.autocommit = &b
+	}
+	if v, err := body.LookupErr("startTransaction"); err == nil {
+		b, ok := v.BooleanOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'startTransaction' is the wrong type '%s', expected type 'bool'", v.Type)
+		}
+		f.start = b
+	}
+	return f, nil
+}
+
+// isWriteCommand 命令是否会修改文档
+// bulkWrite 注册时不声明动作，由处理函数按操作类型鉴权，需要单独判断
+func isWriteCommand(spec *commandSpec) bool {
+	switch spec.action {
+	case ActionInsert, ActionUpdate, ActionRemove:
+		return true
+	}
+	return spec.name == "bulkWrite"
+}
+
+// enterTransaction 根据命令的事务字段找到所属的逻辑会话，startTransaction 时开始新事务
+// 命令属于事务时返回已加锁的逻辑会话，调用方执行完命令后负责解锁；不属于事务时返回 nil
+func (l *EventListener) enterTransaction(ctx context.Context, req *commandRequest, spec *commandSpec, f *transactionFields) (*logicalSession, error) {
+	if f.autocommit == nil {
+		if req.name == "commitTransaction" || req.name == "abortTransaction" {
+			return nil, NewCommandError(CodeInvalidOptions, "%s must be run within a transaction", req.name)
+		}
+		if f.start {
+			return nil, NewCommandError(CodeInvalidOptions, "'startTransaction' requires 'autocommit' to be false")
+		}
+		// 事务进行中时，同一逻辑会话上不属于事务的写操作会绕过事务，直接拒绝
+		// 携带 txnNumber 的可重试写操作由 beginRetryableWrite 处理
+		if f.lsid != "" && !f.hasTxnNumber && isWriteCommand(spec) {
+			if s := logicalSessions.lookup(f.lsid); s != nil {
+				s.mu.Lock()
+				inProgress := s.state == txnInProgress
+				s.mu.Unlock()
+				if inProgress {
+					return nil, NewCommandError(CodeOperationNotSupportedInTx,
+						"Cannot run '%s' outside of the transaction in progress on this session; commit or abort it first", req.name)
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	if *f.autocommit {
+		return nil, NewCommandError(CodeInvalidOptions, "Specifying autocommit=true is not allowed.")
+	}
+	if f.lsid == "" {
+		return nil, NewCommandError(CodeInvalidOptions, "Transactions require a logical session id")
+	}
+	if !f.hasTxnNumber {
+		return nil, NewCommandError(CodeInvalidOptions, "'autocommit' field requires a transaction number to also be specified")
+	}
+	if !transactionCommands[req.name] {
+		return nil, NewCommandError(CodeOperationNotSupportedInTx, "Cannot run '%s' in a multi-document transaction.", req.name)
+	}
+
+	s := logicalSessions.get(f.lsid)
+	s.mu.Lock()
+	if err := s.checkTransaction(ctx, req.name, f); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkTransaction 检查命令的 txnNumber 与逻辑会话的事务状态是否相符，调用方需持有 s.mu
+func (s *logicalSession) checkTransaction(ctx context.Context, name string, f *transactionFields) error {
+	if f.txnNumber < s.txnNumber {
+		return NewCommandError(CodeTransactionTooOld,
+			"Cannot start transaction %d on session because a newer transaction %d has already started.", f.txnNumber, s.txnNumber)
+	}
+
+	if f.start {
+		if f.txnNumber == s.txnNumber && s.state != txnNone {
+			return NewCommandError(CodeConflictingOperation, "Transaction %d has already been started.", f.txnNumber)
+		}
+		// 更大的 txnNumber 开始新事务，未结束的旧事务被中止
+		if s.state == txnInProgress {
+			s.abort(ctx)
+		}
+		if err := s.engineSession.BeginTransaction(ctx); err != nil {
+			return err
+		}
+		s.txnNumber, s.state, s.retryResult = f.txnNumber, txnInProgress, nil
+		return nil
+	}
+
+	if f.txnNumber != s.txnNumber || s.state == txnNone {
+		return NewCommandError(CodeNoSuchTransaction, "Given transaction number %d does not match any in-progress transactions.", f.txnNumber)
+	}
+	switch s.state {
+	case txnAborted:
+		return NewCommandError(CodeNoSuchTransaction, "Transaction %d has been aborted.", f.txnNumber)
+	case txnCommitted:
+		// 重试 commitTransaction 时直接返回成功
+		if name != "commitTransaction" {
+			return NewCommandError(CodeTransactionCommitted, "Transaction %d has been committed.", f.txnNumber)
+		}
+	}
+	return nil
+}
+
+// abort 回滚进行中的事务，调用方需持有 s.mu
+func (s *logicalSession) abort(ctx context.Context) {
+	if s.state != txnInProgress {
+		return
+	}
+	s.state = txnAborted
+	if err := s.engineSession.RollbackTransaction(ctx); err != nil {
+		logger.Errorf("回滚会话 %s 的事务失败: %v", s.engineSession.GetSessionId(), err)
+	}
+}
+
+// cmdCommitTransaction 提交逻辑会话上进行中的事务
+func (l *EventListener) cmdCommitTransaction(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	s := req.txn
+	if s.state == txnInProgress {
+		if err := s.engineSession.CommitTransaction(ctx); err != nil {
+			s.state = txnAborted
+			return nil, err
+		}
+		s.state = txnCommitted
+	}
+	return bsoncore.NewDocumentBuilder(), nil
+}
+
+// cmdAbortTransaction 中止逻辑会话上进行中的事务，撤销事务中的全部写操作
+func (l *EventListener) cmdAbortTransaction(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	s := req.txn
+	if s.state == txnCommitted {
+		return nil, NewCommandError(CodeTransactionCommitted, "Transaction %d has been committed.", s.txnNumber)
+	}
+	s.abort(ctx)
+	return bsoncore.NewDocumentBuilder(), nil
+}
@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// appendFields 复制命令文档并由 extra 在末尾追加字段
+func appendFields(t *testing.T, cmd bsoncore.Document, extra func(*bsoncore.DocumentBuilder)) bsoncore.Document {
+	t.Helper()
+	elems, err := cmd.Elements()
+	if err != nil {
+		t.Fatalf("读取命令文档失败: %v", err)
+	}
+	builder := bsoncore.NewDocumentBuilder()
+	for _, elem := range elems {
+		builder.AppendValue(elem.Key(), elem.Value())
+	}
+	extra(builder)
+	return builder.Build()
+}
+
+// withTransaction 在命令文档末尾加上 lsid、txnNumber 和 autocommit: false，start 为 true 时加上 startTransaction
+func withTransaction(t *testing.T, cmd bsoncore.Document, lsid uuid.UUID, txnNumber int64, start bool) bsoncore.Document {
+	t.Helper()
+	return appendFields(t, cmd, func(b *bsoncore.DocumentBuilder) {
+		b.StartDocument("lsid").AppendBinary("id", 4, lsid[:]).FinishDocument().
+			AppendInt64("txnNumber", txnNumber).
+			AppendBoolean("autocommit", false)
+		if start {
+			b.AppendBoolean("startTransaction", true)
+		}
+	})
+}
+
+// endTransactionCommandDocument 构造 commitTransaction/abortTransaction 命令文档
+func endTransactionCommandDocument(t *testing.T, name string, lsid uuid.UUID, txnNumber int64) bsoncore.Document {
+	cmd := bsoncore.NewDocumentBuilder().AppendInt32(name, 1).AppendString("$db", "admin").Build()
+	return withTransaction(t, cmd, lsid, txnNumber, false)
+}
+
+// TestTransactions 测试 startTransaction/commitTransaction/abortTransaction
+func TestTransactions(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	requestID := int32(0)
+	// 每条命令使用新的连接，与连接池中的驱动一样，事务按 lsid 跟踪而不依赖连接
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+	mustRun := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		reply := run(cmd)
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+		if _, err := reply.LookupErr("writeErrors"); err == nil {
+			t.Fatalf("命令返回写错误: %s", reply)
+		}
+		return reply
+	}
+	count := func(coll string) int {
+		t.Helper()
+		cmd := bsoncore.NewDocumentBuilder().AppendString("find", coll).AppendString("$db", "bank").Build()
+		_, docs := cursorBatch(t, mustRun(cmd), "firstBatch")
+		return len(docs)
+	}
+	doc := func(id int32) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).Build()
+	}
+	expectCode := func(reply bsoncore.Document, code ErrorCode) {
+		t.Helper()
+		if reply.Lookup("ok").Double() != 0 || reply.Lookup("code").Int32() != int32(code) {
+			t.Errorf("应返回错误码 %d (%s): %s", code, code.Name(), reply)
+		}
+	}
+
+	t.Run("提交后两次插入都可见", func(t *testing.T) {
+		lsid := uuid.New()
+		mustRun(withTransaction(t, insertCommandDocument("bank", "committed", doc(1)), lsid, 1, true))
+		mustRun(withTransaction(t, insertCommandDocument("bank", "committed", doc(2)), lsid, 1, false))
+
+		// 事务内的读取能看到自己的写入
+		find := bsoncore.NewDocumentBuilder().AppendString("find", "committed").AppendString("$db", "bank").Build()
+		if _, docs := cursorBatch(t, mustRun(withTransaction(t, find, lsid, 1, false)), "firstBatch"); len(docs) != 2 {
+			t.Errorf("事务内应读到 2 个文档, got %d", len(docs))
+		}
+
+		mustRun(endTransactionCommandDocument(t, "commitTransaction", lsid, 1))
+		if n := count("committed"); n != 2 {
+			t.Errorf("提交后应有 2 个文档, got %d", n)
+		}
+		// 重试提交返回成功
+		mustRun(endTransactionCommandDocument(t, "commitTransaction", lsid, 1))
+		expectCode(run(endTransactionCommandDocument(t, "abortTransaction", lsid, 1)), CodeTransactionCommitted)
+	})
+
+	t.Run("中止后不保留任何写入", func(t *testing.T) {
+		lsid := uuid.New()
+		mustRun(insertCommandDocument("bank", "aborted", doc(1)))
+		mustRun(withTransaction(t, insertCommandDocument("bank", "aborted", doc(2)), lsid, 1, true))
+		mustRun(withTransaction(t, insertCommandDocument("bank", "aborted", doc(3)), lsid, 1, false))
+		set := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendInt32("_id", 1).FinishDocument().
+			StartDocument("u").StartDocument("$set").AppendBoolean("touched", true).FinishDocument().FinishDocument().
+			Build()
+		mustRun(withTransaction(t, updateCommandDocument("bank", "aborted", set), lsid, 1, false))
+
+		mustRun(endTransactionCommandDocument(t, "abortTransaction", lsid, 1))
+		cmd := bsoncore.NewDocumentBuilder().AppendString("find", "aborted").AppendString("$db", "bank").Build()
+		_, docs := cursorBatch(t, mustRun(cmd), "firstBatch")
+		if len(docs) != 1 {
+			t.Fatalf("中止后只应保留事务前的 1 个文档, got %d", len(docs))
+		}
+		if _, err := docs[0].LookupErr("touched"); err == nil {
+			t.Errorf("中止后更新应被撤销: %s", docs[0])
+		}
+		expectCode(run(withTransaction(t, insertCommandDocument("bank", "aborted", doc(4)), lsid, 1, false)), CodeNoSuchTransaction)
+		expectCode(run(endTransactionCommandDocument(t, "commitTransaction", lsid, 1)), CodeNoSuchTransaction)
+	})
+
+	t.Run("写错误中止事务", func(t *testing.T) {
+		lsid := uuid.New()
+		mustRun(withTransaction(t, insertCommandDocument("bank", "dup", doc(1)), lsid, 1, true))
+		reply := run(withTransaction(t, insertCommandDocument("bank", "dup", doc(1)), lsid, 1, false))
+		if _, err := reply.LookupErr("writeErrors"); err != nil {
+			t.Fatalf("重复键应返回写错误: %s", reply)
+		}
+		expectCode(run(endTransactionCommandDocument(t, "commitTransaction", lsid, 1)), CodeNoSuchTransaction)
+		if n := count("dup"); n != 0 {
+			t.Errorf("中止的事务不应保留写入, got %d", n)
+		}
+	})
+
+	t.Run("事务进行中拒绝事务外的写操作", func(t *testing.T) {
+		lsid := uuid.New()
+		mustRun(withTransaction(t, insertCommandDocument("bank", "outside", doc(1)), lsid, 1, true))
+		outside := appendFields(t, insertCommandDocument("bank", "outside", doc(2)), func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("lsid").AppendBinary("id", 4, lsid[:]).FinishDocument()
+		})
+		expectCode(run(outside), CodeOperationNotSupportedInTx)
+
+		mustRun(endTransactionCommandDocument(t, "commitTransaction", lsid, 1))
+		mustRun(outside)
+		if n := count("outside"); n != 2 {
+			t.Errorf("提交后事务外的写操作应可以执行, got %d", n)
+		}
+	})
+
+	t.Run("事务字段校验", func(t *testing.T) {
+		lsid := uuid.New()
+		mustRun(withTransaction(t, insertCommandDocument("bank", "checks", doc(1)), lsid, 5, true))
+		expectCode(run(withTransaction(t, insertCommandDocument("bank", "checks", doc(2)), lsid, 4, true)), CodeTransactionTooOld)
+		expectCode(run(withTransaction(t, insertCommandDocument("bank", "checks", doc(2)), lsid, 5, true)), CodeConflictingOperation)
+		expectCode(run(withTransaction(t, insertCommandDocument("bank", "checks", doc(2)), lsid, 6, false)), CodeNoSuchTransaction)
+		create := bsoncore.NewDocumentBuilder().AppendString("createIndexes", "checks").AppendString("$db", "bank").Build()
+		expectCode(run(withTransaction(t, create, lsid, 5, false)), CodeOperationNotSupportedInTx)
+
+		// 更大的 txnNumber 开始新事务，旧事务被中止
+		mustRun(withTransaction(t, insertCommandDocument("bank", "checks", doc(2)), lsid, 6, true))
+		mustRun(endTransactionCommandDocument(t, "commitTransaction", lsid, 6))
+		cmd := bsoncore.NewDocumentBuilder().AppendString("find", "checks").AppendString("$db", "bank").Build()
+		if _, docs := cursorBatch(t, mustRun(cmd), "firstBatch"); len(docs) != 1 || docs[0].Lookup("_id").Int32() != 2 {
+			t.Errorf("只应保留新事务的写入: %v", docs)
+		}
+
+		expectCode(run(bsoncore.NewDocumentBuilder().AppendInt32("commitTransaction", 1).AppendString("$db", "admin").Build()), CodeInvalidOptions)
+		autocommit := appendFields(t, insertCommandDocument("bank", "checks", doc(3)), func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("lsid").AppendBinary("id", 4, lsid[:]).FinishDocument().
+				AppendInt64("txnNumber", 7).
+				AppendBoolean("autocommit", true)
+		})
+		expectCode(run(autocommit), CodeInvalidOptions)
+	})
+}
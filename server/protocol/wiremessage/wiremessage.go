@@ -267,6 +267,17 @@ func AppendMsgSectionType(dst []byte, stype SectionType) []byte {
 	return append(dst, byte(stype))
 }
 
+// AppendMsgSectionDocumentSequence appends the size, identifier and concatenated documents of a document sequence
+// section to dst. The section type must be appended separately.
+func AppendMsgSectionDocumentSequence(dst []byte, identifier string, docs []bsoncore.Document) []byte {
+	idx, dst := bsoncore.ReserveLength(dst)
+	dst = appendCString(dst, identifier)
+	for _, doc := range docs {
+		dst = append(dst, doc...)
+	}
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
+
 // AppendQueryFullCollectionName appends the full collection name to dst.
 func AppendQueryFullCollectionName(dst []byte, ns string) []byte {
 	return appendCString(dst, ns)
@@ -0,0 +1,362 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+func init() {
+	registerCommand("insert", ActionInsert, (*EventListener).cmdInsert)
+	registerCommand("update", ActionUpdate, (*EventListener).cmdUpdate)
+	registerCommand("delete", ActionRemove, (*EventListener).cmdDelete)
+}
+
+// collectionArgument 读取命令第一个字段中的集合名
+func collectionArgument(req *commandRequest) (string, error) {
+	coll, ok := req.body.Index(0).Value().StringValueOK()
+	if !ok || coll == "" {
+		return "", NewCommandError(CodeInvalidNamespace, "collection name must be a non-empty string")
+	}
+	return coll, nil
+}
+
+// documentsArgument 读取命令中的文档数组，参数可以在命令文档中，也可以在 OP_MSG kind 1 文档序列中
+func documentsArgument(req *commandRequest, name string) ([]bsoncore.Document, error) {
+	if docs, ok := req.sequences[name]; ok {
+		return docs, nil
+	}
+	v, err := req.body.LookupErr(name)
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field '%s.%s' is missing but a required field", req.name, name)
+	}
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s.%s' is the wrong type '%s', expected type 'array'", req.name, name, v.Type)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	docs := make([]bsoncore.Document, 0, len(values))
+	for _, value := range values {
+		doc, ok := value.DocumentOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s.%s' elements must be documents", req.name, name)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// validatedDocument 校验并解码客户端发送的文档，BSON 格式不合法时返回 InvalidBSON，不会写入存储
+func validatedDocument(raw bsoncore.Document) (storage.Document, error) {
+	if err := raw.Validate(); err != nil {
+		return nil, NewCommandError(CodeInvalidBSON, "invalid BSON document: %v", err)
+	}
+	doc, err := storage.UnmarshalDocument(raw)
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	return doc, nil
+}
+
+// orderedArgument 读取写命令的 ordered 参数，默认为 true
+func orderedArgument(req *commandRequest) bool {
+	if v, err := req.body.LookupErr("ordered"); err == nil {
+		if ordered, ok := v.BooleanOK(); ok {
+			return ordered
+		}
+	}
+	return true
+}
+
+// writeErrors 写命令中单个操作的错误列表
+type writeErrors struct {
+	array *bsoncore.ArrayBuilder
+	count int
+}
+
+// add 记录第 index 个操作的错误
+func (w *writeErrors) add(index int, err error) {
+	if w.array == nil {
+		w.array = bsoncore.NewArrayBuilder()
+	}
+	cmdErr := toCommandError(err)
+	w.array.AppendDocument(bsoncore.NewDocumentBuilder().
+		AppendInt32("index", int32(index)).
+		AppendInt32("code", int32(cmdErr.Code)).
+		AppendString("codeName", cmdErr.CodeName).
+		AppendString("errmsg", cmdErr.Message).
+		Build())
+	w.count++
+}
+
+// appendTo 有错误时向结果追加 writeErrors 字段
+func (w *writeErrors) appendTo(builder *bsoncore.DocumentBuilder) *bsoncore.DocumentBuilder {
+	if w.count > 0 {
+		builder.AppendArray("writeErrors", w.array.Build())
+	}
+	return builder
+}
+
+// cmdInsert 处理 insert 命令
+// 单个文档失败记录在 writeErrors 中，命令本身仍返回 ok: 1
+func (l *EventListener) cmdInsert(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := documentsArgument(req, "documents")
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 || len(docs) > maxWriteBatchSize {
+		return nil, NewCommandError(CodeInvalidOptions, "Write batch sizes must be between 1 and %d. Got %d operations.", maxWriteBatchSize, len(docs))
+	}
+	ordered := orderedArgument(req)
+
+	var (
+		inserted int32
+		errs     writeErrors
+	)
+	for i, raw := range docs {
+		if req.retry.skip(i) {
+			continue
+		}
+		doc, err := validatedDocument(raw)
+		if err == nil {
+			err = l.storageEngine.Insert(ctx, req.db, coll, []storage.Document{doc})
+		}
+		if err != nil {
+			errs.add(i, err)
+			if ordered {
+				break
+			}
+			continue
+		}
+		req.retry.done(i)
+		inserted++
+	}
+
+	return errs.appendTo(bsoncore.NewDocumentBuilder().AppendInt32("n", inserted)), nil
+}
+
+// updateStatement update 命令中的单个更新语句
+type updateStatement struct {
+	filter storage.Document
+	update storage.Document
+	opts   storage.UpdateOptions
+}
+
+// arrayFiltersArgument 读取更新语句的 arrayFilters 参数，未指定时返回 nil；field 为错误信息中的参数路径
+func arrayFiltersArgument(raw bsoncore.Document, field string) ([]storage.Document, error) {
+	v, err := raw.LookupErr("arrayFilters")
+	if err != nil {
+		return nil, nil
+	}
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s.arrayFilters' is the wrong type '%s', expected type 'array'", field, v.Type)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	filters := make([]storage.Document, 0, len(values))
+	for _, value := range values {
+		doc, ok := value.DocumentOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field '%s.arrayFilters' elements must be objects, got '%s'", field, value.Type)
+		}
+		parsed, err := storage.UnmarshalDocument(doc)
+		if err != nil {
+			return nil, NewCommandError(CodeFailedToParse, "%v", err)
+		}
+		filters = append(filters, parsed)
+	}
+	return filters, nil
+}
+
+// parseUpdateStatement 解析 {q: <filter>, u: <update>, multi: <bool>, upsert: <bool>, arrayFilters: [...]}
+func parseUpdateStatement(raw bsoncore.Document) (*updateStatement, error) {
+	stmt := &updateStatement{}
+	for _, field := range []string{"q", "u"} {
+		v, err := raw.LookupErr(field)
+		if err != nil {
+			return nil, NewCommandError(CodeFailedToParse, "BSON field 'update.updates.%s' is missing but a required field", field)
+		}
+		doc, ok := v.DocumentOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'update.updates.%s' is the wrong type '%s', expected type 'object'", field, v.Type)
+		}
+		parsed, err := storage.UnmarshalDocument(doc)
+		if err != nil {
+			return nil, NewCommandError(CodeFailedToParse, "%v", err)
+		}
+		if field == "q" {
+			stmt.filter = parsed
+		} else {
+			stmt.update = parsed
+		}
+	}
+	for _, field := range []string{"multi", "upsert"} {
+		v, err := raw.LookupErr(field)
+		if err != nil {
+			continue
+		}
+		flag, ok := v.BooleanOK()
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "BSON field 'update.updates.%s' is the wrong type '%s', expected type 'bool'", field, v.Type)
+		}
+		if field == "multi" {
+			stmt.opts.Multi = flag
+		} else {
+			stmt.opts.Upsert = flag
+		}
+	}
+	var err error
+	if stmt.opts.ArrayFilters, err = arrayFiltersArgument(raw, "update.updates"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// cmdUpdate 处理 update 命令
+// upsert 插入的文档记录在 upserted 数组中；单个语句失败记录在 writeErrors 中，命令本身仍返回 ok: 1
+func (l *EventListener) cmdUpdate(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	statements, err := documentsArgument(req, "updates")
+	if err != nil {
+		return nil, err
+	}
+	if len(statements) == 0 || len(statements) > maxWriteBatchSize {
+		return nil, NewCommandError(CodeInvalidOptions, "Write batch sizes must be between 1 and %d. Got %d operations.", maxWriteBatchSize, len(statements))
+	}
+	ordered := orderedArgument(req)
+
+	var (
+		matched, modified int32
+		upserted          *bsoncore.ArrayBuilder
+		errs              writeErrors
+	)
+	for i, raw := range statements {
+		if req.retry.skip(i) {
+			continue
+		}
+		var result *storage.UpdateResult
+		stmt, err := parseUpdateStatement(raw)
+		if err == nil {
+			result, err = l.storageEngine.Update(ctx, req.db, coll, stmt.filter, stmt.update, stmt.opts)
+		}
+		var entry []byte
+		if err == nil && result.UpsertedID != nil {
+			entry, err = storage.MarshalDocument(storage.Document{"index": int32(i), "_id": result.UpsertedID})
+		}
+		if err != nil {
+			errs.add(i, err)
+			if ordered {
+				break
+			}
+			continue
+		}
+
+		req.retry.done(i)
+		// upsert 插入的文档计入 n，但不计入 nModified
+		matched += int32(result.Matched)
+		modified += int32(result.Modified)
+		if entry != nil {
+			if upserted == nil {
+				upserted = bsoncore.NewArrayBuilder()
+			}
+			upserted.AppendDocument(entry)
+			matched++
+		}
+	}
+
+	builder := bsoncore.NewDocumentBuilder().
+		AppendInt32("n", matched).
+		AppendInt32("nModified", modified)
+	if upserted != nil {
+		builder.AppendArray("upserted", upserted.Build())
+	}
+	return errs.appendTo(builder), nil
+}
+
+// deleteStatement delete 命令中的单个删除语句
+type deleteStatement struct {
+	filter  storage.Document
+	justOne bool
+}
+
+// parseDeleteStatement 解析 {q: <filter>, limit: <0|1>}
+func parseDeleteStatement(raw bsoncore.Document) (*deleteStatement, error) {
+	v, err := raw.LookupErr("q")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'delete.deletes.q' is missing but a required field")
+	}
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'delete.deletes.q' is the wrong type '%s', expected type 'object'", v.Type)
+	}
+	filter, err := storage.UnmarshalDocument(doc)
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+	v, err = raw.LookupErr("limit")
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "BSON field 'delete.deletes.limit' is missing but a required field")
+	}
+	limit, ok := v.AsInt64OK()
+	if !ok || (limit != 0 && limit != 1) {
+		return nil, NewCommandError(CodeFailedToParse, "The limit field in delete objects must be 0 or 1. Got %s", v)
+	}
+	return &deleteStatement{filter: filter, justOne: limit == 1}, nil
+}
+
+// cmdDelete 处理 delete 命令
+// 单个语句失败记录在 writeErrors 中，命令本身仍返回 ok: 1
+func (l *EventListener) cmdDelete(ctx context.Context, req *commandRequest) (*bsoncore.DocumentBuilder, error) {
+	coll, err := collectionArgument(req)
+	if err != nil {
+		return nil, err
+	}
+	statements, err := documentsArgument(req, "deletes")
+	if err != nil {
+		return nil, err
+	}
+	if len(statements) == 0 || len(statements) > maxWriteBatchSize {
+		return nil, NewCommandError(CodeInvalidOptions, "Write batch sizes must be between 1 and %d. Got %d operations.", maxWriteBatchSize, len(statements))
+	}
+	ordered := orderedArgument(req)
+
+	var (
+		deleted int64
+		errs    writeErrors
+	)
+	for i, raw := range statements {
+		if req.retry.skip(i) {
+			continue
+		}
+		var n int64
+		stmt, err := parseDeleteStatement(raw)
+		if err == nil {
+			n, err = l.storageEngine.Delete(ctx, req.db, coll, stmt.filter, stmt.justOne)
+		}
+		if err != nil {
+			errs.add(i, err)
+			if ordered {
+				break
+			}
+			continue
+		}
+		req.retry.done(i)
+		deleted += n
+	}
+
+	return errs.appendTo(bsoncore.NewDocumentBuilder().AppendInt32("n", int32(deleted))), nil
+}
@@ -0,0 +1,401 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// updateCommandDocument 构造 update 命令文档
+func updateCommandDocument(db, coll string, statements ...bsoncore.Document) bsoncore.Document {
+	arr := bsoncore.NewArrayBuilder()
+	for _, stmt := range statements {
+		arr.AppendDocument(stmt)
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("update", coll).
+		AppendArray("updates", arr.Build()).
+		AppendString("$db", db).
+		Build()
+}
+
+// TestUpdateCommand 测试 update 命令和 upsert 的 upserted 结果
+func TestUpdateCommand(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	send := func(id int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		reply := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(id, doc)))
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+		return reply
+	}
+	alice := bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("name", "Alice").Build()
+	send(1, insertCommandDocument("test", "users", alice))
+
+	t.Run("更新已有文档", func(t *testing.T) {
+		stmt := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendString("name", "Alice").FinishDocument().
+			StartDocument("u").StartDocument("$set").AppendInt32("age", 30).FinishDocument().FinishDocument().
+			Build()
+		reply := send(2, updateCommandDocument("test", "users", stmt))
+		if reply.Lookup("n").Int32() != 1 || reply.Lookup("nModified").Int32() != 1 {
+			t.Errorf("更新结果不正确: %s", reply)
+		}
+		if _, err := reply.LookupErr("upserted"); err == nil {
+			t.Errorf("没有插入时不应返回 upserted: %s", reply)
+		}
+	})
+
+	t.Run("upsert 返回插入的 _id", func(t *testing.T) {
+		noMatch := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendString("name", "Bob").FinishDocument().
+			StartDocument("u").StartDocument("$set").AppendInt32("age", 25).FinishDocument().FinishDocument().
+			AppendBoolean("upsert", true).
+			Build()
+		replacement := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendInt32("_id", 3).FinishDocument().
+			StartDocument("u").AppendString("name", "Carol").FinishDocument().
+			AppendBoolean("upsert", true).
+			Build()
+		reply := send(3, updateCommandDocument("test", "users", noMatch, replacement))
+		if reply.Lookup("n").Int32() != 2 || reply.Lookup("nModified").Int32() != 0 {
+			t.Errorf("upsert 计数不正确: %s", reply)
+		}
+		upserted, err := reply.Lookup("upserted").Array().Values()
+		if err != nil || len(upserted) != 2 {
+			t.Fatalf("应返回两个 upserted 条目: %s", reply)
+		}
+		first := upserted[0].Document()
+		if first.Lookup("index").Int32() != 0 || first.Lookup("_id").Type != bsoncore.TypeObjectID {
+			t.Errorf("第一个 upsert 应生成 ObjectId: %s", first)
+		}
+		second := upserted[1].Document()
+		if second.Lookup("index").Int32() != 1 || second.Lookup("_id").Int32() != 3 {
+			t.Errorf("第二个 upsert 应使用过滤条件中的 _id: %s", second)
+		}
+
+		find := bsoncore.NewDocumentBuilder().
+			AppendString("find", "users").
+			StartDocument("filter").AppendString("name", "Bob").FinishDocument().
+			AppendString("$db", "test").
+			Build()
+		_, docs := cursorBatch(t, send(4, find), "firstBatch")
+		if len(docs) != 1 || docs[0].Lookup("age").Int32() != 25 {
+			t.Errorf("upsert 插入的文档应包含查询中的等值字段: %v", docs)
+		}
+	})
+
+	t.Run("语句错误记录在 writeErrors 中", func(t *testing.T) {
+		bad := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendInt32("_id", 1).FinishDocument().
+			StartDocument("u").StartDocument("$set").AppendInt32("_id", 2).FinishDocument().FinishDocument().
+			Build()
+		reply := send(5, updateCommandDocument("test", "users", bad))
+		writeErrors, err := reply.Lookup("writeErrors").Array().Values()
+		if err != nil || len(writeErrors) != 1 || writeErrors[0].Document().Lookup("code").Int32() != int32(CodeBadValue) {
+			t.Errorf("修改 _id 应返回 BadValue writeError: %s", reply)
+		}
+	})
+
+	t.Run("arrayFilters", func(t *testing.T) {
+		scores := bsoncore.NewDocumentBuilder().
+			AppendInt32("_id", 10).
+			AppendArray("scores", bsoncore.NewArrayBuilder().AppendInt32(50).AppendInt32(85).AppendInt32(95).Build()).
+			Build()
+		send(6, insertCommandDocument("test", "users", scores))
+		stmt := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendInt32("_id", 10).FinishDocument().
+			StartDocument("u").StartDocument("$inc").AppendInt32("scores.$[s]", 5).FinishDocument().FinishDocument().
+			AppendArray("arrayFilters", bsoncore.NewArrayBuilder().
+				AppendDocument(bsoncore.NewDocumentBuilder().StartDocument("s").AppendInt32("$gte", 80).FinishDocument().Build()).
+				Build()).
+			Build()
+		if reply := send(7, updateCommandDocument("test", "users", stmt)); reply.Lookup("nModified").Int32() != 1 {
+			t.Fatalf("更新结果不正确: %s", reply)
+		}
+		find := bsoncore.NewDocumentBuilder().
+			AppendString("find", "users").
+			StartDocument("filter").AppendInt32("_id", 10).FinishDocument().
+			AppendString("$db", "test").
+			Build()
+		_, docs := cursorBatch(t, send(8, find), "firstBatch")
+		if len(docs) != 1 {
+			t.Fatalf("应找到一个文档: %v", docs)
+		}
+		values, _ := docs[0].Lookup("scores").Array().Values()
+		if len(values) != 3 || values[0].Int32() != 50 || values[1].Int32() != 90 || values[2].Int32() != 100 {
+			t.Errorf("只应更新不小于 80 的元素: %s", docs[0])
+		}
+
+		bad := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendInt32("_id", 10).FinishDocument().
+			StartDocument("u").StartDocument("$set").AppendInt32("scores.$[s]", 0).FinishDocument().FinishDocument().
+			AppendString("arrayFilters", "s").
+			Build()
+		reply := send(9, updateCommandDocument("test", "users", bad))
+		writeErrors, err := reply.Lookup("writeErrors").Array().Values()
+		if err != nil || len(writeErrors) != 1 || writeErrors[0].Document().Lookup("code").Int32() != int32(CodeTypeMismatch) {
+			t.Errorf("arrayFilters 不是数组时应返回 TypeMismatch writeError: %s", reply)
+		}
+	})
+}
+
+// deleteStatementDocument 构造 {q: filter, limit: limit} 删除语句
+func deleteStatementDocument(filter bsoncore.Document, limit int32) bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().AppendDocument("q", filter).AppendInt32("limit", limit).Build()
+}
+
+// deleteCommandDocument 构造 delete 命令文档
+func deleteCommandDocument(db, coll string, statements ...bsoncore.Document) bsoncore.Document {
+	arr := bsoncore.NewArrayBuilder()
+	for _, stmt := range statements {
+		arr.AppendDocument(stmt)
+	}
+	return bsoncore.NewDocumentBuilder().
+		AppendString("delete", coll).
+		AppendArray("deletes", arr.Build()).
+		AppendString("$db", db).
+		Build()
+}
+
+// TestDeleteCommand 测试 delete 命令的 limit 和 writeErrors
+func TestDeleteCommand(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	send := func(id int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		reply := replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(id, doc)))
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+		return reply
+	}
+	var docs []bsoncore.Document
+	for i := int32(1); i <= 4; i++ {
+		docs = append(docs, bsoncore.NewDocumentBuilder().AppendInt32("_id", i).AppendString("tag", "a").Build())
+	}
+	send(1, insertCommandDocument("test", "items", docs...))
+	tagA := bsoncore.NewDocumentBuilder().AppendString("tag", "a").Build()
+
+	if reply := send(2, deleteCommandDocument("test", "items", deleteStatementDocument(tagA, 1))); reply.Lookup("n").Int32() != 1 {
+		t.Errorf("limit 1 应只删除一个文档: %s", reply)
+	}
+	bad := bsoncore.NewDocumentBuilder().AppendDocument("q", tagA).AppendInt32("limit", 5).Build()
+	reply := send(3, deleteCommandDocument("test", "items", bad, deleteStatementDocument(tagA, 0)))
+	if reply.Lookup("n").Int32() != 0 {
+		t.Errorf("ordered 删除在第一个错误处停止: %s", reply)
+	}
+	errs, err := reply.Lookup("writeErrors").Array().Values()
+	if err != nil || len(errs) != 1 || errs[0].Document().Lookup("code").Int32() != int32(CodeFailedToParse) {
+		t.Errorf("非法的 limit 应记录在 writeErrors 中: %s", reply)
+	}
+	if reply := send(4, deleteCommandDocument("test", "items", deleteStatementDocument(tagA, 0))); reply.Lookup("n").Int32() != 3 {
+		t.Errorf("limit 0 应删除全部匹配的文档: %s", reply)
+	}
+}
+
+// TestMaxBsonObjectSize 测试插入和更新后超过最大长度的文档被拒绝
+func TestMaxBsonObjectSize(t *testing.T) {
+	// {_id: int32, s: string} 的 BSON 长度为字符串长度加 22 字节
+	docOfSize := func(id int32, size int) bsoncore.Document {
+		return bsoncore.NewDocumentBuilder().AppendInt32("_id", id).AppendString("s", strings.Repeat("x", size-22)).Build()
+	}
+	hello := bsoncore.NewDocumentBuilder().AppendInt32("hello", 1).AppendString("$db", "admin").Build()
+	writeErrorCode := func(reply bsoncore.Document) int32 {
+		t.Helper()
+		if reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("命令失败: %s", reply)
+		}
+		v, err := reply.LookupErr("writeErrors")
+		if err != nil {
+			return 0
+		}
+		errs, err := v.Array().Values()
+		if err != nil || len(errs) == 0 {
+			return 0
+		}
+		return errs[0].Document().Lookup("code").Int32()
+	}
+
+	t.Run("默认上限 16MB", func(t *testing.T) {
+		listener := newTestListener(t, &config.Config{})
+		run := func(id int32, doc bsoncore.Document) bsoncore.Document {
+			t.Helper()
+			return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(id, doc)))
+		}
+		if size := run(1, hello).Lookup("maxBsonObjectSize").Int32(); size != 16*1024*1024 {
+			t.Errorf("maxBsonObjectSize 应为 16MB, got %d", size)
+		}
+		under := docOfSize(1, 16*1024*1024)
+		if len(under) != 16*1024*1024 {
+			t.Fatalf("构造的文档长度为 %d", len(under))
+		}
+		if code := writeErrorCode(run(2, insertCommandDocument("test", "big", under))); code != 0 {
+			t.Errorf("等于上限的文档应能插入, code %d", code)
+		}
+		over := docOfSize(2, 16*1024*1024+1)
+		if code := writeErrorCode(run(3, insertCommandDocument("test", "big", over))); code != int32(CodeBSONObjectTooLarge) {
+			t.Errorf("超过上限的文档应返回 BSONObjectTooLarge, code %d", code)
+		}
+	})
+
+	t.Run("配置覆盖上限", func(t *testing.T) {
+		listener := newTestListener(t, &config.Config{Storage: config.StorageConfig{MaxBsonObjectSize: 1024}})
+		run := func(id int32, doc bsoncore.Document) bsoncore.Document {
+			t.Helper()
+			return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(id, doc)))
+		}
+		if size := run(1, hello).Lookup("maxBsonObjectSize").Int32(); size != 1024 {
+			t.Errorf("maxBsonObjectSize 应为配置的 1024, got %d", size)
+		}
+		if code := writeErrorCode(run(2, insertCommandDocument("test", "small", docOfSize(1, 1000)))); code != 0 {
+			t.Fatalf("1000 字节的文档应能插入, code %d", code)
+		}
+		if code := writeErrorCode(run(3, insertCommandDocument("test", "small", docOfSize(2, 1025)))); code != int32(CodeBSONObjectTooLarge) {
+			t.Errorf("超过上限的文档应返回 BSONObjectTooLarge, code %d", code)
+		}
+
+		// 更新后超过上限时拒绝更新，原文档保持不变
+		grow := bsoncore.NewDocumentBuilder().
+			StartDocument("q").AppendInt32("_id", 1).FinishDocument().
+			StartDocument("u").StartDocument("$set").AppendString("t", strings.Repeat("y", 100)).FinishDocument().FinishDocument().
+			Build()
+		if code := writeErrorCode(run(4, updateCommandDocument("test", "small", grow))); code != int32(CodeBSONObjectTooLarge) {
+			t.Errorf("更新后超过上限应返回 BSONObjectTooLarge, code %d", code)
+		}
+		find := bsoncore.NewDocumentBuilder().AppendString("find", "small").AppendString("$db", "test").Build()
+		if _, docs := cursorBatch(t, run(5, find), "firstBatch"); len(docs) != 1 || len(docs[0]) != 1000 {
+			t.Errorf("更新失败后文档不应改变: %v", docs)
+		}
+	})
+}
+
+// TestInsertInvalidBSON 测试格式不合法的文档在写入前被拒绝
+func TestInsertInvalidBSON(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(id int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(id, doc)))
+	}
+	good := bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("name", "Alice").Build()
+	// _id 改为 2 以免与 good 冲突，name 的类型改为未定义的 0x20，外层数组的长度仍然一致
+	bad := append(bsoncore.Document(nil), good...)
+	bad[bytes.Index(bad, []byte("_id\x00"))+4] = 2
+	bad[bytes.Index(bad, []byte("name\x00"))-1] = 0x20
+
+	unordered := bsoncore.NewDocumentBuilder().
+		AppendString("insert", "users").
+		AppendArray("documents", bsoncore.NewArrayBuilder().AppendDocument(bad).AppendDocument(good).Build()).
+		AppendBoolean("ordered", false).
+		AppendString("$db", "test").
+		Build()
+	reply := run(1, unordered)
+	if reply.Lookup("ok").Double() != 1 || reply.Lookup("n").Int32() != 1 {
+		t.Fatalf("应只插入合法的文档: %s", reply)
+	}
+	errs, err := reply.Lookup("writeErrors").Array().Values()
+	if err != nil || len(errs) != 1 {
+		t.Fatalf("应返回一个 writeError: %s", reply)
+	}
+	if e := errs[0].Document(); e.Lookup("index").Int32() != 0 || e.Lookup("code").Int32() != int32(CodeInvalidBSON) {
+		t.Errorf("不合法的文档应返回 InvalidBSON: %s", e)
+	}
+
+	find := bsoncore.NewDocumentBuilder().AppendString("find", "users").AppendString("$db", "test").Build()
+	if _, docs := cursorBatch(t, run(2, find), "firstBatch"); len(docs) != 1 || docs[0].Lookup("_id").Int32() != 1 {
+		t.Errorf("集合中应只有合法的文档: %v", docs)
+	}
+}
+
+// TestDocumentValidationFailure 测试通过 create 和 collMod 设置的校验规则，不满足规则的写入返回 DocumentValidationFailure
+func TestDocumentValidationFailure(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	run := func(id int32, doc bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(id, doc)))
+	}
+	validator := bsoncore.NewDocumentBuilder().
+		StartDocument("$jsonSchema").
+		AppendArray("required", bsoncore.NewArrayBuilder().AppendString("name").Build()).
+		StartDocument("properties").
+		StartDocument("age").AppendString("bsonType", "int").FinishDocument().
+		FinishDocument().
+		FinishDocument().
+		Build()
+	create := bsoncore.NewDocumentBuilder().
+		AppendString("create", "people").
+		AppendDocument("validator", validator).
+		AppendString("$db", "test").
+		Build()
+	if reply := run(100, create); reply.Lookup("ok").Double() != 1 {
+		t.Fatalf("create 失败: %s", reply)
+	}
+	writeError := func(reply bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		v, err := reply.LookupErr("writeErrors")
+		if err != nil {
+			t.Fatalf("应返回 writeErrors: %s", reply)
+		}
+		errs, err := v.Array().Values()
+		if err != nil || len(errs) != 1 {
+			t.Fatalf("应返回一个 writeError: %s", reply)
+		}
+		return errs[0].Document()
+	}
+	assertValidationFailure := func(e bsoncore.Document) {
+		t.Helper()
+		if e.Lookup("code").Int32() != int32(CodeDocumentValidation) || e.Lookup("errmsg").StringValue() != "Document failed validation" {
+			t.Errorf("应返回 DocumentValidationFailure: %s", e)
+		}
+	}
+
+	good := bsoncore.NewDocumentBuilder().AppendInt32("_id", 1).AppendString("name", "Alice").AppendInt32("age", 30).Build()
+	if reply := run(1, insertCommandDocument("test", "people", good)); reply.Lookup("n").Int32() != 1 {
+		t.Fatalf("满足规则的文档应能插入: %s", reply)
+	}
+
+	// 缺少必需字段 name
+	missing := bsoncore.NewDocumentBuilder().AppendInt32("_id", 2).AppendInt32("age", 20).Build()
+	assertValidationFailure(writeError(run(2, insertCommandDocument("test", "people", missing))))
+
+	// age 的类型不是 int
+	mismatch := bsoncore.NewDocumentBuilder().AppendInt32("_id", 3).AppendString("name", "Bob").AppendString("age", "old").Build()
+	assertValidationFailure(writeError(run(3, insertCommandDocument("test", "people", mismatch))))
+
+	update := bsoncore.NewDocumentBuilder().
+		StartDocument("q").AppendInt32("_id", 1).FinishDocument().
+		StartDocument("u").StartDocument("$set").AppendDouble("age", 30.5).FinishDocument().FinishDocument().
+		Build()
+	assertValidationFailure(writeError(run(4, updateCommandDocument("test", "people", update))))
+
+	find := bsoncore.NewDocumentBuilder().AppendString("find", "people").AppendString("$db", "test").Build()
+	if _, docs := cursorBatch(t, run(5, find), "firstBatch"); len(docs) != 1 || docs[0].Lookup("age").Int32() != 30 {
+		t.Errorf("集合中应只有未修改的合法文档: %v", docs)
+	}
+
+	// warn 方式下写入不合法的文档，改为 moderate 后已不合法的文档仍可更新，合法的文档更新后仍需满足规则
+	collMod := func(id int32, field, value string) {
+		t.Helper()
+		cmd := bsoncore.NewDocumentBuilder().AppendString("collMod", "people").AppendString(field, value).AppendString("$db", "test").Build()
+		if reply := run(id, cmd); reply.Lookup("ok").Double() != 1 {
+			t.Fatalf("collMod 失败: %s", reply)
+		}
+	}
+	collMod(6, "validationAction", "warn")
+	if reply := run(7, insertCommandDocument("test", "people", missing)); reply.Lookup("n").Int32() != 1 {
+		t.Fatalf("warn 方式应允许写入不合法的文档: %s", reply)
+	}
+	collMod(8, "validationAction", "error")
+	collMod(9, "validationLevel", "moderate")
+	legacy := bsoncore.NewDocumentBuilder().
+		StartDocument("q").AppendInt32("_id", 2).FinishDocument().
+		StartDocument("u").StartDocument("$set").AppendString("age", "unknown").FinishDocument().FinishDocument().
+		Build()
+	if reply := run(10, updateCommandDocument("test", "people", legacy)); reply.Lookup("nModified").Int32() != 1 {
+		t.Errorf("moderate 级别应允许更新已不合法的文档: %s", reply)
+	}
+	assertValidationFailure(writeError(run(11, updateCommandDocument("test", "people", update))))
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// writeConcern 命令文档中的 writeConcern 参数
+// 单节点部署中写入在本节点完成即满足任意 w，只有日志相关的要求需要额外处理
+type writeConcern struct {
+	journal bool // j: true 或 w: "majority"，确认写入前需要把日志刷到磁盘
+}
+
+// parseWriteConcern 解析命令文档中的 writeConcern，未指定时返回 nil
+func parseWriteConcern(body bsoncore.Document) (*writeConcern, error) {
+	v, err := body.LookupErr("writeConcern")
+	if err != nil {
+		return nil, nil
+	}
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "BSON field 'writeConcern' is the wrong type '%s', expected type 'object'", v.Type)
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, NewCommandError(CodeFailedToParse, "%v", err)
+	}
+
+	wc := &writeConcern{}
+	for _, elem := range elems {
+		v := elem.Value()
+		switch elem.Key() {
+		case "w":
+			if mode, ok := v.StringValueOK(); ok {
+				wc.journal = wc.journal || mode == "majority"
+			} else if !v.IsNumber() {
+				return nil, NewCommandError(CodeFailedToParse, "w has to be a number or string")
+			}
+		case "j":
+			j, ok := v.BooleanOK()
+			if !ok {
+				n, isNumber := v.AsInt64OK()
+				if !isNumber {
+					return nil, NewCommandError(CodeTypeMismatch, "BSON field 'writeConcern.j' is the wrong type '%s', expected type 'bool'", v.Type)
+				}
+				j = n != 0
+			}
+			wc.journal = wc.journal || j
+		case "fsync":
+			if fsync, ok := v.BooleanOK(); ok && fsync {
+				wc.journal = true
+			}
+		case "wtimeout", "provenance":
+		default:
+			return nil, NewCommandError(CodeFailedToParse, "unrecognized write concern field: %s", elem.Key())
+		}
+	}
+	return wc, nil
+}
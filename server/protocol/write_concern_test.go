@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// TestWriteConcern 测试 writeConcern 的校验，要求日志落盘的写关注正常确认写入
+func TestWriteConcern(t *testing.T) {
+	listener := newTestListener(t, &config.Config{})
+	requestID := int32(0)
+	run := func(cmd bsoncore.Document) bsoncore.Document {
+		t.Helper()
+		requestID++
+		return replyDocument(t, listener.handleMessage(newFakeSession(), newOpMsgMessage(requestID, cmd)))
+	}
+	insert := func(id int32, wc func(b *bsoncore.DocumentBuilder)) bsoncore.Document {
+		cmd := insertCommandDocument("test", "items", bsoncore.NewDocumentBuilder().AppendInt32("_id", id).Build())
+		return run(appendFields(t, cmd, wc))
+	}
+
+	reply := insert(1, func(b *bsoncore.DocumentBuilder) {
+		b.StartDocument("writeConcern").AppendInt32("w", 1).AppendBoolean("j", true).FinishDocument()
+	})
+	if reply.Lookup("ok").Double() != 1 || reply.Lookup("n").Int32() != 1 {
+		t.Errorf("j: true 的写入应成功: %s", reply)
+	}
+	reply = insert(2, func(b *bsoncore.DocumentBuilder) {
+		b.StartDocument("writeConcern").AppendString("w", "majority").AppendInt32("wtimeout", 1000).FinishDocument()
+	})
+	if reply.Lookup("ok").Double() != 1 || reply.Lookup("n").Int32() != 1 {
+		t.Errorf("w: majority 的写入应成功: %s", reply)
+	}
+
+	for _, tc := range []struct {
+		name string
+		wc   func(b *bsoncore.DocumentBuilder)
+		code ErrorCode
+	}{
+		{"writeConcern 不是文档", func(b *bsoncore.DocumentBuilder) { b.AppendInt32("writeConcern", 1) }, CodeTypeMismatch},
+		{"j 类型错误", func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("writeConcern").AppendString("j", "yes").FinishDocument()
+		}, CodeTypeMismatch},
+		{"w 类型错误", func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("writeConcern").AppendBoolean("w", true).FinishDocument()
+		}, CodeFailedToParse},
+		{"未知字段", func(b *bsoncore.DocumentBuilder) {
+			b.StartDocument("writeConcern").AppendInt32("bogus", 1).FinishDocument()
+		}, CodeFailedToParse},
+	} {
+		reply := insert(3, tc.wc)
+		if reply.Lookup("ok").Double() != 0 || reply.Lookup("code").Int32() != int32(tc.code) {
+			t.Errorf("%s: 应返回错误码 %d: %s", tc.name, tc.code, reply)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
@@ -18,7 +19,9 @@ import (
 type MongoDBServer struct {
 	config        *config.Config
 	tcpServer     getty.Server
+	sslProxy      *sslSniffingProxy // allowSSL/preferSSL 模式下的对外监听
 	storageEngine storage.Engine
+	rateLimiter   *protocol.RateLimiter // 所有连接共享的命令限流器
 	mu            sync.RWMutex
 	running       bool
 	ctx           context.Context
@@ -53,9 +56,15 @@ func (s *MongoDBServer) Start() error {
 	if err != nil {
 		return fmt.Errorf("初始化存储引擎失败: %w", err)
 	}
+	if err := s.storageEngine.Start(); err != nil {
+		return fmt.Errorf("启动存储引擎失败: %w", err)
+	}
+
+	s.rateLimiter = protocol.NewRateLimiter(s.config.Network)
 
 	// 创建 TCP 服务器
 	if err := s.startTCPServer(); err != nil {
+		s.storageEngine.Stop()
 		return fmt.Errorf("启动 TCP 服务器失败: %w", err)
 	}
 
@@ -76,6 +85,9 @@ func (s *MongoDBServer) Stop() error {
 	logger.Info("正在关闭 XMongoDB 服务器...")
 
 	// 关闭 TCP 服务器
+	if s.sslProxy != nil {
+		s.sslProxy.Close()
+	}
 	if s.tcpServer != nil {
 		s.tcpServer.Close()
 	}
@@ -97,10 +109,46 @@ func (s *MongoDBServer) Stop() error {
 
 // startTCPServer 启动 TCP 服务器
 func (s *MongoDBServer) startTCPServer() error {
+	addr := fmt.Sprintf("%s:%d", s.config.Server.BindAddress, s.config.Server.Port)
+
+	mode := s.config.Security.SSLMode
+	if mode == "" {
+		mode = SSLModeDisabled
+	}
+
+	// 启用 TLS 时先加载证书，证书缺失或无法解析则拒绝启动
+	var tlsConfig *tls.Config
+	switch mode {
+	case SSLModeDisabled:
+	case SSLModeAllow, SSLModePrefer, SSLModeRequire:
+		var err error
+		if tlsConfig, err = buildTLSConfig(s.config.Security); err != nil {
+			return fmt.Errorf("加载 TLS 配置失败: %w", err)
+		}
+	default:
+		return fmt.Errorf("不支持的 SSL 模式: %s", mode)
+	}
+
 	// Getty 服务器选项
-	options := []getty.ServerOption{
-		getty.WithLocalAddress(fmt.Sprintf("%s:%d", s.config.Server.BindAddress, s.config.Server.Port)),
+	listenAddr := addr
+	options := []getty.ServerOption{}
+	switch mode {
+	case SSLModeRequire:
+		options = append(options,
+			getty.WithServerSslEnabled(true),
+			getty.WithServerTlsConfigBuilder(&staticTLSConfigBuilder{config: tlsConfig}),
+		)
+	case SSLModeAllow, SSLModePrefer:
+		// 明文与 TLS 共用端口：Getty 只监听本地回环随机端口，由代理对外服务
+		// 代理先于 getty 创建，newSession 中据此取得客户端的真实地址；代理的限制见 sslSniffingProxy
+		listenAddr = "127.0.0.1:0"
+		proxy, err := newSSLSniffingProxy(addr, tlsConfig, s.config.Network)
+		if err != nil {
+			return err
+		}
+		s.sslProxy = proxy
 	}
+	options = append(options, getty.WithLocalAddress(listenAddr))
 
 	// 创建 Getty 服务器
 	s.tcpServer = getty.NewTCPServer(options...)
@@ -108,7 +156,11 @@ func (s *MongoDBServer) startTCPServer() error {
 	// 设置事件处理器
 	s.tcpServer.RunEventLoop(s.newSession)
 
-	logger.Infof("TCP 服务器监听在 %s:%d", s.config.Server.BindAddress, s.config.Server.Port)
+	if s.sslProxy != nil {
+		s.sslProxy.start(s.tcpServer.(getty.StreamServer).Listener().Addr().String())
+	}
+
+	logger.Infof("TCP 服务器监听在 %s (SSL 模式: %s)", addr, mode)
 
 	go func() {
 		select {
@@ -123,13 +175,20 @@ func (s *MongoDBServer) startTCPServer() error {
 // newSession 创建新的会话
 func (s *MongoDBServer) newSession(session getty.Session) error {
 	// 设置会话属性
-	session.SetPkgHandler(protocol.NewPackageHandler())
-	session.SetEventListener(protocol.NewEventListener(s.storageEngine))
+	session.SetPkgHandler(protocol.NewPackageHandler(s.config.Network.MaxMsgLen))
+	session.SetEventListener(protocol.NewEventListener(s.storageEngine, s.config, s.rateLimiter))
 	session.SetReadTimeout(30 * time.Second)
 	session.SetWriteTimeout(30 * time.Second)
 	session.SetCronPeriod(int(30 * time.Second.Nanoseconds() / 1e6))
 	session.SetWaitTime(1 * time.Second)
 
+	// 经代理转发的连接，getty 看到的远端地址是代理的回环地址
+	if s.sslProxy != nil {
+		if addr, ok := s.sslProxy.peerAddr(session.RemoteAddr(), time.Second); ok {
+			protocol.SetRemoteAddr(session, addr)
+		}
+	}
+
 	logger.Debugf("新会话建立: %s", session.RemoteAddr())
 	return nil
 }
@@ -165,6 +224,7 @@ func (s *MongoDBServer) GetStats() map[string]interface{} {
 			stats["storage"] = storageStats
 		}
 	}
+	stats["latency"] = protocol.LatencyStats()
 
 	return stats
 }
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/wiremessage"
+)
+
+// writeSelfSignedPEM 生成自签名证书，证书和私钥写入同一个 PEM 文件
+func writeSelfSignedPEM(t *testing.T) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成私钥失败: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("生成证书失败: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("编码私钥失败: %v", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+
+	path := filepath.Join(t.TempDir(), "server.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("写入 PEM 文件失败: %v", err)
+	}
+	return path
+}
+
+// freePort 获取一个空闲端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("获取空闲端口失败: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// newTestConfig 创建测试配置
+func newTestConfig(t *testing.T) *config.Config {
+	cfg := &config.Config{}
+	cfg.Server.BindAddress = "127.0.0.1"
+	cfg.Server.Port = freePort(t)
+	cfg.Storage.Engine = "memory"
+	cfg.Network.MaxMsgLen = 16 * 1024 * 1024
+	return cfg
+}
+
+// serverAddr 返回服务器监听地址
+func serverAddr(cfg *config.Config) string {
+	return net.JoinHostPort(cfg.Server.BindAddress, strconv.Itoa(cfg.Server.Port))
+}
+
+// startTestServer 启动测试服务器
+func startTestServer(t *testing.T, cfg *config.Config) *MongoDBServer {
+	t.Helper()
+	srv := NewMongoDBServer(cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+	return srv
+}
+
+// opMsg 把命令编码为 OP_MSG 消息
+func opMsg(command bsoncore.Document) []byte {
+	idx, msg := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), 0, wiremessage.OpMsg)
+	msg = wiremessage.AppendMsgFlags(msg, 0)
+	msg = wiremessage.AppendMsgSectionType(msg, wiremessage.SingleDocument)
+	msg = append(msg, command...)
+	return bsoncore.UpdateLength(msg, idx, int32(len(msg)))
+}
+
+// roundTrip 发送一条 OP_MSG 命令并读取回复文档
+func roundTrip(t *testing.T, conn net.Conn, command bsoncore.Document) bsoncore.Document {
+	t.Helper()
+
+	msg := opMsg(command)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("发送消息失败: %v", err)
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("读取回复头失败: %v", err)
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(header))
+	copy(reply, header)
+	if _, err := io.ReadFull(conn, reply[16:]); err != nil {
+		t.Fatalf("读取回复失败: %v", err)
+	}
+
+	_, _, _, opcode, rem, ok := wiremessage.ReadHeader(reply)
+	if !ok || opcode != wiremessage.OpMsg {
+		t.Fatalf("回复不是 OP_MSG: %v", opcode)
+	}
+	_, rem, _ = wiremessage.ReadMsgFlags(rem)
+	_, rem, _ = wiremessage.ReadMsgSectionType(rem)
+	doc, _, ok := wiremessage.ReadMsgSectionSingleDocument(rem)
+	if !ok {
+		t.Fatal("读取回复文档失败")
+	}
+	return doc
+}
+
+// pingCommand 构造 ping 命令
+func pingCommand() bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().
+		AppendInt32("ping", 1).
+		AppendString("$db", "admin").
+		Build()
+}
+
+// TestTLS 测试 TLS 连接
+func TestTLS(t *testing.T) {
+	pemFile := writeSelfSignedPEM(t)
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("requireSSL", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		cfg.Security.SSLMode = SSLModeRequire
+		cfg.Security.SSLPEMKeyFile = pemFile
+		startTestServer(t, cfg)
+		addr := serverAddr(cfg)
+
+		conn, err := tls.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatalf("TLS 连接失败: %v", err)
+		}
+		defer conn.Close()
+
+		doc := roundTrip(t, conn, pingCommand())
+		if ok := doc.Lookup("ok").Double(); ok != 1 {
+			t.Errorf("ping 失败: %s", doc)
+		}
+	})
+
+	t.Run("preferSSL 同时接受明文和 TLS", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		cfg.Security.SSLMode = SSLModePrefer
+		cfg.Security.SSLPEMKeyFile = pemFile
+		startTestServer(t, cfg)
+		addr := serverAddr(cfg)
+
+		tlsConn, err := tls.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatalf("TLS 连接失败: %v", err)
+		}
+		defer tlsConn.Close()
+		if doc := roundTrip(t, tlsConn, pingCommand()); doc.Lookup("ok").Double() != 1 {
+			t.Errorf("TLS ping 失败: %s", doc)
+		}
+
+		plainConn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("明文连接失败: %v", err)
+		}
+		defer plainConn.Close()
+		if doc := roundTrip(t, plainConn, pingCommand()); doc.Lookup("ok").Double() != 1 {
+			t.Errorf("明文 ping 失败: %s", doc)
+		}
+
+		// 服务端看到的应是客户端的地址，而不是代理转发连接的回环地址
+		whatsmyuri := bsoncore.NewDocumentBuilder().AppendInt32("whatsmyuri", 1).AppendString("$db", "admin").Build()
+		for _, conn := range []net.Conn{tlsConn, plainConn} {
+			if you := roundTrip(t, conn, whatsmyuri).Lookup("you").StringValue(); you != conn.LocalAddr().String() {
+				t.Errorf("whatsmyuri = %s, want %s", you, conn.LocalAddr())
+			}
+		}
+	})
+
+	t.Run("preferSSL 限制客户端连接数", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		cfg.Security.SSLMode = SSLModePrefer
+		cfg.Security.SSLPEMKeyFile = pemFile
+		cfg.Network.MaxConnections = 1
+		startTestServer(t, cfg)
+		addr := serverAddr(cfg)
+
+		first, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("明文连接失败: %v", err)
+		}
+		if doc := roundTrip(t, first, pingCommand()); doc.Lookup("ok").Double() != 1 {
+			t.Fatalf("ping 失败: %s", doc)
+		}
+
+		second, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("明文连接失败: %v", err)
+		}
+		defer second.Close()
+		second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("超过 max_connections 的连接应被关闭: %v", err)
+		}
+
+		// 关闭已有连接后释放名额
+		first.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("明文连接失败: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			conn.Write(opMsg(pingCommand()))
+			n, _ := conn.Read(make([]byte, 16))
+			conn.Close()
+			if n > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("关闭连接后应能建立新连接")
+			}
+		}
+	})
+
+	t.Run("证书缺失时拒绝启动", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		cfg.Security.SSLMode = SSLModeRequire
+		cfg.Security.SSLPEMKeyFile = filepath.Join(t.TempDir(), "missing.pem")
+
+		srv := NewMongoDBServer(cfg)
+		err := srv.Start()
+		if err == nil {
+			srv.Stop()
+			t.Fatal("证书缺失时应启动失败")
+		}
+		if !strings.Contains(err.Error(), "SSL PEM") {
+			t.Errorf("错误信息不明确: %v", err)
+		}
+	})
+
+	t.Run("证书无法解析时拒绝启动", func(t *testing.T) {
+		badFile := filepath.Join(t.TempDir(), "bad.pem")
+		os.WriteFile(badFile, []byte("not a certificate"), 0600)
+
+		cfg := newTestConfig(t)
+		cfg.Security.SSLMode = SSLModePrefer
+		cfg.Security.SSLPEMKeyFile = badFile
+
+		srv := NewMongoDBServer(cfg)
+		if err := srv.Start(); err == nil {
+			srv.Stop()
+			t.Fatal("证书无法解析时应启动失败")
+		}
+	})
+}
+
+// queryRoundTrip 通过 OP_QUERY 向 ns 发送查询并读取 OP_REPLY 中的文档
+func queryRoundTrip(t *testing.T, conn net.Conn, ns string, query bsoncore.Document) []bsoncore.Document {
+	t.Helper()
+
+	requestID := wiremessage.NextRequestID()
+	idx, msg := wiremessage.AppendHeaderStart(nil, requestID, 0, wiremessage.OpQuery)
+	msg = wiremessage.AppendQueryFlags(msg, 0)
+	msg = wiremessage.AppendQueryFullCollectionName(msg, ns)
+	msg = wiremessage.AppendQueryNumberToSkip(msg, 0)
+	msg = wiremessage.AppendQueryNumberToReturn(msg, -1)
+	msg = append(msg, query...)
+	msg = bsoncore.UpdateLength(msg, idx, int32(len(msg)))
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("发送消息失败: %v", err)
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("读取回复头失败: %v", err)
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(header))
+	copy(reply, header)
+	if _, err := io.ReadFull(conn, reply[16:]); err != nil {
+		t.Fatalf("读取回复失败: %v", err)
+	}
+
+	_, _, responseTo, opcode, rem, ok := wiremessage.ReadHeader(reply)
+	if !ok || opcode != wiremessage.OpReply || responseTo != requestID {
+		t.Fatalf("回复不是对应请求的 OP_REPLY: opcode=%v responseTo=%d", opcode, responseTo)
+	}
+	flags, rem, _ := wiremessage.ReadReplyFlags(rem)
+	if flags&wiremessage.QueryFailure != 0 {
+		t.Fatalf("查询失败: flags=%v", flags)
+	}
+	_, rem, _ = wiremessage.ReadReplyCursorID(rem)
+	_, rem, _ = wiremessage.ReadReplyStartingFrom(rem)
+	n, rem, _ := wiremessage.ReadReplyNumberReturned(rem)
+	docs, _, ok := wiremessage.ReadReplyDocuments(rem)
+	if !ok || int(n) != len(docs) {
+		t.Fatalf("读取回复文档失败: numberReturned=%d", n)
+	}
+	return docs
+}
+
+// TestLegacyHandshake 测试驱动在协商 OP_MSG 之前通过 OP_QUERY 发送 isMaster 握手
+func TestLegacyHandshake(t *testing.T) {
+	cfg := newTestConfig(t)
+	startTestServer(t, cfg)
+
+	conn, err := net.Dial("tcp", serverAddr(cfg))
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer conn.Close()
+
+	// 驱动的握手命令带有客户端信息，通过 mongos 时包装在 $query 中
+	isMaster := bsoncore.NewDocumentBuilder().
+		StartDocument("$query").
+		AppendInt32("isMaster", 1).
+		AppendBoolean("helloOk", true).
+		StartDocument("client").
+		StartDocument("driver").AppendString("name", "test").AppendString("version", "1.0").FinishDocument().
+		FinishDocument().
+		FinishDocument().
+		Build()
+	docs := queryRoundTrip(t, conn, "admin.$cmd", isMaster)
+	if len(docs) != 1 {
+		t.Fatalf("握手应返回 1 个文档, got %d", len(docs))
+	}
+	reply := docs[0]
+	if reply.Lookup("ok").Double() != 1 || !reply.Lookup("ismaster").Boolean() || !reply.Lookup("helloOk").Boolean() {
+		t.Errorf("isMaster 回复不正确: %s", reply)
+	}
+	if v := reply.Lookup("maxWireVersion").Int32(); v < 6 {
+		t.Errorf("maxWireVersion 应支持 OP_MSG, got %d", v)
+	}
+
+	// 握手完成后同一连接改用 OP_MSG
+	if doc := roundTrip(t, conn, pingCommand()); doc.Lookup("ok").Double() != 1 {
+		t.Errorf("握手后 OP_MSG ping 失败: %s", doc)
+	}
+}
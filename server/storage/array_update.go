@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// 数组更新操作符 $push/$addToSet/$pop/$pull/$pullAll
+// 字段不存在时 $push/$addToSet 创建数组，$pop/$pull/$pullAll 不做修改；字段存在但不是数组时返回错误
+
+// arrayField 取路径上用于数组更新的数组，字段不存在时 exists 为 false
+func arrayField(doc Document, parts []string, op string) (arr []interface{}, exists bool, err error) {
+	current := lookupPath(doc, parts)
+	if len(current) == 0 {
+		return nil, false, nil
+	}
+	if canonicalType(current[0]) != canonicalArray {
+		return nil, true, fmt.Errorf("%s 只能用于数组字段: %s", op, strings.Join(parts, "."))
+	}
+	return toArray(current[0]), true, nil
+}
+
+// integerArgument 读取整数参数，值为整数的浮点数同样接受（如 shell 发送的 1.0）
+func integerArgument(v interface{}) (int64, bool) {
+	if !isNumber(v) {
+		return 0, false
+	}
+	f := toFloat64(v)
+	if f != math.Trunc(f) {
+		return 0, false
+	}
+	if n, ok := toInt64(v); ok {
+		return n, true
+	}
+	return int64(f), true
+}
+
+// pushModifiers $push 的参数，不带 $each 时 each 只含参数本身
+type pushModifiers struct {
+	each     []interface{}
+	position *int        // 插入位置，负数从末尾倒数，为 nil 时追加到末尾
+	sort     interface{} // 1/-1 按元素排序，{field: 1/-1} 按元素文档的字段排序，为 nil 时不排序
+	slice    *int        // 正数保留前 n 个元素，负数保留后 |n| 个，为 nil 时不截取
+}
+
+// eachArgument 解析 $push/$addToSet 的参数：{$each: [...], 修饰符...} 或单个值
+// allowed 为允许与 $each 同时使用的修饰符
+func eachArgument(op string, operand interface{}, allowed map[string]bool) ([]interface{}, Document, error) {
+	spec := toDocument(operand)
+	if spec == nil {
+		return []interface{}{operand}, nil, nil
+	}
+	each, ok := spec["$each"]
+	if !ok {
+		for key := range spec {
+			if strings.HasPrefix(key, "$") {
+				return nil, nil, fmt.Errorf("%s 的修饰符 %s 必须与 $each 一起使用", op, key)
+			}
+		}
+		return []interface{}{operand}, nil, nil
+	}
+	if canonicalType(each) != canonicalArray {
+		return nil, nil, fmt.Errorf("%s 的 $each 必须是数组", op)
+	}
+	for key := range spec {
+		if key != "$each" && !allowed[key] {
+			return nil, nil, fmt.Errorf("%s 不支持修饰符 %s", op, key)
+		}
+	}
+	return toArray(each), spec, nil
+}
+
+// parsePushModifiers 解析 $push 的参数及其 $position/$sort/$slice 修饰符
+func parsePushModifiers(operand interface{}) (*pushModifiers, error) {
+	each, spec, err := eachArgument("$push", operand, map[string]bool{"$position": true, "$sort": true, "$slice": true})
+	if err != nil {
+		return nil, err
+	}
+	mods := &pushModifiers{each: each}
+	for _, name := range []string{"$position", "$slice"} {
+		v, ok := spec[name]
+		if !ok {
+			continue
+		}
+		n, isInt := integerArgument(v)
+		if !isInt {
+			return nil, fmt.Errorf("$push 的 %s 必须是整数: %v", name, v)
+		}
+		i := int(n)
+		if name == "$position" {
+			mods.position = &i
+		} else {
+			mods.slice = &i
+		}
+	}
+	if v, ok := spec["$sort"]; ok {
+		if err := checkPushSort(v); err != nil {
+			return nil, err
+		}
+		mods.sort = v
+	}
+	return mods, nil
+}
+
+// checkPushSort 检查 $push 的 $sort：1/-1 或字段排序规则文档
+func checkPushSort(v interface{}) error {
+	if isNumber(v) {
+		if d := toFloat64(v); d != 1 && d != -1 {
+			return fmt.Errorf("$push 的 $sort 必须为 1 或 -1")
+		}
+		return nil
+	}
+	spec := toDocument(v)
+	if len(spec) == 0 {
+		return fmt.Errorf("$push 的 $sort 必须为 1、-1 或非空的排序规则文档")
+	}
+	for field, dir := range spec {
+		if d := toFloat64(dir); !isNumber(dir) || (d != 1 && d != -1) {
+			return fmt.Errorf("$push 的 $sort 中 %s 的排序方向必须为 1 或 -1", field)
+		}
+	}
+	return nil
+}
+
+// pushValues 按修饰符将元素插入数组，依次应用 $position、$sort 和 $slice
+func pushValues(arr []interface{}, mods *pushModifiers) []interface{} {
+	pos := len(arr)
+	if mods.position != nil {
+		pos = *mods.position
+		if pos < 0 {
+			pos += len(arr)
+			if pos < 0 {
+				pos = 0
+			}
+		}
+		if pos > len(arr) {
+			pos = len(arr)
+		}
+	}
+	result := make([]interface{}, 0, len(arr)+len(mods.each))
+	result = append(result, arr[:pos]...)
+	for _, v := range mods.each {
+		result = append(result, cloneValue(v))
+	}
+	result = append(result, arr[pos:]...)
+
+	if mods.sort != nil {
+		sortArray(result, mods.sort)
+	}
+	if mods.slice != nil {
+		n := *mods.slice
+		switch {
+		case n >= 0 && n < len(result):
+			result = result[:n]
+		case n < 0 && -n < len(result):
+			result = result[len(result)+n:]
+		}
+	}
+	return result
+}
+
+// sortArray 按 $push 的 $sort 规则稳定排序数组，按字段排序时非文档元素的字段视为 null
+func sortArray(arr []interface{}, spec interface{}) {
+	if isNumber(spec) {
+		dir := int(toFloat64(spec))
+		sort.SliceStable(arr, func(i, j int) bool { return CompareValues(arr[i], arr[j])*dir < 0 })
+		return
+	}
+	fields := toDocument(spec)
+	keys := sortedKeys(fields)
+	sort.SliceStable(arr, func(i, j int) bool {
+		for _, key := range keys {
+			parts := strings.Split(key, ".")
+			c := CompareValues(sortValue(toDocument(arr[i]), parts), sortValue(toDocument(arr[j]), parts))
+			if c != 0 {
+				return c*int(toFloat64(fields[key])) < 0
+			}
+		}
+		return false
+	})
+}
+
+// addToSet 将数组中不存在的值依次加入数组，比较时类型分组相同且值相等即视为已存在，如 int32(1) 与 1.0
+func addToSet(arr []interface{}, values []interface{}) []interface{} {
+	result := append([]interface{}{}, arr...)
+	for _, v := range values {
+		if !containsValue(result, v) {
+			result = append(result, cloneValue(v))
+		}
+	}
+	return result
+}
+
+// containsValue 判断数组中是否有与 v 相等的元素
+func containsValue(arr []interface{}, v interface{}) bool {
+	for _, elem := range arr {
+		if valuesEqual(elem, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullMatcher 返回 $pull 判断元素是否删除的函数
+// 参数为操作符文档时对每个元素应用条件，为普通文档时作为查询条件匹配文档元素，其他值按相等比较
+func pullMatcher(cond interface{}) func(elem interface{}) (bool, error) {
+	spec := toDocument(cond)
+	switch {
+	case spec != nil && hasOperatorKeys(spec):
+		return func(elem interface{}) (bool, error) {
+			return matchField(Document{"elem": elem}, "elem", spec)
+		}
+	case spec != nil:
+		return func(elem interface{}) (bool, error) {
+			doc := toDocument(elem)
+			if doc == nil {
+				return false, nil
+			}
+			return matchDocument(doc, spec)
+		}
+	}
+	return func(elem interface{}) (bool, error) {
+		return valuesEqual(elem, cond), nil
+	}
+}
+
+// removeElements 返回删除满足 remove 的元素后的新数组
+func removeElements(arr []interface{}, remove func(elem interface{}) (bool, error)) ([]interface{}, error) {
+	result := make([]interface{}, 0, len(arr))
+	for _, elem := range arr {
+		ok, err := remove(elem)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			result = append(result, elem)
+		}
+	}
+	return result, nil
+}
+
+// applyArrayOperator 对单个字段路径应用数组更新操作符
+func applyArrayOperator(doc Document, op string, parts []string, operand interface{}) error {
+	arr, exists, err := arrayField(doc, parts, op)
+	if err != nil {
+		return err
+	}
+	path := strings.Join(parts, ".")
+
+	var updated []interface{}
+	switch op {
+	case "$push":
+		mods, err := parsePushModifiers(operand)
+		if err != nil {
+			return err
+		}
+		updated = pushValues(arr, mods)
+	case "$addToSet":
+		values, _, err := eachArgument(op, operand, nil)
+		if err != nil {
+			return err
+		}
+		updated = addToSet(arr, values)
+	case "$pop":
+		n, ok := integerArgument(operand)
+		if !ok || (n != 1 && n != -1) {
+			return fmt.Errorf("$pop 的参数必须为 1 或 -1: %s", path)
+		}
+		if !exists || len(arr) == 0 {
+			return nil
+		}
+		if n == 1 {
+			updated = append([]interface{}{}, arr[:len(arr)-1]...)
+		} else {
+			updated = append([]interface{}{}, arr[1:]...)
+		}
+	case "$pull":
+		if !exists {
+			return nil
+		}
+		if updated, err = removeElements(arr, pullMatcher(operand)); err != nil {
+			return err
+		}
+	case "$pullAll":
+		if canonicalType(operand) != canonicalArray {
+			return fmt.Errorf("$pullAll 的参数必须是数组: %s", path)
+		}
+		if !exists {
+			return nil
+		}
+		values := toArray(operand)
+		updated, _ = removeElements(arr, func(elem interface{}) (bool, error) {
+			return containsValue(values, elem), nil
+		})
+	}
+	return setPath(doc, parts, updated)
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// ObjectID BSON ObjectId
+type ObjectID [12]byte
+
+// Regex BSON 正则表达式
+type Regex struct {
+	Pattern string
+	Options string
+}
+
+// Timestamp BSON 内部时间戳
+type Timestamp struct {
+	T uint32
+	I uint32
+}
+
+// Decimal128 BSON 128 位十进制数
+type Decimal128 struct {
+	High uint64
+	Low  uint64
+}
+
+// BinarySubtypeGeneric 通用二进制子类型
+const BinarySubtypeGeneric byte = 0x00
+
+// BinarySubtypeUUID UUID 二进制子类型，Data 为 16 字节
+const BinarySubtypeUUID byte = 0x04
+
+// Binary 带子类型的 BSON 二进制数据
+// 通用子类型的二进制解码为 []byte，其他子类型解码为 Binary；Binary{Subtype: 0} 与相同内容的 []byte 相等
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+// toBinary 将 []byte 和 Binary 统一为 Binary
+func toBinary(v interface{}) (Binary, bool) {
+	switch b := v.(type) {
+	case []byte:
+		return Binary{Subtype: BinarySubtypeGeneric, Data: b}, true
+	case Binary:
+		return b, true
+	}
+	return Binary{}, false
+}
+
+// MinKey BSON MinKey，比任何值都小
+type MinKey struct{}
+
+// MaxKey BSON MaxKey，比任何值都大
+type MaxKey struct{}
+
+var (
+	objectIDCounter = randomUint32()
+	objectIDProcess = randomProcessUnique()
+)
+
+// NewObjectID 生成新的 ObjectId
+// 格式: 4 字节秒级时间戳 + 5 字节进程随机值 + 3 字节递增计数器
+func NewObjectID() ObjectID {
+	var id ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(time.Now().Unix()))
+	copy(id[4:9], objectIDProcess[:])
+	counter := atomic.AddUint32(&objectIDCounter, 1)
+	id[9] = byte(counter >> 16)
+	id[10] = byte(counter >> 8)
+	id[11] = byte(counter)
+	return id
+}
+
+// Hex 返回 ObjectId 的十六进制表示
+func (id ObjectID) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+// String 字符串表示
+func (id ObjectID) String() string {
+	return fmt.Sprintf("ObjectId(%q)", id.Hex())
+}
+
+// Timestamp 返回 ObjectId 中的生成时间
+func (id ObjectID) Timestamp() time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint32(id[0:4])), 0)
+}
+
+func randomUint32() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func randomProcessUnique() [5]byte {
+	var b [5]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		binary.BigEndian.PutUint32(b[:], uint32(time.Now().UnixNano()))
+	}
+	return b
+}
+
+// MarshalDocument 将 Document 编码为 BSON
+// map 没有字段顺序，编码时 _id 在最前，其余字段按字典序排列，保证输出确定；
+// 需要保留字段顺序时使用 MarshalOrderedDocument
+func MarshalDocument(doc Document) ([]byte, error) {
+	return appendDocument(nil, doc)
+}
+
+// UnmarshalDocument 将 BSON 解码为 Document
+func UnmarshalDocument(data []byte) (Document, error) {
+	raw := bsoncore.Document(data)
+	if err := raw.Validate(); err != nil {
+		return nil, fmt.Errorf("无效的 BSON 文档: %w", err)
+	}
+	return decodeDocument(raw)
+}
+
+// sortedKeys 返回文档的字段名，_id 在最前，其余按字典序
+func sortedKeys(doc Document) []string {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == "_id" || keys[j] == "_id" {
+			return keys[i] == "_id" && keys[j] != "_id"
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func appendDocument(dst []byte, doc Document) ([]byte, error) {
+	idx, dst := bsoncore.AppendDocumentStart(dst)
+	for _, key := range sortedKeys(doc) {
+		var err error
+		if dst, err = appendElement(dst, key, doc[key]); err != nil {
+			return nil, err
+		}
+	}
+	return bsoncore.AppendDocumentEnd(dst, idx)
+}
+
+func appendArray(dst []byte, arr []interface{}) ([]byte, error) {
+	idx, dst := bsoncore.AppendArrayStart(dst)
+	for i, value := range arr {
+		var err error
+		if dst, err = appendElement(dst, fmt.Sprint(i), value); err != nil {
+			return nil, err
+		}
+	}
+	return bsoncore.AppendArrayEnd(dst, idx)
+}
+
+// appendElement 按 Go 类型编码单个 BSON 元素
+func appendElement(dst []byte, key string, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return bsoncore.AppendNullElement(dst, key), nil
+	case bool:
+		return bsoncore.AppendBooleanElement(dst, key, v), nil
+	case int32:
+		return bsoncore.AppendInt32Element(dst, key, v), nil
+	case int64:
+		return bsoncore.AppendInt64Element(dst, key, v), nil
+	case int:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return bsoncore.AppendInt32Element(dst, key, int32(v)), nil
+		}
+		return bsoncore.AppendInt64Element(dst, key, int64(v)), nil
+	case float64:
+		return bsoncore.AppendDoubleElement(dst, key, v), nil
+	case float32:
+		return bsoncore.AppendDoubleElement(dst, key, float64(v)), nil
+	case string:
+		return bsoncore.AppendStringElement(dst, key, v), nil
+	case Document:
+		dst = bsoncore.AppendHeader(dst, bsoncore.TypeEmbeddedDocument, key)
+		return appendDocument(dst, v)
+	case map[string]interface{}:
+		dst = bsoncore.AppendHeader(dst, bsoncore.TypeEmbeddedDocument, key)
+		return appendDocument(dst, Document(v))
+	case OrderedDocument:
+		dst = bsoncore.AppendHeader(dst, bsoncore.TypeEmbeddedDocument, key)
+		return appendOrderedDocument(dst, v)
+	case []interface{}:
+		dst = bsoncore.AppendHeader(dst, bsoncore.TypeArray, key)
+		return appendArray(dst, v)
+	case []Document:
+		arr := make([]interface{}, len(v))
+		for i := range v {
+			arr[i] = v[i]
+		}
+		dst = bsoncore.AppendHeader(dst, bsoncore.TypeArray, key)
+		return appendArray(dst, arr)
+	case []byte:
+		return bsoncore.AppendBinaryElement(dst, key, BinarySubtypeGeneric, v), nil
+	case Binary:
+		return bsoncore.AppendBinaryElement(dst, key, v.Subtype, v.Data), nil
+	case ObjectID:
+		return bsoncore.AppendObjectIDElement(dst, key, v), nil
+	case time.Time:
+		return bsoncore.AppendDateTimeElement(dst, key, v.UnixMilli()), nil
+	case Regex:
+		return bsoncore.AppendRegexElement(dst, key, v.Pattern, v.Options), nil
+	case Timestamp:
+		return bsoncore.AppendTimestampElement(dst, key, v.T, v.I), nil
+	case Decimal128:
+		return bsoncore.AppendDecimal128Element(dst, key, v.High, v.Low), nil
+	case MinKey:
+		return bsoncore.AppendMinKeyElement(dst, key), nil
+	case MaxKey:
+		return bsoncore.AppendMaxKeyElement(dst, key), nil
+	default:
+		return nil, fmt.Errorf("字段 %s 的类型 %T 无法编码为 BSON", key, value)
+	}
+}
+
+func decodeDocument(raw bsoncore.Document) (Document, error) {
+	elements, err := raw.Elements()
+	if err != nil {
+		return nil, err
+	}
+	doc := make(Document, len(elements))
+	for _, element := range elements {
+		value, err := decodeValue(element.Value())
+		if err != nil {
+			return nil, fmt.Errorf("解码字段 %s 失败: %w", element.Key(), err)
+		}
+		doc[element.Key()] = value
+	}
+	return doc, nil
+}
+
+// decodeValue 将 BSON 值解码为 Go 类型
+func decodeValue(value bsoncore.Value) (interface{}, error) {
+	switch value.Type {
+	case bsoncore.TypeDouble:
+		return value.Double(), nil
+	case bsoncore.TypeString:
+		return value.StringValue(), nil
+	case bsoncore.TypeSymbol:
+		return value.Symbol(), nil
+	case bsoncore.TypeEmbeddedDocument:
+		return decodeDocument(value.Document())
+	case bsoncore.TypeArray:
+		values, err := value.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, len(values))
+		for i, v := range values {
+			if arr[i], err = decodeValue(v); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case bsoncore.TypeBinary:
+		subtype, data := value.Binary()
+		return newBinaryValue(subtype, data), nil
+	case bsoncore.TypeUndefined, bsoncore.TypeNull:
+		return nil, nil
+	case bsoncore.TypeObjectID:
+		return ObjectID(value.ObjectID()), nil
+	case bsoncore.TypeBoolean:
+		return value.Boolean(), nil
+	case bsoncore.TypeDateTime:
+		return time.UnixMilli(value.DateTime()).UTC(), nil
+	case bsoncore.TypeRegex:
+		pattern, options := value.Regex()
+		return Regex{Pattern: pattern, Options: options}, nil
+	case bsoncore.TypeInt32:
+		return value.Int32(), nil
+	case bsoncore.TypeTimestamp:
+		t, i := value.Timestamp()
+		return Timestamp{T: t, I: i}, nil
+	case bsoncore.TypeInt64:
+		return value.Int64(), nil
+	case bsoncore.TypeDecimal128:
+		high, low := value.Decimal128()
+		return Decimal128{High: high, Low: low}, nil
+	case bsoncore.TypeMinKey:
+		return MinKey{}, nil
+	case bsoncore.TypeMaxKey:
+		return MaxKey{}, nil
+	default:
+		return nil, fmt.Errorf("不支持的 BSON 类型: %s", value.Type)
+	}
+}
+
+// newBinaryValue 返回二进制数据在 Document 中的表示，通用子类型为 []byte，其他子类型为 Binary
+func newBinaryValue(subtype byte, data []byte) interface{} {
+	data = append([]byte(nil), data...)
+	if subtype == BinarySubtypeGeneric {
+		return data
+	}
+	return Binary{Subtype: subtype, Data: data}
+}
@@ -6,6 +6,13 @@ import (
 	"sync"
 )
 
+const (
+	// DefaultOrder 默认阶数
+	DefaultOrder = 128
+	// MinOrder 最小阶数，更小的阶数无法在分裂后保持节点平衡
+	MinOrder = 3
+)
+
 // BTree B+树实现
 // 用于存储有序的键值对，支持范围查询
 type BTree struct {
@@ -21,13 +28,14 @@ type Node struct {
 	values   [][]byte  // 值列表（仅叶子节点使用）
 	children []*Node   // 子节点列表（仅内部节点使用）
 	next     *Node     // 下一个叶子节点（仅叶子节点使用，用于范围查询）
+	prev     *Node     // 上一个叶子节点（仅叶子节点使用，用于反向范围查询）
 	parent   *Node     // 父节点
 }
 
 // NewBTree 创建新的 B+树
 func NewBTree(order int) *BTree {
-	if order < 3 {
-		order = 3 // 最小阶数为3
+	if order < MinOrder {
+		order = MinOrder
 	}
 	return &BTree{
 		root:  newLeafNode(),
@@ -53,7 +61,8 @@ func newInternalNode() *Node {
 	}
 }
 
-// Insert 插入键值对
+// Insert 插入键值对，键已存在时覆盖其值
+// 键和值在插入前复制，调用方之后可以修改传入的切片
 func (t *BTree) Insert(key, value []byte) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -82,7 +91,35 @@ func (t *BTree) Insert(key, value []byte) error {
 	return nil
 }
 
-// Get 查找键对应的值
+// InsertIfAbsent 键不存在时插入键值对，存在时不做修改
+// 检查和插入在同一次加锁内完成，返回是否插入
+func (t *BTree) InsertIfAbsent(key, value []byte) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(key) == 0 {
+		return false, fmt.Errorf("键不能为空")
+	}
+
+	leaf := t.findLeaf(key)
+	for _, k := range leaf.keys {
+		if bytes.Equal(k, key) {
+			return false, nil
+		}
+	}
+
+	keyCopy := make([]byte, len(key))
+	copy(keyCopy, key)
+	valueCopy := make([]byte, len(value))
+	copy(valueCopy, value)
+	t.insertIntoLeaf(leaf, keyCopy, valueCopy)
+	if len(leaf.keys) >= t.order {
+		t.splitLeaf(leaf)
+	}
+	return true, nil
+}
+
+// Get 查找键对应的值，返回值的副本
 func (t *BTree) Get(key []byte) ([]byte, bool) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
@@ -130,7 +167,7 @@ func (t *BTree) Delete(key []byte) error {
 }
 
 // Range 范围查询
-// 返回 [startKey, endKey) 范围内的所有键值对
+// 返回 [startKey, endKey) 范围内的所有键值对，键和值均为副本
 func (t *BTree) Range(startKey, endKey []byte) ([][]byte, [][]byte, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
@@ -167,6 +204,46 @@ func (t *BTree) Range(startKey, endKey []byte) ([][]byte, [][]byte, error) {
 	return keys, values, nil
 }
 
+// ReverseRange 反向范围查询
+// 返回 [startKey, endKey) 范围内的所有键值对，按键降序排列，键和值均为副本
+// endKey 为 nil 时从最后一个键开始，startKey 为 nil 时扫描到第一个键
+func (t *BTree) ReverseRange(startKey, endKey []byte) ([][]byte, [][]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	keys := make([][]byte, 0)
+	values := make([][]byte, 0)
+
+	// 从 endKey 所在的叶子节点开始，沿叶子节点链表向前遍历
+	leaf := t.findLastLeaf()
+	if endKey != nil {
+		leaf = t.findLeaf(endKey)
+	}
+	for leaf != nil {
+		for i := len(leaf.keys) - 1; i >= 0; i-- {
+			k := leaf.keys[i]
+			if endKey != nil && bytes.Compare(k, endKey) >= 0 {
+				continue
+			}
+			if bytes.Compare(k, startKey) < 0 {
+				return keys, values, nil
+			}
+
+			keyCopy := make([]byte, len(k))
+			copy(keyCopy, k)
+			valueCopy := make([]byte, len(leaf.values[i]))
+			copy(valueCopy, leaf.values[i])
+
+			keys = append(keys, keyCopy)
+			values = append(values, valueCopy)
+		}
+
+		leaf = leaf.prev
+	}
+
+	return keys, values, nil
+}
+
 // findLeaf 查找包含指定键的叶子节点
 func (t *BTree) findLeaf(key []byte) *Node {
 	node := t.root
@@ -211,6 +288,10 @@ func (t *BTree) splitLeaf(leaf *Node) {
 	newLeaf.keys = append(newLeaf.keys, leaf.keys[mid:]...)
 	newLeaf.values = append(newLeaf.values, leaf.values[mid:]...)
 	newLeaf.next = leaf.next
+	newLeaf.prev = leaf
+	if leaf.next != nil {
+		leaf.next.prev = newLeaf
+	}
 	
 	// 更新原叶子节点
 	leaf.keys = leaf.keys[:mid]
@@ -310,3 +391,99 @@ func (t *BTree) findFirstLeaf() *Node {
 	}
 	return node
 }
+
+// findLastLeaf 找到最后一个叶子节点
+func (t *BTree) findLastLeaf() *Node {
+	node := t.root
+	for !node.isLeaf {
+		node = node.children[len(node.children)-1]
+	}
+	return node
+}
+
+// NumLeaves 返回叶子节点数，删除不会合并节点，叶子数相对键数偏多说明树变得稀疏
+func (t *BTree) NumLeaves() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	count := 0
+	for leaf := t.findFirstLeaf(); leaf != nil; leaf = leaf.next {
+		count++
+	}
+	return count
+}
+
+// NewBTreeFromSorted 由按键升序排列且不重复的键值对自底向上批量构建 B+树
+// 每个节点尽量填满（叶子节点 order-1 个键，内部节点 order 个子节点），用于重建紧凑的树
+// 键和值不复制，调用方交出所有权后不应再修改
+func NewBTreeFromSorted(order int, keys, values [][]byte) (*BTree, error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("键和值的数量不一致: %d != %d", len(keys), len(values))
+	}
+	for i := range keys {
+		if len(keys[i]) == 0 {
+			return nil, fmt.Errorf("键不能为空")
+		}
+		if i > 0 && bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			return nil, fmt.Errorf("键必须严格升序排列: 第 %d 个键", i)
+		}
+	}
+	t := NewBTree(order)
+	if len(keys) == 0 {
+		return t, nil
+	}
+
+	// 叶子层：每个叶子最多 order-1 个键，与逐个插入时的分裂阈值一致
+	var level []*Node
+	var firstKeys [][]byte // 每个节点子树中的最小键，作为上层的分隔键
+	for _, bounds := range packedChunks(len(keys), t.order-1) {
+		leaf := newLeafNode()
+		leaf.keys = append(leaf.keys, keys[bounds[0]:bounds[1]]...)
+		leaf.values = append(leaf.values, values[bounds[0]:bounds[1]]...)
+		if n := len(level); n > 0 {
+			level[n-1].next = leaf
+			leaf.prev = level[n-1]
+		}
+		level = append(level, leaf)
+		firstKeys = append(firstKeys, leaf.keys[0])
+	}
+
+	// 内部层：每个内部节点最多 order 个子节点，直到只剩根节点
+	for len(level) > 1 {
+		var parents []*Node
+		var parentFirstKeys [][]byte
+		for _, bounds := range packedChunks(len(level), t.order) {
+			node := newInternalNode()
+			for i := bounds[0]; i < bounds[1]; i++ {
+				if i > bounds[0] {
+					node.keys = append(node.keys, firstKeys[i])
+				}
+				node.children = append(node.children, level[i])
+				level[i].parent = node
+			}
+			parents = append(parents, node)
+			parentFirstKeys = append(parentFirstKeys, firstKeys[bounds[0]])
+		}
+		level, firstKeys = parents, parentFirstKeys
+	}
+	t.root = level[0]
+	return t, nil
+}
+
+// packedChunks 将 n 个元素按每组最多 size 个依次分组，返回各组的 [start, end)
+// 最后一组只有 1 个元素时从前一组借一个，避免出现只有一个子节点的内部节点
+func packedChunks(n, size int) [][2]int {
+	var chunks [][2]int
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		chunks = append(chunks, [2]int{start, end})
+	}
+	if last := len(chunks) - 1; last > 0 && chunks[last][1]-chunks[last][0] == 1 {
+		chunks[last-1][1]--
+		chunks[last][0]--
+	}
+	return chunks
+}
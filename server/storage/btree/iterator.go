@@ -0,0 +1,113 @@
+package btree
+
+import "bytes"
+
+// Iterator 按键的升序分批遍历 [startKey, endKey) 范围内的键值对
+// 每批在读锁内复制最多 batchSize 个键值对，下一批从上一批最后一个键之后重新查找叶子节点，
+// 因此遍历期间的插入、删除和节点分裂合并不会使迭代器失效；两批之间的写入对之后的批次可见
+type Iterator struct {
+	tree      *BTree
+	next      []byte // 下一批的起始键
+	end       []byte
+	batchSize int
+	keys      [][]byte
+	values    [][]byte
+	pos       int
+	done      bool // 已读到范围末尾，当前批次是最后一批
+}
+
+// NewIterator 创建范围迭代器，endKey 为 nil 时没有上界，batchSize 小于 1 时每批读取一个键值对
+func (t *BTree) NewIterator(startKey, endKey []byte, batchSize int) *Iterator {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &Iterator{tree: t, next: startKey, end: endKey, batchSize: batchSize, pos: -1}
+}
+
+// Ascend 在读锁内按键的升序访问 [startKey, endKey) 范围内的键值对，fn 返回 false 时停止
+// 传给 fn 的键和值引用树中的数据，不能修改，也不能在 fn 返回后继续使用；endKey 为 nil 时没有上界
+func (t *BTree) Ascend(startKey, endKey []byte, fn func(key, value []byte) bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for leaf := t.findLeaf(startKey); leaf != nil; leaf = leaf.next {
+		for i, k := range leaf.keys {
+			if bytes.Compare(k, startKey) < 0 {
+				continue
+			}
+			if endKey != nil && bytes.Compare(k, endKey) >= 0 {
+				return
+			}
+			if !fn(k, leaf.values[i]) {
+				return
+			}
+		}
+	}
+}
+
+// Next 移动到下一个键值对，没有更多数据时返回 false
+func (it *Iterator) Next() bool {
+	it.pos++
+	if it.pos < len(it.keys) {
+		return true
+	}
+	if it.done {
+		it.keys, it.values = nil, nil
+		return false
+	}
+	it.fill()
+	it.pos = 0
+	return len(it.keys) > 0
+}
+
+// Key 返回当前键的副本
+func (it *Iterator) Key() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return it.keys[it.pos]
+}
+
+// Value 返回当前值的副本
+func (it *Iterator) Value() []byte {
+	if it.pos < 0 || it.pos >= len(it.values) {
+		return nil
+	}
+	return it.values[it.pos]
+}
+
+// Close 释放当前批次
+func (it *Iterator) Close() {
+	it.keys, it.values = nil, nil
+	it.done = true
+}
+
+// fill 读取下一批键值对
+func (it *Iterator) fill() {
+	t := it.tree
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	keys := make([][]byte, 0, it.batchSize)
+	values := make([][]byte, 0, it.batchSize)
+	for leaf := t.findLeaf(it.next); leaf != nil; leaf = leaf.next {
+		for i, k := range leaf.keys {
+			if it.next != nil && bytes.Compare(k, it.next) < 0 {
+				continue
+			}
+			if it.end != nil && bytes.Compare(k, it.end) >= 0 {
+				it.keys, it.values, it.done = keys, values, true
+				return
+			}
+			if len(keys) == it.batchSize {
+				// 下一批从当前键开始，比上一批最后一个键大
+				it.next = append([]byte(nil), k...)
+				it.keys, it.values = keys, values
+				return
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, append([]byte(nil), leaf.values[i]...))
+		}
+	}
+	it.keys, it.values, it.done = keys, values, true
+}
@@ -0,0 +1,102 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// countdownContext 在 Err 被调用 n 次之后报告已取消，用于在扫描中途确定地取消
+type countdownContext struct {
+	context.Context
+	remaining int64
+}
+
+func newCountdownContext(n int64) *countdownContext {
+	return &countdownContext{Context: context.Background(), remaining: n}
+}
+
+func (c *countdownContext) Err() error {
+	if atomic.AddInt64(&c.remaining, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// TestScanCancellation 测试扫描中途取消 ctx 时查询、建索引和一致性检查立即中止并返回 ctx 的错误
+func TestScanCancellation(t *testing.T) {
+	const total = 5000
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := make([]storage.Document, total)
+	for i := range docs {
+		docs[i] = storage.Document{"_id": int32(i), "n": int32(i % 10)}
+	}
+	if err := engine.Insert(context.Background(), "test", "large", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+
+	t.Run("Find", func(t *testing.T) {
+		stats := &storage.ExecutionStats{}
+		ctx := storage.WithExecutionStats(newCountdownContext(100), stats)
+		if _, err := engine.Find(ctx, "test", "large", storage.Document{"n": int32(99)}); !errors.Is(err, context.Canceled) {
+			t.Fatalf("取消后 Find 应返回 context.Canceled, got %v", err)
+		}
+		if stats.DocsExamined > 100 {
+			t.Errorf("取消后应停止扫描, 已读取 %d 个文档", stats.DocsExamined)
+		}
+	})
+
+	t.Run("FindCursor", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cursor, err := engine.FindCursor(ctx, "test", "large", storage.Document{}, nil, nil)
+		if err != nil {
+			t.Fatalf("创建游标失败: %v", err)
+		}
+		defer cursor.Close()
+		if doc, err := cursor.Next(ctx); err != nil || doc == nil {
+			t.Fatalf("取消前应能读取文档: %v, %v", doc, err)
+		}
+		cancel()
+		if _, err := cursor.Next(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("取消后 Next 应返回 context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("超时", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 0)
+		defer cancel()
+		if _, err := engine.Find(ctx, "test", "large", storage.Document{}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("超时后 Find 应返回 context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("CreateIndex", func(t *testing.T) {
+		index := storage.Index{Name: "n_1", Keys: []storage.IndexKey{{Field: "n", Direction: 1}}}
+		if err := engine.CreateIndex(newCountdownContext(100), "test", "large", index); !errors.Is(err, context.Canceled) {
+			t.Fatalf("取消后 CreateIndex 应返回 context.Canceled, got %v", err)
+		}
+		indexes, err := engine.ListIndexes(context.Background(), "test", "large")
+		if err != nil {
+			t.Fatalf("列出索引失败: %v", err)
+		}
+		if len(indexes) != 1 {
+			t.Errorf("取消的索引不应保留: %v", indexes)
+		}
+		if err := engine.CreateIndex(context.Background(), "test", "large", index); err != nil {
+			t.Errorf("取消后应能重新创建索引: %v", err)
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		if _, err := engine.Validate(newCountdownContext(100), "test", "large"); !errors.Is(err, context.Canceled) {
+			t.Errorf("取消后 Validate 应返回 context.Canceled, got %v", err)
+		}
+	})
+}
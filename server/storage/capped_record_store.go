@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// EvictionHandler 固定集合淘汰记录时的回调，用于同步删除索引条目
+type EvictionHandler func(ctx context.Context, recordId RecordId, data []byte)
+
+// CappedRecordStore 固定集合的记录存储
+// 按插入顺序保存记录，超过大小或文档数上限时从最旧的记录开始淘汰
+type CappedRecordStore struct {
+	RecordStore
+
+	mu sync.Mutex
+
+	maxSize int64 // 数据总字节数上限
+	maxDocs int64 // 文档数上限，0 表示不限制
+
+	onEvict EvictionHandler
+}
+
+// NewCappedRecordStore 创建固定集合的记录存储
+func NewCappedRecordStore(namespace string, maxSize, maxDocs int64, order int) *CappedRecordStore {
+	return &CappedRecordStore{
+		RecordStore: NewRecordStore(namespace, order),
+		maxSize:     maxSize,
+		maxDocs:     maxDocs,
+	}
+}
+
+// SetEvictionHandler 设置淘汰记录时的回调
+func (rs *CappedRecordStore) SetEvictionHandler(handler EvictionHandler) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.onEvict = handler
+}
+
+// MaxSize 返回数据总字节数上限
+func (rs *CappedRecordStore) MaxSize() int64 {
+	return rs.maxSize
+}
+
+// MaxDocs 返回文档数上限，0 表示不限制
+func (rs *CappedRecordStore) MaxDocs() int64 {
+	return rs.maxDocs
+}
+
+// InsertRecord 插入记录，超出上限时淘汰最旧的记录
+// 新记录本身超过大小上限时拒绝插入
+func (rs *CappedRecordStore) InsertRecord(ctx context.Context, recordId RecordId, data []byte) error {
+	if rs.maxSize > 0 && int64(len(data)) > rs.maxSize {
+		return fmt.Errorf("%w: 文档大小 %d 超过固定集合上限 %d", ErrIllegalOperation, len(data), rs.maxSize)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if err := rs.RecordStore.InsertRecord(ctx, recordId, data); err != nil {
+		return err
+	}
+	return rs.evict(ctx, recordId)
+}
+
+// UpdateRecord 更新记录，固定集合不允许增大文档
+func (rs *CappedRecordStore) UpdateRecord(ctx context.Context, recordId RecordId, data []byte) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	old, err := rs.RecordStore.GetRecord(ctx, recordId)
+	if err != nil {
+		return err
+	}
+	if len(data) > len(old) {
+		return fmt.Errorf("%w: 固定集合中的文档大小不能增加", ErrIllegalOperation)
+	}
+	return rs.RecordStore.UpdateRecord(ctx, recordId, data)
+}
+
+// overCap 判断当前记录是否超出上限
+func (rs *CappedRecordStore) overCap() bool {
+	if rs.maxDocs > 0 && rs.NumRecords() > rs.maxDocs {
+		return true
+	}
+	return rs.maxSize > 0 && rs.DataSize() > rs.maxSize
+}
+
+// evict 按插入顺序淘汰最旧的记录直到满足上限，不淘汰刚插入的记录
+func (rs *CappedRecordStore) evict(ctx context.Context, inserted RecordId) error {
+	if !rs.overCap() {
+		return nil
+	}
+
+	cursor, err := rs.RecordStore.Scan(ctx, NullRecordId())
+	if err != nil {
+		return fmt.Errorf("扫描固定集合失败: %w", err)
+	}
+	defer cursor.Close()
+
+	// 游标返回字节形式的 RecordId，按字节比较
+	insertedKey, _ := inserted.AsBytes()
+	for rs.overCap() && cursor.Next() {
+		recordId := cursor.RecordId()
+		if key, _ := recordId.AsBytes(); compareBytes(key, insertedKey) == 0 {
+			continue
+		}
+		data := cursor.Data()
+		if err := rs.RecordStore.DeleteRecord(ctx, recordId); err != nil {
+			return fmt.Errorf("淘汰记录 %s 失败: %w", recordId, err)
+		}
+		if rs.onEvict != nil {
+			rs.onEvict(ctx, recordId, data)
+		}
+	}
+	return nil
+}
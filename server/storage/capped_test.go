@@ -0,0 +1,146 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+	"github.com/zhukovaskychina/xmongodb/server/storage/btree"
+)
+
+// TestCappedCollection 测试固定集合按插入顺序淘汰最旧文档
+func TestCappedCollection(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	if err := engine.CreateDatabase(ctx, "test"); err != nil {
+		t.Fatalf("创建数据库失败: %v", err)
+	}
+
+	t.Run("文档数上限", func(t *testing.T) {
+		if err := engine.CreateCappedCollection(ctx, "test", "logs", 1<<20, 3); err != nil {
+			t.Fatalf("创建固定集合失败: %v", err)
+		}
+		for i := int32(1); i <= 10; i++ {
+			if err := engine.Insert(ctx, "test", "logs", []storage.Document{{"_id": i}}); err != nil {
+				t.Fatalf("插入 %d 失败: %v", i, err)
+			}
+			docs, _ := engine.Find(ctx, "test", "logs", storage.Document{})
+			if int64(len(docs)) > 3 {
+				t.Fatalf("文档数 %d 超过上限 3", len(docs))
+			}
+		}
+
+		docs, err := engine.Find(ctx, "test", "logs", storage.Document{})
+		if err != nil || len(docs) != 3 {
+			t.Fatalf("查询结果不正确: %v, %v", docs, err)
+		}
+		for i, doc := range docs {
+			if want := int32(8 + i); doc["_id"] != want {
+				t.Errorf("第 %d 个文档 _id = %v, want %d", i, doc["_id"], want)
+			}
+		}
+
+		// 被淘汰文档的 _id 索引条目同时删除，可以重新插入
+		if err := engine.Insert(ctx, "test", "logs", []storage.Document{{"_id": int32(1)}}); err != nil {
+			t.Errorf("重新插入被淘汰的 _id 失败: %v", err)
+		}
+	})
+
+	t.Run("大小上限", func(t *testing.T) {
+		if err := engine.CreateCappedCollection(ctx, "test", "sized", 100, 0); err != nil {
+			t.Fatalf("创建固定集合失败: %v", err)
+		}
+		for i := int32(0); i < 20; i++ {
+			doc := storage.Document{"_id": i, "msg": "0123456789"}
+			if err := engine.Insert(ctx, "test", "sized", []storage.Document{doc}); err != nil {
+				t.Fatalf("插入 %d 失败: %v", i, err)
+			}
+		}
+		docs, _ := engine.Find(ctx, "test", "sized", storage.Document{})
+		if len(docs) == 0 || len(docs) >= 20 {
+			t.Fatalf("应淘汰旧文档, 剩余 %d 个", len(docs))
+		}
+		if last := docs[len(docs)-1]["_id"]; last != int32(19) {
+			t.Errorf("最新文档应保留, got %v", last)
+		}
+
+		big := storage.Document{"_id": "big", "msg": string(make([]byte, 200))}
+		if err := engine.Insert(ctx, "test", "sized", []storage.Document{big}); !errors.Is(err, storage.ErrIllegalOperation) {
+			t.Errorf("超过上限的文档应被拒绝: %v", err)
+		}
+	})
+
+	t.Run("插入失败时恢复被淘汰的文档", func(t *testing.T) {
+		if err := engine.CreateCappedCollection(ctx, "test", "unique", 1<<20, 2); err != nil {
+			t.Fatalf("创建固定集合失败: %v", err)
+		}
+		if err := engine.CreateIndex(ctx, "test", "unique", storage.Index{
+			Name: "k_1", Keys: []storage.IndexKey{{Field: "k", Direction: 1}}, Unique: true,
+		}); err != nil {
+			t.Fatalf("创建索引失败: %v", err)
+		}
+		if err := engine.Insert(ctx, "test", "unique", []storage.Document{{"_id": int32(1), "k": int32(1)}, {"_id": int32(2), "k": int32(2)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+
+		// 插入时先淘汰 _id 1，随后 k 与 _id 2 冲突，插入失败后 _id 1 应恢复
+		err := engine.Insert(ctx, "test", "unique", []storage.Document{{"_id": int32(3), "k": int32(2)}})
+		if !errors.Is(err, storage.ErrDuplicateKey) {
+			t.Fatalf("应返回 ErrDuplicateKey: %v", err)
+		}
+		docs, _ := engine.Find(ctx, "test", "unique", storage.Document{})
+		if len(docs) != 2 || docs[0]["_id"] != int32(1) || docs[1]["_id"] != int32(2) {
+			t.Errorf("插入失败后应保留原有文档: %v", docs)
+		}
+		if found, _ := engine.Find(ctx, "test", "unique", storage.Document{"k": int32(1)}); len(found) != 1 {
+			t.Errorf("恢复的文档应能通过索引找到: %v", found)
+		}
+		if results, err := engine.Validate(ctx, "test", "unique"); err != nil || !results.Valid() {
+			t.Errorf("恢复后索引应与记录一致: %+v %v", results, err)
+		}
+	})
+
+	t.Run("拒绝删除和增大文档", func(t *testing.T) {
+		_, err := engine.Delete(ctx, "test", "logs", storage.Document{"_id": int32(9)}, true)
+		if !errors.Is(err, storage.ErrIllegalOperation) {
+			t.Errorf("固定集合不应允许删除: %v", err)
+		}
+
+		_, err = engine.Update(ctx, "test", "logs", storage.Document{"_id": int32(9)},
+			storage.Document{"$set": storage.Document{"payload": "grow"}}, storage.UpdateOptions{})
+		if !errors.Is(err, storage.ErrIllegalOperation) {
+			t.Errorf("固定集合不应允许增大文档: %v", err)
+		}
+		docs, _ := engine.Find(ctx, "test", "logs", storage.Document{"_id": int32(9)})
+		if len(docs) != 1 || len(docs[0]) != 1 {
+			t.Errorf("被拒绝的更新不应生效: %v", docs)
+		}
+	})
+}
+
+// TestCappedRecordStore 测试 NumRecords 不超过文档数上限
+func TestCappedRecordStore(t *testing.T) {
+	ctx := context.Background()
+	rs := storage.NewCappedRecordStore("test.capped", 1<<20, 5, btree.DefaultOrder)
+
+	var evicted []int64
+	rs.SetEvictionHandler(func(ctx context.Context, recordId storage.RecordId, data []byte) {
+		evicted = append(evicted, int64(data[0]))
+	})
+	for i := int64(1); i <= 12; i++ {
+		if err := rs.InsertRecord(ctx, storage.NewRecordIdFromLong(i), []byte{byte(i)}); err != nil {
+			t.Fatalf("插入记录失败: %v", err)
+		}
+		if rs.NumRecords() > 5 {
+			t.Fatalf("NumRecords %d 超过上限 5", rs.NumRecords())
+		}
+	}
+	if len(evicted) != 7 || evicted[0] != 1 || evicted[6] != 7 {
+		t.Errorf("应按插入顺序淘汰最旧的记录: %v", evicted)
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Checkpoint 建立检查点，返回检查点覆盖的文件数：每个集合的记录存储和每个索引各算一个文件
+// 检查点期间持有写入锁，与文档写入和索引、校验规则的修改串行执行，检查点看到的每个集合都不包含写到一半的修改
+// 记录存储和索引都只保存在内存中，启用日志时检查点把日志重写为当前全部数据的快照并刷盘，
+// 之前的条目随旧日志文件一起丢弃，日志的大小不随运行时间无限增长
+func (e *WiredTigerEngine) Checkpoint(ctx context.Context) (int, error) {
+	e.checkpointMu.Lock()
+	defer e.checkpointMu.Unlock()
+
+	e.oplogMu.Lock()
+	defer e.oplogMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	numFiles := 0
+	for _, db := range e.databases {
+		for _, coll := range db.Collections {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			numFiles += 1 + len(coll.IndexSpecs)
+		}
+	}
+
+	e.journalMu.RLock()
+	j := e.journal
+	e.journalMu.RUnlock()
+	if j != nil {
+		err := j.rotate(journalPath(e.config.DirectoryForDB), func(add func(journalEntry) error) error {
+			return e.snapshotJournal(ctx, add)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	e.lastCheckpoint = time.Now()
+	return numFiles, nil
+}
+
+// snapshotJournal 生成重放后能恢复当前全部数据的日志条目：数据库、集合、校验规则、索引定义和每条记录
+// 调用方需持有 e.mu、e.oplogMu 和 e.checkpointMu
+func (e *WiredTigerEngine) snapshotJournal(ctx context.Context, add func(journalEntry) error) error {
+	for _, db := range e.databases {
+		if err := add(journalEntry{Op: journalCreateDatabase, Database: db.Name}); err != nil {
+			return err
+		}
+		for _, coll := range db.Collections {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := e.snapshotCollection(ctx, db.Name, coll, add); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotCollection 生成重建单个集合的日志条目，_id 索引随集合一起创建，不单独记录
+// 记录按不在事务中的读取看到的版本写入快照：未提交的事务写过的记录使用事务写入前的版本，
+// 事务提交时再把事务的修改追加到快照之后
+func (e *WiredTigerEngine) snapshotCollection(ctx context.Context, database string, coll *Collection, add func(journalEntry) error) error {
+	rs := unwrapRecordStore(coll.RecordStore)
+	create := journalEntry{Op: journalCreateCollection, Database: database, Collection: coll.Name}
+	if capped, ok := rs.(*CappedRecordStore); ok {
+		create.SizeBytes, create.MaxDocs = capped.maxSize, capped.maxDocs
+	}
+	if err := add(create); err != nil {
+		return err
+	}
+	if len(coll.Validator) > 0 || coll.ValidationLevel != "" || coll.ValidationAction != "" {
+		if err := add(journalEntry{Op: journalSetValidation, Database: database, Collection: coll.Name, Validation: ValidationOptions{
+			Validator: coll.Validator, Level: coll.ValidationLevel, Action: coll.ValidationAction,
+		}}); err != nil {
+			return err
+		}
+	}
+	for _, spec := range coll.IndexSpecs {
+		if spec.Name == IdIndexName {
+			continue
+		}
+		if err := add(journalEntry{Op: journalCreateIndex, Database: database, Collection: coll.Name, Index: spec}); err != nil {
+			return err
+		}
+	}
+
+	scanner, err := e.newCollectionScanner(ctx, coll, Document{})
+	if err != nil {
+		return err
+	}
+	defer scanner.close()
+	stats := &ExecutionStats{}
+	for {
+		m, ok, err := scanner.next(ctx, stats)
+		if err != nil || !ok {
+			return err
+		}
+		if err := add(journalEntry{
+			Op: journalInsertRecord, Database: database, Collection: coll.Name, RecordId: m.recordId, Data: m.data,
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestCheckpoint 测试检查点统计每个集合的记录存储和索引
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	if n, err := engine.Checkpoint(ctx); err != nil || n != 0 {
+		t.Errorf("空引擎的检查点应覆盖 0 个文件, got %d, %v", n, err)
+	}
+	if _, ok := engine.GetStats()["last_checkpoint"]; !ok {
+		t.Error("检查点后统计信息应包含 last_checkpoint")
+	}
+
+	checkpoint := func() int {
+		t.Helper()
+		n, err := engine.Checkpoint(ctx)
+		if err != nil {
+			t.Fatalf("检查点失败: %v", err)
+		}
+		return n
+	}
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(1), "x": int32(1)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	before := checkpoint()
+	if err := engine.CreateIndex(ctx, "test", "a", storage.Index{Name: "x_1", Keys: []storage.IndexKey{{Field: "x", Direction: 1}}}); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	if n := checkpoint(); n != before+1 {
+		t.Errorf("新建索引后检查点应多覆盖 1 个文件, got %d, want %d", n, before+1)
+	}
+	// 新集合的记录存储和 _id 索引
+	if err := engine.Insert(ctx, "other", "b", []storage.Document{{"_id": int32(1)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if n := checkpoint(); n != before+3 {
+		t.Errorf("新建集合后检查点应多覆盖 2 个文件, got %d, want %d", n, before+3)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := engine.Checkpoint(canceled); err == nil {
+		t.Error("context 已取消时检查点应返回错误")
+	}
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// sampleCapacity 每个集合保留的样本文档数
+const sampleCapacity = 256
+
+// collectionSample 集合文档的蓄水池样本，随写入更新，查询计划器据此估计过滤条件的选择性
+// 插入按蓄水池抽样决定是否进入样本，更新替换样本中的文档，删除从样本中移除
+// 删除较多时样本会偏向之后插入的文档，只用于比较候选索引，不要求精确
+type collectionSample struct {
+	mu    sync.Mutex
+	seen  int64          // 参与抽样的文档数，即当前集合的文档数
+	docs  []Document     // 样本文档
+	ids   []string       // 与 docs 对应的 RecordId
+	index map[string]int // RecordId 到样本下标的映射
+	rand  *rand.Rand
+}
+
+func newCollectionSample() *collectionSample {
+	return &collectionSample{index: make(map[string]int), rand: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+// sampleKey 返回 RecordId 在样本中的键
+func sampleKey(recordId RecordId) string {
+	b, _ := recordId.AsBytes()
+	return string(b)
+}
+
+// add 记录插入的文档，样本未满时直接加入，否则以 capacity/seen 的概率替换一个随机的样本
+func (s *collectionSample) add(recordId RecordId, doc Document) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sampleKey(recordId)
+	if i, ok := s.index[key]; ok {
+		s.docs[i] = cloneDocument(doc)
+		return
+	}
+	s.seen++
+	if len(s.docs) < sampleCapacity {
+		s.index[key] = len(s.docs)
+		s.docs = append(s.docs, cloneDocument(doc))
+		s.ids = append(s.ids, key)
+		return
+	}
+	if j := s.rand.Int63n(s.seen); j < sampleCapacity {
+		delete(s.index, s.ids[j])
+		s.index[key] = int(j)
+		s.docs[j], s.ids[j] = cloneDocument(doc), key
+	}
+}
+
+// update 文档更新后替换样本中的旧文档，文档不在样本中时不做修改
+func (s *collectionSample) update(recordId RecordId, doc Document) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i, ok := s.index[sampleKey(recordId)]; ok {
+		s.docs[i] = cloneDocument(doc)
+	}
+}
+
+// remove 记录删除的文档，文档在样本中时用最后一个样本填补其位置
+func (s *collectionSample) remove(recordId RecordId) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen > 0 {
+		s.seen--
+	}
+	key := sampleKey(recordId)
+	i, ok := s.index[key]
+	if !ok {
+		return
+	}
+	last := len(s.docs) - 1
+	s.docs[i], s.ids[i] = s.docs[last], s.ids[last]
+	s.index[s.ids[i]] = i
+	s.docs, s.ids = s.docs[:last], s.ids[:last]
+	delete(s.index, key)
+}
+
+// reset 清空样本，重建全部索引前调用，重建时重新插入的文档会再次抽样
+func (s *collectionSample) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen = 0
+	s.docs, s.ids = nil, nil
+	s.index = make(map[string]int)
+}
+
+// selectivity 返回样本中满足过滤条件的文档比例，样本为空或条件无法匹配时 ok 为 false
+func (s *collectionSample) selectivity(filter Document) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.docs) == 0 {
+		return 0, false
+	}
+	matched := 0
+	for _, doc := range s.docs {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return 0, false
+		}
+		if ok {
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(s.docs)), true
+}
+
+// boundFilter 返回过滤条件中用于计算索引扫描区间的字段条件，score 为 indexBounds 的返回值
+func boundFilter(spec Index, filter Document, score int) Document {
+	n := (score + 1) / 2
+	if n > len(spec.Keys) {
+		n = len(spec.Keys)
+	}
+	bounded := make(Document, n)
+	for _, key := range spec.Keys[:n] {
+		bounded[key.Field] = filter[key.Field]
+	}
+	return bounded
+}
+
+// estimatePlan 按集合样本估计计划需要读取的文档数和满足过滤条件的文档数
+// COLLSCAN 读取全部文档，IXSCAN 读取满足扫描区间所用条件的文档；无法按样本估计的项为 -1
+func estimatePlan(coll *Collection, plan *QueryPlan) {
+	plan.CostEstimate, plan.CardinalityEstimate = -1, -1
+	total := float64(coll.RecordStore.NumRecords())
+	if sel, ok := coll.sample.selectivity(plan.Filter); ok {
+		plan.CardinalityEstimate = sel * total
+	}
+	switch plan.Stage {
+	case StageCollScan:
+		plan.CostEstimate = total
+	case StageIxScan:
+		if sel, ok := coll.sample.selectivity(plan.bounded); ok {
+			plan.CostEstimate = sel * total
+		}
+	}
+}
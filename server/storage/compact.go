@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// Compact 重建集合记录存储的 B+树以回收大量删除后的稀疏节点，并校正记录数和数据大小的统计
+// 压缩期间持有写入锁，与文档写入串行执行；索引不在压缩范围内，可以通过 ReIndex 重建
+func (e *WiredTigerEngine) Compact(ctx context.Context, database, collection string) (*CompactStats, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return nil, fmt.Errorf("集合 %s 不存在: %w", makeNamespace(database, collection), ErrNamespaceNotFound)
+	}
+
+	e.oplogMu.Lock()
+	defer e.oplogMu.Unlock()
+	return coll.RecordStore.Compact(ctx)
+}
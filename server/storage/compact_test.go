@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestCompact 测试大量删除后压缩记录存储：统计准确、叶子节点变少且扫描结果不变
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("RecordStore", func(t *testing.T) {
+		const n = 1000
+		rs := storage.NewRecordStore("test.compact", 8)
+		for i := int64(1); i <= n; i++ {
+			if err := rs.InsertRecord(ctx, storage.NewRecordIdFromLong(i), []byte(fmt.Sprintf("record-%04d", i))); err != nil {
+				t.Fatalf("插入记录失败: %v", err)
+			}
+		}
+		// 删除偶数记录
+		for i := int64(2); i <= n; i += 2 {
+			if err := rs.DeleteRecord(ctx, storage.NewRecordIdFromLong(i)); err != nil {
+				t.Fatalf("删除记录失败: %v", err)
+			}
+		}
+
+		stats, err := rs.Compact(ctx)
+		if err != nil {
+			t.Fatalf("压缩失败: %v", err)
+		}
+		const recordSize = int64(len("record-0000"))
+		if stats.RecordsAfter != n/2 || stats.SizeAfter != n/2*recordSize {
+			t.Errorf("重新计算的统计不正确: %+v", stats)
+		}
+		if stats.RecordsBefore != stats.RecordsAfter || stats.SizeBefore != stats.SizeAfter {
+			t.Errorf("没有统计偏差时压缩前后应一致: %+v", stats)
+		}
+		if stats.LeavesAfter >= stats.LeavesBefore {
+			t.Errorf("压缩后叶子节点应变少: %+v", stats)
+		}
+		// 阶数为 8 时每个叶子最多 7 个键
+		if want := (n/2 + 6) / 7; stats.LeavesAfter != want {
+			t.Errorf("压缩后应有 %d 个叶子节点, got %d", want, stats.LeavesAfter)
+		}
+		if rs.NumRecords() != n/2 || rs.DataSize() != n/2*recordSize {
+			t.Errorf("压缩后的统计不正确: %d 条, %d 字节", rs.NumRecords(), rs.DataSize())
+		}
+
+		expectScan := func(want []int64) {
+			t.Helper()
+			cursor, err := rs.Scan(ctx, storage.NullRecordId())
+			if err != nil {
+				t.Fatalf("创建游标失败: %v", err)
+			}
+			defer cursor.Close()
+			i := 0
+			for cursor.Next() {
+				if i >= len(want) {
+					t.Fatalf("扫描到多余的记录 %s", cursor.RecordId())
+				}
+				got, _ := cursor.RecordId().AsBytes()
+				wantKey, _ := storage.NewRecordIdFromLong(want[i]).AsBytes()
+				if !bytes.Equal(got, wantKey) || string(cursor.Data()) != fmt.Sprintf("record-%04d", want[i]) {
+					t.Fatalf("第 %d 条记录应为 %d, got %q", i, want[i], cursor.Data())
+				}
+				i++
+			}
+			if i != len(want) {
+				t.Errorf("扫描到 %d 条记录, want %d", i, len(want))
+			}
+		}
+		var odd []int64
+		for i := int64(1); i <= n; i += 2 {
+			odd = append(odd, i)
+		}
+		expectScan(odd)
+
+		// 压缩后的树仍然可以正常读写
+		if _, err := rs.GetRecord(ctx, storage.NewRecordIdFromLong(501)); err != nil {
+			t.Errorf("压缩后读取记录失败: %v", err)
+		}
+		for i := int64(2); i <= 20; i += 2 {
+			if err := rs.InsertRecord(ctx, storage.NewRecordIdFromLong(i), []byte(fmt.Sprintf("record-%04d", i))); err != nil {
+				t.Fatalf("压缩后插入记录失败: %v", err)
+			}
+		}
+		want := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+		want = append(want, odd[10:]...)
+		expectScan(want)
+	})
+
+	t.Run("Engine", func(t *testing.T) {
+		engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+		if err != nil {
+			t.Fatalf("创建引擎失败: %v", err)
+		}
+		if err := engine.CreateIndex(ctx, "test", "items", storage.Index{Name: "tag_1", Keys: []storage.IndexKey{{Field: "tag", Direction: 1}}}); err != nil {
+			t.Fatalf("创建索引失败: %v", err)
+		}
+		for i := 0; i < 300; i++ {
+			tag := "keep"
+			if i%3 != 0 {
+				tag = "drop"
+			}
+			if err := engine.Insert(ctx, "test", "items", []storage.Document{{"_id": int32(i), "tag": tag}}); err != nil {
+				t.Fatalf("插入失败: %v", err)
+			}
+		}
+		if _, err := engine.Delete(ctx, "test", "items", storage.Document{"tag": "drop"}, false); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+
+		stats, err := engine.Compact(ctx, "test", "items")
+		if err != nil {
+			t.Fatalf("压缩失败: %v", err)
+		}
+		if stats.RecordsAfter != 100 {
+			t.Errorf("压缩后应有 100 条记录: %+v", stats)
+		}
+		collStats, err := engine.CollectionStats(ctx, "test", "items")
+		if err != nil || collStats.Count != 100 || collStats.Size != stats.SizeAfter {
+			t.Errorf("集合统计应与压缩结果一致: %+v, %v", collStats, err)
+		}
+		docs, err := engine.Find(ctx, "test", "items", storage.Document{"tag": "keep"})
+		if err != nil || len(docs) != 100 {
+			t.Errorf("压缩后按索引查询应返回 100 个文档, got %d, %v", len(docs), err)
+		}
+		results, err := engine.Validate(ctx, "test", "items")
+		if err != nil || !results.Valid() {
+			t.Errorf("压缩后集合应保持一致: %+v, %v", results, err)
+		}
+
+		if _, err := engine.Compact(ctx, "test", "missing"); !errors.Is(err, storage.ErrNamespaceNotFound) {
+			t.Errorf("不存在的集合应返回 ErrNamespaceNotFound, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"time"
+)
+
+// BSON 比较顺序中的类型分组，数值类型之间可以互相比较
+const (
+	canonicalMinKey    = 1
+	canonicalNull      = 5
+	canonicalNumber    = 10
+	canonicalString    = 15
+	canonicalDocument  = 20
+	canonicalArray     = 25
+	canonicalBinary    = 30
+	canonicalObjectID  = 35
+	canonicalBoolean   = 40
+	canonicalDate      = 45
+	canonicalTimestamp = 47
+	canonicalRegex     = 50
+	canonicalMaxKey    = 127
+	canonicalUnknown   = 126
+)
+
+// canonicalType 返回值在 BSON 比较顺序中的类型分组
+func canonicalType(v interface{}) int {
+	switch v.(type) {
+	case MinKey:
+		return canonicalMinKey
+	case nil:
+		return canonicalNull
+	case int, int32, int64, float32, float64, Decimal128:
+		return canonicalNumber
+	case string:
+		return canonicalString
+	case Document, map[string]interface{}:
+		return canonicalDocument
+	case []interface{}, []Document:
+		return canonicalArray
+	case []byte, Binary:
+		return canonicalBinary
+	case ObjectID:
+		return canonicalObjectID
+	case bool:
+		return canonicalBoolean
+	case time.Time:
+		return canonicalDate
+	case Timestamp:
+		return canonicalTimestamp
+	case Regex:
+		return canonicalRegex
+	case MaxKey:
+		return canonicalMaxKey
+	default:
+		return canonicalUnknown
+	}
+}
+
+// CompareValues 按 MongoDB 的 BSON 比较规则比较两个值
+// 返回: -1 (小于), 0 (等于), 1 (大于)
+func CompareValues(a, b interface{}) int {
+	ta, tb := canonicalType(a), canonicalType(b)
+	if ta != tb {
+		return compareInts(int64(ta), int64(tb))
+	}
+
+	switch ta {
+	case canonicalNumber:
+		return compareNumbers(a, b)
+	case canonicalString:
+		return strings.Compare(a.(string), b.(string))
+	case canonicalDocument:
+		return compareDocuments(toDocument(a), toDocument(b))
+	case canonicalArray:
+		return compareArrays(toArray(a), toArray(b))
+	case canonicalBinary:
+		// 依次比较长度、子类型和内容
+		x, _ := toBinary(a)
+		y, _ := toBinary(b)
+		if len(x.Data) != len(y.Data) {
+			return compareInts(int64(len(x.Data)), int64(len(y.Data)))
+		}
+		if x.Subtype != y.Subtype {
+			return compareInts(int64(x.Subtype), int64(y.Subtype))
+		}
+		return bytes.Compare(x.Data, y.Data)
+	case canonicalObjectID:
+		x, y := a.(ObjectID), b.(ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case canonicalBoolean:
+		x, y := a.(bool), b.(bool)
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	case canonicalDate:
+		return compareInts(a.(time.Time).UnixMilli(), b.(time.Time).UnixMilli())
+	case canonicalTimestamp:
+		x, y := a.(Timestamp), b.(Timestamp)
+		if x.T != y.T {
+			return compareInts(int64(x.T), int64(y.T))
+		}
+		return compareInts(int64(x.I), int64(y.I))
+	case canonicalRegex:
+		x, y := a.(Regex), b.(Regex)
+		if c := strings.Compare(x.Pattern, y.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Options, y.Options)
+	}
+	return 0
+}
+
+// compareNumbers 比较数值，统一转换为 float64
+func compareNumbers(a, b interface{}) int {
+	// 整数之间以及整数与浮点数之间按数学值比较，绝对值超过 2^53 的 int64 转为 float64 会丢失精度
+	if i, ok := toInt64(a); ok {
+		if j, ok := toInt64(b); ok {
+			return compareInts(i, j)
+		}
+		return -compareFloatInt(toFloat64(b), i)
+	}
+	if j, ok := toInt64(b); ok {
+		return compareFloatInt(toFloat64(a), j)
+	}
+	x, y := toFloat64(a), toFloat64(b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	case x == y:
+		return 0
+	}
+	// NaN 比任何数值都小
+	if x != x {
+		if y != y {
+			return 0
+		}
+		return -1
+	}
+	return 1
+}
+
+// compareDocuments 逐字段比较文档，依次比较值的类型分组、字段名和字段值
+func compareDocuments(a, b Document) int {
+	ka, kb := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(ka) && i < len(kb); i++ {
+		if c := compareInts(int64(canonicalType(a[ka[i]])), int64(canonicalType(b[kb[i]]))); c != 0 {
+			return c
+		}
+		if c := strings.Compare(ka[i], kb[i]); c != 0 {
+			return c
+		}
+		if c := CompareValues(a[ka[i]], b[kb[i]]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(ka)), int64(len(kb)))
+}
+
+// compareArrays 逐元素比较数组
+func compareArrays(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := CompareValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// toFloat64 将数值类型转换为 float64
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// toInt64 返回整数类型的值，浮点数返回 false
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// compareFloatInt 精确比较浮点数和整数，NaN 比任何数值都小
+func compareFloatInt(f float64, i int64) int {
+	switch {
+	case f != f:
+		return -1
+	case f < -(1 << 63):
+		return -1
+	case f >= 1<<63:
+		return 1
+	}
+	// 先比较整数部分，相同时由小数部分决定大小
+	whole := math.Trunc(f)
+	if c := compareInts(int64(whole), i); c != 0 {
+		return c
+	}
+	switch frac := f - whole; {
+	case frac < 0:
+		return -1
+	case frac > 0:
+		return 1
+	}
+	return 0
+}
+
+// isNumber 判断是否为数值类型
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float32, float64:
+		return true
+	}
+	return false
+}
+
+// toDocument 将嵌套文档统一为 Document
+func toDocument(v interface{}) Document {
+	switch d := v.(type) {
+	case Document:
+		return d
+	case map[string]interface{}:
+		return Document(d)
+	}
+	return nil
+}
+
+// toArray 将数组统一为 []interface{}
+func toArray(v interface{}) []interface{} {
+	switch a := v.(type) {
+	case []interface{}:
+		return a
+	case []Document:
+		arr := make([]interface{}, len(a))
+		for i := range a {
+			arr[i] = a[i]
+		}
+		return arr
+	}
+	return nil
+}
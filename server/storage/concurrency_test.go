@@ -0,0 +1,250 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+	"github.com/zhukovaskychina/xmongodb/server/storage/btree"
+)
+
+// TestConcurrentDatabases 测试并发创建、删除和列出数据库，配合 go test -race 检查数据竞争
+func TestConcurrentDatabases(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("db%d_%d", i, j)
+				if err := engine.CreateDatabase(ctx, name); err != nil {
+					t.Errorf("创建数据库 %s 失败: %v", name, err)
+					return
+				}
+				if err := engine.Insert(ctx, name, "items", []storage.Document{{"n": int32(j)}}); err != nil {
+					t.Errorf("插入失败: %v", err)
+					return
+				}
+				if _, err := engine.ListCollections(ctx, name); err != nil {
+					t.Errorf("列出集合失败: %v", err)
+					return
+				}
+				if j%2 == 0 {
+					if err := engine.DropCollection(ctx, name, "items"); err != nil {
+						t.Errorf("删除集合失败: %v", err)
+						return
+					}
+					if err := engine.DropDatabase(ctx, name); err != nil {
+						t.Errorf("删除数据库 %s 失败: %v", name, err)
+						return
+					}
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := engine.ListDatabases(ctx); err != nil {
+					t.Errorf("列出数据库失败: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	databases, err := engine.ListDatabases(ctx)
+	if err != nil {
+		t.Fatalf("列出数据库失败: %v", err)
+	}
+	// 写入时会隐式创建保存 oplog 的 local 库
+	remaining := 0
+	for _, name := range databases {
+		if strings.HasPrefix(name, "db") {
+			remaining++
+		}
+	}
+	if remaining != workers*25 {
+		t.Errorf("应剩余 %d 个数据库, got %d", workers*25, remaining)
+	}
+}
+
+// TestConcurrentRecordStore 测试并发写入同一个 RecordStore
+func TestConcurrentRecordStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("并发插入相同 RecordId 只有一个成功", func(t *testing.T) {
+		for round := 0; round < 20; round++ {
+			rs := storage.NewRecordStore("test.items", btree.DefaultOrder)
+			recordId := storage.NewRecordIdFromLong(1)
+			var (
+				wg        sync.WaitGroup
+				mu        sync.Mutex
+				succeeded int
+			)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := rs.InsertRecord(ctx, recordId, []byte(fmt.Sprintf("doc-%d", i))); err == nil {
+						mu.Lock()
+						succeeded++
+						mu.Unlock()
+					}
+				}(i)
+			}
+			wg.Wait()
+			if succeeded != 1 || rs.NumRecords() != 1 {
+				t.Fatalf("第 %d 轮: 成功 %d 次, 记录数 %d, 都应为 1", round, succeeded, rs.NumRecords())
+			}
+		}
+	})
+
+	t.Run("并发更新和删除时统计正确", func(t *testing.T) {
+		rs := storage.NewRecordStore("test.items", btree.DefaultOrder)
+		for i := int64(1); i <= 100; i++ {
+			if err := rs.InsertRecord(ctx, storage.NewRecordIdFromLong(i), []byte("x")); err != nil {
+				t.Fatalf("插入失败: %v", err)
+			}
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := int64(1); i <= 100; i++ {
+					recordId := storage.NewRecordIdFromLong(i)
+					if i%2 == 0 {
+						rs.DeleteRecord(ctx, recordId)
+					} else {
+						rs.UpdateRecord(ctx, recordId, []byte(fmt.Sprintf("%0*d", w+1, 0)))
+					}
+					rs.GetRecord(ctx, recordId)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		var size int64
+		cursor, err := rs.Scan(ctx, storage.NullRecordId())
+		if err != nil {
+			t.Fatalf("扫描失败: %v", err)
+		}
+		for cursor.Next() {
+			size += int64(len(cursor.Data()))
+		}
+		cursor.Close()
+		if rs.NumRecords() != 50 || rs.DataSize() != size {
+			t.Errorf("统计不正确: 记录数 %d, 数据大小 %d, 实际大小 %d", rs.NumRecords(), rs.DataSize(), size)
+		}
+	})
+
+	t.Run("清空与读取并发", func(t *testing.T) {
+		rs := storage.NewRecordStore("test.items", btree.DefaultOrder)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := int64(1); i <= 100; i++ {
+				rs.InsertRecord(ctx, storage.NewRecordIdFromLong(i), []byte("x"))
+				if i%10 == 0 {
+					rs.Truncate(ctx)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if cursor, err := rs.Scan(ctx, storage.NullRecordId()); err == nil {
+					cursor.Close()
+				}
+				rs.GetRecord(ctx, storage.NewRecordIdFromLong(int64(i)))
+			}
+		}()
+		wg.Wait()
+	})
+}
+
+// TestBTreeInsertIfAbsent 测试并发对同一个键调用 InsertIfAbsent 时只有一个插入成功
+func TestBTreeInsertIfAbsent(t *testing.T) {
+	tree := btree.NewBTree(4)
+	var (
+		wg       sync.WaitGroup
+		inserted int32
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < 50; k++ {
+				ok, err := tree.InsertIfAbsent([]byte(fmt.Sprintf("key-%02d", k)), []byte(fmt.Sprint(i)))
+				if err != nil {
+					t.Errorf("插入失败: %v", err)
+					return
+				}
+				if ok {
+					atomic.AddInt32(&inserted, 1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if inserted != 50 || tree.Size() != 50 {
+		t.Errorf("每个键只应插入一次: 插入 %d 次, 树中 %d 个键", inserted, tree.Size())
+	}
+	if ok, _ := tree.InsertIfAbsent([]byte("key-00"), []byte("new")); ok {
+		t.Error("键已存在时不应插入")
+	}
+	if _, err := tree.InsertIfAbsent(nil, []byte("x")); err == nil {
+		t.Error("空键应返回错误")
+	}
+}
+
+// TestConcurrentUniqueIndex 测试并发向唯一索引插入相同的键时只有一个成功
+func TestConcurrentUniqueIndex(t *testing.T) {
+	ctx := context.Background()
+	for round := 0; round < 20; round++ {
+		idx := storage.NewSortedDataInterface("sku_1", true, btree.DefaultOrder)
+		var (
+			wg       sync.WaitGroup
+			inserted int32
+		)
+		for i := 1; i <= 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := idx.Insert(ctx, []byte("sku-1"), storage.NewRecordIdFromLong(int64(i))); err == nil {
+					atomic.AddInt32(&inserted, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if inserted != 1 || idx.NumEntries() != 1 {
+			t.Fatalf("第 %d 轮: 插入成功 %d 次, 条目数 %d, 都应为 1", round, inserted, idx.NumEntries())
+		}
+	}
+
+	// 重复插入相同的键和 RecordId 不重复计数
+	idx := storage.NewSortedDataInterface("tags_1", false, btree.DefaultOrder)
+	for i := 0; i < 2; i++ {
+		if err := idx.Insert(ctx, []byte("a"), storage.NewRecordIdFromLong(1)); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+	}
+	if n := idx.NumEntries(); n != 1 {
+		t.Errorf("条目数应为 1, got %d", n)
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"strings"
+)
+
+// StageProjectionCovered 只用索引键构造结果的投影阶段，不读取文档
+const StageProjectionCovered = "PROJECTION_COVERED"
+
+// coverPlan 判断 IXSCAN 计划能否只用索引键返回结果，可以时把计划标记为覆盖查询
+// 要求索引不是多键索引，过滤条件和投影用到的字段都是索引字段，投影为只包含索引字段的包含模式，
+// 且 _id 被排除或者也是索引字段；projection 为空时需要返回整个文档，不能覆盖
+func coverPlan(coll *Collection, plan *QueryPlan, projection Document) {
+	if plan.Stage != StageIxScan || plan.IsMultiKey || len(projection) == 0 {
+		return
+	}
+	spec, ok := coll.indexSpec(plan.IndexName)
+	if !ok || spec.Type() != "" {
+		return
+	}
+	fields := make(map[string]bool, len(spec.Keys))
+	for _, key := range spec.Keys {
+		fields[key.Field] = true
+	}
+	if !coveredFilter(plan.Filter, fields) || !coveredProjection(projection, fields) {
+		return
+	}
+	plan.Covered = true
+	plan.Projection = projection
+	plan.coveredFields = make([]string, len(spec.Keys))
+	for i, key := range spec.Keys {
+		plan.coveredFields[i] = key.Field
+	}
+}
+
+// coveredFilter 过滤条件中的字段是否都是索引字段，$and、$or 和 $nor 检查每个子条件
+func coveredFilter(filter Document, fields map[string]bool) bool {
+	for key, cond := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			for _, clause := range toArray(cond) {
+				sub := toDocument(clause)
+				if sub == nil || !coveredFilter(sub, fields) {
+					return false
+				}
+			}
+		default:
+			if strings.HasPrefix(key, "$") || !fields[key] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// coveredProjection 投影是否为只包含索引字段的包含模式，_id 没有被排除时也需要是索引字段
+func coveredProjection(projection Document, fields map[string]bool) bool {
+	spec, err := parseProjection(projection)
+	if err != nil || !spec.inclusion || spec.positional != "" || len(spec.slices) > 0 || len(spec.elemMatch) > 0 {
+		return false
+	}
+	if include, set := spec.fields["_id"]; (!set || isTruthy(include)) && !fields["_id"] {
+		return false
+	}
+	for path := range spec.fields {
+		if path != "_id" && !fields[path] {
+			return false
+		}
+	}
+	return true
+}
+
+// coveredDocument 用索引键还原索引字段组成的文档，点号分隔的字段还原为嵌套文档
+// 索引键中没有保存取值或者取值为 null 时返回 false：null 可能表示字段缺失，需要读取文档才能区分
+func coveredDocument(fields []string, key, typeBits []byte) (Document, bool) {
+	doc := Document{}
+	for _, field := range fields {
+		var v interface{}
+		var err error
+		if v, key, typeBits, err = decodeKeyValue(key, typeBits); err != nil || v == nil {
+			return nil, false
+		}
+		path := strings.Split(field, ".")
+		parent := doc
+		for _, name := range path[:len(path)-1] {
+			child, ok := parent[name].(Document)
+			if !ok {
+				child = Document{}
+				parent[name] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = v
+	}
+	return doc, true
+}
+
+// distinctPlan 返回只用索引键求字段不同取值的覆盖查询计划，没有可用的索引时返回 nil
+// 过滤条件选中的索引能覆盖查询时直接使用；过滤条件为空时扫描第一个包含该字段、可以覆盖的普通索引的全部条目，
+// 隐藏索引和部分索引不使用，部分索引可能缺少集合中的文档
+func distinctPlan(coll *Collection, field string, filter Document) (*QueryPlan, error) {
+	projection := Document{field: int32(1)}
+	if field != "_id" {
+		projection["_id"] = int32(0)
+	}
+	if len(filter) > 0 {
+		plan, err := planQuery(coll, filter)
+		if err != nil {
+			return nil, err
+		}
+		if coverPlan(coll, plan, projection); !plan.Covered {
+			return nil, nil
+		}
+		return plan, nil
+	}
+	for _, spec := range coll.IndexSpecs {
+		if spec.Hidden || spec.PartialFilterExpression != nil || coll.index(spec.Name) == nil {
+			continue
+		}
+		plan := &QueryPlan{
+			Stage:      StageIxScan,
+			IndexName:  spec.Name,
+			KeyPattern: spec.KeyPattern(),
+			IsMultiKey: coll.multikey[spec.Name],
+			Filter:     filter,
+			intervals:  []keyInterval{{}},
+		}
+		if coverPlan(coll, plan, projection); plan.Covered {
+			return plan, nil
+		}
+	}
+	return nil, nil
+}
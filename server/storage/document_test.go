@@ -0,0 +1,1030 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestDocumentBSON 测试 Document 与 BSON 的相互转换
+func TestDocumentBSON(t *testing.T) {
+	id := storage.NewObjectID()
+	now := time.UnixMilli(time.Now().UnixMilli()).UTC()
+	doc := storage.Document{
+		"_id":     id,
+		"name":    "Alice",
+		"age":     int32(30),
+		"balance": int64(1) << 40,
+		"score":   9.5,
+		"active":  true,
+		"created": now,
+		"tags":    []interface{}{"a", int32(1)},
+		"address": storage.Document{"city": "Beijing"},
+		"note":    nil,
+	}
+
+	data, err := storage.MarshalDocument(doc)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	decoded, err := storage.UnmarshalDocument(data)
+	if err != nil {
+		t.Fatalf("解码失败: %v", err)
+	}
+
+	for key, want := range doc {
+		if storage.CompareValues(decoded[key], want) != 0 {
+			t.Errorf("字段 %s 不一致: got %#v, want %#v", key, decoded[key], want)
+		}
+	}
+	if _, ok := decoded["age"].(int32); !ok {
+		t.Errorf("int32 类型丢失: %T", decoded["age"])
+	}
+	if _, ok := decoded["balance"].(int64); !ok {
+		t.Errorf("int64 类型丢失: %T", decoded["balance"])
+	}
+}
+
+// TestBinaryBSON 测试二进制数据按子类型编码和解码，通用子类型解码为 []byte，其他子类型解码为 Binary
+func TestBinaryBSON(t *testing.T) {
+	uuid := storage.Binary{Subtype: storage.BinarySubtypeUUID, Data: []byte{
+		0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0x4d, 0xef, 0x80, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+	}}
+	doc := storage.Document{
+		"generic": []byte{1, 2, 3},
+		"wrapped": storage.Binary{Subtype: storage.BinarySubtypeGeneric, Data: []byte{4, 5}},
+		"uuid":    uuid,
+		"empty":   storage.Binary{Subtype: 0x80},
+	}
+	data, err := storage.MarshalDocument(doc)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	raw := bsoncore.Document(data)
+	for key, want := range map[string]byte{"generic": 0x00, "wrapped": 0x00, "uuid": 0x04, "empty": 0x80} {
+		if subtype, _, ok := raw.Lookup(key).BinaryOK(); !ok || subtype != want {
+			t.Errorf("字段 %s 的子类型应为 %d: %d, %v", key, want, subtype, ok)
+		}
+	}
+
+	decoded, err := storage.UnmarshalDocument(data)
+	if err != nil {
+		t.Fatalf("解码失败: %v", err)
+	}
+	if b, ok := decoded["generic"].([]byte); !ok || !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Errorf("通用子类型应解码为 []byte: %#v", decoded["generic"])
+	}
+	if b, ok := decoded["wrapped"].([]byte); !ok || !bytes.Equal(b, []byte{4, 5}) {
+		t.Errorf("子类型为 0 的 Binary 应解码为 []byte: %#v", decoded["wrapped"])
+	}
+	if b, ok := decoded["uuid"].(storage.Binary); !ok || b.Subtype != storage.BinarySubtypeUUID || !bytes.Equal(b.Data, uuid.Data) {
+		t.Errorf("UUID 应解码为子类型 4 的 Binary: %#v", decoded["uuid"])
+	}
+	if b, ok := decoded["empty"].(storage.Binary); !ok || b.Subtype != 0x80 || len(b.Data) != 0 {
+		t.Errorf("空的自定义子类型二进制解码错误: %#v", decoded["empty"])
+	}
+	for key, want := range doc {
+		if storage.CompareValues(decoded[key], want) != 0 {
+			t.Errorf("字段 %s 不一致: got %#v, want %#v", key, decoded[key], want)
+		}
+	}
+
+	// 先比较长度，再比较子类型，最后比较内容
+	ordered := []interface{}{
+		[]byte{9},
+		storage.Binary{Subtype: storage.BinarySubtypeUUID, Data: []byte{1}},
+		[]byte{1, 2},
+		[]byte{1, 3},
+		storage.Binary{Subtype: storage.BinarySubtypeUUID, Data: []byte{0, 0}},
+	}
+	for i := 1; i < len(ordered); i++ {
+		if storage.CompareValues(ordered[i-1], ordered[i]) >= 0 {
+			t.Errorf("%#v 应小于 %#v", ordered[i-1], ordered[i])
+		}
+	}
+	if storage.CompareValues([]byte{1, 2}, storage.Binary{Data: []byte{1, 2}}) != 0 {
+		t.Error("[]byte 应等于内容相同的通用子类型 Binary")
+	}
+}
+
+// TestBinaryIndex 测试二进制字段的索引键保留子类型，可用于等值和范围查询以及唯一约束
+func TestBinaryIndex(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	index := storage.Index{Name: "key_1", Keys: []storage.IndexKey{{Field: "key", Direction: 1}}, Unique: true}
+	if err := engine.CreateIndex(ctx, "test", "blobs", index); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	uuid := func(n byte) storage.Binary {
+		data := make([]byte, 16)
+		data[15] = n
+		return storage.Binary{Subtype: storage.BinarySubtypeUUID, Data: data}
+	}
+	docs := []storage.Document{
+		{"_id": int32(1), "key": uuid(1)},
+		{"_id": int32(2), "key": uuid(2)},
+		{"_id": int32(3), "key": uuid(3)},
+		{"_id": int32(4), "key": make([]byte, 16)},
+		{"_id": int32(5), "key": []byte{1}},
+	}
+	if err := engine.Insert(ctx, "test", "blobs", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+
+	// 内容与 uuid(0) 相同但子类型不同的通用二进制不违反唯一约束，同子类型的重复值违反
+	if err := engine.Insert(ctx, "test", "blobs", []storage.Document{{"_id": int32(6), "key": uuid(0)}}); err != nil {
+		t.Errorf("子类型不同的二进制不应视为重复: %v", err)
+	}
+	err = engine.Insert(ctx, "test", "blobs", []storage.Document{{"_id": int32(7), "key": storage.Binary{Data: []byte{1}}}})
+	if !errors.Is(err, storage.ErrDuplicateKey) {
+		t.Errorf("与 []byte 内容相同的通用子类型 Binary 应视为重复: %v", err)
+	}
+
+	e, err := engine.Explain(ctx, "test", "blobs", storage.Document{"key": uuid(2)}, nil, nil, true)
+	if err != nil {
+		t.Fatalf("explain 失败: %v", err)
+	}
+	if e.Plan.Stage != storage.StageIxScan || e.Plan.IndexName != "key_1" || e.Stats.DocsExamined != 1 || e.Stats.NReturned != 1 {
+		t.Errorf("按 UUID 等值查询应使用索引且只读取一个文档: %+v, %+v", e.Plan, e.Stats)
+	}
+
+	found, err := engine.Find(ctx, "test", "blobs", storage.Document{"key": storage.Document{"$gt": uuid(1)}})
+	if err != nil {
+		t.Fatalf("范围查询失败: %v", err)
+	}
+	ids := make([]int32, 0, len(found))
+	for _, doc := range found {
+		ids = append(ids, doc["_id"].(int32))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if !reflect.DeepEqual(ids, []int32{2, 3}) {
+		t.Errorf("大于 uuid(1) 的文档应为 2 和 3: %v", ids)
+	}
+	for _, doc := range found {
+		if b, ok := doc["key"].(storage.Binary); !ok || b.Subtype != storage.BinarySubtypeUUID {
+			t.Errorf("查询结果应保留子类型: %#v", doc["key"])
+		}
+	}
+}
+
+// TestOrderedDocument 测试有序文档编码时 _id 在最前且其余字段保持写入顺序
+func TestOrderedDocument(t *testing.T) {
+	doc := storage.OrderedDocument{
+		{Key: "zeta", Value: int32(1)},
+		{Key: "alpha", Value: "a"},
+		{Key: "_id", Value: int32(7)},
+		{Key: "nested", Value: storage.OrderedDocument{
+			{Key: "y", Value: true},
+			{Key: "b", Value: nil},
+		}},
+		{Key: "list", Value: []interface{}{storage.OrderedDocument{{Key: "q", Value: 1.5}, {Key: "p", Value: int64(2)}}}},
+	}
+	data, err := storage.MarshalOrderedDocument(doc)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	decoded, err := storage.UnmarshalOrderedDocument(data)
+	if err != nil {
+		t.Fatalf("解码失败: %v", err)
+	}
+	keys := func(d storage.OrderedDocument) string {
+		names := make([]string, len(d))
+		for i, e := range d {
+			names[i] = e.Key
+		}
+		return fmt.Sprint(names)
+	}
+	if got, want := keys(decoded), "[_id zeta alpha nested list]"; got != want {
+		t.Fatalf("字段顺序 = %s, want %s", got, want)
+	}
+	nested, _ := decoded.Lookup("nested")
+	if got, want := keys(nested.(storage.OrderedDocument)), "[y b]"; got != want {
+		t.Errorf("嵌套文档字段顺序 = %s, want %s", got, want)
+	}
+	list, _ := decoded.Lookup("list")
+	if got, want := keys(list.([]interface{})[0].(storage.OrderedDocument)), "[q p]"; got != want {
+		t.Errorf("数组中文档字段顺序 = %s, want %s", got, want)
+	}
+
+	// 与 map 形式相互转换
+	m := decoded.Map()
+	if storage.CompareValues(m, doc.Map()) != 0 {
+		t.Errorf("Map() = %v, want %v", m, doc.Map())
+	}
+	if _, ok := m["nested"].(storage.Document); !ok {
+		t.Errorf("嵌套的有序文档应转换为 Document: %T", m["nested"])
+	}
+	if got, want := keys(storage.NewOrderedDocument(m)), "[_id alpha list nested zeta]"; got != want {
+		t.Errorf("NewOrderedDocument 字段顺序 = %s, want %s", got, want)
+	}
+	fromMap, err := storage.MarshalDocument(m)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	if first := bsoncore.Document(fromMap).Index(0).Key(); first != "_id" {
+		t.Errorf("MarshalDocument 第一个字段 = %s, want _id", first)
+	}
+}
+
+// TestMatches 测试过滤条件匹配
+func TestMatches(t *testing.T) {
+	doc := storage.Document{
+		"name":     "Alice",
+		"age":      int32(30),
+		"tags":     []interface{}{"go", "db"},
+		"address":  storage.Document{"city": "Beijing"},
+		"orders":   []interface{}{storage.Document{"qty": int32(5)}, storage.Document{"qty": int32(10)}},
+		"nickname": nil,
+		"scores":   []interface{}{int32(1), int32(2), int32(3)},
+		"readings": []interface{}{int32(3), int32(11)},
+	}
+
+	tests := []struct {
+		name   string
+		filter storage.Document
+		want   bool
+	}{
+		{"空过滤", storage.Document{}, true},
+		{"相等", storage.Document{"name": "Alice"}, true},
+		{"数值类型不同", storage.Document{"age": 30.0}, true},
+		{"不相等", storage.Document{"name": "Bob"}, false},
+		{"嵌套路径", storage.Document{"address.city": "Beijing"}, true},
+		{"数组元素", storage.Document{"tags": "db"}, true},
+		{"数组文档路径", storage.Document{"orders.qty": int32(10)}, true},
+		{"数组下标", storage.Document{"tags.0": "go"}, true},
+		{"null 匹配缺失字段", storage.Document{"missing": nil}, true},
+		{"$gt", storage.Document{"age": storage.Document{"$gt": int32(25)}}, true},
+		{"$lt 不满足", storage.Document{"age": storage.Document{"$lt": int32(25)}}, false},
+		{"区间", storage.Document{"age": storage.Document{"$gte": int32(30), "$lte": int32(30)}}, true},
+		{"类型不同不比较", storage.Document{"age": storage.Document{"$gt": "a"}}, false},
+		{"$ne", storage.Document{"name": storage.Document{"$ne": "Bob"}}, true},
+		{"$in", storage.Document{"tags": storage.Document{"$in": []interface{}{"rust", "go"}}}, true},
+		{"$nin", storage.Document{"tags": storage.Document{"$nin": []interface{}{"go"}}}, false},
+		{"$exists", storage.Document{"address.city": storage.Document{"$exists": true}}, true},
+		{"$exists 缺失字段", storage.Document{"address.zip": storage.Document{"$exists": true}}, false},
+		{"$exists: false 嵌套路径", storage.Document{"address.zip": storage.Document{"$exists": false}}, true},
+		{"$exists: false 缺失父字段", storage.Document{"contact.email": storage.Document{"$exists": false}}, true},
+		{"$exists: false 字段存在", storage.Document{"orders.qty": storage.Document{"$exists": false}}, false},
+		{"$exists 值为 null", storage.Document{"nickname": storage.Document{"$exists": true}}, true},
+		{"$type 别名", storage.Document{"name": storage.Document{"$type": "string"}}, true},
+		{"$type 编号", storage.Document{"age": storage.Document{"$type": int32(16)}}, true},
+		{"$type 类型不符", storage.Document{"age": storage.Document{"$type": "long"}}, false},
+		{"$type number", storage.Document{"age": storage.Document{"$type": "number"}}, true},
+		{"$type 数组参数", storage.Document{"age": storage.Document{"$type": []interface{}{"string", "int"}}}, true},
+		{"$type array", storage.Document{"tags": storage.Document{"$type": "array"}}, true},
+		{"$type 数组元素", storage.Document{"tags": storage.Document{"$type": "string"}}, true},
+		{"$type 文档不是数组", storage.Document{"address": storage.Document{"$type": "array"}}, false},
+		{"$type 数组不是文档", storage.Document{"tags": storage.Document{"$type": "object"}}, false},
+		{"$type null", storage.Document{"nickname": storage.Document{"$type": "null"}}, true},
+		{"$type 缺失字段", storage.Document{"missing": storage.Document{"$type": "null"}}, false},
+		{"$size", storage.Document{"tags": storage.Document{"$size": int32(2)}}, true},
+		{"$size 长度不符", storage.Document{"tags": storage.Document{"$size": 3.0}}, false},
+		{"$size 非数组", storage.Document{"name": storage.Document{"$size": int32(5)}}, false},
+		{"$size 缺失字段", storage.Document{"missing": storage.Document{"$size": int32(0)}}, false},
+		{"$and", storage.Document{"$and": []interface{}{
+			storage.Document{"name": "Alice"},
+			storage.Document{"age": storage.Document{"$gt": int32(25)}},
+		}}, true},
+		{"$and 任一不满足", storage.Document{"$and": []interface{}{
+			storage.Document{"name": "Alice"},
+			storage.Document{"age": storage.Document{"$gt": int32(35)}},
+		}}, false},
+		{"$or", storage.Document{"$or": []interface{}{
+			storage.Document{"name": "Bob"},
+			storage.Document{"tags": "db"},
+		}}, true},
+		{"$or 都不满足", storage.Document{"$or": []interface{}{
+			storage.Document{"name": "Bob"},
+			storage.Document{"age": storage.Document{"$lt": int32(18)}},
+		}}, false},
+		{"$or 嵌套 $and", storage.Document{"$or": []interface{}{
+			storage.Document{"$and": []interface{}{storage.Document{"name": "Bob"}, storage.Document{"age": int32(30)}}},
+			storage.Document{"$and": []interface{}{storage.Document{"name": "Alice"}, storage.Document{"address.city": "Beijing"}}},
+		}}, true},
+		{"$and 嵌套 $or", storage.Document{"$and": []interface{}{
+			storage.Document{"$or": []interface{}{storage.Document{"name": "Bob"}, storage.Document{"age": int32(30)}}},
+			storage.Document{"$or": []interface{}{storage.Document{"tags": "rust"}, storage.Document{"orders.qty": int32(7)}}},
+		}}, false},
+		{"$or 与字段隐式 $and", storage.Document{
+			"name": "Alice",
+			"$or":  []interface{}{storage.Document{"age": int32(31)}, storage.Document{"age": int32(30)}},
+		}, true},
+		{"$nor", storage.Document{"$nor": []interface{}{
+			storage.Document{"name": "Bob"},
+			storage.Document{"age": storage.Document{"$lt": int32(18)}},
+		}}, true},
+		{"$nor 任一满足", storage.Document{"$nor": []interface{}{
+			storage.Document{"name": "Bob"},
+			storage.Document{"name": "Alice"},
+		}}, false},
+		{"$not 取反 $gt", storage.Document{"age": storage.Document{"$not": storage.Document{"$gt": int32(25)}}}, false},
+		{"$not 取反不满足的 $gt", storage.Document{"age": storage.Document{"$not": storage.Document{"$gt": int32(35)}}}, true},
+		{"$not 缺失字段", storage.Document{"missing": storage.Document{"$not": storage.Document{"$gt": int32(25)}}}, true},
+		{"$all", storage.Document{"scores": storage.Document{"$all": []interface{}{int32(1), int32(2)}}}, true},
+		{"$all 缺少元素", storage.Document{"scores": storage.Document{"$all": []interface{}{int32(1), int32(4)}}}, false},
+		{"$all 空数组", storage.Document{"scores": storage.Document{"$all": []interface{}{}}}, false},
+		{"$all 非数组字段", storage.Document{"name": storage.Document{"$all": []interface{}{"Alice"}}}, true},
+		{"$all 数组文档路径", storage.Document{"orders.qty": storage.Document{"$all": []interface{}{int32(5), int32(10)}}}, true},
+		{"$all 与 $elemMatch", storage.Document{"orders": storage.Document{"$all": []interface{}{
+			storage.Document{"$elemMatch": storage.Document{"qty": storage.Document{"$lt": int32(6)}}},
+			storage.Document{"$elemMatch": storage.Document{"qty": storage.Document{"$gt": int32(6)}}},
+		}}}, true},
+		{"$elemMatch 同一元素满足", storage.Document{"scores": storage.Document{"$elemMatch": storage.Document{"$gt": int32(1), "$lt": int32(3)}}}, true},
+		// 隐式的数组遍历中 3 满足 $lt、11 满足 $gt；$elemMatch 要求同一个元素同时满足
+		{"数组遍历由不同元素满足", storage.Document{"readings": storage.Document{"$gt": int32(5), "$lt": int32(10)}}, true},
+		{"$elemMatch 没有元素同时满足", storage.Document{"readings": storage.Document{"$elemMatch": storage.Document{"$gt": int32(5), "$lt": int32(10)}}}, false},
+		{"$elemMatch 文档元素", storage.Document{"orders": storage.Document{"$elemMatch": storage.Document{"qty": storage.Document{"$gt": int32(6)}}}}, true},
+		{"$elemMatch 文档元素不满足", storage.Document{"orders": storage.Document{"$elemMatch": storage.Document{"qty": storage.Document{"$gt": int32(6), "$lt": int32(9)}}}}, false},
+		{"$elemMatch 子过滤条件含 $or", storage.Document{"orders": storage.Document{"$elemMatch": storage.Document{"$or": []interface{}{
+			storage.Document{"qty": int32(1)}, storage.Document{"qty": int32(10)},
+		}}}}, true},
+		{"$elemMatch 非数组字段", storage.Document{"age": storage.Document{"$elemMatch": storage.Document{"$gt": int32(1)}}}, false},
+		{"$not 取反区间", storage.Document{"age": storage.Document{"$not": storage.Document{"$gte": int32(20), "$lt": int32(30)}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storage.Matches(doc, tt.filter)
+			if err != nil {
+				t.Fatalf("匹配出错: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := storage.Matches(doc, storage.Document{"age": storage.Document{"$foo": 1}}); err == nil {
+		t.Error("未知操作符应返回错误")
+	}
+	for _, filter := range []storage.Document{
+		{"$or": []interface{}{}},
+		{"$and": []interface{}{"name"}},
+		{"$where": "true"},
+		{"age": storage.Document{"$not": int32(30)}},
+		{"scores": storage.Document{"$all": int32(1)}},
+		{"scores": storage.Document{"$elemMatch": int32(1)}},
+		{"age": storage.Document{"$type": "integer"}},
+		{"age": storage.Document{"$type": int32(42)}},
+		{"tags": storage.Document{"$size": int32(-1)}},
+		{"tags": storage.Document{"$size": 1.5}},
+		{"tags": storage.Document{"$size": "2"}},
+	} {
+		if _, err := storage.Matches(doc, filter); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("%v 应返回 ErrBadValue: %v", filter, err)
+		}
+	}
+}
+
+// TestNumericComparison 测试 int32、int64 和 double 按数学值比较，包括超过 2^53 的 int64
+func TestNumericComparison(t *testing.T) {
+	const big = int64(1) << 60
+	tests := []struct {
+		value, query interface{}
+		want         bool
+	}{
+		{int32(30), 30.0, true},
+		{30.0, int32(30), true},
+		{int64(30), 30.0, true},
+		{30.0, int64(30), true},
+		{int32(30), int64(30), true},
+		{30.5, int32(30), false},
+		{big, big + 1, false},
+		{big + 1, float64(big), false},
+		{big, float64(big), true},
+		{int64(math.MaxInt64), float64(math.MaxInt64), false}, // float64(MaxInt64) 为 2^63
+		{int64(math.MinInt64), float64(math.MinInt64), true},
+	}
+	for _, tt := range tests {
+		got, err := storage.Matches(storage.Document{"n": tt.value}, storage.Document{"n": tt.query})
+		if err != nil || got != tt.want {
+			t.Errorf("%T(%v) == %T(%v): got %v, %v, want %v", tt.value, tt.value, tt.query, tt.query, got, err, tt.want)
+		}
+	}
+	if got, _ := storage.Matches(storage.Document{"n": big + 1}, storage.Document{"n": storage.Document{"$gt": float64(big)}}); !got {
+		t.Error("2^60+1 应大于 double 2^60")
+	}
+	if c := storage.CompareValues(big-1, float64(big)); c != -1 {
+		t.Errorf("CompareValues(2^60-1, 2^60) = %d, want -1", c)
+	}
+
+	// 索引键同样按数学值编码，大整数不会因为转为 float64 而合并
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := []storage.Document{
+		{"_id": int32(1), "n": int32(30)},
+		{"_id": int32(2), "n": 30.0},
+		{"_id": int32(3), "n": big},
+		{"_id": int32(4), "n": big + 1},
+		{"_id": int32(5), "n": 30.5},
+	}
+	if err := engine.Insert(ctx, "test", "numbers", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.CreateIndex(ctx, "test", "numbers", storage.Index{Name: "n_1", Keys: []storage.IndexKey{{Field: "n", Direction: 1}}}); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	for _, c := range []struct {
+		filter storage.Document
+		want   []int32
+	}{
+		{storage.Document{"n": int64(30)}, []int32{1, 2}},
+		{storage.Document{"n": 30.0}, []int32{1, 2}},
+		{storage.Document{"n": big + 1}, []int32{4}},
+		{storage.Document{"n": float64(big)}, []int32{3}},
+		{storage.Document{"n": storage.Document{"$gt": float64(big)}}, []int32{4}},
+		{storage.Document{"n": storage.Document{"$gt": int32(30), "$lt": big}}, []int32{5}},
+	} {
+		e, err := engine.Explain(ctx, "test", "numbers", c.filter, nil, nil, true)
+		if err != nil || e.Plan.Stage != storage.StageIxScan {
+			t.Fatalf("%v 应使用索引: %+v, %v", c.filter, e, err)
+		}
+		found, err := engine.Find(ctx, "test", "numbers", c.filter)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		got := make([]int32, len(found))
+		for i, doc := range found {
+			got[i] = doc["_id"].(int32)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%v: got %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
+
+// TestApplyProjection 测试包含/排除投影和数组投影操作符
+func TestApplyProjection(t *testing.T) {
+	doc := storage.Document{
+		"_id":    int32(1),
+		"name":   "Alice",
+		"grades": []interface{}{int32(80), int32(85), int32(90), int32(95)},
+		"courses": []interface{}{
+			storage.Document{"name": "math", "score": int32(70)},
+			storage.Document{"name": "art", "score": int32(92)},
+			storage.Document{"name": "music", "score": int32(96)},
+		},
+	}
+	grades := func(values ...int32) []interface{} {
+		out := make([]interface{}, len(values))
+		for i, v := range values {
+			out[i] = v
+		}
+		return out
+	}
+
+	tests := []struct {
+		name       string
+		projection storage.Document
+		filter     storage.Document
+		want       storage.Document
+	}{
+		{"包含", storage.Document{"name": int32(1)}, nil,
+			storage.Document{"_id": int32(1), "name": "Alice"}},
+		{"排除", storage.Document{"grades": int32(0), "courses": int32(0), "_id": int32(0)}, nil,
+			storage.Document{"name": "Alice"}},
+		{"$slice: 2", storage.Document{"grades": storage.Document{"$slice": int32(2)}, "courses": int32(0)}, nil,
+			storage.Document{"_id": int32(1), "name": "Alice", "grades": grades(80, 85)}},
+		{"$slice: -1", storage.Document{"grades": storage.Document{"$slice": int32(-1)}, "name": int32(1)}, nil,
+			storage.Document{"_id": int32(1), "name": "Alice", "grades": grades(95)}},
+		{"$slice: [1, 2]", storage.Document{"grades": storage.Document{"$slice": []interface{}{int32(1), int32(2)}}, "_id": int32(0), "name": int32(1)}, nil,
+			storage.Document{"name": "Alice", "grades": grades(85, 90)}},
+		{"$slice: [-2, 5]", storage.Document{"grades": storage.Document{"$slice": []interface{}{int32(-2), int32(5)}}, "_id": int32(0), "name": int32(1)}, nil,
+			storage.Document{"name": "Alice", "grades": grades(90, 95)}},
+		{"$elemMatch", storage.Document{"courses": storage.Document{"$elemMatch": storage.Document{"score": storage.Document{"$gt": int32(90)}}}}, nil,
+			storage.Document{"_id": int32(1), "courses": []interface{}{storage.Document{"name": "art", "score": int32(92)}}}},
+		{"$elemMatch 没有匹配的元素", storage.Document{"courses": storage.Document{"$elemMatch": storage.Document{"score": int32(0)}}, "name": int32(1)}, nil,
+			storage.Document{"_id": int32(1), "name": "Alice"}},
+		{"位置投影", storage.Document{"grades.$": int32(1), "_id": int32(0)},
+			storage.Document{"grades": storage.Document{"$gte": int32(86)}},
+			storage.Document{"grades": grades(90)}},
+		{"位置投影嵌套字段条件", storage.Document{"courses.$": int32(1), "name": int32(1)},
+			storage.Document{"name": "Alice", "courses.score": storage.Document{"$gt": int32(95)}},
+			storage.Document{"_id": int32(1), "name": "Alice", "courses": []interface{}{storage.Document{"name": "music", "score": int32(96)}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storage.ApplyQueryProjection(doc, tt.projection, tt.filter)
+			if err != nil {
+				t.Fatalf("投影出错: %v", err)
+			}
+			if storage.CompareValues(got, tt.want) != 0 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, projection := range []storage.Document{
+		{"name": int32(1), "grades": int32(0)},
+		{"grades": int32(0), "courses": storage.Document{"$elemMatch": storage.Document{"score": int32(70)}}},
+		{"grades": storage.Document{"$slice": []interface{}{int32(1), int32(0)}}},
+		{"grades": storage.Document{"$slice": "2"}},
+		{"courses.name": storage.Document{"$elemMatch": storage.Document{"$eq": "art"}}},
+		{"grades": storage.Document{"$meta": "textScore"}},
+		{"grades.$": int32(1)},
+	} {
+		if _, err := storage.ApplyProjection(doc, projection); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("%v 应返回 ErrBadValue: %v", projection, err)
+		}
+	}
+}
+
+// TestApplyUpdate 测试更新操作符与替换更新
+func TestApplyUpdate(t *testing.T) {
+	doc := storage.Document{"_id": int32(1), "name": "Alice", "age": int32(30), "tmp": true}
+
+	updated, err := storage.ApplyUpdate(doc, storage.Document{
+		"$set":   storage.Document{"address.city": "Beijing"},
+		"$inc":   storage.Document{"age": int32(1)},
+		"$unset": storage.Document{"tmp": ""},
+	})
+	if err != nil {
+		t.Fatalf("更新失败: %v", err)
+	}
+	if updated["age"] != int32(31) {
+		t.Errorf("$inc 结果不正确: %#v", updated["age"])
+	}
+	if city := updated["address"].(storage.Document)["city"]; city != "Beijing" {
+		t.Errorf("$set 嵌套路径结果不正确: %v", city)
+	}
+	if _, ok := updated["tmp"]; ok {
+		t.Error("$unset 未删除字段")
+	}
+	if doc["age"] != int32(30) {
+		t.Error("原文档不应被修改")
+	}
+
+	replaced, err := storage.ApplyUpdate(doc, storage.Document{"name": "Bob"})
+	if err != nil {
+		t.Fatalf("替换失败: %v", err)
+	}
+	if len(replaced) != 2 || replaced["_id"] != int32(1) || replaced["name"] != "Bob" {
+		t.Errorf("替换结果不正确: %v", replaced)
+	}
+
+	if _, err := storage.ApplyUpdate(doc, storage.Document{"$set": storage.Document{"_id": int32(2)}}); err == nil {
+		t.Error("修改 _id 应返回错误")
+	}
+	if _, err := storage.ApplyUpdate(doc, storage.Document{"$set": storage.Document{"a": 1}, "b": 1}); err == nil {
+		t.Error("混用操作符和普通字段应返回错误")
+	}
+}
+
+// TestUpdateOperators 测试 $currentDate、$min、$max 和 $setOnInsert
+func TestUpdateOperators(t *testing.T) {
+	doc := storage.Document{"_id": int32(1), "low": int32(5), "high": int32(5), "name": "Alice"}
+
+	t.Run("$currentDate", func(t *testing.T) {
+		before := time.Now().Add(-time.Second)
+		updated, err := storage.ApplyUpdate(doc, storage.Document{"$currentDate": storage.Document{
+			"modified":    true,
+			"audit.at":    storage.Document{"$type": "date"},
+			"lastChanged": storage.Document{"$type": "timestamp"},
+		}})
+		if err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		modified, ok := updated["modified"].(time.Time)
+		if !ok || modified.Before(before) {
+			t.Errorf("modified 应为当前时间: %#v", updated["modified"])
+		}
+		if at := updated["audit"].(storage.Document)["at"]; at != modified {
+			t.Errorf("同一次更新中的日期应相同: %v, %v", at, modified)
+		}
+		if ts, ok := updated["lastChanged"].(storage.Timestamp); !ok || int64(ts.T) < before.Unix() {
+			t.Errorf("lastChanged 应为当前时间戳: %#v", updated["lastChanged"])
+		}
+		for _, operand := range []interface{}{false, storage.Document{"$type": "string"}, int32(1)} {
+			if _, err := storage.ApplyUpdate(doc, storage.Document{"$currentDate": storage.Document{"x": operand}}); !errors.Is(err, storage.ErrBadValue) {
+				t.Errorf("$currentDate 参数 %v 应返回 ErrBadValue: %v", operand, err)
+			}
+		}
+	})
+
+	t.Run("$min/$max", func(t *testing.T) {
+		tests := []struct {
+			update storage.Document
+			field  string
+			want   interface{}
+		}{
+			{storage.Document{"$min": storage.Document{"low": int32(3)}}, "low", int32(3)},
+			{storage.Document{"$min": storage.Document{"low": int32(8)}}, "low", int32(5)},
+			{storage.Document{"$min": storage.Document{"low": 4.5}}, "low", 4.5},
+			{storage.Document{"$max": storage.Document{"high": int64(9)}}, "high", int64(9)},
+			{storage.Document{"$max": storage.Document{"high": int32(2)}}, "high", int32(5)},
+			// 字段不存在时直接设置
+			{storage.Document{"$max": storage.Document{"missing": int32(1)}}, "missing", int32(1)},
+			// 不同类型按 BSON 比较顺序，字符串大于数值
+			{storage.Document{"$max": storage.Document{"high": "z"}}, "high", "z"},
+			{storage.Document{"$min": storage.Document{"name": int32(0)}}, "name", int32(0)},
+		}
+		for _, tt := range tests {
+			updated, err := storage.ApplyUpdate(doc, tt.update)
+			if err != nil {
+				t.Fatalf("%v 失败: %v", tt.update, err)
+			}
+			if updated[tt.field] != tt.want {
+				t.Errorf("%v: %s = %#v, want %#v", tt.update, tt.field, updated[tt.field], tt.want)
+			}
+		}
+	})
+
+	t.Run("$setOnInsert", func(t *testing.T) {
+		update := storage.Document{
+			"$set":         storage.Document{"name": "Bob"},
+			"$setOnInsert": storage.Document{"createdBy": "import", "_id": int32(7)},
+		}
+		updated, err := storage.ApplyUpdate(doc, update)
+		if err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		if _, ok := updated["createdBy"]; ok || updated["_id"] != int32(1) || updated["name"] != "Bob" {
+			t.Errorf("更新已有文档时应忽略 $setOnInsert: %v", updated)
+		}
+
+		inserted, err := storage.UpsertDocument(storage.Document{"name": "Carol"}, update)
+		if err != nil {
+			t.Fatalf("构造 upsert 文档失败: %v", err)
+		}
+		if inserted["createdBy"] != "import" || inserted["_id"] != int32(7) || inserted["name"] != "Bob" {
+			t.Errorf("upsert 插入时应应用 $setOnInsert: %v", inserted)
+		}
+	})
+}
+
+// TestArrayUpdateOperators 测试数组更新操作符 $push/$addToSet/$pop/$pull/$pullAll
+func TestArrayUpdateOperators(t *testing.T) {
+	arr := func(values ...interface{}) []interface{} { return values }
+	doc := storage.Document{
+		"_id":    int32(1),
+		"tags":   arr("a", "b", "c"),
+		"nums":   arr(int32(1), int64(2), 3.5, int32(2), "2"),
+		"scores": arr(storage.Document{"item": "A", "score": int32(8)}, storage.Document{"item": "B", "score": int32(4)}),
+		"name":   "Alice",
+	}
+	tests := []struct {
+		name   string
+		update storage.Document
+		field  string
+		want   interface{}
+	}{
+		{"$push 单个值", storage.Document{"$push": storage.Document{"tags": "d"}}, "tags", arr("a", "b", "c", "d")},
+		{"$push 创建数组", storage.Document{"$push": storage.Document{"list": int32(1)}}, "list", arr(int32(1))},
+		{"$push 文档值", storage.Document{"$push": storage.Document{"list": storage.Document{"x": int32(1)}}}, "list", arr(storage.Document{"x": int32(1)})},
+		{"$push $each", storage.Document{"$push": storage.Document{"tags": storage.Document{"$each": arr("d", "e")}}}, "tags", arr("a", "b", "c", "d", "e")},
+		{"$push $position", storage.Document{"$push": storage.Document{"tags": storage.Document{"$each": arr("x", "y"), "$position": int32(1)}}}, "tags", arr("a", "x", "y", "b", "c")},
+		{"$push 负数 $position", storage.Document{"$push": storage.Document{"tags": storage.Document{"$each": arr("x"), "$position": -1.0}}}, "tags", arr("a", "b", "x", "c")},
+		{"$push $sort", storage.Document{"$push": storage.Document{"tags": storage.Document{"$each": arr("0", "bb"), "$sort": int32(-1)}}}, "tags", arr("c", "bb", "b", "a", "0")},
+		{"$push $slice", storage.Document{"$push": storage.Document{"tags": storage.Document{"$each": arr("d"), "$slice": int32(-2)}}}, "tags", arr("c", "d")},
+		{"$push $slice 0", storage.Document{"$push": storage.Document{"tags": storage.Document{"$each": arr("d"), "$slice": int32(0)}}}, "tags", []interface{}{}},
+		{"$push 按字段 $sort 后 $slice", storage.Document{"$push": storage.Document{"scores": storage.Document{
+			"$each":  arr(storage.Document{"item": "C", "score": int32(6)}),
+			"$sort":  storage.Document{"score": int32(-1)},
+			"$slice": int32(2),
+		}}}, "scores", arr(storage.Document{"item": "A", "score": int32(8)}, storage.Document{"item": "C", "score": int32(6)})},
+
+		{"$addToSet 新值", storage.Document{"$addToSet": storage.Document{"tags": "d"}}, "tags", arr("a", "b", "c", "d")},
+		{"$addToSet 已有值", storage.Document{"$addToSet": storage.Document{"tags": "a"}}, "tags", arr("a", "b", "c")},
+		// 数值按值比较，int32(1) 与 1.0、int64(2) 与 int32(2) 视为相同；字符串 "1" 与数值 1 不同
+		{"$addToSet 跨类型去重", storage.Document{"$addToSet": storage.Document{"nums": storage.Document{"$each": arr(1.0, int32(2), "1", "1", int64(4))}}}, "nums",
+			arr(int32(1), int64(2), 3.5, int32(2), "2", "1", int64(4))},
+		{"$addToSet 文档值", storage.Document{"$addToSet": storage.Document{"scores": storage.Document{"item": "B", "score": 4.0}}}, "scores",
+			arr(storage.Document{"item": "A", "score": int32(8)}, storage.Document{"item": "B", "score": int32(4)})},
+
+		{"$pop 末尾", storage.Document{"$pop": storage.Document{"tags": int32(1)}}, "tags", arr("a", "b")},
+		{"$pop 开头", storage.Document{"$pop": storage.Document{"tags": -1.0}}, "tags", arr("b", "c")},
+		{"$pop 不存在的字段", storage.Document{"$pop": storage.Document{"missing": int32(1)}}, "missing", nil},
+
+		{"$pull 值", storage.Document{"$pull": storage.Document{"nums": int32(2)}}, "nums", arr(int32(1), 3.5, "2")},
+		{"$pull 条件", storage.Document{"$pull": storage.Document{"nums": storage.Document{"$gte": int32(2)}}}, "nums", arr(int32(1), "2")},
+		{"$pull 子文档条件", storage.Document{"$pull": storage.Document{"scores": storage.Document{"score": storage.Document{"$lt": int32(5)}}}}, "scores",
+			arr(storage.Document{"item": "A", "score": int32(8)})},
+		{"$pullAll", storage.Document{"$pullAll": storage.Document{"tags": arr("a", "c", "z")}}, "tags", arr("b")},
+	}
+	for _, tt := range tests {
+		updated, err := storage.ApplyUpdate(doc, tt.update)
+		if err != nil {
+			t.Errorf("%s: 更新失败: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(updated[tt.field], tt.want) {
+			t.Errorf("%s: %s = %#v, want %#v", tt.name, tt.field, updated[tt.field], tt.want)
+		}
+	}
+	if len(doc["tags"].([]interface{})) != 3 {
+		t.Errorf("原文档不应被修改: %v", doc["tags"])
+	}
+
+	for _, update := range []storage.Document{
+		{"$push": storage.Document{"name": "x"}},
+		{"$pull": storage.Document{"name": "x"}},
+		{"$pop": storage.Document{"tags": int32(2)}},
+		{"$pullAll": storage.Document{"tags": "a"}},
+		{"$push": storage.Document{"tags": storage.Document{"$slice": int32(1)}}},
+		{"$push": storage.Document{"tags": storage.Document{"$each": "a"}}},
+		{"$addToSet": storage.Document{"tags": storage.Document{"$each": arr("a"), "$sort": int32(1)}}},
+		{"$push": storage.Document{"tags": storage.Document{"$each": arr("a"), "$sort": int32(2)}}},
+	} {
+		if _, err := storage.ApplyUpdate(doc, update); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("%v 应返回 ErrBadValue: %v", update, err)
+		}
+	}
+}
+
+// TestPositionalUpdate 测试位置操作符 $、$[] 和带 arrayFilters 的 $[<identifier>]
+func TestPositionalUpdate(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	arr := func(values ...interface{}) []interface{} { return values }
+	reset := func() {
+		t.Helper()
+		engine.Delete(ctx, "test", "students", storage.Document{}, false)
+		err := engine.Insert(ctx, "test", "students", []storage.Document{{
+			"_id":    int32(1),
+			"grades": arr(int32(80), int32(95), int32(90), int32(95)),
+			"scores": arr(
+				storage.Document{"subject": "math", "score": int32(70), "tries": arr(int32(1), int32(2))},
+				storage.Document{"subject": "art", "score": int32(92), "tries": arr(int32(3))},
+			),
+		}})
+		if err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+	}
+	update := func(filter, update storage.Document, arrayFilters ...storage.Document) storage.Document {
+		t.Helper()
+		result, err := engine.Update(ctx, "test", "students", filter, update, storage.UpdateOptions{ArrayFilters: arrayFilters})
+		if err != nil || result.Matched != 1 {
+			t.Fatalf("更新 %v 失败: %+v, %v", update, result, err)
+		}
+		found, err := engine.Find(ctx, "test", "students", storage.Document{"_id": int32(1)})
+		if err != nil || len(found) != 1 {
+			t.Fatalf("查询失败: %v, %v", found, err)
+		}
+		return found[0]
+	}
+	scoreOf := func(doc storage.Document, i int) storage.Document {
+		return doc["scores"].([]interface{})[i].(storage.Document)
+	}
+
+	t.Run("$ 更新查询匹配的第一个元素", func(t *testing.T) {
+		reset()
+		doc := update(storage.Document{"_id": int32(1), "grades": int32(95)}, storage.Document{"$set": storage.Document{"grades.$": int32(100)}})
+		if want := arr(int32(80), int32(100), int32(90), int32(95)); !reflect.DeepEqual(doc["grades"], want) {
+			t.Errorf("grades = %v, want %v", doc["grades"], want)
+		}
+		doc = update(storage.Document{"scores.subject": "art"}, storage.Document{"$inc": storage.Document{"scores.$.score": int32(5)}})
+		if scoreOf(doc, 1)["score"] != int32(97) || scoreOf(doc, 0)["score"] != int32(70) {
+			t.Errorf("应只更新 subject 为 art 的元素: %v", doc["scores"])
+		}
+		doc = update(storage.Document{"scores": storage.Document{"$elemMatch": storage.Document{"score": storage.Document{"$lt": int32(80)}}}},
+			storage.Document{"$push": storage.Document{"scores.$.tries": int32(4)}})
+		if !reflect.DeepEqual(scoreOf(doc, 0)["tries"], arr(int32(1), int32(2), int32(4))) {
+			t.Errorf("$elemMatch 匹配的元素应追加尝试次数: %v", doc["scores"])
+		}
+	})
+
+	t.Run("$[] 更新所有元素", func(t *testing.T) {
+		reset()
+		doc := update(storage.Document{"_id": int32(1)}, storage.Document{"$inc": storage.Document{"grades.$[]": int32(1), "scores.$[].tries.$[]": int32(10)}})
+		if want := arr(int32(81), int32(96), int32(91), int32(96)); !reflect.DeepEqual(doc["grades"], want) {
+			t.Errorf("grades = %v, want %v", doc["grades"], want)
+		}
+		if !reflect.DeepEqual(scoreOf(doc, 0)["tries"], arr(int32(11), int32(12))) || !reflect.DeepEqual(scoreOf(doc, 1)["tries"], arr(int32(13))) {
+			t.Errorf("嵌套的 $[] 应更新每个数组的所有元素: %v", doc["scores"])
+		}
+	})
+
+	t.Run("$[<identifier>] 只更新满足 arrayFilters 的元素", func(t *testing.T) {
+		reset()
+		doc := update(storage.Document{"_id": int32(1)}, storage.Document{"$set": storage.Document{"grades.$[high]": int32(100)}},
+			storage.Document{"high": storage.Document{"$gte": int32(90)}})
+		if want := arr(int32(80), int32(100), int32(100), int32(100)); !reflect.DeepEqual(doc["grades"], want) {
+			t.Errorf("grades = %v, want %v", doc["grades"], want)
+		}
+		doc = update(storage.Document{"_id": int32(1)},
+			storage.Document{"$set": storage.Document{"scores.$[low].passed": false}, "$inc": storage.Document{"scores.$[low].tries.$[t]": int32(1)}},
+			storage.Document{"low.score": storage.Document{"$lt": int32(80)}}, storage.Document{"t": storage.Document{"$gt": int32(1)}})
+		if scoreOf(doc, 0)["passed"] != false || !reflect.DeepEqual(scoreOf(doc, 0)["tries"], arr(int32(1), int32(3))) {
+			t.Errorf("应只更新分数低于 80 的元素: %v", scoreOf(doc, 0))
+		}
+		if _, ok := scoreOf(doc, 1)["passed"]; ok || !reflect.DeepEqual(scoreOf(doc, 1)["tries"], arr(int32(3))) {
+			t.Errorf("不满足条件的元素不应修改: %v", scoreOf(doc, 1))
+		}
+	})
+
+	t.Run("非法的位置更新", func(t *testing.T) {
+		reset()
+		tests := []struct {
+			name         string
+			filter       storage.Document
+			update       storage.Document
+			arrayFilters []storage.Document
+		}{
+			{"查询条件中没有数组字段", storage.Document{"_id": int32(1)}, storage.Document{"$set": storage.Document{"grades.$": int32(0)}}, nil},
+			{"标识符没有过滤条件", storage.Document{}, storage.Document{"$set": storage.Document{"grades.$[x]": int32(0)}}, nil},
+			{"过滤条件没有使用", storage.Document{}, storage.Document{"$set": storage.Document{"grades.$[]": int32(0)}},
+				[]storage.Document{{"x": int32(1)}}},
+			{"标识符不合法", storage.Document{}, storage.Document{"$set": storage.Document{"grades.$[X]": int32(0)}},
+				[]storage.Document{{"X": int32(1)}}},
+			{"字段不是数组", storage.Document{}, storage.Document{"$set": storage.Document{"_id.$[]": int32(0)}}, nil},
+		}
+		for _, tt := range tests {
+			_, err := engine.Update(ctx, "test", "students", tt.filter, tt.update, storage.UpdateOptions{ArrayFilters: tt.arrayFilters})
+			if !errors.Is(err, storage.ErrBadValue) {
+				t.Errorf("%s: err = %v, want ErrBadValue", tt.name, err)
+			}
+		}
+	})
+}
+
+// TestEngineCRUD 测试存储引擎的增删改查
+func TestEngineCRUD(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	docs := []storage.Document{
+		{"name": "Alice", "age": int32(30)},
+		{"name": "Bob", "age": int32(25)},
+		{"_id": "carol", "name": "Carol", "age": int32(35)},
+	}
+	if err := engine.Insert(ctx, "test", "people", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if _, ok := docs[0]["_id"].(storage.ObjectID); !ok {
+		t.Errorf("缺少 _id 时应生成 ObjectId: %#v", docs[0]["_id"])
+	}
+	err = engine.Insert(ctx, "test", "people", []storage.Document{{"_id": "carol"}})
+	var dupErr *storage.DuplicateKeyError
+	if !errors.As(err, &dupErr) || !errors.Is(err, storage.ErrDuplicateKey) {
+		t.Fatalf("重复 _id 应返回 DuplicateKeyError: %v", err)
+	}
+	if dupErr.Namespace != "test.people" || dupErr.Index != "_id_" || dupErr.Key.(storage.Document)["_id"] != "carol" {
+		t.Errorf("重复键信息不正确: %+v", dupErr)
+	}
+
+	found, err := engine.Find(ctx, "test", "people", storage.Document{"age": storage.Document{"$gt": int32(26)}})
+	if err != nil || len(found) != 2 {
+		t.Fatalf("查询结果不正确: %v, %v", found, err)
+	}
+
+	result, err := engine.Update(ctx, "test", "people", storage.Document{},
+		storage.Document{"$inc": storage.Document{"age": int32(1)}}, storage.UpdateOptions{Multi: true})
+	if err != nil || result.Matched != 3 || result.Modified != 3 {
+		t.Fatalf("更新结果不正确: %+v, %v", result, err)
+	}
+
+	deleted, err := engine.Delete(ctx, "test", "people", storage.Document{"name": "Carol"}, false)
+	if err != nil || deleted != 1 {
+		t.Fatalf("删除结果不正确: %d, %v", deleted, err)
+	}
+	// 删除后 _id 可以重新使用
+	if err := engine.Insert(ctx, "test", "people", []storage.Document{{"_id": "carol"}}); err != nil {
+		t.Errorf("删除后重新插入失败: %v", err)
+	}
+
+	if found, err := engine.Find(ctx, "missing", "people", storage.Document{}); err != nil || len(found) != 0 {
+		t.Errorf("不存在的集合应返回空结果: %v, %v", found, err)
+	}
+}
+
+// TestUpsert 测试 upsert 没有匹配文档时按过滤条件和更新文档构造新文档
+func TestUpsert(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	upsert := storage.UpdateOptions{Upsert: true}
+	findOne := func(filter storage.Document) storage.Document {
+		t.Helper()
+		found, err := engine.Find(ctx, "test", "people", filter)
+		if err != nil || len(found) != 1 {
+			t.Fatalf("查询 %v 结果不正确: %v, %v", filter, found, err)
+		}
+		return found[0]
+	}
+
+	t.Run("操作符更新", func(t *testing.T) {
+		result, err := engine.Update(ctx, "test", "people", storage.Document{"name": "Alice"},
+			storage.Document{"$set": storage.Document{"age": int32(30)}, "$inc": storage.Document{"visits": int32(1)}}, upsert)
+		if err != nil {
+			t.Fatalf("upsert 失败: %v", err)
+		}
+		id, ok := result.UpsertedID.(storage.ObjectID)
+		if !ok || result.Matched != 0 || result.Modified != 0 {
+			t.Fatalf("应插入新文档并生成 ObjectId: %+v", result)
+		}
+		doc := findOne(storage.Document{"_id": id})
+		if doc["name"] != "Alice" || doc["age"] != int32(30) || doc["visits"] != int32(1) {
+			t.Errorf("新文档不正确: %v", doc)
+		}
+
+		// 再次执行时匹配到已插入的文档，不再插入
+		result, err = engine.Update(ctx, "test", "people", storage.Document{"name": "Alice"},
+			storage.Document{"$inc": storage.Document{"visits": int32(1)}}, upsert)
+		if err != nil || result.Matched != 1 || result.Modified != 1 || result.UpsertedID != nil {
+			t.Fatalf("匹配到文档时不应插入: %+v, %v", result, err)
+		}
+	})
+
+	t.Run("替换文档", func(t *testing.T) {
+		result, err := engine.Update(ctx, "test", "people",
+			storage.Document{"_id": "bob", "age": storage.Document{"$gt": int32(40)}},
+			storage.Document{"name": "Bob", "age": int32(25)}, upsert)
+		if err != nil {
+			t.Fatalf("upsert 失败: %v", err)
+		}
+		if result.UpsertedID != "bob" {
+			t.Fatalf("应使用过滤条件中的 _id: %+v", result)
+		}
+		doc := findOne(storage.Document{"_id": "bob"})
+		if len(doc) != 3 || doc["name"] != "Bob" || doc["age"] != int32(25) {
+			t.Errorf("替换 upsert 只应包含替换文档的字段和 _id: %v", doc)
+		}
+	})
+
+	t.Run("过滤条件中的等值字段", func(t *testing.T) {
+		filter := storage.Document{
+			"city":        storage.Document{"$eq": "Paris"},
+			"address.zip": "75001",
+			"score":       storage.Document{"$gte": int32(10)},
+		}
+		result, err := engine.Update(ctx, "test", "people", filter,
+			storage.Document{"$set": storage.Document{"name": "Carol"}}, upsert)
+		if err != nil || result.UpsertedID == nil {
+			t.Fatalf("upsert 失败: %+v, %v", result, err)
+		}
+		doc := findOne(storage.Document{"name": "Carol"})
+		if doc["city"] != "Paris" {
+			t.Errorf("应包含 $eq 条件的字段: %v", doc)
+		}
+		if address, ok := doc["address"].(storage.Document); !ok || address["zip"] != "75001" {
+			t.Errorf("点号路径应展开为嵌套文档: %v", doc)
+		}
+		if _, ok := doc["score"]; ok {
+			t.Errorf("范围条件不应写入新文档: %v", doc)
+		}
+
+		_, err = engine.Update(ctx, "test", "people", storage.Document{"_id": int32(1)},
+			storage.Document{"$set": storage.Document{"_id": int32(2)}}, upsert)
+		if !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("更新与过滤条件中的 _id 冲突时应失败: %v", err)
+		}
+	})
+
+	t.Run("集合不存在时隐式创建", func(t *testing.T) {
+		result, err := engine.Update(ctx, "test", "fresh", storage.Document{"_id": int32(1)},
+			storage.Document{"$set": storage.Document{"x": int32(1)}}, upsert)
+		if err != nil || result.UpsertedID != int32(1) {
+			t.Fatalf("upsert 失败: %+v, %v", result, err)
+		}
+		if found, err := engine.Find(ctx, "test", "fresh", storage.Document{}); err != nil || len(found) != 1 {
+			t.Errorf("集合中应有一个文档: %v, %v", found, err)
+		}
+	})
+
+	t.Run("$setOnInsert 只在插入时生效", func(t *testing.T) {
+		update := storage.Document{
+			"$setOnInsert": storage.Document{"created": "first"},
+			"$inc":         storage.Document{"hits": int32(1)},
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := engine.Update(ctx, "test", "counters", storage.Document{"_id": "page"}, update, upsert); err != nil {
+				t.Fatalf("upsert 失败: %v", err)
+			}
+		}
+		found, err := engine.Find(ctx, "test", "counters", storage.Document{"_id": "page"})
+		if err != nil || len(found) != 1 || found[0]["created"] != "first" || found[0]["hits"] != int32(2) {
+			t.Errorf("第二次更新应匹配已有文档并忽略 $setOnInsert: %v, %v", found, err)
+		}
+
+		result, err := engine.Update(ctx, "test", "counters", storage.Document{"_id": "page"},
+			storage.Document{"$setOnInsert": storage.Document{"created": "again"}}, upsert)
+		if err != nil || result.Matched != 1 || result.Modified != 0 {
+			t.Errorf("只有 $setOnInsert 的更新不应修改已有文档: %+v, %v", result, err)
+		}
+	})
+}
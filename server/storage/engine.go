@@ -2,13 +2,15 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/zhukovaskychina/xmongodb/config"
-	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+	"github.com/zhukovaskychina/xmongodb/server/storage/btree"
 )
 
 // Engine 存储引擎接口
@@ -26,33 +28,83 @@ type Engine interface {
 
 	// 集合操作
 	CreateCollection(ctx context.Context, database, collection string) error
+	CreateCappedCollection(ctx context.Context, database, collection string, sizeBytes, maxDocs int64) error
 	DropCollection(ctx context.Context, database, collection string) error
 	ListCollections(ctx context.Context, database string) ([]string, error)
+	SetValidation(ctx context.Context, database, collection string, opts ValidationOptions) error
+	CollectionValidation(ctx context.Context, database, collection string) (ValidationOptions, error)
 
 	// 文档操作
 	Insert(ctx context.Context, database, collection string, documents []Document) error
 	Find(ctx context.Context, database, collection string, filter Document) ([]Document, error)
-	Update(ctx context.Context, database, collection string, filter, update Document) error
-	Delete(ctx context.Context, database, collection string, filter Document) error
+	FindWithHint(ctx context.Context, database, collection string, filter Document, hint *Hint) ([]Document, error)
+	FindCursor(ctx context.Context, database, collection string, filter, projection Document, hint *Hint) (DocumentCursor, error)
+	Update(ctx context.Context, database, collection string, filter, update Document, opts UpdateOptions) (*UpdateResult, error)
+	Delete(ctx context.Context, database, collection string, filter Document, justOne bool) (int64, error)
+	Distinct(ctx context.Context, database, collection, field string, filter Document) ([]interface{}, error)
 
 	// 索引操作
 	CreateIndex(ctx context.Context, database, collection string, index Index) error
 	DropIndex(ctx context.Context, database, collection string, indexName string) error
+	DropIndexes(ctx context.Context, database, collection string, names []string) (int, error)
+	ModifyIndex(ctx context.Context, database, collection string, indexName string, mod IndexModification) (Index, error)
 	ListIndexes(ctx context.Context, database, collection string) ([]Index, error)
 
+	// 查询计划
+	Explain(ctx context.Context, database, collection string, filter, projection Document, hint *Hint, execute bool) (*Explanation, error)
+
 	// 统计信息
 	GetStats() map[string]interface{}
+	CollectionStats(ctx context.Context, database, collection string) (*CollectionStats, error)
+
+	// 一致性检查
+	Validate(ctx context.Context, database, collection string) (*ValidateResults, error)
+	ReIndex(ctx context.Context, database, collection string) error
+	Compact(ctx context.Context, database, collection string) (*CompactStats, error)
+
+	// 检查点和日志
+	Checkpoint(ctx context.Context) (int, error)
+	SyncJournal(ctx context.Context) error
 }
 
 // Document 文档类型
 type Document map[string]interface{}
 
+// UpdateOptions 更新选项
+type UpdateOptions struct {
+	Multi        bool       // 更新全部匹配文档
+	Upsert       bool       // 没有匹配文档时插入新文档
+	ArrayFilters []Document // 更新路径中 $[<identifier>] 的过滤条件
+}
+
+// UpdateResult 更新结果
+type UpdateResult struct {
+	Matched    int64       // 匹配的文档数
+	Modified   int64       // 实际被修改的文档数
+	UpsertedID interface{} // upsert 插入的新文档 _id，没有插入时为 nil
+}
+
+// CollectionStats 集合统计信息
+type CollectionStats struct {
+	Namespace    string
+	Count        int64            // 文档数
+	Size         int64            // 文档数据总字节数
+	Capped       bool             // 是否为固定集合
+	MaxSize      int64            // 固定集合的大小上限
+	MaxDocs      int64            // 固定集合的文档数上限
+	IndexEntries map[string]int64 // 索引名到索引条目数的映射
+}
+
 // Index 索引定义
 type Index struct {
 	Name   string
-	Keys   map[string]int // 1: 升序, -1: 降序
+	Keys   []IndexKey // 索引字段，按键模式中的顺序排列
 	Unique bool
 	Sparse bool
+
+	PartialFilterExpression Document // 部分索引的过滤条件，只为满足条件的文档建立索引条目
+	ExpireAfterSeconds      int      // 大于 0 时为 TTL 索引，索引字段的日期早于当前时间减去该秒数的文档会被后台删除
+	Hidden                  bool     // 对查询计划器隐藏，查询不使用该索引，但写入时照常维护索引条目
 }
 
 // NewEngine 创建新的存储引擎
@@ -76,20 +128,51 @@ type WiredTigerEngine struct {
 	databases map[string]*Database
 	running   bool
 	
+	// ephemeral 为 true 时不写入数据目录，也不写预写日志，见 MemoryEngine
+	ephemeral bool
+	
 	// 底层 KV 引擎
 	kvEngine KVEngine
 	
 	// 下一个 RecordId
 	nextRecordId int64
+
+	// oplogMu 保证数据修改与对应 oplog 条目一起写入，并使 oplog 按时间戳顺序追加
+	oplogMu    sync.Mutex
+	lastOpTime Timestamp
+
+	// intents 事务写过的记录，见 writeIntents
+	intents writeIntents
+
+	// 后台 TTL 清理协程的取消函数和退出信号
+	ttlCancel context.CancelFunc
+	ttlDone   chan struct{}
+
+	// 最近一次检查点的时间，由 e.mu 保护
+	lastCheckpoint time.Time
+
+	// 修改索引和校验规则时不持有 e.mu，写日志和修改元数据期间持有 checkpointMu 的读锁，
+	// 检查点持有写锁，重写日志时看到的元数据与已写入的日志一致
+	checkpointMu sync.RWMutex
+
+	// 预写日志，未启用或尚未打开时为 nil；journalReplayed 表示启动时已重放过日志
+	journalMu       sync.RWMutex
+	journal         *journal
+	journalReplayed bool
 }
 
 // NewWiredTigerEngine 创建 WiredTiger 引擎
 func NewWiredTigerEngine(cfg config.StorageConfig) (*WiredTigerEngine, error) {
+	if cfg.BTreeOrder != 0 && cfg.BTreeOrder < btree.MinOrder {
+		return nil, fmt.Errorf("%w: B+树阶数 btree_order 不能小于 %d: %d", ErrBadValue, btree.MinOrder, cfg.BTreeOrder)
+	}
+
 	// 创建 KV 引擎配置
 	kvConfig := KVEngineConfig{
-		CacheSize:         1024 * 1024 * 1024, // 1GB
+		CacheSize:         cfg.CacheSizeBytes(),
 		MaxSessions:       1000,
 		CheckpointEnabled: true,
+		BTreeOrder:        cfg.BTreeOrder,
 	}
 	
 	return &WiredTigerEngine{
@@ -101,6 +184,19 @@ func NewWiredTigerEngine(cfg config.StorageConfig) (*WiredTigerEngine, error) {
 
 // Start 启动引擎
 func (e *WiredTigerEngine) Start() error {
+	e.mu.RLock()
+	running := e.running
+	e.mu.RUnlock()
+	if running {
+		return fmt.Errorf("存储引擎已经在运行")
+	}
+
+	// 重放日志时需要通过集合和索引操作获取 e.mu，在加锁前完成
+	ctx := context.Background()
+	if err := e.openJournal(ctx); err != nil {
+		return err
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	
@@ -109,10 +205,11 @@ func (e *WiredTigerEngine) Start() error {
 	}
 
 	// 启动底层 KV 引擎
-	ctx := context.Background()
 	if err := e.kvEngine.Start(ctx); err != nil {
+		e.closeJournal()
 		return fmt.Errorf("启动 KV 引擎失败: %w", err)
 	}
+	e.startTTLMonitor(time.Duration(e.config.TTLMonitorSecs) * time.Second)
 	
 	e.running = true
 	return nil
@@ -120,6 +217,9 @@ func (e *WiredTigerEngine) Start() error {
 
 // Stop 停止引擎
 func (e *WiredTigerEngine) Stop() error {
+	// 先在不持有 e.mu 的情况下等待 TTL 清理协程退出，清理过程中需要读取集合
+	e.stopTTLMonitor()
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	
@@ -132,6 +232,9 @@ func (e *WiredTigerEngine) Stop() error {
 	if err := e.kvEngine.Stop(ctx); err != nil {
 		return fmt.Errorf("停止 KV 引擎失败: %w", err)
 	}
+	if err := e.closeJournal(); err != nil {
+		return fmt.Errorf("关闭日志失败: %w", err)
+	}
 	
 	e.running = false
 	return nil
@@ -144,8 +247,14 @@ func (e *WiredTigerEngine) Close() error {
 
 // CreateDatabase 创建数据库
 func (e *WiredTigerEngine) CreateDatabase(ctx context.Context, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	if _, exists := e.databases[name]; exists {
-		return fmt.Errorf("数据库 %s 已存在", name)
+		return fmt.Errorf("数据库 %s 已存在: %w", name, ErrNamespaceExists)
+	}
+	if err := e.writeJournal(journalEntry{Op: journalCreateDatabase, Database: name}); err != nil {
+		return err
 	}
 
 	e.databases[name] = &Database{
@@ -157,16 +266,29 @@ func (e *WiredTigerEngine) CreateDatabase(ctx context.Context, name string) erro
 
 // DropDatabase 删除数据库
 func (e *WiredTigerEngine) DropDatabase(ctx context.Context, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	if _, exists := e.databases[name]; !exists {
-		return fmt.Errorf("数据库 %s 不存在", name)
+		return fmt.Errorf("数据库 %s 不存在: %w", name, ErrNamespaceNotFound)
+	}
+	if err := e.writeJournal(journalEntry{Op: journalDropDatabase, Database: name}); err != nil {
+		return err
 	}
 
+	// 同时释放 KV 引擎中的记录存储和索引，之后可以重新创建同名集合
+	for _, coll := range e.databases[name].Collections {
+		e.kvEngine.DropRecordStore(coll.Namespace)
+	}
 	delete(e.databases, name)
 	return nil
 }
 
 // ListDatabases 列出所有数据库
 func (e *WiredTigerEngine) ListDatabases(ctx context.Context) ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	databases := make([]string, 0, len(e.databases))
 	for name := range e.databases {
 		databases = append(databases, name)
@@ -176,62 +298,133 @@ func (e *WiredTigerEngine) ListDatabases(ctx context.Context) ([]string, error)
 
 // CreateCollection 创建集合
 func (e *WiredTigerEngine) CreateCollection(ctx context.Context, database, collection string) error {
+	entry := journalEntry{Op: journalCreateCollection, Database: database, Collection: collection}
+	return e.createCollection(entry, func(namespace string) (RecordStore, error) {
+		return e.kvEngine.CreateRecordStore(namespace)
+	})
+}
+
+// CreateCappedCollection 创建固定集合
+// 超过 sizeBytes 字节或 maxDocs 个文档时按插入顺序淘汰最旧的文档，maxDocs 为 0 表示不限制文档数
+func (e *WiredTigerEngine) CreateCappedCollection(ctx context.Context, database, collection string, sizeBytes, maxDocs int64) error {
+	if sizeBytes <= 0 {
+		return fmt.Errorf("%w: 固定集合的大小必须为正数", ErrBadValue)
+	}
+	if maxDocs < 0 {
+		return fmt.Errorf("%w: 固定集合的文档数上限不能为负数", ErrBadValue)
+	}
+
+	entry := journalEntry{
+		Op: journalCreateCollection, Database: database, Collection: collection, SizeBytes: sizeBytes, MaxDocs: maxDocs,
+	}
+	return e.createCollection(entry, func(namespace string) (RecordStore, error) {
+		rs, err := e.kvEngine.CreateCappedRecordStore(namespace, sizeBytes, maxDocs)
+		if err != nil {
+			return nil, err
+		}
+		// 淘汰记录时同步删除其索引条目，并记录到插入的 context 中，插入失败时据此恢复
+		if capped, ok := rs.(*CappedRecordStore); ok {
+			capped.SetEvictionHandler(func(ctx context.Context, recordId RecordId, data []byte) {
+				coll := e.lookupCollection(database, collection)
+				doc, err := e.bsonToDocument(data)
+				if coll == nil || err != nil {
+					return
+				}
+				e.removeIndexEntries(ctx, coll, doc, recordId)
+				if evicted, ok := ctx.Value(evictionLogKey{}).(*[]evictedRecord); ok {
+					*evicted = append(*evicted, evictedRecord{recordId: recordId, data: data, doc: doc})
+				}
+			})
+		}
+		return rs, nil
+	})
+}
+
+// createCollection 使用给定的 RecordStore 构造函数创建集合及其 _id 索引，entry 为写入日志的建集合条目
+// 启用日志时集合的记录存储包装为先写日志再修改记录
+func (e *WiredTigerEngine) createCollection(entry journalEntry, newRecordStore func(namespace string) (RecordStore, error)) error {
+	database, collection := entry.Database, entry.Collection
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	
 	db, exists := e.databases[database]
 	if !exists {
-		return fmt.Errorf("数据库 %s 不存在", database)
+		return fmt.Errorf("数据库 %s 不存在: %w", database, ErrNamespaceNotFound)
 	}
 
 	if _, exists := db.Collections[collection]; exists {
-		return fmt.Errorf("集合 %s 已存在", collection)
+		return fmt.Errorf("集合 %s 已存在: %w", collection, ErrNamespaceExists)
+	}
+	if err := e.writeJournal(entry); err != nil {
+		return err
 	}
 	
 	// 创建 RecordStore
 	namespace := makeNamespace(database, collection)
-	recordStore, err := e.kvEngine.CreateRecordStore(namespace)
+	recordStore, err := newRecordStore(namespace)
 	if err != nil {
 		return fmt.Errorf("创建 RecordStore 失败: %w", err)
 	}
 	
 	// 创建默认的 _id 索引
-	idxName := "_id_"
-	idIndex, err := e.kvEngine.CreateSortedDataInterface(namespace, idxName, true)
+	idSpec := idIndex()
+	idIdx, err := e.kvEngine.CreateSortedDataInterface(namespace, idSpec.Name, true)
 	if err != nil {
 		return fmt.Errorf("创建 _id 索引失败: %w", err)
 	}
 
+	_, capped := recordStore.(*CappedRecordStore)
+	if e.journalEnabled() {
+		recordStore = &journaledRecordStore{RecordStore: recordStore, engine: e, database: database, collection: collection}
+	}
 	db.Collections[collection] = &Collection{
 		Name:        collection,
+		Namespace:   namespace,
+		Capped:      capped,
 		RecordStore: recordStore,
 		Indexes:     make(map[string]SortedDataInterface),
+		IndexSpecs:  []Index{idSpec},
+		multikey:    make(map[string]bool),
+		plans:       newPlanCache(),
+		sample:      newCollectionSample(),
 	}
-	db.Collections[collection].Indexes[idxName] = idIndex
+	db.Collections[collection].Indexes[idSpec.Name] = idIdx
 	
 	return nil
 }
 
 // DropCollection 删除集合
 func (e *WiredTigerEngine) DropCollection(ctx context.Context, database, collection string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	db, exists := e.databases[database]
 	if !exists {
-		return fmt.Errorf("数据库 %s 不存在", database)
+		return fmt.Errorf("数据库 %s 不存在: %w", database, ErrNamespaceNotFound)
 	}
 
-	if _, exists := db.Collections[collection]; !exists {
-		return fmt.Errorf("集合 %s 不存在", collection)
+	coll, exists := db.Collections[collection]
+	if !exists {
+		return fmt.Errorf("集合 %s 不存在: %w", collection, ErrNamespaceNotFound)
+	}
+	if err := e.writeJournal(journalEntry{Op: journalDropCollection, Database: database, Collection: collection}); err != nil {
+		return err
 	}
 
+	// DropRecordStore 同时删除集合的全部索引
+	e.kvEngine.DropRecordStore(coll.Namespace)
 	delete(db.Collections, collection)
 	return nil
 }
 
 // ListCollections 列出集合
 func (e *WiredTigerEngine) ListCollections(ctx context.Context, database string) ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	db, exists := e.databases[database]
 	if !exists {
-		return nil, fmt.Errorf("数据库 %s 不存在", database)
+		return nil, fmt.Errorf("数据库 %s 不存在: %w", database, ErrNamespaceNotFound)
 	}
 
 	collections := make([]string, 0, len(db.Collections))
@@ -242,123 +435,763 @@ func (e *WiredTigerEngine) ListCollections(ctx context.Context, database string)
 }
 
 // Insert 插入文档
+// 数据库和集合不存在时自动创建；文档缺少 _id 时生成 ObjectId
 func (e *WiredTigerEngine) Insert(ctx context.Context, database, collection string, documents []Document) error {
-	e.mu.RLock()
-	db, exists := e.databases[database]
-	if !exists {
-		e.mu.RUnlock()
-		return fmt.Errorf("数据库 %s 不存在", database)
+	coll, err := e.getOrCreateCollection(ctx, database, collection)
+	if err != nil {
+		return err
 	}
 
-	coll, exists := db.Collections[collection]
-	if !exists {
-		e.mu.RUnlock()
-		return fmt.Errorf("集合 %s 不存在", collection)
-	}
-	e.mu.RUnlock()
-	
 	// 插入每个文档
 	for _, doc := range documents {
-		// 生成 RecordId
-		recordId := NewRecordIdFromLong(atomic.AddInt64(&e.nextRecordId, 1))
-		
-		// 确保文档有 _id 字段
-		if _, hasId := doc["_id"]; !hasId {
-			doc["_id"] = recordId.String()
-		}
-		
-		// 将文档序列化为 BSON
-		data, err := e.documentToBSON(doc)
-		if err != nil {
-			return fmt.Errorf("序列化文档失败: %w", err)
-		}
-		
-		// 插入到 RecordStore
-		if err := coll.RecordStore.InsertRecord(ctx, recordId, data); err != nil {
-			return fmt.Errorf("插入记录失败: %w", err)
-		}
-		
-		// 更新索引
-		for _, idx := range coll.Indexes {
-			// 提取索引键（简化实现，这里使用 _id）
-			idxKey := []byte(doc["_id"].(string))
-			if err := idx.Insert(ctx, idxKey, recordId); err != nil {
-				return fmt.Errorf("更新索引失败: %w", err)
-			}
+		if err := e.insertDocument(ctx, coll, doc); err != nil {
+			return err
 		}
 	}
-	
+
 	return nil
 }
 
+// insertDocument 插入单个文档并写入 oplog，oplog 写入失败或事务回滚时撤销插入
+func (e *WiredTigerEngine) insertDocument(ctx context.Context, coll *Collection, doc Document) error {
+	if err := checkTransactionWrite(ctx, coll); err != nil {
+		return err
+	}
+	e.oplogMu.Lock()
+	defer e.oplogMu.Unlock()
+
+	recordId, evicted, err := e.insertRecord(ctx, coll, doc)
+	if err != nil {
+		return err
+	}
+	undo := func(ctx context.Context) {
+		coll.RecordStore.DeleteRecord(ctx, recordId)
+		e.removeIndexEntries(ctx, coll, doc, recordId)
+		e.restoreEvicted(ctx, coll, evicted)
+	}
+	if err := e.intents.acquire(transactionUnit(ctx), coll, recordId, nil); err != nil {
+		undo(ctx)
+		return err
+	}
+	return e.logOrDefer(ctx, coll, OplogInsert, doc, nil, undo)
+}
+
+// insertRecord 写入记录和索引条目，不记录 oplog
+// 固定集合插入时淘汰的旧记录一并返回，插入失败时已经恢复
+func (e *WiredTigerEngine) insertRecord(ctx context.Context, coll *Collection, doc Document) (RecordId, []evictedRecord, error) {
+	// 生成 RecordId
+	recordId := NewRecordIdFromLong(atomic.AddInt64(&e.nextRecordId, 1))
+
+	// 确保文档有 _id 字段
+	if _, hasId := doc["_id"]; !hasId {
+		doc["_id"] = NewObjectID()
+	}
+	if err := e.checkValidation(coll, nil, doc); err != nil {
+		return recordId, nil, err
+	}
+
+	// 将文档序列化为 BSON
+	data, err := e.documentToBSON(doc)
+	if err != nil {
+		return recordId, nil, fmt.Errorf("序列化文档失败: %w", err)
+	}
+	if err := e.checkDocumentSize(coll, data); err != nil {
+		return recordId, nil, err
+	}
+
+	// 插入到 RecordStore，固定集合淘汰的记录由淘汰回调收集
+	var evicted []evictedRecord
+	insertCtx := context.WithValue(ctx, evictionLogKey{}, &evicted)
+	if err := coll.RecordStore.InsertRecord(insertCtx, recordId, data); err != nil {
+		return recordId, nil, fmt.Errorf("插入记录失败: %w", err)
+	}
+
+	// 更新索引，失败时回滚已写入的记录并恢复被淘汰的记录
+	if err := e.insertIndexEntries(ctx, coll, doc, recordId); err != nil {
+		coll.RecordStore.DeleteRecord(ctx, recordId)
+		e.restoreEvicted(ctx, coll, evicted)
+		return recordId, nil, err
+	}
+	return recordId, evicted, nil
+}
+
+// evictedRecord 插入固定集合时被淘汰的记录
+type evictedRecord struct {
+	recordId RecordId
+	data     []byte
+	doc      Document
+}
+
+// evictionLogKey context 中收集被淘汰记录的键，值为 *[]evictedRecord
+type evictionLogKey struct{}
+
+// restoreEvicted 插入失败时按原 RecordId 恢复被淘汰的记录及其索引条目
+// 删除新记录后集合回到插入前的大小，恢复的记录不会再次触发淘汰
+func (e *WiredTigerEngine) restoreEvicted(ctx context.Context, coll *Collection, evicted []evictedRecord) {
+	for _, r := range evicted {
+		if err := coll.RecordStore.InsertRecord(ctx, r.recordId, r.data); err != nil {
+			continue
+		}
+		e.insertIndexEntries(ctx, coll, r.doc, r.recordId)
+	}
+}
+
 // Find 查找文档
+// 数据库或集合不存在时返回空结果；扫描每条记录前检查 ctx，已取消或超时时中止扫描并返回 ctx 的错误
 func (e *WiredTigerEngine) Find(ctx context.Context, database, collection string, filter Document) ([]Document, error) {
+	return e.FindWithHint(ctx, database, collection, filter, nil)
+}
+
+// FindWithHint 按查询提示查找文档，hint 为 nil 时与 Find 相同由查询计划器选择索引
+// 提示的索引不存在或不能用于该查询时返回 ErrBadValue
+func (e *WiredTigerEngine) FindWithHint(ctx context.Context, database, collection string, filter Document, hint *Hint) ([]Document, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return []Document{}, nil
+	}
+
+	var plan *QueryPlan
+	var err error
+	if hint != nil {
+		plan, err = hintedPlan(coll, filter, hint)
+	} else {
+		plan, err = planQuery(coll, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	matches, err := e.runPlan(ctx, coll, plan, filter, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Document, 0, len(matches))
+	for _, m := range matches {
+		results = append(results, m.doc)
+	}
+	return results, nil
+}
+
+// Update 更新文档
+// 默认只更新第一个匹配的文档，opts.Multi 为 true 时更新全部匹配文档
+func (e *WiredTigerEngine) Update(ctx context.Context, database, collection string, filter, update Document, opts UpdateOptions) (*UpdateResult, error) {
+	result := &UpdateResult{}
+	pos, err := newPositionalUpdate(filter, update, opts.ArrayFilters)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	coll := e.lookupCollection(database, collection)
+	if coll == nil && !opts.Upsert {
+		return result, nil
+	}
+
+	var matches []matchedRecord
+	if coll != nil {
+		matches, err = e.scanMatching(ctx, coll, filter, !opts.Multi)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(matches) == 0 && opts.Upsert {
+		return e.upsert(ctx, database, collection, filter, update, pos)
+	}
+
+	for _, m := range matches {
+		updated, err := applyUpdate(m.doc, update, pos, false)
+		if err != nil {
+			return result, fmt.Errorf("%w: %v", ErrBadValue, err)
+		}
+		result.Matched++
+
+		data, err := e.documentToBSON(updated)
+		if err != nil {
+			return result, fmt.Errorf("序列化文档失败: %w", err)
+		}
+		if err := e.checkDocumentSize(coll, data); err != nil {
+			return result, err
+		}
+		if string(data) == string(m.data) {
+			continue
+		}
+		if err := e.checkValidation(coll, m.doc, updated); err != nil {
+			return result, err
+		}
+
+		if err := e.updateDocument(ctx, coll, m, updated, data, update); err != nil {
+			return result, err
+		}
+		result.Modified++
+	}
+
+	return result, nil
+}
+
+// upsert 没有匹配文档时按过滤条件和更新文档构造新文档并插入，集合不存在时隐式创建
+func (e *WiredTigerEngine) upsert(ctx context.Context, database, collection string, filter, update Document, pos *positionalUpdate) (*UpdateResult, error) {
+	doc, err := upsertDocument(filter, update, pos)
+	if err != nil {
+		return nil, err
+	}
+	coll, err := e.getOrCreateCollection(ctx, database, collection)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.insertDocument(ctx, coll, doc); err != nil {
+		return nil, err
+	}
+	return &UpdateResult{UpsertedID: doc["_id"]}, nil
+}
+
+// updateDocument 用更新后的文档替换匹配的记录并写入 oplog，任一步失败或事务回滚时恢复原记录
+func (e *WiredTigerEngine) updateDocument(ctx context.Context, coll *Collection, m matchedRecord, updated Document, data []byte, update Document) error {
+	if err := checkTransactionWrite(ctx, coll); err != nil {
+		return err
+	}
+	e.oplogMu.Lock()
+	defer e.oplogMu.Unlock()
+	if err := e.beginRecordWrite(ctx, coll, m); err != nil {
+		return err
+	}
+
+	// 先更新记录，固定集合可能拒绝增大文档；索引更新失败时恢复原记录
+	if err := coll.RecordStore.UpdateRecord(ctx, m.recordId, data); err != nil {
+		return fmt.Errorf("更新记录失败: %w", err)
+	}
+	if err := e.updateIndexEntries(ctx, coll, m.doc, updated, m.recordId); err != nil {
+		coll.RecordStore.UpdateRecord(ctx, m.recordId, m.data)
+		return err
+	}
+
+	// 操作符更新记录新旧文档的字段差异，替换更新记录替换后的完整文档
+	o := updated
+	if isOperatorUpdate(update) {
+		o = diffDocuments(m.doc, updated)
+	}
+	return e.logOrDefer(ctx, coll, OplogUpdate, o, Document{"_id": m.doc["_id"]}, func(ctx context.Context) {
+		e.updateIndexEntries(ctx, coll, updated, m.doc, m.recordId)
+		coll.RecordStore.UpdateRecord(ctx, m.recordId, m.data)
+	})
+}
+
+// Delete 删除文档
+// justOne 为 true 时只删除第一个匹配的文档，返回删除的文档数
+func (e *WiredTigerEngine) Delete(ctx context.Context, database, collection string, filter Document, justOne bool) (int64, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return 0, nil
+	}
+	if coll.Capped {
+		return 0, fmt.Errorf("%w: 不能从固定集合 %s 中删除文档", ErrIllegalOperation, coll.Namespace)
+	}
+
+	matches, err := e.scanMatching(ctx, coll, filter, justOne)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, m := range matches {
+		if err := e.deleteDocument(ctx, coll, m); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// deleteDocument 删除匹配的记录并写入 oplog，oplog 写入失败或事务回滚时恢复记录
+func (e *WiredTigerEngine) deleteDocument(ctx context.Context, coll *Collection, m matchedRecord) error {
+	e.oplogMu.Lock()
+	defer e.oplogMu.Unlock()
+	if err := e.beginRecordWrite(ctx, coll, m); err != nil {
+		return err
+	}
+
+	if err := coll.RecordStore.DeleteRecord(ctx, m.recordId); err != nil {
+		return fmt.Errorf("删除记录失败: %w", err)
+	}
+	e.removeIndexEntries(ctx, coll, m.doc, m.recordId)
+
+	return e.logOrDefer(ctx, coll, OplogDelete, Document{"_id": m.doc["_id"]}, nil, func(ctx context.Context) {
+		coll.RecordStore.InsertRecord(ctx, m.recordId, m.data)
+		e.insertIndexEntries(ctx, coll, m.doc, m.recordId)
+	})
+}
+
+// Distinct 返回满足过滤条件的文档在字段路径上的不同取值
+// 数组值按元素展开，数值按数学值去重；有包含该字段的索引时只扫描索引键，不读取文档，见 distinctPlan
+func (e *WiredTigerEngine) Distinct(ctx context.Context, database, collection, field string, filter Document) ([]interface{}, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return []interface{}{}, nil
+	}
+
+	plan, err := distinctPlan(coll, field, filter)
+	if err != nil {
+		return nil, err
+	}
+	var matches []matchedRecord
+	if plan != nil {
+		matches, err = e.runPlan(ctx, coll, plan, filter, false, nil)
+	} else {
+		matches, err = e.scanMatching(ctx, coll, filter, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]Document, len(matches))
+	for i, m := range matches {
+		docs[i] = m.doc
+	}
+	return DistinctValues(docs, field), nil
+}
+
+// matchedRecord 扫描时匹配到的记录
+type matchedRecord struct {
+	recordId RecordId
+	data     []byte
+	doc      Document
+}
+
+// scanMatching 按查询计划返回满足过滤条件的记录，limitOne 为 true 时找到第一条即停止
+func (e *WiredTigerEngine) scanMatching(ctx context.Context, coll *Collection, filter Document, limitOne bool) ([]matchedRecord, error) {
+	plan, err := planQuery(coll, filter)
+	if err != nil {
+		return nil, err
+	}
+	return e.runPlan(ctx, coll, plan, filter, limitOne, nil)
+}
+
+// lookupCollection 查找集合，不存在时返回 nil
+func (e *WiredTigerEngine) lookupCollection(database, collection string) *Collection {
 	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	db, exists := e.databases[database]
 	if !exists {
-		e.mu.RUnlock()
-		return nil, fmt.Errorf("数据库 %s 不存在", database)
+		return nil
 	}
+	return db.Collections[collection]
+}
 
-	coll, exists := db.Collections[collection]
-	if !exists {
-		e.mu.RUnlock()
-		return nil, fmt.Errorf("集合 %s 不存在", collection)
+// getOrCreateCollection 获取集合，数据库或集合不存在时隐式创建
+func (e *WiredTigerEngine) getOrCreateCollection(ctx context.Context, database, collection string) (*Collection, error) {
+	if coll := e.lookupCollection(database, collection); coll != nil {
+		return coll, nil
+	}
+
+	e.mu.Lock()
+	if _, exists := e.databases[database]; !exists {
+		e.databases[database] = &Database{
+			Name:        database,
+			Collections: make(map[string]*Collection),
+		}
+	}
+	e.mu.Unlock()
+
+	if err := e.CreateCollection(ctx, database, collection); err != nil {
+		// 并发创建时集合可能已由其他请求创建
+		if coll := e.lookupCollection(database, collection); coll != nil {
+			return coll, nil
+		}
+		return nil, err
+	}
+	return e.lookupCollection(database, collection), nil
+}
+
+// index 返回集合中的索引，不存在或已删除时返回 nil
+func (coll *Collection) index(name string) SortedDataInterface {
+	coll.indexMu.RLock()
+	defer coll.indexMu.RUnlock()
+	return coll.Indexes[name]
+}
+
+// setIndex 添加或替换集合中的索引
+func (coll *Collection) setIndex(name string, idx SortedDataInterface) {
+	coll.indexMu.Lock()
+	coll.Indexes[name] = idx
+	coll.indexMu.Unlock()
+}
+
+// indexSpec 查找集合中的索引定义
+func (coll *Collection) indexSpec(name string) (Index, bool) {
+	for _, spec := range coll.IndexSpecs {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return Index{}, false
+}
+
+// indexEntries 计算文档在索引中的条目，并记录索引是否成为多键索引
+func (e *WiredTigerEngine) indexEntries(coll *Collection, indexName string, doc Document) []indexEntry {
+	spec, _ := coll.indexSpec(indexName)
+	entries, multikey := indexEntries(spec, doc)
+	if multikey && !coll.multikey[indexName] {
+		coll.multikey[indexName] = true
+		// 多键索引不能合并同一字段的上下界，已缓存的计划需要重新生成
+		coll.plans.clear()
+	}
+	return entries
+}
+
+// annotateIndexError 为唯一索引冲突补充命名空间和解码后的键值
+func (e *WiredTigerEngine) annotateIndexError(coll *Collection, indexName string, entry indexEntry, err error) error {
+	var dup *DuplicateKeyError
+	if errors.As(err, &dup) {
+		spec, _ := coll.indexSpec(indexName)
+		dup.Namespace = coll.Namespace
+		dup.Key = entry.keyDocument(spec)
+	}
+	return fmt.Errorf("更新索引 %s 失败: %w", indexName, err)
+}
+
+// insertIndexEntries 为文档写入所有索引条目，失败时撤销已写入的条目
+func (e *WiredTigerEngine) insertIndexEntries(ctx context.Context, coll *Collection, doc Document, recordId RecordId) error {
+	coll.indexMu.RLock()
+	defer coll.indexMu.RUnlock()
+	inserted := make(map[string][]indexEntry, len(coll.Indexes))
+	for name, idx := range coll.Indexes {
+		for _, entry := range e.indexEntries(coll, name, doc) {
+			if err := idx.InsertWithTypeBits(ctx, entry.key, entry.typeBits, recordId); err != nil {
+				for done, entries := range inserted {
+					for _, doneEntry := range entries {
+						coll.Indexes[done].Remove(ctx, doneEntry.key, recordId)
+					}
+				}
+				return e.annotateIndexError(coll, name, entry, err)
+			}
+			inserted[name] = append(inserted[name], entry)
+		}
+	}
+	coll.sample.add(recordId, doc)
+	return nil
+}
+
+// removeIndexEntries 删除文档的所有索引条目
+func (e *WiredTigerEngine) removeIndexEntries(ctx context.Context, coll *Collection, doc Document, recordId RecordId) {
+	coll.indexMu.RLock()
+	defer coll.indexMu.RUnlock()
+	for name, idx := range coll.Indexes {
+		for _, entry := range e.indexEntries(coll, name, doc) {
+			idx.Remove(ctx, entry.key, recordId)
+		}
+	}
+	coll.sample.remove(recordId)
+}
+
+// updateIndexEntries 文档更新后调整索引键发生变化的索引条目，失败时撤销所有已调整的条目
+func (e *WiredTigerEngine) updateIndexEntries(ctx context.Context, coll *Collection, oldDoc, newDoc Document, recordId RecordId) error {
+	type indexChange struct {
+		idx            SortedDataInterface
+		removed, added []indexEntry
+	}
+	var applied []*indexChange
+	rollback := func() {
+		for _, c := range applied {
+			for _, entry := range c.added {
+				c.idx.Remove(ctx, entry.key, recordId)
+			}
+			for _, entry := range c.removed {
+				c.idx.InsertWithTypeBits(ctx, entry.key, entry.typeBits, recordId)
+			}
+		}
+	}
+
+	coll.indexMu.RLock()
+	defer coll.indexMu.RUnlock()
+	for name, idx := range coll.Indexes {
+		removed, added := diffIndexEntries(e.indexEntries(coll, name, oldDoc), e.indexEntries(coll, name, newDoc))
+		change := &indexChange{idx: idx}
+		applied = append(applied, change)
+		for _, entry := range removed {
+			if err := idx.Remove(ctx, entry.key, recordId); err != nil {
+				rollback()
+				return fmt.Errorf("更新索引 %s 失败: %w", name, err)
+			}
+			change.removed = append(change.removed, entry)
+		}
+		for _, entry := range added {
+			if err := idx.InsertWithTypeBits(ctx, entry.key, entry.typeBits, recordId); err != nil {
+				rollback()
+				return e.annotateIndexError(coll, name, entry, err)
+			}
+			change.added = append(change.added, entry)
+		}
+	}
+	coll.sample.update(recordId, newDoc)
+	return nil
+}
+
+// diffIndexEntries 比较更新前后的索引条目，返回需要删除和需要新增的条目
+// 索引键相同但数值类型变化(如 1 改为 1.0)的条目同样需要重写，覆盖查询才能还原新的类型
+func diffIndexEntries(before, after []indexEntry) (removed, added []indexEntry) {
+	entryID := func(entry indexEntry) string {
+		return string(entry.key) + "\x00" + string(entry.typeBits)
+	}
+	oldKeys := make(map[string]bool, len(before))
+	for _, entry := range before {
+		oldKeys[entryID(entry)] = true
+	}
+	newKeys := make(map[string]bool, len(after))
+	for _, entry := range after {
+		newKeys[entryID(entry)] = true
+		if !oldKeys[entryID(entry)] {
+			added = append(added, entry)
+		}
+	}
+	for _, entry := range before {
+		if !newKeys[entryID(entry)] {
+			removed = append(removed, entry)
+		}
+	}
+	return removed, added
+}
+
+// CreateIndex 创建索引并为集合中已有的文档建立索引条目
+// 集合不存在时隐式创建；同名同定义的索引已存在时不做任何操作
+// 建立索引条目期间 ctx 被取消或超时时放弃创建并返回 ctx 的错误
+func (e *WiredTigerEngine) CreateIndex(ctx context.Context, database, collection string, index Index) error {
+	if err := validateIndex(index); err != nil {
+		return err
+	}
+	coll, err := e.getOrCreateCollection(ctx, database, collection)
+	if err != nil {
+		return err
+	}
+	if coll.Capped && index.ExpireAfterSeconds > 0 {
+		return fmt.Errorf("%w: 不能在固定集合 %s 上创建 TTL 索引", ErrIllegalOperation, coll.Namespace)
+	}
+	e.checkpointMu.RLock()
+	defer e.checkpointMu.RUnlock()
+
+	for _, spec := range coll.IndexSpecs {
+		sameKeys := DefaultIndexName(spec.Keys) == DefaultIndexName(index.Keys)
+		switch {
+		case spec.Name == index.Name && sameKeys && sameIndexOptions(spec, index):
+			return nil
+		case spec.Name == index.Name:
+			return fmt.Errorf("%w: 索引 %s 已存在且定义不同", ErrIndexConflict, index.Name)
+		case sameKeys:
+			return fmt.Errorf("%w: 键模式相同的索引 %s 已存在", ErrIndexConflict, spec.Name)
+		case spec.IsText() && index.IsText():
+			return fmt.Errorf("%w: 每个集合只能有一个文本索引，已存在 %s", ErrIndexConflict, spec.Name)
+		}
 	}
-	e.mu.RUnlock()
 
-	// 扫描所有记录（简化实现）
+	idx, err := e.kvEngine.CreateSortedDataInterface(coll.Namespace, index.Name, index.Unique)
+	if err != nil {
+		return fmt.Errorf("创建索引 %s 失败: %w", index.Name, err)
+	}
+
+	// 为已有文档建立索引条目，唯一索引冲突时放弃创建
 	cursor, err := coll.RecordStore.Scan(ctx, NullRecordId())
 	if err != nil {
-		return nil, fmt.Errorf("扫描记录失败: %w", err)
+		e.kvEngine.DropSortedDataInterface(coll.Namespace, index.Name)
+		return fmt.Errorf("扫描记录失败: %w", err)
 	}
 	defer cursor.Close()
-	
-	results := make([]Document, 0)
+	multikey := false
 	for cursor.Next() {
-		data := cursor.Data()
-		
-		// 将 BSON 反序列化为文档
-		doc, err := e.bsonToDocument(data)
+		if err := ctx.Err(); err != nil {
+			e.kvEngine.DropSortedDataInterface(coll.Namespace, index.Name)
+			return err
+		}
+		doc, err := e.bsonToDocument(cursor.Data())
 		if err != nil {
 			continue
 		}
-		
-		// TODO: 应用过滤器
-		results = append(results, doc)
+		entries, isMultikey := indexEntries(index, doc)
+		multikey = multikey || isMultikey
+		for _, entry := range entries {
+			if err := idx.InsertWithTypeBits(ctx, entry.key, entry.typeBits, cursor.RecordId()); err != nil {
+				e.kvEngine.DropSortedDataInterface(coll.Namespace, index.Name)
+				var dup *DuplicateKeyError
+				if errors.As(err, &dup) {
+					dup.Namespace = coll.Namespace
+					dup.Key = entry.keyDocument(index)
+				}
+				return fmt.Errorf("创建索引 %s 失败: %w", index.Name, err)
+			}
+		}
 	}
-	
-	return results, nil
-}
 
-// Update 更新文档
-func (e *WiredTigerEngine) Update(ctx context.Context, database, collection string, filter, update Document) error {
-	// TODO: 实现更新逻辑
+	if err := e.writeJournal(journalEntry{Op: journalCreateIndex, Database: database, Collection: collection, Index: index}); err != nil {
+		e.kvEngine.DropSortedDataInterface(coll.Namespace, index.Name)
+		return err
+	}
+	coll.setIndex(index.Name, idx)
+	coll.IndexSpecs = append(coll.IndexSpecs, index)
+	coll.multikey[index.Name] = multikey
+	coll.plans.clear()
 	return nil
 }
 
-// Delete 删除文档
-func (e *WiredTigerEngine) Delete(ctx context.Context, database, collection string, filter Document) error {
-	// TODO: 实现删除逻辑
+// DropIndex 删除索引，_id 索引不能删除
+func (e *WiredTigerEngine) DropIndex(ctx context.Context, database, collection string, indexName string) error {
+	e.checkpointMu.RLock()
+	defer e.checkpointMu.RUnlock()
+
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return fmt.Errorf("集合 %s.%s 不存在: %w", database, collection, ErrNamespaceNotFound)
+	}
+	if indexName == IdIndexName {
+		return fmt.Errorf("%w: 不能删除 _id 索引", ErrIllegalOperation)
+	}
+	if _, ok := coll.indexSpec(indexName); !ok {
+		return fmt.Errorf("索引 %s 不存在: %w", indexName, ErrIndexNotFound)
+	}
+	if err := e.writeJournal(journalEntry{Op: journalDropIndex, Database: database, Collection: collection, IndexName: indexName}); err != nil {
+		return err
+	}
+
+	if err := e.kvEngine.DropSortedDataInterface(coll.Namespace, indexName); err != nil {
+		return fmt.Errorf("删除索引 %s 失败: %w", indexName, err)
+	}
+	coll.indexMu.Lock()
+	delete(coll.Indexes, indexName)
+	coll.indexMu.Unlock()
+	delete(coll.multikey, indexName)
+	specs := coll.IndexSpecs[:0:0]
+	for _, spec := range coll.IndexSpecs {
+		if spec.Name != indexName {
+			specs = append(specs, spec)
+		}
+	}
+	coll.IndexSpecs = specs
+	coll.plans.clear()
 	return nil
 }
 
-// CreateIndex 创建索引
-func (e *WiredTigerEngine) CreateIndex(ctx context.Context, database, collection string, index Index) error {
-	// TODO: 实现索引创建逻辑
-	return nil
+// AllIndexes DropIndexes 的索引名通配符，表示 _id 索引以外的所有索引
+const AllIndexes = "*"
+
+// DropIndexes 删除多个索引，返回删除前集合的索引数
+// names 为 ["*"] 时删除 _id 索引以外的所有索引；先检查全部索引名，任一索引不存在或为 _id 索引时不删除任何索引
+func (e *WiredTigerEngine) DropIndexes(ctx context.Context, database, collection string, names []string) (int, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return 0, fmt.Errorf("集合 %s.%s 不存在: %w", database, collection, ErrNamespaceNotFound)
+	}
+	before := len(coll.IndexSpecs)
+	if len(names) == 1 && names[0] == AllIndexes {
+		names = nil
+		for _, spec := range coll.IndexSpecs {
+			if spec.Name != IdIndexName {
+				names = append(names, spec.Name)
+			}
+		}
+	}
+	seen := make(map[string]bool, len(names))
+	unique := names[:0:0]
+	for _, name := range names {
+		if name == IdIndexName {
+			return before, fmt.Errorf("%w: 不能删除 _id 索引", ErrIllegalOperation)
+		}
+		if _, ok := coll.indexSpec(name); !ok {
+			return before, fmt.Errorf("索引 %s 不存在: %w", name, ErrIndexNotFound)
+		}
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	for _, name := range unique {
+		if err := e.DropIndex(ctx, database, collection, name); err != nil {
+			return before, err
+		}
+	}
+	return before, nil
 }
 
-// DropIndex 删除索引
-func (e *WiredTigerEngine) DropIndex(ctx context.Context, database, collection string, indexName string) error {
-	// TODO: 实现索引删除逻辑
-	return nil
+// IndexModification 对已有索引选项的修改，字段为 nil 时保持不变
+type IndexModification struct {
+	ExpireAfterSeconds *int  // TTL 索引的过期秒数，只能修改已经是 TTL 索引的索引
+	Hidden             *bool // 是否对查询计划器隐藏，_id 索引不能隐藏
 }
 
-// ListIndexes 列出索引
+// ModifyIndex 修改索引的选项，返回修改前的索引定义
+// 修改只影响索引的使用方式，不需要重建索引条目
+func (e *WiredTigerEngine) ModifyIndex(ctx context.Context, database, collection string, indexName string, mod IndexModification) (Index, error) {
+	e.checkpointMu.RLock()
+	defer e.checkpointMu.RUnlock()
+
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return Index{}, fmt.Errorf("集合 %s.%s 不存在: %w", database, collection, ErrNamespaceNotFound)
+	}
+	old, ok := coll.indexSpec(indexName)
+	if !ok {
+		return Index{}, fmt.Errorf("索引 %s 不存在: %w", indexName, ErrIndexNotFound)
+	}
+	updated := old
+	if mod.ExpireAfterSeconds != nil {
+		if old.ExpireAfterSeconds <= 0 {
+			return old, fmt.Errorf("%w: 索引 %s 不是 TTL 索引，不能修改 expireAfterSeconds", ErrBadValue, indexName)
+		}
+		if *mod.ExpireAfterSeconds <= 0 {
+			return old, fmt.Errorf("%w: 索引 %s 的 expireAfterSeconds 必须为正数", ErrBadValue, indexName)
+		}
+		updated.ExpireAfterSeconds = *mod.ExpireAfterSeconds
+	}
+	if mod.Hidden != nil {
+		if indexName == IdIndexName && *mod.Hidden {
+			return old, fmt.Errorf("%w: 不能隐藏 _id 索引", ErrBadValue)
+		}
+		updated.Hidden = *mod.Hidden
+	}
+	if err := e.writeJournal(journalEntry{Op: journalModifyIndex, Database: database, Collection: collection, Index: updated}); err != nil {
+		return old, err
+	}
+
+	// 替换为新的切片，正在遍历旧切片的查询和 TTL 清理不受影响
+	specs := make([]Index, len(coll.IndexSpecs))
+	for i, spec := range coll.IndexSpecs {
+		if spec.Name == indexName {
+			spec = updated
+		}
+		specs[i] = spec
+	}
+	coll.IndexSpecs = specs
+	coll.plans.clear()
+	return old, nil
+}
+
+// ListIndexes 按创建顺序列出集合的索引
 func (e *WiredTigerEngine) ListIndexes(ctx context.Context, database, collection string) ([]Index, error) {
-	// TODO: 实现索引列出逻辑
-	return nil, nil
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return nil, fmt.Errorf("集合 %s.%s 不存在: %w", database, collection, ErrNamespaceNotFound)
+	}
+	return append([]Index(nil), coll.IndexSpecs...), nil
+}
+
+// CollectionStats 获取集合统计信息
+func (e *WiredTigerEngine) CollectionStats(ctx context.Context, database, collection string) (*CollectionStats, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return nil, fmt.Errorf("集合 %s 不存在: %w", makeNamespace(database, collection), ErrNamespaceNotFound)
+	}
+
+	stats := &CollectionStats{
+		Namespace:    coll.Namespace,
+		Count:        coll.RecordStore.NumRecords(),
+		Size:         coll.RecordStore.DataSize(),
+		Capped:       coll.Capped,
+		IndexEntries: make(map[string]int64, len(coll.IndexSpecs)),
+	}
+	if capped, ok := unwrapRecordStore(coll.RecordStore).(*CappedRecordStore); ok {
+		stats.MaxSize = capped.MaxSize()
+		stats.MaxDocs = capped.MaxDocs()
+	}
+	coll.indexMu.RLock()
+	for name, idx := range coll.Indexes {
+		stats.IndexEntries[name] = idx.NumEntries()
+	}
+	coll.indexMu.RUnlock()
+	return stats, nil
 }
 
 // GetStats 获取统计信息
@@ -368,8 +1201,15 @@ func (e *WiredTigerEngine) GetStats() map[string]interface{} {
 	
 	stats := make(map[string]interface{})
 	stats["engine"] = "wiredTiger"
+	if e.ephemeral {
+		stats["engine"] = "memory"
+	}
 	stats["running"] = e.running
 	stats["databases"] = len(e.databases)
+	stats["cache_size"] = e.config.CacheSizeBytes()
+	if !e.lastCheckpoint.IsZero() {
+		stats["last_checkpoint"] = e.lastCheckpoint
+	}
 	
 	// 添加 KV 引擎统计
 	if e.kvEngine != nil {
@@ -388,11 +1228,25 @@ type Database struct {
 // Collection 集合结构
 type Collection struct {
 	Name        string
+	Namespace   string                          // 命名空间 db.collection
+	Capped      bool                            // 是否为固定集合
 	RecordStore RecordStore                     // B+Tree 记录存储
-	Indexes     map[string]SortedDataInterface // 索引映射
+	Indexes     map[string]SortedDataInterface // 索引映射，由 indexMu 保护
+	IndexSpecs  []Index                         // 索引定义，按创建顺序排列
+
+	Validator        Document // 文档校验规则，为空时不校验，见 SetValidation
+	ValidationLevel  string   // 校验级别 strict/moderate/off
+	ValidationAction string   // 不满足规则时的处理方式 error/warn
+
+	multikey map[string]bool   // 产生过多键条目的索引
+	plans    *planCache        // 按过滤条件结构缓存的查询计划
+	sample   *collectionSample // 文档样本，用于估计过滤条件的选择性
+	indexMu  sync.RWMutex      // 保护 Indexes，删除索引与查询、写入并发时避免读到已删除的索引
 }
 
 // MemoryEngine 内存存储引擎
+// 与 WiredTiger 引擎共用集合、索引和查询的实现，但数据只保存在内存中：
+// 不写预写日志、不读取也不创建数据目录中的任何文件，忽略 journal_enabled 和 directory_for_db，进程退出后数据丢失
 type MemoryEngine struct {
 	*WiredTigerEngine
 }
@@ -403,6 +1257,7 @@ func NewMemoryEngine(cfg config.StorageConfig) (*MemoryEngine, error) {
 	if err != nil {
 		return nil, err
 	}
+	wt.ephemeral = true
 
 	return &MemoryEngine{
 		WiredTigerEngine: wt,
@@ -416,16 +1271,22 @@ func makeNamespace(database, collection string) string {
 
 // documentToBSON 将 Document 转换为 BSON 字节数组
 func (e *WiredTigerEngine) documentToBSON(doc Document) ([]byte, error) {
-	// 简化实现：使用 JSON 编码
-	// TODO: 在生产环境中应该使用真正的 BSON 编码
-	return json.Marshal(doc)
+	return MarshalDocument(doc)
+}
+
+// checkDocumentSize 检查写入集合的文档是否超过最大长度
+// oplog 条目在文档之外还包含操作信息，local 数据库中的集合不检查
+func (e *WiredTigerEngine) checkDocumentSize(coll *Collection, data []byte) error {
+	if strings.HasPrefix(coll.Namespace, OplogDatabase+".") {
+		return nil
+	}
+	if max := MaxBsonObjectSize(e.config); len(data) > max {
+		return &DocumentTooLargeError{Size: len(data), MaxSize: max}
+	}
+	return nil
 }
 
 // bsonToDocument 将 BSON 字节数组转换为 Document
 func (e *WiredTigerEngine) bsonToDocument(data []byte) (Document, error) {
-	// 简化实现：使用 JSON 解码
-	// TODO: 在生产环境中应该使用真正的 BSON 解码
-	var doc Document
-	err := json.Unmarshal(data, &doc)
-	return doc, err
+	return UnmarshalDocument(data)
 }
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+)
+
+// 存储引擎的错误类型，调用方通过 errors.Is 判断
+var (
+	// ErrNamespaceNotFound 数据库或集合不存在
+	ErrNamespaceNotFound = errors.New("命名空间不存在")
+	// ErrNamespaceExists 数据库或集合已存在
+	ErrNamespaceExists = errors.New("命名空间已存在")
+	// ErrDuplicateKey 违反唯一索引约束
+	ErrDuplicateKey = errors.New("唯一索引约束违反")
+	// ErrBadValue 查询条件、更新文档或投影不合法
+	ErrBadValue = errors.New("参数不合法")
+	// ErrIllegalOperation 操作不被允许，如删除固定集合中的文档
+	ErrIllegalOperation = errors.New("非法操作")
+	// ErrIndexNotFound 索引不存在
+	ErrIndexNotFound = errors.New("索引不存在")
+	// ErrIndexConflict 同名或同键模式的索引已存在且定义不同
+	ErrIndexConflict = errors.New("索引定义冲突")
+	// ErrDocumentTooLarge 文档超过最大长度
+	ErrDocumentTooLarge = errors.New("文档过大")
+	// ErrDocumentValidation 写入的文档不满足集合的校验规则
+	ErrDocumentValidation = errors.New("文档未通过校验")
+	// ErrQueryPlanKilled 查询使用的索引在执行期间被删除
+	ErrQueryPlanKilled = errors.New("查询计划已终止")
+	// ErrWriteConflict 写入的记录正被其他事务修改
+	ErrWriteConflict = errors.New("写冲突")
+)
+
+// DefaultMaxBsonObjectSize 默认的单个文档最大字节数
+const DefaultMaxBsonObjectSize = 16 * 1024 * 1024
+
+// MaxBsonObjectSize 返回配置的单个文档最大字节数，未配置时为 DefaultMaxBsonObjectSize
+func MaxBsonObjectSize(cfg config.StorageConfig) int {
+	if cfg.MaxBsonObjectSize > 0 {
+		return cfg.MaxBsonObjectSize
+	}
+	return DefaultMaxBsonObjectSize
+}
+
+// DocumentTooLargeError 插入或更新后的文档超过最大长度时返回的错误
+// errors.Is(err, ErrDocumentTooLarge) 成立
+type DocumentTooLargeError struct {
+	Size    int // 文档的 BSON 字节数
+	MaxSize int // 允许的最大字节数
+}
+
+func (e *DocumentTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %d 字节，上限 %d 字节", ErrDocumentTooLarge, e.Size, e.MaxSize)
+}
+
+// Is 使 errors.Is 能够识别为 ErrDocumentTooLarge
+func (e *DocumentTooLargeError) Is(target error) bool {
+	return target == ErrDocumentTooLarge
+}
+
+// DuplicateKeyError 唯一索引拒绝写入时返回的错误
+// 携带索引名和解码后的索引键，errors.Is(err, ErrDuplicateKey) 成立
+type DuplicateKeyError struct {
+	Namespace string      // 集合命名空间 db.collection
+	Index     string      // 索引名
+	Key       interface{} // 索引键，按索引字段组成的 Document
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("%v: 集合 %s 索引 %s 键 %v 已存在", ErrDuplicateKey, e.Namespace, e.Index, e.Key)
+}
+
+// Is 使 errors.Is 能够识别为 ErrDuplicateKey
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
@@ -0,0 +1,15 @@
+package storage
+
+// CollectionIndex 返回集合的索引结构，供测试直接修改索引条目
+func CollectionIndex(e *WiredTigerEngine, database, collection, name string) SortedDataInterface {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return nil
+	}
+	return coll.Indexes[name]
+}
+
+// SetDataSize 直接设置记录存储统计的数据大小，供测试模拟统计偏差
+func SetDataSize(rs RecordStore, size int64) {
+	rs.(*BTreeRecordStore).dataSize = size
+}
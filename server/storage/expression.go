@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// EvalExpression 对文档计算聚合表达式
+// 表达式可以是字段路径（"$a.b"）、$$ROOT/$$CURRENT、字面量、{$literal: v}、对象表达式（每个字段分别计算）、
+// 数组（每个元素分别计算）以及操作符表达式；字段缺失时取值为 null
+// 支持的操作符：比较 $eq/$ne/$gt/$gte/$lt/$lte/$cmp，逻辑 $and/$or/$not，算术 $add/$subtract/$multiply/$divide/$mod/$sum，
+// 字符串 $concat/$toUpper/$toLower/$substr，条件 $cond/$ifNull
+func EvalExpression(expr interface{}, doc Document) (interface{}, error) {
+	v, err := evalExpression(expr, doc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	return v, nil
+}
+
+func evalExpression(expr interface{}, doc Document) (interface{}, error) {
+	switch v := expr.(type) {
+	case string:
+		if !strings.HasPrefix(v, "$") {
+			return v, nil
+		}
+		return evalFieldPath(v, doc)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			var err error
+			if out[i], err = evalExpression(elem, doc); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case Document, map[string]interface{}:
+		obj := toDocument(v)
+		if len(obj) == 1 {
+			for op, operand := range obj {
+				if strings.HasPrefix(op, "$") {
+					return evalOperator(op, operand, doc)
+				}
+			}
+		}
+		out := make(Document, len(obj))
+		for key, field := range obj {
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("对象表达式的字段名不能以 $ 开头: %s", key)
+			}
+			value, err := evalExpression(field, doc)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = value
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+// evalFieldPath 计算 "$a.b" 字段路径和 $$ROOT/$$CURRENT 变量
+func evalFieldPath(path string, doc Document) (interface{}, error) {
+	if strings.HasPrefix(path, "$$") {
+		name, rest, _ := strings.Cut(path[2:], ".")
+		if name != "ROOT" && name != "CURRENT" {
+			return nil, fmt.Errorf("未定义的变量: %s", path)
+		}
+		if rest == "" {
+			return doc, nil
+		}
+		path = "$" + rest
+	}
+	if len(path) == 1 {
+		return nil, fmt.Errorf("字段路径不能为空")
+	}
+	v, _ := LookupField(doc, path[1:])
+	return v, nil
+}
+
+// isMissingFieldPath 表达式是否为文档中不存在的字段路径，$addFields 不添加这样的字段
+func isMissingFieldPath(expr interface{}, doc Document) bool {
+	path, ok := expr.(string)
+	if !ok || !strings.HasPrefix(path, "$") || strings.HasPrefix(path, "$$") || len(path) == 1 {
+		return false
+	}
+	_, found := LookupField(doc, path[1:])
+	return !found
+}
+
+// evalOperator 计算操作符表达式
+// $literal、$cond、$ifNull 只计算需要的参数，其余操作符先计算全部参数
+func evalOperator(op string, operand interface{}, doc Document) (interface{}, error) {
+	switch op {
+	case "$literal":
+		return operand, nil
+	case "$cond":
+		return evalCond(operand, doc)
+	case "$ifNull":
+		arr, ok := operand.([]interface{})
+		if !ok || len(arr) < 2 {
+			return nil, fmt.Errorf("$ifNull 需要至少两个参数")
+		}
+		// 依次返回第一个不为 null 的取值，全部为 null 时返回最后一个参数
+		for _, elem := range arr[:len(arr)-1] {
+			v, err := evalExpression(elem, doc)
+			if err != nil || v != nil {
+				return v, err
+			}
+		}
+		return evalExpression(arr[len(arr)-1], doc)
+	}
+
+	args, err := evalArgs(operand, doc)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$cmp":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s 需要两个参数, 实际为 %d 个", op, len(args))
+		}
+		c := CompareValues(args[0], args[1])
+		switch op {
+		case "$eq":
+			return c == 0, nil
+		case "$ne":
+			return c != 0, nil
+		case "$gt":
+			return c > 0, nil
+		case "$gte":
+			return c >= 0, nil
+		case "$lt":
+			return c < 0, nil
+		case "$lte":
+			return c <= 0, nil
+		}
+		return int32(c), nil
+	case "$and":
+		for _, arg := range args {
+			if !isTruthy(arg) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$or":
+		for _, arg := range args {
+			if isTruthy(arg) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$not":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("$not 需要一个参数, 实际为 %d 个", len(args))
+		}
+		return !isTruthy(args[0]), nil
+	case "$sum":
+		// 只有一个数组参数时对数组元素求和；非数值取值被忽略
+		if len(args) == 1 {
+			if arr, ok := args[0].([]interface{}); ok {
+				args = arr
+			}
+		}
+		var sum interface{} = int32(0)
+		for _, arg := range args {
+			if isNumber(arg) {
+				sum = addNumbers(sum, arg)
+			}
+		}
+		return sum, nil
+	case "$add":
+		return evalAdd(args)
+	case "$subtract":
+		return evalSubtract(args)
+	case "$multiply":
+		var product interface{} = int32(1)
+		for _, arg := range args {
+			if arg == nil {
+				return nil, nil
+			}
+			if !isNumber(arg) {
+				return nil, fmt.Errorf("$multiply 只支持数值, 实际为 %T", arg)
+			}
+			product = multiplyNumbers(product, arg)
+		}
+		return product, nil
+	case "$divide", "$mod":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s 需要两个参数, 实际为 %d 个", op, len(args))
+		}
+		if args[0] == nil || args[1] == nil {
+			return nil, nil
+		}
+		if !isNumber(args[0]) || !isNumber(args[1]) {
+			return nil, fmt.Errorf("%s 只支持数值, 实际为 %T 和 %T", op, args[0], args[1])
+		}
+		if toFloat64(args[1]) == 0 {
+			return nil, fmt.Errorf("%s 的除数不能为 0", op)
+		}
+		if op == "$divide" {
+			return toFloat64(args[0]) / toFloat64(args[1]), nil
+		}
+		return modNumbers(args[0], args[1]), nil
+	case "$concat":
+		var sb strings.Builder
+		for _, arg := range args {
+			if arg == nil {
+				return nil, nil
+			}
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("$concat 只支持字符串, 实际为 %T", arg)
+			}
+			sb.WriteString(s)
+		}
+		return sb.String(), nil
+	case "$toUpper", "$toLower":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s 需要一个参数, 实际为 %d 个", op, len(args))
+		}
+		s, err := expressionString(op, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if op == "$toUpper" {
+			return strings.ToUpper(s), nil
+		}
+		return strings.ToLower(s), nil
+	case "$substr", "$substrBytes":
+		return evalSubstr(op, args)
+	}
+	return nil, fmt.Errorf("未知的表达式操作符: %s", op)
+}
+
+// evalCond 计算 $cond，参数为 [if, then, else] 或 {if, then, else}，只计算选中的分支
+func evalCond(operand interface{}, doc Document) (interface{}, error) {
+	var cond, then, otherwise interface{}
+	if arr, ok := operand.([]interface{}); ok {
+		if len(arr) != 3 {
+			return nil, fmt.Errorf("$cond 需要三个参数, 实际为 %d 个", len(arr))
+		}
+		cond, then, otherwise = arr[0], arr[1], arr[2]
+	} else if obj := toDocument(operand); obj != nil {
+		for _, key := range []string{"if", "then", "else"} {
+			if _, ok := obj[key]; !ok {
+				return nil, fmt.Errorf("$cond 缺少 %s 参数", key)
+			}
+		}
+		if len(obj) != 3 {
+			return nil, fmt.Errorf("$cond 只支持 if、then 和 else 参数")
+		}
+		cond, then, otherwise = obj["if"], obj["then"], obj["else"]
+	} else {
+		return nil, fmt.Errorf("$cond 的参数必须是数组或文档")
+	}
+	v, err := evalExpression(cond, doc)
+	if err != nil {
+		return nil, err
+	}
+	if isTruthy(v) {
+		return evalExpression(then, doc)
+	}
+	return evalExpression(otherwise, doc)
+}
+
+// evalAdd 计算 $add：数值相加，最多一个参数可以是日期，结果为日期加上其余参数的毫秒数；任一参数为 null 时结果为 null
+func evalAdd(args []interface{}) (interface{}, error) {
+	var sum interface{} = int32(0)
+	var date *time.Time
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			return nil, nil
+		case time.Time:
+			if date != nil {
+				return nil, fmt.Errorf("$add 只能包含一个日期")
+			}
+			date = &v
+			continue
+		}
+		if !isNumber(arg) {
+			return nil, fmt.Errorf("$add 只支持数值和日期, 实际为 %T", arg)
+		}
+		sum = addNumbers(sum, arg)
+	}
+	if date != nil {
+		return date.Add(time.Duration(math.Round(toFloat64(sum))) * time.Millisecond), nil
+	}
+	return sum, nil
+}
+
+// evalSubtract 计算 $subtract：数值相减；日期减日期得到毫秒数，日期减数值得到日期；任一参数为 null 时结果为 null
+func evalSubtract(args []interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("$subtract 需要两个参数, 实际为 %d 个", len(args))
+	}
+	a, b := args[0], args[1]
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	if t, ok := a.(time.Time); ok {
+		switch u := b.(type) {
+		case time.Time:
+			return t.Sub(u).Milliseconds(), nil
+		default:
+			if isNumber(b) {
+				return t.Add(-time.Duration(math.Round(toFloat64(b))) * time.Millisecond), nil
+			}
+		}
+		return nil, fmt.Errorf("不能从日期中减去 %T", b)
+	}
+	if !isNumber(a) || !isNumber(b) {
+		return nil, fmt.Errorf("$subtract 只支持数值和日期, 实际为 %T 和 %T", a, b)
+	}
+	return addNumbers(a, negateNumber(b)), nil
+}
+
+// negateNumber 取相反数，保持数值类型，int32 和 int64 的最小值分别提升为 int64 和 double
+func negateNumber(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int32:
+		if n == math.MinInt32 {
+			return -int64(n)
+		}
+		return -n
+	case int64:
+		if n == math.MinInt64 {
+			return -float64(n)
+		}
+		return -n
+	case int:
+		return -int64(n)
+	}
+	return -toFloat64(v)
+}
+
+// modNumbers 求余数，结果的符号与被除数相同；两个参数都是整数时结果为整数，除数不能为 0
+func modNumbers(a, b interface{}) interface{} {
+	x, xInt := toInt64(a)
+	y, yInt := toInt64(b)
+	if !xInt || !yInt {
+		return math.Mod(toFloat64(a), toFloat64(b))
+	}
+	if y == -1 {
+		// 避免 math.MinInt64 % -1 溢出
+		x = 0
+	}
+	r := x % y
+	if _, is64 := a.(int64); !is64 {
+		if _, is64 := b.(int64); !is64 {
+			return int32(r)
+		}
+	}
+	return r
+}
+
+// expressionString 将字符串操作符的参数转换为字符串，null 视为空字符串，数值和日期转换为文本
+func expressionString(op string, v interface{}) (string, error) {
+	switch s := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return s, nil
+	case time.Time:
+		return s.UTC().Format("2006-01-02T15:04:05.000Z"), nil
+	}
+	if isNumber(v) {
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("%s 不能转换 %T 类型的取值", op, v)
+}
+
+// evalSubstr 计算 $substr [字符串, 起始字节, 字节数]，字节数为负数时取到末尾，起始位置超出长度时返回空字符串
+func evalSubstr(op string, args []interface{}) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("%s 需要三个参数, 实际为 %d 个", op, len(args))
+	}
+	s, err := expressionString(op, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !isNumber(args[1]) || !isNumber(args[2]) {
+		return nil, fmt.Errorf("%s 的起始位置和长度必须是数值", op)
+	}
+	start, length := int(toFloat64(args[1])), int(toFloat64(args[2]))
+	if start < 0 {
+		return nil, fmt.Errorf("%s 的起始位置不能为负数", op)
+	}
+	if start >= len(s) {
+		return "", nil
+	}
+	end := len(s)
+	if length >= 0 && start+length < end {
+		end = start + length
+	}
+	return s[start:end], nil
+}
+
+// evalArgs 计算操作符的参数，参数不是数组时视为单个参数
+func evalArgs(operand interface{}, doc Document) ([]interface{}, error) {
+	arr, ok := operand.([]interface{})
+	if !ok {
+		arr = []interface{}{operand}
+	}
+	args := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		var err error
+		if args[i], err = evalExpression(elem, doc); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// multiplyNumbers 数值相乘，整数运算保持整数类型，int32 溢出时提升为 int64，int64 溢出时改用 double
+func multiplyNumbers(a, b interface{}) interface{} {
+	x, xInt := toInt64(a)
+	y, yInt := toInt64(b)
+	if !xInt || !yInt {
+		return toFloat64(a) * toFloat64(b)
+	}
+	if x != 0 && (x*y/x != y || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64)) {
+		return float64(x) * float64(y)
+	}
+	product := x * y
+	if _, is64 := a.(int64); !is64 {
+		if _, is64 := b.(int64); !is64 && product == int64(int32(product)) {
+			return int32(product)
+		}
+	}
+	return product
+}
+
+// AddFields 计算 $addFields/$set 的每个字段并写入文档副本，点号分隔的字段写入嵌套文档
+// 取值为文档中不存在的字段路径时不添加该字段
+func AddFields(doc, fields Document) (Document, error) {
+	result := cloneDocument(doc)
+	for _, path := range sortedKeys(fields) {
+		expr := fields[path]
+		if isMissingFieldPath(expr, doc) {
+			continue
+		}
+		v, err := evalExpression(expr, doc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: 计算字段 %s 失败: %v", ErrBadValue, path, err)
+		}
+		if err := setPath(result, strings.Split(path, "."), v); err != nil {
+			return nil, fmt.Errorf("%w: 设置字段 %s 失败: %v", ErrBadValue, path, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,195 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestEvalExpression 按类别测试聚合表达式的计算
+func TestEvalExpression(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	doc := storage.Document{
+		"name":    "Widget",
+		"price":   int32(12),
+		"qty":     int32(5),
+		"ratio":   2.5,
+		"big":     int64(1) << 40,
+		"nothing": nil,
+		"created": created,
+		"tags":    []interface{}{"a", "b"},
+		"dims":    storage.Document{"w": int32(3), "h": int32(4)},
+		"items":   []interface{}{storage.Document{"n": int32(1)}, storage.Document{"n": int32(2)}},
+	}
+	arr := func(values ...interface{}) []interface{} { return values }
+	op := func(name string, operand interface{}) storage.Document { return storage.Document{name: operand} }
+
+	tests := []struct {
+		category string
+		expr     interface{}
+		want     interface{}
+	}{
+		{"字段路径", "$name", "Widget"},
+		{"字段路径", "$dims.w", int32(3)},
+		{"字段路径", "$items.n", arr(int32(1), int32(2))},
+		{"字段路径", "$missing", nil},
+		{"字段路径", "$$ROOT.price", int32(12)},
+		{"字面量", "plain", "plain"},
+		{"字面量", int32(7), int32(7)},
+		{"字面量", op("$literal", "$name"), "$name"},
+		{"字面量", storage.Document{"p": "$price", "fixed": true}, storage.Document{"p": int32(12), "fixed": true}},
+		{"字面量", arr("$qty", int32(1)), arr(int32(5), int32(1))},
+
+		{"比较", op("$eq", arr("$price", 12.0)), true},
+		{"比较", op("$ne", arr("$price", int32(12))), false},
+		{"比较", op("$gt", arr("$price", "$qty")), true},
+		{"比较", op("$gte", arr("$qty", int32(5))), true},
+		{"比较", op("$lt", arr("$ratio", int32(2))), false},
+		{"比较", op("$lte", arr("$missing", nil)), true},
+		{"比较", op("$cmp", arr("$qty", "$price")), int32(-1)},
+		// 不同类型按类型顺序比较，字符串大于数值
+		{"比较", op("$gt", arr("$name", "$price")), true},
+
+		{"逻辑", op("$and", arr(op("$gt", arr("$price", int32(10))), "$qty")), true},
+		{"逻辑", op("$or", arr(false, "$nothing", int32(0))), false},
+		{"逻辑", op("$not", arr("$missing")), true},
+
+		{"算术", op("$add", arr("$price", "$qty", 0.5)), 17.5},
+		{"算术", op("$add", arr("$price", "$qty")), int32(17)},
+		{"算术", op("$add", arr("$created", int64(1000))), created.Add(time.Second)},
+		{"算术", op("$add", arr("$price", "$nothing")), nil},
+		{"算术", op("$subtract", arr("$price", "$qty")), int32(7)},
+		{"算术", op("$subtract", arr("$created", int32(60000))), created.Add(-time.Minute)},
+		{"算术", op("$subtract", arr(created.Add(time.Hour), "$created")), int64(3600000)},
+		{"算术", op("$multiply", arr("$price", "$qty")), int32(60)},
+		{"算术", op("$multiply", arr("$big", "$big", "$big")), float64(int64(1)<<40) * float64(int64(1)<<40) * float64(int64(1)<<40)},
+		{"算术", op("$multiply", arr("$price", "$ratio")), 30.0},
+		{"算术", op("$divide", arr("$price", "$qty")), 2.4},
+		{"算术", op("$mod", arr("$price", "$qty")), int32(2)},
+		{"算术", op("$mod", arr(int32(-7), int32(3))), int32(-1)},
+		{"算术", op("$mod", arr(7.5, int32(2))), 1.5},
+		{"算术", op("$sum", "$tags"), int32(0)},
+		{"算术", op("$sum", arr("$price", "$qty", "$name")), int32(17)},
+
+		{"字符串", op("$concat", arr("$name", "-", "x")), "Widget-x"},
+		{"字符串", op("$concat", arr("$name", "$missing")), nil},
+		{"字符串", op("$toUpper", "$name"), "WIDGET"},
+		{"字符串", op("$toLower", arr("$name")), "widget"},
+		{"字符串", op("$toUpper", "$missing"), ""},
+		{"字符串", op("$substr", arr("$name", int32(1), int32(3))), "idg"},
+		{"字符串", op("$substr", arr("$name", int32(2), int32(-1))), "dget"},
+		{"字符串", op("$substr", arr("$name", int32(10), int32(2))), ""},
+
+		{"条件", op("$cond", arr(op("$gt", arr("$qty", int32(3))), "many", "few")), "many"},
+		{"条件", op("$cond", storage.Document{"if": "$missing", "then": "yes", "else": "no"}), "no"},
+		// 只计算选中的分支，未选中分支的错误不影响结果
+		{"条件", op("$cond", arr(true, "ok", op("$divide", arr(int32(1), int32(0))))), "ok"},
+		{"条件", op("$ifNull", arr("$missing", "$nothing", "default")), "default"},
+		{"条件", op("$ifNull", arr("$name", "default")), "Widget"},
+	}
+	for _, tt := range tests {
+		got, err := storage.EvalExpression(tt.expr, doc)
+		if err != nil {
+			t.Errorf("%s: EvalExpression(%v) 失败: %v", tt.category, tt.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: EvalExpression(%v) = %#v, want %#v", tt.category, tt.expr, got, tt.want)
+		}
+	}
+}
+
+// TestEvalExpressionErrors 测试非法表达式返回 ErrBadValue
+func TestEvalExpressionErrors(t *testing.T) {
+	doc := storage.Document{"name": "Widget", "price": int32(12)}
+	for _, expr := range []interface{}{
+		storage.Document{"$unknown": int32(1)},
+		storage.Document{"$eq": []interface{}{int32(1)}},
+		storage.Document{"$divide": []interface{}{"$price", int32(0)}},
+		storage.Document{"$mod": []interface{}{"$price", int32(0)}},
+		storage.Document{"$multiply": []interface{}{"$price", "$name"}},
+		storage.Document{"$concat": []interface{}{"$name", "$price"}},
+		storage.Document{"$substr": []interface{}{"$name", int32(-1), int32(2)}},
+		storage.Document{"$cond": []interface{}{true, "a"}},
+		storage.Document{"$cond": storage.Document{"if": true, "then": "a"}},
+		storage.Document{"$ifNull": "$name"},
+		storage.Document{"$add": []interface{}{"$price", "$name"}},
+		storage.Document{"a": int32(1), "$b": int32(2)},
+		"$$NOW",
+	} {
+		if _, err := storage.EvalExpression(expr, doc); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("EvalExpression(%v) err = %v, want ErrBadValue", expr, err)
+		}
+	}
+}
+
+// TestExprFilter 测试过滤条件中的 $expr 比较同一文档的两个字段，并与普通条件组合为隐式 $and
+func TestExprFilter(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := []storage.Document{
+		{"_id": int32(1), "dept": "eng", "spent": int32(120), "budget": int32(100)},
+		{"_id": int32(2), "dept": "eng", "spent": int32(80), "budget": int32(100)},
+		{"_id": int32(3), "dept": "ops", "spent": 250.5, "budget": int64(200)},
+		{"_id": int32(4), "dept": "ops", "spent": int32(10)},
+	}
+	if err := engine.Insert(ctx, "test", "budgets", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	overspent := storage.Document{"$gt": []interface{}{"$spent", "$budget"}}
+	ids := func(filter storage.Document) []interface{} {
+		t.Helper()
+		found, err := engine.Find(ctx, "test", "budgets", filter)
+		if err != nil {
+			t.Fatalf("查询 %v 失败: %v", filter, err)
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i]["_id"].(int32) < found[j]["_id"].(int32) })
+		result := make([]interface{}, len(found))
+		for i, doc := range found {
+			result[i] = doc["_id"]
+		}
+		return result
+	}
+
+	// 缺失的 budget 取值为 null，数值大于 null
+	if got := ids(storage.Document{"$expr": overspent}); !reflect.DeepEqual(got, []interface{}{int32(1), int32(3), int32(4)}) {
+		t.Errorf("$expr 比较两个字段的结果 = %v", got)
+	}
+	if got := ids(storage.Document{"$expr": overspent, "dept": "eng"}); !reflect.DeepEqual(got, []interface{}{int32(1)}) {
+		t.Errorf("$expr 与等值条件组合的结果 = %v", got)
+	}
+	ratio := storage.Document{"$expr": storage.Document{"$lt": []interface{}{
+		storage.Document{"$divide": []interface{}{"$spent", "$budget"}}, 0.9,
+	}}}
+	// 缺少 budget 时除法结果为 null，小于任何数值
+	if got := ids(ratio); !reflect.DeepEqual(got, []interface{}{int32(2), int32(4)}) {
+		t.Errorf("$expr 中的算术表达式结果 = %v", got)
+	}
+
+	result, err := engine.Update(ctx, "test", "budgets", storage.Document{"$expr": overspent, "dept": "ops"},
+		storage.Document{"$set": storage.Document{"flagged": true}}, storage.UpdateOptions{Multi: true})
+	if err != nil || result.Matched != 2 {
+		t.Fatalf("按 $expr 更新的结果不正确: %+v, %v", result, err)
+	}
+	deleted, err := engine.Delete(ctx, "test", "budgets", storage.Document{"$expr": storage.Document{"$eq": []interface{}{"$spent", int32(80)}}}, false)
+	if err != nil || deleted != 1 {
+		t.Fatalf("按 $expr 删除的结果不正确: %d, %v", deleted, err)
+	}
+	if got := ids(storage.Document{"flagged": true}); !reflect.DeepEqual(got, []interface{}{int32(3), int32(4)}) {
+		t.Errorf("更新后的文档 = %v", got)
+	}
+
+	invalid := storage.Document{"$expr": storage.Document{"$bogus": int32(1)}}
+	if _, err := engine.Find(ctx, "test", "budgets", invalid); !errors.Is(err, storage.ErrBadValue) {
+		t.Errorf("非法的 $expr 应返回 ErrBadValue: %v", err)
+	}
+}
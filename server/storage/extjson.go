@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// ToExtendedJSON 将 Document 编码为 MongoDB Canonical Extended JSON
+// 普通 JSON 无法区分的类型以 $oid、$date、$numberInt、$numberLong 等包装文档表示，
+// 字段顺序与 MarshalDocument 相同：_id 在最前，其余按字典序
+func ToExtendedJSON(doc Document) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeExtJSONDocument(&buf, doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FromExtendedJSON 将 Extended JSON 解码为 Document
+// 同时接受 Canonical 与 Relaxed 格式：Relaxed 格式中的整数按范围解码为 int32 或 int64，
+// 带小数点或指数的数值解码为 float64，$date 可以是 ISO-8601 字符串或毫秒数
+func FromExtendedJSON(data []byte) (Document, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%w: 无效的 JSON: %v", ErrBadValue, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: JSON 文档之后有多余的内容", ErrBadValue)
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: Extended JSON 的顶层必须是对象", ErrBadValue)
+	}
+	value, err := decodeExtJSONObject(obj)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	doc, ok := value.(Document)
+	if !ok {
+		return nil, fmt.Errorf("%w: Extended JSON 的顶层必须是文档，而不是 %T", ErrBadValue, value)
+	}
+	return doc, nil
+}
+
+func writeExtJSONDocument(buf *bytes.Buffer, doc Document) error {
+	buf.WriteByte('{')
+	for i, key := range sortedKeys(doc) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeExtJSONString(buf, key)
+		buf.WriteByte(':')
+		if err := writeExtJSONValue(buf, doc[key]); err != nil {
+			return fmt.Errorf("字段 %s: %w", key, err)
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func writeExtJSONArray(buf *bytes.Buffer, arr []interface{}) error {
+	buf.WriteByte('[')
+	for i, value := range arr {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeExtJSONValue(buf, value); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+// writeExtJSONValue 按 Go 类型写出单个值，支持的类型与 appendElement 一致
+func writeExtJSONValue(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int32:
+		fmt.Fprintf(buf, `{"$numberInt":"%d"}`, v)
+	case int64:
+		fmt.Fprintf(buf, `{"$numberLong":"%d"}`, v)
+	case int:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			fmt.Fprintf(buf, `{"$numberInt":"%d"}`, v)
+		} else {
+			fmt.Fprintf(buf, `{"$numberLong":"%d"}`, v)
+		}
+	case float64:
+		fmt.Fprintf(buf, `{"$numberDouble":"%s"}`, formatExtJSONDouble(v))
+	case float32:
+		fmt.Fprintf(buf, `{"$numberDouble":"%s"}`, formatExtJSONDouble(float64(v)))
+	case string:
+		writeExtJSONString(buf, v)
+	case Document:
+		return writeExtJSONDocument(buf, v)
+	case map[string]interface{}:
+		return writeExtJSONDocument(buf, Document(v))
+	case []interface{}:
+		return writeExtJSONArray(buf, v)
+	case []Document:
+		arr := make([]interface{}, len(v))
+		for i := range v {
+			arr[i] = v[i]
+		}
+		return writeExtJSONArray(buf, arr)
+	case []byte:
+		fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"00"}}`, base64.StdEncoding.EncodeToString(v))
+	case Binary:
+		fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"%02x"}}`, base64.StdEncoding.EncodeToString(v.Data), v.Subtype)
+	case ObjectID:
+		fmt.Fprintf(buf, `{"$oid":"%s"}`, v.Hex())
+	case time.Time:
+		fmt.Fprintf(buf, `{"$date":{"$numberLong":"%d"}}`, v.UnixMilli())
+	case Regex:
+		buf.WriteString(`{"$regularExpression":{"pattern":`)
+		writeExtJSONString(buf, v.Pattern)
+		buf.WriteString(`,"options":`)
+		writeExtJSONString(buf, v.Options)
+		buf.WriteString(`}}`)
+	case Timestamp:
+		fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, v.T, v.I)
+	case Decimal128:
+		fmt.Fprintf(buf, `{"$numberDecimal":"%s"}`, bsoncore.NewDecimal128(v.High, v.Low).String())
+	case MinKey:
+		buf.WriteString(`{"$minKey":1}`)
+	case MaxKey:
+		buf.WriteString(`{"$maxKey":1}`)
+	default:
+		return fmt.Errorf("类型 %T 无法编码为 Extended JSON", value)
+	}
+	return nil
+}
+
+func writeExtJSONString(buf *bytes.Buffer, s string) {
+	// 字符串的 JSON 编码不会失败
+	data, _ := json.Marshal(s)
+	buf.Write(data)
+}
+
+// formatExtJSONDouble 按 Canonical 格式表示 double：非有限值使用 Infinity、-Infinity 和 NaN，
+// 整数值保留 ".0" 以便与整数区分
+func formatExtJSONDouble(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return s
+}
+
+// decodeExtJSONValue 将 encoding/json 解码出的值转换为 Document 使用的 Go 类型
+func decodeExtJSONValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return decodeExtJSONObject(v)
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i, elem := range v {
+			var err error
+			if arr[i], err = decodeExtJSONValue(elem); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case json.Number:
+		return decodeExtJSONNumber(v)
+	default:
+		// nil、bool 和 string
+		return v, nil
+	}
+}
+
+// decodeExtJSONNumber 解码 Relaxed 格式的数值
+func decodeExtJSONNumber(n json.Number) (interface{}, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int32(i), nil
+			}
+			return i, nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无效的数值 %s", s)
+	}
+	return f, nil
+}
+
+// decodeExtJSONObject 识别类型包装文档，其他对象解码为 Document
+// 包装文档必须只有一个以 $ 开头的字段，像 {$gt: 1} 这样的查询操作符文档按普通文档解码
+func decodeExtJSONObject(obj map[string]interface{}) (interface{}, error) {
+	if len(obj) == 1 {
+		for key, value := range obj {
+			if v, ok, err := decodeExtJSONWrapper(key, value); ok || err != nil {
+				return v, err
+			}
+		}
+	}
+	doc := make(Document, len(obj))
+	for key, value := range obj {
+		v, err := decodeExtJSONValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("字段 %s: %w", key, err)
+		}
+		doc[key] = v
+	}
+	return doc, nil
+}
+
+// decodeExtJSONWrapper 解码单字段的类型包装文档，key 不是已知的类型包装时返回 ok 为 false
+func decodeExtJSONWrapper(key string, value interface{}) (result interface{}, ok bool, err error) {
+	switch key {
+	case "$oid":
+		s, isString := value.(string)
+		data, decodeErr := hex.DecodeString(s)
+		if !isString || decodeErr != nil || len(data) != len(ObjectID{}) {
+			return nil, true, fmt.Errorf("$oid 必须是 24 位十六进制字符串: %v", value)
+		}
+		var id ObjectID
+		copy(id[:], data)
+		return id, true, nil
+	case "$numberInt":
+		s, _ := value.(string)
+		i, parseErr := strconv.ParseInt(s, 10, 32)
+		if parseErr != nil {
+			return nil, true, fmt.Errorf("无效的 $numberInt: %v", value)
+		}
+		return int32(i), true, nil
+	case "$numberLong":
+		s, _ := value.(string)
+		i, parseErr := strconv.ParseInt(s, 10, 64)
+		if parseErr != nil {
+			return nil, true, fmt.Errorf("无效的 $numberLong: %v", value)
+		}
+		return i, true, nil
+	case "$numberDouble":
+		s, _ := value.(string)
+		f, parseErr := parseExtJSONDouble(s)
+		if parseErr != nil {
+			return nil, true, fmt.Errorf("无效的 $numberDouble: %v", value)
+		}
+		return f, true, nil
+	case "$numberDecimal":
+		s, _ := value.(string)
+		d, parseErr := bsoncore.ParseDecimal128(s)
+		if parseErr != nil {
+			return nil, true, fmt.Errorf("无效的 $numberDecimal: %v", value)
+		}
+		high, low := d.GetBytes()
+		return Decimal128{High: high, Low: low}, true, nil
+	case "$date":
+		t, dateErr := decodeExtJSONDate(value)
+		return t, true, dateErr
+	case "$binary":
+		data, binaryErr := decodeExtJSONBinary(value)
+		return data, true, binaryErr
+	case "$regularExpression":
+		fields, _ := value.(map[string]interface{})
+		pattern, patternOK := fields["pattern"].(string)
+		options, optionsOK := fields["options"].(string)
+		if len(fields) != 2 || !patternOK || !optionsOK {
+			return nil, true, fmt.Errorf("$regularExpression 需要字符串字段 pattern 和 options")
+		}
+		return Regex{Pattern: pattern, Options: options}, true, nil
+	case "$timestamp":
+		fields, _ := value.(map[string]interface{})
+		t, tErr := extJSONUint32(fields["t"])
+		i, iErr := extJSONUint32(fields["i"])
+		if len(fields) != 2 || tErr != nil || iErr != nil {
+			return nil, true, fmt.Errorf("$timestamp 需要无符号 32 位整数字段 t 和 i")
+		}
+		return Timestamp{T: t, I: i}, true, nil
+	case "$minKey":
+		return MinKey{}, true, nil
+	case "$maxKey":
+		return MaxKey{}, true, nil
+	case "$undefined":
+		return nil, true, nil
+	}
+	return nil, false, nil
+}
+
+func parseExtJSONDouble(s string) (float64, error) {
+	switch s {
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// decodeExtJSONDate 解码 $date 的三种形式：{$numberLong: "ms"}、ISO-8601 字符串和毫秒数
+func decodeExtJSONDate(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if s, ok := v["$numberLong"].(string); ok && len(v) == 1 {
+			if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return time.UnixMilli(ms).UTC(), nil
+			}
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return time.UnixMilli(t.UnixMilli()).UTC(), nil
+		}
+	case json.Number:
+		if ms, err := v.Int64(); err == nil {
+			return time.UnixMilli(ms).UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无效的 $date: %v", value)
+}
+
+// decodeExtJSONBinary 解码 $binary，通用子类型解码为 []byte，其他子类型解码为 Binary
+func decodeExtJSONBinary(value interface{}) (interface{}, error) {
+	fields, _ := value.(map[string]interface{})
+	encoded, base64OK := fields["base64"].(string)
+	subType, subTypeOK := fields["subType"].(string)
+	if len(fields) != 2 || !base64OK || !subTypeOK {
+		return nil, fmt.Errorf("$binary 需要字符串字段 base64 和 subType")
+	}
+	subtype, err := strconv.ParseUint(subType, 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 $binary 子类型: %s", subType)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 $binary base64 数据: %v", err)
+	}
+	return newBinaryValue(byte(subtype), data), nil
+}
+
+func extJSONUint32(value interface{}) (uint32, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("需要数值: %v", value)
+	}
+	i, err := strconv.ParseUint(n.String(), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(i), nil
+}
@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestExtendedJSON 测试 Document 与 Extended JSON 的相互转换
+func TestExtendedJSON(t *testing.T) {
+	id := storage.NewObjectID()
+	now := time.UnixMilli(time.Now().UnixMilli()).UTC()
+	doc := storage.Document{
+		"_id":      id,
+		"name":     "Alice",
+		"age":      int32(30),
+		"balance":  int64(1) << 40,
+		"score":    9.5,
+		"round":    2.0,
+		"active":   true,
+		"created":  now,
+		"tags":     []interface{}{"a", int32(1), int64(2)},
+		"address":  storage.Document{"city": "Beijing", "zip": int64(100000)},
+		"note":     nil,
+		"data":     []byte{1, 2, 3},
+		"uuid":     storage.Binary{Subtype: storage.BinarySubtypeUUID, Data: []byte{0xde, 0xad}},
+		"pattern":  storage.Regex{Pattern: "^a\"b", Options: "i"},
+		"ts":       storage.Timestamp{T: 1700000000, I: 2},
+		"price":    storage.Decimal128{High: 0x3040000000000000, Low: 12345},
+		"low":      storage.MinKey{},
+		"high":     storage.MaxKey{},
+		"infinite": math.Inf(1),
+	}
+
+	data, err := storage.ToExtendedJSON(doc)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	for _, want := range []string{
+		`{"_id":{"$oid":"` + id.Hex() + `"}`,
+		`"balance":{"$numberLong":"1099511627776"}`,
+		`"age":{"$numberInt":"30"}`,
+		`"round":{"$numberDouble":"2.0"}`,
+		`"price":{"$numberDecimal":"12345"}`,
+		`"uuid":{"$binary":{"base64":"3q0=","subType":"04"}}`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("编码结果应包含 %s: %s", want, data)
+		}
+	}
+
+	decoded, err := storage.FromExtendedJSON(data)
+	if err != nil {
+		t.Fatalf("解码失败: %v", err)
+	}
+	if len(decoded) != len(doc) {
+		t.Errorf("字段数不一致: got %d, want %d", len(decoded), len(doc))
+	}
+	for key, want := range doc {
+		if storage.CompareValues(decoded[key], want) != 0 {
+			t.Errorf("字段 %s 不一致: got %#v, want %#v", key, decoded[key], want)
+		}
+	}
+	if got, ok := decoded["_id"].(storage.ObjectID); !ok || got != id {
+		t.Errorf("ObjectID 类型丢失: %#v", decoded["_id"])
+	}
+	if got, ok := decoded["created"].(time.Time); !ok || !got.Equal(now) {
+		t.Errorf("日期类型丢失: %#v", decoded["created"])
+	}
+	if _, ok := decoded["balance"].(int64); !ok {
+		t.Errorf("int64 类型丢失: %T", decoded["balance"])
+	}
+	if _, ok := decoded["address"].(storage.Document)["zip"].(int64); !ok {
+		t.Errorf("嵌套文档中的 int64 类型丢失: %#v", decoded["address"])
+	}
+	if _, ok := decoded["age"].(int32); !ok {
+		t.Errorf("int32 类型丢失: %T", decoded["age"])
+	}
+	if _, ok := decoded["round"].(float64); !ok {
+		t.Errorf("double 类型丢失: %T", decoded["round"])
+	}
+
+	// 编码结果是确定的
+	again, err := storage.ToExtendedJSON(decoded)
+	if err != nil {
+		t.Fatalf("再次编码失败: %v", err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("往返后编码结果不一致:\n%s\n%s", again, data)
+	}
+
+	t.Run("Relaxed 格式", func(t *testing.T) {
+		decoded, err := storage.FromExtendedJSON([]byte(`{
+			"n": 1, "big": 5000000000, "f": 1.5, "e": 1e3,
+			"when": {"$date": "2023-11-14T22:13:20.123Z"},
+			"filter": {"$gt": 1}
+		}`))
+		if err != nil {
+			t.Fatalf("解码失败: %v", err)
+		}
+		if _, ok := decoded["n"].(int32); !ok {
+			t.Errorf("小整数应解码为 int32: %T", decoded["n"])
+		}
+		if _, ok := decoded["big"].(int64); !ok {
+			t.Errorf("超出 int32 的整数应解码为 int64: %T", decoded["big"])
+		}
+		if _, ok := decoded["f"].(float64); !ok {
+			t.Errorf("小数应解码为 float64: %T", decoded["f"])
+		}
+		if _, ok := decoded["e"].(float64); !ok {
+			t.Errorf("指数形式应解码为 float64: %T", decoded["e"])
+		}
+		if got, ok := decoded["when"].(time.Time); !ok || got.UnixMilli() != 1700000000123 {
+			t.Errorf("ISO-8601 日期解码错误: %#v", decoded["when"])
+		}
+		// 查询操作符不是类型包装，按普通文档解码
+		if filter, ok := decoded["filter"].(storage.Document); !ok || filter["$gt"] != int32(1) {
+			t.Errorf("操作符文档应解码为 Document: %#v", decoded["filter"])
+		}
+	})
+
+	t.Run("无效输入", func(t *testing.T) {
+		for _, input := range []string{
+			`[1, 2]`,
+			`{"a": 1} {"b": 2}`,
+			`{"_id": {"$oid": "xyz"}}`,
+			`{"n": {"$numberLong": 12}}`,
+			`{"n": {"$numberInt": "3000000000"}}`,
+			`{"d": {"$date": true}}`,
+			`{"a": `,
+		} {
+			if _, err := storage.FromExtendedJSON([]byte(input)); err == nil {
+				t.Errorf("%s 应返回错误", input)
+			}
+		}
+		if _, err := storage.ToExtendedJSON(storage.Document{"ch": make(chan int)}); err == nil {
+			t.Error("不支持的类型应返回错误")
+		}
+	})
+}
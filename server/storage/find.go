@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// FindOptions 查询的排序、投影、skip、limit 和索引提示
+type FindOptions struct {
+	Sort       Document // 排序规则，形如 {a: 1, b: -1}，字段取值可以是 {$meta: "textScore"}
+	Projection Document // 投影，支持位置投影、$slice、$elemMatch 和 {$meta: "textScore"}
+	Skip       int64
+	Limit      int64 // 0 表示不限制
+	Hint       *Hint // 强制使用的索引，nil 时由查询计划器选择
+}
+
+// FindDocuments 执行查询并返回全部结果，依次应用排序、skip、limit 和投影
+// 排序和相关度得分需要先取得全部结果；skip、limit 和投影由 NewFindResultCursor 应用，
+// 与 find 命令按需读取结果时相同。skip 或 limit 为负数时返回 ErrBadValue
+func FindDocuments(ctx context.Context, engine Engine, database, collection string, filter Document, opts FindOptions) ([]Document, error) {
+	if opts.Skip < 0 {
+		return nil, fmt.Errorf("%w: skip 不能为负数: %d", ErrBadValue, opts.Skip)
+	}
+	if opts.Limit < 0 {
+		return nil, fmt.Errorf("%w: limit 不能为负数: %d", ErrBadValue, opts.Limit)
+	}
+
+	docs, err := engine.FindWithHint(ctx, database, collection, filter, opts.Hint)
+	if err != nil {
+		return nil, err
+	}
+	opts, scoreFields, hiddenFields, err := textScoreOptions(ctx, engine, database, collection, filter, opts, docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Sort) > 0 {
+		if err := SortDocuments(docs, opts.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	cursor := &findResultCursor{
+		cursor:   &documentSliceCursor{docs: docs},
+		filter:   filter,
+		opts:     opts,
+		restored: scoreFields,
+		hidden:   hiddenFields,
+	}
+	results := make([]Document, 0, len(docs))
+	for {
+		doc, err := cursor.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			return results, nil
+		}
+		results = append(results, doc)
+	}
+}
+
+// NewFindResultCursor 在按结果顺序返回文档的 cursor 上依次应用 opts 的 skip、limit 和投影，不处理排序和索引提示
+// find 命令按需读取结果和 FindDocuments 共用这一实现；位置投影需要查询条件 filter
+func NewFindResultCursor(cursor DocumentCursor, filter Document, opts FindOptions) DocumentCursor {
+	return &findResultCursor{cursor: cursor, filter: filter, opts: opts}
+}
+
+// findResultCursor 见 NewFindResultCursor
+type findResultCursor struct {
+	cursor   DocumentCursor
+	filter   Document
+	opts     FindOptions
+	restored []string // 投影后从原文档补回的字段，见 textScoreOptions
+	hidden   []string // 投影后删除的字段
+	skipped  bool     // 是否已跳过 skip 个文档
+	returned int64
+}
+
+func (c *findResultCursor) Next(ctx context.Context) (Document, error) {
+	if !c.skipped {
+		c.skipped = true
+		for i := int64(0); i < c.opts.Skip; i++ {
+			doc, err := c.cursor.Next(ctx)
+			if err != nil || doc == nil {
+				return nil, err
+			}
+		}
+	}
+	if c.opts.Limit > 0 && c.returned >= c.opts.Limit {
+		return nil, nil
+	}
+	doc, err := c.cursor.Next(ctx)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	c.returned++
+
+	result := doc
+	if len(c.opts.Projection) > 0 {
+		if result, err = ApplyQueryProjection(doc, c.opts.Projection, c.filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range c.restored {
+		result[field] = doc[field]
+	}
+	for _, field := range c.hidden {
+		delete(result, field)
+	}
+	return result, nil
+}
+
+func (c *findResultCursor) Close() error {
+	return c.cursor.Close()
+}
+
+// documentSliceCursor 逐个返回已经取得的文档
+type documentSliceCursor struct {
+	docs []Document
+}
+
+func (c *documentSliceCursor) Next(ctx context.Context) (Document, error) {
+	if len(c.docs) == 0 {
+		return nil, nil
+	}
+	doc := c.docs[0]
+	c.docs = c.docs[1:]
+	return doc, nil
+}
+
+func (c *documentSliceCursor) Close() error {
+	c.docs = nil
+	return nil
+}
+
+// TextScoreFields 返回投影或排序中取值为 {$meta: "textScore"} 的字段
+func TextScoreFields(spec Document) []string {
+	var fields []string
+	for field, v := range spec {
+		if meta, ok := v.(Document); ok && len(meta) == 1 && meta["$meta"] == "textScore" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// textScoreOptions 处理排序和投影中的 {$meta: "textScore"}
+// 为每个文档计算相关度得分并写入对应字段，返回改写后的选项：排序改为按得分降序，投影去掉 $meta 字段
+// projected 为需要在投影后补回的得分字段，hidden 为只用于排序、投影后需要删除的字段
+func textScoreOptions(ctx context.Context, engine Engine, database, collection string, filter Document, opts FindOptions, docs []Document) (rewritten FindOptions, projected, hidden []string, err error) {
+	projected = TextScoreFields(opts.Projection)
+	sorted := TextScoreFields(opts.Sort)
+	if len(projected) == 0 && len(sorted) == 0 {
+		return opts, nil, nil, nil
+	}
+	terms, ok, err := TextSearchTerms(filter)
+	if err != nil {
+		return opts, nil, nil, err
+	}
+	if !ok {
+		return opts, nil, nil, fmt.Errorf("%w: query requires text score metadata, but it is not available", ErrBadValue)
+	}
+	indexes, err := engine.ListIndexes(ctx, database, collection)
+	if err != nil {
+		return opts, nil, nil, err
+	}
+	var textIndex Index
+	for _, index := range indexes {
+		if index.IsText() {
+			textIndex = index
+		}
+	}
+
+	fields := append(append([]string(nil), projected...), sorted...)
+	for _, doc := range docs {
+		score := TextScore(textIndex, doc, terms)
+		for _, field := range fields {
+			doc[field] = score
+		}
+	}
+
+	rewritten = opts
+	if len(sorted) > 0 {
+		rewritten.Sort = make(Document, len(opts.Sort))
+		for field, v := range opts.Sort {
+			rewritten.Sort[field] = v
+		}
+		for _, field := range sorted {
+			rewritten.Sort[field] = int32(-1)
+		}
+	}
+	if len(projected) > 0 {
+		rewritten.Projection = make(Document, len(opts.Projection))
+		for field, v := range opts.Projection {
+			rewritten.Projection[field] = v
+		}
+		for _, field := range projected {
+			delete(rewritten.Projection, field)
+		}
+	}
+	for _, field := range sorted {
+		if _, ok := opts.Projection[field]; !ok {
+			hidden = append(hidden, field)
+		}
+	}
+	return rewritten, projected, hidden, nil
+}
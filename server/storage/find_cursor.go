@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+)
+
+// DocumentCursor 按需读取查询结果的游标
+// 全表扫描和单索引扫描在 Next 时才读取下一条记录，内存占用与结果集大小无关；
+// 游标存续期间提交的写入对尚未读取的部分可见
+type DocumentCursor interface {
+	// Next 返回下一个满足过滤条件的文档，没有更多结果时返回 nil
+	// 扫描的索引条目数和文档数累加到 ctx 携带的执行统计
+	Next(ctx context.Context) (Document, error)
+	Close() error
+}
+
+// FindCursor 返回按需读取查询结果的游标，hint 为 nil 时由查询计划器选择索引
+// $or、$text 和 $near 查询需要合并或排序全部结果，仍在创建游标时执行完整个计划
+// projection 为调用方将对结果应用的投影；查询被索引覆盖时返回的文档只包含索引字段，不读取文档
+func (e *WiredTigerEngine) FindCursor(ctx context.Context, database, collection string, filter, projection Document, hint *Hint) (DocumentCursor, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return &documentCursor{scanner: &matchedScanner{}}, nil
+	}
+
+	var plan *QueryPlan
+	var err error
+	if hint != nil {
+		plan, err = hintedPlan(coll, filter, hint)
+	} else {
+		plan, err = planQuery(coll, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	coverPlan(coll, plan, projection)
+
+	switch plan = e.isolatedPlan(ctx, coll, plan); plan.Stage {
+	case StageCollScan:
+		scanner, err := e.newCollectionScanner(ctx, coll, filter)
+		if err != nil {
+			return nil, err
+		}
+		return &documentCursor{scanner: scanner}, nil
+	case StageIxScan:
+		scanner := e.newIndexScanner(coll, plan, filter)
+		if !plan.IsMultiKey {
+			// 非多键索引中每个文档只有一个条目，不需要记录已返回的 RecordId
+			scanner.seen = nil
+		}
+		return &documentCursor{scanner: scanner}, nil
+	}
+	matches, err := e.runPlan(ctx, coll, plan, filter, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &documentCursor{scanner: &matchedScanner{matches: matches}}, nil
+}
+
+// documentCursor 把记录扫描器包装为 DocumentCursor
+type documentCursor struct {
+	scanner recordScanner
+	closed  bool
+}
+
+func (c *documentCursor) Next(ctx context.Context) (Document, error) {
+	if c.closed {
+		return nil, nil
+	}
+	stats, _ := ctx.Value(executionStatsKey{}).(*ExecutionStats)
+	if stats == nil {
+		stats = &ExecutionStats{}
+	}
+	m, ok, err := c.scanner.next(ctx, stats)
+	if err != nil || !ok {
+		c.Close()
+		return nil, err
+	}
+	return m.doc, nil
+}
+
+func (c *documentCursor) Close() error {
+	if !c.closed {
+		c.closed = true
+		c.scanner.close()
+	}
+	return nil
+}
+
+// matchedScanner 逐条返回已经执行完的计划结果
+type matchedScanner struct {
+	matches []matchedRecord
+}
+
+func (s *matchedScanner) next(ctx context.Context, stats *ExecutionStats) (matchedRecord, bool, error) {
+	if len(s.matches) == 0 {
+		return matchedRecord{}, false, nil
+	}
+	m := s.matches[0]
+	s.matches = s.matches[1:]
+	return m, true, nil
+}
+
+func (s *matchedScanner) close() {
+	s.matches = nil
+}
@@ -0,0 +1,506 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// 地理索引按 geohash 编码坐标：两个坐标轴各自量化后交错组成 52 位整数，作为数值索引键存入 B+Tree
+// 相邻的点大多落在相同前缀的单元内，矩形范围可以用少量 geohash 区间覆盖
+const (
+	geoMin            = -180.0    // 坐标范围下界，与 mongod 2d 索引默认的 min 一致
+	geoMax            = 180.0     // 坐标范围上界
+	geoBits           = 26        // 每个坐标轴的量化位数
+	maxGeoCells       = 64        // 覆盖查询范围的 geohash 单元数上限，超过时使用更粗的单元
+	earthRadiusMeters = 6378100.0 // 与 mongod 一致的地球半径
+)
+
+// 地理查询计划阶段
+const (
+	StageGeoNear2D       = "GEO_NEAR_2D"       // 2d 索引上按距离排序
+	StageGeoNear2DSphere = "GEO_NEAR_2DSPHERE" // 2dsphere 索引上按距离排序
+)
+
+// IsGeo 索引是否为 2d 或 2dsphere 地理索引
+func (idx Index) IsGeo() bool {
+	t := idx.Type()
+	return t == IndexType2D || t == IndexType2DSphere
+}
+
+// geoPoint 平面坐标或经纬度，x 为经度，y 为纬度
+type geoPoint struct {
+	x, y float64
+}
+
+// parseGeoPoint 解析 [x, y] 形式的坐标对或 {type: "Point", coordinates: [x, y]} 形式的 GeoJSON 点
+func parseGeoPoint(v interface{}) (geoPoint, bool) {
+	if doc := toDocument(v); doc != nil {
+		if doc["type"] != "Point" {
+			return geoPoint{}, false
+		}
+		return parseGeoPoint(doc["coordinates"])
+	}
+	arr := toArray(v)
+	if len(arr) < 2 || !isNumber(arr[0]) || !isNumber(arr[1]) {
+		return geoPoint{}, false
+	}
+	return geoPoint{x: toFloat64(arr[0]), y: toFloat64(arr[1])}, true
+}
+
+// firstGeoPoint 返回字段取值中第一个合法的坐标
+func firstGeoPoint(values []interface{}) (geoPoint, bool) {
+	for _, v := range values {
+		if p, ok := parseGeoPoint(v); ok {
+			return p, true
+		}
+	}
+	return geoPoint{}, false
+}
+
+// geoCell 将坐标量化为单元编号，超出范围的坐标归入边界单元
+func geoCell(v float64) uint64 {
+	n := math.Floor((v - geoMin) / (geoMax - geoMin) * (1 << geoBits))
+	switch {
+	case n < 0:
+		return 0
+	case n >= 1<<geoBits:
+		return 1<<geoBits - 1
+	}
+	return uint64(n)
+}
+
+// interleaveBits 交错两个坐标轴编号的低 bits 位，x 在高位
+func interleaveBits(cx, cy uint64, bits int) uint64 {
+	var hash uint64
+	for i := bits - 1; i >= 0; i-- {
+		hash = hash<<2 | (cx>>uint(i)&1)<<1 | cy>>uint(i)&1
+	}
+	return hash
+}
+
+// geoHashKey 返回坐标的索引键
+func geoHashKey(p geoPoint) []byte {
+	return encodeKeyValue(int64(interleaveBits(geoCell(p.x), geoCell(p.y), geoBits)))
+}
+
+// geoIndexEntries 计算文档在地理索引中的条目，字段不是合法坐标的文档不建索引
+func geoIndexEntries(index Index, doc Document) []indexEntry {
+	values := lookupPath(doc, strings.Split(index.Keys[0].Field, "."))
+	p, ok := firstGeoPoint(values)
+	if !ok {
+		return nil
+	}
+	return []indexEntry{{key: geoHashKey(p), values: []interface{}{[]interface{}{p.x, p.y}}}}
+}
+
+// geoBox 坐标矩形范围
+type geoBox struct {
+	minX, minY, maxX, maxY float64
+}
+
+// fullGeoBox 覆盖全部坐标的范围
+var fullGeoBox = geoBox{minX: geoMin, minY: geoMin, maxX: geoMax, maxY: geoMax}
+
+// geoIntervals 计算覆盖矩形范围的 geohash 区间
+// 从最细的单元开始逐级放大，直到单元数不超过 maxGeoCells，相邻的区间合并
+func geoIntervals(box geoBox) []keyInterval {
+	x0, x1 := geoCell(box.minX), geoCell(box.maxX)
+	y0, y1 := geoCell(box.minY), geoCell(box.maxY)
+	level := geoBits
+	for ; level > 0; level-- {
+		shift := uint(geoBits - level)
+		if (x1>>shift-x0>>shift+1)*(y1>>shift-y0>>shift+1) <= maxGeoCells {
+			break
+		}
+	}
+	shift := uint(geoBits - level)
+
+	var ranges [][2]uint64
+	for cx := x0 >> shift; cx <= x1>>shift; cx++ {
+		for cy := y0 >> shift; cy <= y1>>shift; cy++ {
+			prefix := interleaveBits(cx, cy, level)
+			ranges = append(ranges, [2]uint64{prefix << (2 * shift), (prefix + 1) << (2 * shift)})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1][1] == r[0] {
+			merged[n-1][1] = r[1]
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	intervals := make([]keyInterval, len(merged))
+	for i, r := range merged {
+		intervals[i] = keyInterval{start: encodeKeyValue(int64(r[0])), end: encodeKeyValue(int64(r[1]))}
+	}
+	return intervals
+}
+
+// planarDistance 平面上两点的欧氏距离
+func planarDistance(a, b geoPoint) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+// sphereDistance 球面上两个经纬度之间的夹角（弧度）
+func sphereDistance(a, b geoPoint) float64 {
+	lat1, lat2 := a.y*math.Pi/180, b.y*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.x - a.x) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// sphereBox 返回球面上以 center 为圆心、radians 为半径的圆的外接经纬度矩形
+// 跨越极点或日期变更线时经度取全部范围
+func sphereBox(center geoPoint, radians float64) geoBox {
+	d := radians * 180 / math.Pi
+	box := geoBox{minX: geoMin, maxX: geoMax, minY: center.y - d, maxY: center.y + d}
+	maxLat := math.Max(math.Abs(box.minY), math.Abs(box.maxY))
+	if maxLat >= 90 {
+		return box
+	}
+	dLng := d / math.Cos(maxLat*math.Pi/180)
+	if center.x-dLng >= -180 && center.x+dLng <= 180 {
+		box.minX, box.maxX = center.x-dLng, center.x+dLng
+	}
+	return box
+}
+
+// nearQuery 解析后的 $near/$nearSphere 条件
+type nearQuery struct {
+	center      geoPoint
+	spherical   bool    // 按球面距离计算
+	meters      bool    // 距离单位为米，否则平面距离为坐标单位、球面距离为弧度
+	maxDistance float64 // 小于 0 表示不限制
+	minDistance float64
+}
+
+// isNearQuery 操作符文档是否为 $near/$nearSphere 条件
+func isNearQuery(ops Document) bool {
+	_, near := ops["$near"]
+	_, nearSphere := ops["$nearSphere"]
+	return near || nearSphere
+}
+
+// parseNearQuery 解析 {$near: [x, y], $maxDistance: d} 或 {$near: {$geometry: 点, $maxDistance: 米}}，$nearSphere 同理
+func parseNearQuery(ops Document) (*nearQuery, error) {
+	q := &nearQuery{maxDistance: -1}
+	op := "$near"
+	arg, ok := ops[op]
+	if !ok {
+		op, arg, q.spherical = "$nearSphere", ops["$nearSphere"], true
+	}
+	distances := ops
+	if spec := toDocument(arg); spec != nil && spec["$geometry"] != nil {
+		p, ok := parseGeoPoint(spec["$geometry"])
+		if !ok {
+			return nil, fmt.Errorf("%s 的 $geometry 必须是 GeoJSON 点", op)
+		}
+		q.center, q.spherical, q.meters = p, true, true
+		distances = spec
+	} else if p, ok := parseGeoPoint(arg); ok {
+		q.center = p
+	} else {
+		return nil, fmt.Errorf("%s 需要坐标点参数", op)
+	}
+
+	for key, v := range distances {
+		switch key {
+		case "$maxDistance", "$minDistance":
+			if !isNumber(v) || toFloat64(v) < 0 {
+				return nil, fmt.Errorf("%s 必须是非负数", key)
+			}
+			if key == "$maxDistance" {
+				q.maxDistance = toFloat64(v)
+			} else {
+				q.minDistance = toFloat64(v)
+			}
+		}
+	}
+	for key := range ops {
+		switch key {
+		case "$near", "$nearSphere", "$maxDistance", "$minDistance":
+		default:
+			return nil, fmt.Errorf("%s 不能与 %s 组合使用", op, key)
+		}
+	}
+	return q, nil
+}
+
+// distance 返回点到查询中心的距离，单位与 $maxDistance 一致
+func (q *nearQuery) distance(p geoPoint) float64 {
+	if !q.spherical {
+		return planarDistance(q.center, p)
+	}
+	d := sphereDistance(q.center, p)
+	if q.meters {
+		d *= earthRadiusMeters
+	}
+	return d
+}
+
+// matches 点是否在 $minDistance 和 $maxDistance 之间
+func (q *nearQuery) matches(p geoPoint) bool {
+	d := q.distance(p)
+	return d >= q.minDistance && (q.maxDistance < 0 || d <= q.maxDistance)
+}
+
+// bounds 返回查询范围的外接矩形
+func (q *nearQuery) bounds() geoBox {
+	if q.maxDistance < 0 {
+		return fullGeoBox
+	}
+	if !q.spherical {
+		d := q.maxDistance
+		return geoBox{minX: q.center.x - d, minY: q.center.y - d, maxX: q.center.x + d, maxY: q.center.y + d}
+	}
+	radians := q.maxDistance
+	if q.meters {
+		radians /= earthRadiusMeters
+	}
+	return sphereBox(q.center, radians)
+}
+
+// matchNear 匹配 $near/$nearSphere 条件：字段的坐标在距离范围内
+func matchNear(values []interface{}, ops Document) (bool, error) {
+	q, err := parseNearQuery(ops)
+	if err != nil {
+		return false, err
+	}
+	p, ok := firstGeoPoint(values)
+	return ok && q.matches(p), nil
+}
+
+// geoShape $geoWithin 的查询范围
+type geoShape interface {
+	contains(p geoPoint) bool
+	bounds() geoBox
+}
+
+// parseGeoShape 解析 $geoWithin 的参数
+// 支持 $box、$center、$centerSphere、$polygon 和 GeoJSON 多边形，GeoJSON 多边形的边按平面直线处理
+func parseGeoShape(operand interface{}) (geoShape, error) {
+	spec := toDocument(operand)
+	if len(spec) != 1 {
+		return nil, fmt.Errorf("$geoWithin 需要且只能包含一个形状")
+	}
+	for op, arg := range spec {
+		switch op {
+		case "$box":
+			points, err := geoPoints(arg, op)
+			if err != nil || len(points) != 2 {
+				return nil, fmt.Errorf("$box 需要两个坐标点")
+			}
+			return geoBox{
+				minX: math.Min(points[0].x, points[1].x), minY: math.Min(points[0].y, points[1].y),
+				maxX: math.Max(points[0].x, points[1].x), maxY: math.Max(points[0].y, points[1].y),
+			}, nil
+		case "$center", "$centerSphere":
+			arr := toArray(arg)
+			if len(arr) != 2 || !isNumber(arr[1]) {
+				return nil, fmt.Errorf("%s 需要 [坐标点, 半径] 参数", op)
+			}
+			center, ok := parseGeoPoint(arr[0])
+			if !ok {
+				return nil, fmt.Errorf("%s 的圆心必须是坐标点", op)
+			}
+			return geoCircle{center: center, radius: toFloat64(arr[1]), spherical: op == "$centerSphere"}, nil
+		case "$polygon":
+			points, err := geoPoints(arg, op)
+			if err != nil || len(points) < 3 {
+				return nil, fmt.Errorf("$polygon 至少需要三个坐标点")
+			}
+			return geoPolygon(points), nil
+		case "$geometry":
+			geometry := toDocument(arg)
+			if geometry == nil || geometry["type"] != "Polygon" {
+				return nil, fmt.Errorf("$geoWithin 的 $geometry 只支持 Polygon")
+			}
+			rings := toArray(geometry["coordinates"])
+			if len(rings) == 0 {
+				return nil, fmt.Errorf("Polygon 缺少坐标")
+			}
+			points, err := geoPoints(rings[0], op)
+			if err != nil || len(points) < 4 {
+				return nil, fmt.Errorf("Polygon 的外环至少需要四个坐标点")
+			}
+			return geoPolygon(points), nil
+		default:
+			return nil, fmt.Errorf("$geoWithin 不支持的形状: %s", op)
+		}
+	}
+	return nil, nil
+}
+
+// geoPoints 解析坐标点数组
+func geoPoints(v interface{}, op string) ([]geoPoint, error) {
+	arr := toArray(v)
+	points := make([]geoPoint, 0, len(arr))
+	for _, elem := range arr {
+		p, ok := parseGeoPoint(elem)
+		if !ok {
+			return nil, fmt.Errorf("%s 的坐标点不合法: %v", op, elem)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func (b geoBox) contains(p geoPoint) bool {
+	return p.x >= b.minX && p.x <= b.maxX && p.y >= b.minY && p.y <= b.maxY
+}
+
+func (b geoBox) bounds() geoBox {
+	return b
+}
+
+// geoCircle $center 平面圆或 $centerSphere 球面圆（半径为弧度）
+type geoCircle struct {
+	center    geoPoint
+	radius    float64
+	spherical bool
+}
+
+func (c geoCircle) contains(p geoPoint) bool {
+	if c.spherical {
+		return sphereDistance(c.center, p) <= c.radius
+	}
+	return planarDistance(c.center, p) <= c.radius
+}
+
+func (c geoCircle) bounds() geoBox {
+	if c.spherical {
+		return sphereBox(c.center, c.radius)
+	}
+	return geoBox{minX: c.center.x - c.radius, minY: c.center.y - c.radius, maxX: c.center.x + c.radius, maxY: c.center.y + c.radius}
+}
+
+// geoPolygon 平面多边形，边界上的点视为在多边形内
+type geoPolygon []geoPoint
+
+func (poly geoPolygon) contains(p geoPoint) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		// 点在边上
+		cross := (b.x-a.x)*(p.y-a.y) - (b.y-a.y)*(p.x-a.x)
+		if cross == 0 && p.x >= math.Min(a.x, b.x) && p.x <= math.Max(a.x, b.x) &&
+			p.y >= math.Min(a.y, b.y) && p.y <= math.Max(a.y, b.y) {
+			return true
+		}
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (poly geoPolygon) bounds() geoBox {
+	box := geoBox{minX: math.Inf(1), minY: math.Inf(1), maxX: math.Inf(-1), maxY: math.Inf(-1)}
+	for _, p := range poly {
+		box.minX, box.maxX = math.Min(box.minX, p.x), math.Max(box.maxX, p.x)
+		box.minY, box.maxY = math.Min(box.minY, p.y), math.Max(box.maxY, p.y)
+	}
+	return box
+}
+
+// matchGeoWithin 匹配 $geoWithin 条件：字段的坐标在形状内
+func matchGeoWithin(values []interface{}, operand interface{}) (bool, error) {
+	shape, err := parseGeoShape(operand)
+	if err != nil {
+		return false, err
+	}
+	p, ok := firstGeoPoint(values)
+	return ok && shape.contains(p), nil
+}
+
+// geoIndexOn 返回字段上的地理索引
+func geoIndexOn(coll *Collection, field string) (Index, bool) {
+	for _, spec := range coll.IndexSpecs {
+		if spec.IsGeo() && !spec.Hidden && spec.Keys[0].Field == field && coll.index(spec.Name) != nil {
+			return spec, true
+		}
+	}
+	return Index{}, false
+}
+
+// geoPlan 为包含 $near/$nearSphere 或 $geoWithin 的查询构造地理索引计划
+// $near 必须使用地理索引，结果按距离排序；$geoWithin 没有地理索引时交给普通的计划选择
+// 第二个返回值表示是否生成了地理计划
+func geoPlan(coll *Collection, filter Document) (*QueryPlan, bool, error) {
+	for _, field := range sortedKeys(filter) {
+		ops := toDocument(filter[field])
+		if ops == nil || !hasOperatorKeys(ops) {
+			continue
+		}
+		if isNearQuery(ops) {
+			near, err := parseNearQuery(ops)
+			if err != nil {
+				return nil, true, fmt.Errorf("%w: %v", ErrBadValue, err)
+			}
+			spec, ok := geoIndexOn(coll, field)
+			if !ok {
+				return nil, true, fmt.Errorf("%w: 字段 %s 上没有 $near 查询需要的 2d 或 2dsphere 索引", ErrIndexNotFound, field)
+			}
+			stage := StageGeoNear2D
+			if spec.Type() == IndexType2DSphere {
+				stage = StageGeoNear2DSphere
+			}
+			return &QueryPlan{
+				Stage:      stage,
+				IndexName:  spec.Name,
+				KeyPattern: spec.KeyPattern(),
+				Filter:     filter,
+				intervals:  geoIntervals(near.bounds()),
+				near:       near,
+				nearField:  field,
+			}, true, nil
+		}
+		if within, ok := ops["$geoWithin"]; ok {
+			spec, ok := geoIndexOn(coll, field)
+			if !ok {
+				continue
+			}
+			shape, err := parseGeoShape(within)
+			if err != nil {
+				return nil, true, fmt.Errorf("%w: %v", ErrBadValue, err)
+			}
+			return &QueryPlan{
+				Stage:      StageIxScan,
+				IndexName:  spec.Name,
+				KeyPattern: spec.KeyPattern(),
+				Filter:     filter,
+				intervals:  geoIntervals(shape.bounds()),
+			}, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// sortByDistance 按到 $near 中心的距离对匹配的记录排序
+func sortByDistance(matches []matchedRecord, plan *QueryPlan) {
+	distances := make([]float64, len(matches))
+	for i, m := range matches {
+		p, _ := firstGeoPoint(lookupPath(m.doc, strings.Split(plan.nearField, ".")))
+		distances[i] = plan.near.distance(p)
+	}
+	sort.Stable(byDistance{matches: matches, distances: distances})
+}
+
+// byDistance 按距离排序匹配的记录
+type byDistance struct {
+	matches   []matchedRecord
+	distances []float64
+}
+
+func (b byDistance) Len() int           { return len(b.matches) }
+func (b byDistance) Less(i, j int) bool { return b.distances[i] < b.distances[j] }
+func (b byDistance) Swap(i, j int) {
+	b.matches[i], b.matches[j] = b.matches[j], b.matches[i]
+	b.distances[i], b.distances[j] = b.distances[j], b.distances[i]
+}
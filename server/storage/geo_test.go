@@ -0,0 +1,161 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestGeoIndex 测试 2d/2dsphere 索引上的 $near 和 $geoWithin 查询
+func TestGeoIndex(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	places := []storage.Document{
+		{"_id": int32(1), "loc": []interface{}{1.0, 1.0}},
+		{"_id": int32(2), "loc": []interface{}{int32(3), int32(4)}},
+		{"_id": int32(3), "loc": []interface{}{-2.0, 0.5}},
+		{"_id": int32(4), "loc": []interface{}{10.0, 10.0}},
+		{"_id": int32(5), "loc": []interface{}{0.1, -0.2}},
+		{"_id": int32(6), "loc": "not a point"},
+		{"_id": int32(7)},
+	}
+	if err := engine.Insert(ctx, "test", "places", places); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	ids := func(docs []storage.Document) []int32 {
+		out := make([]int32, len(docs))
+		for i, doc := range docs {
+			out[i] = doc["_id"].(int32)
+		}
+		return out
+	}
+	equal := func(a []int32, b ...int32) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	near := storage.Document{"loc": storage.Document{"$near": []interface{}{0.0, 0.0}, "$maxDistance": 5.0}}
+
+	t.Run("没有地理索引时 $near 查询失败", func(t *testing.T) {
+		if _, err := engine.Find(ctx, "test", "places", near); !errors.Is(err, storage.ErrIndexNotFound) {
+			t.Errorf("应返回 ErrIndexNotFound: %v", err)
+		}
+	})
+
+	box := storage.Document{"loc": storage.Document{"$geoWithin": storage.Document{
+		"$box": []interface{}{[]interface{}{0.0, 0.0}, []interface{}{5.0, 5.0}},
+	}}}
+	t.Run("没有地理索引时 $geoWithin 全表扫描", func(t *testing.T) {
+		found, err := engine.Find(ctx, "test", "places", box)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		got := ids(found)
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !equal(got, 1, 2) {
+			t.Errorf("got %v, want [1 2]", got)
+		}
+	})
+
+	if err := engine.CreateIndex(ctx, "test", "places", storage.Index{
+		Name: "loc_2d", Keys: []storage.IndexKey{{Field: "loc", Direction: 1, Type: storage.IndexType2D}},
+	}); err != nil {
+		t.Fatalf("创建 2d 索引失败: %v", err)
+	}
+
+	t.Run("$near 按距离返回最大距离内的文档", func(t *testing.T) {
+		found, err := engine.Find(ctx, "test", "places", near)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		// 距离: 5 -> 0.22, 1 -> 1.41, 3 -> 2.06, 2 -> 5, 4 -> 14.1
+		if got := ids(found); !equal(got, 5, 1, 3, 2) {
+			t.Errorf("got %v, want [5 1 3 2]", got)
+		}
+		e, err := engine.Explain(ctx, "test", "places", near, nil, nil, true)
+		if err != nil {
+			t.Fatalf("explain 失败: %v", err)
+		}
+		if e.Plan.Stage != storage.StageGeoNear2D || e.Stats.DocsExamined >= 5 {
+			t.Errorf("应使用 2d 索引并只读取范围内的文档: %+v %+v", e.Plan, e.Stats)
+		}
+
+		unbounded := storage.Document{"loc": storage.Document{"$near": []interface{}{9.0, 9.0}}}
+		found, err = engine.Find(ctx, "test", "places", unbounded)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if got := ids(found); !equal(got, 4, 2, 1, 5, 3) {
+			t.Errorf("不限距离时应返回所有带坐标的文档: got %v", got)
+		}
+	})
+
+	t.Run("$geoWithin 使用索引", func(t *testing.T) {
+		e, err := engine.Explain(ctx, "test", "places", box, nil, nil, true)
+		if err != nil {
+			t.Fatalf("explain 失败: %v", err)
+		}
+		if e.Plan.Stage != storage.StageIxScan || e.Plan.IndexName != "loc_2d" || e.Stats.NReturned != 2 {
+			t.Errorf("应使用 2d 索引返回 2 个文档: %+v %+v", e.Plan, e.Stats)
+		}
+		center := storage.Document{"loc": storage.Document{"$geoWithin": storage.Document{
+			"$center": []interface{}{[]interface{}{0.0, 0.0}, 2.0},
+		}}}
+		found, err := engine.Find(ctx, "test", "places", center)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		got := ids(found)
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !equal(got, 1, 5) {
+			t.Errorf("$center: got %v, want [1 5]", got)
+		}
+	})
+
+	t.Run("2dsphere 按米计算距离", func(t *testing.T) {
+		cities := []storage.Document{
+			{"_id": "beijing", "loc": storage.Document{"type": "Point", "coordinates": []interface{}{116.40, 39.90}}},
+			{"_id": "tianjin", "loc": storage.Document{"type": "Point", "coordinates": []interface{}{117.20, 39.13}}},
+			{"_id": "shanghai", "loc": storage.Document{"type": "Point", "coordinates": []interface{}{121.47, 31.23}}},
+			{"_id": "langfang", "loc": storage.Document{"type": "Point", "coordinates": []interface{}{116.68, 39.52}}},
+		}
+		if err := engine.Insert(ctx, "test", "cities", cities); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		if err := engine.CreateIndex(ctx, "test", "cities", storage.Index{
+			Name: "loc_2dsphere", Keys: []storage.IndexKey{{Field: "loc", Direction: 1, Type: storage.IndexType2DSphere}},
+		}); err != nil {
+			t.Fatalf("创建 2dsphere 索引失败: %v", err)
+		}
+		filter := storage.Document{"loc": storage.Document{"$near": storage.Document{
+			"$geometry":    storage.Document{"type": "Point", "coordinates": []interface{}{116.40, 39.90}},
+			"$maxDistance": int32(200000),
+		}}}
+		found, err := engine.Find(ctx, "test", "cities", filter)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		// 北京到廊坊约 50km，到天津约 110km，到上海超过 1000km
+		var got []string
+		for _, doc := range found {
+			got = append(got, doc["_id"].(string))
+		}
+		if len(got) != 3 || got[0] != "beijing" || got[1] != "langfang" || got[2] != "tianjin" {
+			t.Errorf("got %v, want [beijing langfang tianjin]", got)
+		}
+	})
+}
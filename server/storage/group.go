@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 分组的聚合方式
+const (
+	AccumulatorCount = "count" // 每组的取值个数
+	AccumulatorSum   = "sum"   // 每组数值取值的和，非数值取值被忽略
+	AccumulatorPush  = "push"  // 每组的取值按输入顺序组成数组
+)
+
+// LookupField 按点号分隔的字段路径取值，与聚合表达式中的 "$a.b" 含义相同
+// 路径经过数组时返回数组中各个文档元素在剩余路径上的取值组成的数组；字段不存在时 ok 为 false
+func LookupField(doc Document, path string) (value interface{}, ok bool) {
+	return lookupField(doc, strings.Split(path, "."))
+}
+
+func lookupField(value interface{}, parts []string) (interface{}, bool) {
+	if len(parts) == 0 {
+		return value, true
+	}
+	if doc := toDocument(value); doc != nil {
+		child, ok := doc[parts[0]]
+		if !ok {
+			return nil, false
+		}
+		return lookupField(child, parts[1:])
+	}
+	arr := toArray(value)
+	if arr == nil {
+		return nil, false
+	}
+	out := []interface{}{}
+	for _, elem := range arr {
+		if toDocument(elem) == nil {
+			continue
+		}
+		if v, ok := lookupField(elem, parts); ok {
+			out = append(out, v)
+		}
+	}
+	return out, true
+}
+
+// GroupKey 返回取值用于分组和连接的键，CompareValues 相等的取值（如 1 和 1.0）得到相同的键
+func GroupKey(v interface{}) string {
+	return string(encodeKeyValue(v))
+}
+
+// GroupEmit 一个文档参与分组的键和取值
+type GroupEmit struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// GroupValues 按键分组并聚合取值，返回按键排序的 {_id: 键, value: 聚合结果} 文档
+// 键按 CompareValues 判等，数值类型不同的相同取值（如 1 和 1.0）属于同一组，组的键取第一次出现的取值
+func GroupValues(emits []GroupEmit, accumulator string) ([]Document, error) {
+	switch accumulator {
+	case AccumulatorCount, AccumulatorSum, AccumulatorPush:
+	default:
+		return nil, fmt.Errorf("%w: 未知的聚合方式 %s", ErrBadValue, accumulator)
+	}
+	type group struct {
+		key   interface{}
+		value interface{}
+	}
+	groups := make(map[string]*group)
+	var order []*group
+	for _, emit := range emits {
+		id := GroupKey(emit.Key)
+		g, ok := groups[id]
+		if !ok {
+			g = &group{key: emit.Key}
+			switch accumulator {
+			case AccumulatorCount, AccumulatorSum:
+				g.value = int32(0)
+			case AccumulatorPush:
+				g.value = []interface{}{}
+			}
+			groups[id] = g
+			order = append(order, g)
+		}
+		switch accumulator {
+		case AccumulatorCount:
+			g.value = addNumbers(g.value, int32(1))
+		case AccumulatorSum:
+			if isNumber(emit.Value) {
+				g.value = addNumbers(g.value, emit.Value)
+			}
+		case AccumulatorPush:
+			g.value = append(g.value.([]interface{}), emit.Value)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return CompareValues(order[i].key, order[j].key) < 0
+	})
+	out := make([]Document, len(order))
+	for i, g := range order {
+		out[i] = Document{"_id": g.key, "value": g.value}
+	}
+	return out, nil
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"hash/fnv"
+)
+
+// IsHashed 索引是否为哈希索引
+func (idx Index) IsHashed() bool {
+	return idx.Type() == IndexTypeHashed
+}
+
+// hashedKeyValue 计算哈希索引中字段取值对应的索引键取值
+// 对取值的索引键编码做 64 位 FNV-1a 哈希：编码与数值类型无关（1 与 1.0 相同），哈希结果在进程和版本之间稳定，可以持久化
+// 不同取值可能得到相同的哈希，索引扫描读取文档后仍按过滤条件检查
+func hashedKeyValue(v interface{}) int64 {
+	h := fnv.New64a()
+	h.Write(encodeKeyValue(v))
+	return int64(h.Sum64())
+}
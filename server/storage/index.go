@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IndexKey 索引键模式中的一个字段
+type IndexKey struct {
+	Field     string
+	Direction int    // 1: 升序, -1: 降序
+	Type      string // 特殊索引类型 text、2d、2dsphere 或 hashed，为空时为普通的升降序字段
+}
+
+// 特殊索引类型
+const (
+	IndexTypeText     = "text"     // 文本索引，按词元建立索引
+	IndexType2D       = "2d"       // 平面坐标索引
+	IndexType2DSphere = "2dsphere" // 球面坐标索引
+	IndexTypeHashed   = "hashed"   // 哈希索引，按取值的哈希建立索引，只支持等值查询
+)
+
+// Type 返回索引的特殊类型，普通索引返回空字符串
+func (idx Index) Type() string {
+	if len(idx.Keys) == 0 {
+		return ""
+	}
+	return idx.Keys[0].Type
+}
+
+// IdIndexName _id 索引的名称
+const IdIndexName = "_id_"
+
+// 一个文档在单个索引中最多生成的索引条目数，避免多个数组字段的组合过多
+const maxIndexEntriesPerDocument = 1000
+
+// KeyPattern 返回索引的键模式文档，如 {a: 1, b: -1}
+// 文本索引与 mongod 一致返回 {_fts: "text", _ftsx: 1}
+func (idx Index) KeyPattern() Document {
+	if idx.IsText() {
+		return Document{"_fts": "text", "_ftsx": int32(1)}
+	}
+	pattern := make(Document, len(idx.Keys))
+	for _, key := range idx.Keys {
+		if key.Type != "" {
+			pattern[key.Field] = key.Type
+			continue
+		}
+		pattern[key.Field] = int32(key.Direction)
+	}
+	return pattern
+}
+
+// DefaultIndexName 按 mongod 的规则生成索引名，如 a_1_b_-1
+func DefaultIndexName(keys []IndexKey) string {
+	parts := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		if key.Type != "" {
+			parts = append(parts, key.Field, key.Type)
+			continue
+		}
+		parts = append(parts, key.Field, fmt.Sprint(key.Direction))
+	}
+	return strings.Join(parts, "_")
+}
+
+// idIndex 返回集合默认的 _id 索引定义
+func idIndex() Index {
+	return Index{Name: IdIndexName, Keys: []IndexKey{{Field: "_id", Direction: 1}}, Unique: true}
+}
+
+// validateIndex 检查索引定义是否合法
+func validateIndex(index Index) error {
+	if index.Name == "" {
+		return fmt.Errorf("%w: 索引名不能为空", ErrBadValue)
+	}
+	if len(index.Keys) == 0 {
+		return fmt.Errorf("%w: 索引 %s 的键模式不能为空", ErrBadValue, index.Name)
+	}
+	seen := make(map[string]bool, len(index.Keys))
+	for _, key := range index.Keys {
+		if key.Field == "" {
+			return fmt.Errorf("%w: 索引 %s 的字段名不能为空", ErrBadValue, index.Name)
+		}
+		if key.Direction != 1 && key.Direction != -1 {
+			return fmt.Errorf("%w: 索引 %s 字段 %s 的方向必须为 1 或 -1", ErrBadValue, index.Name, key.Field)
+		}
+		if seen[key.Field] {
+			return fmt.Errorf("%w: 索引 %s 的字段 %s 重复", ErrBadValue, index.Name, key.Field)
+		}
+		seen[key.Field] = true
+		if key.Type != index.Type() {
+			return fmt.Errorf("%w: 索引 %s 暂不支持不同类型的字段组合", ErrBadValue, index.Name)
+		}
+	}
+	switch index.Type() {
+	case "", IndexTypeText:
+	case IndexType2D, IndexType2DSphere:
+		if len(index.Keys) != 1 {
+			return fmt.Errorf("%w: 地理索引 %s 只能包含一个字段", ErrBadValue, index.Name)
+		}
+	case IndexTypeHashed:
+		if len(index.Keys) != 1 {
+			return fmt.Errorf("%w: 哈希索引 %s 只能包含一个字段", ErrBadValue, index.Name)
+		}
+		if index.Unique {
+			return fmt.Errorf("%w: 哈希索引 %s 不支持 unique", ErrBadValue, index.Name)
+		}
+	default:
+		return fmt.Errorf("%w: 未知的索引类型 %s", ErrBadValue, index.Type())
+	}
+	if index.ExpireAfterSeconds < 0 {
+		return fmt.Errorf("%w: 索引 %s 的 expireAfterSeconds 不能为负数", ErrBadValue, index.Name)
+	}
+	if index.ExpireAfterSeconds > 0 {
+		if len(index.Keys) != 1 || index.Type() != "" {
+			return fmt.Errorf("%w: TTL 索引 %s 只能包含一个普通字段", ErrBadValue, index.Name)
+		}
+		if index.Keys[0].Field == "_id" {
+			return fmt.Errorf("%w: 不能在 _id 字段上创建 TTL 索引", ErrBadValue)
+		}
+	}
+	if len(index.PartialFilterExpression) > 0 {
+		if _, err := Matches(Document{}, index.PartialFilterExpression); err != nil {
+			return fmt.Errorf("索引 %s 的 partialFilterExpression 不合法: %w", index.Name, err)
+		}
+	}
+	return nil
+}
+
+// sameIndexOptions 比较两个索引除名称和键模式以外的选项是否相同
+func sameIndexOptions(a, b Index) bool {
+	return a.Unique == b.Unique && a.Sparse == b.Sparse && a.ExpireAfterSeconds == b.ExpireAfterSeconds &&
+		string(encodeKeyValue(a.PartialFilterExpression)) == string(encodeKeyValue(b.PartialFilterExpression))
+}
+
+// indexEntry 文档在索引中的一个条目
+type indexEntry struct {
+	key      []byte        // 各字段编码后拼接的索引键
+	typeBits []byte        // 从索引键还原取值所需的类型信息，见 appendKeyTypeBits
+	values   []interface{} // 与键模式字段一一对应的取值
+}
+
+// indexEntries 计算文档在索引中的全部条目
+// 字段缺失时按 null 建索引；字段值为数组时按元素展开（多键索引），多个数组字段取组合
+// 返回的第二个值表示文档是否产生了多键条目
+// 降序字段同样按升序编码，方向只影响排序输出，不影响等值和范围查找；哈希索引字段按 hashedKeyValue 编码
+// 部分索引只为满足 partialFilterExpression 的文档生成条目，稀疏索引跳过索引字段全部缺失的文档
+func indexEntries(index Index, doc Document) ([]indexEntry, bool) {
+	if len(index.PartialFilterExpression) > 0 {
+		if ok, err := Matches(doc, index.PartialFilterExpression); err != nil || !ok {
+			return nil, false
+		}
+	}
+	if index.IsText() {
+		return textIndexEntries(index, doc), false
+	}
+	if index.IsGeo() {
+		return geoIndexEntries(index, doc), false
+	}
+	if index.Sparse && !hasAnyIndexField(index, doc) {
+		return nil, false
+	}
+	entries := []indexEntry{{}}
+	multikey := false
+	for _, key := range index.Keys {
+		values := indexFieldValues(doc, key.Field)
+		if len(values) > 1 {
+			multikey = true
+		}
+		next := make([]indexEntry, 0, len(entries)*len(values))
+		for _, entry := range entries {
+			for _, v := range values {
+				if len(next) >= maxIndexEntriesPerDocument {
+					break
+				}
+				if key.Type == IndexTypeHashed {
+					v = hashedKeyValue(v)
+				}
+				next = append(next, indexEntry{
+					key:      appendKeyValue(append([]byte(nil), entry.key...), v),
+					typeBits: appendKeyTypeBits(append([]byte(nil), entry.typeBits...), v),
+					values:   append(append([]interface{}(nil), entry.values...), v),
+				})
+			}
+		}
+		entries = next
+	}
+
+	// 同一个文档的相同索引键只保留一个条目；数值类型不同的相同键(如 1 和 1.0)保留第一个
+	seen := make(map[string]bool, len(entries))
+	unique := entries[:0]
+	for _, entry := range entries {
+		if !seen[string(entry.key)] {
+			seen[string(entry.key)] = true
+			unique = append(unique, entry)
+		}
+	}
+	return unique, multikey
+}
+
+// hasAnyIndexField 文档是否包含索引的任一字段，值为 null 也算包含
+func hasAnyIndexField(index Index, doc Document) bool {
+	for _, key := range index.Keys {
+		if len(lookupPath(doc, strings.Split(key.Field, "."))) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFieldValues 返回文档在索引字段上的取值，数组按元素展开，字段缺失时返回 null
+func indexFieldValues(doc Document, field string) []interface{} {
+	var values []interface{}
+	for _, v := range lookupPath(doc, strings.Split(field, ".")) {
+		if arr := toArray(v); arr != nil && len(arr) > 0 {
+			values = append(values, arr...)
+			continue
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return []interface{}{nil}
+	}
+	return values
+}
+
+// keyDocument 将索引条目的取值按键模式组成文档，用于重复键错误信息
+func (e indexEntry) keyDocument(index Index) Document {
+	doc := make(Document, len(index.Keys))
+	for i, key := range index.Keys {
+		if i < len(e.values) {
+			doc[key.Field] = e.values[i]
+		}
+	}
+	return doc
+}
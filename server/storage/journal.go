@@ -0,0 +1,799 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 日志文件所在的子目录和文件名
+const (
+	journalDirName  = "journal"
+	journalFileName = "WiredTigerLog"
+)
+
+// maxJournalPayloadSize 单个条目负载的最大长度：最大的文档加上库名、集合名和 RecordId 等字段留出的余量
+// 恢复时长度超过该值的条目视为崩溃时写坏的数据，不按其长度分配内存
+const maxJournalPayloadSize = DefaultMaxBsonObjectSize + 1<<20
+
+// journalOp 日志条目的操作类型
+type journalOp byte
+
+const (
+	journalCreateDatabase journalOp = iota + 1
+	journalDropDatabase
+	journalCreateCollection
+	journalDropCollection
+	journalCreateIndex
+	journalDropIndex
+	journalInsertRecord
+	journalUpdateRecord
+	journalDeleteRecord
+	journalTruncate
+	journalSetValidation
+	journalModifyIndex
+)
+
+// journalEntry 一条日志记录
+// 各操作只使用其中的部分字段，见 encodeJournalEntry；创建固定集合时 SizeBytes 大于 0
+type journalEntry struct {
+	Op         journalOp
+	Database   string
+	Collection string
+	RecordId   RecordId
+	Data       []byte
+	SizeBytes  int64
+	MaxDocs    int64
+	Index      Index             // journalCreateIndex 的索引定义，journalModifyIndex 修改后的索引定义
+	IndexName  string            // journalDropIndex 的索引名
+	Validation ValidationOptions // journalSetValidation 的校验规则
+}
+
+// journal 预写日志，文件由若干条目顺序组成
+// 每个条目为 4 字节负载长度、4 字节负载的 CRC32 校验和以及负载本身；
+// 崩溃时最后一个条目可能只写了一部分，恢复时从第一个不完整或校验失败的条目处截断
+type journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	syncEach bool // 每次写入后立即刷盘，sync_period_secs 为 0 时启用
+	dirty    bool // 上次刷盘后是否有新的写入
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// journalPath 返回数据目录下日志文件的路径
+func journalPath(dir string) string {
+	return filepath.Join(dir, journalDirName, journalFileName)
+}
+
+// openJournal 打开日志文件用于追加，size 之后的内容是崩溃时写了一半的条目，先截断
+// syncPeriod 大于 0 时由后台协程按周期刷盘，否则每次写入后刷盘
+func openJournal(path string, size int64, syncPeriod time.Duration) (*journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("创建日志目录失败: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("打开日志文件失败: %w", err)
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("截断日志文件失败: %w", err)
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("定位日志文件失败: %w", err)
+	}
+
+	j := &journal{file: file, syncEach: syncPeriod <= 0}
+	if syncPeriod > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		j.cancel = cancel
+		j.done = make(chan struct{})
+		go j.syncLoop(ctx, syncPeriod)
+	}
+	return j, nil
+}
+
+// syncLoop 按周期把日志刷到磁盘
+func (j *journal) syncLoop(ctx context.Context, period time.Duration) {
+	defer close(j.done)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.sync()
+		}
+	}
+}
+
+// frameJournalEntry 编码条目并加上负载长度和校验和
+func frameJournalEntry(entry journalEntry) ([]byte, error) {
+	payload, err := encodeJournalEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxJournalPayloadSize {
+		return nil, fmt.Errorf("%w: 日志条目长度 %d 超过上限 %d", ErrBadValue, len(payload), maxJournalPayloadSize)
+	}
+	buf := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[8:], payload)
+	return buf, nil
+}
+
+// append 追加一个条目，条目写入操作系统后返回，是否立即刷盘取决于 syncEach
+func (j *journal) append(entry journalEntry) error {
+	buf, err := frameJournalEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return fmt.Errorf("%w: 日志已关闭", ErrIllegalOperation)
+	}
+	if _, err := j.file.Write(buf); err != nil {
+		return fmt.Errorf("写入日志失败: %w", err)
+	}
+	j.dirty = true
+	if j.syncEach {
+		return j.syncLocked()
+	}
+	return nil
+}
+
+// sync 把已写入的日志刷到磁盘
+func (j *journal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.syncLocked()
+}
+
+// syncLocked 同 sync，调用方需持有 j.mu
+func (j *journal) syncLocked() error {
+	if j.file == nil || !j.dirty {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("日志刷盘失败: %w", err)
+	}
+	j.dirty = false
+	return nil
+}
+
+// rotate 用 snapshot 生成的条目替换日志文件的全部内容，之后继续在新文件末尾追加
+// 新内容先写入同目录下的临时文件并刷盘，再通过重命名原子地替换日志文件，任一步骤失败时原日志保持不变；
+// 调用方需保证 snapshot 执行期间没有其他条目写入日志
+func (j *journal) rotate(path string, snapshot func(add func(journalEntry) error) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return fmt.Errorf("%w: 日志已关闭", ErrIllegalOperation)
+	}
+
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("创建日志文件失败: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	err = snapshot(func(entry journalEntry) error {
+		buf, err := frameJournalEntry(entry)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("重写日志失败: %w", err)
+	}
+	// 目录刷盘后重命名才能在崩溃后保留
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	j.file.Close()
+	j.file = tmp
+	j.dirty = false
+	return nil
+}
+
+// close 停止后台刷盘，刷盘后关闭日志文件
+func (j *journal) close() error {
+	if j.cancel != nil {
+		j.cancel()
+		<-j.done
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.syncLocked()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	j.file = nil
+	return err
+}
+
+// scanJournal 按顺序读取日志中完整的条目并逐个交给 fn，返回完整条目结束的位置
+// 条目读出后立即处理，不在内存中保留整个日志；日志不存在时返回 0；
+// 末尾不完整、长度超过 maxJournalPayloadSize 或校验失败的条目视为崩溃时未写完，从该条目处截断
+func scanJournal(path string, fn func(journalEntry)) (int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("打开日志文件失败: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var offset int64
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return offset, nil
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		if size > maxJournalPayloadSize {
+			return offset, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			return offset, nil
+		}
+		entry, err := decodeJournalEntry(payload)
+		if err != nil {
+			return offset, nil
+		}
+		fn(entry)
+		offset += int64(len(header)) + int64(size)
+	}
+}
+
+// encodeJournalEntry 编码条目负载：操作类型后按操作依次写入各字段，字符串和字节数组带 uvarint 长度前缀
+func encodeJournalEntry(entry journalEntry) ([]byte, error) {
+	w := &journalWriter{buf: []byte{byte(entry.Op)}}
+	switch entry.Op {
+	case journalCreateDatabase, journalDropDatabase:
+		w.string(entry.Database)
+	case journalCreateCollection:
+		w.string(entry.Database)
+		w.string(entry.Collection)
+		w.int64(entry.SizeBytes)
+		w.int64(entry.MaxDocs)
+	case journalDropCollection, journalTruncate:
+		w.string(entry.Database)
+		w.string(entry.Collection)
+	case journalCreateIndex, journalModifyIndex:
+		w.string(entry.Database)
+		w.string(entry.Collection)
+		if err := w.index(entry.Index); err != nil {
+			return nil, err
+		}
+	case journalDropIndex:
+		w.string(entry.Database)
+		w.string(entry.Collection)
+		w.string(entry.IndexName)
+	case journalInsertRecord, journalUpdateRecord:
+		w.string(entry.Database)
+		w.string(entry.Collection)
+		w.bytes(encodeRecordId(entry.RecordId))
+		w.bytes(entry.Data)
+	case journalDeleteRecord:
+		w.string(entry.Database)
+		w.string(entry.Collection)
+		w.bytes(encodeRecordId(entry.RecordId))
+	case journalSetValidation:
+		w.string(entry.Database)
+		w.string(entry.Collection)
+		if err := w.validation(entry.Validation); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: 未知的日志操作 %d", ErrBadValue, entry.Op)
+	}
+	return w.buf, nil
+}
+
+// decodeJournalEntry 解码 encodeJournalEntry 生成的负载
+func decodeJournalEntry(payload []byte) (journalEntry, error) {
+	if len(payload) == 0 {
+		return journalEntry{}, fmt.Errorf("%w: 日志条目为空", ErrBadValue)
+	}
+	entry := journalEntry{Op: journalOp(payload[0])}
+	r := &journalReader{buf: payload[1:]}
+	switch entry.Op {
+	case journalCreateDatabase, journalDropDatabase:
+		entry.Database = r.string()
+	case journalCreateCollection:
+		entry.Database = r.string()
+		entry.Collection = r.string()
+		entry.SizeBytes = r.int64()
+		entry.MaxDocs = r.int64()
+	case journalDropCollection, journalTruncate:
+		entry.Database = r.string()
+		entry.Collection = r.string()
+	case journalCreateIndex, journalModifyIndex:
+		entry.Database = r.string()
+		entry.Collection = r.string()
+		entry.Index = r.index()
+	case journalDropIndex:
+		entry.Database = r.string()
+		entry.Collection = r.string()
+		entry.IndexName = r.string()
+	case journalInsertRecord, journalUpdateRecord:
+		entry.Database = r.string()
+		entry.Collection = r.string()
+		entry.RecordId = decodeRecordId(r.bytes())
+		entry.Data = r.bytes()
+	case journalDeleteRecord:
+		entry.Database = r.string()
+		entry.Collection = r.string()
+		entry.RecordId = decodeRecordId(r.bytes())
+	case journalSetValidation:
+		entry.Database = r.string()
+		entry.Collection = r.string()
+		entry.Validation = r.validation()
+	default:
+		return journalEntry{}, fmt.Errorf("%w: 未知的日志操作 %d", ErrBadValue, entry.Op)
+	}
+	if r.err != nil {
+		return journalEntry{}, r.err
+	}
+	return entry, nil
+}
+
+// journalWriter 编码日志负载
+type journalWriter struct {
+	buf []byte
+}
+
+func (w *journalWriter) bytes(b []byte) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *journalWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+func (w *journalWriter) int64(n int64) {
+	w.buf = binary.AppendVarint(w.buf, n)
+}
+
+func (w *journalWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// index 编码索引定义，部分索引的过滤条件以 BSON 保存
+func (w *journalWriter) index(index Index) error {
+	w.string(index.Name)
+	w.int64(int64(len(index.Keys)))
+	for _, key := range index.Keys {
+		w.string(key.Field)
+		w.int64(int64(key.Direction))
+		w.string(key.Type)
+	}
+	w.bool(index.Unique)
+	w.bool(index.Sparse)
+	w.int64(int64(index.ExpireAfterSeconds))
+	var filter []byte
+	if index.PartialFilterExpression != nil {
+		data, err := MarshalDocument(index.PartialFilterExpression)
+		if err != nil {
+			return fmt.Errorf("序列化部分索引过滤条件失败: %w", err)
+		}
+		filter = data
+	}
+	w.bytes(filter)
+	w.bool(index.Hidden)
+	return nil
+}
+
+// validation 编码集合的校验规则，校验规则以 BSON 保存
+func (w *journalWriter) validation(opts ValidationOptions) error {
+	var validator []byte
+	if len(opts.Validator) > 0 {
+		data, err := MarshalDocument(opts.Validator)
+		if err != nil {
+			return fmt.Errorf("序列化校验规则失败: %w", err)
+		}
+		validator = data
+	}
+	w.bytes(validator)
+	w.string(opts.Level)
+	w.string(opts.Action)
+	return nil
+}
+
+// journalReader 解码日志负载，遇到第一个错误后不再读取
+type journalReader struct {
+	buf []byte
+	err error
+}
+
+func (r *journalReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: 日志条目不完整", ErrBadValue)
+	}
+}
+
+func (r *journalReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	n, size := binary.Uvarint(r.buf)
+	if size <= 0 || uint64(len(r.buf)-size) < n {
+		r.fail()
+		return nil
+	}
+	b := r.buf[size : size+int(n)]
+	r.buf = r.buf[size+int(n):]
+	return b
+}
+
+func (r *journalReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *journalReader) int64() int64 {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Varint(r.buf)
+	if size <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[size:]
+	return n
+}
+
+func (r *journalReader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.buf) == 0 {
+		r.fail()
+		return false
+	}
+	b := r.buf[0] != 0
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *journalReader) index() Index {
+	index := Index{Name: r.string()}
+	n := r.int64()
+	for i := int64(0); i < n && r.err == nil; i++ {
+		index.Keys = append(index.Keys, IndexKey{
+			Field:     r.string(),
+			Direction: int(r.int64()),
+			Type:      r.string(),
+		})
+	}
+	index.Unique = r.bool()
+	index.Sparse = r.bool()
+	index.ExpireAfterSeconds = int(r.int64())
+	if filter := r.bytes(); len(filter) > 0 && r.err == nil {
+		doc, err := UnmarshalDocument(filter)
+		if err != nil {
+			r.err = fmt.Errorf("解析部分索引过滤条件失败: %w", err)
+			return index
+		}
+		index.PartialFilterExpression = doc
+	}
+	index.Hidden = r.bool()
+	return index
+}
+
+func (r *journalReader) validation() ValidationOptions {
+	var opts ValidationOptions
+	if validator := r.bytes(); len(validator) > 0 && r.err == nil {
+		doc, err := UnmarshalDocument(validator)
+		if err != nil {
+			r.err = fmt.Errorf("解析校验规则失败: %w", err)
+			return opts
+		}
+		opts.Validator = doc
+	}
+	opts.Level = r.string()
+	opts.Action = r.string()
+	return opts
+}
+
+// journaledRecordStore 在修改记录前先写日志的 RecordStore
+// 固定集合淘汰旧记录时直接删除内层记录，不写日志，重放插入时会以相同的顺序再次淘汰；
+// 事务中的修改在事务提交时才写日志，崩溃时尚未提交的事务不会在重放时生效，
+// 事务回滚时撤销修改的写入照常写日志，重放时只是把记录恢复为日志中已有的版本
+type journaledRecordStore struct {
+	RecordStore
+	engine               *WiredTigerEngine
+	database, collection string
+}
+
+// journal 写入修改记录的日志条目，在事务中时注册变更，提交时按修改的顺序写入
+func (rs *journaledRecordStore) journal(ctx context.Context, entry journalEntry) error {
+	entry.Database, entry.Collection = rs.database, rs.collection
+	ru := transactionUnit(ctx)
+	if ru == nil {
+		return rs.engine.writeJournal(entry)
+	}
+	entry.Data = bytes.Clone(entry.Data)
+	return ru.RegisterChange(NewSimpleChange(func() error {
+		return rs.engine.writeJournal(entry)
+	}, func() error {
+		return nil
+	}))
+}
+
+func (rs *journaledRecordStore) InsertRecord(ctx context.Context, recordId RecordId, data []byte) error {
+	if err := rs.journal(ctx, journalEntry{Op: journalInsertRecord, RecordId: recordId, Data: data}); err != nil {
+		return err
+	}
+	return rs.RecordStore.InsertRecord(ctx, recordId, data)
+}
+
+func (rs *journaledRecordStore) UpdateRecord(ctx context.Context, recordId RecordId, data []byte) error {
+	if err := rs.journal(ctx, journalEntry{Op: journalUpdateRecord, RecordId: recordId, Data: data}); err != nil {
+		return err
+	}
+	return rs.RecordStore.UpdateRecord(ctx, recordId, data)
+}
+
+func (rs *journaledRecordStore) DeleteRecord(ctx context.Context, recordId RecordId) error {
+	if err := rs.journal(ctx, journalEntry{Op: journalDeleteRecord, RecordId: recordId}); err != nil {
+		return err
+	}
+	return rs.RecordStore.DeleteRecord(ctx, recordId)
+}
+
+func (rs *journaledRecordStore) Truncate(ctx context.Context) error {
+	if err := rs.journal(ctx, journalEntry{Op: journalTruncate}); err != nil {
+		return err
+	}
+	return rs.RecordStore.Truncate(ctx)
+}
+
+// unwrapRecordStore 返回日志包装下的实际记录存储
+func unwrapRecordStore(rs RecordStore) RecordStore {
+	if journaled, ok := rs.(*journaledRecordStore); ok {
+		return journaled.RecordStore
+	}
+	return rs
+}
+
+// journalEnabled 是否启用预写日志：需要开启 journal_enabled 并配置数据目录，内存引擎总是不启用
+func (e *WiredTigerEngine) journalEnabled() bool {
+	return !e.ephemeral && e.config.JournalEnabled && e.config.DirectoryForDB != ""
+}
+
+// writeJournal 追加日志条目，未启用日志或正在重放日志时不做任何操作
+func (e *WiredTigerEngine) writeJournal(entry journalEntry) error {
+	e.journalMu.RLock()
+	j := e.journal
+	e.journalMu.RUnlock()
+	if j == nil {
+		return nil
+	}
+	return j.append(entry)
+}
+
+// SyncJournal 把已写入的日志刷到磁盘，未启用日志时不做任何操作
+// 写关注要求 j: true 时在确认写入前调用
+func (e *WiredTigerEngine) SyncJournal(ctx context.Context) error {
+	e.journalMu.RLock()
+	j := e.journal
+	e.journalMu.RUnlock()
+	if j == nil {
+		return nil
+	}
+	return j.sync()
+}
+
+// openJournal 首次启动时重放日志恢复数据，然后打开日志文件继续追加
+// 记录存储和索引只保存在内存中，日志是唯一的持久化数据：检查点把日志重写为当时全部数据的快照，
+// 重放时从快照开始依次应用之后的条目
+func (e *WiredTigerEngine) openJournal(ctx context.Context) error {
+	if !e.journalEnabled() {
+		return nil
+	}
+	e.journalMu.Lock()
+	opened := e.journal != nil
+	e.journalMu.Unlock()
+	if opened {
+		return nil
+	}
+
+	path := journalPath(e.config.DirectoryForDB)
+	var size int64
+	var err error
+	if e.journalReplayed {
+		size, err = scanJournal(path, func(journalEntry) {})
+	} else {
+		size, err = e.replayJournal(ctx, path)
+	}
+	if err != nil {
+		return err
+	}
+	e.journalReplayed = true
+
+	j, err := openJournal(path, size, time.Duration(e.config.SyncPeriodSecs)*time.Second)
+	if err != nil {
+		return err
+	}
+	e.journalMu.Lock()
+	e.journal = j
+	e.journalMu.Unlock()
+	return nil
+}
+
+// closeJournal 刷盘并关闭日志文件
+func (e *WiredTigerEngine) closeJournal() error {
+	e.journalMu.Lock()
+	j := e.journal
+	e.journal = nil
+	e.journalMu.Unlock()
+	if j == nil {
+		return nil
+	}
+	return j.close()
+}
+
+// replayJournal 按顺序重放日志文件中的条目，返回完整条目结束的位置，重放期间不写日志也不记录 oplog
+// 记录操作直接作用于记录存储，最后为所有集合重建索引；
+// 原操作失败的条目重放时会以相同的原因失败，因此忽略单个条目的错误
+func (e *WiredTigerEngine) replayJournal(ctx context.Context, path string) (int64, error) {
+	var maxRecordId int64
+	size, err := scanJournal(path, func(entry journalEntry) {
+		switch entry.Op {
+		case journalCreateDatabase:
+			e.CreateDatabase(ctx, entry.Database)
+		case journalDropDatabase:
+			e.DropDatabase(ctx, entry.Database)
+		case journalCreateCollection:
+			e.ensureDatabase(entry.Database)
+			if entry.SizeBytes > 0 {
+				e.CreateCappedCollection(ctx, entry.Database, entry.Collection, entry.SizeBytes, entry.MaxDocs)
+			} else {
+				e.CreateCollection(ctx, entry.Database, entry.Collection)
+			}
+		case journalDropCollection:
+			e.DropCollection(ctx, entry.Database, entry.Collection)
+		case journalCreateIndex:
+			e.CreateIndex(ctx, entry.Database, entry.Collection, entry.Index)
+		case journalDropIndex:
+			e.DropIndex(ctx, entry.Database, entry.Collection, entry.IndexName)
+		case journalSetValidation:
+			e.SetValidation(ctx, entry.Database, entry.Collection, entry.Validation)
+		case journalModifyIndex:
+			mod := IndexModification{Hidden: &entry.Index.Hidden}
+			if entry.Index.ExpireAfterSeconds > 0 {
+				mod.ExpireAfterSeconds = &entry.Index.ExpireAfterSeconds
+			}
+			e.ModifyIndex(ctx, entry.Database, entry.Collection, entry.Index.Name, mod)
+		default:
+			coll := e.lookupCollection(entry.Database, entry.Collection)
+			if coll == nil {
+				return
+			}
+			switch entry.Op {
+			case journalInsertRecord:
+				coll.RecordStore.InsertRecord(ctx, entry.RecordId, entry.Data)
+			case journalUpdateRecord:
+				coll.RecordStore.UpdateRecord(ctx, entry.RecordId, entry.Data)
+			case journalDeleteRecord:
+				coll.RecordStore.DeleteRecord(ctx, entry.RecordId)
+			case journalTruncate:
+				coll.RecordStore.Truncate(ctx)
+			}
+			if id, ok := entry.RecordId.AsLong(); ok && id > maxRecordId {
+				maxRecordId = id
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if maxRecordId > e.nextRecordId {
+		e.nextRecordId = maxRecordId
+	}
+
+	e.mu.RLock()
+	var colls []*Collection
+	for _, db := range e.databases {
+		for _, coll := range db.Collections {
+			colls = append(colls, coll)
+		}
+	}
+	e.mu.RUnlock()
+	for _, coll := range colls {
+		if err := e.rebuildAllIndexes(ctx, coll); err != nil {
+			return 0, fmt.Errorf("重放日志失败: %w", err)
+		}
+	}
+	return size, nil
+}
+
+// ensureDatabase 数据库不存在时创建，不写日志
+func (e *WiredTigerEngine) ensureDatabase(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exists := e.databases[name]; !exists {
+		e.databases[name] = &Database{
+			Name:        name,
+			Collections: make(map[string]*Collection),
+		}
+	}
+}
+
+// rebuildAllIndexes 清空集合的所有索引后扫描记录重新生成索引条目
+func (e *WiredTigerEngine) rebuildAllIndexes(ctx context.Context, coll *Collection) error {
+	for _, spec := range coll.IndexSpecs {
+		e.kvEngine.DropSortedDataInterface(coll.Namespace, spec.Name)
+		idx, err := e.kvEngine.CreateSortedDataInterface(coll.Namespace, spec.Name, spec.Unique)
+		if err != nil {
+			return fmt.Errorf("重建索引 %s 失败: %w", spec.Name, err)
+		}
+		coll.setIndex(spec.Name, idx)
+		coll.multikey[spec.Name] = false
+	}
+	coll.plans.clear()
+	coll.sample.reset()
+
+	cursor, err := coll.RecordStore.Scan(ctx, NullRecordId())
+	if err != nil {
+		return fmt.Errorf("扫描集合 %s 失败: %w", coll.Namespace, err)
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		doc, err := e.bsonToDocument(cursor.Data())
+		if err != nil {
+			continue
+		}
+		if err := e.insertIndexEntries(ctx, coll, doc, cursor.RecordId()); err != nil {
+			return fmt.Errorf("重建集合 %s 的索引失败: %w", coll.Namespace, err)
+		}
+	}
+	return nil
+}
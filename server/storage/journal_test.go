@@ -0,0 +1,441 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestJournalRecovery 测试丢弃内存中的数据后，启动时重放日志恢复集合、文档和索引
+func TestJournalRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := config.StorageConfig{Engine: "wiredTiger", JournalEnabled: true, DirectoryForDB: dir}
+	start := func() *storage.WiredTigerEngine {
+		t.Helper()
+		engine, err := storage.NewWiredTigerEngine(cfg)
+		if err != nil {
+			t.Fatalf("创建引擎失败: %v", err)
+		}
+		if err := engine.Start(); err != nil {
+			t.Fatalf("启动引擎失败: %v", err)
+		}
+		return engine
+	}
+
+	engine := start()
+	docs := []storage.Document{
+		{"_id": int32(1), "x": int32(10)},
+		{"_id": int32(2), "x": int32(20)},
+		{"_id": int32(3), "x": int32(30)},
+	}
+	if err := engine.Insert(ctx, "test", "a", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	unique := storage.Index{Name: "x_1", Keys: []storage.IndexKey{{Field: "x", Direction: 1}}, Unique: true}
+	if err := engine.CreateIndex(ctx, "test", "a", unique); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	if _, err := engine.Update(ctx, "test", "a", storage.Document{"_id": int32(2)},
+		storage.Document{"$set": storage.Document{"x": int32(21)}}, storage.UpdateOptions{}); err != nil {
+		t.Fatalf("更新失败: %v", err)
+	}
+	if _, err := engine.Delete(ctx, "test", "a", storage.Document{"_id": int32(3)}, true); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	if err := engine.CreateCappedCollection(ctx, "test", "capped", 1<<20, 2); err != nil {
+		t.Fatalf("创建固定集合失败: %v", err)
+	}
+	for i := int32(1); i <= 4; i++ {
+		if err := engine.Insert(ctx, "test", "capped", []storage.Document{{"_id": i}}); err != nil {
+			t.Fatalf("插入固定集合失败: %v", err)
+		}
+	}
+	if err := engine.Insert(ctx, "test", "gone", []storage.Document{{"_id": int32(1)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.DropCollection(ctx, "test", "gone"); err != nil {
+		t.Fatalf("删除集合失败: %v", err)
+	}
+	validation := storage.ValidationOptions{
+		Validator: storage.Document{"x": storage.Document{"$type": "int"}}, Level: storage.ValidationLevelModerate,
+	}
+	if err := engine.SetValidation(ctx, "test", "a", validation); err != nil {
+		t.Fatalf("设置校验规则失败: %v", err)
+	}
+	hidden := true
+	if _, err := engine.ModifyIndex(ctx, "test", "a", "x_1", storage.IndexModification{Hidden: &hidden}); err != nil {
+		t.Fatalf("隐藏索引失败: %v", err)
+	}
+
+	// 模拟崩溃：不停止引擎直接丢弃，并在日志末尾留下写了一半的条目
+	path := filepath.Join(dir, "journal", "WiredTigerLog")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("打开日志文件失败: %v", err)
+	}
+	f.Write([]byte{0x40, 0, 0, 0, 1, 2})
+	f.Close()
+
+	engine = start()
+	got, err := engine.Find(ctx, "test", "a", storage.Document{})
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	want := map[int32]int32{1: 10, 2: 21}
+	if len(got) != len(want) {
+		t.Fatalf("恢复后应有 %d 个文档, got %v", len(want), got)
+	}
+	for _, doc := range got {
+		if x := doc["x"]; x != want[doc["_id"].(int32)] {
+			t.Errorf("文档 %v 的 x 应为 %v, got %v", doc["_id"], want[doc["_id"].(int32)], x)
+		}
+	}
+	indexes, err := engine.ListIndexes(ctx, "test", "a")
+	if err != nil || len(indexes) != 2 {
+		t.Fatalf("恢复后应有 _id 和 x_1 两个索引, got %v, %v", indexes, err)
+	}
+	if !indexes[1].Hidden {
+		t.Errorf("恢复后 x_1 应仍然隐藏")
+	}
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(4), "x": int32(10)}}); err == nil {
+		t.Error("恢复的唯一索引应拒绝重复键")
+	}
+	if got, _ := engine.Find(ctx, "test", "a", storage.Document{"x": int32(21)}); len(got) != 1 {
+		t.Errorf("通过恢复的索引应查到 1 个文档, got %v", got)
+	}
+	capped, err := engine.Find(ctx, "test", "capped", storage.Document{})
+	if err != nil || len(capped) != 2 || capped[0]["_id"] != int32(3) {
+		t.Errorf("固定集合应只保留最新的 2 个文档, got %v, %v", capped, err)
+	}
+	if colls, _ := engine.ListCollections(ctx, "test"); len(colls) != 2 {
+		t.Errorf("已删除的集合不应恢复, got %v", colls)
+	}
+	if got, err := engine.CollectionValidation(ctx, "test", "a"); err != nil || got.Level != storage.ValidationLevelModerate {
+		t.Errorf("恢复后的校验规则 = %v, %v", got, err)
+	}
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(6), "x": "six"}}); err == nil {
+		t.Error("恢复的校验规则应拒绝 x 不是 int 的文档")
+	}
+
+	// 恢复后继续写入，正常停止后再次启动仍能恢复全部数据
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(5), "x": int32(50)}}); err != nil {
+		t.Fatalf("恢复后插入失败: %v", err)
+	}
+	if err := engine.Stop(); err != nil {
+		t.Fatalf("停止引擎失败: %v", err)
+	}
+	engine = start()
+	defer engine.Stop()
+	if got, _ := engine.Find(ctx, "test", "a", storage.Document{}); len(got) != 3 {
+		t.Errorf("再次启动后应有 3 个文档, got %v", got)
+	}
+}
+
+// TestJournalCorruptLength 测试末尾条目的长度字段被写坏时，恢复从该条目处截断，不按写坏的长度分配内存
+func TestJournalCorruptLength(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := config.StorageConfig{Engine: "wiredTiger", JournalEnabled: true, DirectoryForDB: dir}
+	start := func() *storage.WiredTigerEngine {
+		t.Helper()
+		engine, err := storage.NewWiredTigerEngine(cfg)
+		if err != nil {
+			t.Fatalf("创建引擎失败: %v", err)
+		}
+		if err := engine.Start(); err != nil {
+			t.Fatalf("启动引擎失败: %v", err)
+		}
+		return engine
+	}
+
+	engine := start()
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(1)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.Stop(); err != nil {
+		t.Fatalf("停止引擎失败: %v", err)
+	}
+	path := filepath.Join(dir, "journal", "WiredTigerLog")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("读取日志文件失败: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("打开日志文件失败: %v", err)
+	}
+	f.Write([]byte{0xf0, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+	f.Close()
+
+	engine = start()
+	defer engine.Stop()
+	if got, err := engine.Find(ctx, "test", "a", storage.Document{}); err != nil || len(got) != 1 {
+		t.Errorf("恢复后应有 1 个文档, got %v, %v", got, err)
+	}
+	if after, err := os.Stat(path); err != nil || after.Size() != info.Size() {
+		t.Errorf("写坏的条目应被截断: %d -> %v, %v", info.Size(), after, err)
+	}
+}
+
+// TestJournalCheckpoint 测试检查点把日志重写为当前数据的快照，之后的写入追加在快照后，崩溃后都能恢复
+func TestJournalCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := config.StorageConfig{Engine: "wiredTiger", JournalEnabled: true, DirectoryForDB: dir}
+	start := func() *storage.WiredTigerEngine {
+		t.Helper()
+		engine, err := storage.NewWiredTigerEngine(cfg)
+		if err != nil {
+			t.Fatalf("创建引擎失败: %v", err)
+		}
+		if err := engine.Start(); err != nil {
+			t.Fatalf("启动引擎失败: %v", err)
+		}
+		return engine
+	}
+	path := filepath.Join(dir, "journal", "WiredTigerLog")
+	journalSize := func() int64 {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("读取日志文件失败: %v", err)
+		}
+		return info.Size()
+	}
+
+	engine := start()
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(1), "x": int32(0)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	for i := int32(1); i <= 100; i++ {
+		if _, err := engine.Update(ctx, "test", "a", storage.Document{"_id": int32(1)},
+			storage.Document{"$set": storage.Document{"x": i}}, storage.UpdateOptions{}); err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+	}
+	unique := storage.Index{Name: "x_1", Keys: []storage.IndexKey{{Field: "x", Direction: 1}}, Unique: true, Hidden: true}
+	if err := engine.CreateIndex(ctx, "test", "a", unique); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	if err := engine.SetValidation(ctx, "test", "a", storage.ValidationOptions{
+		Validator: storage.Document{"x": storage.Document{"$type": "int"}},
+	}); err != nil {
+		t.Fatalf("设置校验规则失败: %v", err)
+	}
+	if err := engine.CreateCappedCollection(ctx, "test", "capped", 1<<20, 2); err != nil {
+		t.Fatalf("创建固定集合失败: %v", err)
+	}
+	for i := int32(1); i <= 4; i++ {
+		if err := engine.Insert(ctx, "test", "capped", []storage.Document{{"_id": i}}); err != nil {
+			t.Fatalf("插入固定集合失败: %v", err)
+		}
+	}
+	if err := engine.CreateDatabase(ctx, "empty"); err != nil {
+		t.Fatalf("创建数据库失败: %v", err)
+	}
+
+	before := journalSize()
+	if _, err := engine.Checkpoint(ctx); err != nil {
+		t.Fatalf("检查点失败: %v", err)
+	}
+	after := journalSize()
+	if after >= before {
+		t.Errorf("检查点后日志应只包含当前数据, size %d -> %d", before, after)
+	}
+	if _, err := engine.Checkpoint(ctx); err != nil {
+		t.Fatalf("检查点失败: %v", err)
+	}
+	if size := journalSize(); size != after {
+		t.Errorf("数据不变时再次检查点日志大小应不变, size %d -> %d", after, size)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("检查点后不应留下临时文件, got %v", err)
+	}
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(2), "x": int32(200)}}); err != nil {
+		t.Fatalf("检查点后插入失败: %v", err)
+	}
+
+	// 模拟崩溃：不停止引擎直接丢弃
+	engine = start()
+	defer engine.Stop()
+	got, err := engine.Find(ctx, "test", "a", storage.Document{})
+	if err != nil || len(got) != 2 {
+		t.Fatalf("恢复后应有 2 个文档, got %v, %v", got, err)
+	}
+	if got, _ := engine.Find(ctx, "test", "a", storage.Document{"_id": int32(1)}); len(got) != 1 || got[0]["x"] != int32(100) {
+		t.Errorf("恢复后 _id 1 的 x 应为 100, got %v", got)
+	}
+	indexes, err := engine.ListIndexes(ctx, "test", "a")
+	if err != nil || len(indexes) != 2 || !indexes[1].Hidden || !indexes[1].Unique {
+		t.Fatalf("恢复后应有隐藏的唯一索引 x_1, got %v, %v", indexes, err)
+	}
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(3), "x": int32(200)}}); err == nil {
+		t.Error("恢复的唯一索引应拒绝重复键")
+	}
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(4), "x": "four"}}); err == nil {
+		t.Error("恢复的校验规则应拒绝 x 不是 int 的文档")
+	}
+	capped, err := engine.Find(ctx, "test", "capped", storage.Document{})
+	if err != nil || len(capped) != 2 || capped[0]["_id"] != int32(3) {
+		t.Errorf("固定集合应只保留最新的 2 个文档, got %v, %v", capped, err)
+	}
+	if err := engine.Insert(ctx, "test", "capped", []storage.Document{{"_id": int32(5)}}); err != nil {
+		t.Fatalf("插入固定集合失败: %v", err)
+	}
+	if capped, _ := engine.Find(ctx, "test", "capped", storage.Document{}); len(capped) != 2 || capped[0]["_id"] != int32(4) {
+		t.Errorf("恢复的固定集合应保持文档数上限, got %v", capped)
+	}
+	if dbs, _ := engine.ListDatabases(ctx); !slices.Contains(dbs, "empty") {
+		t.Errorf("恢复后应包含空数据库, got %v", dbs)
+	}
+}
+
+// TestJournalTransaction 测试事务结束前崩溃时，重放日志不会恢复事务中的写入，已提交的事务完整恢复
+func TestJournalTransaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := config.StorageConfig{Engine: "wiredTiger", JournalEnabled: true, DirectoryForDB: dir}
+	start := func() *storage.WiredTigerEngine {
+		t.Helper()
+		engine, err := storage.NewWiredTigerEngine(cfg)
+		if err != nil {
+			t.Fatalf("创建引擎失败: %v", err)
+		}
+		if err := engine.Start(); err != nil {
+			t.Fatalf("启动引擎失败: %v", err)
+		}
+		return engine
+	}
+	balances := func(engine *storage.WiredTigerEngine) map[int32]int32 {
+		t.Helper()
+		docs, err := engine.Find(ctx, "test", "accounts", storage.Document{})
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		out := make(map[int32]int32, len(docs))
+		for _, doc := range docs {
+			out[doc["_id"].(int32)] = doc["balance"].(int32)
+		}
+		return out
+	}
+	// 在事务中修改、删除和插入各一个文档
+	write := func(engine *storage.WiredTigerEngine) storage.RecoveryUnit {
+		t.Helper()
+		ru := storage.NewRecoveryUnit()
+		if err := ru.BeginTransaction(ctx); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+		txnCtx := storage.WithRecoveryUnit(ctx, ru)
+		if _, err := engine.Update(txnCtx, "test", "accounts", storage.Document{"_id": int32(1)},
+			storage.Document{"$inc": storage.Document{"balance": int32(-30)}}, storage.UpdateOptions{}); err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		if _, err := engine.Delete(txnCtx, "test", "accounts", storage.Document{"_id": int32(2)}, true); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+		if err := engine.Insert(txnCtx, "test", "accounts", []storage.Document{{"_id": int32(3), "balance": int32(30)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		return ru
+	}
+
+	engine := start()
+	if err := engine.Insert(ctx, "test", "accounts", []storage.Document{
+		{"_id": int32(1), "balance": int32(100)},
+		{"_id": int32(2), "balance": int32(50)},
+	}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+
+	// 事务进行中建立检查点并写入其他文档，随后不关闭引擎直接丢弃，模拟崩溃
+	write(engine)
+	if _, err := engine.Checkpoint(ctx); err != nil {
+		t.Fatalf("检查点失败: %v", err)
+	}
+	if err := engine.Insert(ctx, "test", "accounts", []storage.Document{{"_id": int32(4), "balance": int32(5)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	engine = start()
+	if got := balances(engine); len(got) != 3 || got[1] != 100 || got[2] != 50 || got[4] != 5 {
+		t.Fatalf("未提交的事务不应在恢复后生效: %v", got)
+	}
+
+	// 提交的事务在崩溃后完整恢复
+	ru := write(engine)
+	if err := ru.Commit(ctx); err != nil {
+		t.Fatalf("提交失败: %v", err)
+	}
+	engine = start()
+	if got := balances(engine); len(got) != 3 || got[1] != 70 || got[3] != 30 || got[4] != 5 {
+		t.Errorf("已提交的事务应在恢复后生效: %v", got)
+	}
+}
+
+// TestJournalDisabled 测试关闭 journal_enabled 时不写日志
+func TestJournalDisabled(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	engine, err := storage.NewWiredTigerEngine(config.StorageConfig{Engine: "wiredTiger", DirectoryForDB: dir})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	if err := engine.Start(); err != nil {
+		t.Fatalf("启动引擎失败: %v", err)
+	}
+	defer engine.Stop()
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(1)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "journal")); !os.IsNotExist(err) {
+		t.Errorf("关闭日志时不应创建日志目录, got %v", err)
+	}
+}
+
+// TestMemoryEngineEphemeral 测试内存引擎即使开启 journal_enabled 也不在数据目录中创建文件
+func TestMemoryEngineEphemeral(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory", JournalEnabled: true, DirectoryForDB: dir})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	if err := engine.Start(); err != nil {
+		t.Fatalf("启动引擎失败: %v", err)
+	}
+	if err := engine.Insert(ctx, "test", "a", []storage.Document{{"_id": int32(1), "x": int32(1)}, {"_id": int32(2)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.CreateIndex(ctx, "test", "a", storage.Index{Name: "x_1", Keys: []storage.IndexKey{{Field: "x", Direction: 1}}}); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	if _, err := engine.Update(ctx, "test", "a", storage.Document{"_id": int32(1)},
+		storage.Document{"$set": storage.Document{"x": int32(2)}}, storage.UpdateOptions{}); err != nil {
+		t.Fatalf("更新失败: %v", err)
+	}
+	if _, err := engine.Delete(ctx, "test", "a", storage.Document{"_id": int32(2)}, true); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	if _, err := engine.Checkpoint(ctx); err != nil {
+		t.Fatalf("检查点失败: %v", err)
+	}
+	if err := engine.Stop(); err != nil {
+		t.Fatalf("停止引擎失败: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("读取数据目录失败: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("内存引擎不应在数据目录中创建文件: %v", entries)
+	}
+	if name := engine.GetStats()["engine"]; name != "memory" {
+		t.Errorf("engine = %v, want memory", name)
+	}
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// jsonSchema 解析后的 $jsonSchema 规则
+// 与 JSON Schema 一致，只对对应类型的值生效的关键字(如 minimum 之于数值、required 之于文档)遇到其他类型的值时不做检查
+type jsonSchema struct {
+	types []int // bsonType 或 type 允许的 BSON 类型编号，为空时不限制
+
+	// 文档
+	required             []string
+	properties           map[string]*jsonSchema
+	additionalProperties *jsonSchema // 未在 properties 中列出的字段需满足的规则
+	noAdditional         bool        // additionalProperties 为 false，不允许出现 properties 以外的字段
+
+	// 数值
+	minimum, maximum *float64
+
+	// 字符串
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	// 数组
+	items              *jsonSchema
+	minItems, maxItems *int
+
+	enum []interface{}
+}
+
+// jsonSchemaTypes type 关键字使用的 JSON 类型名及对应的 BSON 类型编号
+var jsonSchemaTypes = map[string][]int{
+	"object":  {3},
+	"array":   {4},
+	"string":  {2},
+	"boolean": {8},
+	"null":    {10},
+	"number":  {typeNumber},
+}
+
+// parseJSONSchema 解析 $jsonSchema 的参数
+// 支持 bsonType、type、required、properties、additionalProperties、minimum、maximum、
+// minLength、maxLength、pattern、items、minItems、maxItems、enum 以及不影响匹配的 title 和 description
+func parseJSONSchema(operand interface{}) (*jsonSchema, error) {
+	doc := toDocument(operand)
+	if doc == nil {
+		return nil, fmt.Errorf("$jsonSchema 需要文档参数, 实际为 %v", operand)
+	}
+	s := &jsonSchema{}
+	for _, key := range sortedKeys(doc) {
+		value := doc[key]
+		var err error
+		switch key {
+		case "bsonType":
+			if _, ok := doc["type"]; ok {
+				return nil, fmt.Errorf("$jsonSchema 不能同时指定 type 和 bsonType")
+			}
+			s.types, err = parseTypeOperand(value)
+		case "type":
+			s.types, err = parseJSONType(value)
+		case "required":
+			s.required, err = schemaStrings(key, value)
+		case "properties":
+			props := toDocument(value)
+			if props == nil {
+				return nil, fmt.Errorf("$jsonSchema 的 properties 必须是文档")
+			}
+			s.properties = make(map[string]*jsonSchema, len(props))
+			for name, prop := range props {
+				if s.properties[name], err = parseJSONSchema(prop); err != nil {
+					return nil, err
+				}
+			}
+		case "additionalProperties":
+			if allowed, ok := value.(bool); ok {
+				s.noAdditional = !allowed
+			} else {
+				s.additionalProperties, err = parseJSONSchema(value)
+			}
+		case "minimum", "maximum":
+			if canonicalType(value) != canonicalNumber {
+				return nil, fmt.Errorf("$jsonSchema 的 %s 必须是数值, 实际为 %v", key, value)
+			}
+			f := toFloat64(value)
+			if key == "minimum" {
+				s.minimum = &f
+			} else {
+				s.maximum = &f
+			}
+		case "minLength":
+			s.minLength, err = schemaCount(key, value)
+		case "maxLength":
+			s.maxLength, err = schemaCount(key, value)
+		case "minItems":
+			s.minItems, err = schemaCount(key, value)
+		case "maxItems":
+			s.maxItems, err = schemaCount(key, value)
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("$jsonSchema 的 pattern 必须是字符串, 实际为 %v", value)
+			}
+			if s.pattern, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("$jsonSchema 的 pattern 不是合法的正则表达式: %v", err)
+			}
+		case "items":
+			s.items, err = parseJSONSchema(value)
+		case "enum":
+			if s.enum = toArray(value); len(s.enum) == 0 {
+				return nil, fmt.Errorf("$jsonSchema 的 enum 必须是非空数组")
+			}
+		case "title", "description":
+			if _, ok := value.(string); !ok {
+				return nil, fmt.Errorf("$jsonSchema 的 %s 必须是字符串", key)
+			}
+		default:
+			return nil, fmt.Errorf("$jsonSchema 不支持关键字 %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// parseJSONType 解析 type 关键字：JSON 类型名或由类型名组成的数组
+func parseJSONType(value interface{}) ([]int, error) {
+	names := []interface{}{value}
+	if arr := toArray(value); arr != nil {
+		names = arr
+	}
+	var types []int
+	for _, name := range names {
+		s, _ := name.(string)
+		t, ok := jsonSchemaTypes[s]
+		if !ok {
+			return nil, fmt.Errorf("$jsonSchema 的 type 不支持 %v，BSON 类型请使用 bsonType", name)
+		}
+		types = append(types, t...)
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("$jsonSchema 的 type 数组不能为空")
+	}
+	return types, nil
+}
+
+// schemaStrings 读取由字符串组成的非空数组
+func schemaStrings(key string, value interface{}) ([]string, error) {
+	arr := toArray(value)
+	if len(arr) == 0 {
+		return nil, fmt.Errorf("$jsonSchema 的 %s 必须是非空的字符串数组", key)
+	}
+	strs := make([]string, len(arr))
+	for i, elem := range arr {
+		s, ok := elem.(string)
+		if !ok {
+			return nil, fmt.Errorf("$jsonSchema 的 %s 必须是非空的字符串数组", key)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// schemaCount 读取非负整数
+func schemaCount(key string, value interface{}) (*int, error) {
+	if canonicalType(value) != canonicalNumber {
+		return nil, fmt.Errorf("$jsonSchema 的 %s 必须是非负整数, 实际为 %v", key, value)
+	}
+	f := toFloat64(value)
+	if f < 0 || f != float64(int(f)) {
+		return nil, fmt.Errorf("$jsonSchema 的 %s 必须是非负整数, 实际为 %v", key, value)
+	}
+	n := int(f)
+	return &n, nil
+}
+
+// matches 判断值是否满足规则
+func (s *jsonSchema) matches(v interface{}) bool {
+	if len(s.types) > 0 && !schemaTypeMatches(s.types, v) {
+		return false
+	}
+	if len(s.enum) > 0 && !schemaEnumMatches(s.enum, v) {
+		return false
+	}
+
+	switch canonicalType(v) {
+	case canonicalNumber:
+		f := toFloat64(v)
+		if (s.minimum != nil && f < *s.minimum) || (s.maximum != nil && f > *s.maximum) {
+			return false
+		}
+	case canonicalString:
+		str, _ := v.(string)
+		n := utf8.RuneCountInString(str)
+		if (s.minLength != nil && n < *s.minLength) || (s.maxLength != nil && n > *s.maxLength) {
+			return false
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return false
+		}
+	case canonicalDocument:
+		return s.documentMatches(toDocument(v))
+	case canonicalArray:
+		arr := toArray(v)
+		if (s.minItems != nil && len(arr) < *s.minItems) || (s.maxItems != nil && len(arr) > *s.maxItems) {
+			return false
+		}
+		if s.items != nil {
+			for _, elem := range arr {
+				if !s.items.matches(elem) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// documentMatches 检查文档的必需字段和各字段的规则
+func (s *jsonSchema) documentMatches(doc Document) bool {
+	for _, name := range s.required {
+		if _, ok := doc[name]; !ok {
+			return false
+		}
+	}
+	for name, value := range doc {
+		if prop, ok := s.properties[name]; ok {
+			if !prop.matches(value) {
+				return false
+			}
+			continue
+		}
+		if s.noAdditional {
+			return false
+		}
+		if s.additionalProperties != nil && !s.additionalProperties.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// schemaTypeMatches 与 $type 不同，bsonType 只检查值本身的类型，不展开数组元素
+func schemaTypeMatches(types []int, v interface{}) bool {
+	actual := bsonType(v)
+	for _, t := range types {
+		if t == actual || (t == typeNumber && canonicalType(v) == canonicalNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaEnumMatches 判断值是否等于 enum 中的某一项
+func schemaEnumMatches(enum []interface{}, v interface{}) bool {
+	for _, candidate := range enum {
+		if valuesEqual(v, candidate) {
+			return true
+		}
+	}
+	return false
+}
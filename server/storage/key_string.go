@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// encodeKeyValue 将值编码为可按字节序比较的索引键
+// 首字节为 BSON 比较顺序中的类型分组，编码后的字节序与 CompareValues 的顺序一致
+func encodeKeyValue(value interface{}) []byte {
+	return appendKeyValue(nil, value)
+}
+
+func appendKeyValue(dst []byte, value interface{}) []byte {
+	dst = append(dst, byte(canonicalType(value)))
+
+	switch v := value.(type) {
+	case int, int32, int64, float32, float64:
+		return appendKeyNumber(dst, v)
+	case string:
+		return appendKeyString(dst, v)
+	case Document, map[string]interface{}:
+		doc := toDocument(v)
+		for _, key := range sortedKeys(doc) {
+			dst = append(dst, byte(canonicalType(doc[key])))
+			dst = appendKeyString(dst, key)
+			dst = appendKeyValue(dst, doc[key])
+		}
+		return append(dst, 0x00)
+	case []interface{}, []Document:
+		for _, elem := range toArray(v) {
+			dst = appendKeyValue(dst, elem)
+		}
+		return append(dst, 0x00)
+	case []byte, Binary:
+		b, _ := toBinary(v)
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(b.Data)))
+		dst = append(dst, b.Subtype)
+		return append(dst, b.Data...)
+	case ObjectID:
+		return append(dst, v[:]...)
+	case bool:
+		if v {
+			return append(dst, 1)
+		}
+		return append(dst, 0)
+	case time.Time:
+		return binary.BigEndian.AppendUint64(dst, uint64(v.UnixMilli())^(1<<63))
+	case Timestamp:
+		dst = binary.BigEndian.AppendUint32(dst, v.T)
+		return binary.BigEndian.AppendUint32(dst, v.I)
+	case Regex:
+		dst = appendKeyString(dst, v.Pattern)
+		return appendKeyString(dst, v.Options)
+	}
+	return dst
+}
+
+// appendKeyNumber 编码数值：先编码最接近的 float64，再编码整数与该 float64 的差值
+// 绝对值超过 2^53 的 int64 转为 float64 时会舍入，差值保证相邻的大整数编码不同且顺序正确；
+// 舍入误差不超过半个 ulp，int64 范围内最大为 2^9，用 2 字节翻转符号位的补码表示，浮点数的差值总为 0
+func appendKeyNumber(dst []byte, v interface{}) []byte {
+	f := toFloat64(v)
+	dst = appendKeyFloat(dst, f)
+	var diff int64
+	if i, ok := toInt64(v); ok {
+		diff = int64(uint64(i) - floatToUint64Bits(f))
+	}
+	return binary.BigEndian.AppendUint16(dst, uint16(diff)^0x8000)
+}
+
+// floatToUint64Bits 返回整数舍入得到的 float64 对应的 int64 补码，2^63 超出 int64 范围，按补码回绕
+func floatToUint64Bits(f float64) uint64 {
+	if f >= 1<<63 {
+		return 1 << 63
+	}
+	return uint64(int64(f))
+}
+
+// appendKeyFloat 编码浮点数，负数翻转全部位，非负数翻转符号位
+func appendKeyFloat(dst []byte, f float64) []byte {
+	if f == 0 {
+		f = 0 // 统一 -0 与 +0
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(dst, bits)
+}
+
+// appendKeyString 编码字符串，0x00 转义为 0x00 0xFF，以 0x00 0x00 结尾
+func appendKeyString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		dst = append(dst, s[i])
+		if s[i] == 0x00 {
+			dst = append(dst, 0xFF)
+		}
+	}
+	return append(dst, 0x00, 0x00)
+}
+
+// keySuccessor 返回大于所有以 key 为前缀的字节串的最小键，用作范围扫描的开区间上界
+// 按大端整数加一并截去末尾进位的 0xFF，key 全部为 0xFF 时返回 nil 表示没有上界
+func keySuccessor(key []byte) []byte {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] != 0xFF {
+			next := append([]byte(nil), key[:i+1]...)
+			next[i]++
+			return next
+		}
+	}
+	return nil
+}
+
+// 类型信息中数值的标记，索引键不区分数值类型，还原时需要原来的类型
+const (
+	keyTypeDouble = 'd'
+	keyTypeInt32  = 'i'
+	keyTypeInt64  = 'l'
+	keyTypeOpaque = 'x' // Decimal128 等索引键中没有保存取值的数值，不能还原
+)
+
+// errKeyNotDecodable 索引键中没有保存还原取值所需的全部信息
+var errKeyNotDecodable = errors.New("索引键无法还原为取值")
+
+// appendKeyTypeBits 追加从索引键还原取值所需的类型信息
+// 按 appendKeyValue 的编码顺序为每个数值记录原来的类型，其他类型可以直接从索引键还原
+func appendKeyTypeBits(bits []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case int32:
+		return append(bits, keyTypeInt32)
+	case int64, int:
+		return append(bits, keyTypeInt64)
+	case float64, float32:
+		return append(bits, keyTypeDouble)
+	case Decimal128:
+		return append(bits, keyTypeOpaque)
+	case Document, map[string]interface{}:
+		doc := toDocument(v)
+		for _, key := range sortedKeys(doc) {
+			bits = appendKeyTypeBits(bits, doc[key])
+		}
+	case []interface{}, []Document:
+		for _, elem := range toArray(v) {
+			bits = appendKeyTypeBits(bits, elem)
+		}
+	}
+	return bits
+}
+
+// decodeKeyValue 从索引键开头还原 appendKeyValue 编码的一个值，bits 为 appendKeyTypeBits 生成的类型信息
+// 返回剩余的索引键和类型信息；索引键中没有保存取值时返回 errKeyNotDecodable
+func decodeKeyValue(key, bits []byte) (interface{}, []byte, []byte, error) {
+	if len(key) == 0 {
+		return nil, nil, nil, errKeyNotDecodable
+	}
+	t, key := int(key[0]), key[1:]
+	switch t {
+	case canonicalMinKey:
+		return MinKey{}, key, bits, nil
+	case canonicalMaxKey:
+		return MaxKey{}, key, bits, nil
+	case canonicalNull:
+		return nil, key, bits, nil
+	case canonicalNumber:
+		if len(bits) == 0 || bits[0] == keyTypeOpaque || len(key) < 10 {
+			return nil, nil, nil, errKeyNotDecodable
+		}
+		f := decodeKeyFloat(key[:8])
+		diff := int64(int16(binary.BigEndian.Uint16(key[8:10]) ^ 0x8000))
+		tag, key, bits := bits[0], key[10:], bits[1:]
+		switch tag {
+		case keyTypeDouble:
+			return f, key, bits, nil
+		case keyTypeInt32:
+			return int32(f), key, bits, nil
+		case keyTypeInt64:
+			return int64(floatToUint64Bits(f) + uint64(diff)), key, bits, nil
+		}
+	case canonicalString:
+		if s, rest, ok := decodeKeyString(key); ok {
+			return s, rest, bits, nil
+		}
+	case canonicalDocument:
+		doc := Document{}
+		for len(key) > 0 {
+			if key[0] == 0x00 {
+				return doc, key[1:], bits, nil
+			}
+			name, rest, ok := decodeKeyString(key[1:])
+			if !ok {
+				break
+			}
+			var v interface{}
+			var err error
+			if v, key, bits, err = decodeKeyValue(rest, bits); err != nil {
+				return nil, nil, nil, err
+			}
+			doc[name] = v
+		}
+	case canonicalArray:
+		arr := []interface{}{}
+		for len(key) > 0 {
+			if key[0] == 0x00 {
+				return arr, key[1:], bits, nil
+			}
+			var v interface{}
+			var err error
+			if v, key, bits, err = decodeKeyValue(key, bits); err != nil {
+				return nil, nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+	case canonicalBinary:
+		if len(key) >= 5 {
+			n := int(binary.BigEndian.Uint32(key))
+			if len(key) >= 5+n {
+				return newBinaryValue(key[4], key[5:5+n]), key[5+n:], bits, nil
+			}
+		}
+	case canonicalObjectID:
+		if len(key) >= 12 {
+			var id ObjectID
+			copy(id[:], key)
+			return id, key[12:], bits, nil
+		}
+	case canonicalBoolean:
+		if len(key) >= 1 {
+			return key[0] == 1, key[1:], bits, nil
+		}
+	case canonicalDate:
+		if len(key) >= 8 {
+			millis := int64(binary.BigEndian.Uint64(key) ^ (1 << 63))
+			return time.UnixMilli(millis).UTC(), key[8:], bits, nil
+		}
+	case canonicalTimestamp:
+		if len(key) >= 8 {
+			return Timestamp{T: binary.BigEndian.Uint32(key), I: binary.BigEndian.Uint32(key[4:])}, key[8:], bits, nil
+		}
+	case canonicalRegex:
+		if pattern, rest, ok := decodeKeyString(key); ok {
+			if options, rest, ok := decodeKeyString(rest); ok {
+				return Regex{Pattern: pattern, Options: options}, rest, bits, nil
+			}
+		}
+	}
+	return nil, nil, nil, errKeyNotDecodable
+}
+
+// decodeKeyFloat 还原 appendKeyFloat 编码的浮点数
+func decodeKeyFloat(b []byte) float64 {
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+// decodeKeyString 还原 appendKeyString 编码的字符串
+func decodeKeyString(key []byte) (string, []byte, bool) {
+	var s []byte
+	for i := 0; i+1 < len(key); i++ {
+		if key[i] != 0x00 {
+			s = append(s, key[i])
+			continue
+		}
+		switch key[i+1] {
+		case 0x00:
+			return string(s), key[i+2:], true
+		case 0xFF:
+			s = append(s, 0x00)
+			i++
+		default:
+			return "", nil, false
+		}
+	}
+	return "", nil, false
+}
@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 	
 	"github.com/google/uuid"
+	"github.com/zhukovaskychina/xmongodb/server/storage/btree"
 )
 
 // KVEngine 键值存储引擎接口
@@ -22,6 +23,7 @@ type KVEngine interface {
 	// RecordStore 管理
 	GetRecordStore(namespace string) (RecordStore, error)
 	CreateRecordStore(namespace string) (RecordStore, error)
+	CreateCappedRecordStore(namespace string, maxSize, maxDocs int64) (RecordStore, error)
 	DropRecordStore(namespace string) error
 	
 	// SortedDataInterface（索引）管理
@@ -45,8 +47,8 @@ type WiredTigerKVEngine struct {
 	recordStores map[string]RecordStore
 	
 	// SortedDataInterface（索引）管理
-	// namespace.indexName -> SortedDataInterface
-	indexes map[string]SortedDataInterface
+	// (namespace, indexName) -> SortedDataInterface
+	indexes map[indexKey]SortedDataInterface
 	
 	// 会话管理
 	sessions     map[string]EngineSession
@@ -66,6 +68,9 @@ type KVEngineConfig struct {
 	
 	// 是否启用检查点
 	CheckpointEnabled bool
+
+	// RecordStore 和索引 B+树的阶数，0 表示使用默认阶数 btree.DefaultOrder
+	BTreeOrder int
 }
 
 // NewKVEngine 创建新的 KV 引擎
@@ -76,10 +81,13 @@ func NewKVEngine(config KVEngineConfig) KVEngine {
 	if config.CacheSize == 0 {
 		config.CacheSize = 1024 * 1024 * 1024 // 默认 1GB
 	}
+	if config.BTreeOrder == 0 {
+		config.BTreeOrder = btree.DefaultOrder
+	}
 	
 	return &WiredTigerKVEngine{
 		recordStores: make(map[string]RecordStore),
-		indexes:      make(map[string]SortedDataInterface),
+		indexes:      make(map[indexKey]SortedDataInterface),
 		sessions:     make(map[string]EngineSession),
 		config:       config,
 	}
@@ -168,12 +176,27 @@ func (e *WiredTigerKVEngine) CreateRecordStore(namespace string) (RecordStore, e
 		return nil, fmt.Errorf("RecordStore %s 已存在", namespace)
 	}
 	
-	rs := NewRecordStore(namespace)
+	rs := NewRecordStore(namespace, e.config.BTreeOrder)
 	e.recordStores[namespace] = rs
 	
 	return rs, nil
 }
 
+// CreateCappedRecordStore 创建固定集合的 RecordStore
+func (e *WiredTigerKVEngine) CreateCappedRecordStore(namespace string, maxSize, maxDocs int64) (RecordStore, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, exists := e.recordStores[namespace]; exists {
+		return nil, fmt.Errorf("RecordStore %s 已存在", namespace)
+	}
+
+	rs := NewCappedRecordStore(namespace, maxSize, maxDocs, e.config.BTreeOrder)
+	e.recordStores[namespace] = rs
+
+	return rs, nil
+}
+
 // DropRecordStore 删除 RecordStore
 func (e *WiredTigerKVEngine) DropRecordStore(namespace string) error {
 	e.mu.Lock()
@@ -185,9 +208,10 @@ func (e *WiredTigerKVEngine) DropRecordStore(namespace string) error {
 	
 	delete(e.recordStores, namespace)
 	
-	// 同时删除相关的索引
+	// 同时删除相关的索引，按命名空间精确匹配
+	// 集合名可以包含 "."，按前缀匹配时删除 db.fs 会误删 db.fs.files 的索引
 	for key := range e.indexes {
-		if len(key) > len(namespace) && key[:len(namespace)] == namespace {
+		if key.namespace == namespace {
 			delete(e.indexes, key)
 		}
 	}
@@ -219,7 +243,7 @@ func (e *WiredTigerKVEngine) CreateSortedDataInterface(namespace, indexName stri
 		return nil, fmt.Errorf("索引 %s.%s 已存在", namespace, indexName)
 	}
 	
-	idx := NewSortedDataInterface(indexName, unique)
+	idx := NewSortedDataInterface(indexName, unique, e.config.BTreeOrder)
 	e.indexes[key] = idx
 	
 	return idx, nil
@@ -252,6 +276,7 @@ func (e *WiredTigerKVEngine) GetStats() map[string]interface{} {
 	stats["total_sessions_created"] = atomic.LoadInt64(&e.sessionCount)
 	stats["cache_size"] = e.config.CacheSize
 	stats["max_sessions"] = e.config.MaxSessions
+	stats["btree_order"] = e.config.BTreeOrder
 	
 	// RecordStore 统计
 	var totalRecords, totalDataSize int64
@@ -272,7 +297,13 @@ func (e *WiredTigerKVEngine) GetStats() map[string]interface{} {
 	return stats
 }
 
+// indexKey 索引在 KV 引擎中的键
+type indexKey struct {
+	namespace string
+	indexName string
+}
+
 // makeIndexKey 创建索引键
-func makeIndexKey(namespace, indexName string) string {
-	return namespace + "." + indexName
+func makeIndexKey(namespace, indexName string) indexKey {
+	return indexKey{namespace: namespace, indexName: indexName}
 }
@@ -0,0 +1,551 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matches 判断文档是否满足过滤条件
+// 支持字段相等匹配、点号路径、数组元素匹配、比较操作符 $eq/$ne/$gt/$gte/$lt/$lte/$in/$nin
+// 结构操作符 $exists/$type/$size，数组操作符 $all/$elemMatch，以及逻辑操作符 $and/$or/$nor 和字段上的 $not
+// 顶层的 $jsonSchema 按 JSON Schema 规则检查整个文档，见 parseJSONSchema
+// 顶层的 $expr 用聚合表达式计算文档，结果为真时匹配，可以比较同一文档的不同字段，见 EvalExpression
+func Matches(doc, filter Document) (bool, error) {
+	ok, err := matchDocument(doc, filter)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	return ok, nil
+}
+
+// matchDocument 依次匹配过滤条件中的每个字段，多个字段之间为隐式的 $and
+func matchDocument(doc, filter Document) (bool, error) {
+	for _, key := range sortedKeys(filter) {
+		var (
+			ok  bool
+			err error
+		)
+		switch {
+		case key == "$and" || key == "$or" || key == "$nor":
+			ok, err = matchLogical(doc, key, filter[key])
+		case key == "$jsonSchema":
+			var schema *jsonSchema
+			if schema, err = parseJSONSchema(filter[key]); err == nil {
+				ok = schema.matches(doc)
+			}
+		case key == "$expr":
+			var value interface{}
+			if value, err = evalExpression(filter[key], doc); err == nil {
+				ok = isTruthy(value)
+			}
+		case strings.HasPrefix(key, "$"):
+			return false, fmt.Errorf("未知的顶层操作符: %s", key)
+		default:
+			ok, err = matchField(doc, key, filter[key])
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// logicalBranches 读取 $and/$or/$nor 的参数，必须是非空的过滤条件数组
+func logicalBranches(op string, operand interface{}) ([]Document, error) {
+	arr := toArray(operand)
+	if len(arr) == 0 {
+		return nil, fmt.Errorf("%s 需要非空数组参数", op)
+	}
+	branches := make([]Document, len(arr))
+	for i, elem := range arr {
+		branch := toDocument(elem)
+		if branch == nil {
+			return nil, fmt.Errorf("%s 数组的元素必须是文档", op)
+		}
+		branches[i] = branch
+	}
+	return branches, nil
+}
+
+// matchLogical 匹配 $and/$or/$nor，结果确定后不再匹配后续分支
+func matchLogical(doc Document, op string, operand interface{}) (bool, error) {
+	branches, err := logicalBranches(op, operand)
+	if err != nil {
+		return false, err
+	}
+	for _, branch := range branches {
+		ok, err := matchDocument(doc, branch)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !ok:
+			return false, nil
+		case op == "$or" && ok:
+			return true, nil
+		case op == "$nor" && ok:
+			return false, nil
+		}
+	}
+	// $and 与 $nor 全部分支通过，$or 没有分支匹配
+	return op != "$or", nil
+}
+
+// matchField 匹配单个字段的条件
+func matchField(doc Document, path string, cond interface{}) (bool, error) {
+	values := lookupPath(doc, strings.Split(path, "."))
+
+	ops, isOps, err := operatorDocument(cond)
+	if err != nil {
+		return false, err
+	}
+	if !isOps {
+		return matchEquality(values, cond), nil
+	}
+	return matchOperators(values, ops)
+}
+
+// matchOperators 对路径上取到的值应用操作符文档中的全部操作符
+func matchOperators(values []interface{}, ops Document) (bool, error) {
+	// $maxDistance 等参数与 $near 写在同一个操作符文档中，需要一起处理
+	if isNearQuery(ops) {
+		return matchNear(values, ops)
+	}
+	for _, op := range sortedKeys(ops) {
+		ok, err := matchOperator(values, op, ops[op])
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// operatorDocument 判断条件是否为操作符文档，如 {$gt: 1}
+// 操作符文档中不允许混用普通字段
+func operatorDocument(cond interface{}) (Document, bool, error) {
+	doc := toDocument(cond)
+	if len(doc) == 0 {
+		return nil, false, nil
+	}
+
+	operators := 0
+	for key := range doc {
+		if strings.HasPrefix(key, "$") {
+			operators++
+		}
+	}
+	if operators == 0 {
+		return nil, false, nil
+	}
+	if operators != len(doc) {
+		return nil, false, fmt.Errorf("操作符文档中不能包含普通字段: %v", sortedKeys(doc))
+	}
+	return doc, true, nil
+}
+
+// matchOperator 对路径上取到的值应用单个操作符
+func matchOperator(values []interface{}, op string, operand interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEquality(values, operand), nil
+	case "$ne":
+		return !matchEquality(values, operand), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return matchComparison(values, op, operand), nil
+	case "$in":
+		candidates, ok := operand.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("$in 需要数组参数")
+		}
+		return matchIn(values, candidates), nil
+	case "$nin":
+		candidates, ok := operand.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("$nin 需要数组参数")
+		}
+		return !matchIn(values, candidates), nil
+	case "$not":
+		// $not 取反整个操作符文档，字段缺失时 {$not: {$gt: 5}} 也匹配
+		ops, isOps, err := operatorDocument(operand)
+		if err != nil {
+			return false, err
+		}
+		if !isOps {
+			return false, fmt.Errorf("$not 需要操作符文档参数")
+		}
+		ok, err := matchOperators(values, ops)
+		return !ok, err
+	case "$all":
+		return matchAll(values, operand)
+	case "$elemMatch":
+		return matchElemMatch(values, operand)
+	case "$exists":
+		exists, ok := operand.(bool)
+		if !ok {
+			// 与 mongod 一致，非布尔参数按真值处理：数值 0 和 null 视为 false
+			exists = operand != nil && (canonicalType(operand) != canonicalNumber || toFloat64(operand) != 0)
+		}
+		return (len(values) > 0) == exists, nil
+	case "$type":
+		return matchType(values, operand)
+	case "$size":
+		return matchSize(values, operand)
+	case "$geoWithin", "$within":
+		return matchGeoWithin(values, operand)
+	default:
+		return false, fmt.Errorf("未知的操作符: %s", op)
+	}
+}
+
+// matchEquality 相等匹配，数组字段的任一元素相等即匹配，null 同时匹配缺失字段
+func matchEquality(values []interface{}, operand interface{}) bool {
+	if len(values) == 0 {
+		return operand == nil
+	}
+	return anyValue(values, func(v interface{}) bool {
+		return valuesEqual(v, operand)
+	})
+}
+
+// matchIn 匹配 $in 中的任一值
+func matchIn(values []interface{}, candidates []interface{}) bool {
+	for _, candidate := range candidates {
+		if matchEquality(values, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchComparison 范围比较，只比较同一类型分组的值
+func matchComparison(values []interface{}, op string, operand interface{}) bool {
+	if len(values) == 0 {
+		return operand == nil && (op == "$gte" || op == "$lte")
+	}
+	return anyValue(values, func(v interface{}) bool {
+		if canonicalType(v) != canonicalType(operand) {
+			return false
+		}
+		c := CompareValues(v, operand)
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		default:
+			return c <= 0
+		}
+	})
+}
+
+// matchAll 匹配 $all，参数中的每个值都要与字段或其数组元素相等，空数组不匹配任何文档
+// 参数元素可以是 {$elemMatch: ...}，要求存在满足该条件的数组元素
+func matchAll(values []interface{}, operand interface{}) (bool, error) {
+	candidates, ok := operand.([]interface{})
+	if !ok {
+		return false, fmt.Errorf("$all 需要数组参数")
+	}
+	if len(candidates) == 0 {
+		return false, nil
+	}
+	for _, candidate := range candidates {
+		var (
+			matched bool
+			err     error
+		)
+		if ops, isOps, _ := operatorDocument(candidate); isOps {
+			cond, ok := ops["$elemMatch"]
+			if !ok || len(ops) != 1 {
+				return false, fmt.Errorf("$all 中的操作符只能是 $elemMatch")
+			}
+			matched, err = matchElemMatch(values, cond)
+		} else {
+			matched = matchEquality(values, candidate)
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchElemMatch 匹配 $elemMatch，要求同一个数组元素满足全部条件
+// 参数为操作符文档时条件作用于元素的值，如 {$gt: 5, $lt: 10}；否则作为子过滤条件作用于文档元素，如 {qty: 5, price: {$gt: 1}}
+func matchElemMatch(values []interface{}, operand interface{}) (bool, error) {
+	cond := toDocument(operand)
+	if cond == nil {
+		return false, fmt.Errorf("$elemMatch 需要文档参数")
+	}
+	for _, v := range values {
+		if canonicalType(v) != canonicalArray {
+			continue
+		}
+		i, err := elemMatchIndex(toArray(v), cond)
+		if err != nil || i >= 0 {
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
+
+// elemMatchIndex 返回第一个满足 $elemMatch 条件的数组元素下标，没有时返回 -1
+func elemMatchIndex(arr []interface{}, cond Document) (int, error) {
+	ops, isOps, err := operatorDocument(cond)
+	if err != nil {
+		return -1, err
+	}
+	// 只含 $and/$or/$nor 的参数是作用于文档元素的子过滤条件
+	if isOps {
+		for op := range ops {
+			if op == "$and" || op == "$or" || op == "$nor" {
+				isOps = false
+				break
+			}
+		}
+	}
+
+	for i, elem := range arr {
+		var ok bool
+		if isOps {
+			ok, err = matchOperators([]interface{}{elem}, ops)
+		} else if doc := toDocument(elem); doc != nil {
+			ok, err = matchDocument(doc, cond)
+		}
+		if err != nil {
+			return -1, err
+		}
+		if ok {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// bsonTypeAliases $type 可以使用的类型别名及对应的 BSON 类型编号
+var bsonTypeAliases = map[string]int{
+	"double":    1,
+	"string":    2,
+	"object":    3,
+	"array":     4,
+	"binData":   5,
+	"undefined": 6,
+	"objectId":  7,
+	"bool":      8,
+	"date":      9,
+	"null":      10,
+	"regex":     11,
+	"int":       16,
+	"timestamp": 17,
+	"long":      18,
+	"decimal":   19,
+	"minKey":    -1,
+	"maxKey":    127,
+}
+
+// typeNumber $type 中的 "number" 别名，匹配全部数值类型
+const typeNumber = 0
+
+// bsonType 返回值对应的 BSON 类型编号，无法识别时返回 0
+func bsonType(v interface{}) int {
+	switch v.(type) {
+	case float64, float32:
+		return 1
+	case string:
+		return 2
+	case Document, map[string]interface{}:
+		return 3
+	case []interface{}, []Document:
+		return 4
+	case []byte, Binary:
+		return 5
+	case ObjectID:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case nil:
+		return 10
+	case Regex:
+		return 11
+	case int32:
+		return 16
+	case Timestamp:
+		return 17
+	case int64, int:
+		return 18
+	case Decimal128:
+		return 19
+	case MinKey:
+		return -1
+	case MaxKey:
+		return 127
+	}
+	return 0
+}
+
+// parseTypeOperand 解析 $type 的参数：类型编号、类型别名或由它们组成的数组
+func parseTypeOperand(operand interface{}) ([]int, error) {
+	if arr := toArray(operand); arr != nil {
+		if len(arr) == 0 {
+			return nil, fmt.Errorf("$type 的数组参数不能为空")
+		}
+		types := make([]int, 0, len(arr))
+		for _, elem := range arr {
+			t, err := parseTypeOperand(elem)
+			if err != nil {
+				return nil, err
+			}
+			types = append(types, t...)
+		}
+		return types, nil
+	}
+	if alias, ok := operand.(string); ok {
+		if alias == "number" {
+			return []int{typeNumber}, nil
+		}
+		t, ok := bsonTypeAliases[alias]
+		if !ok {
+			return nil, fmt.Errorf("未知的 $type 类型别名: %s", alias)
+		}
+		return []int{t}, nil
+	}
+	if canonicalType(operand) == canonicalNumber {
+		f := toFloat64(operand)
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("$type 的类型编号必须是整数: %v", operand)
+		}
+		for _, t := range bsonTypeAliases {
+			if t == int(f) {
+				return []int{t}, nil
+			}
+		}
+		return nil, fmt.Errorf("无效的 $type 类型编号: %v", operand)
+	}
+	return nil, fmt.Errorf("$type 需要类型编号或类型别名, 实际为 %v", operand)
+}
+
+// matchType 匹配 $type，数组字段本身或其任一元素的类型相符即匹配
+func matchType(values []interface{}, operand interface{}) (bool, error) {
+	types, err := parseTypeOperand(operand)
+	if err != nil {
+		return false, err
+	}
+	return anyValue(values, func(v interface{}) bool {
+		actual := bsonType(v)
+		for _, t := range types {
+			if t == typeNumber {
+				if canonicalType(v) == canonicalNumber {
+					return true
+				}
+				continue
+			}
+			if t == actual {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// matchSize 匹配 $size，字段必须是长度恰好为参数的数组，不展开数组元素
+func matchSize(values []interface{}, operand interface{}) (bool, error) {
+	if canonicalType(operand) != canonicalNumber {
+		return false, fmt.Errorf("$size 需要数值参数, 实际为 %v", operand)
+	}
+	f := toFloat64(operand)
+	if f != math.Trunc(f) || f < 0 {
+		return false, fmt.Errorf("$size 的参数必须是非负整数: %v", operand)
+	}
+	for _, v := range values {
+		if canonicalType(v) == canonicalArray && len(toArray(v)) == int(f) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// anyValue 对每个值及数组值的每个元素应用判定函数
+func anyValue(values []interface{}, pred func(interface{}) bool) bool {
+	for _, v := range values {
+		if pred(v) {
+			return true
+		}
+		for _, elem := range toArray(v) {
+			if pred(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// valuesEqual 判断两个值是否相等，数值按数学值比较
+func valuesEqual(a, b interface{}) bool {
+	return canonicalType(a) == canonicalType(b) && CompareValues(a, b) == 0
+}
+
+// lookupPath 按点号路径取值，路径经过数组时展开到每个元素
+// 数组后的数字路径段同时按下标取值
+func lookupPath(value interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{value}
+	}
+
+	if doc := toDocument(value); doc != nil {
+		child, ok := doc[parts[0]]
+		if !ok {
+			return nil
+		}
+		return lookupPath(child, parts[1:])
+	}
+
+	arr := toArray(value)
+	if arr == nil {
+		return nil
+	}
+	var out []interface{}
+	if idx, err := strconv.Atoi(parts[0]); err == nil && idx >= 0 && idx < len(arr) {
+		out = append(out, lookupPath(arr[idx], parts[1:])...)
+	}
+	for _, elem := range arr {
+		if toDocument(elem) != nil {
+			out = append(out, lookupPath(elem, parts)...)
+		}
+	}
+	return out
+}
+
+// DistinctValues 收集文档在字段路径上的不同取值，按首次出现的顺序返回
+// 数组值按元素展开，类型分组相同且值相等的视为同一个值，如 int32(1) 与 1.0
+func DistinctValues(docs []Document, field string) []interface{} {
+	parts := strings.Split(field, ".")
+	values := []interface{}{}
+	// 索引键编码中数值统一为 double，可直接作为去重的键
+	seen := make(map[string]bool)
+	add := func(v interface{}) {
+		key := string(encodeKeyValue(v))
+		if !seen[key] {
+			seen[key] = true
+			values = append(values, v)
+		}
+	}
+
+	for _, doc := range docs {
+		for _, v := range lookupPath(doc, parts) {
+			if arr := toArray(v); arr != nil {
+				for _, elem := range arr {
+					add(elem)
+				}
+				continue
+			}
+			add(v)
+		}
+	}
+	return values
+}
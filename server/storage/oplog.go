@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// oplog 所在的数据库和集合
+const (
+	OplogDatabase   = "local"
+	OplogCollection = "oplog.rs"
+)
+
+// oplog 条目的操作类型
+const (
+	OplogInsert = "i"
+	OplogUpdate = "u"
+	OplogDelete = "d"
+)
+
+// defaultOplogSizeBytes 未配置 oplog_size_mb 时 oplog 的大小上限
+const defaultOplogSizeBytes = 192 * 1024 * 1024
+
+// oplogSizeBytes 返回 oplog 固定集合的大小上限
+func (e *WiredTigerEngine) oplogSizeBytes() int64 {
+	if e.config.OplogSizeMB > 0 {
+		return int64(e.config.OplogSizeMB) * 1024 * 1024
+	}
+	return defaultOplogSizeBytes
+}
+
+// oplogCollection 返回 local.oplog.rs 集合，不存在时创建为固定集合
+func (e *WiredTigerEngine) oplogCollection(ctx context.Context) (*Collection, error) {
+	if coll := e.lookupCollection(OplogDatabase, OplogCollection); coll != nil {
+		return coll, nil
+	}
+
+	e.mu.Lock()
+	if _, exists := e.databases[OplogDatabase]; !exists {
+		e.databases[OplogDatabase] = &Database{
+			Name:        OplogDatabase,
+			Collections: make(map[string]*Collection),
+		}
+	}
+	e.mu.Unlock()
+
+	err := e.CreateCappedCollection(ctx, OplogDatabase, OplogCollection, e.oplogSizeBytes(), 0)
+	if err != nil && !errors.Is(err, ErrNamespaceExists) {
+		return nil, fmt.Errorf("创建 oplog 失败: %w", err)
+	}
+	return e.lookupCollection(OplogDatabase, OplogCollection), nil
+}
+
+// nextOpTime 生成单调递增的 oplog 时间戳，调用方需持有 oplogMu
+func (e *WiredTigerEngine) nextOpTime() Timestamp {
+	now := uint32(time.Now().Unix())
+	if now > e.lastOpTime.T {
+		e.lastOpTime = Timestamp{T: now, I: 1}
+	} else {
+		e.lastOpTime.I++
+	}
+	return e.lastOpTime
+}
+
+// logOp 为集合上的一次写操作追加 oplog 条目，调用方需持有 oplogMu
+// local 数据库上的写操作不记录
+// 插入记录完整文档，更新记录更新文档并在 o2 中记录 _id，删除记录 _id
+func (e *WiredTigerEngine) logOp(ctx context.Context, coll *Collection, op string, o, o2 Document) error {
+	if strings.HasPrefix(coll.Namespace, OplogDatabase+".") {
+		return nil
+	}
+
+	oplog, err := e.oplogCollection(ctx)
+	if err != nil {
+		return err
+	}
+
+	entry := Document{
+		"ts":   e.nextOpTime(),
+		"op":   op,
+		"ns":   coll.Namespace,
+		"o":    cloneDocument(o),
+		"wall": time.Now().UTC(),
+	}
+	if o2 != nil {
+		entry["o2"] = cloneDocument(o2)
+	}
+	if _, _, err := e.insertRecord(ctx, oplog, entry); err != nil {
+		return fmt.Errorf("写入 oplog 失败: %w", err)
+	}
+	return nil
+}
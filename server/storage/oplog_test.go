@@ -0,0 +1,82 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestOplog 测试增删改按顺序写入 local.oplog.rs
+func TestOplog(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	if err := engine.Insert(ctx, "test", "users", []storage.Document{
+		{"_id": int32(1), "name": "Alice"},
+		{"_id": int32(2), "name": "Bob"},
+	}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if _, err := engine.Update(ctx, "test", "users", storage.Document{"_id": int32(1)},
+		storage.Document{"$set": storage.Document{"age": int32(30)}}, storage.UpdateOptions{}); err != nil {
+		t.Fatalf("更新失败: %v", err)
+	}
+	if _, err := engine.Update(ctx, "test", "users", storage.Document{"_id": int32(2)},
+		storage.Document{"name": "Robert"}, storage.UpdateOptions{}); err != nil {
+		t.Fatalf("替换失败: %v", err)
+	}
+	if _, err := engine.Delete(ctx, "test", "users", storage.Document{"_id": int32(1)}, true); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	// 失败的写操作不应记录
+	if err := engine.Insert(ctx, "test", "users", []storage.Document{{"_id": int32(2)}}); err == nil {
+		t.Fatal("重复 _id 应插入失败")
+	}
+	// local 数据库上的写操作不记录
+	if err := engine.Insert(ctx, "local", "startup_log", []storage.Document{{"_id": "host"}}); err != nil {
+		t.Fatalf("插入 local 失败: %v", err)
+	}
+
+	entries, err := engine.Find(ctx, storage.OplogDatabase, storage.OplogCollection, storage.Document{})
+	if err != nil {
+		t.Fatalf("读取 oplog 失败: %v", err)
+	}
+
+	want := []struct {
+		op string
+		o  storage.Document
+		o2 storage.Document
+	}{
+		{storage.OplogInsert, storage.Document{"_id": int32(1), "name": "Alice"}, nil},
+		{storage.OplogInsert, storage.Document{"_id": int32(2), "name": "Bob"}, nil},
+		{storage.OplogUpdate, storage.Document{"$set": storage.Document{"age": int32(30)}}, storage.Document{"_id": int32(1)}},
+		{storage.OplogUpdate, storage.Document{"_id": int32(2), "name": "Robert"}, storage.Document{"_id": int32(2)}},
+		{storage.OplogDelete, storage.Document{"_id": int32(1)}, nil},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("oplog 条目数 = %d, want %d: %v", len(entries), len(want), entries)
+	}
+
+	var last storage.Timestamp
+	for i, entry := range entries {
+		if entry["op"] != want[i].op || entry["ns"] != "test.users" {
+			t.Errorf("条目 %d 操作不正确: %v", i, entry)
+		}
+		if storage.CompareValues(entry["o"], want[i].o) != 0 {
+			t.Errorf("条目 %d o = %v, want %v", i, entry["o"], want[i].o)
+		}
+		if want[i].o2 != nil && storage.CompareValues(entry["o2"], want[i].o2) != 0 {
+			t.Errorf("条目 %d o2 = %v, want %v", i, entry["o2"], want[i].o2)
+		}
+		ts, ok := entry["ts"].(storage.Timestamp)
+		if !ok || storage.CompareValues(ts, last) <= 0 {
+			t.Errorf("条目 %d 时间戳未递增: %v", i, entry["ts"])
+		}
+		last = ts
+	}
+}
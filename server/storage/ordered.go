@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/zhukovaskychina/xmongodb/server/protocol/bsoncore"
+)
+
+// DocElement 有序文档中的一个字段
+type DocElement struct {
+	Key   string
+	Value interface{}
+}
+
+// OrderedDocument 保留字段顺序的文档
+// Document 是 map，字段顺序在写入时丢失；需要确定的字段顺序时使用 OrderedDocument，
+// 编码为 BSON 时顶层的 _id 总在最前，其余字段保持原有顺序
+type OrderedDocument []DocElement
+
+// Lookup 返回字段的值，字段不存在时 ok 为 false
+func (d OrderedDocument) Lookup(key string) (value interface{}, ok bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Map 转换为 Document，嵌套的有序文档同样转换，字段重复时以最后一个为准
+func (d OrderedDocument) Map() Document {
+	doc := make(Document, len(d))
+	for _, e := range d {
+		doc[e.Key] = orderedToMapValue(e.Value)
+	}
+	return doc
+}
+
+func orderedToMapValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case OrderedDocument:
+		return v.Map()
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i := range v {
+			arr[i] = orderedToMapValue(v[i])
+		}
+		return arr
+	default:
+		return value
+	}
+}
+
+// NewOrderedDocument 把 Document 转换为有序文档
+// map 没有字段顺序，与 MarshalDocument 一致 _id 在最前，其余字段按字典序；嵌套的文档同样转换
+func NewOrderedDocument(doc Document) OrderedDocument {
+	ordered := make(OrderedDocument, 0, len(doc))
+	for _, key := range sortedKeys(doc) {
+		ordered = append(ordered, DocElement{Key: key, Value: mapToOrderedValue(doc[key])})
+	}
+	return ordered
+}
+
+func mapToOrderedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case Document:
+		return NewOrderedDocument(v)
+	case map[string]interface{}:
+		return NewOrderedDocument(Document(v))
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i := range v {
+			arr[i] = mapToOrderedValue(v[i])
+		}
+		return arr
+	default:
+		return value
+	}
+}
+
+// MarshalOrderedDocument 按字段顺序将有序文档编码为 BSON，顶层的 _id 移到最前
+func MarshalOrderedDocument(doc OrderedDocument) ([]byte, error) {
+	idx, dst := bsoncore.AppendDocumentStart(nil)
+	var err error
+	if id, ok := doc.Lookup("_id"); ok {
+		if dst, err = appendElement(dst, "_id", id); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range doc {
+		if e.Key == "_id" {
+			continue
+		}
+		if dst, err = appendElement(dst, e.Key, e.Value); err != nil {
+			return nil, err
+		}
+	}
+	return bsoncore.AppendDocumentEnd(dst, idx)
+}
+
+// UnmarshalOrderedDocument 将 BSON 解码为有序文档，嵌套的文档同样保留字段顺序
+func UnmarshalOrderedDocument(data []byte) (OrderedDocument, error) {
+	raw := bsoncore.Document(data)
+	if err := raw.Validate(); err != nil {
+		return nil, fmt.Errorf("无效的 BSON 文档: %w", err)
+	}
+	return decodeOrderedDocument(raw)
+}
+
+func appendOrderedDocument(dst []byte, doc OrderedDocument) ([]byte, error) {
+	idx, dst := bsoncore.AppendDocumentStart(dst)
+	for _, e := range doc {
+		var err error
+		if dst, err = appendElement(dst, e.Key, e.Value); err != nil {
+			return nil, err
+		}
+	}
+	return bsoncore.AppendDocumentEnd(dst, idx)
+}
+
+func decodeOrderedDocument(raw bsoncore.Document) (OrderedDocument, error) {
+	elements, err := raw.Elements()
+	if err != nil {
+		return nil, err
+	}
+	doc := make(OrderedDocument, 0, len(elements))
+	for _, element := range elements {
+		value, err := decodeOrderedValue(element.Value())
+		if err != nil {
+			return nil, fmt.Errorf("解码字段 %s 失败: %w", element.Key(), err)
+		}
+		doc = append(doc, DocElement{Key: element.Key(), Value: value})
+	}
+	return doc, nil
+}
+
+// decodeOrderedValue 与 decodeValue 相同，但文档（包括数组中的文档）解码为有序文档
+func decodeOrderedValue(value bsoncore.Value) (interface{}, error) {
+	switch value.Type {
+	case bsoncore.TypeEmbeddedDocument:
+		return decodeOrderedDocument(value.Document())
+	case bsoncore.TypeArray:
+		values, err := value.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, len(values))
+		for i, v := range values {
+			if arr[i], err = decodeOrderedValue(v); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return decodeValue(value)
+	}
+}
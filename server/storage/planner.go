@@ -0,0 +1,1189 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 查询计划阶段
+const (
+	StageCollScan = "COLLSCAN" // 全表扫描
+	StageIxScan   = "IXSCAN"   // 索引扫描
+	StageFetch    = "FETCH"    // 根据索引扫描得到的 RecordId 读取文档
+	StageText     = "TEXT"     // 文本索引扫描
+	StageOr       = "OR"       // 分别扫描 $or 每个分支使用的索引并合并结果
+)
+
+const (
+	maxIndexIntervals = 200  // 一个计划最多展开的索引扫描区间数，$in 组合超过时不再使用后续字段
+	maxCachedPlans    = 1000 // 每个集合缓存的查询计划数上限，超过时清空重建
+)
+
+// QueryPlan 查询计划
+type QueryPlan struct {
+	Stage      string       // COLLSCAN、IXSCAN、OR、TEXT、GEO_NEAR_2D 或 GEO_NEAR_2DSPHERE
+	IndexName  string       // 使用的索引名，COLLSCAN 为空
+	KeyPattern Document     // 使用的索引键模式
+	IsMultiKey bool         // IXSCAN 使用的索引是否为多键索引
+	Filter     Document     // 查询的过滤条件
+	FromCache  bool         // 计划是否来自计划缓存
+	TextTerms  []string     // TEXT 计划的搜索词元
+	Branches   []*QueryPlan // OR 计划中每个 $or 分支的索引扫描计划
+	Covered    bool         // IXSCAN 计划是否只用索引键返回结果，见 coverPlan
+	Projection Document     // 覆盖查询的投影
+
+	// 按集合样本估计的需要读取的文档数和满足过滤条件的文档数，只在 Explain 中计算，无法估计时为 -1，见 estimatePlan
+	CostEstimate        float64
+	CardinalityEstimate float64
+
+	intervals     []keyInterval // 需要扫描的索引键区间，按字节序排列且互不重叠
+	coveredFields []string      // 覆盖查询按索引键还原的字段，与键模式的顺序一致
+	residual      Document      // TEXT 计划读取文档后需要检查的 $text 以外的条件
+	near          *nearQuery    // GEO_NEAR 计划的距离条件
+	pointLookup   bool          // 单字段唯一索引上只有一个等值键，例如 {_id: x}，用 SeekExact 直接取得 RecordId
+	bounded       Document      // IXSCAN 计划中用于计算扫描区间的字段条件
+	nearField     string        // GEO_NEAR 计划的坐标字段
+}
+
+// keyInterval 索引键的左闭右开区间，end 为 nil 时没有上界
+type keyInterval struct {
+	start, end []byte
+}
+
+// ExecutionStats 查询执行统计
+type ExecutionStats struct {
+	NReturned     int64         // 返回的文档数
+	KeysExamined  int64         // 扫描的索引条目数
+	DocsExamined  int64         // 读取的文档数
+	ExecutionTime time.Duration // 执行耗时
+}
+
+// executionStatsKey 携带执行统计的 context 键
+type executionStatsKey struct{}
+
+// WithExecutionStats 返回携带执行统计的 context
+// 在该 context 上执行的查询、更新和删除把扫描的索引条目数和读取的文档数累加到 stats
+func WithExecutionStats(ctx context.Context, stats *ExecutionStats) context.Context {
+	return context.WithValue(ctx, executionStatsKey{}, stats)
+}
+
+// Explanation explain 的结果
+type Explanation struct {
+	Namespace string
+	Plan      *QueryPlan
+	Rejected  []*QueryPlan    // 未被选中的候选计划：其他可用的单索引计划和全表扫描
+	Stats     *ExecutionStats // 只生成查询计划时为 nil
+}
+
+// Explain 返回查询的执行计划，execute 为 true 时执行查询并收集执行统计
+// hint 不为 nil 时按查询提示构造计划；集合不存在时返回全表扫描计划
+// projection 为查询结果的投影，只用于判断能否覆盖查询，为空时总是读取文档
+func (e *WiredTigerEngine) Explain(ctx context.Context, database, collection string, filter, projection Document, hint *Hint, execute bool) (*Explanation, error) {
+	result := &Explanation{Namespace: makeNamespace(database, collection)}
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		result.Plan = &QueryPlan{Stage: StageCollScan, Filter: filter}
+		if execute {
+			result.Stats = &ExecutionStats{}
+		}
+		return result, nil
+	}
+
+	var err error
+	if hint != nil {
+		result.Plan, err = hintedPlan(coll, filter, hint)
+	} else {
+		result.Plan, err = planQuery(coll, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	coverPlan(coll, result.Plan, projection)
+	estimatePlan(coll, result.Plan)
+	if hint == nil && (result.Plan.Stage == StageIxScan || result.Plan.Stage == StageCollScan) {
+		result.Rejected = rejectedPlans(coll, filter, result.Plan)
+	}
+	if !execute {
+		return result, nil
+	}
+	result.Stats = &ExecutionStats{}
+	start := time.Now()
+	matches, err := e.runPlan(ctx, coll, result.Plan, filter, false, result.Stats)
+	if err != nil {
+		return nil, err
+	}
+	result.Stats.NReturned = int64(len(matches))
+	result.Stats.ExecutionTime = time.Since(start)
+	return result, nil
+}
+
+// planCache 按过滤条件的结构缓存选中的索引
+// 结构相同的查询只是取值不同，选出的索引相同，扫描区间每次按实际取值重新计算
+type planCache struct {
+	mu      sync.Mutex
+	entries map[string]string // 查询结构到索引名的映射，空字符串表示全表扫描
+}
+
+func newPlanCache() *planCache {
+	return &planCache{entries: make(map[string]string)}
+}
+
+// get 查找缓存的计划
+func (c *planCache) get(shape string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.entries[shape]
+	return name, ok
+}
+
+// put 缓存查询结构选中的索引
+func (c *planCache) put(shape, indexName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedPlans {
+		c.entries = make(map[string]string)
+	}
+	c.entries[shape] = indexName
+}
+
+// clear 清空缓存，索引增删或索引变为多键索引后调用
+func (c *planCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]string)
+}
+
+// queryShape 计算过滤条件的结构，只保留字段名、操作符和取值的类别，忽略具体取值
+// 如 {a: 1, b: {$gt: 2}} 的结构为 a:eq;b:$gt
+func queryShape(filter Document) string {
+	fields := sortedKeys(filter)
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parts = append(parts, field+":"+conditionShape(filter[field]))
+	}
+	return strings.Join(parts, ";")
+}
+
+// conditionShape 描述单个字段条件的结构
+func conditionShape(cond interface{}) string {
+	switch v := cond.(type) {
+	case nil:
+		return "null"
+	case Regex:
+		return "regex"
+	case []interface{}, []Document:
+		return "array"
+	case Document, map[string]interface{}:
+		doc := toDocument(v)
+		if !hasOperatorKeys(doc) {
+			return "eq"
+		}
+		ops := sortedKeys(doc)
+		for i, op := range ops {
+			// $in 的元素可能包含正则等不能走索引的取值，需要区分
+			if op == "$in" {
+				if _, ok := equalityValues(doc); !ok {
+					ops[i] = "$in!"
+				}
+			}
+			if op == "$eq" {
+				ops[i] = "$eq:" + conditionShape(doc[op])
+			}
+		}
+		return strings.Join(ops, ",")
+	}
+	return "eq"
+}
+
+// planQuery 为过滤条件选择执行计划
+// 检查每个索引的键模式前缀：前缀字段上都有等值条件时，下一个字段还可以使用范围条件
+// 使用前缀字段最多的索引，相同时优先唯一索引和先创建的索引；没有可用索引时全表扫描
+// $text 查询只能使用文本索引，$near 查询只能使用地理索引，集合没有对应索引时返回错误
+func planQuery(coll *Collection, filter Document) (*QueryPlan, error) {
+	if _, ok := filter["$text"]; ok {
+		return textPlan(coll, filter)
+	}
+	if plan, ok, err := geoPlan(coll, filter); ok {
+		return plan, err
+	}
+	if _, ok := filter["$or"]; ok {
+		return orPlan(coll, filter), nil
+	}
+	shape := queryShape(filter)
+	if name, ok := coll.plans.get(shape); ok {
+		if plan := indexPlan(coll, name, filter); plan != nil {
+			plan.FromCache = true
+			return plan, nil
+		}
+		if name == "" {
+			return &QueryPlan{Stage: StageCollScan, Filter: filter, FromCache: true}, nil
+		}
+	}
+
+	best, cacheable := chooseIndex(coll, filter)
+	if cacheable {
+		coll.plans.put(shape, best)
+	}
+
+	if plan := indexPlan(coll, best, filter); plan != nil {
+		return plan, nil
+	}
+	return &QueryPlan{Stage: StageCollScan, Filter: filter}, nil
+}
+
+// Hint 查询提示，强制查询使用指定的索引或全表扫描，并可以用 min/max 限定索引的扫描范围
+type Hint struct {
+	IndexName string     // 按索引名指定索引
+	Keys      []IndexKey // 按键模式指定索引，IndexName 为空时使用
+	Natural   bool       // {$natural: 1}，强制全表扫描
+
+	// Min、Max 将索引扫描限定在 [Min, Max) 内，字段必须与索引键模式的字段和顺序一致
+	// 没有指定索引时使用键模式字段与 Min/Max 一致的索引
+	Min, Max []IndexKeyValue
+}
+
+// IndexKeyValue 索引键中一个字段的取值
+type IndexKeyValue struct {
+	Field string
+	Value interface{}
+}
+
+// hasBounds 是否指定了 min 或 max
+func (h *Hint) hasBounds() bool {
+	return len(h.Min) > 0 || len(h.Max) > 0
+}
+
+// boundFields 返回 min/max 的字段列表，两者都指定时字段必须相同
+func (h *Hint) boundFields() ([]string, error) {
+	fields := func(values []IndexKeyValue) []string {
+		out := make([]string, len(values))
+		for i, v := range values {
+			out[i] = v.Field
+		}
+		return out
+	}
+	minFields, maxFields := fields(h.Min), fields(h.Max)
+	if len(h.Min) == 0 {
+		return maxFields, nil
+	}
+	if len(h.Max) > 0 {
+		same := len(minFields) == len(maxFields)
+		for i := 0; same && i < len(minFields); i++ {
+			same = minFields[i] == maxFields[i]
+		}
+		if !same {
+			return nil, fmt.Errorf("%w: min 和 max 的字段必须相同", ErrBadValue)
+		}
+	}
+	return minFields, nil
+}
+
+// boundsMatch 判断 min/max 的字段与索引键模式的字段和顺序是否一致
+func boundsMatch(spec Index, fields []string) bool {
+	if len(spec.Keys) != len(fields) {
+		return false
+	}
+	for i, key := range spec.Keys {
+		if key.Field != fields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeBound 将 min/max 编码为索引键
+func encodeBound(values []IndexKeyValue) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	var key []byte
+	for _, v := range values {
+		key = appendKeyValue(key, v.Value)
+	}
+	return key
+}
+
+// String 返回提示的描述，用于错误信息
+func (h *Hint) String() string {
+	switch {
+	case h.Natural:
+		return "{$natural: 1}"
+	case h.IndexName != "":
+		return h.IndexName
+	}
+	return DefaultIndexName(h.Keys)
+}
+
+// matches 判断索引是否为提示指定的索引，按键模式指定时字段、顺序和方向都必须相同
+func (h *Hint) matches(spec Index) bool {
+	if h.IndexName != "" {
+		return spec.Name == h.IndexName
+	}
+	if len(spec.Keys) != len(h.Keys) {
+		return false
+	}
+	for i, key := range spec.Keys {
+		if key != h.Keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hintedPlan 按查询提示构造执行计划，不读取也不更新计划缓存
+// 指定了 min/max 时按 [min, max) 扫描索引，否则过滤条件不能限定索引的扫描区间时扫描整个索引；索引不存在、是文本或地理索引，
+// 或者是不能保证包含全部匹配文档的部分索引和稀疏索引时返回 ErrBadValue
+func hintedPlan(coll *Collection, filter Document, hint *Hint) (*QueryPlan, error) {
+	if _, ok := filter["$text"]; ok {
+		return nil, fmt.Errorf("%w: $text 查询不能使用 hint", ErrBadValue)
+	}
+	if _, ok, _ := geoPlan(coll, filter); ok {
+		return nil, fmt.Errorf("%w: $near 查询不能使用 hint", ErrBadValue)
+	}
+	if hint.Natural {
+		if hint.hasBounds() {
+			return nil, fmt.Errorf("%w: min/max 不能与 $natural 一起使用", ErrBadValue)
+		}
+		return &QueryPlan{Stage: StageCollScan, Filter: filter}, nil
+	}
+
+	var fields []string
+	if hint.hasBounds() {
+		var err error
+		if fields, err = hint.boundFields(); err != nil {
+			return nil, err
+		}
+	}
+	var spec Index
+	found := false
+	for _, s := range coll.IndexSpecs {
+		if hint.IndexName == "" && len(hint.Keys) == 0 {
+			// 只指定了 min/max 时使用字段一致的普通索引
+			found = s.Type() == "" && boundsMatch(s, fields)
+		} else {
+			found = hint.matches(s)
+		}
+		if found {
+			spec = s
+			break
+		}
+	}
+	if !found || coll.index(spec.Name) == nil || spec.Hidden {
+		if hint.IndexName == "" && len(hint.Keys) == 0 {
+			return nil, fmt.Errorf("%w: 没有键模式与 min/max 字段 %v 一致的索引", ErrBadValue, fields)
+		}
+		return nil, fmt.Errorf("%w: hint 指定的索引 %s 不存在", ErrBadValue, hint)
+	}
+	if !spec.boundedByFilter() || !partialIndexUsable(spec, filter) || !sparseIndexUsable(spec, filter) {
+		return nil, fmt.Errorf("%w: hint 指定的索引 %s 不能用于该查询", ErrBadValue, spec.Name)
+	}
+	if spec.IsHashed() && hint.hasBounds() {
+		return nil, fmt.Errorf("%w: 哈希索引 %s 不能使用 min/max", ErrBadValue, spec.Name)
+	}
+
+	// 指定 min/max 时扫描范围完全由 min/max 决定，过滤条件在读取文档后检查
+	interval := keyInterval{}
+	if hint.hasBounds() {
+		if !boundsMatch(spec, fields) {
+			return nil, fmt.Errorf("%w: min/max 的字段 %v 与索引 %s 的键模式不一致", ErrBadValue, fields, spec.Name)
+		}
+		interval = keyInterval{start: encodeBound(hint.Min), end: encodeBound(hint.Max)}
+		if interval.start != nil && interval.end != nil && bytes.Compare(interval.start, interval.end) >= 0 {
+			return nil, fmt.Errorf("%w: max 必须大于 min", ErrBadValue)
+		}
+	} else if plan := indexPlan(coll, spec.Name, filter); plan != nil {
+		return plan, nil
+	}
+	return &QueryPlan{
+		Stage:      StageIxScan,
+		IndexName:  spec.Name,
+		KeyPattern: spec.KeyPattern(),
+		IsMultiKey: coll.multikey[spec.Name],
+		Filter:     filter,
+		intervals:  []keyInterval{interval},
+	}, nil
+}
+
+// chooseIndex 选择按集合样本估计需要扫描的文档最少的索引，没有可用索引时返回空字符串
+// 估计相同或集合没有样本时选择前缀字段最多的索引，再相同时优先唯一索引和先创建的索引
+// 跳过了部分索引或稀疏索引时 cacheable 为 false，这类索引是否可用取决于具体取值
+func chooseIndex(coll *Collection, filter Document) (best string, cacheable bool) {
+	bestScore := 0
+	bestUnique := false
+	bestCost, bestEstimated := 0.0, false
+	cacheable = true
+	for _, spec := range coll.IndexSpecs {
+		// 文本和地理索引只用于对应的查询操作符
+		if !spec.boundedByFilter() || spec.Hidden {
+			continue
+		}
+		if !partialIndexUsable(spec, filter) || !sparseIndexUsable(spec, filter) {
+			cacheable = false
+			continue
+		}
+		_, score := indexBounds(spec, filter, coll.multikey[spec.Name])
+		if score == 0 {
+			continue
+		}
+		cost, estimated := coll.sample.selectivity(boundFilter(spec, filter, score))
+		var better bool
+		switch {
+		case best == "":
+			better = true
+		case estimated && bestEstimated && cost != bestCost:
+			better = cost < bestCost
+		case score != bestScore:
+			better = score > bestScore
+		default:
+			better = spec.Unique && !bestUnique
+		}
+		if better {
+			best, bestScore, bestUnique, bestCost, bestEstimated = spec.Name, score, spec.Unique, cost, estimated
+		}
+	}
+	return best, cacheable
+}
+
+// rejectedPlans 返回未被选中的候选计划及其估计：其他可用的单索引计划和全表扫描
+func rejectedPlans(coll *Collection, filter Document, chosen *QueryPlan) []*QueryPlan {
+	var plans []*QueryPlan
+	for _, spec := range coll.IndexSpecs {
+		if spec.Name == chosen.IndexName || spec.Hidden {
+			continue
+		}
+		if plan := indexPlan(coll, spec.Name, filter); plan != nil {
+			estimatePlan(coll, plan)
+			plans = append(plans, plan)
+		}
+	}
+	if chosen.Stage != StageCollScan {
+		plan := &QueryPlan{Stage: StageCollScan, Filter: filter}
+		estimatePlan(coll, plan)
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// orPlan 为包含 $or 的过滤条件选择执行计划，分支的结构各不相同，不使用计划缓存
+// $or 以外的字段可以使用索引时按普通方式选择索引；否则每个分支都能使用索引时分别扫描后合并，
+// 任一分支只能全表扫描时整个查询全表扫描
+func orPlan(coll *Collection, filter Document) *QueryPlan {
+	best, _ := chooseIndex(coll, filter)
+	if plan := indexPlan(coll, best, filter); plan != nil {
+		return plan
+	}
+
+	collScan := &QueryPlan{Stage: StageCollScan, Filter: filter}
+	branches, err := logicalBranches("$or", filter["$or"])
+	if err != nil {
+		// 由执行阶段的匹配报告参数错误
+		return collScan
+	}
+	plan := &QueryPlan{Stage: StageOr, Filter: filter}
+	for _, branch := range branches {
+		name, _ := chooseIndex(coll, branch)
+		sub := indexPlan(coll, name, branch)
+		if sub == nil {
+			return collScan
+		}
+		plan.Branches = append(plan.Branches, sub)
+	}
+	return plan
+}
+
+// indexPlan 构造使用指定索引的计划，索引不存在或不能用于该过滤条件时返回 nil
+func indexPlan(coll *Collection, indexName string, filter Document) *QueryPlan {
+	spec, ok := coll.indexSpec(indexName)
+	if !ok || !spec.boundedByFilter() || coll.index(indexName) == nil || !partialIndexUsable(spec, filter) || !sparseIndexUsable(spec, filter) {
+		return nil
+	}
+	intervals, score := indexBounds(spec, filter, coll.multikey[indexName])
+	if score == 0 {
+		return nil
+	}
+	return &QueryPlan{
+		Stage:       StageIxScan,
+		IndexName:   indexName,
+		KeyPattern:  spec.KeyPattern(),
+		IsMultiKey:  coll.multikey[indexName],
+		Filter:      filter,
+		intervals:   intervals,
+		pointLookup: spec.Unique && len(spec.Keys) == 1 && !coll.multikey[indexName] && isPointInterval(intervals),
+		bounded:     boundFilter(spec, filter, score),
+	}
+}
+
+// isPointInterval 区间是否只包含一个索引键，即 indexBounds 为单个等值条件生成的 [key, keySuccessor(key))
+func isPointInterval(intervals []keyInterval) bool {
+	return len(intervals) == 1 && len(intervals[0].start) > 0 && bytes.Equal(intervals[0].end, keySuccessor(intervals[0].start))
+}
+
+// boundedByFilter 索引能否按过滤条件计算扫描区间，即普通索引和哈希索引
+func (idx Index) boundedByFilter() bool {
+	return idx.Type() == "" || idx.IsHashed()
+}
+
+// indexBounds 计算过滤条件在索引上的扫描区间
+// 哈希索引字段只能使用等值条件，取值按 hashedKeyValue 编码后查找
+// score 为使用的键模式前缀字段数的两倍，最后一个字段只用了范围条件时减一；为 0 表示索引不可用
+func indexBounds(spec Index, filter Document, multikey bool) ([]keyInterval, int) {
+	prefixes := [][]byte{nil}
+	score := 0
+	for _, key := range spec.Keys {
+		cond, ok := filter[key.Field]
+		if !ok {
+			break
+		}
+
+		if values, ok := equalityValues(cond); ok {
+			if key.Type == IndexTypeHashed {
+				for i, v := range values {
+					values[i] = hashedKeyValue(v)
+				}
+			}
+			next := make([][]byte, 0, len(prefixes)*len(values))
+			for _, prefix := range prefixes {
+				for _, v := range values {
+					next = append(next, appendKeyValue(append([]byte(nil), prefix...), v))
+				}
+			}
+			if len(next) > maxIndexIntervals {
+				break
+			}
+			prefixes = dedupeKeys(next)
+			score += 2
+			continue
+		}
+		if key.Type == IndexTypeHashed {
+			// 哈希不保留取值的顺序，范围条件不能使用哈希索引
+			break
+		}
+
+		if lower, upper, ok := rangeBounds(cond); ok {
+			// 多键索引的上下界可能由数组中不同的元素满足，只能使用其中一个边界
+			if multikey && lower != nil && upper != nil {
+				upper = nil
+			}
+			intervals := make([]keyInterval, 0, len(prefixes))
+			for _, prefix := range prefixes {
+				if interval, ok := rangeInterval(prefix, lower, upper); ok {
+					intervals = append(intervals, interval)
+				}
+			}
+			return intervals, score + 1
+		}
+		break
+	}
+	if score == 0 {
+		return nil, 0
+	}
+
+	intervals := make([]keyInterval, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		intervals = append(intervals, keyInterval{start: prefix, end: keySuccessor(prefix)})
+	}
+	return intervals, score
+}
+
+// partialIndexUsable 部分索引只包含满足 partialFilterExpression 的文档，只有查询条件蕴含该条件时才能使用
+func partialIndexUsable(spec Index, filter Document) bool {
+	return len(spec.PartialFilterExpression) == 0 || impliesFilter(filter, spec.PartialFilterExpression)
+}
+
+// sparseIndexUsable 稀疏索引不包含索引字段全部缺失的文档
+// 只有查询条件要求至少一个索引字段存在时才能使用，{a: null}、{a: {$exists: false}} 等可能匹配缺失字段的条件不能使用
+func sparseIndexUsable(spec Index, filter Document) bool {
+	if !spec.Sparse {
+		return true
+	}
+	for _, key := range spec.Keys {
+		if cond, ok := filter[key.Field]; ok && excludesMissing(cond) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesMissing 判断字段条件是否一定不匹配缺失该字段的文档
+// 操作符文档中任一操作符排除缺失字段即可，无法判断的操作符保守地返回 false
+func excludesMissing(cond interface{}) bool {
+	if cond == nil {
+		return false
+	}
+	doc := toDocument(cond)
+	if doc == nil || !hasOperatorKeys(doc) {
+		return true
+	}
+	for op, operand := range doc {
+		switch op {
+		case "$eq", "$gt", "$gte", "$lt", "$lte":
+			if operand != nil {
+				return true
+			}
+		case "$in":
+			if arr, ok := operand.([]interface{}); ok && len(arr) > 0 {
+				hasNull := false
+				for _, elem := range arr {
+					hasNull = hasNull || elem == nil
+				}
+				if !hasNull {
+					return true
+				}
+			}
+		case "$exists":
+			if exists, ok := operand.(bool); ok && exists {
+				return true
+			}
+		case "$type", "$regex", "$size", "$all", "$elemMatch", "$mod":
+			return true
+		}
+	}
+	return false
+}
+
+// 蕴含判断支持的部分索引条件操作符，均为数组任一元素满足即匹配的正向条件
+var implicationOperators = map[string]bool{
+	"$eq": true, "$in": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true, "$exists": true,
+}
+
+// impliesFilter 判断满足 query 的文档是否一定满足 partial
+// 只识别 partial 的每个字段在 query 中都有等值条件，或有更严格的单边范围条件的情形，其余情况保守地返回 false
+func impliesFilter(query, partial Document) bool {
+	for field, pc := range partial {
+		if strings.HasPrefix(field, "$") || !positiveCondition(pc) {
+			return false
+		}
+		qc, ok := query[field]
+		if !ok {
+			return false
+		}
+
+		if values, ok := equalityValues(qc); ok {
+			for _, v := range values {
+				if matched, err := matchField(Document{"v": v}, "v", pc); err != nil || !matched {
+					return false
+				}
+			}
+			continue
+		}
+		lower, upper, ok := rangeBounds(qc)
+		if !ok || !rangeImplies(lower, upper, pc) {
+			return false
+		}
+	}
+	return true
+}
+
+// positiveCondition 条件是否只由等值、$in、范围和 $exists: true 组成
+func positiveCondition(cond interface{}) bool {
+	doc := toDocument(cond)
+	if doc == nil || !hasOperatorKeys(doc) {
+		return true
+	}
+	for op, operand := range doc {
+		if !implicationOperators[op] {
+			return false
+		}
+		if exists, ok := operand.(bool); op == "$exists" && (!ok || !exists) {
+			return false
+		}
+	}
+	return true
+}
+
+// rangeImplies 判断查询的范围条件是否蕴含部分索引的单个范围条件
+// 多键字段的上下界可能由不同元素满足，部分索引条件同时包含上下界时不做判断
+func rangeImplies(lower, upper *rangeBound, cond interface{}) bool {
+	doc := toDocument(cond)
+	if doc == nil || !hasOperatorKeys(doc) {
+		return false
+	}
+	bounds := 0
+	for op, p := range doc {
+		switch op {
+		case "$exists":
+			continue
+		case "$gt", "$gte":
+			if lower == nil || canonicalType(lower.value) != canonicalType(p) {
+				return false
+			}
+			c := CompareValues(lower.value, p)
+			if c < 0 || (c == 0 && op == "$gt" && lower.inclusive) {
+				return false
+			}
+		case "$lt", "$lte":
+			if upper == nil || canonicalType(upper.value) != canonicalType(p) {
+				return false
+			}
+			c := CompareValues(upper.value, p)
+			if c > 0 || (c == 0 && op == "$lt" && upper.inclusive) {
+				return false
+			}
+		default:
+			return false
+		}
+		bounds++
+	}
+	return bounds <= 1
+}
+
+// dedupeKeys 对索引键排序去重
+func dedupeKeys(keys [][]byte) [][]byte {
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	out := keys[:0]
+	for i, key := range keys {
+		if i == 0 || !bytes.Equal(key, keys[i-1]) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// rangeBound 范围条件的一个边界
+type rangeBound struct {
+	value     interface{}
+	inclusive bool
+}
+
+// rangeBounds 从 $gt/$gte/$lt/$lte 条件中提取上下界
+// 同一方向有多个条件时任取其一，其余条件在读取文档后由完整的过滤条件检查
+func rangeBounds(cond interface{}) (lower, upper *rangeBound, ok bool) {
+	doc := toDocument(cond)
+	if doc == nil || !hasOperatorKeys(doc) {
+		return nil, nil, false
+	}
+	for _, op := range sortedKeys(doc) {
+		v := doc[op]
+		if !rangeOperand(v) {
+			continue
+		}
+		switch op {
+		case "$gt", "$gte":
+			lower = &rangeBound{value: v, inclusive: op == "$gte"}
+		case "$lt", "$lte":
+			upper = &rangeBound{value: v, inclusive: op == "$lte"}
+		}
+	}
+	return lower, upper, lower != nil || upper != nil
+}
+
+// rangeOperand 取值能否作为索引范围扫描的边界
+func rangeOperand(v interface{}) bool {
+	switch v.(type) {
+	case nil, Regex, Document, map[string]interface{}, []interface{}, []Document:
+		return false
+	}
+	return true
+}
+
+// rangeInterval 计算前缀下范围条件对应的区间
+// 只有一个边界时另一端限定在边界取值的类型分组内，与 MongoDB 比较运算符不跨类型匹配一致
+func rangeInterval(prefix []byte, lower, upper *rangeBound) (keyInterval, bool) {
+	var interval keyInterval
+	if lower != nil {
+		key := appendKeyValue(append([]byte(nil), prefix...), lower.value)
+		interval.start = key
+		if !lower.inclusive {
+			if interval.start = keySuccessor(key); interval.start == nil {
+				return interval, false
+			}
+		}
+	} else {
+		interval.start = append(append([]byte(nil), prefix...), byte(canonicalType(upper.value)))
+	}
+
+	if upper != nil {
+		key := appendKeyValue(append([]byte(nil), prefix...), upper.value)
+		interval.end = key
+		if upper.inclusive {
+			interval.end = keySuccessor(key)
+		}
+	} else {
+		interval.end = append(append([]byte(nil), prefix...), byte(canonicalType(lower.value)+1))
+	}
+
+	if interval.end != nil && bytes.Compare(interval.start, interval.end) >= 0 {
+		return interval, false
+	}
+	return interval, true
+}
+
+// equalityValues 返回条件能够精确匹配的取值列表
+// 支持直接给值、{$eq: v} 和 {$in: [...]}，含 null、正则、数组或其他操作符时返回 false
+func equalityValues(cond interface{}) ([]interface{}, bool) {
+	switch v := cond.(type) {
+	case nil:
+		// null 还会匹配字段缺失的文档，交给全表扫描处理
+		return nil, false
+	case Regex:
+		return nil, false
+	case []interface{}, []Document:
+		// 数组相等条件还会匹配包含该数组的数组字段，不能用索引点查
+		return nil, false
+	case Document, map[string]interface{}:
+		doc := toDocument(v)
+		if !hasOperatorKeys(doc) {
+			return []interface{}{doc}, true
+		}
+		if eq, ok := doc["$eq"]; ok {
+			return equalityValues(eq)
+		}
+		if in, ok := doc["$in"]; ok {
+			arr, ok := in.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			values := make([]interface{}, 0, len(arr))
+			for _, elem := range arr {
+				elemValues, ok := equalityValues(elem)
+				if !ok {
+					return nil, false
+				}
+				values = append(values, elemValues...)
+			}
+			return values, true
+		}
+		return nil, false
+	}
+	return []interface{}{cond}, true
+}
+
+// hasOperatorKeys 文档的字段是否都是 $ 开头的操作符
+func hasOperatorKeys(doc Document) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// runPlan 执行查询计划并返回满足过滤条件的记录，limitOne 为 true 时找到第一条即停止
+// stats 不为 nil 时累计扫描的索引条目数和文档数，为 nil 时累计到 context 携带的执行统计
+func (e *WiredTigerEngine) runPlan(ctx context.Context, coll *Collection, plan *QueryPlan, filter Document, limitOne bool, stats *ExecutionStats) ([]matchedRecord, error) {
+	if stats == nil {
+		stats, _ = ctx.Value(executionStatsKey{}).(*ExecutionStats)
+	}
+	if stats == nil {
+		stats = &ExecutionStats{}
+	}
+	plan = e.isolatedPlan(ctx, coll, plan)
+	switch plan.Stage {
+	case StageCollScan:
+		return e.collectionScan(ctx, coll, filter, limitOne, stats)
+	case StageOr:
+		// 各分支的扫描结果可能重叠，按 RecordId 去重；每个文档检查完整的过滤条件
+		seen := make(map[string]bool)
+		var matches []matchedRecord
+		for _, branch := range plan.Branches {
+			found, err := e.indexScan(ctx, coll, branch, filter, limitOne, stats)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range found {
+				ridBytes, _ := m.recordId.AsBytes()
+				if seen[string(ridBytes)] {
+					continue
+				}
+				seen[string(ridBytes)] = true
+				matches = append(matches, m)
+				if limitOne {
+					return matches, nil
+				}
+			}
+		}
+		return matches, nil
+	case StageText:
+		// 命中文本索引区间的文档已满足 $text 条件
+		return e.indexScan(ctx, coll, plan, plan.residual, limitOne, stats)
+	case StageGeoNear2D, StageGeoNear2DSphere:
+		// 需要读取范围内的全部文档才能按距离排序
+		matches, err := e.indexScan(ctx, coll, plan, filter, false, stats)
+		if err != nil {
+			return nil, err
+		}
+		sortByDistance(matches, plan)
+		if limitOne && len(matches) > 1 {
+			matches = matches[:1]
+		}
+		return matches, nil
+	}
+	return e.indexScan(ctx, coll, plan, filter, limitOne, stats)
+}
+
+// indexScan 按计划的区间扫描索引，通过 RecordId 读取文档并检查完整的过滤条件
+// 多键索引中同一文档可能出现多次，按 RecordId 去重
+func (e *WiredTigerEngine) indexScan(ctx context.Context, coll *Collection, plan *QueryPlan, filter Document, limitOne bool, stats *ExecutionStats) ([]matchedRecord, error) {
+	return drainScan(ctx, e.newIndexScanner(coll, plan, filter), limitOne, stats)
+}
+
+// collectionScan 全表扫描并返回满足过滤条件的记录
+func (e *WiredTigerEngine) collectionScan(ctx context.Context, coll *Collection, filter Document, limitOne bool, stats *ExecutionStats) ([]matchedRecord, error) {
+	scanner, err := e.newCollectionScanner(ctx, coll, filter)
+	if err != nil {
+		return nil, err
+	}
+	return drainScan(ctx, scanner, limitOne, stats)
+}
+
+// recordScanner 逐条返回满足过滤条件的记录，只在需要下一条结果时读取记录
+type recordScanner interface {
+	// next 返回下一条满足过滤条件的记录，没有更多记录时第二个返回值为 false
+	next(ctx context.Context, stats *ExecutionStats) (matchedRecord, bool, error)
+	close()
+}
+
+// drainScan 读取扫描器的全部结果，limitOne 为 true 时找到第一条即停止
+func drainScan(ctx context.Context, scanner recordScanner, limitOne bool, stats *ExecutionStats) ([]matchedRecord, error) {
+	defer scanner.close()
+	var matches []matchedRecord
+	for {
+		m, ok, err := scanner.next(ctx, stats)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return matches, nil
+		}
+		matches = append(matches, m)
+		if limitOne {
+			return matches, nil
+		}
+	}
+}
+
+// collectionScanner 按 RecordId 顺序扫描集合
+// 其他事务持有写意向的记录按事务写入前的版本返回：跳过其他事务插入的记录，
+// 已被其他事务删除的记录按 RecordId 顺序插入到扫描结果中
+type collectionScanner struct {
+	e          *WiredTigerEngine
+	coll       *Collection
+	ru         RecoveryUnit // 发起扫描的事务，读到该事务自己的写入
+	cursor     RecordCursor
+	positioned bool // 游标停在尚未返回的记录上
+	exhausted  bool
+	deleted    []*writeIntent // 其他事务持有写意向且写入前存在的记录，按 RecordId 排序
+	filter     Document
+}
+
+// newCollectionScanner 创建全表扫描
+func (e *WiredTigerEngine) newCollectionScanner(ctx context.Context, coll *Collection, filter Document) (*collectionScanner, error) {
+	cursor, err := coll.RecordStore.Scan(ctx, NullRecordId())
+	if err != nil {
+		return nil, fmt.Errorf("扫描记录失败: %w", err)
+	}
+	ru := transactionUnit(ctx)
+	return &collectionScanner{
+		e:       e,
+		coll:    coll,
+		ru:      ru,
+		cursor:  cursor,
+		deleted: e.intents.foreignDeleted(ru, coll),
+		filter:  filter,
+	}, nil
+}
+
+func (s *collectionScanner) next(ctx context.Context, stats *ExecutionStats) (matchedRecord, bool, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return matchedRecord{}, false, err
+		}
+		if !s.positioned && !s.exhausted {
+			s.positioned = s.cursor.Next()
+			s.exhausted = !s.positioned
+		}
+
+		var recordId RecordId
+		var data []byte
+		if len(s.deleted) > 0 && (s.exhausted || compareRecordIds(s.deleted[0].recordId, s.cursor.RecordId()) < 0) {
+			intent := s.deleted[0]
+			s.deleted = s.deleted[1:]
+			// 记录仍在存储中时由游标按当前可见的版本返回
+			if _, err := s.coll.RecordStore.GetRecord(ctx, intent.recordId); err == nil {
+				continue
+			}
+			recordId, data = intent.recordId, intent.before
+		} else if s.exhausted {
+			return matchedRecord{}, false, nil
+		} else {
+			s.positioned = false
+			var visible bool
+			recordId = s.cursor.RecordId()
+			if data, visible = s.e.intents.visibleVersion(s.ru, s.coll, recordId, s.cursor.Data()); !visible {
+				continue
+			}
+		}
+
+		stats.DocsExamined++
+		m, ok, err := s.e.matchRecord(recordId, data, s.filter)
+		if err != nil {
+			return matchedRecord{}, false, err
+		}
+		if ok {
+			return m, true, nil
+		}
+	}
+}
+
+func (s *collectionScanner) close() {
+	s.cursor.Close()
+}
+
+// indexScanner 依次扫描计划中的索引区间，按 RecordId 去重
+type indexScanner struct {
+	e         *WiredTigerEngine
+	coll      *Collection
+	indexName string
+	index     SortedDataInterface // 创建扫描时的索引，索引被删除或重建后扫描以 ErrQueryPlanKilled 结束
+	intervals []keyInterval       // 尚未扫描的区间
+	cursor    IndexCursor         // 当前区间的游标，nil 时打开下一个区间
+	filter    Document
+	seen      map[string]bool // 已返回的 RecordId，为 nil 时不去重
+	covered   []string        // 覆盖查询按索引键还原的字段，为空时读取文档
+	point     bool            // 用 SeekExact 查找唯一的区间键，不打开游标
+}
+
+// newIndexScanner 创建索引扫描，区间在读取到时才打开
+func (e *WiredTigerEngine) newIndexScanner(coll *Collection, plan *QueryPlan, filter Document) *indexScanner {
+	return &indexScanner{
+		e:         e,
+		coll:      coll,
+		indexName: plan.IndexName,
+		index:     coll.index(plan.IndexName),
+		intervals: plan.intervals,
+		filter:    filter,
+		seen:      make(map[string]bool),
+		covered:   plan.coveredFields,
+		// 覆盖查询需要游标返回的索引键和类型信息
+		point: plan.pointLookup && len(plan.coveredFields) == 0,
+	}
+}
+
+func (s *indexScanner) next(ctx context.Context, stats *ExecutionStats) (matchedRecord, bool, error) {
+	if s.point {
+		return s.seekExact(ctx, stats)
+	}
+	for {
+		if s.cursor == nil {
+			if len(s.intervals) == 0 {
+				return matchedRecord{}, false, nil
+			}
+			if err := s.checkIndex(); err != nil {
+				return matchedRecord{}, false, err
+			}
+			interval := s.intervals[0]
+			s.intervals = s.intervals[1:]
+			cursor, err := s.index.SeekRange(ctx, interval.start, interval.end)
+			if err != nil {
+				return matchedRecord{}, false, fmt.Errorf("索引 %s 扫描失败: %w", s.indexName, err)
+			}
+			s.cursor = cursor
+		}
+		for s.cursor.Next() {
+			if err := ctx.Err(); err != nil {
+				return matchedRecord{}, false, err
+			}
+			stats.KeysExamined++
+			recordId := s.cursor.RecordId()
+			if s.seen != nil {
+				ridBytes, _ := recordId.AsBytes()
+				if s.seen[string(ridBytes)] {
+					continue
+				}
+				s.seen[string(ridBytes)] = true
+			}
+
+			if len(s.covered) > 0 {
+				if doc, ok := coveredDocument(s.covered, s.cursor.Key(), s.cursor.TypeBits()); ok {
+					matched, err := Matches(doc, s.filter)
+					if err != nil {
+						return matchedRecord{}, false, err
+					}
+					if matched {
+						return matchedRecord{recordId: recordId, doc: doc}, true, nil
+					}
+					continue
+				}
+			}
+
+			if m, ok, err := s.fetch(ctx, recordId, stats); err != nil || ok {
+				return m, ok, err
+			}
+		}
+		s.cursor.Close()
+		s.cursor = nil
+	}
+}
+
+// seekExact 用 SeekExact 查找点查询计划唯一的索引键，只返回一次结果
+func (s *indexScanner) seekExact(ctx context.Context, stats *ExecutionStats) (matchedRecord, bool, error) {
+	if len(s.intervals) == 0 {
+		return matchedRecord{}, false, nil
+	}
+	if err := s.checkIndex(); err != nil {
+		return matchedRecord{}, false, err
+	}
+	key := s.intervals[0].start
+	s.intervals = nil
+	recordId, found, err := s.index.SeekExact(ctx, key)
+	if err != nil {
+		return matchedRecord{}, false, fmt.Errorf("索引 %s 查找失败: %w", s.indexName, err)
+	}
+	if !found {
+		return matchedRecord{}, false, nil
+	}
+	stats.KeysExamined++
+	return s.fetch(ctx, recordId, stats)
+}
+
+// checkIndex 检查扫描的索引是否仍是集合中的同一个索引，索引已被删除或重建时返回 ErrQueryPlanKilled
+func (s *indexScanner) checkIndex() error {
+	if s.index == nil || s.coll.index(s.indexName) != s.index {
+		return fmt.Errorf("索引 %s 已被删除: %w", s.indexName, ErrQueryPlanKilled)
+	}
+	return nil
+}
+
+// fetch 读取索引条目指向的文档并检查过滤条件，记录已被删除时视为不匹配
+// 记录被其他事务持有写意向时按该事务写入前的版本检查
+func (s *indexScanner) fetch(ctx context.Context, recordId RecordId, stats *ExecutionStats) (matchedRecord, bool, error) {
+	data, err := s.coll.RecordStore.GetRecord(ctx, recordId)
+	if err != nil {
+		return matchedRecord{}, false, nil
+	}
+	data, visible := s.e.intents.visibleVersion(transactionUnit(ctx), s.coll, recordId, data)
+	if !visible {
+		return matchedRecord{}, false, nil
+	}
+	stats.DocsExamined++
+	return s.e.matchRecord(recordId, data, s.filter)
+}
+
+func (s *indexScanner) close() {
+	if s.cursor != nil {
+		s.cursor.Close()
+		s.cursor = nil
+	}
+	s.intervals = nil
+}
+
+// matchRecord 反序列化记录并判断是否满足过滤条件，无法解析的记录视为不匹配
+func (e *WiredTigerEngine) matchRecord(recordId RecordId, data []byte, filter Document) (matchedRecord, bool, error) {
+	doc, err := e.bsonToDocument(data)
+	if err != nil {
+		return matchedRecord{}, false, nil
+	}
+	ok, err := Matches(doc, filter)
+	if err != nil || !ok {
+		return matchedRecord{}, false, err
+	}
+	return matchedRecord{recordId: recordId, data: data, doc: doc}, true, nil
+}
@@ -0,0 +1,982 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestQueryPlanner 测试查询计划选择索引并通过索引扫描返回正确结果
+func TestQueryPlanner(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	cities := []string{"Beijing", "Shanghai", "Shenzhen", "Hangzhou"}
+	docs := make([]storage.Document, 0, 40)
+	for i := 0; i < 40; i++ {
+		docs = append(docs, storage.Document{
+			"_id":  int32(i),
+			"city": cities[i%len(cities)],
+			"age":  int32(20 + i),
+			"tags": []interface{}{cities[i%len(cities)], int32(i % 3)},
+		})
+	}
+	if err := engine.Insert(ctx, "test", "people", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+
+	createIndex := func(name string, unique bool, fields ...string) {
+		t.Helper()
+		index := storage.Index{Name: name, Unique: unique}
+		for _, field := range fields {
+			index.Keys = append(index.Keys, storage.IndexKey{Field: field, Direction: 1})
+		}
+		if err := engine.CreateIndex(ctx, "test", "people", index); err != nil {
+			t.Fatalf("创建索引 %s 失败: %v", name, err)
+		}
+	}
+	// ids 返回查询结果的 _id，按升序排列
+	ids := func(filter storage.Document) []int32 {
+		t.Helper()
+		found, err := engine.Find(ctx, "test", "people", filter)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		out := make([]int32, len(found))
+		for i, doc := range found {
+			out[i] = doc["_id"].(int32)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+		return out
+	}
+	explain := func(filter storage.Document) *storage.Explanation {
+		t.Helper()
+		e, err := engine.Explain(ctx, "test", "people", filter, nil, nil, true)
+		if err != nil {
+			t.Fatalf("explain 失败: %v", err)
+		}
+		return e
+	}
+	equal := func(a, b []int32) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// 建索引前的全表扫描结果作为对照
+	filters := []storage.Document{
+		{"city": "Beijing"},
+		{"city": storage.Document{"$in": []interface{}{"Shanghai", "Hangzhou"}}},
+		{"age": storage.Document{"$gte": int32(25), "$lt": int32(30)}},
+		{"city": "Shenzhen", "age": storage.Document{"$gt": int32(40)}},
+		{"tags": int32(2)},
+		{"tags": storage.Document{"$gt": int32(0), "$lt": int32(2)}},
+	}
+	expected := make([][]int32, len(filters))
+	for i, filter := range filters {
+		expected[i] = ids(filter)
+		if len(expected[i]) == 0 {
+			t.Fatalf("对照查询 %v 没有结果", filter)
+		}
+	}
+
+	orFilter := storage.Document{"$or": []interface{}{
+		storage.Document{"city": "Beijing"},
+		storage.Document{"age": storage.Document{"$lt": int32(23)}},
+	}}
+	orExpected := ids(orFilter)
+
+	createIndex("city_1", false, "city")
+	createIndex("age_1", false, "age")
+	createIndex("city_1_age_1", false, "city", "age")
+	createIndex("tags_1", false, "tags")
+
+	t.Run("等值条件使用索引", func(t *testing.T) {
+		e := explain(storage.Document{"city": "Beijing"})
+		if e.Plan.Stage != storage.StageIxScan || e.Plan.IndexName != "city_1" {
+			t.Fatalf("应使用 city_1 索引: %+v", e.Plan)
+		}
+		if e.Stats.NReturned != 10 || e.Stats.KeysExamined != 10 || e.Stats.DocsExamined != 10 {
+			t.Errorf("应只读取 10 个匹配的索引条目和文档: %+v", e.Stats)
+		}
+	})
+
+	t.Run("索引扫描结果与全表扫描一致", func(t *testing.T) {
+		for i, filter := range filters {
+			if e := explain(filter); e.Plan.Stage != storage.StageIxScan {
+				t.Errorf("%v 应使用索引: %+v", filter, e.Plan)
+			}
+			if got := ids(filter); !equal(got, expected[i]) {
+				t.Errorf("%v: got %v, want %v", filter, got, expected[i])
+			}
+		}
+	})
+
+	t.Run("复合索引前缀", func(t *testing.T) {
+		e := explain(storage.Document{"city": "Shenzhen", "age": storage.Document{"$gt": int32(40)}})
+		if e.Plan.IndexName != "city_1_age_1" {
+			t.Errorf("等值加范围条件应使用复合索引: %+v", e.Plan)
+		}
+		if e.Stats.KeysExamined != e.Stats.NReturned {
+			t.Errorf("复合索引扫描不应读取多余的条目: %+v", e.Stats)
+		}
+		// age 不是 city_1_age_1 的前缀，只能使用 age_1
+		if e := explain(storage.Document{"age": int32(30)}); e.Plan.IndexName != "age_1" {
+			t.Errorf("应使用 age_1 索引: %+v", e.Plan)
+		}
+	})
+
+	t.Run("多键索引", func(t *testing.T) {
+		e := explain(storage.Document{"tags": int32(2)})
+		if !e.Plan.IsMultiKey {
+			t.Errorf("tags_1 应为多键索引: %+v", e.Plan)
+		}
+	})
+
+	t.Run("没有可用索引时全表扫描", func(t *testing.T) {
+		e := explain(storage.Document{"name": "x"})
+		if e.Plan.Stage != storage.StageCollScan || e.Stats.DocsExamined != 40 {
+			t.Errorf("应全表扫描 40 个文档: %+v %+v", e.Plan, e.Stats)
+		}
+	})
+
+	t.Run("$or 的每个分支使用索引", func(t *testing.T) {
+		e := explain(orFilter)
+		if e.Plan.Stage != storage.StageOr || len(e.Plan.Branches) != 2 ||
+			e.Plan.Branches[0].IndexName != "city_1" || e.Plan.Branches[1].IndexName != "age_1" {
+			t.Fatalf("应分别使用 city_1 和 age_1 索引: %+v", e.Plan)
+		}
+		// 0 号文档同时满足两个分支，只返回一次
+		if got := ids(orFilter); !equal(got, orExpected) {
+			t.Errorf("got %v, want %v", got, orExpected)
+		}
+		if e.Stats.NReturned != int64(len(orExpected)) || e.Stats.DocsExamined != e.Stats.KeysExamined {
+			t.Errorf("执行统计不正确: %+v", e.Stats)
+		}
+
+		// 任一分支不能使用索引时全表扫描
+		unindexed := storage.Document{"$or": []interface{}{
+			storage.Document{"city": "Beijing"},
+			storage.Document{"name": "x"},
+		}}
+		if e := explain(unindexed); e.Plan.Stage != storage.StageCollScan || e.Stats.NReturned != 10 {
+			t.Errorf("分支 name 没有索引时应全表扫描: %+v %+v", e.Plan, e.Stats)
+		}
+		// $or 以外的字段可以使用索引时直接使用
+		withField := storage.Document{"city": "Shenzhen", "$or": orFilter["$or"]}
+		if e := explain(withField); e.Plan.Stage != storage.StageIxScan || e.Stats.NReturned != 1 {
+			t.Errorf("应使用 city 上的索引: %+v %+v", e.Plan, e.Stats)
+		}
+	})
+
+	t.Run("计划缓存", func(t *testing.T) {
+		if e := explain(storage.Document{"age": int32(21)}); !e.Plan.FromCache {
+			t.Errorf("结构相同的查询应命中计划缓存: %+v", e.Plan)
+		}
+		if err := engine.DropIndex(ctx, "test", "people", "age_1"); err != nil {
+			t.Fatalf("删除索引失败: %v", err)
+		}
+		e := explain(storage.Document{"age": int32(21)})
+		if e.Plan.FromCache || e.Plan.Stage != storage.StageCollScan {
+			t.Errorf("删除索引后应重新生成计划: %+v", e.Plan)
+		}
+		if got := ids(storage.Document{"age": int32(21)}); !equal(got, []int32{1}) {
+			t.Errorf("got %v, want [1]", got)
+		}
+	})
+
+	t.Run("索引随写操作维护", func(t *testing.T) {
+		if _, err := engine.Update(ctx, "test", "people", storage.Document{"_id": int32(0)},
+			storage.Document{"$set": storage.Document{"city": "Wuhan"}}, storage.UpdateOptions{}); err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		if _, err := engine.Delete(ctx, "test", "people", storage.Document{"_id": int32(4)}, true); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+		if got := ids(storage.Document{"city": "Wuhan"}); !equal(got, []int32{0}) {
+			t.Errorf("Wuhan: got %v, want [0]", got)
+		}
+		if got := ids(storage.Document{"city": "Beijing"}); len(got) != 8 {
+			t.Errorf("Beijing 应剩 8 个文档: %v", got)
+		}
+	})
+
+	t.Run("唯一索引", func(t *testing.T) {
+		err := engine.CreateIndex(ctx, "test", "people", storage.Index{
+			Name: "city_unique", Keys: []storage.IndexKey{{Field: "city", Direction: -1}}, Unique: true,
+		})
+		if !errors.Is(err, storage.ErrDuplicateKey) {
+			t.Errorf("已有重复值时创建唯一索引应失败: %v", err)
+		}
+		createIndex("age_unique", true, "age")
+		err = engine.Insert(ctx, "test", "people", []storage.Document{{"_id": int32(100), "age": int32(25)}})
+		var dup *storage.DuplicateKeyError
+		if !errors.As(err, &dup) || dup.Index != "age_unique" || dup.Key.(storage.Document)["age"] != int32(25) {
+			t.Errorf("应返回 age_unique 的重复键错误: %v", err)
+		}
+	})
+}
+
+// TestPartialIndex 测试部分索引只包含满足过滤条件的文档，且只在查询条件蕴含过滤条件时使用
+func TestPartialIndex(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	docs := make([]storage.Document, 0, 20)
+	for i := 0; i < 20; i++ {
+		docs = append(docs, storage.Document{"_id": int32(i), "age": int32(20 + i)})
+	}
+	if err := engine.Insert(ctx, "test", "people", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.CreateIndex(ctx, "test", "people", storage.Index{
+		Name:                    "age_adult",
+		Keys:                    []storage.IndexKey{{Field: "age", Direction: 1}},
+		PartialFilterExpression: storage.Document{"age": storage.Document{"$gte": int32(30)}},
+	}); err != nil {
+		t.Fatalf("创建部分索引失败: %v", err)
+	}
+
+	entries := func() int64 {
+		t.Helper()
+		stats, err := engine.CollectionStats(ctx, "test", "people")
+		if err != nil {
+			t.Fatalf("获取统计失败: %v", err)
+		}
+		return stats.IndexEntries["age_adult"]
+	}
+	explain := func(filter storage.Document) *storage.Explanation {
+		t.Helper()
+		e, err := engine.Explain(ctx, "test", "people", filter, nil, nil, true)
+		if err != nil {
+			t.Fatalf("explain 失败: %v", err)
+		}
+		return e
+	}
+
+	t.Run("不满足过滤条件的文档不建索引", func(t *testing.T) {
+		if n := entries(); n != 10 {
+			t.Errorf("部分索引应只有 10 个条目, got %d", n)
+		}
+	})
+
+	t.Run("查询条件蕴含过滤条件时使用部分索引", func(t *testing.T) {
+		for _, filter := range []storage.Document{
+			{"age": int32(35)},
+			{"age": storage.Document{"$gt": int32(34)}},
+			{"age": storage.Document{"$gte": int32(30), "$lt": int32(33)}},
+			{"age": storage.Document{"$in": []interface{}{int32(31), int32(38)}}},
+		} {
+			e := explain(filter)
+			if e.Plan.Stage != storage.StageIxScan || e.Plan.IndexName != "age_adult" {
+				t.Errorf("%v 应使用部分索引: %+v", filter, e.Plan)
+			}
+			if e.Stats.NReturned == 0 || e.Stats.KeysExamined != e.Stats.NReturned {
+				t.Errorf("%v 的索引扫描结果不正确: %+v", filter, e.Stats)
+			}
+		}
+	})
+
+	t.Run("查询条件不蕴含过滤条件时全表扫描", func(t *testing.T) {
+		for _, filter := range []storage.Document{
+			{"age": int32(25)},
+			{"age": storage.Document{"$gt": int32(25)}},
+			{"age": storage.Document{"$in": []interface{}{int32(25), int32(35)}}},
+		} {
+			e := explain(filter)
+			if e.Plan.Stage != storage.StageCollScan {
+				t.Errorf("%v 不应使用部分索引: %+v", filter, e.Plan)
+			}
+			found, err := engine.Find(ctx, "test", "people", filter)
+			if err != nil || len(found) == 0 {
+				t.Errorf("%v 应返回不在部分索引中的文档: %v %v", filter, found, err)
+			}
+		}
+	})
+
+	t.Run("更新时维护部分索引", func(t *testing.T) {
+		update := func(id, age int32) {
+			t.Helper()
+			if _, err := engine.Update(ctx, "test", "people", storage.Document{"_id": id},
+				storage.Document{"$set": storage.Document{"age": age}}, storage.UpdateOptions{}); err != nil {
+				t.Fatalf("更新失败: %v", err)
+			}
+		}
+		update(0, 50) // 进入过滤范围
+		update(15, 5) // 离开过滤范围
+		update(16, 3)
+		if n := entries(); n != 9 {
+			t.Errorf("更新后部分索引应有 9 个条目, got %d", n)
+		}
+		found, err := engine.Find(ctx, "test", "people", storage.Document{"age": int32(50)})
+		if err != nil || len(found) != 1 || found[0]["_id"] != int32(0) {
+			t.Errorf("应通过部分索引找到更新后的文档: %v %v", found, err)
+		}
+	})
+}
+
+// TestSparseIndex 测试稀疏索引跳过缺失索引字段的文档
+func TestSparseIndex(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	docs := []storage.Document{
+		{"_id": int32(1), "email": "a@example.com"},
+		{"_id": int32(2), "email": "b@example.com"},
+		{"_id": int32(3)},
+		{"_id": int32(4)},
+		{"_id": int32(5), "email": nil},
+	}
+	if err := engine.Insert(ctx, "test", "users", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.CreateIndex(ctx, "test", "users", storage.Index{
+		Name:   "email_1",
+		Keys:   []storage.IndexKey{{Field: "email", Direction: 1}},
+		Unique: true,
+		Sparse: true,
+	}); err != nil {
+		t.Fatalf("多个文档缺失字段时应能创建唯一稀疏索引: %v", err)
+	}
+
+	entries := func() int64 {
+		t.Helper()
+		stats, err := engine.CollectionStats(ctx, "test", "users")
+		if err != nil {
+			t.Fatalf("获取统计失败: %v", err)
+		}
+		return stats.IndexEntries["email_1"]
+	}
+
+	t.Run("缺失字段的文档不建索引", func(t *testing.T) {
+		// 值为 null 的字段仍然存在，需要建索引
+		if n := entries(); n != 3 {
+			t.Errorf("稀疏索引应有 3 个条目, got %d", n)
+		}
+	})
+
+	t.Run("唯一稀疏索引允许多个缺失字段的文档", func(t *testing.T) {
+		if err := engine.Insert(ctx, "test", "users", []storage.Document{{"_id": int32(6)}, {"_id": int32(7)}}); err != nil {
+			t.Fatalf("插入缺失字段的文档失败: %v", err)
+		}
+		if n := entries(); n != 3 {
+			t.Errorf("缺失字段的文档不应写入稀疏索引, got %d", n)
+		}
+		err := engine.Insert(ctx, "test", "users", []storage.Document{{"_id": int32(8), "email": "a@example.com"}})
+		if !errors.Is(err, storage.ErrDuplicateKey) {
+			t.Errorf("存在字段的重复值仍应违反唯一约束: %v", err)
+		}
+		err = engine.Insert(ctx, "test", "users", []storage.Document{{"_id": int32(9), "email": nil}})
+		if !errors.Is(err, storage.ErrDuplicateKey) {
+			t.Errorf("重复的 null 值仍应违反唯一约束: %v", err)
+		}
+	})
+
+	t.Run("可能匹配缺失字段的查询不使用稀疏索引", func(t *testing.T) {
+		cases := []struct {
+			filter storage.Document
+			stage  string
+			count  int
+		}{
+			{storage.Document{"email": "b@example.com"}, storage.StageIxScan, 1},
+			{storage.Document{"email": storage.Document{"$gt": "a"}}, storage.StageIxScan, 2},
+			{storage.Document{"email": storage.Document{"$ne": "a@example.com"}}, storage.StageCollScan, 6},
+			{storage.Document{"email": nil}, storage.StageCollScan, 5},
+			{storage.Document{"email": storage.Document{"$in": []interface{}{"a@example.com", nil}}}, storage.StageCollScan, 6},
+			{storage.Document{"email": storage.Document{"$exists": false}}, storage.StageCollScan, 4},
+		}
+		for _, c := range cases {
+			e, err := engine.Explain(ctx, "test", "users", c.filter, nil, nil, true)
+			if err != nil {
+				t.Fatalf("explain 失败: %v", err)
+			}
+			if e.Plan.Stage != c.stage {
+				t.Errorf("%v 的执行计划应为 %s: %+v", c.filter, c.stage, e.Plan)
+			}
+			if found, err := engine.Find(ctx, "test", "users", c.filter); err != nil || len(found) != c.count {
+				t.Errorf("%v 应返回 %d 个文档, got %d, %v", c.filter, c.count, len(found), err)
+			}
+		}
+	})
+}
+
+// TestQueryHint 测试 hint 强制使用指定索引或全表扫描，以及不可用的提示返回错误
+func TestQueryHint(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := make([]storage.Document, 0, 20)
+	for i := 0; i < 20; i++ {
+		doc := storage.Document{"_id": int32(i), "a": int32(i % 5), "b": int32(i)}
+		if i%2 == 0 {
+			doc["c"] = int32(i)
+		}
+		docs = append(docs, doc)
+	}
+	if err := engine.Insert(ctx, "test", "hints", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	indexes := []storage.Index{
+		{Name: "a_1", Keys: []storage.IndexKey{{Field: "a", Direction: 1}}},
+		{Name: "a_1_b_-1", Keys: []storage.IndexKey{{Field: "a", Direction: 1}, {Field: "b", Direction: -1}}},
+		{Name: "c_1", Keys: []storage.IndexKey{{Field: "c", Direction: 1}}, Sparse: true},
+	}
+	for _, index := range indexes {
+		if err := engine.CreateIndex(ctx, "test", "hints", index); err != nil {
+			t.Fatalf("创建索引 %s 失败: %v", index.Name, err)
+		}
+	}
+
+	filter := storage.Document{"a": int32(2), "b": storage.Document{"$gte": int32(5)}}
+	cases := []struct {
+		name      string
+		hint      *storage.Hint
+		stage     string
+		indexName string
+	}{
+		{"不指定时选择前缀字段最多的索引", nil, storage.StageIxScan, "a_1_b_-1"},
+		{"按索引名", &storage.Hint{IndexName: "a_1"}, storage.StageIxScan, "a_1"},
+		{"按键模式", &storage.Hint{Keys: []storage.IndexKey{{Field: "a", Direction: 1}}}, storage.StageIxScan, "a_1"},
+		{"过滤条件不含索引字段时扫描整个索引", &storage.Hint{IndexName: "_id_"}, storage.StageIxScan, "_id_"},
+		{"$natural", &storage.Hint{Natural: true}, storage.StageCollScan, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, err := engine.Explain(ctx, "test", "hints", filter, nil, c.hint, true)
+			if err != nil {
+				t.Fatalf("explain 失败: %v", err)
+			}
+			if e.Plan.Stage != c.stage || e.Plan.IndexName != c.indexName {
+				t.Errorf("计划应为 %s %s, got %s %s", c.stage, c.indexName, e.Plan.Stage, e.Plan.IndexName)
+			}
+			if e.Stats.NReturned != 3 {
+				t.Errorf("应返回 3 个文档, got %d", e.Stats.NReturned)
+			}
+			found, err := engine.FindWithHint(ctx, "test", "hints", filter, c.hint)
+			if err != nil || len(found) != 3 {
+				t.Errorf("FindWithHint 应返回 3 个文档, got %d, %v", len(found), err)
+			}
+		})
+	}
+
+	// 全表扫描读取全部文档，整个索引扫描读取全部索引条目
+	e, _ := engine.Explain(ctx, "test", "hints", filter, nil, &storage.Hint{Natural: true}, true)
+	if e.Stats.DocsExamined != 20 || e.Stats.KeysExamined != 0 {
+		t.Errorf("$natural 应全表扫描: %+v", e.Stats)
+	}
+	e, _ = engine.Explain(ctx, "test", "hints", filter, nil, &storage.Hint{IndexName: "_id_"}, true)
+	if e.Stats.KeysExamined != 20 {
+		t.Errorf("应扫描整个 _id_ 索引: %+v", e.Stats)
+	}
+
+	bad := []*storage.Hint{
+		{IndexName: "missing"},
+		{Keys: []storage.IndexKey{{Field: "a", Direction: -1}}},
+		// 稀疏索引不包含缺少 c 的文档
+		{IndexName: "c_1"},
+	}
+	for _, hint := range bad {
+		if _, err := engine.FindWithHint(ctx, "test", "hints", filter, hint); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("hint %s 应返回 ErrBadValue, got %v", hint, err)
+		}
+	}
+	found, err := engine.FindWithHint(ctx, "test", "hints", storage.Document{"c": storage.Document{"$gt": int32(10)}}, &storage.Hint{IndexName: "c_1"})
+	if err != nil || len(found) != 4 {
+		t.Errorf("过滤条件排除缺少 c 的文档时可以使用稀疏索引, got %d, %v", len(found), err)
+	}
+}
+
+// TestIndexBounds 测试 min/max 将索引扫描限定在 [min, max) 内
+func TestIndexBounds(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := make([]storage.Document, 0, 20)
+	for i := 0; i < 20; i++ {
+		docs = append(docs, storage.Document{"_id": int32(i), "a": int32(i / 5), "b": int32(i % 5)})
+	}
+	if err := engine.Insert(ctx, "test", "bounds", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	index := storage.Index{Name: "a_1_b_1", Keys: []storage.IndexKey{{Field: "a", Direction: 1}, {Field: "b", Direction: 1}}}
+	if err := engine.CreateIndex(ctx, "test", "bounds", index); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	key := func(a, b int32) []storage.IndexKeyValue {
+		return []storage.IndexKeyValue{{Field: "a", Value: a}, {Field: "b", Value: b}}
+	}
+	ids := func(filter storage.Document, hint *storage.Hint) []int32 {
+		t.Helper()
+		found, err := engine.FindWithHint(ctx, "test", "bounds", filter, hint)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		out := make([]int32, len(found))
+		for i, doc := range found {
+			out[i] = doc["_id"].(int32)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+		return out
+	}
+	equal := func(a []int32, b ...int32) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// [{a: 1, b: 3}, {a: 2, b: 2}) 包含 _id 8..11，上界不包含
+	hint := &storage.Hint{IndexName: "a_1_b_1", Min: key(1, 3), Max: key(2, 2)}
+	if got := ids(storage.Document{}, hint); !equal(got, 8, 9, 10, 11) {
+		t.Errorf("[min, max) 范围内的文档不正确: %v", got)
+	}
+	e, err := engine.Explain(ctx, "test", "bounds", storage.Document{}, nil, hint, true)
+	if err != nil || e.Stats.KeysExamined != 4 {
+		t.Errorf("只应扫描范围内的索引条目: %+v, %v", e.Stats, err)
+	}
+	// 过滤条件在读取文档后检查
+	if got := ids(storage.Document{"b": int32(4)}, hint); !equal(got, 9) {
+		t.Errorf("过滤条件应继续生效: %v", got)
+	}
+	// 只有下界或上界，不指定索引时使用字段一致的索引
+	if got := ids(storage.Document{}, &storage.Hint{Min: key(3, 3)}); !equal(got, 18, 19) {
+		t.Errorf("只有 min 时的结果不正确: %v", got)
+	}
+	if got := ids(storage.Document{}, &storage.Hint{Max: key(0, 2)}); !equal(got, 0, 1) {
+		t.Errorf("只有 max 时的结果不正确: %v", got)
+	}
+
+	bad := []*storage.Hint{
+		// 字段顺序与键模式不一致
+		{IndexName: "a_1_b_1", Min: []storage.IndexKeyValue{{Field: "b", Value: int32(0)}, {Field: "a", Value: int32(0)}}},
+		// 只有键模式的前缀
+		{IndexName: "a_1_b_1", Min: []storage.IndexKeyValue{{Field: "a", Value: int32(0)}}},
+		{IndexName: "_id_", Min: key(0, 0)},
+		{Min: []storage.IndexKeyValue{{Field: "c", Value: int32(0)}}},
+		{Min: key(2, 0), Max: key(1, 0)},
+		{Min: key(0, 0), Max: []storage.IndexKeyValue{{Field: "a", Value: int32(1)}}},
+		{Natural: true, Min: key(0, 0)},
+	}
+	for i, hint := range bad {
+		if _, err := engine.FindWithHint(ctx, "test", "bounds", storage.Document{}, hint); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("第 %d 个提示应返回 ErrBadValue, got %v", i, err)
+		}
+	}
+}
+
+// TestCoveredQuery 测试覆盖查询只用索引键返回结果，并保留数值的原始类型
+func TestCoveredQuery(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := []storage.Document{
+		{"_id": int32(1), "a": int32(1), "b": "x", "c": true},
+		{"_id": int32(2), "a": int64(1) << 60, "b": 2.5, "c": true},
+		{"_id": int32(3), "a": int32(3), "c": true},
+	}
+	if err := engine.Insert(ctx, "test", "covered", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	index := storage.Index{Name: "a_1_b_1", Keys: []storage.IndexKey{{Field: "a", Direction: 1}, {Field: "b", Direction: 1}}}
+	if err := engine.CreateIndex(ctx, "test", "covered", index); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	projection := storage.Document{"a": int32(1), "b": int32(1), "_id": int32(0)}
+	find := func(filter storage.Document) ([]storage.Document, *storage.ExecutionStats) {
+		t.Helper()
+		stats := &storage.ExecutionStats{}
+		cursor, err := engine.FindCursor(storage.WithExecutionStats(ctx, stats), "test", "covered", filter, projection, nil)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		defer cursor.Close()
+		var found []storage.Document
+		for {
+			doc, err := cursor.Next(storage.WithExecutionStats(ctx, stats))
+			if err != nil {
+				t.Fatalf("读取结果失败: %v", err)
+			}
+			if doc == nil {
+				return found, stats
+			}
+			found = append(found, doc)
+		}
+	}
+
+	e, err := engine.Explain(ctx, "test", "covered", storage.Document{"a": storage.Document{"$in": []interface{}{int32(1), int64(1) << 60}}}, projection, nil, true)
+	if err != nil || !e.Plan.Covered || e.Stats.DocsExamined != 0 {
+		t.Fatalf("应为覆盖查询且不读取文档: %+v, %+v, %v", e.Plan, e.Stats, err)
+	}
+
+	found, stats := find(storage.Document{"a": int32(1)})
+	if len(found) != 1 || found[0]["a"] != int32(1) || found[0]["b"] != "x" || stats.DocsExamined != 0 {
+		t.Errorf("a 为 1 的结果不正确: %v, %+v", found, stats)
+	}
+	// 超过 2^53 的 int64 需要从类型信息中还原原值
+	found, _ = find(storage.Document{"a": int64(1) << 60})
+	if len(found) != 1 || found[0]["a"] != int64(1)<<60 || found[0]["b"] != 2.5 {
+		t.Errorf("int64 取值还原不正确: %v", found)
+	}
+	// b 缺失时索引键为 null，需要读取文档区分缺失和 null
+	found, stats = find(storage.Document{"a": int32(3)})
+	if len(found) != 1 || stats.DocsExamined != 1 {
+		t.Errorf("索引键含 null 时应读取文档: %v, %+v", found, stats)
+	}
+
+	// 只改变数值类型的更新同样需要重写索引条目
+	if _, err := engine.Update(ctx, "test", "covered", storage.Document{"_id": int32(1)},
+		storage.Document{"$set": storage.Document{"a": 1.0}}, storage.UpdateOptions{}); err != nil {
+		t.Fatalf("更新失败: %v", err)
+	}
+	found, _ = find(storage.Document{"a": int32(1)})
+	if len(found) != 1 || found[0]["a"] != 1.0 {
+		t.Errorf("更新后 a 应为 double: %v", found)
+	}
+
+	// 过滤条件或投影用到索引以外的字段时不能覆盖
+	for _, c := range []struct{ filter, projection storage.Document }{
+		{storage.Document{"a": int32(1), "c": true}, projection},
+		{storage.Document{"a": int32(1)}, storage.Document{"a": int32(1), "c": int32(1), "_id": int32(0)}},
+		{storage.Document{"a": int32(1)}, storage.Document{"a": int32(1)}},
+		{storage.Document{"a": int32(1)}, nil},
+	} {
+		e, err := engine.Explain(ctx, "test", "covered", c.filter, c.projection, nil, false)
+		if err != nil || e.Plan.Covered {
+			t.Errorf("filter %v projection %v 不应覆盖: %v", c.filter, c.projection, err)
+		}
+	}
+}
+
+// TestCoveredDistinct 测试有包含字段的索引时 distinct 只扫描索引键，结果与读取文档时相同
+func TestCoveredDistinct(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := []storage.Document{
+		{"_id": int32(1), "city": "Beijing", "age": int32(30)},
+		{"_id": int32(2), "city": "Shanghai", "age": 30.0},
+		{"_id": int32(3), "city": "Beijing", "age": int32(25)},
+		{"_id": int32(4), "age": int32(40)},
+		{"_id": int32(5), "city": nil},
+	}
+	if err := engine.Insert(ctx, "test", "people", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	distinct := func(field string, filter storage.Document) ([]interface{}, *storage.ExecutionStats) {
+		t.Helper()
+		stats := &storage.ExecutionStats{}
+		values, err := engine.Distinct(storage.WithExecutionStats(ctx, stats), "test", "people", field, filter)
+		if err != nil {
+			t.Fatalf("distinct 失败: %v", err)
+		}
+		return values, stats
+	}
+
+	if _, stats := distinct("city", nil); stats.DocsExamined != int64(len(docs)) || stats.KeysExamined != 0 {
+		t.Errorf("没有索引时应读取全部文档: %+v", stats)
+	}
+	index := storage.Index{Name: "city_1_age_1", Keys: []storage.IndexKey{{Field: "city", Direction: 1}, {Field: "age", Direction: 1}}}
+	if err := engine.CreateIndex(ctx, "test", "people", index); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+
+	// city 缺失或为 null 的条目需要读取文档区分，其余条目只用索引键
+	values, stats := distinct("city", nil)
+	if len(values) != 3 || values[0] != nil || values[1] != "Beijing" || values[2] != "Shanghai" || stats.DocsExamined != 2 {
+		t.Errorf("city = %v, %+v", values, stats)
+	}
+	// int32(30) 与 30.0 视为同一个值
+	values, stats = distinct("age", storage.Document{"city": "Beijing"})
+	if len(values) != 2 || values[0] != int32(25) || values[1] != int32(30) || stats.DocsExamined != 0 {
+		t.Errorf("age = %v, %+v", values, stats)
+	}
+	// 过滤条件用到索引以外的字段时读取文档
+	if _, stats := distinct("age", storage.Document{"city": "Beijing", "_id": int32(1)}); stats.DocsExamined == 0 {
+		t.Errorf("不能覆盖时应读取文档: %+v", stats)
+	}
+
+	// 多键索引的条目按数组元素展开，不能覆盖
+	if err := engine.Insert(ctx, "test", "people", []storage.Document{{"_id": int32(6), "city": []interface{}{"Beijing", "Tianjin"}}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	values, stats = distinct("city", nil)
+	if len(values) != 4 || stats.DocsExamined == 0 {
+		t.Errorf("多键索引 city = %v, %+v", values, stats)
+	}
+}
+
+// TestIDIndexLookup 测试 _id 等值查询通过 _id_ 索引只读取一个索引条目和一个文档
+func TestIDIndexLookup(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	const n = 5000
+	ids := make([]interface{}, 0, n+2)
+	docs := make([]storage.Document, 0, n+2)
+	for i := 0; i < n; i++ {
+		id := storage.NewObjectID()
+		ids = append(ids, id)
+		docs = append(docs, storage.Document{"_id": id, "i": int32(i)})
+	}
+	ids = append(ids, int32(7), "seven")
+	docs = append(docs, storage.Document{"_id": int32(7)}, storage.Document{"_id": "seven"})
+	if err := engine.Insert(ctx, "test", "ids", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+
+	for _, id := range []interface{}{ids[0], ids[n/2], ids[n-1], ids[n], ids[n+1]} {
+		e, err := engine.Explain(ctx, "test", "ids", storage.Document{"_id": id}, nil, nil, true)
+		if err != nil {
+			t.Fatalf("explain 失败: %v", err)
+		}
+		if e.Plan.Stage != storage.StageIxScan || e.Plan.IndexName != storage.IdIndexName {
+			t.Errorf("_id %v 应使用 _id_ 索引: %+v", id, e.Plan)
+		}
+		if e.Stats.NReturned != 1 || e.Stats.KeysExamined != 1 || e.Stats.DocsExamined != 1 {
+			t.Errorf("_id %v 应只读取一个索引条目和一个文档: %+v", id, e.Stats)
+		}
+	}
+
+	// 数值按数学值比较，int64 的 7 同样命中 int32 的 _id
+	found, err := engine.Find(ctx, "test", "ids", storage.Document{"_id": int64(7)})
+	if err != nil || len(found) != 1 || found[0]["_id"] != int32(7) {
+		t.Errorf("按 int64 查询 _id 结果不正确: %v, %v", found, err)
+	}
+	// ObjectID 的索引键保持字节序，范围查询只读取范围内的文档
+	pivot := ids[n-10].(storage.ObjectID)
+	var want int64
+	for _, id := range ids[:n] {
+		if oid := id.(storage.ObjectID); bytes.Compare(oid[:], pivot[:]) >= 0 {
+			want++
+		}
+	}
+	e, err := engine.Explain(ctx, "test", "ids", storage.Document{"_id": storage.Document{"$gte": pivot}}, nil, nil, true)
+	if err != nil || e.Plan.IndexName != storage.IdIndexName || e.Stats.NReturned != want || e.Stats.DocsExamined != want {
+		t.Errorf("_id 范围查询应只读取范围内的 %d 个文档: %+v, %v", want, e.Stats, err)
+	}
+}
+
+// TestHashedIndex 测试哈希索引用于等值查询，范围查询退回全表扫描
+func TestHashedIndex(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := make([]storage.Document, 0, 100)
+	for i := 0; i < 100; i++ {
+		docs = append(docs, storage.Document{"_id": int32(i), "user": fmt.Sprintf("u%d", i%20), "n": int32(i)})
+	}
+	docs = append(docs, storage.Document{"_id": int32(100), "user": []interface{}{"u3", "x"}})
+	if err := engine.Insert(ctx, "test", "events", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	hashed := storage.Index{Name: "user_hashed", Keys: []storage.IndexKey{{Field: "user", Direction: 1, Type: storage.IndexTypeHashed}}}
+	if err := engine.CreateIndex(ctx, "test", "events", hashed); err != nil {
+		t.Fatalf("创建哈希索引失败: %v", err)
+	}
+	n := storage.Index{Name: "n_hashed", Keys: []storage.IndexKey{{Field: "n", Direction: 1, Type: storage.IndexTypeHashed}}}
+	if err := engine.CreateIndex(ctx, "test", "events", n); err != nil {
+		t.Fatalf("创建哈希索引失败: %v", err)
+	}
+
+	explain := func(filter storage.Document) *storage.Explanation {
+		t.Helper()
+		e, err := engine.Explain(ctx, "test", "events", filter, nil, nil, true)
+		if err != nil {
+			t.Fatalf("explain %v 失败: %v", filter, err)
+		}
+		return e
+	}
+
+	// 数组字段按元素建立索引，u3 同样命中包含 u3 的数组
+	e := explain(storage.Document{"user": "u3"})
+	if e.Plan.Stage != storage.StageIxScan || e.Plan.IndexName != "user_hashed" {
+		t.Fatalf("等值查询应使用哈希索引: %+v", e.Plan)
+	}
+	if e.Stats.NReturned != 6 || e.Stats.DocsExamined != 6 {
+		t.Errorf("等值查询应只读取匹配的 6 个文档: %+v", e.Stats)
+	}
+	e = explain(storage.Document{"user": storage.Document{"$in": []interface{}{"u1", "u2"}}})
+	if e.Plan.IndexName != "user_hashed" || e.Stats.NReturned != 10 || e.Stats.DocsExamined != 10 {
+		t.Errorf("$in 查询应使用哈希索引: %+v, %+v", e.Plan, e.Stats)
+	}
+	// 数值按数学值哈希，int64 和 double 的取值同样命中
+	for _, v := range []interface{}{int64(42), float64(42)} {
+		e = explain(storage.Document{"n": v})
+		if e.Plan.IndexName != "n_hashed" || e.Stats.NReturned != 1 {
+			t.Errorf("n = %v(%T) 应通过哈希索引找到一个文档: %+v, %+v", v, v, e.Plan, e.Stats)
+		}
+	}
+
+	e = explain(storage.Document{"n": storage.Document{"$gte": int32(90)}})
+	if e.Plan.Stage != storage.StageCollScan {
+		t.Errorf("范围查询不能使用哈希索引: %+v", e.Plan)
+	}
+	if e.Stats.NReturned != 10 {
+		t.Errorf("范围查询应返回 10 个文档: %+v", e.Stats)
+	}
+
+	for _, index := range []storage.Index{
+		{Name: "unique_hashed", Keys: []storage.IndexKey{{Field: "user", Direction: 1, Type: storage.IndexTypeHashed}}, Unique: true},
+		{Name: "compound_hashed", Keys: []storage.IndexKey{{Field: "a", Direction: 1, Type: storage.IndexTypeHashed}, {Field: "b", Direction: 1, Type: storage.IndexTypeHashed}}},
+	} {
+		if err := engine.CreateIndex(ctx, "test", "events", index); !errors.Is(err, storage.ErrBadValue) {
+			t.Errorf("创建索引 %s err = %v, want ErrBadValue", index.Name, err)
+		}
+	}
+}
+
+// TestSelectivityEstimate 测试计划器按集合样本估计的选择性优先使用选择性高的索引，并在 explain 中给出估计
+func TestSelectivityEstimate(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	const total = 1000
+	docs := make([]storage.Document, total)
+	for i := range docs {
+		docs[i] = storage.Document{"_id": int32(i), "status": []string{"active", "inactive"}[i%2], "sku": fmt.Sprintf("sku-%04d", i)}
+	}
+	if err := engine.Insert(ctx, "test", "orders", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	// 选择性低的索引先创建，按前缀字段数和创建顺序会选中它
+	for _, field := range []string{"status", "sku"} {
+		index := storage.Index{Name: field + "_1", Keys: []storage.IndexKey{{Field: field, Direction: 1}}}
+		if err := engine.CreateIndex(ctx, "test", "orders", index); err != nil {
+			t.Fatalf("创建索引失败: %v", err)
+		}
+	}
+
+	filter := storage.Document{"status": "active", "sku": "sku-0042"}
+	e, err := engine.Explain(ctx, "test", "orders", filter, nil, nil, true)
+	if err != nil {
+		t.Fatalf("explain 失败: %v", err)
+	}
+	if e.Plan.IndexName != "sku_1" {
+		t.Fatalf("应使用选择性高的 sku_1, 实际为 %q", e.Plan.IndexName)
+	}
+	if e.Stats.DocsExamined != 1 || e.Stats.NReturned != 1 {
+		t.Errorf("sku_1 应只读取 1 个文档: %+v", e.Stats)
+	}
+	if e.Plan.CostEstimate < 0 || e.Plan.CostEstimate > 10 {
+		t.Errorf("sku_1 的读取估计应接近 1, 实际为 %v", e.Plan.CostEstimate)
+	}
+
+	estimates := make(map[string]float64)
+	for _, plan := range e.Rejected {
+		estimates[plan.Stage+":"+plan.IndexName] = plan.CostEstimate
+	}
+	if cost, ok := estimates["IXSCAN:status_1"]; !ok || cost < 350 || cost > 650 {
+		t.Errorf("status_1 的读取估计应接近 500: %v", estimates)
+	}
+	if cost, ok := estimates["COLLSCAN:"]; !ok || cost != total {
+		t.Errorf("全表扫描的读取估计应为文档数 %d: %v", total, estimates)
+	}
+
+	// 删除 inactive 文档后样本随之更新，status 条件不再排除任何文档
+	if _, err := engine.Delete(ctx, "test", "orders", storage.Document{"status": "inactive"}, false); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	e, err = engine.Explain(ctx, "test", "orders", storage.Document{"status": "active"}, nil, nil, false)
+	if err != nil {
+		t.Fatalf("explain 失败: %v", err)
+	}
+	if e.Plan.CardinalityEstimate != total/2 {
+		t.Errorf("删除后 status 为 active 的文档数估计应为 %d, 实际为 %v", total/2, e.Plan.CardinalityEstimate)
+	}
+}
+
+// TestDropIndexDuringScan 测试游标使用的索引被删除后继续读取返回 ErrQueryPlanKilled 而不是使用已删除的索引
+func TestDropIndexDuringScan(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := make([]storage.Document, 10)
+	for i := range docs {
+		docs[i] = storage.Document{"_id": int32(i), "n": int32(i), "sku": fmt.Sprintf("sku-%d", i)}
+	}
+	if err := engine.Insert(ctx, "test", "items", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	for _, index := range []storage.Index{
+		{Name: "n_1", Keys: []storage.IndexKey{{Field: "n", Direction: 1}}},
+		{Name: "sku_1", Keys: []storage.IndexKey{{Field: "sku", Direction: 1}}, Unique: true},
+	} {
+		if err := engine.CreateIndex(ctx, "test", "items", index); err != nil {
+			t.Fatalf("创建索引失败: %v", err)
+		}
+	}
+
+	t.Run("多区间扫描", func(t *testing.T) {
+		filter := storage.Document{"n": storage.Document{"$in": []interface{}{int32(1), int32(5), int32(8)}}}
+		cursor, err := engine.FindCursor(ctx, "test", "items", filter, nil, nil)
+		if err != nil {
+			t.Fatalf("创建游标失败: %v", err)
+		}
+		defer cursor.Close()
+		if doc, err := cursor.Next(ctx); err != nil || doc == nil {
+			t.Fatalf("删除索引前应能读取文档: %v, %v", doc, err)
+		}
+		if err := engine.DropIndex(ctx, "test", "items", "n_1"); err != nil {
+			t.Fatalf("删除索引失败: %v", err)
+		}
+		if _, err := cursor.Next(ctx); !errors.Is(err, storage.ErrQueryPlanKilled) {
+			t.Errorf("索引删除后应返回 ErrQueryPlanKilled, got %v", err)
+		}
+	})
+
+	t.Run("点查询", func(t *testing.T) {
+		cursor, err := engine.FindCursor(ctx, "test", "items", storage.Document{"sku": "sku-3"}, nil, nil)
+		if err != nil {
+			t.Fatalf("创建游标失败: %v", err)
+		}
+		defer cursor.Close()
+		if err := engine.DropIndex(ctx, "test", "items", "sku_1"); err != nil {
+			t.Fatalf("删除索引失败: %v", err)
+		}
+		if _, err := cursor.Next(ctx); !errors.Is(err, storage.ErrQueryPlanKilled) {
+			t.Errorf("索引删除后应返回 ErrQueryPlanKilled, got %v", err)
+		}
+	})
+}
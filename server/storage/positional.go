@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// arrayFilterIdentifier arrayFilters 标识符：以小写字母开头，只包含字母和数字
+var arrayFilterIdentifier = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+
+// positionalUpdate 展开更新路径中的位置操作符所需的条件
+// $ 按查询条件确定数组中第一个匹配的元素，$[] 选中所有元素，$[<identifier>] 按 arrayFilters 中该标识符的条件筛选元素
+type positionalUpdate struct {
+	filter       Document
+	arrayFilters map[string]Document
+}
+
+// newPositionalUpdate 解析 arrayFilters 并检查更新路径中的标识符
+// 每个过滤条件只能使用一个标识符，路径中的标识符必须有对应的过滤条件，每个过滤条件也必须在更新路径中使用
+func newPositionalUpdate(filter, update Document, arrayFilters []Document) (*positionalUpdate, error) {
+	p := &positionalUpdate{filter: filter, arrayFilters: make(map[string]Document, len(arrayFilters))}
+	for _, af := range arrayFilters {
+		id := ""
+		for key := range af {
+			name := strings.SplitN(key, ".", 2)[0]
+			if !arrayFilterIdentifier.MatchString(name) {
+				return nil, fmt.Errorf("arrayFilters 的标识符必须以小写字母开头且只包含字母和数字: %s", name)
+			}
+			if id != "" && id != name {
+				return nil, fmt.Errorf("每个 arrayFilters 条件只能使用一个标识符, 实际为 %s 和 %s", id, name)
+			}
+			id = name
+		}
+		if id == "" {
+			return nil, fmt.Errorf("arrayFilters 的条件不能为空")
+		}
+		if _, dup := p.arrayFilters[id]; dup {
+			return nil, fmt.Errorf("arrayFilters 中的标识符 %s 重复", id)
+		}
+		if _, err := matchDocument(Document{}, af); err != nil {
+			return nil, err
+		}
+		p.arrayFilters[id] = af
+	}
+
+	used := make(map[string]bool)
+	for op, fields := range update {
+		if !strings.HasPrefix(op, "$") {
+			continue
+		}
+		for path := range toDocument(fields) {
+			for _, part := range strings.Split(path, ".") {
+				id, ok := filteredIdentifier(part)
+				if !ok {
+					continue
+				}
+				if _, defined := p.arrayFilters[id]; !defined {
+					return nil, fmt.Errorf("路径 %s 中的标识符 %s 没有对应的 arrayFilters 条件", path, id)
+				}
+				used[id] = true
+			}
+		}
+	}
+	for id := range p.arrayFilters {
+		if !used[id] {
+			return nil, fmt.Errorf("arrayFilters 中的标识符 %s 没有在更新中使用", id)
+		}
+	}
+	return p, nil
+}
+
+// filteredIdentifier 返回 $[<identifier>] 路径段中的标识符
+func filteredIdentifier(part string) (string, bool) {
+	if len(part) > 3 && strings.HasPrefix(part, "$[") && strings.HasSuffix(part, "]") {
+		return part[2 : len(part)-1], true
+	}
+	return "", false
+}
+
+// expandPaths 将含位置操作符的路径展开为 doc 中的具体路径，位置操作符替换为数组下标
+// 不含位置操作符时原样返回；位置操作符所在的字段必须是已存在的数组，$[<identifier>] 没有匹配的元素时返回空
+func (p *positionalUpdate) expandPaths(doc Document, parts []string) ([][]string, error) {
+	for i, part := range parts {
+		if part != "$" && !strings.HasPrefix(part, "$[") {
+			continue
+		}
+		prefix := parts[:i]
+		path := strings.Join(prefix, ".")
+		value, ok := valueAtPath(doc, prefix)
+		if part == "$" && (!ok || canonicalType(value) != canonicalArray) {
+			return nil, fmt.Errorf("位置操作符 $ 没有在查询条件中找到匹配的数组元素: %s", path)
+		}
+		if !ok || canonicalType(value) != canonicalArray {
+			return nil, fmt.Errorf("字段 %s 必须是已存在的数组才能使用 %s", path, part)
+		}
+
+		arr := toArray(value)
+		var indexes []int
+		switch part {
+		case "$":
+			idx, err := positionalIndex(doc, path, p.filter)
+			if err != nil {
+				return nil, err
+			}
+			if idx < 0 {
+				return nil, fmt.Errorf("位置操作符 $ 没有在查询条件中找到匹配的数组元素: %s", path)
+			}
+			indexes = []int{idx}
+		case "$[]":
+			for idx := range arr {
+				indexes = append(indexes, idx)
+			}
+		default:
+			id, ok := filteredIdentifier(part)
+			if !ok {
+				return nil, fmt.Errorf("无效的位置操作符: %s", part)
+			}
+			for idx, elem := range arr {
+				matched, err := matchDocument(Document{id: elem}, p.arrayFilters[id])
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					indexes = append(indexes, idx)
+				}
+			}
+		}
+
+		var expanded [][]string
+		for _, idx := range indexes {
+			concrete := append(append(append([]string{}, prefix...), strconv.Itoa(idx)), parts[i+1:]...)
+			paths, err := p.expandPaths(doc, concrete)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, paths...)
+		}
+		return expanded, nil
+	}
+	return [][]string{parts}, nil
+}
+
+// valueAtPath 按具体路径取值，数组上的路径段必须是下标，不展开数组元素
+func valueAtPath(value interface{}, parts []string) (interface{}, bool) {
+	for _, part := range parts {
+		if doc := toDocument(value); doc != nil {
+			child, ok := doc[part]
+			if !ok {
+				return nil, false
+			}
+			value = child
+			continue
+		}
+		arr := toArray(value)
+		idx, err := strconv.Atoi(part)
+		if arr == nil || err != nil || idx < 0 || idx >= len(arr) {
+			return nil, false
+		}
+		value = arr[idx]
+	}
+	return value, true
+}
+
+// positionalIndex 返回数组字段中第一个满足查询条件的元素下标，没有满足的元素或字段不是数组时返回 -1
+// 只检查查询条件中位于该数组字段及其子字段上的条件，没有这样的条件时返回错误
+func positionalIndex(doc Document, path string, filter Document) (int, error) {
+	conds := Document{}
+	for key, cond := range filter {
+		if key == path || strings.HasPrefix(key, path+".") {
+			conds[key] = cond
+		}
+	}
+	if len(conds) == 0 {
+		return -1, fmt.Errorf("位置操作符的字段 %s 必须出现在查询条件中", path)
+	}
+
+	parts := strings.Split(path, ".")
+	values := lookupPath(doc, parts)
+	if len(values) != 1 || canonicalType(values[0]) != canonicalArray {
+		return -1, nil
+	}
+	for i, elem := range toArray(values[0]) {
+		// 将数组替换为只含该元素的数组后检查条件，嵌套字段的条件同样适用
+		candidate := cloneDocument(doc)
+		if err := setPath(candidate, parts, []interface{}{elem}); err != nil {
+			return -1, err
+		}
+		ok, err := matchDocument(candidate, conds)
+		if err != nil {
+			return -1, err
+		}
+		if ok {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
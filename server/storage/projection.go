@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ApplyProjection 对文档应用投影，返回新文档
+// 支持包含模式 {a: 1} 与排除模式 {a: 0}，除 _id 外两种模式不能混用
+// 数组字段可以使用 {a: {$slice: n}}、{a: {$slice: [skip, limit]}} 和 {a: {$elemMatch: <条件>}}
+func ApplyProjection(doc, projection Document) (Document, error) {
+	return ApplyQueryProjection(doc, projection, nil)
+}
+
+// ApplyQueryProjection 对查询结果应用投影，在 ApplyProjection 的基础上支持位置投影 {"a.$": 1}，
+// 返回数组 a 中第一个满足查询条件 filter 的元素
+func ApplyQueryProjection(doc, projection, filter Document) (Document, error) {
+	if len(projection) == 0 {
+		return doc, nil
+	}
+	result, err := applyProjection(doc, projection, filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	return result, nil
+}
+
+// projectionSpec 解析后的投影
+type projectionSpec struct {
+	fields     Document // 普通的包含或排除字段
+	slices     Document // $slice 投影的字段及参数
+	elemMatch  Document // $elemMatch 投影的字段及条件
+	positional string   // 位置投影的数组字段路径，没有时为空
+	inclusion  bool
+}
+
+// parseProjection 区分普通字段与数组投影操作符，并确定投影模式
+func parseProjection(projection Document) (*projectionSpec, error) {
+	spec := &projectionSpec{
+		fields:    Document{},
+		slices:    Document{},
+		elemMatch: Document{},
+	}
+	for path, value := range projection {
+		if strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("不支持的投影操作符: %s", path)
+		}
+		if strings.HasSuffix(path, ".$") {
+			if spec.positional != "" {
+				return nil, fmt.Errorf("投影中只能有一个位置操作符")
+			}
+			if !isTruthy(value) {
+				return nil, fmt.Errorf("位置投影 %s 不能用于排除字段", path)
+			}
+			spec.positional = strings.TrimSuffix(path, ".$")
+			continue
+		}
+		ops, isOps, err := operatorDocument(value)
+		if err != nil {
+			return nil, err
+		}
+		if !isOps {
+			spec.fields[path] = value
+			continue
+		}
+		if len(ops) != 1 {
+			return nil, fmt.Errorf("字段 %s 的投影只能有一个操作符", path)
+		}
+		switch {
+		case ops["$slice"] != nil:
+			spec.slices[path] = ops["$slice"]
+		case ops["$elemMatch"] != nil:
+			cond := toDocument(ops["$elemMatch"])
+			if cond == nil {
+				return nil, fmt.Errorf("$elemMatch 投影需要文档参数")
+			}
+			if strings.Contains(path, ".") {
+				return nil, fmt.Errorf("$elemMatch 投影不能用于嵌套字段 %s", path)
+			}
+			spec.elemMatch[path] = cond
+		default:
+			return nil, fmt.Errorf("不支持的投影操作符: %s", sortedKeys(ops)[0])
+		}
+	}
+
+	// $elemMatch 和位置投影属于包含模式，$slice 不影响投影模式
+	inclusion, err := projectionMode(spec.fields)
+	if err != nil {
+		return nil, err
+	}
+	if len(spec.elemMatch) > 0 || spec.positional != "" {
+		if !inclusion && hasNonIDFields(spec.fields) {
+			return nil, fmt.Errorf("投影不能同时包含和排除字段")
+		}
+		inclusion = true
+	} else if len(spec.fields) == 0 {
+		// 只有 $slice 时返回其余全部字段
+		inclusion = false
+	}
+	spec.inclusion = inclusion
+	return spec, nil
+}
+
+// hasNonIDFields 判断投影中是否有 _id 以外的普通字段
+func hasNonIDFields(fields Document) bool {
+	for path := range fields {
+		if path != "_id" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyProjection 按解析后的投影构造结果文档
+func applyProjection(doc, projection, filter Document) (Document, error) {
+	spec, err := parseProjection(projection)
+	if err != nil {
+		return nil, err
+	}
+
+	var result Document
+	if !spec.inclusion {
+		result = cloneDocument(doc)
+		for path := range spec.fields {
+			unsetPath(result, strings.Split(path, "."))
+		}
+	} else {
+		result = Document{}
+		if id, ok := doc["_id"]; ok {
+			if include, set := spec.fields["_id"]; !set || isTruthy(include) {
+				result["_id"] = cloneValue(id)
+			}
+		}
+		for _, path := range sortedKeys(spec.fields) {
+			if path == "_id" {
+				continue
+			}
+			includePath(doc, result, strings.Split(path, "."))
+		}
+		for path := range spec.slices {
+			includePath(doc, result, strings.Split(path, "."))
+		}
+	}
+
+	for _, path := range sortedKeys(spec.elemMatch) {
+		arr := toArray(doc[path])
+		i, err := elemMatchIndex(arr, toDocument(spec.elemMatch[path]))
+		if err != nil {
+			return nil, err
+		}
+		if i >= 0 {
+			result[path] = []interface{}{cloneValue(arr[i])}
+		}
+	}
+	if spec.positional != "" {
+		if err := projectPositional(doc, result, spec.positional, filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range sortedKeys(spec.slices) {
+		if err := slicePath(result, strings.Split(path, "."), spec.slices[path]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// projectionMode 判断投影为包含模式还是排除模式
+func projectionMode(projection Document) (bool, error) {
+	included, excluded := 0, 0
+	for path, value := range projection {
+		if path == "_id" {
+			continue
+		}
+		if isTruthy(value) {
+			included++
+		} else {
+			excluded++
+		}
+	}
+	if included > 0 && excluded > 0 {
+		return false, fmt.Errorf("投影不能同时包含和排除字段")
+	}
+	if included == 0 && excluded == 0 {
+		// 只有 _id 时，{_id: 1} 为包含模式，{_id: 0} 为排除模式
+		return isTruthy(projection["_id"]), nil
+	}
+	return included > 0, nil
+}
+
+// projectPositional 位置投影：数组字段只保留第一个满足查询条件的元素，没有满足的元素时不返回该字段
+// 只检查查询条件中位于该数组字段及其子字段上的条件，见 positionalIndex
+func projectPositional(doc, result Document, path string, filter Document) error {
+	parts := strings.Split(path, ".")
+	i, err := positionalIndex(doc, path, filter)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		unsetPath(result, parts)
+		return nil
+	}
+	arr := toArray(lookupPath(doc, parts)[0])
+	return setPath(result, parts, []interface{}{cloneValue(arr[i])})
+}
+
+// slicePath 对路径上的数组应用 $slice，字段不存在或不是数组时保持不变
+// 参数 n 为正数时保留前 n 个元素，负数时保留后 |n| 个；[skip, limit] 跳过 skip 个元素后保留 limit 个，skip 为负数时从末尾倒数
+func slicePath(doc Document, parts []string, operand interface{}) error {
+	skip, limit, err := sliceArguments(operand)
+	if err != nil {
+		return err
+	}
+	value, ok := doc[parts[0]]
+	if !ok {
+		return nil
+	}
+	if len(parts) > 1 {
+		if child := toDocument(value); child != nil {
+			return slicePath(child, parts[1:], operand)
+		}
+		return nil
+	}
+	if canonicalType(value) != canonicalArray {
+		return nil
+	}
+
+	arr := toArray(value)
+	start := skip
+	if start < 0 {
+		start += len(arr)
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start > len(arr) {
+		start = len(arr)
+	}
+	end := len(arr)
+	if limit >= 0 && start+limit < end {
+		end = start + limit
+	}
+	doc[parts[0]] = append([]interface{}{}, arr[start:end]...)
+	return nil
+}
+
+// sliceArguments 将 $slice 参数转换为起始位置和数量，数量为 -1 表示取到末尾
+func sliceArguments(operand interface{}) (skip, limit int, err error) {
+	if arr := toArray(operand); arr != nil {
+		if len(arr) != 2 || !isNumber(arr[0]) || !isNumber(arr[1]) {
+			return 0, 0, fmt.Errorf("$slice 数组参数必须是两个数值 [skip, limit]")
+		}
+		limit = int(toFloat64(arr[1]))
+		if limit <= 0 {
+			return 0, 0, fmt.Errorf("$slice 的 limit 必须为正数: %v", arr[1])
+		}
+		return int(toFloat64(arr[0])), limit, nil
+	}
+	if !isNumber(operand) {
+		return 0, 0, fmt.Errorf("$slice 需要数值或 [skip, limit] 数组参数")
+	}
+	n := int(toFloat64(operand))
+	if n < 0 {
+		return n, -1, nil
+	}
+	return 0, n, nil
+}
+
+// includePath 将源文档中路径对应的字段复制到目标文档，路径经过数组时逐元素投影
+func includePath(src, dst Document, parts []string) {
+	value, ok := src[parts[0]]
+	if !ok {
+		return
+	}
+	if len(parts) == 1 {
+		dst[parts[0]] = cloneValue(value)
+		return
+	}
+
+	if child := toDocument(value); child != nil {
+		next := toDocument(dst[parts[0]])
+		if next == nil {
+			next = Document{}
+			dst[parts[0]] = next
+		}
+		includePath(child, next, parts[1:])
+		return
+	}
+
+	if arr := toArray(value); arr != nil {
+		existing := toArray(dst[parts[0]])
+		projected := make([]interface{}, 0, len(arr))
+		for _, elem := range arr {
+			child := toDocument(elem)
+			if child == nil {
+				continue
+			}
+			var next Document
+			if i := len(projected); i < len(existing) {
+				next = toDocument(existing[i])
+			}
+			if next == nil {
+				next = Document{}
+			}
+			includePath(child, next, parts[1:])
+			projected = append(projected, next)
+		}
+		dst[parts[0]] = projected
+	}
+}
+
+// isTruthy 判断投影值是否表示包含
+func isTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	}
+	if isNumber(value) {
+		return toFloat64(value) != 0
+	}
+	return true
+}
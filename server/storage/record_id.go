@@ -108,6 +108,32 @@ func (r RecordId) String() string {
 	return "RecordId(unknown)"
 }
 
+// encodeRecordId 编码 RecordId，首字节保存类型以便还原
+func encodeRecordId(r RecordId) []byte {
+	data, _ := r.AsBytes()
+	buf := make([]byte, 1+len(data))
+	buf[0] = byte(r.repr)
+	copy(buf[1:], data)
+	return buf
+}
+
+// decodeRecordId 解码 encodeRecordId 生成的字节
+func decodeRecordId(buf []byte) RecordId {
+	if len(buf) == 0 {
+		return NullRecordId()
+	}
+	switch buf[0] {
+	case 1:
+		if len(buf) != 9 {
+			return NullRecordId()
+		}
+		return NewRecordIdFromLong(int64(binary.BigEndian.Uint64(buf[1:])))
+	case 2:
+		return NewRecordIdFromBytes(buf[1:])
+	}
+	return NullRecordId()
+}
+
 // compareBytes 比较两个字节数组
 func compareBytes(a, b []byte) int {
 	minLen := len(a)
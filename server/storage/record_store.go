@@ -11,6 +11,13 @@ import (
 
 // RecordStore 记录存储接口
 // 负责存储完整的 BSON 文档，使用 RecordId 作为主键
+//
+// 字节切片的所有权约定：
+//   - InsertRecord/UpdateRecord 返回后，存储不再引用参数 data，调用方可以继续修改或复用它
+//   - GetRecord 和 RecordCursor.Data 返回的切片归调用方所有，修改它不会影响已存储的记录，
+//     之后对记录的更新也不会改变已返回的切片
+//
+// 实现必须在边界处复制，不能返回或保留与内部存储共享底层数组的切片
 type RecordStore interface {
 	// 文档操作
 	InsertRecord(ctx context.Context, recordId RecordId, data []byte) error
@@ -27,12 +34,27 @@ type RecordStore interface {
 	
 	// 生命周期
 	Truncate(ctx context.Context) error
+	Compact(ctx context.Context) (*CompactStats, error)
 }
 
+// CompactStats Compact 前后的统计信息
+type CompactStats struct {
+	RecordsBefore int64 // 压缩前统计的记录数
+	RecordsAfter  int64 // 按存活记录重新计算的记录数
+	SizeBefore    int64 // 压缩前统计的数据大小，统计有偏差时与实际不符
+	SizeAfter     int64 // 按存活记录重新计算的数据大小
+	LeavesBefore  int   // 压缩前 B+树的叶子节点数
+	LeavesAfter   int   // 压缩后 B+树的叶子节点数
+}
+
+// scanBatchSize 扫描游标每次从 B+树复制的记录数和索引条目数
+const scanBatchSize = 128
+
 // RecordCursor 记录游标
 type RecordCursor interface {
 	Next() bool
 	RecordId() RecordId
+	// Data 返回当前记录的数据，切片归调用方所有，见 RecordStore 的所有权约定
 	Data() []byte
 	Close() error
 }
@@ -50,13 +72,16 @@ type BTreeRecordStore struct {
 	
 	// 标识
 	namespace string // database.collection
+
+	order int // B+树的阶数，Truncate 重建时沿用
 }
 
-// NewRecordStore 创建新的 RecordStore
-func NewRecordStore(namespace string) RecordStore {
+// NewRecordStore 创建新的 RecordStore，order 为底层 B+树的阶数
+func NewRecordStore(namespace string, order int) RecordStore {
 	return &BTreeRecordStore{
-		tree:      btree.NewBTree(128), // 使用阶数128的B+树
+		tree:      btree.NewBTree(order),
 		namespace: namespace,
+		order:     order,
 	}
 }
 
@@ -72,19 +97,21 @@ func (rs *BTreeRecordStore) InsertRecord(ctx context.Context, recordId RecordId,
 		return fmt.Errorf("无法将 RecordId 转换为字节")
 	}
 	
-	// 检查是否已存在
-	if _, exists := rs.tree.Get(key); exists {
-		return fmt.Errorf("RecordId %s 已存在", recordId.String())
-	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
 	
-	// 插入到 B+Tree
-	if err := rs.tree.Insert(key, data); err != nil {
+	// 检查和插入在 B+Tree 的同一次加锁内完成，并发插入相同 RecordId 时只有一个成功
+	inserted, err := rs.tree.InsertIfAbsent(key, data)
+	if err != nil {
 		return fmt.Errorf("插入记录失败: %w", err)
 	}
+	if !inserted {
+		return fmt.Errorf("RecordId %s 已存在", recordId.String())
+	}
 	
 	// 更新统计
 	atomic.AddInt64(&rs.numRecords, 1)
-	atomic.AddInt64(&rs.dataSize, int64(len(data)))
+	rs.addDataSize(int64(len(data)))
 	
 	return nil
 }
@@ -100,6 +127,9 @@ func (rs *BTreeRecordStore) UpdateRecord(ctx context.Context, recordId RecordId,
 		return fmt.Errorf("无法将 RecordId 转换为字节")
 	}
 	
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	
 	// 获取旧数据以更新统计
 	oldData, exists := rs.tree.Get(key)
 	if !exists {
@@ -111,8 +141,8 @@ func (rs *BTreeRecordStore) UpdateRecord(ctx context.Context, recordId RecordId,
 		return fmt.Errorf("更新记录失败: %w", err)
 	}
 	
-	// 更新统计
-	atomic.AddInt64(&rs.dataSize, int64(len(data)-len(oldData)))
+	// 更新统计：新数据变小时差值为负
+	rs.addDataSize(int64(len(data) - len(oldData)))
 	
 	return nil
 }
@@ -128,6 +158,9 @@ func (rs *BTreeRecordStore) DeleteRecord(ctx context.Context, recordId RecordId)
 		return fmt.Errorf("无法将 RecordId 转换为字节")
 	}
 	
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	
 	// 获取数据以更新统计
 	data, exists := rs.tree.Get(key)
 	if !exists {
@@ -141,11 +174,22 @@ func (rs *BTreeRecordStore) DeleteRecord(ctx context.Context, recordId RecordId)
 	
 	// 更新统计
 	atomic.AddInt64(&rs.numRecords, -1)
-	atomic.AddInt64(&rs.dataSize, -int64(len(data)))
+	rs.addDataSize(-int64(len(data)))
 	
 	return nil
 }
 
+// addDataSize 按 delta 调整数据大小，结果不小于 0
+// 统计出现偏差时不会变成负数，偏差可由 Compact 从头重新计算修正
+// 调用方必须持有 rs.mu 写锁，读取和写回之间不会有其他修改
+func (rs *BTreeRecordStore) addDataSize(delta int64) {
+	size := atomic.LoadInt64(&rs.dataSize) + delta
+	if size < 0 {
+		size = 0
+	}
+	atomic.StoreInt64(&rs.dataSize, size)
+}
+
 // GetRecord 获取记录
 func (rs *BTreeRecordStore) GetRecord(ctx context.Context, recordId RecordId) ([]byte, error) {
 	if recordId.IsNull() {
@@ -157,6 +201,10 @@ func (rs *BTreeRecordStore) GetRecord(ctx context.Context, recordId RecordId) ([
 		return nil, fmt.Errorf("无法将 RecordId 转换为字节")
 	}
 	
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	
+	// BTree.Get 返回值的副本，调用方修改返回的切片不影响树中的数据
 	data, exists := rs.tree.Get(key)
 	if !exists {
 		return nil, fmt.Errorf("RecordId %s 不存在", recordId.String())
@@ -179,17 +227,14 @@ func (rs *BTreeRecordStore) Scan(ctx context.Context, startId RecordId) (RecordC
 		startKey = []byte{0} // 从最小值开始
 	}
 	
-	// 执行范围查询
-	keys, values, err := rs.tree.Range(startKey, nil)
-	if err != nil {
-		return nil, fmt.Errorf("扫描失败: %w", err)
-	}
+	// Truncate 会替换整棵树，读取 rs.tree 也需要持有锁
+	// 清空后游标继续遍历原来的树，不会看到清空之后插入的记录
+	rs.mu.RLock()
+	tree := rs.tree
+	rs.mu.RUnlock()
 	
-	return &btreeCursor{
-		keys:   keys,
-		values: values,
-		index:  -1,
-	}, nil
+	// 迭代器每批复制 scanBatchSize 条记录，游标不引用树的内部切片，内存占用与集合大小无关
+	return &btreeCursor{iter: tree.NewIterator(startKey, nil, scanBatchSize)}, nil
 }
 
 // NumRecords 返回记录数
@@ -208,7 +253,7 @@ func (rs *BTreeRecordStore) Truncate(ctx context.Context) error {
 	defer rs.mu.Unlock()
 	
 	// 重新创建 B+Tree
-	rs.tree = btree.NewBTree(128)
+	rs.tree = btree.NewBTree(rs.order)
 	
 	// 重置统计
 	atomic.StoreInt64(&rs.numRecords, 0)
@@ -217,34 +262,61 @@ func (rs *BTreeRecordStore) Truncate(ctx context.Context) error {
 	return nil
 }
 
+// Compact 用存活的记录重建紧凑的 B+树，并从头重新计算记录数和数据大小
+// 删除不会合并节点，大量删除后叶子节点变得稀疏，重建后每个叶子尽量填满
+func (rs *BTreeRecordStore) Compact(ctx context.Context) (*CompactStats, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	stats := &CompactStats{
+		RecordsBefore: atomic.LoadInt64(&rs.numRecords),
+		SizeBefore:    atomic.LoadInt64(&rs.dataSize),
+		LeavesBefore:  rs.tree.NumLeaves(),
+	}
+	keys, values, err := rs.tree.Range(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("扫描记录失败: %w", err)
+	}
+	tree, err := btree.NewBTreeFromSorted(rs.order, keys, values)
+	if err != nil {
+		return nil, fmt.Errorf("重建 B+树失败: %w", err)
+	}
+	for _, value := range values {
+		stats.SizeAfter += int64(len(value))
+	}
+	stats.RecordsAfter = int64(len(keys))
+	stats.LeavesAfter = tree.NumLeaves()
+
+	rs.tree = tree
+	atomic.StoreInt64(&rs.numRecords, stats.RecordsAfter)
+	atomic.StoreInt64(&rs.dataSize, stats.SizeAfter)
+	return stats, nil
+}
+
 // btreeCursor B+Tree 游标实现
+// 按 RecordId 顺序分批读取，两批之间提交的写入对之后的批次可见
 type btreeCursor struct {
-	keys   [][]byte
-	values [][]byte
-	index  int
+	iter *btree.Iterator
 }
 
 func (c *btreeCursor) Next() bool {
-	c.index++
-	return c.index < len(c.keys)
+	return c.iter.Next()
 }
 
 func (c *btreeCursor) RecordId() RecordId {
-	if c.index < 0 || c.index >= len(c.keys) {
+	key := c.iter.Key()
+	if key == nil {
 		return NullRecordId()
 	}
-	return NewRecordIdFromBytes(c.keys[c.index])
+	return NewRecordIdFromBytes(key)
 }
 
+// Data 返回迭代器复制出的副本，每条记录只属于这个游标
 func (c *btreeCursor) Data() []byte {
-	if c.index < 0 || c.index >= len(c.values) {
-		return nil
-	}
-	return c.values[c.index]
+	return c.iter.Value()
 }
 
 func (c *btreeCursor) Close() error {
-	c.keys = nil
-	c.values = nil
+	c.iter.Close()
 	return nil
 }
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ReIndex 清空集合中除 _id 以外的全部索引，并扫描记录重新生成索引条目
+// 重建在一个事务中完成：每个索引清空前保存原有条目，任一索引重建失败时恢复所有已重建的索引
+func (e *WiredTigerEngine) ReIndex(ctx context.Context, database, collection string) error {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return fmt.Errorf("集合 %s 不存在: %w", makeNamespace(database, collection), ErrNamespaceNotFound)
+	}
+
+	e.oplogMu.Lock()
+	defer e.oplogMu.Unlock()
+
+	ru := NewRecoveryUnit()
+	if err := ru.BeginTransaction(ctx); err != nil {
+		return err
+	}
+	multikey := make(map[string]bool, len(coll.IndexSpecs))
+	for _, spec := range coll.IndexSpecs {
+		idx := coll.index(spec.Name)
+		if spec.Name == IdIndexName || idx == nil {
+			continue
+		}
+		isMultikey, err := e.rebuildIndex(ctx, ru, coll, spec, idx)
+		if err != nil {
+			if rbErr := ru.Rollback(ctx); rbErr != nil {
+				return fmt.Errorf("重建索引 %s 失败: %v，回滚失败: %w", spec.Name, err, rbErr)
+			}
+			return fmt.Errorf("重建索引 %s 失败: %w", spec.Name, err)
+		}
+		multikey[spec.Name] = isMultikey
+	}
+	if err := ru.Commit(ctx); err != nil {
+		return err
+	}
+
+	for name, isMultikey := range multikey {
+		coll.multikey[name] = isMultikey
+	}
+	coll.plans.clear()
+	return nil
+}
+
+// rebuildIndex 保存索引原有条目并注册回滚变更，然后清空索引并按记录重新生成条目
+// 返回重建后的索引是否为多键索引
+func (e *WiredTigerEngine) rebuildIndex(ctx context.Context, ru RecoveryUnit, coll *Collection, spec Index, idx SortedDataInterface) (bool, error) {
+	cursor, err := idx.SeekRange(ctx, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("扫描索引失败: %w", err)
+	}
+	var saved []IndexKeyEntry
+	for cursor.Next() {
+		if err := ctx.Err(); err != nil {
+			cursor.Close()
+			return false, err
+		}
+		saved = append(saved, IndexKeyEntry{Key: cursor.Key(), RecordId: cursor.RecordId(), TypeBits: cursor.TypeBits()})
+	}
+	cursor.Close()
+
+	restore := func() error {
+		if err := idx.Clear(ctx); err != nil {
+			return err
+		}
+		for _, entry := range saved {
+			if err := idx.InsertWithTypeBits(ctx, entry.Key, entry.TypeBits, entry.RecordId); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := ru.RegisterChange(NewSimpleChange(nil, restore)); err != nil {
+		return false, err
+	}
+
+	if err := idx.Clear(ctx); err != nil {
+		return false, err
+	}
+	records, err := coll.RecordStore.Scan(ctx, NullRecordId())
+	if err != nil {
+		return false, fmt.Errorf("扫描记录失败: %w", err)
+	}
+	defer records.Close()
+	multikey := false
+	for records.Next() {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		doc, err := e.bsonToDocument(records.Data())
+		if err != nil {
+			continue
+		}
+		entries, isMultikey := indexEntries(spec, doc)
+		multikey = multikey || isMultikey
+		for _, entry := range entries {
+			if err := idx.InsertWithTypeBits(ctx, entry.key, entry.typeBits, records.RecordId()); err != nil {
+				var dup *DuplicateKeyError
+				if errors.As(err, &dup) {
+					dup.Namespace = coll.Namespace
+					dup.Key = entry.keyDocument(spec)
+				}
+				return false, err
+			}
+		}
+	}
+	return multikey, nil
+}
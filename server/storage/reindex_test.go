@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestReIndex 测试索引与记录不一致后重建索引
+func TestReIndex(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := []storage.Document{
+		{"_id": int32(1), "sku": "a", "qty": int32(5)},
+		{"_id": int32(2), "sku": "b", "qty": int32(5)},
+		{"_id": int32(3), "sku": "c", "qty": int32(7)},
+	}
+	if err := engine.Insert(ctx, "test", "items", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	for _, index := range []storage.Index{
+		{Name: "qty_1", Keys: []storage.IndexKey{{Field: "qty", Direction: 1}}},
+		{Name: "sku_1", Keys: []storage.IndexKey{{Field: "sku", Direction: 1}}, Unique: true},
+	} {
+		if err := engine.CreateIndex(ctx, "test", "items", index); err != nil {
+			t.Fatalf("创建索引 %s 失败: %v", index.Name, err)
+		}
+	}
+	count := func(filter storage.Document) int {
+		t.Helper()
+		found, err := engine.Find(ctx, "test", "items", filter)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		return len(found)
+	}
+	// removeFirst 直接删除索引中的第一个条目，使索引与记录不一致
+	removeFirst := func(name string) {
+		t.Helper()
+		idx := storage.CollectionIndex(engine.WiredTigerEngine, "test", "items", name)
+		cursor, err := idx.SeekRange(ctx, nil, nil)
+		if err != nil || !cursor.Next() {
+			t.Fatalf("读取索引 %s 失败: %v", name, err)
+		}
+		key, recordId := cursor.Key(), cursor.RecordId()
+		cursor.Close()
+		if err := idx.Remove(ctx, key, recordId); err != nil {
+			t.Fatalf("删除索引条目失败: %v", err)
+		}
+	}
+	qty5 := storage.Document{"qty": int32(5)}
+
+	t.Run("重建后查询结果正确", func(t *testing.T) {
+		removeFirst("qty_1")
+		if n := count(qty5); n != 1 {
+			t.Fatalf("索引缺少条目时查询应少返回文档: got %d", n)
+		}
+		if err := engine.ReIndex(ctx, "test", "items"); err != nil {
+			t.Fatalf("重建索引失败: %v", err)
+		}
+		if n := count(qty5); n != 2 {
+			t.Errorf("重建后应返回 2 个文档: got %d", n)
+		}
+		results, err := engine.Validate(ctx, "test", "items")
+		if err != nil || !results.Valid() {
+			t.Errorf("重建后索引应与记录一致: %+v, %v", results, err)
+		}
+	})
+
+	t.Run("重建失败时恢复原有索引", func(t *testing.T) {
+		// 删除 sku 索引中 "a" 的条目后可以插入重复的 sku，重建唯一索引会失败
+		removeFirst("sku_1")
+		if err := engine.Insert(ctx, "test", "items", []storage.Document{{"_id": int32(4), "sku": "a", "qty": int32(5)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		removeFirst("qty_1")
+
+		err := engine.ReIndex(ctx, "test", "items")
+		if !errors.Is(err, storage.ErrDuplicateKey) {
+			t.Fatalf("重建唯一索引应返回重复键错误: %v", err)
+		}
+		results, err := engine.Validate(ctx, "test", "items")
+		if err != nil {
+			t.Fatalf("检查失败: %v", err)
+		}
+		for _, index := range results.Indexes {
+			if index.Name != "_id_" && index.MissingEntries != 1 {
+				t.Errorf("失败后索引 %s 应保持重建前的状态: %+v", index.Name, index)
+			}
+		}
+		if n := count(qty5); n != 2 {
+			t.Errorf("失败后 qty_1 应恢复为缺少一个条目的状态: got %d", n)
+		}
+	})
+
+	if err := engine.ReIndex(ctx, "test", "missing"); !errors.Is(err, storage.ErrNamespaceNotFound) {
+		t.Errorf("集合不存在时应返回 ErrNamespaceNotFound: %v", err)
+	}
+}
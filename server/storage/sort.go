@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortDocuments 按排序规则对文档稳定排序，规则形如 {a: 1, b: -1}
+// 多个排序字段按字段名顺序依次比较，缺失字段视为 null
+func SortDocuments(docs []Document, spec Document) error {
+	keys := sortedKeys(spec)
+	directions := make([]int, len(keys))
+	for i, key := range keys {
+		switch toFloat64(spec[key]) {
+		case 1:
+			directions[i] = 1
+		case -1:
+			directions[i] = -1
+		default:
+			return fmt.Errorf("%w: 排序方向必须为 1 或 -1: %s", ErrBadValue, key)
+		}
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for k, key := range keys {
+			parts := strings.Split(key, ".")
+			c := CompareValues(sortValue(docs[i], parts), sortValue(docs[j], parts))
+			if c != 0 {
+				return c*directions[k] < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// sortValue 取排序字段的值，路径不存在时返回 nil
+func sortValue(doc Document, parts []string) interface{} {
+	values := lookupPath(doc, parts)
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
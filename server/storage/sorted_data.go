@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"sync"
 	
@@ -15,15 +16,25 @@ type SortedDataInterface interface {
 	// 插入索引条目
 	Insert(ctx context.Context, key []byte, recordId RecordId) error
 	
+	// 插入索引条目并保存从索引键还原取值所需的类型信息
+	InsertWithTypeBits(ctx context.Context, key, typeBits []byte, recordId RecordId) error
+	
 	// 删除索引条目
 	Remove(ctx context.Context, key []byte, recordId RecordId) error
 	
 	// 查找精确匹配的记录
 	Seek(ctx context.Context, key []byte) (IndexCursor, error)
 	
+	// 点查询：返回索引键等于 key 的第一个条目的 RecordId，不创建游标；不存在时返回 false
+	SeekExact(ctx context.Context, key []byte) (RecordId, bool, error)
+	
 	// 范围查询
 	SeekRange(ctx context.Context, startKey, endKey []byte) (IndexCursor, error)
 	
+	// 单边范围查询：索引键小于 key 的条目按降序返回，大于 key 的条目按升序返回
+	SeekLessThan(ctx context.Context, key []byte) (IndexCursor, error)
+	SeekGreaterThan(ctx context.Context, key []byte) (IndexCursor, error)
+	
 	// 统计信息
 	NumEntries() int64
 	IsEmpty() bool
@@ -37,6 +48,7 @@ type IndexCursor interface {
 	Next() bool
 	Key() []byte
 	RecordId() RecordId
+	TypeBits() []byte // 插入时保存的类型信息，没有保存时为 nil
 	Close() error
 }
 
@@ -45,6 +57,7 @@ type IndexCursor interface {
 type IndexKeyEntry struct {
 	Key      []byte
 	RecordId RecordId
+	TypeBits []byte
 }
 
 // BTreeIndex 基于 B+Tree 的索引实现
@@ -53,26 +66,33 @@ type BTreeIndex struct {
 	
 	// B+Tree 存储
 	// Key: indexKey + recordId (组合键确保唯一性)
-	// Value: recordId (冗余存储便于查询)
+	// Value: 带类型标记的 recordId (冗余存储便于查询) + 类型信息，格式见 encodeIndexValue
 	tree *btree.BTree
 	
 	// 索引配置
 	name      string
 	unique    bool
 	numEntries int64
+	order     int // B+树的阶数，Clear 重建时沿用
 }
 
-// NewSortedDataInterface 创建新的索引
-func NewSortedDataInterface(name string, unique bool) SortedDataInterface {
+// NewSortedDataInterface 创建新的索引，order 为底层 B+树的阶数
+func NewSortedDataInterface(name string, unique bool, order int) SortedDataInterface {
 	return &BTreeIndex{
-		tree:   btree.NewBTree(128),
+		tree:   btree.NewBTree(order),
 		name:   name,
 		unique: unique,
+		order:  order,
 	}
 }
 
 // Insert 插入索引条目
 func (idx *BTreeIndex) Insert(ctx context.Context, key []byte, recordId RecordId) error {
+	return idx.InsertWithTypeBits(ctx, key, nil, recordId)
+}
+
+// InsertWithTypeBits 插入索引条目，typeBits 与 RecordId 一起保存在值中，覆盖查询用它还原索引键中的取值
+func (idx *BTreeIndex) InsertWithTypeBits(ctx context.Context, key, typeBits []byte, recordId RecordId) error {
 	if len(key) == 0 {
 		return fmt.Errorf("索引键不能为空")
 	}
@@ -81,29 +101,33 @@ func (idx *BTreeIndex) Insert(ctx context.Context, key []byte, recordId RecordId
 		return fmt.Errorf("RecordId 不能为空")
 	}
 	
+	// 唯一性检查和插入需要在同一把锁内完成，否则并发插入相同的键时都会通过检查
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	
 	// 如果是唯一索引，检查是否已存在
 	if idx.unique {
 		if exists, err := idx.keyExists(key); err != nil {
 			return err
 		} else if exists {
-			return fmt.Errorf("唯一索引约束违反: 键 %x 已存在", key)
+			return &DuplicateKeyError{Index: idx.name, Key: key}
 		}
 	}
 	
 	// 组合键: indexKey + recordId
 	compositeKey := idx.makeCompositeKey(key, recordId)
 	
-	// RecordId 作为值
-	recordIdBytes, _ := recordId.AsBytes()
+	// RecordId 和类型信息作为值
+	value := encodeIndexValue(recordId, typeBits)
 	
-	// 插入到 B+Tree
-	if err := idx.tree.Insert(compositeKey, recordIdBytes); err != nil {
+	// 插入到 B+Tree，相同的键和 RecordId 已存在时不重复计数
+	inserted, err := idx.tree.InsertIfAbsent(compositeKey, value)
+	if err != nil {
 		return fmt.Errorf("插入索引失败: %w", err)
 	}
-	
-	idx.mu.Lock()
-	idx.numEntries++
-	idx.mu.Unlock()
+	if inserted {
+		idx.numEntries++
+	}
 	
 	return nil
 }
@@ -121,14 +145,14 @@ func (idx *BTreeIndex) Remove(ctx context.Context, key []byte, recordId RecordId
 	// 组合键
 	compositeKey := idx.makeCompositeKey(key, recordId)
 	
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	
 	// 从 B+Tree 删除
 	if err := idx.tree.Delete(compositeKey); err != nil {
 		return fmt.Errorf("删除索引失败: %w", err)
 	}
-	
-	idx.mu.Lock()
 	idx.numEntries--
-	idx.mu.Unlock()
 	
 	return nil
 }
@@ -139,12 +163,10 @@ func (idx *BTreeIndex) Seek(ctx context.Context, key []byte) (IndexCursor, error
 		return nil, fmt.Errorf("索引键不能为空")
 	}
 	
-	// 构造范围查询的起始键和结束键
-	startKey := idx.makeCompositeKey(key, NullRecordId())
-	endKey := idx.makeNextKey(key)
-	
-	// 执行范围查询
-	keys, values, err := idx.tree.Range(startKey, endKey)
+	// Clear 会替换整棵树，读取 idx.tree 也需要持有锁
+	idx.mu.RLock()
+	keys, values, err := idx.exactRange(key)
+	idx.mu.RUnlock()
 	if err != nil {
 		return nil, fmt.Errorf("查找失败: %w", err)
 	}
@@ -156,6 +178,30 @@ func (idx *BTreeIndex) Seek(ctx context.Context, key []byte) (IndexCursor, error
 	}, nil
 }
 
+// SeekExact 返回索引键等于 key 的第一个条目的 RecordId
+// 组合键以索引键开头，从 key 开始顺序查找即可，唯一索引上通常第一个条目就是结果
+func (idx *BTreeIndex) SeekExact(ctx context.Context, key []byte) (RecordId, bool, error) {
+	if len(key) == 0 {
+		return NullRecordId(), false, fmt.Errorf("索引键不能为空")
+	}
+	
+	idx.mu.RLock()
+	tree := idx.tree
+	idx.mu.RUnlock()
+	
+	recordId, found := NullRecordId(), false
+	tree.Ascend(key, keySuccessor(key), func(composite, value []byte) bool {
+		existing, _, err := parseCompositeKey(composite)
+		if err != nil || !bytes.Equal(existing, key) {
+			return true
+		}
+		recordId, _ = decodeIndexValue(append([]byte(nil), value...))
+		found = true
+		return false
+	})
+	return recordId, found, nil
+}
+
 // SeekRange 范围查询
 func (idx *BTreeIndex) SeekRange(ctx context.Context, startKey, endKey []byte) (IndexCursor, error) {
 	var start, end []byte
@@ -168,8 +214,24 @@ func (idx *BTreeIndex) SeekRange(ctx context.Context, startKey, endKey []byte) (
 		end = idx.makeCompositeKey(endKey, NullRecordId())
 	}
 	
-	// 执行范围查询
-	keys, values, err := idx.tree.Range(start, end)
+	// 按批读取，扫描大范围时不需要一次复制全部条目
+	idx.mu.RLock()
+	tree := idx.tree
+	idx.mu.RUnlock()
+	
+	return &btreeIndexRangeCursor{iter: tree.NewIterator(start, end, scanBatchSize)}, nil
+}
+
+// SeekLessThan 返回索引键小于 key 的条目，从最接近 key 的条目开始按降序排列
+// 索引键小于 key 的组合键都小于 key 本身，沿叶子节点链表从 key 向前遍历即可，不需要扫描 key 之后的条目
+func (idx *BTreeIndex) SeekLessThan(ctx context.Context, key []byte) (IndexCursor, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("索引键不能为空")
+	}
+	
+	idx.mu.RLock()
+	keys, values, err := idx.tree.ReverseRange(nil, key)
+	idx.mu.RUnlock()
 	if err != nil {
 		return nil, fmt.Errorf("范围查询失败: %w", err)
 	}
@@ -181,6 +243,35 @@ func (idx *BTreeIndex) SeekRange(ctx context.Context, startKey, endKey []byte) (
 	}, nil
 }
 
+// SeekGreaterThan 返回索引键大于 key 的条目，按升序排列
+// 从 key 开始扫描，索引键等于 key 的条目紧跟在 key 之后，需要逐个比较跳过
+func (idx *BTreeIndex) SeekGreaterThan(ctx context.Context, key []byte) (IndexCursor, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("索引键不能为空")
+	}
+	
+	idx.mu.RLock()
+	keys, values, err := idx.tree.Range(key, nil)
+	idx.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("范围查询失败: %w", err)
+	}
+	
+	n := 0
+	for i, composite := range keys {
+		if existing, _, err := parseCompositeKey(composite); err == nil && bytes.Compare(existing, key) > 0 {
+			keys[n], values[n] = composite, values[i]
+			n++
+		}
+	}
+	
+	return &btreeIndexCursor{
+		keys:   keys[:n],
+		values: values[:n],
+		index:  -1,
+	}, nil
+}
+
 // NumEntries 返回索引条目数
 func (idx *BTreeIndex) NumEntries() int64 {
 	idx.mu.RLock()
@@ -199,78 +290,97 @@ func (idx *BTreeIndex) Clear(ctx context.Context) error {
 	defer idx.mu.Unlock()
 	
 	// 重新创建 B+Tree
-	idx.tree = btree.NewBTree(128)
+	idx.tree = btree.NewBTree(idx.order)
 	idx.numEntries = 0
 	
 	return nil
 }
 
 // makeCompositeKey 创建组合键
-// 格式: [keyLen(4字节)][key][recordId]
+// 格式: [key][recordId][recordIdLen(4字节)]
+// 索引键放在最前面，组合键的字节序与索引键的字节序一致，范围查询可以直接按索引键的边界扫描
 func (idx *BTreeIndex) makeCompositeKey(key []byte, recordId RecordId) []byte {
 	recordIdBytes, _ := recordId.AsBytes()
 	
-	// 计算总长度
-	totalLen := 4 + len(key) + len(recordIdBytes)
-	composite := make([]byte, totalLen)
-	
-	// 写入键长度（大端序）
-	composite[0] = byte(len(key) >> 24)
-	composite[1] = byte(len(key) >> 16)
-	composite[2] = byte(len(key) >> 8)
-	composite[3] = byte(len(key))
-	
-	// 写入键
-	copy(composite[4:], key)
+	composite := make([]byte, 0, len(key)+len(recordIdBytes)+4)
+	composite = append(composite, key...)
+	composite = append(composite, recordIdBytes...)
 	
-	// 写入 RecordId
-	copy(composite[4+len(key):], recordIdBytes)
-	
-	return composite
+	// 写入 RecordId 长度（大端序）
+	n := len(recordIdBytes)
+	return append(composite, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
 }
 
-// parseCompositeKey 解析组合键
-func (idx *BTreeIndex) parseCompositeKey(composite []byte) ([]byte, RecordId, error) {
+// parseCompositeKey 从组合键末尾读取 RecordId 长度，拆分出索引键和 RecordId
+func parseCompositeKey(composite []byte) ([]byte, RecordId, error) {
 	if len(composite) < 4 {
 		return nil, NullRecordId(), fmt.Errorf("组合键太短")
 	}
 	
-	// 读取键长度
-	keyLen := int(composite[0])<<24 | int(composite[1])<<16 | int(composite[2])<<8 | int(composite[3])
+	// 读取 RecordId 长度
+	tail := composite[len(composite)-4:]
+	recordIdLen := int(tail[0])<<24 | int(tail[1])<<16 | int(tail[2])<<8 | int(tail[3])
 	
-	if len(composite) < 4+keyLen {
+	keyLen := len(composite) - 4 - recordIdLen
+	if keyLen < 0 {
 		return nil, NullRecordId(), fmt.Errorf("组合键格式错误")
 	}
 	
-	// 提取键
-	key := composite[4 : 4+keyLen]
-	
-	// 提取 RecordId
-	recordIdBytes := composite[4+keyLen:]
-	recordId := NewRecordIdFromBytes(recordIdBytes)
+	// 提取键和 RecordId
+	key := composite[:keyLen]
+	recordId := NewRecordIdFromBytes(composite[keyLen : len(composite)-4])
 	
 	return key, recordId, nil
 }
 
-// makeNextKey 创建下一个键（用于范围查询的上界）
-func (idx *BTreeIndex) makeNextKey(key []byte) []byte {
-	nextKey := make([]byte, len(key)+1)
-	copy(nextKey, key)
-	// 在末尾添加一个字节以表示"大于"
-	nextKey[len(key)] = 0xFF
-	return idx.makeCompositeKey(nextKey, NullRecordId())
+// encodeIndexValue 编码索引条目的值
+// 格式: [encodeRecordId 长度(uvarint)][encodeRecordId][typeBits]
+func encodeIndexValue(recordId RecordId, typeBits []byte) []byte {
+	recordIdBytes := encodeRecordId(recordId)
+	value := binary.AppendUvarint(make([]byte, 0, 1+len(recordIdBytes)+len(typeBits)), uint64(len(recordIdBytes)))
+	value = append(value, recordIdBytes...)
+	return append(value, typeBits...)
 }
 
-// keyExists 检查键是否存在（用于唯一索引）
-func (idx *BTreeIndex) keyExists(key []byte) (bool, error) {
-	startKey := idx.makeCompositeKey(key, NullRecordId())
-	endKey := idx.makeNextKey(key)
+// decodeIndexValue 拆分 encodeIndexValue 生成的值
+func decodeIndexValue(value []byte) (RecordId, []byte) {
+	n, size := binary.Uvarint(value)
+	if size <= 0 || uint64(len(value)-size) < n {
+		return NullRecordId(), nil
+	}
+	end := size + int(n)
+	var typeBits []byte
+	if end < len(value) {
+		typeBits = value[end:]
+	}
+	return decodeRecordId(value[size:end]), typeBits
+}
+
+// exactRange 返回索引键等于 key 的全部组合键和值，调用方需持有 idx.mu
+// 组合键以索引键开头，扫描 [key, keySuccessor(key)) 即可覆盖所有以 key 为前缀的组合键，
+// 其中还包含以 key 为前缀的更长的索引键，需要逐个比较
+func (idx *BTreeIndex) exactRange(key []byte) ([][]byte, [][]byte, error) {
+	keys, values, err := idx.tree.Range(key, keySuccessor(key))
+	if err != nil {
+		return nil, nil, err
+	}
 	
-	keys, _, err := idx.tree.Range(startKey, endKey)
+	n := 0
+	for i, composite := range keys {
+		if existing, _, err := parseCompositeKey(composite); err == nil && bytes.Equal(existing, key) {
+			keys[n], values[n] = composite, values[i]
+			n++
+		}
+	}
+	return keys[:n], values[:n], nil
+}
+
+// keyExists 检查键是否存在（用于唯一索引），调用方需持有 idx.mu
+func (idx *BTreeIndex) keyExists(key []byte) (bool, error) {
+	keys, _, err := idx.exactRange(key)
 	if err != nil {
 		return false, err
 	}
-	
 	return len(keys) > 0, nil
 }
 
@@ -292,24 +402,27 @@ func (c *btreeIndexCursor) Key() []byte {
 	}
 	
 	// 解析组合键，提取索引键
-	compositeKey := c.keys[c.index]
-	if len(compositeKey) < 4 {
-		return nil
-	}
-	
-	keyLen := int(compositeKey[0])<<24 | int(compositeKey[1])<<16 | int(compositeKey[2])<<8 | int(compositeKey[3])
-	if len(compositeKey) < 4+keyLen {
+	key, _, err := parseCompositeKey(c.keys[c.index])
+	if err != nil {
 		return nil
 	}
-	
-	return compositeKey[4 : 4+keyLen]
+	return key
 }
 
 func (c *btreeIndexCursor) RecordId() RecordId {
 	if c.index < 0 || c.index >= len(c.values) {
 		return NullRecordId()
 	}
-	return NewRecordIdFromBytes(c.values[c.index])
+	recordId, _ := decodeIndexValue(c.values[c.index])
+	return recordId
+}
+
+func (c *btreeIndexCursor) TypeBits() []byte {
+	if c.index < 0 || c.index >= len(c.values) {
+		return nil
+	}
+	_, typeBits := decodeIndexValue(c.values[c.index])
+	return typeBits
 }
 
 func (c *btreeIndexCursor) Close() error {
@@ -317,3 +430,47 @@ func (c *btreeIndexCursor) Close() error {
 	c.values = nil
 	return nil
 }
+
+// btreeIndexRangeCursor 分批读取的索引范围游标，两批之间提交的写入对之后的批次可见
+type btreeIndexRangeCursor struct {
+	iter *btree.Iterator
+}
+
+func (c *btreeIndexRangeCursor) Next() bool {
+	return c.iter.Next()
+}
+
+func (c *btreeIndexRangeCursor) Key() []byte {
+	composite := c.iter.Key()
+	if composite == nil {
+		return nil
+	}
+	key, _, err := parseCompositeKey(composite)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+func (c *btreeIndexRangeCursor) RecordId() RecordId {
+	value := c.iter.Value()
+	if value == nil {
+		return NullRecordId()
+	}
+	recordId, _ := decodeIndexValue(value)
+	return recordId
+}
+
+func (c *btreeIndexRangeCursor) TypeBits() []byte {
+	value := c.iter.Value()
+	if value == nil {
+		return nil
+	}
+	_, typeBits := decodeIndexValue(value)
+	return typeBits
+}
+
+func (c *btreeIndexRangeCursor) Close() error {
+	c.iter.Close()
+	return nil
+}
@@ -1,10 +1,17 @@
 package storage_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	
+	"github.com/zhukovaskychina/xmongodb/config"
 	"github.com/zhukovaskychina/xmongodb/server/storage"
+	"github.com/zhukovaskychina/xmongodb/server/storage/btree"
 )
 
 // TestKVEngine 测试 KV 引擎
@@ -104,6 +111,30 @@ func TestKVEngine(t *testing.T) {
 			t.Errorf("RecordId 不匹配")
 		}
 	})
+	
+	t.Run("删除RecordStore只删除本集合的索引", func(t *testing.T) {
+		// db.coll 是 db.collection 和 db.coll.files 的前缀，删除 db.coll 不应影响它们的索引
+		for _, namespace := range []string{"db.coll", "db.collection", "db.coll.files"} {
+			if _, err := engine.CreateRecordStore(namespace); err != nil {
+				t.Fatalf("创建 RecordStore 失败: %v", err)
+			}
+			if _, err := engine.CreateSortedDataInterface(namespace, "a_1", false); err != nil {
+				t.Fatalf("创建索引失败: %v", err)
+			}
+		}
+		
+		if err := engine.DropRecordStore("db.coll"); err != nil {
+			t.Fatalf("删除 RecordStore 失败: %v", err)
+		}
+		if _, err := engine.GetSortedDataInterface("db.coll", "a_1"); err == nil {
+			t.Error("db.coll 的索引应被删除")
+		}
+		for _, namespace := range []string{"db.collection", "db.coll.files"} {
+			if _, err := engine.GetSortedDataInterface(namespace, "a_1"); err != nil {
+				t.Errorf("%s 的索引不应被删除: %v", namespace, err)
+			}
+		}
+	})
 }
 
 // TestRecoveryUnit 测试事务恢复单元
@@ -194,7 +225,7 @@ func TestRecoveryUnit(t *testing.T) {
 func TestBTreeRecordStore(t *testing.T) {
 	ctx := context.Background()
 	
-	rs := storage.NewRecordStore("test.btree")
+	rs := storage.NewRecordStore("test.btree", btree.DefaultOrder)
 	
 	t.Run("插入和读取", func(t *testing.T) {
 		// 插入多条记录
@@ -282,12 +313,144 @@ func TestBTreeRecordStore(t *testing.T) {
 	})
 }
 
+// TestRecordStoreDataSize 测试交替变大和变小的更新后 DataSize 始终等于现存记录长度之和
+func TestRecordStoreDataSize(t *testing.T) {
+	ctx := context.Background()
+	rs := storage.NewRecordStore("test.datasize", btree.DefaultOrder)
+
+	// 期望的各记录长度
+	sizes := make(map[int64]int)
+	expectSize := func(step string) {
+		t.Helper()
+		var want int64
+		for _, n := range sizes {
+			want += int64(n)
+		}
+		if got := rs.DataSize(); got != want {
+			t.Fatalf("%s 后 DataSize = %d, want %d", step, got, want)
+		}
+		if got := rs.NumRecords(); got != int64(len(sizes)) {
+			t.Fatalf("%s 后 NumRecords = %d, want %d", step, got, len(sizes))
+		}
+	}
+
+	for i := int64(1); i <= 20; i++ {
+		sizes[i] = int(i)
+		if err := rs.InsertRecord(ctx, storage.NewRecordIdFromLong(i), make([]byte, i)); err != nil {
+			t.Fatalf("插入记录失败: %v", err)
+		}
+	}
+	expectSize("插入")
+
+	// 每轮依次把记录改大、改小、改为空和改回相同长度
+	lengths := []int{100, 3, 0, 57, 57, 1, 250, 10}
+	for round, n := range lengths {
+		for i := int64(1); i <= 20; i++ {
+			size := (n + int(i)*round) % 300
+			if err := rs.UpdateRecord(ctx, storage.NewRecordIdFromLong(i), make([]byte, size)); err != nil {
+				t.Fatalf("更新记录失败: %v", err)
+			}
+			sizes[i] = size
+		}
+		expectSize(fmt.Sprintf("第 %d 轮更新", round))
+	}
+
+	for i := int64(1); i <= 20; i += 3 {
+		if err := rs.DeleteRecord(ctx, storage.NewRecordIdFromLong(i)); err != nil {
+			t.Fatalf("删除记录失败: %v", err)
+		}
+		delete(sizes, i)
+	}
+	expectSize("删除")
+
+	// 统计出现偏差时 DataSize 不会变为负数
+	storage.SetDataSize(rs, 0)
+	for i := int64(2); i <= 17; i += 3 {
+		if err := rs.UpdateRecord(ctx, storage.NewRecordIdFromLong(i), nil); err != nil {
+			t.Fatalf("更新记录失败: %v", err)
+		}
+		if err := rs.DeleteRecord(ctx, storage.NewRecordIdFromLong(i+1)); err != nil {
+			t.Fatalf("删除记录失败: %v", err)
+		}
+	}
+	if got := rs.DataSize(); got < 0 {
+		t.Errorf("DataSize 不应为负数, got %d", got)
+	}
+}
+
+// TestRecordStoreOwnership 测试 RecordStore 边界处的字节切片所有权：修改传入或返回的切片不影响已存储的记录
+func TestRecordStoreOwnership(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]storage.RecordStore{
+		"btree":  storage.NewRecordStore("test.ownership", btree.DefaultOrder),
+		"capped": storage.NewCappedRecordStore("test.ownership_capped", 1<<20, 100, btree.DefaultOrder),
+	}
+	for name, rs := range stores {
+		t.Run(name, func(t *testing.T) {
+			id := storage.NewRecordIdFromLong(1)
+			expectStored := func(want string) {
+				t.Helper()
+				data, err := rs.GetRecord(ctx, id)
+				if err != nil {
+					t.Fatalf("读取记录失败: %v", err)
+				}
+				if string(data) != want {
+					t.Errorf("已存储的记录被修改: got %q, want %q", data, want)
+				}
+			}
+			overwrite := func(b []byte) {
+				for i := range b {
+					b[i] = 'X'
+				}
+			}
+
+			input := []byte("original")
+			if err := rs.InsertRecord(ctx, id, input); err != nil {
+				t.Fatalf("插入记录失败: %v", err)
+			}
+			overwrite(input)
+			expectStored("original")
+
+			data, err := rs.GetRecord(ctx, id)
+			if err != nil {
+				t.Fatalf("读取记录失败: %v", err)
+			}
+			overwrite(data)
+			expectStored("original")
+
+			cursor, err := rs.Scan(ctx, storage.NullRecordId())
+			if err != nil {
+				t.Fatalf("创建游标失败: %v", err)
+			}
+			if !cursor.Next() {
+				t.Fatal("游标应返回一条记录")
+			}
+			scanned := cursor.Data()
+			overwrite(scanned)
+			cursor.Close()
+			expectStored("original")
+
+			// 之后的更新不影响已返回的切片
+			before, _ := rs.GetRecord(ctx, id)
+			update := []byte("updated!")
+			if err := rs.UpdateRecord(ctx, id, update); err != nil {
+				t.Fatalf("更新记录失败: %v", err)
+			}
+			overwrite(update)
+			expectStored("updated!")
+			if string(before) != "original" {
+				t.Errorf("更新前返回的切片被修改: %q", before)
+			}
+		})
+	}
+}
+
 // TestSortedDataInterface 测试索引接口
 func TestSortedDataInterface(t *testing.T) {
 	ctx := context.Background()
 	
 	t.Run("非唯一索引", func(t *testing.T) {
-		idx := storage.NewSortedDataInterface("test_idx", false)
+		idx := storage.NewSortedDataInterface("test_idx", false, btree.DefaultOrder)
 		
 		// 插入相同键的多个条目
 		key := []byte("duplicate_key")
@@ -316,7 +479,7 @@ func TestSortedDataInterface(t *testing.T) {
 	})
 	
 	t.Run("唯一索引", func(t *testing.T) {
-		idx := storage.NewSortedDataInterface("unique_idx", true)
+		idx := storage.NewSortedDataInterface("unique_idx", true, btree.DefaultOrder)
 		
 		key := []byte("unique_key")
 		recordId1 := storage.NewRecordIdFromLong(1)
@@ -335,7 +498,7 @@ func TestSortedDataInterface(t *testing.T) {
 	})
 	
 	t.Run("范围查询", func(t *testing.T) {
-		idx := storage.NewSortedDataInterface("range_idx", false)
+		idx := storage.NewSortedDataInterface("range_idx", false, btree.DefaultOrder)
 		
 		// 插入有序数据
 		for i := 0; i < 100; i++ {
@@ -365,12 +528,199 @@ func TestSortedDataInterface(t *testing.T) {
 			t.Errorf("范围查询结果数不正确: got %d, want 10", count)
 		}
 	})
+	
+	t.Run("以0xFF结尾的键", func(t *testing.T) {
+		idx := storage.NewSortedDataInterface("ff_idx", false, btree.DefaultOrder)
+		seek := func(key []byte) int {
+			t.Helper()
+			cursor, err := idx.Seek(ctx, key)
+			if err != nil {
+				t.Fatalf("查找失败: %v", err)
+			}
+			defer cursor.Close()
+			count := 0
+			for cursor.Next() {
+				if !bytes.Equal(cursor.Key(), key) {
+					t.Errorf("Seek(%x) 返回了其他键 %x", key, cursor.Key())
+				}
+				count++
+			}
+			return count
+		}
+		
+		// RecordId 以 0xFF 开头时组合键在索引键之后紧跟 0xFF，旧的上界 key+0xFF 会漏掉这些条目
+		entries := []struct {
+			key      []byte
+			recordId storage.RecordId
+		}{
+			{[]byte{0x01, 0xFF}, storage.NewRecordIdFromLong(1)},
+			{[]byte{0x01, 0xFF}, storage.NewRecordIdFromBytes([]byte{0xFF, 0xFF})},
+			{[]byte{0x01, 0xFF, 0x00}, storage.NewRecordIdFromLong(2)},
+			{[]byte{0x02}, storage.NewRecordIdFromLong(3)},
+			{[]byte{0xFF, 0xFF}, storage.NewRecordIdFromLong(4)},
+			{[]byte{0xFF, 0xFF}, storage.NewRecordIdFromBytes([]byte{0xFF})},
+			{[]byte{0xFF, 0xFF, 0xFF}, storage.NewRecordIdFromLong(5)},
+		}
+		for _, e := range entries {
+			if err := idx.Insert(ctx, e.key, e.recordId); err != nil {
+				t.Fatalf("插入失败: %v", err)
+			}
+		}
+		
+		if n := seek([]byte{0x01, 0xFF}); n != 2 {
+			t.Errorf("Seek(01ff) 应返回 2 个条目, got %d", n)
+		}
+		if n := seek([]byte{0x01}); n != 0 {
+			t.Errorf("Seek(01) 不应返回以 01 为前缀的其他键, got %d", n)
+		}
+		if n := seek([]byte{0xFF, 0xFF}); n != 2 {
+			t.Errorf("全部为 0xFF 的键应返回 2 个条目, got %d", n)
+		}
+		if n := seek([]byte{0xFF, 0xFF, 0xFF}); n != 1 {
+			t.Errorf("Seek(ffffff) 应返回 1 个条目, got %d", n)
+		}
+		
+		unique := storage.NewSortedDataInterface("ff_unique", true, btree.DefaultOrder)
+		for i, key := range [][]byte{{0x01, 0xFF}, {0x01}, {0xFF, 0xFF}, {0xFF}} {
+			if err := unique.Insert(ctx, key, storage.NewRecordIdFromBytes([]byte{0xFF, byte(i)})); err != nil {
+				t.Fatalf("插入 %x 失败: %v", key, err)
+			}
+		}
+		for _, key := range [][]byte{{0x01, 0xFF}, {0xFF, 0xFF}} {
+			if err := unique.Insert(ctx, key, storage.NewRecordIdFromLong(100)); !errors.Is(err, storage.ErrDuplicateKey) {
+				t.Errorf("唯一索引应拒绝重复键 %x: %v", key, err)
+			}
+		}
+	})
+	
+	t.Run("单边范围查询", func(t *testing.T) {
+		idx := storage.NewSortedDataInterface("range_idx", false, btree.DefaultOrder)
+		key := func(i int) []byte { return []byte{byte(i >> 8), byte(i)} }
+		
+		// 条目数超过一个叶子节点的容量，乱序插入使叶子节点多次分裂
+		const n = 600
+		for i := 0; i < n; i++ {
+			v := (i * 7) % n
+			if err := idx.Insert(ctx, key(v), storage.NewRecordIdFromLong(int64(v))); err != nil {
+				t.Fatalf("插入失败: %v", err)
+			}
+		}
+		collect := func(cursor storage.IndexCursor, err error) []int {
+			t.Helper()
+			if err != nil {
+				t.Fatalf("范围查询失败: %v", err)
+			}
+			defer cursor.Close()
+			var got []int
+			for cursor.Next() {
+				k := cursor.Key()
+				got = append(got, int(k[0])<<8|int(k[1]))
+			}
+			return got
+		}
+		check := func(name string, got []int, from, to, step int) {
+			t.Helper()
+			var want []int
+			for i := from; i != to; i += step {
+				want = append(want, i)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%s: 应返回 %d 个条目, got %d", name, len(want), len(got))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("%s: 第 %d 个条目应为 %d, got %d", name, i, want[i], got[i])
+				}
+			}
+		}
+		
+		check("SeekLessThan(300)", collect(idx.SeekLessThan(ctx, key(300))), 299, -1, -1)
+		check("SeekGreaterThan(300)", collect(idx.SeekGreaterThan(ctx, key(300))), 301, n, 1)
+		check("SeekLessThan(0)", collect(idx.SeekLessThan(ctx, key(0))), 0, 0, 1)
+		check("SeekGreaterThan(599)", collect(idx.SeekGreaterThan(ctx, key(n-1))), 0, 0, 1)
+		check("SeekLessThan(ffff)", collect(idx.SeekLessThan(ctx, []byte{0xFF, 0xFF})), n-1, -1, -1)
+		check("SeekGreaterThan(00)", collect(idx.SeekGreaterThan(ctx, []byte{0x00})), 0, n, 1)
+		
+		// 索引键为 key 的条目不在任一边界内，以 key 为前缀的更长的键大于 key
+		if err := idx.Insert(ctx, []byte{0x01, 0x2C, 0x00}, storage.NewRecordIdFromLong(2000)); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		got := collect(idx.SeekGreaterThan(ctx, key(300)))
+		if len(got) != n-300 || got[0] != 300 || got[1] != 301 {
+			t.Errorf("SeekGreaterThan(300) 应包含以 300 为前缀的键: got %v", got[:2])
+		}
+		if got := collect(idx.SeekLessThan(ctx, key(300))); len(got) != 300 || got[0] != 299 {
+			t.Errorf("SeekLessThan(300) 不应包含以 300 为前缀的键: got %d 个条目", len(got))
+		}
+	})
+
+	t.Run("点查询", func(t *testing.T) {
+		unique := storage.NewSortedDataInterface("point_unique", true, btree.DefaultOrder)
+		for i := int64(1); i <= 500; i++ {
+			if err := unique.Insert(ctx, []byte(fmt.Sprintf("key-%03d", i)), storage.NewRecordIdFromLong(i)); err != nil {
+				t.Fatalf("插入失败: %v", err)
+			}
+		}
+		rid, found, err := unique.SeekExact(ctx, []byte("key-250"))
+		if err != nil || !found || rid.Compare(storage.NewRecordIdFromLong(250)) != 0 {
+			t.Errorf("SeekExact(key-250) = %v, %v, %v, want 250", rid, found, err)
+		}
+		// 以查找键为前缀的更长的键不算匹配
+		for _, key := range []string{"key-501", "key-25", "key"} {
+			if _, found, err := unique.SeekExact(ctx, []byte(key)); err != nil || found {
+				t.Errorf("SeekExact(%s) 不应找到条目: %v, %v", key, found, err)
+			}
+		}
+		if _, _, err := unique.SeekExact(ctx, nil); err == nil {
+			t.Error("空键应返回错误")
+		}
+
+		multi := storage.NewSortedDataInterface("point_multi", false, btree.DefaultOrder)
+		for _, i := range []int64{9, 3, 7} {
+			if err := multi.Insert(ctx, []byte("dup"), storage.NewRecordIdFromLong(i)); err != nil {
+				t.Fatalf("插入失败: %v", err)
+			}
+		}
+		if rid, found, err := multi.SeekExact(ctx, []byte("dup")); err != nil || !found || rid.Compare(storage.NewRecordIdFromLong(3)) != 0 {
+			t.Errorf("非唯一索引应返回第一个条目: %v, %v, %v, want 3", rid, found, err)
+		}
+	})
+}
+
+// TestBTreeOrderConfig 测试通过 StorageConfig 配置 B+树阶数
+func TestBTreeOrderConfig(t *testing.T) {
+	ctx := context.Background()
+	if _, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory", BTreeOrder: 2}); !errors.Is(err, storage.ErrBadValue) {
+		t.Fatalf("阶数小于 3 时应返回 ErrBadValue, got %v", err)
+	}
+
+	// 最小阶数下大量插入会频繁分裂节点，数据和索引仍应完整
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory", BTreeOrder: btree.MinOrder})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	if err := engine.CreateIndex(ctx, "test", "items", storage.Index{Name: "n_1", Keys: []storage.IndexKey{{Field: "n", Direction: 1}}}); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := engine.Insert(ctx, "test", "items", []storage.Document{{"_id": int32(i), "n": int32(i % 10)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+	}
+	docs, err := engine.Find(ctx, "test", "items", storage.Document{})
+	if err != nil || len(docs) != 200 {
+		t.Fatalf("应查询到 200 个文档, got %d, %v", len(docs), err)
+	}
+	docs, err = engine.Find(ctx, "test", "items", storage.Document{"n": int32(3)})
+	if err != nil || len(docs) != 20 {
+		t.Errorf("按索引字段应查询到 20 个文档, got %d, %v", len(docs), err)
+	}
 }
 
 // BenchmarkRecordStoreInsert 基准测试：插入记录
 func BenchmarkRecordStoreInsert(b *testing.B) {
 	ctx := context.Background()
-	rs := storage.NewRecordStore("bench.collection")
+	rs := storage.NewRecordStore("bench.collection", btree.DefaultOrder)
 	data := []byte("benchmark data for testing insert performance")
 	
 	b.ResetTimer()
@@ -385,7 +735,7 @@ func BenchmarkRecordStoreInsert(b *testing.B) {
 // BenchmarkRecordStoreGet 基准测试：读取记录
 func BenchmarkRecordStoreGet(b *testing.B) {
 	ctx := context.Background()
-	rs := storage.NewRecordStore("bench.collection")
+	rs := storage.NewRecordStore("bench.collection", btree.DefaultOrder)
 	data := []byte("benchmark data")
 	
 	// 预先插入数据
@@ -406,7 +756,7 @@ func BenchmarkRecordStoreGet(b *testing.B) {
 // BenchmarkIndexInsert 基准测试：插入索引
 func BenchmarkIndexInsert(b *testing.B) {
 	ctx := context.Background()
-	idx := storage.NewSortedDataInterface("bench_idx", false)
+	idx := storage.NewSortedDataInterface("bench_idx", false, btree.DefaultOrder)
 	
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -417,3 +767,123 @@ func BenchmarkIndexInsert(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkBTreeOrder 基准测试：比较不同 B+树阶数下 RecordStore 的插入和全表扫描吞吐，用于调整 btree_order
+func BenchmarkBTreeOrder(b *testing.B) {
+	ctx := context.Background()
+	data := []byte("benchmark data for comparing btree orders")
+	const scanRecords = 10000
+
+	for _, order := range []int{4, 16, 64, btree.DefaultOrder, 512} {
+		b.Run(fmt.Sprintf("insert/order=%d", order), func(b *testing.B) {
+			rs := storage.NewRecordStore("bench.collection", order)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := rs.InsertRecord(ctx, storage.NewRecordIdFromLong(int64(i+1)), data); err != nil {
+					b.Fatalf("插入失败: %v", err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("scan/order=%d", order), func(b *testing.B) {
+			rs := storage.NewRecordStore("bench.collection", order)
+			for i := 0; i < scanRecords; i++ {
+				rs.InsertRecord(ctx, storage.NewRecordIdFromLong(int64(i+1)), data)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cursor, err := rs.Scan(ctx, storage.NullRecordId())
+				if err != nil {
+					b.Fatalf("扫描失败: %v", err)
+				}
+				n := 0
+				for cursor.Next() {
+					n++
+				}
+				cursor.Close()
+				if n != scanRecords {
+					b.Fatalf("扫描到 %d 条记录, want %d", n, scanRecords)
+				}
+			}
+		})
+	}
+}
+
+// TestEngineCacheSize 测试引擎按配置文件设置 KV 引擎的缓存大小，cache_size_gb 优先于 wired_tiger_cache
+func TestEngineCacheSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xmongodb.toml")
+	content := "[storage]\nengine = \"memory\"\ncache_size_gb = 2\nwired_tiger_cache = 1073741824\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("写入配置文件失败: %v", err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	engine, err := storage.NewMemoryEngine(cfg.Storage)
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	stats := engine.GetStats()
+	if got := stats["kv_engine"].(map[string]interface{})["cache_size"]; got != int64(2<<30) {
+		t.Errorf("KV 引擎缓存大小 = %v, want 2GiB", got)
+	}
+	if got := stats["cache_size"]; got != int64(2<<30) {
+		t.Errorf("统计中的缓存大小 = %v, want 2GiB", got)
+	}
+
+	for _, tt := range []struct {
+		cfg  config.StorageConfig
+		want int64
+	}{
+		{config.StorageConfig{WiredTigerCache: 512 << 20}, 512 << 20},
+		{config.StorageConfig{CacheSizeGB: 3, WiredTigerCache: 512 << 20}, 3 << 30},
+		{config.StorageConfig{}, config.DefaultCacheSize},
+	} {
+		if got := tt.cfg.CacheSizeBytes(); got != tt.want {
+			t.Errorf("CacheSizeBytes(%+v) = %d, want %d", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+// TestRecreateDroppedCollection 测试删除集合或数据库后释放 KV 引擎中的存储，可以重新创建同名集合
+func TestRecreateDroppedCollection(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	kvIndexes := func() int {
+		return engine.GetStats()["kv_engine"].(map[string]interface{})["indexes"].(int)
+	}
+	if err := engine.Insert(ctx, "test", "items", []storage.Document{{"_id": int32(1), "a": int32(1)}}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	before := kvIndexes()
+	if err := engine.CreateIndex(ctx, "test", "items", storage.Index{Name: "a_1", Keys: []storage.IndexKey{{Field: "a", Direction: 1}}}); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+
+	if err := engine.DropCollection(ctx, "test", "items"); err != nil {
+		t.Fatalf("删除集合失败: %v", err)
+	}
+	if n := kvIndexes(); n != before-1 {
+		t.Errorf("删除集合后 KV 引擎中的索引数 = %d, want %d", n, before-1)
+	}
+	if err := engine.CreateCollection(ctx, "test", "items"); err != nil {
+		t.Fatalf("重新创建集合失败: %v", err)
+	}
+	if docs, err := engine.Find(ctx, "test", "items", storage.Document{}); err != nil || len(docs) != 0 {
+		t.Errorf("重新创建的集合应为空: %v, %v", docs, err)
+	}
+
+	if err := engine.DropDatabase(ctx, "test"); err != nil {
+		t.Fatalf("删除数据库失败: %v", err)
+	}
+	if err := engine.CreateDatabase(ctx, "test"); err != nil {
+		t.Fatalf("重新创建数据库失败: %v", err)
+	}
+	if err := engine.CreateCollection(ctx, "test", "items"); err != nil {
+		t.Errorf("删除数据库后重新创建集合失败: %v", err)
+	}
+}
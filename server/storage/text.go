@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// 文本索引目前只支持英文分词，不做词干提取
+const defaultTextLanguage = "english"
+
+// englishStopWords 英文停用词，分词时去掉
+var englishStopWords = map[string]bool{
+	"a": true, "about": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true, "has": true, "have": true,
+	"he": true, "her": true, "his": true, "i": true, "in": true, "is": true, "it": true, "its": true,
+	"of": true, "on": true, "or": true, "our": true, "she": true, "so": true, "that": true,
+	"the": true, "their": true, "them": true, "there": true, "they": true, "this": true,
+	"to": true, "was": true, "we": true, "were": true, "what": true, "when": true, "which": true,
+	"who": true, "will": true, "with": true, "you": true, "your": true,
+}
+
+// IsText 索引是否为文本索引
+func (idx Index) IsText() bool {
+	return idx.Type() == IndexTypeText
+}
+
+// tokenizeText 将字符串按非字母数字字符切分为小写词元，并去掉英文停用词
+func tokenizeText(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, word := range words {
+		if !englishStopWords[word] {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// textFieldStrings 返回文档在文本字段上的字符串取值，字符串数组按元素展开，其他类型忽略
+func textFieldStrings(doc Document, field string) []string {
+	var out []string
+	for _, v := range lookupPath(doc, strings.Split(field, ".")) {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+			continue
+		}
+		for _, elem := range toArray(v) {
+			if s, ok := elem.(string); ok {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// textIndexEntries 计算文档在文本索引中的条目，每个不同的词元一个条目
+// 没有任何词元的文档不建索引
+func textIndexEntries(index Index, doc Document) []indexEntry {
+	seen := make(map[string]bool)
+	var entries []indexEntry
+	for _, key := range index.Keys {
+		for _, s := range textFieldStrings(doc, key.Field) {
+			for _, token := range tokenizeText(s) {
+				if seen[token] {
+					continue
+				}
+				seen[token] = true
+				entries = append(entries, indexEntry{key: encodeKeyValue(token), values: []interface{}{token}})
+			}
+		}
+	}
+	return entries
+}
+
+// TextSearchTerms 解析过滤条件中的 {$text: {$search: "..."}}，返回去重排序后的搜索词元
+// 第二个返回值表示过滤条件是否包含 $text；短语和排除词按普通词处理
+func TextSearchTerms(filter Document) ([]string, bool, error) {
+	cond, ok := filter["$text"]
+	if !ok {
+		return nil, false, nil
+	}
+	spec := toDocument(cond)
+	if spec == nil {
+		return nil, true, fmt.Errorf("%w: $text 的参数必须是文档", ErrBadValue)
+	}
+	var terms []string
+	hasSearch := false
+	for key, v := range spec {
+		switch key {
+		case "$search":
+			s, ok := v.(string)
+			if !ok {
+				return nil, true, fmt.Errorf("%w: $search 必须是字符串", ErrBadValue)
+			}
+			hasSearch = true
+			terms = tokenizeText(s)
+		case "$language":
+			lang, _ := v.(string)
+			if lang != defaultTextLanguage && lang != "en" && lang != "none" {
+				return nil, true, fmt.Errorf("%w: 不支持的文本搜索语言: %v", ErrBadValue, v)
+			}
+		case "$caseSensitive", "$diacriticSensitive":
+			if sensitive, _ := v.(bool); sensitive {
+				return nil, true, fmt.Errorf("%w: 暂不支持 %s", ErrBadValue, key)
+			}
+		default:
+			return nil, true, fmt.Errorf("%w: $text 不支持的参数: %s", ErrBadValue, key)
+		}
+	}
+	if !hasSearch {
+		return nil, true, fmt.Errorf("%w: $text 缺少 $search 参数", ErrBadValue)
+	}
+
+	sort.Strings(terms)
+	unique := terms[:0]
+	for i, term := range terms {
+		if i == 0 || term != terms[i-1] {
+			unique = append(unique, term)
+		}
+	}
+	return unique, true, nil
+}
+
+// TextScore 计算文档对搜索词元的相关度得分
+// 与 mongod 的算法一致：词元在字段中重复出现时的贡献依次减半，并按在字段词元中的占比加权
+func TextScore(index Index, doc Document, terms []string) float64 {
+	var score float64
+	for _, key := range index.Keys {
+		for _, s := range textFieldStrings(doc, key.Field) {
+			tokens := tokenizeText(s)
+			counts := make(map[string]int, len(tokens))
+			freqs := make(map[string]float64, len(tokens))
+			for _, token := range tokens {
+				freqs[token] += 1 / math.Pow(2, float64(counts[token]))
+				counts[token]++
+			}
+			for _, term := range terms {
+				if counts[term] == 0 {
+					continue
+				}
+				coeff := 0.5*float64(counts[term])/float64(len(tokens)) + 0.5
+				score += freqs[term] * coeff
+			}
+		}
+	}
+	return score
+}
+
+// textPlan 为 $text 查询构造文本索引扫描计划，每个搜索词元对应一个索引区间
+// 读取文档后只检查 $text 以外的条件
+func textPlan(coll *Collection, filter Document) (*QueryPlan, error) {
+	terms, _, err := TextSearchTerms(filter)
+	if err != nil {
+		return nil, err
+	}
+	var spec Index
+	for _, s := range coll.IndexSpecs {
+		if s.IsText() && !s.Hidden {
+			spec = s
+			break
+		}
+	}
+	if spec.Name == "" || coll.index(spec.Name) == nil {
+		return nil, fmt.Errorf("%w: $text 查询需要文本索引", ErrIndexNotFound)
+	}
+
+	residual := make(Document, len(filter))
+	for key, v := range filter {
+		if key != "$text" {
+			residual[key] = v
+		}
+	}
+	intervals := make([]keyInterval, 0, len(terms))
+	for _, term := range terms {
+		key := encodeKeyValue(term)
+		intervals = append(intervals, keyInterval{start: key, end: keySuccessor(key)})
+	}
+	return &QueryPlan{
+		Stage:      StageText,
+		IndexName:  spec.Name,
+		KeyPattern: spec.KeyPattern(),
+		Filter:     filter,
+		TextTerms:  terms,
+		intervals:  intervals,
+		residual:   residual,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestTextIndex 测试文本索引的分词、$text 查询和相关度得分
+func TestTextIndex(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+
+	docs := []storage.Document{
+		{"_id": int32(1), "title": "Go concurrency patterns", "body": "Channels and goroutines in Go.", "year": int32(2012)},
+		{"_id": int32(2), "title": "Rust ownership", "body": "Borrowing, lifetimes and the borrow checker.", "year": int32(2015)},
+		{"_id": int32(3), "title": "Advanced Go", "body": "Go go GO: generics, channels.", "year": int32(2022)},
+		{"_id": int32(4), "title": "Cooking pasta", "tags": []interface{}{"Italian", "dinner"}, "year": int32(2020)},
+		{"_id": int32(5), "title": int32(42)},
+	}
+	if err := engine.Insert(ctx, "test", "articles", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+
+	t.Run("没有文本索引时 $text 查询失败", func(t *testing.T) {
+		_, err := engine.Find(ctx, "test", "articles", storage.Document{"$text": storage.Document{"$search": "go"}})
+		if !errors.Is(err, storage.ErrIndexNotFound) {
+			t.Errorf("应返回 ErrIndexNotFound: %v", err)
+		}
+	})
+
+	index := storage.Index{
+		Name: "title_text_body_text_tags_text",
+		Keys: []storage.IndexKey{
+			{Field: "title", Direction: 1, Type: storage.IndexTypeText},
+			{Field: "body", Direction: 1, Type: storage.IndexTypeText},
+			{Field: "tags", Direction: 1, Type: storage.IndexTypeText},
+		},
+	}
+	if err := engine.CreateIndex(ctx, "test", "articles", index); err != nil {
+		t.Fatalf("创建文本索引失败: %v", err)
+	}
+
+	search := func(filter storage.Document) []int32 {
+		t.Helper()
+		found, err := engine.Find(ctx, "test", "articles", filter)
+		if err != nil {
+			t.Fatalf("查询 %v 失败: %v", filter, err)
+		}
+		ids := make([]int32, len(found))
+		for i, doc := range found {
+			ids[i] = doc["_id"].(int32)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+	text := func(s string) storage.Document {
+		return storage.Document{"$text": storage.Document{"$search": s}}
+	}
+	equal := func(a []int32, b ...int32) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	t.Run("索引条目按词元去重并去掉停用词", func(t *testing.T) {
+		stats, err := engine.CollectionStats(ctx, "test", "articles")
+		if err != nil {
+			t.Fatalf("获取统计失败: %v", err)
+		}
+		// 1: go concurrency patterns channels goroutines
+		// 2: rust ownership borrowing lifetimes borrow checker
+		// 3: advanced go generics channels
+		// 4: cooking pasta italian dinner
+		if n := stats.IndexEntries[index.Name]; n != 19 {
+			t.Errorf("文本索引应有 19 个条目, got %d", n)
+		}
+	})
+
+	t.Run("单个词", func(t *testing.T) {
+		if got := search(text("GO")); !equal(got, 1, 3) {
+			t.Errorf("go: got %v", got)
+		}
+		if got := search(text("italian")); !equal(got, 4) {
+			t.Errorf("字符串数组应按元素分词: got %v", got)
+		}
+		if got := search(text("the")); len(got) != 0 {
+			t.Errorf("停用词不应匹配任何文档: %v", got)
+		}
+	})
+
+	t.Run("多个词匹配任一词", func(t *testing.T) {
+		if got := search(text("rust, pasta!")); !equal(got, 2, 4) {
+			t.Errorf("rust pasta: got %v", got)
+		}
+		if got := search(text("channels borrow")); !equal(got, 1, 2, 3) {
+			t.Errorf("channels borrow: got %v", got)
+		}
+	})
+
+	t.Run("与其他条件组合", func(t *testing.T) {
+		filter := text("go")
+		filter["year"] = storage.Document{"$gt": int32(2020)}
+		if got := search(filter); !equal(got, 3) {
+			t.Errorf("got %v, want [3]", got)
+		}
+		e, err := engine.Explain(ctx, "test", "articles", filter, nil, nil, true)
+		if err != nil {
+			t.Fatalf("explain 失败: %v", err)
+		}
+		if e.Plan.Stage != storage.StageText || e.Plan.IndexName != index.Name || e.Stats.NReturned != 1 {
+			t.Errorf("应使用文本索引: %+v %+v", e.Plan, e.Stats)
+		}
+	})
+
+	t.Run("相关度得分", func(t *testing.T) {
+		found, err := engine.Find(ctx, "test", "articles", text("go"))
+		if err != nil || len(found) != 2 {
+			t.Fatalf("查询失败: %v %v", found, err)
+		}
+		scores := map[int32]float64{}
+		for _, doc := range found {
+			scores[doc["_id"].(int32)] = storage.TextScore(index, doc, []string{"go"})
+		}
+		if scores[3] <= scores[1] || scores[1] <= 0 {
+			t.Errorf("go 出现更多次的文档得分应更高: %v", scores)
+		}
+	})
+
+	t.Run("每个集合只能有一个文本索引", func(t *testing.T) {
+		err := engine.CreateIndex(ctx, "test", "articles", storage.Index{
+			Name: "body_text", Keys: []storage.IndexKey{{Field: "body", Direction: 1, Type: storage.IndexTypeText}},
+		})
+		if !errors.Is(err, storage.ErrIndexConflict) {
+			t.Errorf("应返回 ErrIndexConflict: %v", err)
+		}
+	})
+}
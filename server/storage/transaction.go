@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// recoveryUnitKey context 中保存事务 RecoveryUnit 的键
+type recoveryUnitKey struct{}
+
+// WithRecoveryUnit 返回携带事务 RecoveryUnit 的 context
+// 在该 context 上执行的写操作立即写入记录存储，同时向 RecoveryUnit 注册变更：
+// 提交时写入 oplog，回滚时按相反顺序撤销写操作。事务写过的记录持有写意向，见 writeIntents：
+// 事务结束前只有该事务能读到新的版本，其他会话读到事务写入前的版本，其他写操作修改这些记录时返回 ErrWriteConflict
+func WithRecoveryUnit(ctx context.Context, ru RecoveryUnit) context.Context {
+	return context.WithValue(ctx, recoveryUnitKey{}, ru)
+}
+
+// transactionUnit 返回 context 中处于活动状态的 RecoveryUnit，不在事务中时返回 nil
+func transactionUnit(ctx context.Context) RecoveryUnit {
+	ru, ok := ctx.Value(recoveryUnitKey{}).(RecoveryUnit)
+	if !ok || !ru.IsActive() {
+		return nil
+	}
+	return ru
+}
+
+// checkTransactionWrite 检查集合能否在事务中写入
+// 固定集合插入时会淘汰旧文档，淘汰无法回滚，与 mongod 一致不允许在事务中写入
+func checkTransactionWrite(ctx context.Context, coll *Collection) error {
+	if coll.Capped && transactionUnit(ctx) != nil {
+		return fmt.Errorf("%w: 不能在事务中写入固定集合 %s", ErrIllegalOperation, coll.Namespace)
+	}
+	return nil
+}
+
+// logOrDefer 写入 oplog；在事务中时改为注册变更，提交时写入 oplog，回滚时调用 undo 撤销已执行的写操作
+// 调用方需持有 e.oplogMu；变更在事务结束时执行，届时重新获取 e.oplogMu
+func (e *WiredTigerEngine) logOrDefer(ctx context.Context, coll *Collection, op string, o, o2 Document, undo func(ctx context.Context)) error {
+	ru := transactionUnit(ctx)
+	if ru == nil {
+		if err := e.logOp(ctx, coll, op, o, o2); err != nil {
+			undo(ctx)
+			return err
+		}
+		return nil
+	}
+
+	o = cloneDocument(o)
+	change := NewSimpleChange(func() error {
+		e.oplogMu.Lock()
+		defer e.oplogMu.Unlock()
+		return e.logOp(context.Background(), coll, op, o, o2)
+	}, func() error {
+		e.oplogMu.Lock()
+		defer e.oplogMu.Unlock()
+		undo(context.Background())
+		return nil
+	})
+	if err := ru.RegisterChange(change); err != nil {
+		undo(ctx)
+		return err
+	}
+	return nil
+}
+
+// writeIntents 记录事务写过的记录，事务提交或回滚前其他写操作修改这些记录时返回 ErrWriteConflict
+// 事务回滚时写回记录的旧版本，若期间允许其他会话修改同一记录，回滚会覆盖其他会话已提交的修改
+// 写意向同时保存记录在事务首次写入前的版本，其他会话读取时用它代替事务尚未提交的写入
+type writeIntents struct {
+	mu     sync.Mutex
+	owners map[string]*writeIntent         // 记录到写意向
+	held   map[RecoveryUnit][]string       // 事务持有写意向的记录
+	colls  map[string]map[RecoveryUnit]int // 集合命名空间到各事务在集合上持有的写意向数
+	count  atomic.Int64                    // owners 中的写意向数，为 0 时读取不需要检查写意向
+}
+
+// writeIntent 事务对一条记录的写意向
+type writeIntent struct {
+	ru        RecoveryUnit
+	namespace string
+	recordId  RecordId
+	before    []byte // 事务首次写入前的记录，事务插入的记录为 nil
+}
+
+// writeIntentKey 返回记录在 writeIntents 中的键
+// 扫描游标返回字节形式的 RecordId，插入时生成整数形式的 RecordId，统一按字节形式比较
+func writeIntentKey(coll *Collection, recordId RecordId) string {
+	ridBytes, _ := recordId.AsBytes()
+	return coll.Namespace + "\x00" + string(ridBytes)
+}
+
+// acquire 获取记录的写意向，记录被其他事务持有时返回 ErrWriteConflict
+// ru 为 nil 表示不在事务中的写操作，只检查冲突不持有写意向；before 为记录修改前的版本，插入时为 nil；
+// 事务首次获取写意向时注册变更，在事务提交或回滚的最后释放该事务持有的全部写意向
+func (w *writeIntents) acquire(ru RecoveryUnit, coll *Collection, recordId RecordId, before []byte) error {
+	if ru != nil {
+		w.mu.Lock()
+		_, registered := w.held[ru]
+		if !registered {
+			if w.held == nil {
+				w.held = make(map[RecoveryUnit][]string)
+				w.owners = make(map[string]*writeIntent)
+				w.colls = make(map[string]map[RecoveryUnit]int)
+			}
+			w.held[ru] = nil
+		}
+		w.mu.Unlock()
+
+		// 回滚按注册的相反顺序执行，释放变更先于该事务的所有写操作注册，撤销全部完成后才释放
+		if !registered {
+			release := func() error {
+				w.release(ru)
+				return nil
+			}
+			if err := ru.RegisterChange(NewSimpleChange(release, release)); err != nil {
+				w.release(ru)
+				return err
+			}
+		}
+	}
+
+	key := writeIntentKey(coll, recordId)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	intent, ok := w.owners[key]
+	switch {
+	case ok && intent.ru == ru:
+		return nil
+	case ok:
+		return fmt.Errorf("%w: 记录正被其他事务修改", ErrWriteConflict)
+	case ru == nil:
+		return nil
+	}
+	// 扫描游标返回的数据可能与存储共用内存，复制一份避免被之后的写入改写
+	w.owners[key] = &writeIntent{ru: ru, namespace: coll.Namespace, recordId: recordId, before: bytes.Clone(before)}
+	w.held[ru] = append(w.held[ru], key)
+	if w.colls[coll.Namespace] == nil {
+		w.colls[coll.Namespace] = make(map[RecoveryUnit]int)
+	}
+	w.colls[coll.Namespace][ru]++
+	w.count.Add(1)
+	return nil
+}
+
+// release 释放事务持有的全部写意向
+func (w *writeIntents) release(ru RecoveryUnit) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range w.held[ru] {
+		intent := w.owners[key]
+		delete(w.owners, key)
+		w.count.Add(-1)
+		owners := w.colls[intent.namespace]
+		if owners[ru]--; owners[ru] <= 0 {
+			delete(owners, ru)
+		}
+		if len(owners) == 0 {
+			delete(w.colls, intent.namespace)
+		}
+	}
+	delete(w.held, ru)
+}
+
+// foreign 集合中是否有 ru 以外的事务持有写意向
+func (w *writeIntents) foreign(ru RecoveryUnit, coll *Collection) bool {
+	if w.count.Load() == 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for owner := range w.colls[coll.Namespace] {
+		if owner != ru {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleVersion 返回 ru 读取记录时应看到的版本
+// 记录被其他事务持有写意向时返回该事务写入前的版本，该事务插入的记录对 ru 不可见，返回 false
+func (w *writeIntents) visibleVersion(ru RecoveryUnit, coll *Collection, recordId RecordId, data []byte) ([]byte, bool) {
+	if w.count.Load() == 0 {
+		return data, true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	intent, ok := w.owners[writeIntentKey(coll, recordId)]
+	if !ok || intent.ru == ru {
+		return data, true
+	}
+	return intent.before, intent.before != nil
+}
+
+// foreignDeleted 返回集合中被 ru 以外的事务持有写意向、写入前存在的记录，按 RecordId 排序
+// 全表扫描结束后从中找出已被这些事务删除的记录，按删除前的版本返回
+func (w *writeIntents) foreignDeleted(ru RecoveryUnit, coll *Collection) []*writeIntent {
+	if w.count.Load() == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var intents []*writeIntent
+	for owner := range w.colls[coll.Namespace] {
+		if owner == ru {
+			continue
+		}
+		for _, key := range w.held[owner] {
+			if intent := w.owners[key]; intent.namespace == coll.Namespace && intent.before != nil {
+				intents = append(intents, intent)
+			}
+		}
+	}
+	sort.Slice(intents, func(i, j int) bool { return compareRecordIds(intents[i].recordId, intents[j].recordId) < 0 })
+	return intents
+}
+
+// compareRecordIds 按字节形式比较 RecordId，整数形式与字节形式的同一记录相等
+func compareRecordIds(a, b RecordId) int {
+	aBytes, _ := a.AsBytes()
+	bBytes, _ := b.AsBytes()
+	return bytes.Compare(aBytes, bBytes)
+}
+
+// isolatedPlan 其他事务在集合上持有写意向时把索引扫描改为全表扫描
+// 这些事务已经改写了索引条目，按索引扫描会漏掉写入前的版本，全表扫描才能按写入前的版本读到这些记录
+func (e *WiredTigerEngine) isolatedPlan(ctx context.Context, coll *Collection, plan *QueryPlan) *QueryPlan {
+	if (plan.Stage != StageIxScan && plan.Stage != StageOr) || !e.intents.foreign(transactionUnit(ctx), coll) {
+		return plan
+	}
+	return &QueryPlan{Stage: StageCollScan, Filter: plan.Filter}
+}
+
+// beginRecordWrite 修改或删除已有记录前获取写意向
+// 事务中还要确认记录仍是扫描时读到的版本，否则回滚写回的旧版本会覆盖其他会话在此期间提交的修改
+// 调用方需持有 e.oplogMu
+func (e *WiredTigerEngine) beginRecordWrite(ctx context.Context, coll *Collection, m matchedRecord) error {
+	ru := transactionUnit(ctx)
+	if err := e.intents.acquire(ru, coll, m.recordId, m.data); err != nil {
+		return err
+	}
+	if ru == nil {
+		return nil
+	}
+	current, err := coll.RecordStore.GetRecord(ctx, m.recordId)
+	if err != nil || !bytes.Equal(current, m.data) {
+		return fmt.Errorf("%w: 记录 %s 在读取后已被修改", ErrWriteConflict, m.recordId)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestTransaction 测试在携带 RecoveryUnit 的 context 上执行的写操作随事务提交或回滚
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	if err := engine.Insert(ctx, "test", "accounts", []storage.Document{
+		{"_id": int32(1), "balance": int32(100)},
+		{"_id": int32(2), "balance": int32(50)},
+	}); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.CreateIndex(ctx, "test", "accounts", storage.Index{
+		Name: "balance_1", Keys: []storage.IndexKey{{Field: "balance", Direction: 1}},
+	}); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+
+	balances := func(ctx context.Context) map[int32]int32 {
+		t.Helper()
+		docs, err := engine.Find(ctx, "test", "accounts", storage.Document{})
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		out := make(map[int32]int32, len(docs))
+		for _, doc := range docs {
+			out[doc["_id"].(int32)] = doc["balance"].(int32)
+		}
+		return out
+	}
+	oplogCount := func() int {
+		t.Helper()
+		entries, err := engine.Find(ctx, storage.OplogDatabase, storage.OplogCollection, storage.Document{})
+		if err != nil {
+			t.Fatalf("读取 oplog 失败: %v", err)
+		}
+		return len(entries)
+	}
+	// 在事务中转账、开户和销户
+	run := func() storage.RecoveryUnit {
+		t.Helper()
+		ru := storage.NewRecoveryUnit()
+		if err := ru.BeginTransaction(ctx); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+		txnCtx := storage.WithRecoveryUnit(ctx, ru)
+		if _, err := engine.Update(txnCtx, "test", "accounts", storage.Document{"_id": int32(1)},
+			storage.Document{"$inc": storage.Document{"balance": int32(-30)}}, storage.UpdateOptions{}); err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		if _, err := engine.Update(txnCtx, "test", "accounts", storage.Document{"_id": int32(2)},
+			storage.Document{"$inc": storage.Document{"balance": int32(30)}}, storage.UpdateOptions{}); err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		if err := engine.Insert(txnCtx, "test", "accounts", []storage.Document{{"_id": int32(3), "balance": int32(10)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		if _, err := engine.Delete(txnCtx, "test", "accounts", storage.Document{"_id": int32(3)}, true); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+		if err := engine.Insert(txnCtx, "test", "accounts", []storage.Document{{"_id": int32(4), "balance": int32(5)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		// 事务内的读取能看到事务自己的写入，其他会话只能看到事务开始前的版本
+		if got := balances(txnCtx); len(got) != 3 || got[1] != 70 || got[2] != 80 || got[4] != 5 {
+			t.Fatalf("事务内读取结果不正确: %v", got)
+		}
+		if got := balances(ctx); len(got) != 2 || got[1] != 100 || got[2] != 50 {
+			t.Fatalf("事务外不应读到未提交的写入: %v", got)
+		}
+		return ru
+	}
+	entriesBefore := oplogCount()
+
+	t.Run("回滚撤销全部写操作", func(t *testing.T) {
+		ru := run()
+		if err := ru.Rollback(ctx); err != nil {
+			t.Fatalf("回滚失败: %v", err)
+		}
+		if got := balances(ctx); len(got) != 2 || got[1] != 100 || got[2] != 50 {
+			t.Errorf("回滚后应恢复原始文档: %v", got)
+		}
+		if n := oplogCount(); n != entriesBefore {
+			t.Errorf("回滚的事务不应写入 oplog: %d -> %d", entriesBefore, n)
+		}
+		results, err := engine.Validate(ctx, "test", "accounts")
+		if err != nil || !results.Valid() {
+			t.Errorf("回滚后索引应与记录一致: %+v %v", results, err)
+		}
+		found, err := engine.Find(ctx, "test", "accounts", storage.Document{"balance": int32(100)})
+		if err != nil || len(found) != 1 {
+			t.Errorf("回滚后应能通过索引找到原始余额: %v %v", found, err)
+		}
+	})
+
+	t.Run("提交后写入 oplog", func(t *testing.T) {
+		ru := run()
+		if n := oplogCount(); n != entriesBefore {
+			t.Errorf("提交前不应写入 oplog: %d -> %d", entriesBefore, n)
+		}
+		if err := ru.Commit(ctx); err != nil {
+			t.Fatalf("提交失败: %v", err)
+		}
+		if got := balances(ctx); len(got) != 3 || got[1] != 70 || got[2] != 80 || got[4] != 5 {
+			t.Errorf("提交后的结果不正确: %v", got)
+		}
+		entries, err := engine.Find(ctx, storage.OplogDatabase, storage.OplogCollection, storage.Document{})
+		if err != nil {
+			t.Fatalf("读取 oplog 失败: %v", err)
+		}
+		var ops []string
+		for _, entry := range entries[entriesBefore:] {
+			ops = append(ops, entry["op"].(string))
+		}
+		want := []string{storage.OplogUpdate, storage.OplogUpdate, storage.OplogInsert, storage.OplogDelete, storage.OplogInsert}
+		if len(ops) != len(want) {
+			t.Fatalf("提交后的 oplog 条目不正确: %v", ops)
+		}
+		for i := range want {
+			if ops[i] != want[i] {
+				t.Errorf("第 %d 个 oplog 条目应为 %s, got %s", i, want[i], ops[i])
+			}
+		}
+	})
+
+	t.Run("其他会话读不到未提交的写入", func(t *testing.T) {
+		ru := storage.NewRecoveryUnit()
+		if err := ru.BeginTransaction(ctx); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+		txnCtx := storage.WithRecoveryUnit(ctx, ru)
+		if err := engine.Insert(txnCtx, "test", "accounts", []storage.Document{{"_id": int32(5), "balance": int32(1)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		if _, err := engine.Update(txnCtx, "test", "accounts", storage.Document{"_id": int32(2)},
+			storage.Document{"$set": storage.Document{"balance": int32(0)}}, storage.UpdateOptions{}); err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+		if _, err := engine.Delete(txnCtx, "test", "accounts", storage.Document{"_id": int32(4)}, true); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+
+		// 另一个会话：事务插入的文档不可见，修改和删除的文档保持事务开始前的版本
+		if got := balances(ctx); len(got) != 3 || got[1] != 70 || got[2] != 80 || got[4] != 5 {
+			t.Errorf("其他会话应只看到事务开始前的版本: %v", got)
+		}
+		if found, err := engine.Find(ctx, "test", "accounts", storage.Document{"_id": int32(5)}); err != nil || len(found) != 0 {
+			t.Errorf("其他会话不应读到未提交的插入: %v %v", found, err)
+		}
+		if found, err := engine.Find(ctx, "test", "accounts", storage.Document{"balance": int32(80)}); err != nil || len(found) != 1 {
+			t.Errorf("其他会话按索引查询应读到修改前的版本: %v %v", found, err)
+		}
+		if found, err := engine.Find(ctx, "test", "accounts", storage.Document{"balance": int32(0)}); err != nil || len(found) != 0 {
+			t.Errorf("其他会话按索引查询不应读到未提交的修改: %v %v", found, err)
+		}
+		if got := balances(txnCtx); len(got) != 3 || got[2] != 0 || got[5] != 1 {
+			t.Errorf("事务内读取结果不正确: %v", got)
+		}
+
+		if err := ru.Commit(ctx); err != nil {
+			t.Fatalf("提交失败: %v", err)
+		}
+		if got := balances(ctx); len(got) != 3 || got[2] != 0 || got[5] != 1 {
+			t.Errorf("提交后其他会话应读到事务的写入: %v", got)
+		}
+		// 恢复后续子测试使用的数据
+		if _, err := engine.Delete(ctx, "test", "accounts", storage.Document{"_id": int32(5)}, true); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+		if err := engine.Insert(ctx, "test", "accounts", []storage.Document{{"_id": int32(4), "balance": int32(5)}}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		if _, err := engine.Update(ctx, "test", "accounts", storage.Document{"_id": int32(2)},
+			storage.Document{"$set": storage.Document{"balance": int32(80)}}, storage.UpdateOptions{}); err != nil {
+			t.Fatalf("更新失败: %v", err)
+		}
+	})
+
+	t.Run("事务结束前其他写操作不能修改事务写过的记录", func(t *testing.T) {
+		inc := func(ctx context.Context, id, delta int32) error {
+			_, err := engine.Update(ctx, "test", "accounts", storage.Document{"_id": id},
+				storage.Document{"$inc": storage.Document{"balance": delta}}, storage.UpdateOptions{})
+			return err
+		}
+		ru := storage.NewRecoveryUnit()
+		if err := ru.BeginTransaction(ctx); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+		if err := inc(storage.WithRecoveryUnit(ctx, ru), 1, 1); err != nil {
+			t.Fatalf("事务中更新失败: %v", err)
+		}
+
+		if err := inc(ctx, 1, 100); !errors.Is(err, storage.ErrWriteConflict) {
+			t.Errorf("事务外更新应返回 ErrWriteConflict: %v", err)
+		}
+		if _, err := engine.Delete(ctx, "test", "accounts", storage.Document{"_id": int32(1)}, true); !errors.Is(err, storage.ErrWriteConflict) {
+			t.Errorf("事务外删除应返回 ErrWriteConflict: %v", err)
+		}
+		other := storage.NewRecoveryUnit()
+		if err := other.BeginTransaction(ctx); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+		if err := inc(storage.WithRecoveryUnit(ctx, other), 1, 100); !errors.Is(err, storage.ErrWriteConflict) {
+			t.Errorf("其他事务更新应返回 ErrWriteConflict: %v", err)
+		}
+		other.Rollback(ctx)
+		if err := inc(ctx, 2, 1); err != nil {
+			t.Errorf("未被事务修改的记录应能更新: %v", err)
+		}
+
+		if err := ru.Rollback(ctx); err != nil {
+			t.Fatalf("回滚失败: %v", err)
+		}
+		if got := balances(ctx); got[1] != 70 || got[2] != 81 {
+			t.Errorf("回滚只应撤销事务自己的写入: %v", got)
+		}
+		if err := inc(ctx, 1, 1); err != nil {
+			t.Errorf("事务结束后应能更新记录: %v", err)
+		}
+		if got := balances(ctx); got[1] != 71 {
+			t.Errorf("事务结束后的更新结果不正确: %v", got)
+		}
+	})
+
+	t.Run("事务中不能写入固定集合", func(t *testing.T) {
+		if err := engine.CreateCappedCollection(ctx, "test", "events", 4096, 0); err != nil {
+			t.Fatalf("创建固定集合失败: %v", err)
+		}
+		ru := storage.NewRecoveryUnit()
+		if err := ru.BeginTransaction(ctx); err != nil {
+			t.Fatalf("开始事务失败: %v", err)
+		}
+		defer ru.Rollback(ctx)
+		err := engine.Insert(storage.WithRecoveryUnit(ctx, ru), "test", "events", []storage.Document{{"_id": int32(1)}})
+		if !errors.Is(err, storage.ErrIllegalOperation) {
+			t.Errorf("应返回 ErrIllegalOperation: %v", err)
+		}
+		if docs, _ := engine.Find(ctx, "test", "events", storage.Document{}); len(docs) != 0 {
+			t.Errorf("固定集合不应被写入: %v", docs)
+		}
+	})
+}
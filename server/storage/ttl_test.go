@@ -0,0 +1,113 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestTTLIndex 测试 TTL 索引的过期清理
+func TestTTLIndex(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	newEngine := func(cfg config.StorageConfig) *storage.MemoryEngine {
+		t.Helper()
+		engine, err := storage.NewMemoryEngine(cfg)
+		if err != nil {
+			t.Fatalf("创建引擎失败: %v", err)
+		}
+		docs := []storage.Document{
+			{"_id": int32(1), "createdAt": now.Add(-2 * time.Hour)},
+			{"_id": int32(2), "createdAt": now},
+			{"_id": int32(3), "createdAt": "not a date"},
+			{"_id": int32(4)},
+			{"_id": int32(5), "createdAt": []interface{}{now, now.Add(-3 * time.Hour)}},
+		}
+		if err := engine.Insert(ctx, "test", "sessions", docs); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		if err := engine.CreateIndex(ctx, "test", "sessions", storage.Index{
+			Name:               "createdAt_1",
+			Keys:               []storage.IndexKey{{Field: "createdAt", Direction: 1}},
+			ExpireAfterSeconds: 3600,
+		}); err != nil {
+			t.Fatalf("创建 TTL 索引失败: %v", err)
+		}
+		return engine
+	}
+	remaining := func(engine *storage.MemoryEngine) []int32 {
+		t.Helper()
+		docs, err := engine.Find(ctx, "test", "sessions", storage.Document{})
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		ids := make([]int32, len(docs))
+		for i, doc := range docs {
+			ids[i] = doc["_id"].(int32)
+		}
+		return ids
+	}
+
+	t.Run("清理过期文档", func(t *testing.T) {
+		engine := newEngine(config.StorageConfig{Engine: "memory"})
+		n, err := engine.ExpireDocuments(ctx, now)
+		if err != nil || n != 2 {
+			t.Fatalf("应删除 2 个过期文档, got %d, %v", n, err)
+		}
+		if ids := remaining(engine); len(ids) != 3 || ids[0] != 2 || ids[1] != 3 || ids[2] != 4 {
+			t.Errorf("未过期、非日期和缺失字段的文档应保留: %v", ids)
+		}
+		stats, err := engine.CollectionStats(ctx, "test", "sessions")
+		if err != nil {
+			t.Fatalf("获取统计失败: %v", err)
+		}
+		if stats.IndexEntries["createdAt_1"] != 3 || stats.IndexEntries[storage.IdIndexName] != 3 {
+			t.Errorf("过期文档的索引条目应一并删除: %v", stats.IndexEntries)
+		}
+	})
+
+	t.Run("后台清理", func(t *testing.T) {
+		engine := newEngine(config.StorageConfig{Engine: "memory", TTLMonitorSecs: 1})
+		if err := engine.Start(); err != nil {
+			t.Fatalf("启动引擎失败: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(remaining(engine)) != 3 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if ids := remaining(engine); len(ids) != 3 {
+			t.Errorf("后台清理后应剩 3 个文档: %v", ids)
+		}
+		if err := engine.Stop(); err != nil {
+			t.Fatalf("停止引擎失败: %v", err)
+		}
+	})
+
+	t.Run("非法定义", func(t *testing.T) {
+		engine := newEngine(config.StorageConfig{Engine: "memory"})
+		invalid := []storage.Index{
+			{Name: "a_1_b_1", Keys: []storage.IndexKey{{Field: "a", Direction: 1}, {Field: "b", Direction: 1}}, ExpireAfterSeconds: 10},
+			{Name: "id_ttl", Keys: []storage.IndexKey{{Field: "_id", Direction: 1}}, ExpireAfterSeconds: 10},
+			{Name: "a_1", Keys: []storage.IndexKey{{Field: "a", Direction: 1}}, ExpireAfterSeconds: -1},
+		}
+		for _, index := range invalid {
+			if err := engine.CreateIndex(ctx, "test", "sessions", index); !errors.Is(err, storage.ErrBadValue) {
+				t.Errorf("%s 应返回 ErrBadValue: %v", index.Name, err)
+			}
+		}
+		if err := engine.CreateCappedCollection(ctx, "test", "capped", 1<<20, 0); err != nil {
+			t.Fatalf("创建固定集合失败: %v", err)
+		}
+		err := engine.CreateIndex(ctx, "test", "capped", storage.Index{
+			Name: "t_1", Keys: []storage.IndexKey{{Field: "t", Direction: 1}}, ExpireAfterSeconds: 10,
+		})
+		if !errors.Is(err, storage.ErrIllegalOperation) {
+			t.Errorf("固定集合上不能创建 TTL 索引: %v", err)
+		}
+	})
+}
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApplyUpdate 将更新文档应用到文档上，返回更新后的新文档，原文档不被修改
+// 更新文档全部为操作符时按 $set/$unset/$inc/$currentDate/$min/$max 以及数组操作符 $push/$addToSet/$pop/$pull/$pullAll 处理，
+// 否则视为替换文档
+// $setOnInsert 只在 upsert 插入新文档时生效，更新已有文档时忽略，见 UpsertDocument
+// 没有查询条件和 arrayFilters，路径中只能使用 $[] 位置操作符，见 ApplyPositionalUpdate
+func ApplyUpdate(doc, update Document) (Document, error) {
+	return ApplyPositionalUpdate(doc, update, nil, nil)
+}
+
+// ApplyPositionalUpdate 应用可能含位置操作符的更新文档
+// filter 为选中文档的查询条件，用于确定 $ 对应的数组元素；arrayFilters 为 $[<identifier>] 的过滤条件
+func ApplyPositionalUpdate(doc, update, filter Document, arrayFilters []Document) (Document, error) {
+	pos, err := newPositionalUpdate(filter, update, arrayFilters)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	result, err := applyUpdate(doc, update, pos, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	return result, nil
+}
+
+// applyUpdate 应用更新文档，路径中的位置操作符按原文档展开为具体路径
+// inserting 为 true 表示构造 upsert 插入的新文档，此时 $setOnInsert 按 $set 处理
+func applyUpdate(doc, update Document, pos *positionalUpdate, inserting bool) (Document, error) {
+	operators := 0
+	for key := range update {
+		if strings.HasPrefix(key, "$") {
+			operators++
+		}
+	}
+	if operators > 0 && operators != len(update) {
+		return nil, fmt.Errorf("更新文档不能混用操作符和普通字段")
+	}
+
+	if operators == 0 {
+		return replaceDocument(doc, update)
+	}
+
+	// 同一次更新中的所有 $currentDate 字段使用相同的时间
+	now := time.Now()
+	result := cloneDocument(doc)
+	for _, op := range sortedKeys(update) {
+		fields := toDocument(update[op])
+		if fields == nil {
+			return nil, fmt.Errorf("%s 的参数必须是文档", op)
+		}
+		if op == "$setOnInsert" && !inserting {
+			continue
+		}
+		for _, path := range sortedKeys(fields) {
+			if path == "_id" && op != "$set" && op != "$setOnInsert" {
+				return nil, fmt.Errorf("不允许修改 _id 字段")
+			}
+			operand := fields[path]
+			if op == "$currentDate" {
+				var err error
+				if operand, err = currentDate(operand, now); err != nil {
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+			}
+			paths, err := pos.expandPaths(doc, strings.Split(path, "."))
+			if err != nil {
+				return nil, err
+			}
+			for _, parts := range paths {
+				if err := applyOperator(result, op, strings.Join(parts, "."), operand); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if id, ok := doc["_id"]; ok && !valuesEqual(id, result["_id"]) {
+		return nil, fmt.Errorf("不允许修改 _id 字段")
+	}
+	return result, nil
+}
+
+// isOperatorUpdate 判断更新文档是否为操作符更新，否则为替换文档
+func isOperatorUpdate(update Document) bool {
+	for key := range update {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceDocument 用替换文档整体替换，保留原 _id
+func replaceDocument(doc, replacement Document) (Document, error) {
+	for key := range replacement {
+		if strings.Contains(key, ".") {
+			return nil, fmt.Errorf("替换文档的字段名不能包含点号: %s", key)
+		}
+	}
+	id, hasId := doc["_id"]
+	if newId, ok := replacement["_id"]; ok && hasId && !valuesEqual(id, newId) {
+		return nil, fmt.Errorf("不允许修改 _id 字段")
+	}
+
+	result := cloneDocument(replacement)
+	if hasId {
+		result["_id"] = id
+	}
+	return result, nil
+}
+
+// UpsertDocument 构造 upsert 没有匹配文档时插入的新文档
+// 操作符更新以过滤条件中的顶层等值字段为基础应用更新，$setOnInsert 只在这里生效；替换更新使用替换文档，只继承过滤条件中的 _id
+// 结果中没有 _id 时生成新的 ObjectId
+func UpsertDocument(filter, update Document) (Document, error) {
+	pos, err := newPositionalUpdate(filter, update, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	return upsertDocument(filter, update, pos)
+}
+
+// upsertDocument 构造 upsert 插入的新文档，pos 为已检查的位置操作符条件
+func upsertDocument(filter, update Document, pos *positionalUpdate) (Document, error) {
+	base, err := equalityFields(filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	if !isOperatorUpdate(update) {
+		seed := Document{}
+		if id, ok := base["_id"]; ok {
+			seed["_id"] = id
+		}
+		base = seed
+	}
+
+	doc, err := applyUpdate(base, update, pos, true)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadValue, err)
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = NewObjectID()
+	}
+	return doc, nil
+}
+
+// equalityFields 收集过滤条件中的顶层等值条件，包括普通值和 {$eq: v}
+// 点号路径按嵌套文档展开，顶层操作符和其他比较条件忽略
+func equalityFields(filter Document) (Document, error) {
+	doc := Document{}
+	for _, path := range sortedKeys(filter) {
+		if strings.HasPrefix(path, "$") {
+			continue
+		}
+		value := filter[path]
+		ops, isOps, err := operatorDocument(value)
+		if err != nil {
+			return nil, err
+		}
+		if isOps {
+			eq, ok := ops["$eq"]
+			if !ok {
+				continue
+			}
+			value = eq
+		}
+		if err := setPath(doc, strings.Split(path, "."), cloneValue(value)); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// applyOperator 对单个字段路径应用更新操作符
+func applyOperator(doc Document, op, path string, operand interface{}) error {
+	parts := strings.Split(path, ".")
+	switch op {
+	case "$set", "$setOnInsert", "$currentDate":
+		// $currentDate 的参数已由 currentDate 转换为当前时间
+		return setPath(doc, parts, operand)
+	case "$unset":
+		unsetPath(doc, parts)
+		return nil
+	case "$inc":
+		if !isNumber(operand) {
+			return fmt.Errorf("$inc 的参数必须是数值: %s", path)
+		}
+		current := lookupPath(doc, parts)
+		if len(current) == 0 {
+			return setPath(doc, parts, operand)
+		}
+		if !isNumber(current[0]) {
+			return fmt.Errorf("无法对非数值字段执行 $inc: %s", path)
+		}
+		return setPath(doc, parts, addNumbers(current[0], operand))
+	case "$min", "$max":
+		// 字段不存在时直接设置，否则按 BSON 比较顺序只在新值更小（$min）或更大（$max）时替换
+		current := lookupPath(doc, parts)
+		if len(current) > 0 {
+			cmp := CompareValues(operand, current[0])
+			if (op == "$min" && cmp >= 0) || (op == "$max" && cmp <= 0) {
+				return nil
+			}
+		}
+		return setPath(doc, parts, operand)
+	case "$push", "$addToSet", "$pop", "$pull", "$pullAll":
+		return applyArrayOperator(doc, op, parts, operand)
+	default:
+		return fmt.Errorf("未知的更新操作符: %s", op)
+	}
+}
+
+// currentDate 将 $currentDate 的参数转换为字段的新值
+// 参数为 true 或 {$type: "date"} 时为日期，{$type: "timestamp"} 时为以秒为单位的时间戳
+func currentDate(operand interface{}, now time.Time) (interface{}, error) {
+	if b, ok := operand.(bool); ok {
+		if !b {
+			return nil, fmt.Errorf("$currentDate 的参数必须是 true 或 {$type: \"date\" | \"timestamp\"}")
+		}
+		return now.Truncate(time.Millisecond).UTC(), nil
+	}
+	spec := toDocument(operand)
+	if len(spec) != 1 {
+		return nil, fmt.Errorf("$currentDate 的参数必须是 true 或 {$type: \"date\" | \"timestamp\"}")
+	}
+	switch spec["$type"] {
+	case "date":
+		return now.Truncate(time.Millisecond).UTC(), nil
+	case "timestamp":
+		return Timestamp{T: uint32(now.Unix()), I: 1}, nil
+	}
+	return nil, fmt.Errorf("$currentDate 的 $type 必须是 \"date\" 或 \"timestamp\": %v", spec["$type"])
+}
+
+// setPath 按点号路径设置字段值，中间缺失的文档自动创建
+func setPath(doc Document, parts []string, value interface{}) error {
+	if len(parts) == 1 {
+		doc[parts[0]] = value
+		return nil
+	}
+
+	child, ok := doc[parts[0]]
+	if !ok || child == nil {
+		next := Document{}
+		doc[parts[0]] = next
+		return setPath(next, parts[1:], value)
+	}
+	if next := toDocument(child); next != nil {
+		return setPath(next, parts[1:], value)
+	}
+	if arr := toArray(child); arr != nil {
+		updated, err := setArrayPath(arr, parts[1:], value)
+		if err != nil {
+			return err
+		}
+		doc[parts[0]] = updated
+		return nil
+	}
+	return fmt.Errorf("无法在非文档字段 %s 上创建子字段", parts[0])
+}
+
+// setArrayPath 按数字下标设置数组元素，下标超出长度时用 null 补齐
+func setArrayPath(arr []interface{}, parts []string, value interface{}) ([]interface{}, error) {
+	idx, err := strconv.Atoi(parts[0])
+	if err != nil || idx < 0 {
+		return nil, fmt.Errorf("无法在数组上使用字段名 %s", parts[0])
+	}
+	for len(arr) <= idx {
+		arr = append(arr, nil)
+	}
+	if len(parts) == 1 {
+		arr[idx] = value
+		return arr, nil
+	}
+
+	if arr[idx] == nil {
+		arr[idx] = Document{}
+	}
+	next := toDocument(arr[idx])
+	if next == nil {
+		return nil, fmt.Errorf("无法在非文档元素 %s 上创建子字段", parts[0])
+	}
+	return arr, setPath(next, parts[1:], value)
+}
+
+// unsetPath 按点号路径删除字段，数组元素置为 null
+func unsetPath(doc Document, parts []string) {
+	child, ok := doc[parts[0]]
+	if !ok {
+		return
+	}
+	if len(parts) == 1 {
+		delete(doc, parts[0])
+		return
+	}
+	if next := toDocument(child); next != nil {
+		unsetPath(next, parts[1:])
+		return
+	}
+	arr := toArray(child)
+	idx, err := strconv.Atoi(parts[1])
+	if arr == nil || err != nil || idx < 0 || idx >= len(arr) {
+		return
+	}
+	if len(parts) == 2 {
+		arr[idx] = nil
+		return
+	}
+	if next := toDocument(arr[idx]); next != nil {
+		unsetPath(next, parts[2:])
+	}
+}
+
+// addNumbers 数值相加，整数运算保持整数类型
+func addNumbers(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case int32:
+		switch y := b.(type) {
+		case int32:
+			sum := int64(x) + int64(y)
+			if sum == int64(int32(sum)) {
+				return int32(sum)
+			}
+			return sum
+		case int64:
+			return int64(x) + y
+		case int:
+			return int64(x) + int64(y)
+		}
+	case int64:
+		switch y := b.(type) {
+		case int32:
+			return x + int64(y)
+		case int64:
+			return x + y
+		case int:
+			return x + int64(y)
+		}
+	case int:
+		switch y := b.(type) {
+		case int32:
+			return int64(x) + int64(y)
+		case int64:
+			return int64(x) + y
+		case int:
+			return int64(x) + int64(y)
+		}
+	}
+	return toFloat64(a) + toFloat64(b)
+}
+
+// diffDocuments 计算两个文档顶层字段的差异，以 {$set, $unset} 更新文档表示
+func diffDocuments(oldDoc, newDoc Document) Document {
+	set, unset := Document{}, Document{}
+	for key, value := range newDoc {
+		if old, ok := oldDoc[key]; !ok || !valuesEqual(old, value) {
+			set[key] = value
+		}
+	}
+	for key := range oldDoc {
+		if _, ok := newDoc[key]; !ok {
+			unset[key] = true
+		}
+	}
+
+	diff := Document{}
+	if len(set) > 0 {
+		diff["$set"] = set
+	}
+	if len(unset) > 0 {
+		diff["$unset"] = unset
+	}
+	return diff
+}
+
+// cloneDocument 深拷贝文档
+func cloneDocument(doc Document) Document {
+	result := make(Document, len(doc))
+	for key, value := range doc {
+		result[key] = cloneValue(value)
+	}
+	return result
+}
+
+func cloneValue(value interface{}) interface{} {
+	if doc := toDocument(value); doc != nil {
+		return cloneDocument(doc)
+	}
+	if arr := toArray(value); arr != nil {
+		copied := make([]interface{}, len(arr))
+		for i, elem := range arr {
+			copied[i] = cloneValue(elem)
+		}
+		return copied
+	}
+	switch b := value.(type) {
+	case []byte:
+		return append([]byte(nil), b...)
+	case Binary:
+		return Binary{Subtype: b.Subtype, Data: append([]byte(nil), b.Data...)}
+	}
+	return value
+}
@@ -0,0 +1,83 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestValidate 测试一致性检查发现索引缺少和多出的条目
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	docs := []storage.Document{
+		{"_id": int32(1), "tags": []interface{}{"a", "b"}},
+		{"_id": int32(2), "tags": "c"},
+		{"_id": int32(3)},
+	}
+	if err := engine.Insert(ctx, "test", "items", docs); err != nil {
+		t.Fatalf("插入失败: %v", err)
+	}
+	if err := engine.CreateIndex(ctx, "test", "items", storage.Index{
+		Name: "tags_1", Keys: []storage.IndexKey{{Field: "tags", Direction: 1}},
+	}); err != nil {
+		t.Fatalf("创建索引失败: %v", err)
+	}
+	if _, err := engine.Delete(ctx, "test", "items", storage.Document{"_id": int32(2)}, true); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	validate := func() (*storage.ValidateResults, storage.IndexValidation) {
+		t.Helper()
+		results, err := engine.Validate(ctx, "test", "items")
+		if err != nil {
+			t.Fatalf("检查失败: %v", err)
+		}
+		for _, index := range results.Indexes {
+			if index.Name == "tags_1" {
+				return results, index
+			}
+		}
+		t.Fatalf("缺少 tags_1 的检查结果: %+v", results)
+		return nil, storage.IndexValidation{}
+	}
+
+	results, tags := validate()
+	if !results.Valid() || results.NRecords != 2 || len(results.Indexes) != 2 || tags.Keys != 3 {
+		t.Fatalf("索引维护后应一致: %+v", results)
+	}
+
+	// 直接删除一个索引条目
+	idx := storage.CollectionIndex(engine.WiredTigerEngine, "test", "items", "tags_1")
+	cursor, err := idx.SeekRange(ctx, nil, nil)
+	if err != nil || !cursor.Next() {
+		t.Fatalf("读取索引条目失败: %v", err)
+	}
+	key, recordId := cursor.Key(), cursor.RecordId()
+	cursor.Close()
+	if err := idx.Remove(ctx, key, recordId); err != nil {
+		t.Fatalf("删除索引条目失败: %v", err)
+	}
+	results, tags = validate()
+	if results.Valid() || tags.MissingEntries != 1 || tags.ExtraEntries != 0 {
+		t.Errorf("应发现 1 个缺少的条目: %+v", tags)
+	}
+
+	// 插入指向不存在记录的条目
+	if err := idx.Insert(ctx, key, storage.NewRecordIdFromLong(1<<40)); err != nil {
+		t.Fatalf("插入索引条目失败: %v", err)
+	}
+	results, tags = validate()
+	if results.Valid() || tags.MissingEntries != 1 || tags.ExtraEntries != 1 || tags.Keys != 3 {
+		t.Errorf("应发现 1 个缺少和 1 个多出的条目: %+v", tags)
+	}
+
+	if _, err := engine.Validate(ctx, "test", "missing"); !errors.Is(err, storage.ErrNamespaceNotFound) {
+		t.Errorf("集合不存在时应返回 ErrNamespaceNotFound: %v", err)
+	}
+}
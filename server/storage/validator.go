@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zhukovaskychina/xmongodb/logger"
+)
+
+// 集合的文档校验级别
+const (
+	ValidationLevelOff      = "off"      // 不校验
+	ValidationLevelStrict   = "strict"   // 校验所有插入和更新，默认级别
+	ValidationLevelModerate = "moderate" // 校验所有插入，更新时只校验原来已满足规则的文档
+)
+
+// 文档不满足校验规则时的处理方式
+const (
+	ValidationActionError = "error" // 拒绝写入，默认方式
+	ValidationActionWarn  = "warn"  // 记录警告日志后照常写入
+)
+
+// ValidationOptions 集合的文档校验规则
+type ValidationOptions struct {
+	Validator Document // 与查询过滤条件的语法相同，另外支持顶层的 $jsonSchema；为空时不校验
+	Level     string   // 校验级别，为空时为 strict
+	Action    string   // 处理方式，为空时为 error
+}
+
+// normalize 填充默认值并检查校验级别、处理方式和校验规则是否合法
+func (opts ValidationOptions) normalize() (ValidationOptions, error) {
+	if opts.Level == "" {
+		opts.Level = ValidationLevelStrict
+	}
+	if opts.Action == "" {
+		opts.Action = ValidationActionError
+	}
+	switch opts.Level {
+	case ValidationLevelOff, ValidationLevelStrict, ValidationLevelModerate:
+	default:
+		return opts, fmt.Errorf("%w: 未知的校验级别 %s", ErrBadValue, opts.Level)
+	}
+	switch opts.Action {
+	case ValidationActionError, ValidationActionWarn:
+	default:
+		return opts, fmt.Errorf("%w: 未知的校验处理方式 %s", ErrBadValue, opts.Action)
+	}
+	if schema, ok := opts.Validator["$jsonSchema"]; ok {
+		if _, err := parseJSONSchema(schema); err != nil {
+			return opts, fmt.Errorf("%w: %v", ErrBadValue, err)
+		}
+	}
+	if _, err := Matches(Document{}, opts.Validator); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// Validate 检查校验级别、处理方式和校验规则是否合法，用于在创建集合之前检查
+func (opts ValidationOptions) Validate() error {
+	_, err := opts.normalize()
+	return err
+}
+
+// SetValidation 设置集合的文档校验规则
+// 规则只对之后的插入和更新生效，不检查集合中已有的文档
+func (e *WiredTigerEngine) SetValidation(ctx context.Context, database, collection string, opts ValidationOptions) error {
+	opts, err := opts.normalize()
+	if err != nil {
+		return err
+	}
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return fmt.Errorf("集合 %s 不存在: %w", makeNamespace(database, collection), ErrNamespaceNotFound)
+	}
+	e.checkpointMu.RLock()
+	defer e.checkpointMu.RUnlock()
+	if err := e.writeJournal(journalEntry{Op: journalSetValidation, Database: database, Collection: collection, Validation: opts}); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	coll.Validator = opts.Validator
+	coll.ValidationLevel = opts.Level
+	coll.ValidationAction = opts.Action
+	return nil
+}
+
+// CollectionValidation 返回集合的文档校验规则，没有设置时校验规则为空
+func (e *WiredTigerEngine) CollectionValidation(ctx context.Context, database, collection string) (ValidationOptions, error) {
+	coll := e.lookupCollection(database, collection)
+	if coll == nil {
+		return ValidationOptions{}, fmt.Errorf("集合 %s 不存在: %w", makeNamespace(database, collection), ErrNamespaceNotFound)
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	opts := ValidationOptions{Validator: coll.Validator, Level: coll.ValidationLevel, Action: coll.ValidationAction}
+	if opts.Level == "" {
+		opts.Level = ValidationLevelStrict
+	}
+	if opts.Action == "" {
+		opts.Action = ValidationActionError
+	}
+	return opts, nil
+}
+
+// checkValidation 按集合的校验规则检查写入的文档，oldDoc 为更新前的文档，插入时为 nil
+// 处理方式为 warn 时不满足规则的文档只记录日志
+func (e *WiredTigerEngine) checkValidation(coll *Collection, oldDoc, doc Document) error {
+	e.mu.RLock()
+	validator, level, action := coll.Validator, coll.ValidationLevel, coll.ValidationAction
+	e.mu.RUnlock()
+	if len(validator) == 0 || level == ValidationLevelOff {
+		return nil
+	}
+	if oldDoc != nil && level == ValidationLevelModerate {
+		// 原来就不满足规则的文档可以继续按任意方式更新
+		if ok, err := Matches(oldDoc, validator); err != nil || !ok {
+			return err
+		}
+	}
+
+	ok, err := Matches(doc, validator)
+	if err != nil || ok {
+		return err
+	}
+	if action == ValidationActionWarn {
+		logger.Warnf("集合 %s 中 _id 为 %v 的文档未通过校验", coll.Namespace, doc["_id"])
+		return nil
+	}
+	return fmt.Errorf("%w: 集合 %s 中 _id 为 %v 的文档", ErrDocumentValidation, coll.Namespace, doc["_id"])
+}
@@ -0,0 +1,172 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/server/storage"
+)
+
+// TestCollectionValidator 测试集合的校验规则在插入和更新时生效
+func TestCollectionValidator(t *testing.T) {
+	ctx := context.Background()
+	engine, err := storage.NewMemoryEngine(config.StorageConfig{Engine: "memory"})
+	if err != nil {
+		t.Fatalf("创建引擎失败: %v", err)
+	}
+	if err := engine.CreateDatabase(ctx, "test"); err != nil {
+		t.Fatalf("创建数据库失败: %v", err)
+	}
+	schema := storage.Document{"$jsonSchema": storage.Document{
+		"bsonType": "object",
+		"required": []interface{}{"name", "age"},
+		"properties": storage.Document{
+			"name": storage.Document{"bsonType": "string"},
+			"age":  storage.Document{"bsonType": "int", "minimum": int32(0)},
+		},
+	}}
+	newCollection := func(t *testing.T, name string, opts storage.ValidationOptions) {
+		t.Helper()
+		if err := engine.CreateCollection(ctx, "test", name); err != nil {
+			t.Fatalf("创建集合失败: %v", err)
+		}
+		opts.Validator = schema
+		if err := engine.SetValidation(ctx, "test", name, opts); err != nil {
+			t.Fatalf("设置校验规则失败: %v", err)
+		}
+	}
+	insert := func(name string, doc storage.Document) error {
+		return engine.Insert(ctx, "test", name, []storage.Document{doc})
+	}
+	set := func(name string, id int32, fields storage.Document) error {
+		_, err := engine.Update(ctx, "test", name, storage.Document{"_id": id},
+			storage.Document{"$set": fields}, storage.UpdateOptions{})
+		return err
+	}
+
+	t.Run("缺少必需字段", func(t *testing.T) {
+		newCollection(t, "required", storage.ValidationOptions{})
+		if err := insert("required", storage.Document{"_id": int32(1), "name": "a", "age": int32(1)}); err != nil {
+			t.Fatalf("插入满足规则的文档失败: %v", err)
+		}
+		err := insert("required", storage.Document{"_id": int32(2), "name": "b"})
+		if !errors.Is(err, storage.ErrDocumentValidation) {
+			t.Fatalf("缺少 age 的文档 err = %v, want ErrDocumentValidation", err)
+		}
+		docs, _ := engine.Find(ctx, "test", "required", storage.Document{})
+		if len(docs) != 1 {
+			t.Errorf("被拒绝的文档不应写入, 文档数 = %d", len(docs))
+		}
+	})
+
+	t.Run("类型不符", func(t *testing.T) {
+		newCollection(t, "types", storage.ValidationOptions{})
+		err := insert("types", storage.Document{"_id": int32(1), "name": int32(5), "age": int32(1)})
+		if !errors.Is(err, storage.ErrDocumentValidation) {
+			t.Fatalf("name 为数值的文档 err = %v, want ErrDocumentValidation", err)
+		}
+		if err := insert("types", storage.Document{"_id": int32(2), "name": "b", "age": int32(1)}); err != nil {
+			t.Fatalf("插入满足规则的文档失败: %v", err)
+		}
+		// 更新后的文档同样需要满足规则
+		if err := set("types", 2, storage.Document{"age": "old"}); !errors.Is(err, storage.ErrDocumentValidation) {
+			t.Fatalf("把 age 改为字符串 err = %v, want ErrDocumentValidation", err)
+		}
+		if err := set("types", 2, storage.Document{"age": int32(-1)}); !errors.Is(err, storage.ErrDocumentValidation) {
+			t.Fatalf("age 小于 minimum err = %v, want ErrDocumentValidation", err)
+		}
+		if err := set("types", 2, storage.Document{"age": int32(2)}); err != nil {
+			t.Fatalf("满足规则的更新失败: %v", err)
+		}
+	})
+
+	t.Run("moderate", func(t *testing.T) {
+		if err := insert("moderate", storage.Document{"_id": int32(1), "name": "legacy"}); err != nil {
+			t.Fatalf("插入失败: %v", err)
+		}
+		if err := engine.SetValidation(ctx, "test", "moderate", storage.ValidationOptions{
+			Validator: schema, Level: storage.ValidationLevelModerate,
+		}); err != nil {
+			t.Fatalf("设置校验规则失败: %v", err)
+		}
+		// 原来就不满足规则的文档可以继续更新
+		if err := set("moderate", 1, storage.Document{"name": int32(1)}); err != nil {
+			t.Errorf("更新不满足规则的旧文档失败: %v", err)
+		}
+		if err := insert("moderate", storage.Document{"_id": int32(2)}); !errors.Is(err, storage.ErrDocumentValidation) {
+			t.Errorf("moderate 级别仍然校验插入, err = %v", err)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		newCollection(t, "warn", storage.ValidationOptions{Action: storage.ValidationActionWarn})
+		if err := insert("warn", storage.Document{"_id": int32(1)}); err != nil {
+			t.Errorf("warn 方式不应拒绝写入: %v", err)
+		}
+	})
+
+	t.Run("非法规则", func(t *testing.T) {
+		for _, opts := range []storage.ValidationOptions{
+			{Validator: storage.Document{"$jsonSchema": storage.Document{"bsonType": "nope"}}},
+			{Validator: storage.Document{"$jsonSchema": storage.Document{"unknownKeyword": true}}},
+			{Validator: schema, Level: "sometimes"},
+			{Validator: schema, Action: "ignore"},
+		} {
+			if err := engine.SetValidation(ctx, "test", "warn", opts); !errors.Is(err, storage.ErrBadValue) {
+				t.Errorf("SetValidation(%v) err = %v, want ErrBadValue", opts, err)
+			}
+		}
+		if err := engine.SetValidation(ctx, "test", "missing", storage.ValidationOptions{Validator: schema}); !errors.Is(err, storage.ErrNamespaceNotFound) {
+			t.Errorf("集合不存在时 err = %v, want ErrNamespaceNotFound", err)
+		}
+	})
+}
+
+// TestJSONSchemaMatch 测试 $jsonSchema 作为查询条件时的匹配规则
+func TestJSONSchemaMatch(t *testing.T) {
+	doc := storage.Document{
+		"name": "alice",
+		"tags": []interface{}{"a", "b"},
+		"address": storage.Document{
+			"city": "paris",
+			"zip":  int32(75001),
+		},
+	}
+	tests := []struct {
+		schema storage.Document
+		want   bool
+	}{
+		{storage.Document{"required": []interface{}{"name", "tags"}}, true},
+		{storage.Document{"required": []interface{}{"email"}}, false},
+		{storage.Document{"properties": storage.Document{"name": storage.Document{"type": "string", "minLength": int32(3)}}}, true},
+		{storage.Document{"properties": storage.Document{"name": storage.Document{"maxLength": int32(3)}}}, false},
+		{storage.Document{"properties": storage.Document{"name": storage.Document{"pattern": "^a"}}}, true},
+		{storage.Document{"properties": storage.Document{"name": storage.Document{"enum": []interface{}{"bob"}}}}, false},
+		// bsonType 检查数组本身，不展开数组元素
+		{storage.Document{"properties": storage.Document{"tags": storage.Document{"bsonType": "string"}}}, false},
+		{storage.Document{"properties": storage.Document{"tags": storage.Document{"bsonType": "array", "items": storage.Document{"bsonType": "string"}}}}, true},
+		{storage.Document{"properties": storage.Document{"tags": storage.Document{"maxItems": int32(1)}}}, false},
+		{storage.Document{"properties": storage.Document{"address": storage.Document{
+			"required":   []interface{}{"zip"},
+			"properties": storage.Document{"zip": storage.Document{"bsonType": "number"}},
+		}}}, true},
+		{storage.Document{"properties": storage.Document{"address": storage.Document{
+			"properties": storage.Document{"zip": storage.Document{"bsonType": "string"}},
+		}}}, false},
+		{storage.Document{"properties": storage.Document{"name": storage.Document{}}, "additionalProperties": false}, false},
+		// 缺失的字段不检查类型
+		{storage.Document{"properties": storage.Document{"email": storage.Document{"bsonType": "string"}}}, true},
+	}
+	for _, tt := range tests {
+		got, err := storage.Matches(doc, storage.Document{"$jsonSchema": tt.schema})
+		if err != nil {
+			t.Errorf("Matches(%v) 失败: %v", tt.schema, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Matches(%v) = %v, want %v", tt.schema, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zhukovaskychina/xmongodb/config"
+	"github.com/zhukovaskychina/xmongodb/logger"
+)
+
+// SSL 模式，与 mongod 的 --sslMode 取值一致
+const (
+	SSLModeDisabled = "disabled"   // 仅明文
+	SSLModeAllow    = "allowSSL"   // 明文与 TLS 均可
+	SSLModePrefer   = "preferSSL"  // 明文与 TLS 均可
+	SSLModeRequire  = "requireSSL" // 仅 TLS
+)
+
+// tlsRecordTypeHandshake TLS 握手记录的首字节
+const tlsRecordTypeHandshake = 0x16
+
+// buildTLSConfig 根据安全配置构造 TLS 配置
+// PEM 密钥文件需同时包含证书和私钥；CA 文件可选，配置后用于校验客户端证书
+func buildTLSConfig(cfg config.SecurityConfig) (*tls.Config, error) {
+	if cfg.SSLPEMKeyFile == "" {
+		return nil, fmt.Errorf("SSL 模式 %s 需要配置 ssl_pem_key_file", cfg.SSLMode)
+	}
+
+	pemData, err := os.ReadFile(cfg.SSLPEMKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取 SSL PEM 密钥文件失败: %w", err)
+	}
+
+	certificate, err := tls.X509KeyPair(pemData, pemData)
+	if err != nil {
+		return nil, fmt.Errorf("解析 SSL PEM 密钥文件 %s 失败: %w", cfg.SSLPEMKeyFile, err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.SSLCAFile != "" {
+		caData, err := os.ReadFile(cfg.SSLCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取 SSL CA 文件失败: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("解析 SSL CA 文件 %s 失败: 未找到有效证书", cfg.SSLCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// staticTLSConfigBuilder 返回预先构造好的 TLS 配置，供 getty 使用
+type staticTLSConfigBuilder struct {
+	config *tls.Config
+}
+
+// BuildTlsConfig 实现 getty.TlsConfigBuilder
+func (b *staticTLSConfigBuilder) BuildTlsConfig() (*tls.Config, error) {
+	return b.config, nil
+}
+
+// sslSniffingProxy 同一端口同时接受明文和 TLS 连接
+// 通过窥探首字节区分两种连接，TLS 连接在此完成握手后，
+// 与明文连接一样转发给仅监听本地回环地址的 getty 服务。
+// getty 自行接受连接且只支持 *net.TCPConn 和 *tls.Conn，无法把窥探过的连接直接交给它，由此带来以下限制：
+//   - getty 看到的远端地址是代理的回环地址；代理按转发连接的本地地址记录客户端的真实地址，见 peerAddr
+//   - 每个连接的数据经代理多复制一次，allowSSL/preferSSL 模式的吞吐低于 disabled 和 requireSSL 模式
+//   - getty 看到的连接数不代表客户端连接数，max_connections 由代理按客户端连接计数限制
+//   - getty 看到的是回环连接，tcp_keep_alive 和 keep_alive_period 由代理设置在客户端连接上
+//   - TLS 在代理处终止，会话拿不到客户端证书，这两种模式下无法使用 x509 身份
+//
+// getty 因读超时或空闲回收关闭转发连接时，代理随之关闭客户端连接
+type sslSniffingProxy struct {
+	listener        net.Listener
+	backend         string
+	tlsConfig       *tls.Config
+	maxConns        int           // 同时转发的客户端连接数上限，0 表示不限制
+	keepAlive       bool          // 客户端连接是否开启 TCP keepalive
+	keepAlivePeriod time.Duration // keepalive 探测周期，0 时使用系统默认值
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	clients int                     // 正在转发的客户端连接数
+	peers   map[string]*proxiedPeer // 转发连接的本地地址 -> 客户端地址
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// proxiedPeer 转发连接对应的客户端地址，登记后关闭 ready
+type proxiedPeer struct {
+	addr  string
+	ready chan struct{}
+}
+
+// newSSLSniffingProxy 在 addr 上监听，调用 start 后开始接受连接
+// 客户端连接按 network 配置限制连接数并设置 TCP keepalive
+func newSSLSniffingProxy(addr string, tlsConfig *tls.Config, network config.NetworkConfig) (*sslSniffingProxy, error) {
+	var keepAlivePeriod time.Duration
+	if network.KeepAlivePeriod != "" {
+		period, err := time.ParseDuration(network.KeepAlivePeriod)
+		if err != nil || period < 0 {
+			return nil, fmt.Errorf("无效的 keep_alive_period 配置: %q", network.KeepAlivePeriod)
+		}
+		keepAlivePeriod = period
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("监听 %s 失败: %w", addr, err)
+	}
+
+	return &sslSniffingProxy{
+		listener:        listener,
+		tlsConfig:       tlsConfig,
+		maxConns:        network.MaxConnections,
+		keepAlive:       network.TCPKeepAlive,
+		keepAlivePeriod: keepAlivePeriod,
+		conns:           make(map[net.Conn]struct{}),
+		peers:           make(map[string]*proxiedPeer),
+	}, nil
+}
+
+// start 开始接受连接并转发到 backend
+func (p *sslSniffingProxy) start(backend string) {
+	p.backend = backend
+	p.wg.Add(1)
+	go p.serve()
+}
+
+// Addr 返回对外监听地址
+func (p *sslSniffingProxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// serve 接受连接
+func (p *sslSniffingProxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return
+			}
+			logger.Warnf("接受连接失败: %v", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if !p.track(conn) {
+			conn.Close()
+			return
+		}
+		if !p.admit() {
+			logger.Warnf("连接数已达上限 %d，拒绝来自 %s 的连接", p.maxConns, conn.RemoteAddr())
+			p.untrack(conn)
+			conn.Close()
+			continue
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(p.keepAlive)
+			if p.keepAlive && p.keepAlivePeriod > 0 {
+				tcpConn.SetKeepAlivePeriod(p.keepAlivePeriod)
+			}
+		}
+		p.wg.Add(1)
+		go p.handle(conn)
+	}
+}
+
+// admit 为新的客户端连接占用一个名额，达到 maxConns 时返回 false
+func (p *sslSniffingProxy) admit() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.maxConns > 0 && p.clients >= p.maxConns {
+		return false
+	}
+	p.clients++
+	return true
+}
+
+// release 客户端连接结束后释放名额
+func (p *sslSniffingProxy) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients--
+}
+
+// handle 识别连接类型并双向转发
+func (p *sslSniffingProxy) handle(conn net.Conn) {
+	defer p.wg.Done()
+	defer p.release()
+	defer p.untrack(conn)
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	header, err := reader.Peek(2)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var client net.Conn = &peekedConn{Conn: conn, reader: reader}
+	// TLS 记录以 0x16 开头，紧跟主版本号 0x03；
+	// 明文消息以小端序的消息长度开头，同时满足两者的长度不会是合法的首条消息
+	if header[0] == tlsRecordTypeHandshake && header[1] == 0x03 {
+		tlsConn := tls.Server(client, p.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warnf("TLS 握手失败 %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		client = tlsConn
+	}
+
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		logger.Errorf("连接内部服务失败: %v", err)
+		client.Close()
+		return
+	}
+
+	if !p.track(backend) {
+		client.Close()
+		backend.Close()
+		return
+	}
+	defer p.untrack(backend)
+	local := backend.LocalAddr().String()
+	p.setPeer(local, conn.RemoteAddr().String())
+	defer p.removePeer(local)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go pipe(backend, client)
+	go pipe(client, backend)
+	<-done
+	<-done
+}
+
+// track 记录活动连接，代理关闭后拒绝新连接
+func (p *sslSniffingProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+// untrack 移除活动连接
+func (p *sslSniffingProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+// peer 返回转发连接的登记项，不存在时创建；调用方需持有 p.mu
+func (p *sslSniffingProxy) peer(local string) *proxiedPeer {
+	entry, ok := p.peers[local]
+	if !ok {
+		entry = &proxiedPeer{ready: make(chan struct{})}
+		p.peers[local] = entry
+	}
+	return entry
+}
+
+// setPeer 登记转发连接对应的客户端地址
+func (p *sslSniffingProxy) setPeer(local, addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry := p.peer(local)
+	entry.addr = addr
+	close(entry.ready)
+}
+
+// removePeer 转发结束后移除登记
+func (p *sslSniffingProxy) removePeer(local string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peers, local)
+}
+
+// peerAddr 返回经代理转发的连接的客户端地址，local 为 getty 看到的远端地址
+// 代理连上内部服务后才登记地址，getty 可能先接受连接，此时等待登记，最多等待 timeout；
+// 登记紧随连接建立，通常不需要等待。不是经代理转发的连接返回 false
+func (p *sslSniffingProxy) peerAddr(local string, timeout time.Duration) (string, bool) {
+	p.mu.Lock()
+	entry := p.peer(local)
+	p.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-entry.ready:
+		return entry.addr, true
+	case <-timer.C:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		select {
+		case <-entry.ready:
+			return entry.addr, true
+		default:
+			if p.peers[local] == entry {
+				delete(p.peers, local)
+			}
+			return "", false
+		}
+	}
+}
+
+func (p *sslSniffingProxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Close 停止监听并断开所有连接
+func (p *sslSniffingProxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	err := p.listener.Close()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+// peekedConn 先读取已窥探缓冲的数据，再读取底层连接
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -12,7 +12,8 @@ import (
 )
 
 func main() {
-	fmt.Println("=== MongoDB 协议层与 Getty 集成测试 ===\n")
+	fmt.Println("=== MongoDB 协议层与 Getty 集成测试 ===")
+	fmt.Println()
 
 	// 等待服务器启动
 	time.Sleep(2 * time.Second)